@@ -0,0 +1,279 @@
+// Package acl authorizes clients in the proxy, before their statements reach
+// a backend: which users may connect to a listener, which databases and
+// backends (shards) a user may use, and which users are read-only, for whom
+// the proxy rejects writes.
+//
+// The rules complement the privileges of the backends, which still apply.
+// The read-only check allows the statements that read (SELECT without INTO a
+// table or file, SHOW, EXPLAIN without a write, transaction control and
+// session settings) and rejects all others, so statements it does not know
+// are rejected too.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrUserDenied is returned for users that may not connect
+	ErrUserDenied = errors.New("not allowed by the proxy")
+	// ErrDatabaseDenied is returned for databases and backends a user may
+	// not use
+	ErrDatabaseDenied = errors.New("not allowed by the proxy")
+	// ErrReadOnly is returned for writes of read-only users and to
+	// read-only databases
+	ErrReadOnly = errors.New("read-only in the proxy")
+)
+
+// Config holds the rules of a listener
+type Config struct {
+	AllowUsers    []string            // Users that may connect (empty = all)
+	DenyUsers     []string            // Users that may not connect
+	ReadOnlyUsers []string            // Users whose writes are rejected
+	Databases     map[string][]string // User -> databases and backends the user may use (no entry = all)
+	DBMap         map[string]string   // Database -> backend, for the backends of the allowed databases
+	Default       string              // Backend of databases not in DBMap
+}
+
+// Rules authorizes the clients of a listener. A nil Rules allows everything.
+type Rules struct {
+	allow    map[string]bool
+	deny     map[string]bool
+	readOnly map[string]bool
+	names    map[string]map[string]bool // User -> allowed databases and backends
+	shards   map[string]map[string]bool // User -> allowed backends, including those of the allowed databases
+}
+
+// New creates the rules of a listener
+func New(cfg Config) *Rules {
+	r := &Rules{
+		allow:    toSet(cfg.AllowUsers),
+		deny:     toSet(cfg.DenyUsers),
+		readOnly: toSet(cfg.ReadOnlyUsers),
+		names:    make(map[string]map[string]bool),
+		shards:   make(map[string]map[string]bool),
+	}
+	for user, names := range cfg.Databases {
+		r.names[user] = toSet(names)
+		r.shards[user] = toSet(names)
+		for _, name := range names {
+			if shard := cfg.DBMap[name]; shard != "" {
+				r.shards[user][shard] = true
+			} else if cfg.Default != "" {
+				r.shards[user][cfg.Default] = true
+			}
+		}
+	}
+	return r
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// CheckUser returns an error when a user may not connect
+func (r *Rules) CheckUser(user string) error {
+	if r == nil {
+		return nil
+	}
+	if r.deny[user] || (len(r.allow) > 0 && !r.allow[user]) {
+		return fmt.Errorf("access denied for user %q: %w", user, ErrUserDenied)
+	}
+	return nil
+}
+
+// CheckDatabase returns an error when a user may not use a database, where
+// "" (no database) is always allowed
+func (r *Rules) CheckDatabase(user, database string) error {
+	if r == nil || database == "" {
+		return nil
+	}
+	if names, ok := r.names[user]; ok && !names[database] {
+		return fmt.Errorf("access denied for user %q to database %q: %w", user, database, ErrDatabaseDenied)
+	}
+	return nil
+}
+
+// CheckShard returns an error when a user may not use a backend, which is
+// allowed when it is listed for the user or holds a listed database
+func (r *Rules) CheckShard(user, shard string) error {
+	if r == nil {
+		return nil
+	}
+	if shards, ok := r.shards[user]; ok && !shards[shard] {
+		return fmt.Errorf("access denied for user %q to backend %q: %w", user, shard, ErrDatabaseDenied)
+	}
+	return nil
+}
+
+// ReadOnly reports whether the writes of a user are rejected
+func (r *Rules) ReadOnly(user string) bool {
+	return r != nil && r.readOnly[user]
+}
+
+// CheckStatement returns an error when a read-only user sends a query that
+// may write
+func (r *Rules) CheckStatement(user, query string) error {
+	if !r.ReadOnly(user) || !Writes(query) {
+		return nil
+	}
+	return fmt.Errorf("cannot execute statement for user %q: %w", user, ErrReadOnly)
+}
+
+// CheckReadOnlyDatabase returns an error when a query that may write is sent
+// to a database that the proxy exposes read-only, such as a database on the
+// replicas of a backend
+func CheckReadOnlyDatabase(database, query string) error {
+	if !Writes(query) {
+		return nil
+	}
+	return fmt.Errorf("cannot execute statement in read-only database %q: %w", database, ErrReadOnly)
+}
+
+// readKeywords are the first keywords of the statements that read
+var readKeywords = map[string]bool{
+	"SELECT": true, "SHOW": true, "DESCRIBE": true, "DESC": true, "EXPLAIN": true, "WITH": true,
+	"VALUES": true, "TABLE": true, "HELP": true, "USE": true, "SET": true, "RESET": true,
+	"BEGIN": true, "START": true, "COMMIT": true, "ROLLBACK": true, "END": true, "ABORT": true,
+	"SAVEPOINT": true, "RELEASE": true, "DECLARE": true, "FETCH": true, "MOVE": true, "CLOSE": true,
+	"LISTEN": true, "UNLISTEN": true, "DISCARD": true, "DEALLOCATE": true,
+}
+
+var (
+	// writeKeywordRegex matches a write nested in a read, such as a
+	// data-modifying CTE or EXPLAIN ANALYZE DELETE
+	writeKeywordRegex = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|MERGE|REPLACE|UPSERT)\b`)
+	// selectIntoRegex matches SELECT INTO a table or file, but not into a
+	// variable
+	selectIntoRegex = regexp.MustCompile(`(?i)\bINTO\s+[^@\s]`)
+	// forLockRegex matches the locking clauses of a SELECT
+	forLockRegex = regexp.MustCompile(`(?i)\bFOR\s+(NO\s+KEY\s+)?UPDATE\b`)
+)
+
+// Writes reports whether a query may write, which is true when any of its
+// statements is not a known read. The quoting rules of MariaDB and
+// PostgreSQL differ, so the query is split by the rules of both, with and
+// without backslash escapes, and any split with a write counts.
+func Writes(query string) bool {
+	for _, backslash := range []bool{true, false} {
+		for _, dollar := range []bool{true, false} {
+			for _, stmt := range statements(query, backslash, dollar) {
+				if writes(stmt) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// writes reports whether a statement may write
+func writes(stmt string) bool {
+	fields := strings.Fields(stmt)
+	if len(fields) == 0 {
+		return false
+	}
+	keyword := strings.ToUpper(strings.TrimRight(fields[0], "("))
+	if !readKeywords[keyword] {
+		return true
+	}
+	switch keyword {
+	case "SELECT":
+		return selectIntoRegex.MatchString(stmt)
+	case "WITH", "EXPLAIN", "DESCRIBE", "DESC":
+		return writeKeywordRegex.MatchString(forLockRegex.ReplaceAllString(stmt, "")) || selectIntoRegex.MatchString(stmt)
+	}
+	return false
+}
+
+// statements splits a query on the semicolons outside quotes and removes the
+// content of strings and the comments, except for the content of executable
+// comments of MariaDB (/*! ... */). With backslash a backslash escapes the next
+// character in quotes, with dollar $tag$ quotes text up to the next $tag$.
+func statements(query string, backslash, dollar bool) []string {
+	var stmts []string
+	var sb strings.Builder
+	executable := false // In an executable comment
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			// Skip the quoted text, where a doubled quote escapes the quote.
+			// Identifiers are kept, strings become ''.
+			start := i
+			for i++; i < len(query); i++ {
+				if backslash && query[i] == '\\' && i+1 < len(query) {
+					i++
+				} else if query[i] == ch {
+					if i+1 < len(query) && query[i+1] == ch {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			if ch == '\'' {
+				sb.WriteString("''")
+			} else {
+				sb.WriteString(query[start:min(i+1, len(query))])
+			}
+		case dollar && ch == '$' && dollarTagRegex.MatchString(query[i:]):
+			tag := dollarTagRegex.FindString(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+			sb.WriteString("''")
+		case ch == '/' && (strings.HasPrefix(query[i:], "/*!") || strings.HasPrefix(query[i:], "/*M!")):
+			// The content of an executable comment is part of the query
+			i += strings.IndexByte(query[i:], '!')
+			for i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				i++
+			}
+			executable = true
+			sb.WriteByte(' ')
+		case ch == '*' && executable && strings.HasPrefix(query[i:], "*/"):
+			i++
+			executable = false
+			sb.WriteByte(' ')
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			sb.WriteByte(' ')
+		case ch == '-' && strings.HasPrefix(query[i:], "--") && (i+2 == len(query) || isSpace(query[i+2])):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			sb.WriteByte(' ')
+		case ch == ';':
+			stmts = append(stmts, sb.String())
+			sb.Reset()
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return append(stmts, sb.String())
+}
+
+// dollarTagRegex matches the opening $tag$ of a dollar quoted string
+var dollarTagRegex = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+func isSpace(ch byte) bool {
+	return ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r'
+}
@@ -0,0 +1,115 @@
+package acl
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRules_Users(t *testing.T) {
+	r := New(Config{AllowUsers: []string{"app", "report"}, DenyUsers: []string{"report"}})
+	if err := r.CheckUser("app"); err != nil {
+		t.Errorf("Expected app to be allowed, got %v", err)
+	}
+	for _, user := range []string{"report", "root"} {
+		if err := r.CheckUser(user); !errors.Is(err, ErrUserDenied) {
+			t.Errorf("Expected %s to be denied, got %v", user, err)
+		}
+	}
+	if err := New(Config{DenyUsers: []string{"root"}}).CheckUser("app"); err != nil {
+		t.Errorf("Expected users to be allowed without an allow list, got %v", err)
+	}
+
+	var none *Rules
+	if none.CheckUser("root") != nil || none.CheckDatabase("root", "shop") != nil || none.CheckStatement("root", "DROP TABLE t") != nil {
+		t.Error("Expected nil rules to allow everything")
+	}
+}
+
+func TestRules_Databases(t *testing.T) {
+	r := New(Config{
+		Databases: map[string][]string{"app": {"shop", "archive"}},
+		DBMap:     map[string]string{"shop": "shard1"},
+		Default:   "main",
+	})
+	tests := []struct {
+		user, database, shard string
+		allowed               bool
+	}{
+		{"app", "shop", "shard1", true},
+		{"app", "archive", "main", true},
+		{"app", "", "main", true},
+		{"app", "billing", "shard2", false},
+		{"other", "billing", "shard2", true},
+	}
+	for _, tt := range tests {
+		if err := r.CheckDatabase(tt.user, tt.database); (err == nil) != tt.allowed {
+			t.Errorf("CheckDatabase(%s, %s) = %v, expected allowed %v", tt.user, tt.database, err, tt.allowed)
+		}
+		if err := r.CheckShard(tt.user, tt.shard); (err == nil) != tt.allowed {
+			t.Errorf("CheckShard(%s, %s) = %v, expected allowed %v", tt.user, tt.shard, err, tt.allowed)
+		}
+	}
+	if err := r.CheckDatabase("app", "billing"); !errors.Is(err, ErrDatabaseDenied) {
+		t.Errorf("Expected ErrDatabaseDenied, got %v", err)
+	}
+}
+
+func TestRules_ReadOnly(t *testing.T) {
+	r := New(Config{ReadOnlyUsers: []string{"report"}})
+	if err := r.CheckStatement("report", "DELETE FROM users"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := r.CheckStatement("report", "SELECT * FROM users"); err != nil {
+		t.Errorf("Expected a read to be allowed, got %v", err)
+	}
+	if err := r.CheckStatement("app", "DELETE FROM users"); err != nil {
+		t.Errorf("Expected writes of other users to be allowed, got %v", err)
+	}
+	if err := CheckReadOnlyDatabase("shop_ro", "UPDATE users SET name = 'x'"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly for a read-only database, got %v", err)
+	}
+	if err := CheckReadOnlyDatabase("shop_ro", "BEGIN; SELECT * FROM users"); err != nil {
+		t.Errorf("Expected reads of a read-only database to be allowed, got %v", err)
+	}
+}
+
+func TestWrites(t *testing.T) {
+	tests := []struct {
+		query  string
+		writes bool
+	}{
+		{"SELECT * FROM users WHERE name = 'x'", false},
+		{"select id from users for update", false},
+		{"SELECT @a := 1 INTO @b", false},
+		{"SELECT 'insert into users' AS note", false},
+		{"  SHOW TABLES", false},
+		{"EXPLAIN SELECT 1", false},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", false},
+		{"BEGIN; SELECT 1; COMMIT", false},
+		{"SET NAMES utf8mb4", false},
+		{"SELECT /*!40001 SQL_NO_CACHE */ * FROM t", false},
+		{"-- comment\nSELECT 1", false},
+		{"SELECT 1;", false},
+		{"INSERT INTO users VALUES (1)", true},
+		{"update users set name = 'x'", true},
+		{"DROP TABLE users", true},
+		{"CALL cleanup()", true},
+		{"LOAD DATA LOCAL INFILE 'x' INTO TABLE t", true},
+		{"SELECT * INTO backup FROM users", true},
+		{"SELECT * FROM users INTO OUTFILE '/tmp/users'", true},
+		{"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d", true},
+		{"EXPLAIN ANALYZE DELETE FROM users", true},
+		{"SELECT 1; DELETE FROM users", true},
+		{"/* note */ DELETE FROM users", true},
+		{"SELECT 1 /*!; DELETE FROM users */", true},
+		{"SELECT 'a\\'; DELETE FROM users; -- '", true}, // PostgreSQL, no backslash escapes
+		{"SELECT $$'$$; DELETE FROM users; --'", true},  // PostgreSQL dollar quotes
+		{"SELECT a$b$ ; DELETE FROM users", true},       // MariaDB identifier with $
+		{"PREPARE s FROM 'DELETE FROM users'", true},
+	}
+	for _, tt := range tests {
+		if got := Writes(tt.query); got != tt.writes {
+			t.Errorf("Writes(%q) = %v, expected %v", tt.query, got, tt.writes)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+// Package admin provides runtime administration endpoints, served over HTTP
+// next to the metrics endpoint.
+//
+// Endpoints:
+//
+//	POST /admin/drain?protocol=mariadb&addr=10.0.0.2:3306&timeout=30s
+//	POST /admin/undrain?protocol=mariadb&addr=10.0.0.2:3306
+//	GET  /admin/cache/top?window=1h&k=20
+//	GET  /admin/overrides
+//	POST /admin/overrides?fingerprint=...&action=no_batch&ttl=1h
+//	DELETE /admin/overrides?fingerprint=...&action=no_batch
+//	GET  /admin/quotas?protocol=mariadb
+//	GET  /admin/history?protocol=mariadb&conn=1001
+//	GET  /admin/killswitches
+//	GET  /admin/slowqueries?protocol=mariadb
+//
+// Drain stops routing new queries to a replica, waits for its in-flight
+// queries and reports when it is drained, so it can be taken out for
+// maintenance without error spikes. Undrain puts it back into rotation.
+//
+// The cache report lists the queries that saved the most backend time
+// through caching within a sliding window (5m, 1h or 24h).
+//
+// Overrides disable the batch hint (no_batch) or ttl hint (no_cache) of the
+// queries with a fingerprint until they expire, see package override. Instead
+// of a fingerprint a query may be given, which is fingerprinted. The
+// no_batch overrides added by the batch bypass are listed with auto set.
+//
+// The quota report lists the budgets and resource usage of each database
+// (tenant) per protocol, including what was rejected because of the
+// budgets, see package quota.
+//
+// The history lists the open client connections of a protocol, or with a
+// conn parameter the last statements of one connection, see package history.
+//
+// The kill switches report lists whether each feature is enabled and the
+// audit trail of who toggled which switch, see package killswitch. Switches
+// are toggled with SET GLOBAL by admin users, not through this endpoint.
+//
+// The slow queries report lists the statements recorded in the slow query
+// log, of one protocol or of both without a protocol parameter, see package
+// slowlog.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/history"
+	"github.com/mevdschee/tqdbproxy/killswitch"
+	"github.com/mevdschee/tqdbproxy/override"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/quota"
+	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/slowlog"
+)
+
+// defaultDrainTimeout is used when the drain request has no timeout parameter
+const defaultDrainTimeout = 30 * time.Second
+
+// defaultTopK is the report size when the cache report has no k parameter
+const defaultTopK = 20
+
+// Server holds the state the admin endpoints operate on
+type Server struct {
+	mu        sync.RWMutex
+	pools     map[string]map[string]*replica.Pool // protocol -> backend name -> pool
+	stats     *cache.Stats
+	overrides *override.Set
+	switches  *killswitch.Switches
+	slowLog   *slowlog.Log
+	quotas    map[string]*quota.Quotas     // protocol -> budgets and usage per database
+	histories map[string]*history.Registry // protocol -> client connections
+}
+
+// New creates an admin server without any pools
+func New() *Server {
+	return &Server{
+		pools:     make(map[string]map[string]*replica.Pool),
+		quotas:    make(map[string]*quota.Quotas),
+		histories: make(map[string]*history.Registry),
+	}
+}
+
+// SetPools sets the backend pools of a protocol ("mariadb" or "postgres").
+// Call it again after a config reload.
+func (s *Server) SetPools(protocol string, pools map[string]*replica.Pool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pools[protocol] = pools
+}
+
+// SetCacheStats sets the cache statistics used by the cache report
+func (s *Server) SetCacheStats(stats *cache.Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = stats
+}
+
+// SetOverrides sets the runtime overrides managed by the overrides endpoint
+func (s *Server) SetOverrides(overrides *override.Set) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overrides = overrides
+}
+
+// SetKillSwitches sets the kill switches reported by the killswitches endpoint
+func (s *Server) SetKillSwitches(switches *killswitch.Switches) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.switches = switches
+}
+
+// SetSlowLog sets the slow query log reported by the slowqueries endpoint
+func (s *Server) SetSlowLog(slowLog *slowlog.Log) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slowLog = slowLog
+}
+
+// SetQuotas sets the budgets of a protocol ("mariadb" or "postgres"),
+// reported by the quotas endpoint
+func (s *Server) SetQuotas(protocol string, quotas *quota.Quotas) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas[protocol] = quotas
+}
+
+// SetHistories sets the client connections of a protocol ("mariadb" or
+// "postgres"), whose query history the history endpoint reports
+func (s *Server) SetHistories(protocol string, histories *history.Registry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.histories[protocol] = histories
+}
+
+// Handler returns the HTTP handler for the /admin/ endpoints
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/drain", s.handleDrain)
+	mux.HandleFunc("/admin/undrain", s.handleUndrain)
+	mux.HandleFunc("/admin/cache/top", s.handleCacheTop)
+	mux.HandleFunc("/admin/overrides", s.handleOverrides)
+	mux.HandleFunc("/admin/quotas", s.handleQuotas)
+	mux.HandleFunc("/admin/history", s.handleHistory)
+	mux.HandleFunc("/admin/killswitches", s.handleKillSwitches)
+	mux.HandleFunc("/admin/slowqueries", s.handleSlowQueries)
+	return mux
+}
+
+// matchingPools returns the pools of protocol that have addr as a replica
+func (s *Server) matchingPools(protocol, addr string) map[string]*replica.Pool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matches := make(map[string]*replica.Pool)
+	for name, pool := range s.pools[protocol] {
+		if pool.HasReplica(addr) {
+			matches[name] = pool
+		}
+	}
+	return matches
+}
+
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	pools, ok := s.requestPools(w, r)
+	if !ok {
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+
+	timeout := defaultDrainTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid timeout"})
+			return
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// Drain all pools concurrently, so no pool keeps routing to addr while
+	// we wait for another
+	var wg sync.WaitGroup
+	errs := make([]error, 0, len(pools))
+	var errMu sync.Mutex
+	for _, pool := range pools {
+		wg.Add(1)
+		go func(pool *replica.Pool) {
+			defer wg.Done()
+			if err := pool.Drain(ctx, addr); err != nil {
+				errMu.Lock()
+				errs = append(errs, err)
+				errMu.Unlock()
+			}
+		}(pool)
+	}
+	wg.Wait()
+
+	inFlight := 0
+	for _, pool := range pools {
+		inFlight += pool.InFlight(addr)
+	}
+	status, code := "drained", http.StatusOK
+	if len(errs) > 0 {
+		status, code = "draining", http.StatusGatewayTimeout
+	}
+	writeJSON(w, code, map[string]interface{}{
+		"status":    status,
+		"addr":      addr,
+		"pools":     poolNames(pools),
+		"in_flight": inFlight,
+	})
+}
+
+func (s *Server) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	pools, ok := s.requestPools(w, r)
+	if !ok {
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	for _, pool := range pools {
+		pool.Undrain(addr)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "active",
+		"addr":   addr,
+		"pools":  poolNames(pools),
+	})
+}
+
+func (s *Server) handleCacheTop(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	stats := s.stats
+	s.mu.RUnlock()
+	if stats == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "cache statistics not available"})
+		return
+	}
+
+	window := 5 * time.Minute
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid window"})
+			return
+		}
+		window = d
+	}
+	k := defaultTopK
+	if v := r.URL.Query().Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid k"})
+			return
+		}
+		k = n
+	}
+
+	top, err := stats.Top(window, k)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	queries := make([]map[string]interface{}, 0, len(top))
+	var saved time.Duration
+	for _, q := range top {
+		saved += q.Saved
+		queries = append(queries, map[string]interface{}{
+			"fingerprint": q.Fingerprint,
+			"hits":        q.Hits,
+			"misses":      q.Misses,
+			"avg_exec_ms": float64(q.AvgExec) / float64(time.Millisecond),
+			"saved_ms":    float64(q.Saved) / float64(time.Millisecond),
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"window":   window.String(),
+		"saved_ms": float64(saved) / float64(time.Millisecond),
+		"queries":  queries,
+	})
+}
+
+func (s *Server) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	overrides := s.overrides
+	s.mu.RUnlock()
+	if overrides == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "overrides not available"})
+		return
+	}
+
+	q := r.URL.Query()
+	fingerprint := q.Get("fingerprint")
+	if fingerprint == "" && q.Get("query") != "" {
+		fingerprint = parser.Fingerprint(parser.Parse(q.Get("query")).Query)
+	}
+	action := q.Get("action")
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"overrides": overrides.List()})
+	case http.MethodPost:
+		ttl, err := time.ParseDuration(q.Get("ttl"))
+		if err != nil || ttl <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid ttl"})
+			return
+		}
+		rule, err := overrides.Add(fingerprint, action, ttl)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	case http.MethodDelete:
+		if !overrides.Remove(fingerprint, action) {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "no active override"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"fingerprint": fingerprint, "action": action, "status": "removed"})
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+	}
+}
+
+func (s *Server) handleKillSwitches(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	switches := s.switches
+	s.mu.RUnlock()
+	if switches == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "kill switches not available"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled": switches.States(),
+		"audit":   switches.Audit(),
+	})
+}
+
+func (s *Server) handleSlowQueries(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	slowLog := s.slowLog
+	s.mu.RUnlock()
+	if slowLog == nil {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "slow query log not available"})
+		return
+	}
+	entries := slowLog.Entries(r.URL.Query().Get("protocol"))
+	if entries == nil {
+		entries = []slowlog.Entry{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"queries": entries})
+}
+
+func (s *Server) handleQuotas(w http.ResponseWriter, r *http.Request) {
+	protocol := r.URL.Query().Get("protocol")
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if protocol != "" {
+		quotas, ok := s.quotas[protocol]
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "no quotas for protocol " + protocol})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{protocol: quotas.Usage()})
+		return
+	}
+	report := make(map[string]interface{}, len(s.quotas))
+	for protocol, quotas := range s.quotas {
+		report[protocol] = quotas.Usage()
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	protocol := r.URL.Query().Get("protocol")
+	s.mu.RLock()
+	histories, ok := s.histories[protocol]
+	s.mu.RUnlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "no history for protocol " + protocol})
+		return
+	}
+
+	v := r.URL.Query().Get("conn")
+	if v == "" {
+		conns := make([]map[string]interface{}, 0)
+		for _, c := range histories.List() {
+			conns = append(conns, map[string]interface{}{
+				"conn":       c.ID,
+				"addr":       c.Addr,
+				"user":       c.User,
+				"started":    c.Started,
+				"statements": len(c.History.Entries()),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"connections": conns})
+		return
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid conn"})
+		return
+	}
+	c, ok := histories.Get(uint32(id))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "no open connection " + v})
+		return
+	}
+	statements := make([]map[string]interface{}, 0)
+	for _, e := range c.History.Entries() {
+		statements = append(statements, map[string]interface{}{
+			"time":       e.Time,
+			"latency_ms": float64(e.Latency) / float64(time.Millisecond),
+			"backend":    e.Backend,
+			"query":      e.Query,
+			"error":      e.Error,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"conn":       c.ID,
+		"addr":       c.Addr,
+		"user":       c.User,
+		"started":    c.Started,
+		"statements": statements,
+	})
+}
+
+// requestPools validates a drain/undrain request and returns the pools it
+// applies to. It writes an error response and returns false when invalid.
+func (s *Server) requestPools(w http.ResponseWriter, r *http.Request) (map[string]*replica.Pool, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+		return nil, false
+	}
+	protocol := r.URL.Query().Get("protocol")
+	addr := r.URL.Query().Get("addr")
+	if protocol == "" || addr == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "protocol and addr are required"})
+		return nil, false
+	}
+	pools := s.matchingPools(protocol, addr)
+	if len(pools) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "no " + protocol + " pool has replica " + addr})
+		return nil, false
+	}
+	return pools, true
+}
+
+func poolNames(pools map[string]*replica.Pool) []string {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,261 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/history"
+	"github.com/mevdschee/tqdbproxy/override"
+	"github.com/mevdschee/tqdbproxy/quota"
+	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/slowlog"
+)
+
+func doRequest(t *testing.T, s *Server, method, url string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, url, nil)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return w.Code, body
+}
+
+func TestDrainAndUndrain(t *testing.T) {
+	pool := replica.NewPool("localhost:3306", []string{"localhost:3307", "localhost:3308"})
+	s := New()
+	s.SetPools("mariadb", map[string]*replica.Pool{"main": pool})
+
+	code, body := doRequest(t, s, http.MethodPost, "/admin/drain?protocol=mariadb&addr=localhost:3307")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	if body["status"] != "drained" {
+		t.Errorf("Expected status drained, got %v", body["status"])
+	}
+	if !pool.IsDraining("localhost:3307") {
+		t.Error("Expected replica to be draining")
+	}
+
+	code, body = doRequest(t, s, http.MethodPost, "/admin/undrain?protocol=mariadb&addr=localhost:3307")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	if pool.IsDraining("localhost:3307") {
+		t.Error("Expected replica to be back in rotation")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	pool := replica.NewPool("localhost:3306", []string{"localhost:3307"})
+	defer pool.Track("localhost:3307")()
+	s := New()
+	s.SetPools("postgres", map[string]*replica.Pool{"main": pool})
+
+	code, body := doRequest(t, s, http.MethodPost, "/admin/drain?protocol=postgres&addr=localhost:3307&timeout=20ms")
+	if code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected 504, got %d: %v", code, body)
+	}
+	if body["in_flight"] != float64(1) {
+		t.Errorf("Expected 1 in-flight query, got %v", body["in_flight"])
+	}
+}
+
+func TestDrainErrors(t *testing.T) {
+	s := New()
+	s.SetPools("mariadb", map[string]*replica.Pool{"main": replica.NewPool("localhost:3306", []string{"localhost:3307"})})
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{http.MethodGet, "/admin/drain?protocol=mariadb&addr=localhost:3307", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/drain?protocol=mariadb", http.StatusBadRequest},
+		{http.MethodPost, "/admin/drain?protocol=mariadb&addr=localhost:3307&timeout=x", http.StatusBadRequest},
+		{http.MethodPost, "/admin/drain?protocol=mariadb&addr=localhost:3306", http.StatusNotFound},
+		{http.MethodPost, "/admin/drain?protocol=postgres&addr=localhost:3307", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			if code, body := doRequest(t, s, tt.method, tt.url); code != tt.code {
+				t.Errorf("Expected %d, got %d: %v", tt.code, code, body)
+			}
+		})
+	}
+}
+
+func TestCacheTop(t *testing.T) {
+	stats := cache.NewStats(0)
+	stats.RecordMiss("SELECT * FROM users WHERE id = 1", 10*time.Millisecond)
+	stats.RecordHit("SELECT * FROM users WHERE id = 2")
+	stats.RecordHit("SELECT * FROM users WHERE id = 3")
+
+	s := New()
+	if code, _ := doRequest(t, s, http.MethodGet, "/admin/cache/top"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without cache statistics, got %d", code)
+	}
+	s.SetCacheStats(stats)
+
+	code, body := doRequest(t, s, http.MethodGet, "/admin/cache/top?window=1h&k=5")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	queries := body["queries"].([]interface{})
+	if len(queries) != 1 {
+		t.Fatalf("Expected 1 query, got %v", queries)
+	}
+	q := queries[0].(map[string]interface{})
+	if q["fingerprint"] != "SELECT * FROM users WHERE id = ?" || q["hits"] != float64(2) || q["saved_ms"] != float64(20) {
+		t.Errorf("Unexpected report entry: %v", q)
+	}
+
+	if code, _ := doRequest(t, s, http.MethodGet, "/admin/cache/top?window=2m"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for unsupported window, got %d", code)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	s := New()
+	if code, _ := doRequest(t, s, http.MethodGet, "/admin/overrides"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without overrides, got %d", code)
+	}
+	overrides := override.New()
+	s.SetOverrides(overrides)
+
+	code, body := doRequest(t, s, http.MethodPost, "/admin/overrides?query=%2F*+ttl%3A60+*%2F+SELECT+*+FROM+users+WHERE+id+%3D+1&action=no_cache&ttl=1h")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	if body["fingerprint"] != "SELECT * FROM users WHERE id = ?" {
+		t.Errorf("Unexpected fingerprint: %v", body["fingerprint"])
+	}
+
+	code, body = doRequest(t, s, http.MethodGet, "/admin/overrides")
+	if list := body["overrides"].([]interface{}); code != http.StatusOK || len(list) != 1 {
+		t.Fatalf("Expected 1 override, got %d: %v", code, body)
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+	}{
+		{http.MethodPost, "/admin/overrides?fingerprint=SELECT+1&action=no_cache&ttl=x", http.StatusBadRequest},
+		{http.MethodPost, "/admin/overrides?fingerprint=SELECT+1&action=never&ttl=1m", http.StatusBadRequest},
+		{http.MethodPut, "/admin/overrides", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/admin/overrides?fingerprint=SELECT+*+FROM+users+WHERE+id+%3D+%3F&action=no_cache", http.StatusOK},
+		{http.MethodDelete, "/admin/overrides?fingerprint=SELECT+*+FROM+users+WHERE+id+%3D+%3F&action=no_cache", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.url, func(t *testing.T) {
+			if code, body := doRequest(t, s, tt.method, tt.url); code != tt.code {
+				t.Errorf("Expected %d, got %d: %v", tt.code, code, body)
+			}
+		})
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	s := New()
+	q := quota.New(quota.Limits{QPS: 100}, nil)
+	q.Allow("app")
+	s.SetQuotas("mariadb", q)
+
+	code, body := doRequest(t, s, http.MethodGet, "/admin/quotas")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	usage, ok := body["mariadb"].([]interface{})
+	if !ok || len(usage) != 1 {
+		t.Fatalf("Expected the usage of 1 database, got %v", body)
+	}
+	app := usage[0].(map[string]interface{})
+	if app["database"] != "app" || app["queries"] != float64(1) {
+		t.Errorf("Unexpected usage: %v", app)
+	}
+	if limits := app["limits"].(map[string]interface{}); limits["qps"] != float64(100) {
+		t.Errorf("Unexpected limits: %v", limits)
+	}
+
+	if code, _ := doRequest(t, s, http.MethodGet, "/admin/quotas?protocol=postgres"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a protocol without quotas, got %d", code)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := New()
+	reg := history.NewRegistry()
+	ring := history.NewRing(5)
+	ring.Add(history.Entry{Time: time.Now(), Query: "SELECT 1", Latency: 2 * time.Millisecond, Backend: "cache"})
+	defer reg.Register(&history.Conn{ID: 1001, Addr: "127.0.0.1:50000", User: "app", Started: time.Now(), History: ring})()
+	s.SetHistories("mariadb", reg)
+
+	code, body := doRequest(t, s, http.MethodGet, "/admin/history?protocol=mariadb")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	conns := body["connections"].([]interface{})
+	if len(conns) != 1 || conns[0].(map[string]interface{})["conn"] != float64(1001) {
+		t.Fatalf("Expected connection 1001, got %v", body)
+	}
+
+	code, body = doRequest(t, s, http.MethodGet, "/admin/history?protocol=mariadb&conn=1001")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	statements := body["statements"].([]interface{})
+	if len(statements) != 1 {
+		t.Fatalf("Expected 1 statement, got %v", body)
+	}
+	if st := statements[0].(map[string]interface{}); st["query"] != "SELECT 1" || st["backend"] != "cache" || st["latency_ms"] != float64(2) {
+		t.Errorf("Unexpected statement: %v", st)
+	}
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/admin/history?protocol=postgres", http.StatusNotFound},
+		{"/admin/history?protocol=mariadb&conn=x", http.StatusBadRequest},
+		{"/admin/history?protocol=mariadb&conn=1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code, body := doRequest(t, s, http.MethodGet, tt.url); code != tt.code {
+			t.Errorf("%s: expected %d, got %d: %v", tt.url, tt.code, code, body)
+		}
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	s := New()
+	if code, _ := doRequest(t, s, http.MethodGet, "/admin/slowqueries"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a slow query log, got %d", code)
+	}
+	slowLog := slowlog.New()
+	slowLog.Configure(slowlog.Config{Threshold: time.Millisecond, Size: 10})
+	slowLog.Add(slowlog.Entry{Protocol: "mariadb", Query: "SELECT SLEEP(1)", Latency: time.Second, File: "report.go", Line: 12})
+	slowLog.Add(slowlog.Entry{Protocol: "postgres", Query: "SELECT pg_sleep(1)", Latency: time.Second})
+	s.SetSlowLog(slowLog)
+
+	code, body := doRequest(t, s, http.MethodGet, "/admin/slowqueries?protocol=mariadb")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %v", code, body)
+	}
+	queries := body["queries"].([]interface{})
+	if len(queries) != 1 {
+		t.Fatalf("Expected 1 slow query, got %v", body)
+	}
+	if q := queries[0].(map[string]interface{}); q["query"] != "SELECT SLEEP(1)" || q["latency_ms"] != float64(1000) || q["line"] != float64(12) {
+		t.Errorf("Unexpected slow query: %v", q)
+	}
+	if _, body := doRequest(t, s, http.MethodGet, "/admin/slowqueries"); len(body["queries"].([]interface{})) != 2 {
+		t.Errorf("Expected the slow queries of both protocols, got %v", body)
+	}
+}
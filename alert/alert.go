@@ -0,0 +1,224 @@
+// Package alert delivers notifications about critical conditions such as a
+// backend going down, write batches failing repeatedly, memory pressure or a
+// failed configuration reload.
+//
+// Events are sent as JSON to an optional webhook URL and/or passed to an
+// optional script on stdin, so small deployments without a full monitoring
+// stack still get notified. Delivery is asynchronous and never blocks the
+// proxy hot path; events are dropped (and logged) when the queue is full.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	BackendDown        = "backend_down"
+	BackendUp          = "backend_up"
+	Failover           = "failover"
+	BatchFailures      = "batch_failures"
+	MemoryPressure     = "memory_pressure"
+	ConfigReloadFailed = "config_reload_failed"
+)
+
+// Event is the JSON payload sent to webhooks and scripts
+type Event struct {
+	Type    string            `json:"type"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Config holds the alert delivery configuration
+type Config struct {
+	WebhookURL            string // URL that receives a JSON POST per event
+	Script                string // Script executed per event with the JSON on stdin
+	BatchFailureThreshold int    // Failed write batches per minute before alerting (0 = disabled)
+	MemoryThresholdMB     int    // Heap size in MB before alerting (0 = disabled)
+}
+
+const queueSize = 100
+
+type notifier struct {
+	cfg    Config
+	queue  chan Event
+	client *http.Client
+}
+
+var (
+	mu      sync.RWMutex
+	current *notifier
+
+	// Failed batch counting for the BatchFailures threshold
+	failMu      sync.Mutex
+	failWindow  time.Time
+	failCount   int
+	failAlerted bool
+)
+
+// Configure sets up alert delivery. It may be called again (e.g. on config
+// reload) to replace the configuration.
+func Configure(cfg Config) {
+	n := &notifier{
+		cfg:    cfg,
+		queue:  make(chan Event, queueSize),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	go n.run()
+
+	mu.Lock()
+	old := current
+	current = n
+	mu.Unlock()
+
+	if old != nil {
+		close(old.queue)
+	}
+}
+
+// Fire queues an event for delivery. It is a no-op when no webhook or script
+// is configured.
+func Fire(eventType, message string, fields map[string]string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	n := current
+	if n == nil || (n.cfg.WebhookURL == "" && n.cfg.Script == "") {
+		return
+	}
+
+	ev := Event{
+		Type:    eventType,
+		Message: message,
+		Time:    time.Now().UTC(),
+		Fields:  fields,
+	}
+	select {
+	case n.queue <- ev:
+	default:
+		log.Printf("[Alert] Queue full, dropping %s event: %s", eventType, message)
+	}
+}
+
+// BatchFailure records a failed write batch and fires a BatchFailures event
+// once the number of failures within a minute reaches the configured threshold.
+func BatchFailure(err error) {
+	mu.RLock()
+	threshold := 0
+	if current != nil {
+		threshold = current.cfg.BatchFailureThreshold
+	}
+	mu.RUnlock()
+	if threshold <= 0 {
+		return
+	}
+
+	failMu.Lock()
+	now := time.Now()
+	if now.Sub(failWindow) >= time.Minute {
+		failWindow = now
+		failCount = 0
+		failAlerted = false
+	}
+	failCount++
+	fire := failCount >= threshold && !failAlerted
+	if fire {
+		failAlerted = true
+	}
+	count := failCount
+	failMu.Unlock()
+
+	if fire {
+		Fire(BatchFailures, "write batch failures exceeded threshold", map[string]string{
+			"failures":   strconv.Itoa(count),
+			"threshold":  strconv.Itoa(threshold),
+			"last_error": err.Error(),
+		})
+	}
+}
+
+// StartMemoryMonitor periodically checks the heap size and fires a
+// MemoryPressure event when it crosses the configured threshold. It fires
+// again only after the heap has dropped below the threshold.
+func StartMemoryMonitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	above := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			mu.RLock()
+			thresholdMB := 0
+			if current != nil {
+				thresholdMB = current.cfg.MemoryThresholdMB
+			}
+			mu.RUnlock()
+			if thresholdMB <= 0 {
+				continue
+			}
+
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			heapMB := int(ms.HeapInuse / (1024 * 1024))
+			if heapMB >= thresholdMB && !above {
+				above = true
+				Fire(MemoryPressure, "heap size exceeded threshold", map[string]string{
+					"heap_mb":      strconv.Itoa(heapMB),
+					"threshold_mb": strconv.Itoa(thresholdMB),
+				})
+			} else if heapMB < thresholdMB {
+				above = false
+			}
+		}
+	}
+}
+
+func (n *notifier) run() {
+	for ev := range n.queue {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("[Alert] Failed to encode %s event: %v", ev.Type, err)
+			continue
+		}
+		if n.cfg.WebhookURL != "" {
+			n.postWebhook(ev, payload)
+		}
+		if n.cfg.Script != "" {
+			n.runScript(ev, payload)
+		}
+	}
+}
+
+func (n *notifier) postWebhook(ev Event, payload []byte) {
+	resp, err := n.client.Post(n.cfg.WebhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("[Alert] Webhook error for %s event: %v", ev.Type, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[Alert] Webhook returned status %d for %s event", resp.StatusCode, ev.Type)
+	}
+}
+
+func (n *notifier) runScript(ev Event, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.cfg.Script, ev.Type)
+	cmd.Stdin = bytes.NewReader(payload)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("[Alert] Script error for %s event: %v (%s)", ev.Type, err, bytes.TrimSpace(out))
+	}
+}
@@ -0,0 +1,94 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newWebhookServer(t *testing.T) (*httptest.Server, chan Event) {
+	events := make(chan Event, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			t.Errorf("Failed to decode webhook payload: %v", err)
+		}
+		events <- ev
+	}))
+	return srv, events
+}
+
+func TestFire_Webhook(t *testing.T) {
+	srv, events := newWebhookServer(t)
+	defer srv.Close()
+
+	Configure(Config{WebhookURL: srv.URL})
+	defer Configure(Config{})
+
+	Fire(BackendDown, "backend unreachable", map[string]string{"addr": "127.0.0.1:3306"})
+
+	select {
+	case ev := <-events:
+		if ev.Type != BackendDown {
+			t.Errorf("Expected type %s, got %s", BackendDown, ev.Type)
+		}
+		if ev.Fields["addr"] != "127.0.0.1:3306" {
+			t.Errorf("Expected addr field, got %v", ev.Fields)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Webhook was not called")
+	}
+}
+
+func TestFire_Unconfigured(t *testing.T) {
+	Configure(Config{})
+	// Must not block or panic
+	for i := 0; i < queueSize*2; i++ {
+		Fire(Failover, "no replicas", nil)
+	}
+}
+
+func TestBatchFailure_Threshold(t *testing.T) {
+	srv, events := newWebhookServer(t)
+	defer srv.Close()
+
+	Configure(Config{WebhookURL: srv.URL, BatchFailureThreshold: 3})
+	defer Configure(Config{})
+	failMu.Lock()
+	failWindow = time.Time{}
+	failMu.Unlock()
+
+	err := errors.New("deadlock detected")
+	BatchFailure(err)
+	BatchFailure(err)
+
+	select {
+	case ev := <-events:
+		t.Fatalf("Alert fired before threshold: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	BatchFailure(err)
+	BatchFailure(err) // Only one alert per window
+
+	select {
+	case ev := <-events:
+		if ev.Type != BatchFailures {
+			t.Errorf("Expected type %s, got %s", BatchFailures, ev.Type)
+		}
+		if ev.Fields["failures"] != "3" {
+			t.Errorf("Expected 3 failures, got %s", ev.Fields["failures"])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Batch failure alert was not fired")
+	}
+
+	select {
+	case ev := <-events:
+		t.Errorf("Duplicate alert fired: %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
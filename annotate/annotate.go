@@ -0,0 +1,89 @@
+// Package annotate prefixes the queries that the proxies send to their
+// backends with a comment identifying the proxy, the client connection and
+// the client user, so that pg_stat_activity, the processlist and server logs
+// can attribute load when several proxies front one database. The comment is
+// built from a format with placeholders:
+//
+//	{host}  hostname of the proxy
+//	{conn}  connection ID of the client
+//	{user}  user of the client
+//	{db}    database of the client
+//	{shard} backend (shard) the query is sent to
+//
+// Values are reduced to letters, digits and "_.-@", so that a client cannot
+// end the comment early. An Annotator with an empty format, or a nil
+// *Annotator, leaves queries unchanged.
+package annotate
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultFormat is a compact comment with the proxy identity
+const DefaultFormat = "/* tqdb h={host} c={conn} u={user} */"
+
+// Session identifies the client connection a query is sent for
+type Session struct {
+	ConnID   uint32
+	User     string
+	Database string
+	Shard    string
+}
+
+// Annotator prefixes queries with a comment
+type Annotator struct {
+	format atomic.Pointer[string]
+	host   string
+}
+
+// New creates an annotator with the given format (empty = disabled)
+func New(format string) *Annotator {
+	host, _ := os.Hostname()
+	a := &Annotator{host: sanitize(host)}
+	a.SetFormat(format)
+	return a
+}
+
+// SetFormat changes the format of the comment, e.g. on config reload
+func (a *Annotator) SetFormat(format string) {
+	if a == nil {
+		return
+	}
+	a.format.Store(&format)
+}
+
+// Annotate returns query prefixed with the comment for session s
+func (a *Annotator) Annotate(query string, s Session) string {
+	if a == nil {
+		return query
+	}
+	format := *a.format.Load()
+	if format == "" {
+		return query
+	}
+	comment := strings.NewReplacer(
+		"{host}", a.host,
+		"{conn}", strconv.FormatUint(uint64(s.ConnID), 10),
+		"{user}", sanitize(s.User),
+		"{db}", sanitize(s.Database),
+		"{shard}", sanitize(s.Shard),
+	).Replace(format)
+	return comment + " " + query
+}
+
+// sanitize replaces the characters of a value that could end or escape the
+// comment with underscores
+func sanitize(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("_.-@", r):
+			return r
+		}
+		return '_'
+	}, value)
+}
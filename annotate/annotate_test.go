@@ -0,0 +1,27 @@
+package annotate
+
+import "testing"
+
+func TestAnnotate(t *testing.T) {
+	a := New("/* tqdb c={conn} u={user} db={db} s={shard} */")
+	s := Session{ConnID: 123, User: "app1", Database: "shop", Shard: "main"}
+	want := "/* tqdb c=123 u=app1 db=shop s=main */ SELECT 1"
+	if got := a.Annotate("SELECT 1", s); got != want {
+		t.Errorf("Annotate() = %q, want %q", got, want)
+	}
+
+	// Values cannot end the comment
+	s.User = "x */ DROP TABLE users; /*"
+	want = "/* tqdb c=123 u=x____DROP_TABLE_users____ db=shop s=main */ SELECT 1"
+	if got := a.Annotate("SELECT 1", s); got != want {
+		t.Errorf("Annotate() = %q, want %q", got, want)
+	}
+
+	a.SetFormat("")
+	if got := a.Annotate("SELECT 1", s); got != "SELECT 1" {
+		t.Errorf("Expected an empty format to leave the query unchanged, got %q", got)
+	}
+	if got := (*Annotator)(nil).Annotate("SELECT 1", s); got != "SELECT 1" {
+		t.Errorf("Expected a nil annotator to leave the query unchanged, got %q", got)
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the API files")
+
+// packages are the packages whose exported API is recorded
+var packages = []string{"writebatch", "cache", "parser", "replica"}
+
+func TestAPI(t *testing.T) {
+	for _, pkg := range packages {
+		t.Run(pkg, func(t *testing.T) {
+			got, err := exported(filepath.Join("..", pkg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := pkg + ".txt"
+			if *update {
+				if err := os.WriteFile(file, []byte(strings.Join(got, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Split(strings.TrimSpace(string(data)), "\n")
+			for _, line := range want {
+				if !slices.Contains(got, line) {
+					t.Errorf("Removed or changed: %s (keep it as a deprecated wrapper until the next major version)", line)
+				}
+			}
+			for _, line := range got {
+				if !slices.Contains(want, line) {
+					t.Errorf("Added: %s (record it with go test ./api -update)", line)
+				}
+			}
+		})
+	}
+}
+
+func TestExported(t *testing.T) {
+	dir := t.TempDir()
+	src := `package p
+
+// Deprecated: Use New.
+func Old() {}
+func New(a, b int) (*T, error) { return nil, nil }
+func hidden() {}
+
+type T struct {
+	A    string
+	b    int
+	Clock
+}
+
+type Clock interface{ Now() int }
+
+func (t *T) Get(key string) []byte { return nil }
+func (t *T) get() {}
+
+const (
+	K Kind = iota
+	L
+)
+
+type Kind int
+
+var ErrX, errY error
+`
+	if err := os.WriteFile(filepath.Join(dir, "p.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := exported(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"const K Kind",
+		"const L Kind",
+		"field T.A string",
+		"field T.Clock",
+		"func New(a, b int) (*T, error)",
+		"func Old() (deprecated)",
+		"method (*T) Get(key string) []byte",
+		"method (Clock) Now() int",
+		"type Clock interface",
+		"type Kind int",
+		"type T struct",
+		"var ErrX error",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// exported returns the exported symbols of the package in dir, one sorted
+// line per symbol with its type or signature
+func exported(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	var lines []string
+	add := func(line string, doc ...*ast.CommentGroup) {
+		for _, d := range doc {
+			if d != nil && deprecated(d.Text()) {
+				line += " (deprecated)"
+				break
+			}
+		}
+		lines = append(lines, line)
+	}
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if !d.Name.IsExported() {
+					continue
+				}
+				signature := strings.TrimPrefix(node(fset, d.Type), "func")
+				if d.Recv == nil {
+					add("func "+d.Name.Name+signature, d.Doc)
+				} else if recv := d.Recv.List[0].Type; ast.IsExported(typeName(recv)) {
+					add("method ("+node(fset, recv)+") "+d.Name.Name+signature, d.Doc)
+				}
+			case *ast.GenDecl:
+				var constType ast.Expr // Type of the constants of an iota group
+				for _, spec := range d.Specs {
+					switch s := spec.(type) {
+					case *ast.TypeSpec:
+						if !s.Name.IsExported() {
+							continue
+						}
+						switch typ := s.Type.(type) {
+						case *ast.StructType:
+							add("type "+s.Name.Name+" struct", s.Doc, d.Doc)
+							for _, field := range typ.Fields.List {
+								if len(field.Names) == 0 && ast.IsExported(typeName(field.Type)) {
+									add("field "+s.Name.Name+"."+typeName(field.Type), field.Doc)
+								}
+								for _, name := range field.Names {
+									if name.IsExported() {
+										add("field "+s.Name.Name+"."+name.Name+" "+node(fset, field.Type), field.Doc)
+									}
+								}
+							}
+						case *ast.InterfaceType:
+							add("type "+s.Name.Name+" interface", s.Doc, d.Doc)
+							for _, method := range typ.Methods.List {
+								for _, name := range method.Names {
+									if name.IsExported() {
+										add("method ("+s.Name.Name+") "+name.Name+strings.TrimPrefix(node(fset, method.Type), "func"), method.Doc)
+									}
+								}
+							}
+						default:
+							assign := " "
+							if s.Assign.IsValid() {
+								assign = " = "
+							}
+							add("type "+s.Name.Name+assign+node(fset, s.Type), s.Doc, d.Doc)
+						}
+					case *ast.ValueSpec:
+						if s.Type != nil || len(s.Values) > 0 {
+							constType = s.Type
+						}
+						typ := s.Type
+						if d.Tok == token.CONST && typ == nil && len(s.Values) == 0 {
+							typ = constType
+						}
+						for _, name := range s.Names {
+							if !name.IsExported() {
+								continue
+							}
+							line := d.Tok.String() + " " + name.Name
+							if typ != nil {
+								line += " " + node(fset, typ)
+							}
+							add(line, s.Doc, d.Doc)
+						}
+					}
+				}
+			}
+		}
+	}
+	slices.Sort(lines)
+	return slices.Compact(lines), nil
+}
+
+// node prints a node of the syntax tree on one line
+func node(fset *token.FileSet, n ast.Node) string {
+	var b bytes.Buffer
+	printer.Fprint(&b, fset, n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// typeName returns the name of a (pointer to a, generic) named type
+func typeName(expr ast.Expr) string {
+	switch e := expr.(type) {
+	case *ast.StarExpr:
+		return typeName(e.X)
+	case *ast.IndexExpr:
+		return typeName(e.X)
+	case *ast.IndexListExpr:
+		return typeName(e.X)
+	case *ast.SelectorExpr:
+		return e.Sel.Name
+	case *ast.Ident:
+		return e.Name
+	}
+	return ""
+}
+
+// deprecated reports whether a doc comment has a Deprecated: paragraph
+func deprecated(doc string) bool {
+	return strings.HasPrefix(doc, "Deprecated: ") || strings.Contains(doc, "\n\nDeprecated: ")
+}
@@ -0,0 +1,10 @@
+// Package api records the exported API of the packages that are used as a
+// library outside of the proxy: writebatch, cache, parser and replica. Each
+// package has a file in this directory with one line per exported symbol,
+// and the test of this package fails when a symbol is added, changed or
+// removed without updating that file, see docs/API_STABILITY.md.
+//
+// After an intended addition, update the files with:
+//
+//	go test ./api -update
+package api
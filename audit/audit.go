@@ -0,0 +1,331 @@
+// Package audit records the statements of the clients for compliance: every
+// write, or with mode "all" every statement, with the time, client address,
+// user, database, normalized SQL and affected rows.
+//
+// The proxies hand the records to a buffered channel, so that auditing does
+// not block the hot path. A writer goroutine appends them in batches to a
+// file as JSON lines and/or inserts them into an audit table. When the buffer
+// is full the records are dropped and counted, unless block is set, in which
+// case the statement waits for the writer.
+package audit
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // Driver of audit tables in MariaDB
+	_ "github.com/lib/pq"              // Driver of audit tables in PostgreSQL
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// Modes of the audit log
+const (
+	ModeOff    = "off"
+	ModeWrites = "writes" // Writes and schema changes
+	ModeAll    = "all"
+)
+
+// maxBatch is the number of records written at once
+const maxBatch = 500
+
+// tableRegex matches the (possibly schema qualified) name of the audit table
+var tableRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Record is an audited statement
+type Record struct {
+	Time         time.Time `json:"time"`
+	Protocol     string    `json:"protocol"`
+	Client       string    `json:"client"` // Address of the client
+	User         string    `json:"user"`
+	Database     string    `json:"database"`
+	Query        string    `json:"query"`         // Normalized, literals replaced with ?
+	AffectedRows int64     `json:"affected_rows"` // -1 when unknown
+	Error        string    `json:"error,omitempty"`
+}
+
+// Config holds the settings of the audit log
+type Config struct {
+	Mode          string        // ModeOff, ModeWrites or ModeAll
+	File          string        // Append-only JSON lines file ("" = none)
+	Table         string        // Audit table ("" = none)
+	TableDriver   string        // "mysql" or "postgres"
+	TableDSN      string        // Data source name of the database holding the table
+	FlushInterval time.Duration // Maximum time a record waits in the buffer
+	Block         bool          // Wait for the writer when the buffer is full instead of dropping
+}
+
+// Log is the audit log. A nil Log records nothing.
+type Log struct {
+	mode    atomic.Value // string
+	block   atomic.Bool
+	records chan Record
+	dropped atomic.Int64 // Records dropped since the last flush
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu       sync.Mutex // Held while writing
+	config   Config
+	file     *os.File
+	fileBuf  *bufio.Writer
+	table    *sql.DB
+	interval time.Duration
+}
+
+// New creates an audit log with a buffer of bufferSize records, disabled
+// until it is configured
+func New(bufferSize int) *Log {
+	l := &Log{
+		records:  make(chan Record, max(bufferSize, 1)),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		interval: time.Second,
+	}
+	l.mode.Store(ModeOff)
+	return l
+}
+
+// Configure applies the settings. It can be called again on a config reload,
+// which reopens the file and the table when they changed.
+func (l *Log) Configure(cfg Config) error {
+	switch cfg.Mode {
+	case ModeOff, ModeWrites, ModeAll:
+	default:
+		return fmt.Errorf("invalid audit mode %q, expected off, writes or all", cfg.Mode)
+	}
+	if cfg.Table != "" && !tableRegex.MatchString(cfg.Table) {
+		return fmt.Errorf("invalid audit table %q", cfg.Table)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg.File != l.config.File || l.file == nil {
+		l.closeFile()
+		if cfg.File != "" {
+			f, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+			if err != nil {
+				return err
+			}
+			l.file, l.fileBuf = f, bufio.NewWriter(f)
+		}
+	}
+	if cfg.Table != l.config.Table || cfg.TableDriver != l.config.TableDriver || cfg.TableDSN != l.config.TableDSN || l.table == nil {
+		if l.table != nil {
+			l.table.Close()
+			l.table = nil
+		}
+		if cfg.Table != "" {
+			db, err := sql.Open(cfg.TableDriver, cfg.TableDSN)
+			if err != nil {
+				return err
+			}
+			l.table = db
+		}
+	}
+	if cfg.FlushInterval > 0 {
+		l.interval = cfg.FlushInterval
+	}
+	l.config = cfg
+	l.block.Store(cfg.Block)
+	l.mode.Store(cfg.Mode)
+	return nil
+}
+
+// Wants reports whether a statement is audited, where write is true for
+// writes and schema changes
+func (l *Log) Wants(write bool) bool {
+	if l == nil {
+		return false
+	}
+	switch l.mode.Load() {
+	case ModeAll:
+		return true
+	case ModeWrites:
+		return write
+	default:
+		return false
+	}
+}
+
+// Record hands a record to the writer
+func (l *Log) Record(r Record) {
+	if l == nil {
+		return
+	}
+	if l.block.Load() {
+		select {
+		case l.records <- r:
+		case <-l.stop:
+		}
+		return
+	}
+	select {
+	case l.records <- r:
+	default:
+		l.dropped.Add(1)
+		metrics.AuditRecords.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run writes the records in batches until Close is called
+func (l *Log) Run(ctx context.Context) {
+	defer close(l.done)
+	batch := make([]Record, 0, maxBatch)
+	timer := time.NewTimer(l.flushInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case r := <-l.records:
+			batch = append(batch, r)
+			if len(batch) < maxBatch {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(l.flushInterval())
+		case <-l.stop:
+			// Write what is buffered before stopping
+			for {
+				select {
+				case r := <-l.records:
+					batch = append(batch, r)
+					if len(batch) == maxBatch {
+						l.write(ctx, batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			l.write(ctx, batch)
+			return
+		}
+		l.write(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// Close stops Run after it wrote the buffered records, and closes the file
+// and the table
+func (l *Log) Close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closeFile()
+	if l.table != nil {
+		l.table.Close()
+		l.table = nil
+	}
+}
+
+func (l *Log) flushInterval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.interval
+}
+
+// write appends a batch to the file and inserts it into the table
+func (l *Log) write(ctx context.Context, batch []Record) {
+	if dropped := l.dropped.Swap(0); dropped > 0 {
+		log.Printf("[Audit] Buffer full, dropped %d records", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	written := true
+	if l.fileBuf != nil {
+		if err := l.writeFile(batch); err != nil {
+			log.Printf("[Audit] Failed to write %s: %v", l.config.File, err)
+			written = false
+		}
+	}
+	if l.table != nil {
+		if err := l.insert(ctx, batch); err != nil {
+			log.Printf("[Audit] Failed to insert into %s: %v", l.config.Table, err)
+			written = false
+		}
+	}
+	result := "written"
+	if !written {
+		result = "failed"
+	}
+	metrics.AuditRecords.WithLabelValues(result).Add(float64(len(batch)))
+}
+
+// writeFile appends records to the file and syncs it, with l.mu held
+func (l *Log) writeFile(batch []Record) error {
+	for _, r := range batch {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		l.fileBuf.Write(line)
+		l.fileBuf.WriteByte('\n')
+	}
+	if err := l.fileBuf.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// insert inserts records into the table with a single statement, with l.mu
+// held
+func (l *Log) insert(ctx context.Context, batch []Record) error {
+	query, args := insertStatement(l.config.Table, l.config.TableDriver == "postgres", batch)
+	_, err := l.table.ExecContext(ctx, query, args...)
+	return err
+}
+
+// insertStatement returns a multi-row INSERT of records into table, with
+// $n placeholders for PostgreSQL and ? otherwise
+func insertStatement(table string, dollar bool, batch []Record) (string, []any) {
+	const columns = 8
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO " + table + " (time, protocol, client, user_name, database_name, query, affected_rows, error) VALUES ")
+	args := make([]any, 0, len(batch)*columns)
+	for i, r := range batch {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('(')
+		for j := range columns {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			if dollar {
+				sb.WriteString("$" + strconv.Itoa(i*columns+j+1))
+			} else {
+				sb.WriteByte('?')
+			}
+		}
+		sb.WriteByte(')')
+		args = append(args, r.Time.UTC(), r.Protocol, r.Client, r.User, r.Database, r.Query, r.AffectedRows, r.Error)
+	}
+	return sb.String(), args
+}
+
+// closeFile flushes and closes the file, with l.mu held
+func (l *Log) closeFile() {
+	if l.file == nil {
+		return
+	}
+	l.fileBuf.Flush()
+	l.file.Close()
+	l.file, l.fileBuf = nil, nil
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog_Wants(t *testing.T) {
+	l := New(10)
+	if l.Wants(true) {
+		t.Error("Expected a new log to be disabled")
+	}
+	l.Configure(Config{Mode: ModeWrites})
+	if !l.Wants(true) || l.Wants(false) {
+		t.Error("Expected mode writes to audit only writes")
+	}
+	l.Configure(Config{Mode: ModeAll})
+	if !l.Wants(false) {
+		t.Error("Expected mode all to audit reads")
+	}
+	if err := l.Configure(Config{Mode: "some"}); err == nil {
+		t.Error("Expected an error for an invalid mode")
+	}
+	if err := l.Configure(Config{Mode: ModeAll, Table: "audit; DROP TABLE users"}); err == nil {
+		t.Error("Expected an error for an invalid table")
+	}
+
+	var none *Log
+	none.Record(Record{})
+	if none.Wants(true) {
+		t.Error("Expected a nil log to record nothing")
+	}
+}
+
+func TestLog_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	os.WriteFile(file, []byte("{}\n"), 0o600)
+	l := New(10)
+	if err := l.Configure(Config{Mode: ModeWrites, File: file, FlushInterval: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	go l.Run(context.Background())
+	l.Record(Record{Protocol: "mariadb", Client: "10.0.0.1:5000", User: "app", Database: "shop", Query: "UPDATE users SET name = ? WHERE id = ?", AffectedRows: 1})
+	l.Record(Record{Protocol: "postgres", Query: "DELETE FROM carts", AffectedRows: -1, Error: "permission denied"})
+	l.Close()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || lines[0] != "{}" {
+		t.Fatalf("Expected 2 records appended to the file, got %s", data)
+	}
+	var r Record
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Client != "10.0.0.1:5000" || r.User != "app" || r.Database != "shop" || r.AffectedRows != 1 {
+		t.Errorf("Expected the first record, got %+v", r)
+	}
+	if !strings.Contains(lines[2], `"error":"permission denied"`) {
+		t.Errorf("Expected the error in the second record, got %s", lines[2])
+	}
+}
+
+func TestLog_Dropped(t *testing.T) {
+	l := New(1)
+	l.Configure(Config{Mode: ModeAll})
+	l.Record(Record{Query: "SELECT 1"})
+	l.Record(Record{Query: "SELECT 2"})
+	if got := l.dropped.Load(); got != 1 {
+		t.Errorf("Expected a full buffer to drop 1 record, dropped %d", got)
+	}
+}
+
+func TestInsertStatement(t *testing.T) {
+	batch := []Record{{Query: "INSERT INTO t VALUES (?)"}, {Query: "DELETE FROM t"}}
+	query, args := insertStatement("audit_log", true, batch)
+	if !strings.HasPrefix(query, "INSERT INTO audit_log (time, protocol, client, user_name, database_name, query, affected_rows, error) VALUES ($1, ") ||
+		!strings.HasSuffix(query, "$15, $16)") || len(args) != 16 {
+		t.Errorf("Unexpected PostgreSQL insert %q with %d args", query, len(args))
+	}
+	query, _ = insertStatement("audit_log", false, batch[:1])
+	if !strings.HasSuffix(query, "VALUES (?, ?, ?, ?, ?, ?, ?, ?)") {
+		t.Errorf("Unexpected MariaDB insert %q", query)
+	}
+}
@@ -0,0 +1,303 @@
+// Package binlog follows the binary log of a MariaDB primary as a replication
+// client, to invalidate cached results of tables that change through writes
+// that do not pass the proxy, such as jobs or other applications.
+//
+// The listener registers with the primary under its own server ID and
+// requests the binlog from the current position. Row events (row based
+// replication) are mapped to their tables through the preceding table map
+// events, statements (statement based replication and DDL) are parsed for
+// their tables. Events arrive when their transaction commits, so a table is
+// invalidated after its change became visible. After a lost connection the
+// listener reconnects and continues where it left off; changes in between are
+// replayed, invalidating again.
+//
+// The account needs the REPLICATION SLAVE and REPLICATION CLIENT (BINLOG
+// MONITOR) privileges. Compressed query events are not decoded.
+//
+// https://mariadb.com/kb/en/2-binlog-event-header/
+package binlog
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+// Event types handled by the listener
+const (
+	queryEvent       = 2
+	rotateEvent      = 4
+	tableMapEvent    = 19
+	writeRowsV1      = 23
+	updateRowsV1     = 24
+	deleteRowsV1     = 25
+	writeRowsV2      = 30
+	updateRowsV2     = 31
+	deleteRowsV2     = 32
+	writeCompressed1 = 166 // MariaDB compressed row events
+	deleteCompressed = 171
+)
+
+// headerSize is the size of the event header
+const headerSize = 19
+
+// heartbeat is the interval of the heartbeat events the primary sends when
+// idle, a connection without events for three intervals is considered lost
+const heartbeat = 10 * time.Second
+
+// retryDelay is the delay between reconnects, set by tests
+var retryDelay = 5 * time.Second
+
+// Listener follows the binlog of one primary
+type Listener struct {
+	Name       string                                      // Backend name, for logging
+	ServerID   uint32                                      // Replication server ID, unique among the replicas of the primary
+	Dial       func(ctx context.Context) (net.Conn, error) // Connects and authenticates to the primary
+	Invalidate func(tables []string, ddl bool)             // Called with the lowercase names of changed tables
+
+	file     string            // Binlog file to continue from
+	pos      uint32            // Position in the binlog file
+	checksum bool              // Events end with a CRC32 checksum
+	tables   map[uint64]string // Table ID -> table name, from table map events
+}
+
+// Run follows the binlog until ctx is done, reconnecting after errors
+func (l *Listener) Run(ctx context.Context) {
+	for {
+		err := l.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[Binlog] Following %s failed, reconnecting: %v", l.Name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// follow connects to the primary and processes events until an error occurs
+func (l *Listener) follow(ctx context.Context) error {
+	conn, err := l.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	row, err := queryRow(conn, "SELECT @@global.binlog_checksum")
+	if err != nil {
+		return err
+	}
+	l.checksum = len(row) > 0 && !strings.EqualFold(string(row[0]), "NONE")
+	for _, query := range []string{
+		"SET @master_binlog_checksum = @@global.binlog_checksum",
+		"SET @mariadb_slave_capability = 4",
+		fmt.Sprintf("SET @master_heartbeat_period = %d", heartbeat.Nanoseconds()),
+	} {
+		if _, err := queryRow(conn, query); err != nil {
+			return err
+		}
+	}
+	if l.file == "" {
+		row, err := queryRow(conn, "SHOW MASTER STATUS")
+		if err != nil {
+			return err
+		}
+		if len(row) < 2 {
+			return errors.New("binary logging is disabled on the primary")
+		}
+		pos, err := strconv.ParseUint(string(row[1]), 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad binlog position %q: %v", row[1], err)
+		}
+		l.file, l.pos = string(row[0]), uint32(pos)
+	}
+
+	if err := command(conn, mariadbproto.ComRegisterSlave, registerSlave(l.ServerID)); err != nil {
+		return err
+	}
+	if _, err := readOK(conn); err != nil {
+		return err
+	}
+	if err := command(conn, mariadbproto.ComBinlogDump, binlogDump(l.file, l.pos, l.ServerID)); err != nil {
+		return err
+	}
+	log.Printf("[Binlog] Following %s from %s:%d", l.Name, l.file, l.pos)
+
+	l.tables = make(map[uint64]string)
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * heartbeat))
+		payload, _, err := mariadbproto.ReadPacket(conn)
+		if err != nil {
+			return err
+		}
+		switch {
+		case mariadbproto.IsErr(payload):
+			m, _ := mariadbproto.ParseErr(payload)
+			return m
+		case mariadbproto.IsEOF(payload):
+			return errors.New("binlog dump ended")
+		case len(payload) < 1+headerSize:
+			return mariadbproto.ErrShortPacket
+		}
+		event := payload[1:]
+		if l.checksum && len(event) >= headerSize+4 {
+			event = event[:len(event)-4]
+		}
+		l.handle(event)
+	}
+}
+
+// handle processes an event and advances the position
+func (l *Listener) handle(event []byte) {
+	eventType := event[4]
+	if next := binary.LittleEndian.Uint32(event[13:]); next > 0 {
+		l.pos = next
+	}
+	body := event[headerSize:]
+	switch {
+	case eventType == rotateEvent && len(body) >= 8:
+		l.file = string(body[8:])
+		l.pos = uint32(binary.LittleEndian.Uint64(body))
+	case eventType == tableMapEvent:
+		if id, table, ok := parseTableMap(body); ok {
+			l.tables[id] = table
+		}
+	case eventType >= writeRowsV1 && eventType <= deleteRowsV1,
+		eventType >= writeRowsV2 && eventType <= deleteRowsV2,
+		eventType >= writeCompressed1 && eventType <= deleteCompressed:
+		if len(body) < 6 {
+			return
+		}
+		if table, ok := l.tables[tableID(body)]; ok {
+			l.Invalidate([]string{table}, false)
+		}
+	case eventType == queryEvent:
+		query, ok := parseQuery(body)
+		if !ok {
+			return
+		}
+		parsed := parser.Parse(query)
+		if len(parsed.Tables) > 0 && (parsed.IsWritable() || parsed.IsDDL()) {
+			l.Invalidate(parsed.Tables, parsed.IsDDL())
+		}
+	}
+}
+
+// tableID reads the 6 byte table ID at the start of a table map or rows event
+func tableID(body []byte) uint64 {
+	var id [8]byte
+	copy(id[:], body[:6])
+	return binary.LittleEndian.Uint64(id[:])
+}
+
+// parseTableMap returns the table ID and lowercase table name of a table map
+// event: table ID (6), flags (2), database and table name, each as length (1),
+// name and a 0 byte
+func parseTableMap(body []byte) (uint64, string, bool) {
+	if len(body) < 9 {
+		return 0, "", false
+	}
+	pos := 8 + 1 + int(body[8]) + 1 // Skip the database name
+	if pos >= len(body) || pos+1+int(body[pos]) > len(body) {
+		return 0, "", false
+	}
+	return tableID(body), strings.ToLower(string(body[pos+1 : pos+1+int(body[pos])])), true
+}
+
+// parseQuery returns the statement of a query event: thread ID (4), execution
+// time (4), database name length (1), error code (2), status variables length
+// (2), status variables, database name, a 0 byte and the statement
+func parseQuery(body []byte) (string, bool) {
+	if len(body) < 13 {
+		return "", false
+	}
+	pos := 13 + int(binary.LittleEndian.Uint16(body[11:])) + int(body[8]) + 1
+	if pos > len(body) {
+		return "", false
+	}
+	return string(body[pos:]), true
+}
+
+// registerSlave returns the arguments of COM_REGISTER_SLAVE: server ID, empty
+// host, user and password, port, rank and primary ID
+func registerSlave(serverID uint32) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, serverID)
+	data = append(data, 0, 0, 0)
+	data = binary.LittleEndian.AppendUint16(data, 0)
+	data = binary.LittleEndian.AppendUint32(data, 0)
+	return binary.LittleEndian.AppendUint32(data, 0)
+}
+
+// binlogDump returns the arguments of COM_BINLOG_DUMP: position, flags,
+// server ID and file name
+func binlogDump(file string, pos, serverID uint32) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, pos)
+	data = binary.LittleEndian.AppendUint16(data, 0)
+	data = binary.LittleEndian.AppendUint32(data, serverID)
+	return append(data, file...)
+}
+
+// command sends a command packet
+func command(conn net.Conn, cmd byte, data []byte) error {
+	return mariadbproto.WritePacket(conn, 0, mariadbproto.Command(cmd, data))
+}
+
+// readOK reads the response to a command that returns an OK packet
+func readOK(conn net.Conn) ([]byte, error) {
+	payload, _, err := mariadbproto.ReadPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	if mariadbproto.IsErr(payload) {
+		m, _ := mariadbproto.ParseErr(payload)
+		return nil, m
+	}
+	return payload, nil
+}
+
+// queryRow executes a query and returns the first row of its result set, or
+// nil for a statement without result set or an empty result set
+func queryRow(conn net.Conn, query string) ([][]byte, error) {
+	if err := mariadbproto.WritePacket(conn, 0, mariadbproto.Query(query)); err != nil {
+		return nil, err
+	}
+	var packets [][]byte
+	var tracker mariadbproto.ResponseTracker
+	for {
+		payload, _, err := mariadbproto.ReadPacket(conn)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, payload)
+		if tracker.Done(payload) {
+			break
+		}
+	}
+	if mariadbproto.IsErr(packets[0]) {
+		m, _ := mariadbproto.ParseErr(packets[0])
+		return nil, m
+	}
+	if mariadbproto.IsOK(packets[0]) {
+		return nil, nil
+	}
+	columns, _, _ := mariadbproto.ReadLenEncInt(packets[0])
+	// Column count, column definitions and EOF precede the rows
+	rowAt := 1 + int(columns) + 1
+	if rowAt >= len(packets) || mariadbproto.IsEOF(packets[rowAt]) {
+		return nil, nil
+	}
+	return mariadbproto.ParseTextRow(packets[rowAt], int(columns))
+}
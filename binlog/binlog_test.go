@@ -0,0 +1,156 @@
+package binlog
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+)
+
+// event returns the packet payload of a binlog event with a CRC32 checksum
+// placeholder
+func event(eventType byte, nextPos uint32, body []byte) []byte {
+	header := make([]byte, headerSize)
+	header[4] = eventType
+	binary.LittleEndian.PutUint32(header[9:], uint32(headerSize+len(body)+4))
+	binary.LittleEndian.PutUint32(header[13:], nextPos)
+	payload := append([]byte{mariadbproto.OKHeader}, header...)
+	return append(append(payload, body...), 0, 0, 0, 0)
+}
+
+func tableMap(id uint64, db, table string) []byte {
+	body := binary.LittleEndian.AppendUint64(nil, id)[:6]
+	body = append(body, 0, 0, byte(len(db)))
+	body = append(append(body, db...), 0, byte(len(table)))
+	return append(append(body, table...), 0)
+}
+
+func queryEventBody(db, query string) []byte {
+	body := make([]byte, 13)
+	body[8] = byte(len(db))
+	return append(append(append(body, db...), 0), query...)
+}
+
+// fakePrimary answers the setup queries of a listener and sends events
+func fakePrimary(conn net.Conn, events [][]byte, dumps chan<- string) {
+	defer conn.Close()
+	for {
+		payload, _, err := mariadbproto.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch payload[0] {
+		case mariadbproto.ComQuery:
+			var response []byte
+			switch query := string(payload[1:]); {
+			case strings.HasPrefix(query, "SELECT"):
+				rs := mariadbproto.ResultSet{Columns: []mariadbproto.Column{{Name: "checksum"}}, Rows: [][][]byte{{[]byte("CRC32")}}}
+				response, _ = rs.AppendPackets(nil, 0)
+			case query == "SHOW MASTER STATUS":
+				rs := mariadbproto.ResultSet{Columns: []mariadbproto.Column{{Name: "File"}, {Name: "Position"}}, Rows: [][][]byte{{[]byte("bin.000007"), []byte("120")}}}
+				response, _ = rs.AppendPackets(nil, 0)
+			default:
+				response = mariadbproto.AppendPacket(nil, 1, mariadbproto.OK{}.Encode())
+			}
+			conn.Write(response)
+		case mariadbproto.ComRegisterSlave:
+			mariadbproto.WritePacket(conn, 1, mariadbproto.OK{}.Encode())
+		case mariadbproto.ComBinlogDump:
+			pos := binary.LittleEndian.Uint32(payload[1:])
+			select {
+			case dumps <- fmt.Sprintf("%s:%d", payload[11:], pos):
+			default:
+			}
+			for i, e := range events {
+				mariadbproto.WritePacket(conn, byte(i+1), e)
+			}
+			// The connection is lost after the events
+			return
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 10 * time.Millisecond
+
+	events := [][]byte{
+		event(tableMapEvent, 200, tableMap(42, "shop", "Orders")),
+		event(writeRowsV2, 250, binary.LittleEndian.AppendUint64(nil, 42)[:6]),
+		event(queryEvent, 300, queryEventBody("shop", "ALTER TABLE users ADD note TEXT")),
+		event(queryEvent, 350, queryEventBody("shop", "BEGIN")),
+		event(rotateEvent, 0, append(binary.LittleEndian.AppendUint64(nil, 4), "bin.000008"...)),
+	}
+
+	type change struct {
+		tables []string
+		ddl    bool
+	}
+	changes := make(chan change, 10)
+	dumps := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := &Listener{
+		Name:     "main",
+		ServerID: 1001,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go fakePrimary(server, events, dumps)
+			return client, nil
+		},
+		Invalidate: func(tables []string, ddl bool) {
+			select {
+			case changes <- change{tables, ddl}:
+			default:
+			}
+		},
+	}
+	go l.Run(ctx)
+
+	expect := func(want change) {
+		t.Helper()
+		select {
+		case got := <-changes:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %v, got nothing", want)
+		}
+	}
+	expectDump := func(want string) {
+		t.Helper()
+		select {
+		case got := <-dumps:
+			if got != want {
+				t.Errorf("Expected a binlog dump from %s, got %s", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected a binlog dump from %s, got none", want)
+		}
+	}
+	expectDump("bin.000007:120")
+	expect(change{[]string{"orders"}, false})
+	expect(change{[]string{"users"}, true})
+
+	// After the lost connection the listener continues from the rotated file,
+	// BEGIN did not invalidate anything
+	expectDump("bin.000008:4")
+	expect(change{[]string{"orders"}, false})
+}
+
+func TestParseTableMap(t *testing.T) {
+	id, table, ok := parseTableMap(tableMap(7, "shop", "Orders"))
+	if !ok || id != 7 || table != "orders" {
+		t.Errorf("Expected table 7 orders, got %d %q %v", id, table, ok)
+	}
+	if _, _, ok := parseTableMap([]byte{1, 0, 0, 0, 0, 0, 0, 0, 9, 'x'}); ok {
+		t.Error("Expected a truncated table map to be rejected")
+	}
+}
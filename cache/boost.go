@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// boostWindow is the time constant of the query rates measured by Booster:
+// a query that stops repeating loses its boost within a few windows
+const boostWindow = time.Second
+
+// defaultMaxBoosted bounds the memory used by Booster
+const defaultMaxBoosted = 10000
+
+// Booster micro-caches identical SELECTs without a ttl hint that repeat at a
+// high rate, such as dashboards and psql \watch loops. It measures the rate of
+// each query and returns a TTL that grows with it: from 0 at the configured
+// rate to the configured maximum at twice that rate. When the rate drops the
+// TTL backs off again. A Booster with a rate of 0, or a nil *Booster, boosts
+// nothing.
+type Booster struct {
+	mu        sync.Mutex
+	qps       float64       // Rate of a query at which its boost starts
+	maxTTL    time.Duration // TTL at twice that rate and above
+	entries   map[string]*boostEntry
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type boostEntry struct {
+	rate float64 // Executions per second, decayed over boostWindow
+	seen time.Time
+}
+
+// NewBooster creates a booster for queries repeating at qps or more per
+// second, with TTLs up to maxTTL
+func NewBooster(qps float64, maxTTL time.Duration) *Booster {
+	b := &Booster{entries: make(map[string]*boostEntry), now: time.Now}
+	b.SetLimits(qps, maxTTL)
+	return b
+}
+
+// SetLimits changes the rate at which queries are boosted and the maximum TTL
+func (b *Booster) SetLimits(qps float64, maxTTL time.Duration) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.qps = math.Max(0, qps)
+	b.maxTTL = max(0, maxTTL)
+	if b.qps == 0 || b.maxTTL == 0 {
+		clear(b.entries)
+	}
+}
+
+// Observe records an execution of query and returns the TTL to cache it with,
+// or 0 when it does not repeat often enough
+func (b *Booster) Observe(query string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.qps == 0 || b.maxTTL == 0 {
+		return 0
+	}
+	now := b.now()
+	b.prune(now)
+	e := b.entries[query]
+	if e == nil {
+		if len(b.entries) >= defaultMaxBoosted {
+			return 0
+		}
+		e = &boostEntry{seen: now}
+		b.entries[query] = e
+	}
+	decay := math.Exp(-now.Sub(e.seen).Seconds() / boostWindow.Seconds())
+	e.rate = e.rate*decay + 1/boostWindow.Seconds()
+	e.seen = now
+
+	boost := math.Min(1, e.rate/b.qps-1)
+	if boost <= 0 {
+		return 0
+	}
+	return time.Duration(boost * float64(b.maxTTL)).Truncate(time.Millisecond)
+}
+
+// prune drops the queries that stopped repeating, at most once per minute.
+// The caller holds b.mu.
+func (b *Booster) prune(now time.Time) {
+	if now.Sub(b.lastPrune) < time.Minute {
+		return
+	}
+	b.lastPrune = now
+	for query, e := range b.entries {
+		if now.Sub(e.seen) > 10*boostWindow {
+			delete(b.entries, query)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBooster(t *testing.T) {
+	b := NewBooster(10, time.Second)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	// observe executes query at the given rate for a second
+	observe := func(query string, qps int) time.Duration {
+		var ttl time.Duration
+		for i := 0; i < qps; i++ {
+			now = now.Add(time.Second / time.Duration(qps))
+			ttl = b.Observe(query)
+		}
+		return ttl
+	}
+
+	if ttl := observe("SELECT 1", 5); ttl != 0 {
+		t.Errorf("Expected no boost at 5 qps, got %v", ttl)
+	}
+	if ttl := observe("SELECT 1", 15); ttl <= 0 || ttl >= time.Second {
+		t.Errorf("Expected a partial boost at 15 qps, got %v", ttl)
+	}
+	for i := 0; i < 3; i++ {
+		observe("SELECT 1", 100)
+	}
+	if ttl := observe("SELECT 1", 100); ttl != time.Second {
+		t.Errorf("Expected the maximum TTL at 100 qps, got %v", ttl)
+	}
+	if ttl := observe("SELECT 2", 1); ttl != 0 {
+		t.Errorf("Expected other queries not to be boosted, got %v", ttl)
+	}
+
+	// The boost backs off when the rate drops
+	now = now.Add(5 * time.Second)
+	if ttl := b.Observe("SELECT 1"); ttl != 0 {
+		t.Errorf("Expected no boost after a pause, got %v", ttl)
+	}
+
+	b.SetLimits(0, time.Second)
+	if ttl := observe("SELECT 1", 100); ttl != 0 {
+		t.Errorf("Expected a disabled booster not to boost, got %v", ttl)
+	}
+	if ttl := (*Booster)(nil).Observe("SELECT 1"); ttl != 0 {
+		t.Errorf("Expected a nil booster not to boost, got %v", ttl)
+	}
+}
@@ -1,9 +1,15 @@
 package cache
 
 import (
+	"container/list"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/mevdschee/tqdbproxy/metrics"
 	"github.com/mevdschee/tqmemory/pkg/tqmemory"
 )
 
@@ -16,8 +22,50 @@ const (
 
 // Cache wraps TQMemory cache for query result caching with thundering herd protection
 type Cache struct {
+	storeMu  sync.RWMutex // Guards store, config and staleMultiplier against Reconfigure
 	store    *tqmemory.ShardedCache
+	config   CacheConfig
 	inflight sync.Map // key -> *flight for cold cache single-flight
+
+	staleMultiplier float64 // Hard expiry = TTL * staleMultiplier
+
+	tablesMu    sync.Mutex                     // Guards tables, keys, hot, lru, used, limits, pruneAt, budgetPrune and limitPrune
+	tables      map[string]map[string]struct{} // table -> keys of entries that read it
+	keys        map[string]indexEntry          // key -> expiry and budget charge, for Purge
+	hot         map[string]struct{}            // Keys of entries with a refresh function that were read since they were stored, see RunRefresh
+	lru         *list.List                     // Keys of the entries, most recently used first
+	used        int64                          // Bytes of the entries in keys
+	limits      CacheConfig                    // Limits on the entries, see evict
+	pruneAt     int                            // Size of keys at which expired keys are pruned
+	budgetPrune time.Time                      // Last prune because a result exceeded its budget
+	limitPrune  time.Time                      // Last prune because the entries exceeded the limits
+
+	stats *Stats // Hits and backend time saved per query fingerprint
+}
+
+// indexEntry is a stored entry in the key index
+type indexEntry struct {
+	fresh   time.Time     // Expiry of the TTL, after which the entry is stale
+	expiry  time.Time     // Hard expiry
+	refresh RefreshFunc   // Refreshes the entry in the background (nil = none)
+	budget  Budget        // Budget the entry is charged to (nil = none)
+	db      string        // Database the entry is charged to
+	size    int           // Charged bytes
+	bytes   int64         // Bytes of the key and value in the store
+	elem    *list.Element // Element of the key in lru
+	tables  []string      // Tables the entry was read from, see Track
+}
+
+// Budget limits the cache usage per database, see quota.Quotas. Entries are
+// charged until they are deleted or their hard expiry passed, also when the
+// store evicted them earlier.
+type Budget interface {
+	// ChargeCache charges an entry to db and reports whether it fits
+	ChargeCache(db string, size int) bool
+	// RejectCache counts an entry of db that did not fit
+	RejectCache(db string)
+	// ReleaseCache releases a charged entry of db
+	ReleaseCache(db string, size int)
 }
 
 // flight represents an in-flight cache population request
@@ -28,9 +76,19 @@ type flight struct {
 
 // CacheConfig holds configuration for the cache
 type CacheConfig struct {
-	MaxMemory       int64   // Maximum memory in bytes
+	MaxMemory       int64   // Maximum bytes of the keys and values of the entries (0 = unlimited)
+	MaxEntries      int     // Maximum number of entries (0 = unlimited)
+	MaxEntrySize    int64   // Maximum bytes of the key and value of an entry (0 = MaxMemory)
 	Workers         int     // Number of worker goroutines
 	StaleMultiplier float64 // Hard expiry = TTL * StaleMultiplier
+
+	RefreshAhead time.Duration // Time before the TTL expires at which hot entries are refreshed, see RunRefresh (0 = disabled)
+}
+
+// storeConfig returns the part of the configuration that the store is
+// created with
+func (cfg CacheConfig) storeConfig() CacheConfig {
+	return CacheConfig{Workers: cfg.Workers, StaleMultiplier: cfg.StaleMultiplier}
 }
 
 // DefaultCacheConfig returns sensible defaults
@@ -44,15 +102,73 @@ func DefaultCacheConfig() CacheConfig {
 
 // New creates a new cache with the specified configuration
 func New(cfg CacheConfig) (*Cache, error) {
+	store, err := newStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		store:           store,
+		config:          cfg,
+		staleMultiplier: cfg.StaleMultiplier,
+		tables:          make(map[string]map[string]struct{}),
+		keys:            make(map[string]indexEntry),
+		hot:             make(map[string]struct{}),
+		lru:             list.New(),
+		limits:          cfg,
+		pruneAt:         minPruneAt,
+		stats:           NewStats(0),
+	}, nil
+}
+
+// newStore creates the TQMemory store for a configuration. The cache enforces
+// the limits itself, across the workers of the store, so the store is
+// unlimited.
+func newStore(cfg CacheConfig) (*tqmemory.ShardedCache, error) {
 	tqcfg := tqmemory.DefaultConfig()
-	tqcfg.MaxMemory = cfg.MaxMemory
+	tqcfg.MaxMemory = 0
 	tqcfg.StaleMultiplier = cfg.StaleMultiplier
+	return tqmemory.NewSharded(tqcfg, cfg.Workers)
+}
 
-	store, err := tqmemory.NewSharded(tqcfg, cfg.Workers)
+// Reconfigure applies a changed configuration, e.g. on SIGHUP. Changed
+// limits apply to the cached results, evicting those over the new limits,
+// and a changed refresh ahead time to the next refreshes.
+// Changed workers or stale multiplier need a new store, which replaces the old
+// one and drops the cached results, as with Purge(""). Calls in progress
+// finish on the old store first.
+func (c *Cache) Reconfigure(cfg CacheConfig) error {
+	c.storeMu.Lock()
+	if cfg.storeConfig() == c.config.storeConfig() {
+		c.config = cfg
+		c.tablesMu.Lock()
+		c.limits = cfg
+		evicted := c.evict(time.Now(), "")
+		c.tablesMu.Unlock()
+		for _, key := range evicted {
+			c.store.Delete(key)
+		}
+		c.storeMu.Unlock()
+		return nil
+	}
+	store, err := newStore(cfg)
 	if err != nil {
-		return nil, err
+		c.storeMu.Unlock()
+		return err
+	}
+	old := c.store
+	c.store = store
+	c.config = cfg
+	c.staleMultiplier = cfg.StaleMultiplier
+	c.tablesMu.Lock()
+	for key := range c.keys {
+		c.unindex(key)
 	}
-	return &Cache{store: store}, nil
+	c.limits = cfg
+	c.tables = make(map[string]map[string]struct{})
+	c.pruneAt = minPruneAt
+	c.tablesMu.Unlock()
+	c.storeMu.Unlock()
+	return old.Close()
 }
 
 // Get retrieves a cached result by key.
@@ -61,13 +177,23 @@ func New(cfg CacheConfig) (*Cache, error) {
 //   - FlagStale (1): Value is stale, already being refreshed
 //   - FlagRefresh (3): Value is stale, caller should refresh
 func (c *Cache) Get(key string) ([]byte, int, bool) {
+	c.storeMu.RLock()
 	value, _, flags, err := c.store.Get(key)
+	c.storeMu.RUnlock()
 	if err != nil {
 		return nil, 0, false
 	}
 	if value == nil {
 		return nil, 0, false
 	}
+	c.tablesMu.Lock()
+	if e, ok := c.keys[key]; ok {
+		c.lru.MoveToFront(e.elem)
+		if e.refresh != nil {
+			c.hot[key] = struct{}{}
+		}
+	}
+	c.tablesMu.Unlock()
 	return value, flags, true
 }
 
@@ -104,14 +230,19 @@ func (c *Cache) GetOrWait(key string) ([]byte, int, bool, bool) {
 // SetAndNotify stores a value and notifies any waiting goroutines.
 // Use this after GetOrWait returns (nil, _, false, false).
 func (c *Cache) SetAndNotify(key string, value []byte, ttl time.Duration) {
-	if ttl > 0 {
-		c.store.Set(key, value, ttl)
-	}
+	c.SetAndNotifyFor(nil, "", key, value, ttl)
+}
+
+// SetAndNotifyFor is SetAndNotify for a result charged to database db, see
+// SetFor. Waiters are notified also when the result was not stored.
+func (c *Cache) SetAndNotifyFor(budget Budget, db, key string, value []byte, ttl time.Duration) bool {
+	stored := c.SetFor(budget, db, key, value, ttl)
 
 	// Notify waiters
 	if f, ok := c.inflight.LoadAndDelete(key); ok {
 		close(f.(*flight).done)
 	}
+	return stored
 }
 
 // CancelInflight cancels an in-flight request (e.g., on error).
@@ -124,17 +255,362 @@ func (c *Cache) CancelInflight(key string) {
 
 // Set stores a result with the specified TTL (for backward compatibility)
 func (c *Cache) Set(key string, value []byte, ttl time.Duration) {
-	if ttl > 0 {
-		c.store.Set(key, value, ttl)
+	c.SetFor(nil, "", key, value, ttl)
+}
+
+// SetFor stores a result of database db with the specified TTL, charging it
+// to budget (nil = none). A result that exceeds the budget of db or the
+// maximum entry size is not stored, and the earlier entry under key is
+// deleted. Storing a result may evict the least recently used entries to stay
+// within the limits. It reports whether the result was stored.
+func (c *Cache) SetFor(budget Budget, db, key string, value []byte, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	c.storeMu.RLock()
+	defer c.storeMu.RUnlock()
+	evicted, ok := c.index(key, ttl, budget, db, value)
+	for _, k := range evicted {
+		c.store.Delete(k)
+	}
+	if !ok {
+		c.store.Delete(key)
+		return false
+	}
+	c.store.Set(key, value, ttl)
+	return true
+}
+
+// minPruneAt is the smallest key index that is pruned of expired keys
+const minPruneAt = 1024
+
+// budgetPruneInterval is the least time between prunes of expired keys for
+// results that exceeded their budget or the limits
+const budgetPruneInterval = time.Second
+
+// index records the key of a stored entry, so that Purge can find it, charges
+// it to budget and accounts its bytes. The caller holds storeMu for reading.
+// It reports false, and removes the key, when the entry does not fit the
+// budget or the maximum entry size. It returns the keys of the entries that
+// were evicted to stay within the limits, which the caller deletes from the
+// store. Keys of expired entries are pruned whenever the index doubled in
+// size, or at most every second when a budget is exceeded, as their charges
+// may make room.
+func (c *Cache) index(key string, ttl time.Duration, budget Budget, db string, value []byte) ([]string, bool) {
+	now := time.Now()
+	bytes := int64(len(key) + len(value))
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
+	// A replaced entry, e.g. by a refresh, was read from the same tables
+	tables := c.keys[key].tables
+	c.unindex(key)
+	if c.tooLarge(bytes) {
+		metrics.CacheEvictions.WithLabelValues("too_large").Inc()
+		return nil, false
+	}
+	if budget != nil && !budget.ChargeCache(db, len(value)) {
+		if now.Sub(c.budgetPrune) < budgetPruneInterval {
+			budget.RejectCache(db)
+			return nil, false
+		}
+		c.budgetPrune = now
+		c.prune(now)
+		if !budget.ChargeCache(db, len(value)) {
+			budget.RejectCache(db)
+			return nil, false
+		}
+	}
+	c.keys[key] = indexEntry{
+		fresh:  now.Add(ttl),
+		expiry: now.Add(time.Duration(float64(ttl) * max(c.staleMultiplier, 1))),
+		budget: budget,
+		db:     db,
+		size:   len(value),
+		bytes:  bytes,
+		elem:   c.lru.PushFront(key),
+	}
+	c.used += bytes
+	c.track(key, tables)
+	if len(c.keys) >= c.pruneAt {
+		c.prune(now)
+	}
+	c.updateUsage()
+	return c.evict(now, key), true
+}
+
+// tooLarge reports whether an entry of the given bytes exceeds the maximum
+// entry size, or the maximum memory when that is not set. The caller holds
+// tablesMu.
+func (c *Cache) tooLarge(bytes int64) bool {
+	maxSize := c.limits.MaxEntrySize
+	if maxSize <= 0 || (c.limits.MaxMemory > 0 && maxSize > c.limits.MaxMemory) {
+		maxSize = c.limits.MaxMemory
+	}
+	return maxSize > 0 && bytes > maxSize
+}
+
+// overLimits reports whether the entries exceed the maximum memory or number
+// of entries. The caller holds tablesMu.
+func (c *Cache) overLimits() bool {
+	return (c.limits.MaxMemory > 0 && c.used > c.limits.MaxMemory) ||
+		(c.limits.MaxEntries > 0 && len(c.keys) > c.limits.MaxEntries)
+}
+
+// evict removes the least recently used entries, except keep, until the
+// entries are within the limits, and returns their keys. Expired entries are
+// pruned first, at most every second, as they may make room. The caller holds
+// tablesMu.
+func (c *Cache) evict(now time.Time, keep string) []string {
+	if !c.overLimits() {
+		return nil
+	}
+	if now.Sub(c.limitPrune) >= budgetPruneInterval {
+		c.limitPrune = now
+		c.prune(now)
+	}
+	var evicted []string
+	for c.overLimits() {
+		elem := c.lru.Back()
+		for elem != nil && elem.Value.(string) == keep {
+			elem = elem.Prev()
+		}
+		if elem == nil {
+			break
+		}
+		key := elem.Value.(string)
+		reason := "entries"
+		if c.limits.MaxMemory > 0 && c.used > c.limits.MaxMemory {
+			reason = "memory"
+		}
+		metrics.CacheEvictions.WithLabelValues(reason).Inc()
+		c.unindex(key)
+		evicted = append(evicted, key)
+	}
+	return evicted
+}
+
+// updateUsage reports the bytes and number of the entries in the metrics.
+// The caller holds tablesMu.
+func (c *Cache) updateUsage() {
+	metrics.CacheBytes.Set(float64(c.used))
+	metrics.CacheEntries.Set(float64(len(c.keys)))
+}
+
+// Usage returns the number and bytes of the keys and values of the cached
+// entries, including expired entries that were not pruned yet
+func (c *Cache) Usage() (entries int, bytes int64) {
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
+	return len(c.keys), c.used
+}
+
+// prune removes the keys of expired entries from the index. The caller
+// holds tablesMu.
+func (c *Cache) prune(now time.Time) {
+	for k, e := range c.keys {
+		if now.After(e.expiry) {
+			c.unindex(k)
+		}
+	}
+	c.pruneAt = max(minPruneAt, 2*len(c.keys))
+}
+
+// unindex removes a key from the index and the tables it was read from, and
+// releases its budget charge. The caller holds tablesMu.
+func (c *Cache) unindex(key string) {
+	e, ok := c.keys[key]
+	if !ok {
+		return
+	}
+	delete(c.keys, key)
+	delete(c.hot, key)
+	c.lru.Remove(e.elem)
+	c.used -= e.bytes
+	c.updateUsage()
+	for _, table := range e.tables {
+		keys := c.tables[table]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.tables, table)
+		}
+	}
+	if e.budget != nil {
+		e.budget.ReleaseCache(e.db, e.size)
 	}
 }
 
 // Delete removes an entry from the cache
 func (c *Cache) Delete(key string) {
+	c.storeMu.RLock()
 	c.store.Delete(key)
+	c.storeMu.RUnlock()
+	c.tablesMu.Lock()
+	c.unindex(key)
+	c.tablesMu.Unlock()
+}
+
+// Track records that the entry stored under key was read from tables, so
+// InvalidateTables can remove it when one of them changes. Keys that are not
+// stored are not tracked.
+func (c *Cache) Track(key string, tables []string) {
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
+	c.track(key, tables)
+}
+
+// track adds tables to the tables of the stored key. The caller holds
+// tablesMu.
+func (c *Cache) track(key string, tables []string) {
+	e, ok := c.keys[key]
+	if !ok {
+		return
+	}
+	for _, table := range tables {
+		keys := c.tables[table]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			c.tables[table] = keys
+		}
+		if _, ok := keys[key]; !ok {
+			keys[key] = struct{}{}
+			e.tables = append(e.tables, table)
+		}
+	}
+	c.keys[key] = e
+}
+
+// InvalidateTables deletes all entries tracked for any of the tables, e.g.
+// after a DDL statement changed them. It returns the number of deleted keys.
+func (c *Cache) InvalidateTables(tables []string) int {
+	c.tablesMu.Lock()
+	deleted := make(map[string]struct{})
+	for _, table := range tables {
+		for key := range c.tables[table] {
+			deleted[key] = struct{}{}
+		}
+	}
+	for key := range deleted {
+		c.unindex(key)
+	}
+	c.tablesMu.Unlock()
+
+	c.storeMu.RLock()
+	for key := range deleted {
+		c.store.Delete(key)
+	}
+	c.storeMu.RUnlock()
+	return len(deleted)
+}
+
+// Purge deletes the entries matching pattern and returns the number of deleted
+// keys. The pattern is one of:
+//   - empty: all entries
+//   - "table:<name>": the entries that read the table
+//   - a glob with "*" (any text) or "?" (any character): matching keys
+//   - otherwise: the entry with exactly this key
+func (c *Cache) Purge(pattern string) int {
+	if table, ok := strings.CutPrefix(pattern, "table:"); ok {
+		return c.InvalidateTables([]string{table})
+	}
+
+	now := time.Now()
+	c.storeMu.RLock()
+	defer c.storeMu.RUnlock()
+	c.tablesMu.Lock()
+	if pattern == "" {
+		c.store.FlushAll()
+		n := 0
+		for key, e := range c.keys {
+			if !now.After(e.expiry) {
+				n++
+			}
+			c.unindex(key)
+		}
+		c.tables = make(map[string]map[string]struct{})
+		c.pruneAt = minPruneAt
+		c.tablesMu.Unlock()
+		return n
+	}
+
+	var deleted []string
+	if strings.ContainsAny(pattern, "*?") {
+		re := globRegexp(pattern)
+		for key := range c.keys {
+			if re.MatchString(key) {
+				deleted = append(deleted, key)
+			}
+		}
+	} else if _, ok := c.keys[pattern]; ok {
+		deleted = append(deleted, pattern)
+	}
+	n := 0
+	for _, key := range deleted {
+		if !now.After(c.keys[key].expiry) {
+			n++
+		}
+		c.unindex(key)
+	}
+	c.tablesMu.Unlock()
+
+	for _, key := range deleted {
+		c.store.Delete(key)
+	}
+	return n
+}
+
+// Shrink deletes a fraction of the entries, those that expire first, to free
+// memory under pressure. It returns the number of deleted entries.
+func (c *Cache) Shrink(fraction float64) int {
+	c.storeMu.RLock()
+	defer c.storeMu.RUnlock()
+	c.tablesMu.Lock()
+	c.prune(time.Now())
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.keys[keys[i]].expiry.Before(c.keys[keys[j]].expiry)
+	})
+	keys = keys[:int(math.Ceil(float64(len(keys))*min(fraction, 1)))]
+	for _, key := range keys {
+		c.unindex(key)
+	}
+	c.tablesMu.Unlock()
+
+	for _, key := range keys {
+		c.store.Delete(key)
+	}
+	return len(keys)
+}
+
+// globRegexp compiles a glob, in which "*" matches any text (including
+// newlines) and "?" any character, to an anchored regular expression
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Stats returns the hot query statistics of the cache
+func (c *Cache) Stats() *Stats {
+	return c.stats
 }
 
 // Close closes the cache
 func (c *Cache) Close() error {
+	c.storeMu.RLock()
+	defer c.storeMu.RUnlock()
 	return c.store.Close()
 }
@@ -1,6 +1,9 @@
 package cache
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -268,3 +271,384 @@ func TestCache_StaleConcurrentSingleFlight(t *testing.T) {
 		t.Errorf("Expected exactly 1 FlagRefresh, got %d", refreshCount)
 	}
 }
+
+func TestCache_InvalidateTables(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	c.Set("q1", []byte("v1"), time.Minute)
+	c.Track("q1", []string{"users"})
+	c.Set("q2", []byte("v2"), time.Minute)
+	c.Track("q2", []string{"users", "orders"})
+	c.Set("q3", []byte("v3"), time.Minute)
+	c.Track("q3", []string{"orders"})
+	time.Sleep(10 * time.Millisecond)
+
+	if n := c.InvalidateTables([]string{"users"}); n != 2 {
+		t.Errorf("InvalidateTables(users) = %d, want 2", n)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	for _, key := range []string{"q1", "q2"} {
+		if _, _, ok := c.Get(key); ok {
+			t.Errorf("Get(%q) returned ok=true after invalidation", key)
+		}
+	}
+	if _, _, ok := c.Get("q3"); !ok {
+		t.Error("Get(q3) returned ok=false, entry of other table should survive")
+	}
+
+	if n := c.InvalidateTables([]string{"users"}); n != 0 {
+		t.Errorf("Second InvalidateTables(users) = %d, want 0", n)
+	}
+}
+
+func TestCache_Purge(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	set := func() {
+		c.Set("SELECT * FROM users WHERE id = 1", []byte("v1"), time.Minute)
+		c.Track("SELECT * FROM users WHERE id = 1", []string{"users"})
+		c.Set("SELECT * FROM users WHERE id = 2", []byte("v2"), time.Minute)
+		c.Track("SELECT * FROM users WHERE id = 2", []string{"users"})
+		c.Set("SELECT * FROM orders", []byte("v3"), time.Minute)
+		c.Track("SELECT * FROM orders", []string{"orders"})
+		time.Sleep(10 * time.Millisecond)
+	}
+	cached := func() int {
+		n := 0
+		for _, key := range []string{"SELECT * FROM users WHERE id = 1", "SELECT * FROM users WHERE id = 2", "SELECT * FROM orders"} {
+			if _, _, ok := c.Get(key); ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		pattern string
+		purged  int
+	}{
+		{"SELECT * FROM orders", 1},
+		{"SELECT * FROM unknown", 0},
+		{"table:users", 2},
+		{"*users WHERE id = ?", 2},
+		{"select*", 0},
+		{"", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			set()
+			if n := c.Purge(tt.pattern); n != tt.purged {
+				t.Errorf("Purge(%q) = %d, want %d", tt.pattern, n, tt.purged)
+			}
+			time.Sleep(10 * time.Millisecond)
+			if n := cached(); n != 3-tt.purged {
+				t.Errorf("Expected %d cached entries after Purge(%q), got %d", 3-tt.purged, tt.pattern, n)
+			}
+		})
+	}
+}
+
+// testBudget allows a fixed number of entries per database
+type testBudget struct {
+	limit    int
+	entries  map[string]int
+	rejected int
+}
+
+func (b *testBudget) ChargeCache(db string, size int) bool {
+	if b.entries[db] >= b.limit {
+		return false
+	}
+	b.entries[db]++
+	return true
+}
+
+func (b *testBudget) RejectCache(db string) { b.rejected++ }
+
+func (b *testBudget) ReleaseCache(db string, size int) { b.entries[db]-- }
+
+func TestCache_SetForBudget(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	b := &testBudget{limit: 2, entries: make(map[string]int)}
+	if !c.SetFor(b, "app", "q1", []byte("v1"), time.Minute) || !c.SetFor(b, "app", "q2", []byte("v2"), time.Minute) {
+		t.Fatal("Expected entries within the budget to be stored")
+	}
+	// Replacing an entry does not charge it twice
+	if !c.SetFor(b, "app", "q2", []byte("v2"), time.Minute) {
+		t.Fatal("Expected a replaced entry to be stored")
+	}
+	if c.SetFor(b, "app", "q3", []byte("v3"), time.Minute) {
+		t.Error("Expected an entry over the budget not to be stored")
+	}
+	if !c.SetFor(b, "other", "q4", []byte("v4"), time.Minute) {
+		t.Error("Expected another database to have its own budget")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("q3"); ok {
+		t.Error("Get(q3) returned ok=true for an entry over the budget")
+	}
+	if b.rejected != 1 {
+		t.Errorf("Expected 1 rejected entry, got %d", b.rejected)
+	}
+
+	// Deleted, invalidated and purged entries release their charge
+	c.Track("q1", []string{"users"})
+	c.InvalidateTables([]string{"users"})
+	c.Delete("q2")
+	if b.entries["app"] != 0 {
+		t.Errorf("Expected all entries of app released, got %d", b.entries["app"])
+	}
+	c.Purge("")
+	if b.entries["other"] != 0 {
+		t.Errorf("Expected all entries of other released, got %d", b.entries["other"])
+	}
+}
+
+func TestCache_Reconfigure(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	c.Set("key1", []byte("value1"), time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if err := c.Reconfigure(DefaultCacheConfig()); err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if _, _, ok := c.Get("key1"); !ok {
+		t.Error("Expected an unchanged configuration to keep the entry")
+	}
+
+	cfg := DefaultCacheConfig()
+	cfg.MaxMemory = 32 * 1024 * 1024
+	cfg.StaleMultiplier = 3
+	if err := c.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	if _, _, ok := c.Get("key1"); ok {
+		t.Error("Expected a changed configuration to drop the entry")
+	}
+	if n := c.Purge(""); n != 0 {
+		t.Errorf("Expected an empty key index, purged %d", n)
+	}
+	c.Set("key2", []byte("value2"), time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if v, _, ok := c.Get("key2"); !ok || string(v) != "value2" {
+		t.Errorf("Expected value2 from the new store, got %q (%v)", v, ok)
+	}
+}
+
+func TestCache_Shrink(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	for i, ttl := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 4 * time.Minute} {
+		c.Set(fmt.Sprintf("key%d", i), []byte("value"), ttl)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := c.Shrink(0.5); n != 2 {
+		t.Errorf("Shrink(0.5) = %d, want 2", n)
+	}
+	for i, want := range []bool{false, false, true, true} {
+		if _, _, ok := c.Get(fmt.Sprintf("key%d", i)); ok != want {
+			t.Errorf("Expected key%d cached = %v, got %v", i, want, ok)
+		}
+	}
+	if n := c.Shrink(1); n != 2 {
+		t.Errorf("Shrink(1) = %d, want 2", n)
+	}
+}
+
+func TestCache_LRUEviction(t *testing.T) {
+	cfg := DefaultCacheConfig()
+	cfg.MaxEntries = 2
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	c.Set("key1", []byte("value1"), time.Minute)
+	c.Set("key2", []byte("value2"), time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("key1"); !ok {
+		t.Fatal("Expected key1 to be cached")
+	}
+	// key2 is now the least recently used entry
+	c.Set("key3", []byte("value3"), time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	for key, want := range map[string]bool{"key1": true, "key2": false, "key3": true} {
+		if _, _, ok := c.Get(key); ok != want {
+			t.Errorf("Expected %s cached = %v, got %v", key, want, ok)
+		}
+	}
+	if entries, bytes := c.Usage(); entries != 2 || bytes != 20 {
+		t.Errorf("Usage() = %d entries, %d bytes, want 2 entries, 20 bytes", entries, bytes)
+	}
+}
+
+func TestCache_TrackedTablesReleased(t *testing.T) {
+	cfg := DefaultCacheConfig()
+	cfg.MaxEntries = 2
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	tables := func() int {
+		c.tablesMu.Lock()
+		defer c.tablesMu.Unlock()
+		return len(c.tables)
+	}
+
+	// Keys that are not stored are not tracked
+	c.Track("missing", []string{"users"})
+	if n := tables(); n != 0 {
+		t.Errorf("Expected no tracked tables for a missing key, got %d", n)
+	}
+
+	// Evicted entries release their tables
+	c.Set("q1", []byte("v1"), time.Minute)
+	c.Track("q1", []string{"users"})
+	c.Set("q2", []byte("v2"), time.Minute)
+	c.Track("q2", []string{"orders"})
+	c.Set("q3", []byte("v3"), time.Minute)
+	c.Track("q3", []string{"orders", "items"})
+	if n := tables(); n != 2 {
+		t.Errorf("Expected 2 tracked tables after eviction, got %d", n)
+	}
+	if n := c.InvalidateTables([]string{"users"}); n != 0 {
+		t.Errorf("InvalidateTables(users) = %d for an evicted entry, want 0", n)
+	}
+
+	// Deleted and expired entries release their tables
+	c.Delete("q2")
+	c.Set("q3", []byte("v3"), time.Millisecond)
+	if n := tables(); n != 2 {
+		t.Errorf("Expected a replaced entry to keep its tables, got %d", n)
+	}
+	time.Sleep(10 * time.Millisecond)
+	c.Shrink(0)
+	if n := tables(); n != 0 {
+		t.Errorf("Expected no tracked tables after expiry, got %d", n)
+	}
+}
+
+func TestCache_MaxMemory(t *testing.T) {
+	cfg := DefaultCacheConfig()
+	cfg.MaxMemory = 100
+	cfg.MaxEntrySize = 60
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	value := []byte(strings.Repeat("x", 36)) // 40 bytes with the key
+	c.Set("key1", value, time.Minute)
+	c.Set("key2", value, time.Minute)
+	if _, bytes := c.Usage(); bytes != 80 {
+		t.Errorf("Expected 80 bytes, got %d", bytes)
+	}
+	c.Set("key3", value, time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("key1"); ok {
+		t.Error("Expected key1 to be evicted for memory")
+	}
+	if entries, bytes := c.Usage(); entries != 2 || bytes != 80 {
+		t.Errorf("Usage() = %d entries, %d bytes, want 2 entries, 80 bytes", entries, bytes)
+	}
+
+	// An entry over the maximum entry size is not stored and replaces nothing
+	if c.SetFor(nil, "", "key2", []byte(strings.Repeat("x", 57)), time.Minute) {
+		t.Error("Expected an entry over the maximum entry size not to be stored")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("key2"); ok {
+		t.Error("Expected the earlier entry under the key to be deleted")
+	}
+	if entries, bytes := c.Usage(); entries != 1 || bytes != 40 {
+		t.Errorf("Usage() = %d entries, %d bytes, want 1 entry, 40 bytes", entries, bytes)
+	}
+
+	// Lowered limits evict without dropping the other entries
+	c.Set("key4", value, time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	cfg.MaxEntries = 1
+	if err := c.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure failed: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("key4"); !ok {
+		t.Error("Expected key4 to be kept by the changed limits")
+	}
+	if entries, _ := c.Usage(); entries != 1 {
+		t.Errorf("Expected 1 entry after Reconfigure, got %d", entries)
+	}
+}
+
+func TestCache_Refresh(t *testing.T) {
+	cfg := DefaultCacheConfig()
+	cfg.RefreshAhead = time.Minute
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	refreshed := make(chan string, 2)
+	refresh := func(key string) RefreshFunc {
+		return func(ctx context.Context) ([]byte, time.Duration, error) {
+			refreshed <- key
+			return []byte("new"), 10 * time.Minute, nil
+		}
+	}
+	c.Set("hot", []byte("old"), 10*time.Second)
+	c.SetRefresh("hot", refresh("hot"))
+	c.Set("cold", []byte("old"), 10*time.Second)
+	c.SetRefresh("cold", refresh("cold"))
+	time.Sleep(10 * time.Millisecond)
+	if _, _, ok := c.Get("hot"); !ok {
+		t.Fatal("Expected hot to be cached")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.RunRefresh(ctx, 5*time.Millisecond)
+	select {
+	case key := <-refreshed:
+		if key != "hot" {
+			t.Fatalf("Expected only the entry that was read to be refreshed, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the hot entry to be refreshed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if value, _, _ := c.Get("hot"); string(value) != "new" {
+		t.Errorf("Expected the refreshed value, got %q", value)
+	}
+	select {
+	case key := <-refreshed:
+		t.Errorf("Expected no other refresh, got %s", key)
+	default:
+	}
+}
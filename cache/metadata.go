@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MetadataCache caches schema metadata queries (SHOW COLUMNS,
+// information_schema, pg_catalog lookups) with its own TTL, separate from
+// the hint-driven result cache. It absorbs the bursts of identical metadata
+// queries that ORMs issue when application instances start.
+//
+// Entries are keyed by a generation number, so Invalidate drops all entries
+// at once without scanning the store. A nil *MetadataCache is valid and
+// never caches anything.
+type MetadataCache struct {
+	cache      *Cache
+	namespace  string
+	ttl        time.Duration
+	generation atomic.Uint64
+}
+
+// NewMetadataCache creates a metadata cache on top of c. The namespace keeps
+// entries of different wire protocols apart. It returns nil (disabled) when
+// ttl <= 0.
+func NewMetadataCache(c *Cache, namespace string, ttl time.Duration) *MetadataCache {
+	if c == nil || ttl <= 0 {
+		return nil
+	}
+	return &MetadataCache{
+		cache:     c,
+		namespace: namespace,
+		ttl:       ttl,
+	}
+}
+
+func (m *MetadataCache) key(db, query string) string {
+	return "meta:" + m.namespace + ":" + strconv.FormatUint(m.generation.Load(), 10) + ":" + db + ":" + query
+}
+
+// Get returns the cached response for a metadata query in database db
+func (m *MetadataCache) Get(db, query string) ([]byte, bool) {
+	if m == nil {
+		return nil, false
+	}
+	value, _, ok := m.cache.Get(m.key(db, query))
+	return value, ok
+}
+
+// Set stores the response for a metadata query in database db
+func (m *MetadataCache) Set(db, query string, value []byte) {
+	if m == nil {
+		return
+	}
+	m.cache.Set(m.key(db, query), value, m.ttl)
+}
+
+// Invalidate drops all cached metadata, e.g. after a DDL statement
+func (m *MetadataCache) Invalidate() {
+	if m == nil {
+		return
+	}
+	m.generation.Add(1)
+}
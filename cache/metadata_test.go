@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetadataCache_Disabled(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	m := NewMetadataCache(c, "mariadb", 0)
+	if m != nil {
+		t.Fatal("NewMetadataCache with ttl 0 should return nil")
+	}
+
+	// nil cache is a no-op
+	m.Set("db", "SHOW TABLES", []byte("x"))
+	if _, ok := m.Get("db", "SHOW TABLES"); ok {
+		t.Error("Disabled metadata cache should never hit")
+	}
+	m.Invalidate()
+}
+
+func TestMetadataCache_SetGetInvalidate(t *testing.T) {
+	c, err := New(DefaultCacheConfig())
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	m := NewMetadataCache(c, "mariadb", time.Minute)
+	m.Set("app", "SHOW TABLES", []byte("tables"))
+	time.Sleep(10 * time.Millisecond)
+
+	got, ok := m.Get("app", "SHOW TABLES")
+	if !ok || string(got) != "tables" {
+		t.Fatalf("Get = %q, %v; want %q, true", got, ok, "tables")
+	}
+
+	// Different database or namespace must not share entries
+	if _, ok := m.Get("other", "SHOW TABLES"); ok {
+		t.Error("Entry should be scoped to its database")
+	}
+	pg := NewMetadataCache(c, "postgres", time.Minute)
+	if _, ok := pg.Get("app", "SHOW TABLES"); ok {
+		t.Error("Entry should be scoped to its namespace")
+	}
+
+	m.Invalidate()
+	if _, ok := m.Get("app", "SHOW TABLES"); ok {
+		t.Error("Get after Invalidate should miss")
+	}
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// RefreshFunc executes the query of a cached result again and returns the
+// new result with its TTL (0 = do not store it), see SetRefresh
+type RefreshFunc func(ctx context.Context) ([]byte, time.Duration, error)
+
+// refreshTimeout bounds the time a background refresh may take
+const refreshTimeout = 30 * time.Second
+
+// SetRefresh registers the function that refreshes the entry stored under
+// key in the background, see RunRefresh. It applies until the entry is
+// replaced or deleted.
+func (c *Cache) SetRefresh(key string, fn RefreshFunc) {
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
+	if e, ok := c.keys[key]; ok {
+		e.refresh = fn
+		c.keys[key] = e
+	}
+}
+
+// dueRefresh is an entry that is refreshed in the background
+type dueRefresh struct {
+	key    string
+	fresh  time.Time // Expiry of the TTL of the entry when it was due
+	fn     RefreshFunc
+	budget Budget
+	db     string
+}
+
+// RunRefresh refreshes hot entries in the background every interval until
+// ctx is done: the entries with a refresh function (see SetRefresh) that
+// were read since they were stored and whose TTL expires within the
+// RefreshAhead of the configuration. The result replaces the entry, so that
+// clients keep getting fresh hits instead of the first client after the
+// expiry waiting for the backend. An entry that is not read again is not
+// refreshed again, and expires.
+func (c *Cache) RunRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, r := range c.dueRefreshes(time.Now()) {
+				c.refresh(ctx, r)
+			}
+		}
+	}
+}
+
+// dueRefreshes returns the hot entries whose TTL expires within the refresh
+// ahead time, and takes them from the hot entries
+func (c *Cache) dueRefreshes(now time.Time) []dueRefresh {
+	c.tablesMu.Lock()
+	defer c.tablesMu.Unlock()
+	ahead := c.limits.RefreshAhead
+	if ahead <= 0 {
+		return nil
+	}
+	var due []dueRefresh
+	for key := range c.hot {
+		e := c.keys[key]
+		if e.fresh.After(now.Add(ahead)) {
+			continue
+		}
+		delete(c.hot, key)
+		if now.Before(e.expiry) {
+			due = append(due, dueRefresh{key: key, fresh: e.fresh, fn: e.refresh, budget: e.budget, db: e.db})
+		}
+	}
+	return due
+}
+
+// refresh executes the refresh of an entry and stores the result, unless
+// the entry was replaced or deleted in the meantime, e.g. by an invalidation
+func (c *Cache) refresh(ctx context.Context, r dueRefresh) {
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	value, ttl, err := r.fn(ctx)
+	if err != nil {
+		metrics.CacheRefreshes.WithLabelValues("error").Inc()
+		log.Printf("[Cache] Background refresh failed: %v", err)
+		return
+	}
+	c.tablesMu.Lock()
+	e, ok := c.keys[r.key]
+	current := ok && e.fresh.Equal(r.fresh)
+	c.tablesMu.Unlock()
+	if !current || ttl <= 0 || !c.SetFor(r.budget, r.db, r.key, value, ttl) {
+		metrics.CacheRefreshes.WithLabelValues("skipped").Inc()
+		return
+	}
+	c.SetRefresh(r.key, r.fn)
+	metrics.CacheRefreshes.WithLabelValues("refreshed").Inc()
+}
@@ -0,0 +1,46 @@
+package cache
+
+import "sync"
+
+// Schema tracks the tables changed by DDL statements, so that the proxies
+// prepare the statements on those tables again. Each DDL statement raises the
+// version of the schema, a statement prepared at an older version than the
+// last change of one of its tables is stale. The zero value is ready to use.
+type Schema struct {
+	mu      sync.RWMutex
+	version uint64
+	tables  map[string]uint64 // table -> version of its last change
+}
+
+// Change records a DDL statement on tables and returns the new version
+func (s *Schema) Change(tables []string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	if s.tables == nil {
+		s.tables = make(map[string]uint64)
+	}
+	for _, table := range tables {
+		s.tables[table] = s.version
+	}
+	return s.version
+}
+
+// Version returns the current version, which statements prepared now get
+func (s *Schema) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version
+}
+
+// Changed reports whether one of the tables changed after version
+func (s *Schema) Changed(tables []string, version uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, table := range tables {
+		if s.tables[table] > version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package cache
+
+import "testing"
+
+func TestSchema_Changed(t *testing.T) {
+	var s Schema
+	prepared := s.Version()
+	if s.Changed([]string{"users"}, prepared) {
+		t.Error("Expected no changes before a DDL statement")
+	}
+
+	s.Change([]string{"orders"})
+	if s.Changed([]string{"users"}, prepared) {
+		t.Error("Expected users to be unchanged by a DDL statement on orders")
+	}
+	if !s.Changed([]string{"users", "orders"}, prepared) {
+		t.Error("Expected a statement on orders to be stale")
+	}
+
+	// Statements prepared again after the change are current
+	if s.Changed([]string{"orders"}, s.Version()) {
+		t.Error("Expected a statement prepared after the change to be current")
+	}
+}
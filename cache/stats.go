@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+// StatsWindows are the sliding windows supported by Stats.Top
+var StatsWindows = []time.Duration{5 * time.Minute, time.Hour, 24 * time.Hour}
+
+// Each window is covered by a ring of time slots; older slots decay out of
+// the window as time advances.
+var statsResolutions = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// defaultMaxFingerprints bounds the memory used by Stats
+const defaultMaxFingerprints = 10000
+
+// QueryStats is one row of the hot query report
+type QueryStats struct {
+	Fingerprint string
+	Hits        int64
+	Misses      int64
+	AvgExec     time.Duration // Average backend execution time on a miss
+	Saved       time.Duration // Hits * AvgExec
+}
+
+// Stats tracks cache hits and backend execution time per query fingerprint,
+// to report which cached queries save the most backend time.
+type Stats struct {
+	mu         sync.RWMutex
+	entries    map[string]*statsEntry
+	maxEntries int
+	lastPrune  time.Time
+	now        func() time.Time
+	hits       atomic.Int64 // All hits, also of queries beyond maxEntries
+	misses     atomic.Int64
+}
+
+type statsSlot struct {
+	epoch  int64 // Slot start in units of the ring resolution
+	hits   int64
+	misses int64
+}
+
+type statsEntry struct {
+	mu        sync.Mutex
+	execTotal time.Duration // Backend time of all misses
+	execCount int64
+	lastSeen  time.Time
+	rings     [3][]statsSlot // One ring per window
+}
+
+// NewStats creates a tracker for up to maxFingerprints distinct queries
+// (0 = default). New fingerprints are ignored while it is full.
+func NewStats(maxFingerprints int) *Stats {
+	if maxFingerprints <= 0 {
+		maxFingerprints = defaultMaxFingerprints
+	}
+	return &Stats{
+		entries:    make(map[string]*statsEntry),
+		maxEntries: maxFingerprints,
+		now:        time.Now,
+	}
+}
+
+// RecordHit records a cache hit for query
+func (s *Stats) RecordHit(query string) {
+	s.hits.Add(1)
+	if e := s.entry(parser.Fingerprint(query)); e != nil {
+		e.record(s.now(), true, 0)
+	}
+}
+
+// RecordMiss records a cache miss for query that took exec on the backend
+func (s *Stats) RecordMiss(query string, exec time.Duration) {
+	s.misses.Add(1)
+	if e := s.entry(parser.Fingerprint(query)); e != nil {
+		e.record(s.now(), false, exec)
+	}
+}
+
+// Totals returns the number of hits and misses recorded since the start
+func (s *Stats) Totals() (hits, misses int64) {
+	return s.hits.Load(), s.misses.Load()
+}
+
+// entry returns the entry for a fingerprint, creating it when there is room
+func (s *Stats) entry(fingerprint string) *statsEntry {
+	s.mu.RLock()
+	e := s.entries[fingerprint]
+	s.mu.RUnlock()
+	if e != nil {
+		return e
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e = s.entries[fingerprint]; e != nil {
+		return e
+	}
+	if len(s.entries) >= s.maxEntries && !s.prune() {
+		return nil
+	}
+	e = &statsEntry{}
+	for i, w := range StatsWindows {
+		// One extra slot for the partially elapsed current one
+		e.rings[i] = make([]statsSlot, int(w/statsResolutions[i])+1)
+	}
+	s.entries[fingerprint] = e
+	return e
+}
+
+// prune removes entries without activity in the largest window. It runs at
+// most once per minute and returns whether room was made. Caller holds s.mu.
+func (s *Stats) prune() bool {
+	now := s.now()
+	if now.Sub(s.lastPrune) < time.Minute {
+		return false
+	}
+	s.lastPrune = now
+
+	cutoff := now.Add(-StatsWindows[len(StatsWindows)-1])
+	for fingerprint, e := range s.entries {
+		e.mu.Lock()
+		stale := e.lastSeen.Before(cutoff)
+		e.mu.Unlock()
+		if stale {
+			delete(s.entries, fingerprint)
+		}
+	}
+	return len(s.entries) < s.maxEntries
+}
+
+func (e *statsEntry) record(now time.Time, hit bool, exec time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastSeen = now
+	if !hit {
+		e.execTotal += exec
+		e.execCount++
+	}
+	for i, res := range statsResolutions {
+		epoch := now.UnixNano() / int64(res)
+		slot := &e.rings[i][epoch%int64(len(e.rings[i]))]
+		if slot.epoch != epoch {
+			*slot = statsSlot{epoch: epoch}
+		}
+		if hit {
+			slot.hits++
+		} else {
+			slot.misses++
+		}
+	}
+}
+
+// window sums the hits and misses of ring i within its window
+func (e *statsEntry) window(i int, now time.Time) (hits, misses int64) {
+	res := statsResolutions[i]
+	current := now.UnixNano() / int64(res)
+	oldest := current - int64(StatsWindows[i]/res)
+	for _, slot := range e.rings[i] {
+		if slot.epoch > oldest && slot.epoch <= current {
+			hits += slot.hits
+			misses += slot.misses
+		}
+	}
+	return hits, misses
+}
+
+// Top returns the k queries that saved the most backend time within window,
+// which must be one of StatsWindows. The saved time of a query is its number
+// of hits times its average backend execution time on a miss.
+func (s *Stats) Top(window time.Duration, k int) ([]QueryStats, error) {
+	ring := -1
+	for i, w := range StatsWindows {
+		if w == window {
+			ring = i
+		}
+	}
+	if ring < 0 {
+		return nil, fmt.Errorf("unsupported window %s", window)
+	}
+
+	now := s.now()
+	s.mu.RLock()
+	report := make([]QueryStats, 0, len(s.entries))
+	for fingerprint, e := range s.entries {
+		e.mu.Lock()
+		hits, misses := e.window(ring, now)
+		var avg time.Duration
+		if e.execCount > 0 {
+			avg = e.execTotal / time.Duration(e.execCount)
+		}
+		e.mu.Unlock()
+		if hits == 0 && misses == 0 {
+			continue
+		}
+		report = append(report, QueryStats{
+			Fingerprint: fingerprint,
+			Hits:        hits,
+			Misses:      misses,
+			AvgExec:     avg,
+			Saved:       time.Duration(hits) * avg,
+		})
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Saved != report[j].Saved {
+			return report[i].Saved > report[j].Saved
+		}
+		return report[i].Fingerprint < report[j].Fingerprint
+	})
+	if k > 0 && len(report) > k {
+		report = report[:k]
+	}
+	return report, nil
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats_Top(t *testing.T) {
+	s := NewStats(0)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	// Same fingerprint for different values
+	s.RecordMiss("SELECT * FROM users WHERE id = 1", 10*time.Millisecond)
+	s.RecordMiss("SELECT * FROM users WHERE id = 2", 30*time.Millisecond)
+	for i := 0; i < 5; i++ {
+		s.RecordHit("SELECT * FROM users WHERE id = 1")
+	}
+
+	s.RecordMiss("SELECT count(*) FROM orders", 100*time.Millisecond)
+	s.RecordHit("SELECT count(*) FROM orders")
+
+	top, err := s.Top(5*time.Minute, 10)
+	if err != nil {
+		t.Fatalf("Top returned error: %v", err)
+	}
+	if len(top) != 2 {
+		t.Fatalf("Expected 2 fingerprints, got %d: %+v", len(top), top)
+	}
+
+	first := top[0]
+	if first.Fingerprint != "SELECT * FROM users WHERE id = ?" {
+		t.Errorf("Expected users query first, got %q", first.Fingerprint)
+	}
+	if first.Hits != 5 || first.Misses != 2 {
+		t.Errorf("Expected 5 hits and 2 misses, got %d and %d", first.Hits, first.Misses)
+	}
+	if first.AvgExec != 20*time.Millisecond {
+		t.Errorf("Expected avg exec 20ms, got %v", first.AvgExec)
+	}
+	if first.Saved != 100*time.Millisecond {
+		t.Errorf("Expected 100ms saved, got %v", first.Saved)
+	}
+
+	top, _ = s.Top(5*time.Minute, 1)
+	if len(top) != 1 {
+		t.Errorf("Expected k=1 to limit report, got %d entries", len(top))
+	}
+}
+
+func TestStats_WindowDecay(t *testing.T) {
+	s := NewStats(0)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	s.RecordMiss("SELECT 1", time.Millisecond)
+	s.RecordHit("SELECT 1")
+
+	now = now.Add(10 * time.Minute)
+	s.RecordHit("SELECT 1")
+
+	tests := []struct {
+		window time.Duration
+		hits   int64
+	}{
+		{5 * time.Minute, 1},
+		{time.Hour, 2},
+		{24 * time.Hour, 2},
+	}
+	for _, tt := range tests {
+		top, err := s.Top(tt.window, 10)
+		if err != nil {
+			t.Fatalf("Top(%v) returned error: %v", tt.window, err)
+		}
+		if len(top) != 1 || top[0].Hits != tt.hits {
+			t.Errorf("Top(%v) = %+v, want %d hits", tt.window, top, tt.hits)
+		}
+	}
+
+	// Everything decays out of the largest window
+	now = now.Add(25 * time.Hour)
+	if top, _ := s.Top(24*time.Hour, 10); len(top) != 0 {
+		t.Errorf("Expected empty report after 25h, got %+v", top)
+	}
+
+	if _, err := s.Top(time.Minute, 10); err == nil {
+		t.Error("Expected error for unsupported window")
+	}
+}
+
+func TestStats_MaxFingerprints(t *testing.T) {
+	s := NewStats(1)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	s.RecordHit("SELECT * FROM a")
+	s.RecordHit("SELECT * FROM b") // Full, ignored
+	if top, _ := s.Top(5*time.Minute, 10); len(top) != 1 {
+		t.Fatalf("Expected 1 tracked fingerprint, got %d", len(top))
+	}
+
+	// Stale entries are pruned to make room
+	now = now.Add(25 * time.Hour)
+	s.RecordHit("SELECT * FROM b")
+	top, _ := s.Top(5*time.Minute, 10)
+	if len(top) != 1 || top[0].Fingerprint != "SELECT * FROM b" {
+		t.Errorf("Expected SELECT * FROM b after prune, got %+v", top)
+	}
+
+	// The totals count untracked fingerprints too
+	s.RecordMiss("SELECT * FROM c", time.Millisecond)
+	if hits, misses := s.Totals(); hits != 3 || misses != 1 {
+		t.Errorf("Expected 3 hits and 1 miss, got %d and %d", hits, misses)
+	}
+}
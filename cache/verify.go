@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// MaxVerifications limits the verifications of sampled cache hits that run at
+// the same time, see Verifier.Acquire
+const MaxVerifications = 4
+
+// Verifier samples cache hits that the proxies verify against the backend: the
+// query is executed on the primary as well, and the checksum of its response
+// is compared with the checksum of the cached response. Mismatches show that
+// the cache (or serving stale results) returned data the backend no longer
+// has. A Verifier with a sample of 0, or a nil *Verifier, verifies nothing.
+type Verifier struct {
+	sample  atomic.Uint64 // math.Float64bits of the fraction of hits to verify
+	random  func() float64
+	running chan struct{} // Slots of the running verifications
+}
+
+// NewVerifier creates a verifier for the given fraction (0..1) of cache hits
+func NewVerifier(sample float64) *Verifier {
+	v := &Verifier{random: rand.Float64, running: make(chan struct{}, MaxVerifications)}
+	v.SetSample(sample)
+	return v
+}
+
+// SetSample changes the fraction (0..1) of cache hits to verify
+func (v *Verifier) SetSample(sample float64) {
+	if v == nil {
+		return
+	}
+	v.sample.Store(math.Float64bits(math.Max(0, math.Min(1, sample))))
+}
+
+// Sample reports whether a cache hit should be verified
+func (v *Verifier) Sample() bool {
+	if v == nil {
+		return false
+	}
+	sample := math.Float64frombits(v.sample.Load())
+	return sample > 0 && v.random() < sample
+}
+
+// Acquire takes a slot for the verification of a sampled cache hit, which the
+// proxies run in the background and end with Release. It reports false when
+// MaxVerifications verifications are running, the hit is then not verified.
+func (v *Verifier) Acquire() bool {
+	if v == nil {
+		return false
+	}
+	select {
+	case v.running <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees the slot of a verification taken with Acquire
+func (v *Verifier) Release() {
+	<-v.running
+}
+
+// Checksum returns the checksum of a response, as compared and logged by the
+// verification of cache hits
+func Checksum(response []byte) string {
+	h := fnv.New64a()
+	h.Write(response)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
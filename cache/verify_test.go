@@ -0,0 +1,64 @@
+package cache
+
+import "testing"
+
+func TestVerifier_Sample(t *testing.T) {
+	v := NewVerifier(0.25)
+	for _, tt := range []struct {
+		random float64
+		want   bool
+	}{{0, true}, {0.2, true}, {0.25, false}, {0.9, false}} {
+		v.random = func() float64 { return tt.random }
+		if got := v.Sample(); got != tt.want {
+			t.Errorf("Sample() with random %v = %v, want %v", tt.random, got, tt.want)
+		}
+	}
+
+	v.SetSample(0)
+	v.random = func() float64 { return 0 }
+	if v.Sample() {
+		t.Error("Expected no samples when disabled")
+	}
+	v.SetSample(5)
+	v.random = func() float64 { return 0.999 }
+	if !v.Sample() {
+		t.Error("Expected a sample above 1 to verify every hit")
+	}
+
+	var disabled *Verifier
+	disabled.SetSample(1)
+	if disabled.Sample() {
+		t.Error("Expected a nil verifier to verify nothing")
+	}
+}
+
+func TestVerifier_Acquire(t *testing.T) {
+	v := NewVerifier(1)
+	for i := 0; i < MaxVerifications; i++ {
+		if !v.Acquire() {
+			t.Fatalf("Expected slot %d to be free", i)
+		}
+	}
+	if v.Acquire() {
+		t.Error("Expected no slot while MaxVerifications verifications run")
+	}
+	v.Release()
+	if !v.Acquire() {
+		t.Error("Expected the released slot to be free")
+	}
+
+	var disabled *Verifier
+	if disabled.Acquire() {
+		t.Error("Expected a nil verifier to verify nothing")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	a, b := Checksum([]byte("row 1")), Checksum([]byte("row 2"))
+	if a == b || len(a) != 16 {
+		t.Errorf("Expected distinct 16 digit checksums, got %s and %s", a, b)
+	}
+	if Checksum([]byte("row 1")) != a {
+		t.Error("Expected the checksum to be deterministic")
+	}
+}
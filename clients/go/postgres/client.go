@@ -35,9 +35,8 @@ package postgres
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"path/filepath"
-	"runtime"
+
+	"github.com/mevdschee/tqdbproxy/clients/go/tqdbhint"
 )
 
 // DB wraps sql.DB to provide TTL-aware query methods
@@ -63,38 +62,10 @@ func Wrap(db *sql.DB) *DB {
 
 // QueryWithTTL executes a query with a cache TTL hint and caller metadata
 func (db *DB) QueryWithTTL(ctx context.Context, ttl int, query string, args ...any) (*sql.Rows, error) {
-	// Capture caller info
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "unknown"
-		line = 0
-	} else {
-		file = filepath.Base(file)
-	}
-
-	// Construct hint
-	hint := fmt.Sprintf("/* ttl:%d file:%s line:%d */", ttl, file, line)
-
-	// Prepend hint to query
-	hintedQuery := hint + " " + query
-
-	// Execute query
-	return db.DB.QueryContext(ctx, hintedQuery, args...)
+	return db.DB.QueryContext(ctx, tqdbhint.Hint{TTL: ttl}.At(1).Wrap(query), args...)
 }
 
 // QueryRowWithTTL executes a query that is expected to return at most one row
 func (db *DB) QueryRowWithTTL(ctx context.Context, ttl int, query string, args ...any) *sql.Row {
-	// Capture caller info
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "unknown"
-		line = 0
-	} else {
-		file = filepath.Base(file)
-	}
-
-	hint := fmt.Sprintf("/* ttl:%d file:%s line:%d */", ttl, file, line)
-	hintedQuery := hint + " " + query
-
-	return db.DB.QueryRowContext(ctx, hintedQuery, args...)
+	return db.DB.QueryRowContext(ctx, tqdbhint.Hint{TTL: ttl}.At(1).Wrap(query), args...)
 }
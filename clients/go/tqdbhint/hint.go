@@ -0,0 +1,112 @@
+// Package tqdbhint builds the SQL comment hints that tqdbproxy reads from a
+// query, with the file and line of the caller filled in automatically:
+//
+//	query := tqdbhint.TTL(60, "SELECT * FROM users WHERE id = $1")
+//	// /* ttl:60 file:user.go line:42 */ SELECT * FROM users WHERE id = $1
+//
+// The hints are formatted in the order the proxy expects, so that
+// applications no longer write the comments by hand. The helpers work with
+// any driver: Query, QueryRow and Exec take the method of the driver that
+// executes the query, such as QueryContext of database/sql or Query of a pgx
+// connection or pool:
+//
+//	rows, err := tqdbhint.Query(ctx, db.QueryContext, tqdbhint.Hint{TTL: 60}, "SELECT * FROM users")
+//	rows, err := tqdbhint.Query(ctx, pool.Query, tqdbhint.Hint{TTL: 60}, "SELECT * FROM users")
+//	_, err := tqdbhint.Exec(ctx, pool.Exec, tqdbhint.Hint{BatchMs: 10}, "INSERT INTO logs (msg) VALUES ($1)", msg)
+package tqdbhint
+
+import (
+	"context"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Hint holds the hints of a query, where zero values are left out
+type Hint struct {
+	TTL      int    // Seconds the result is cached
+	BatchMs  int    // Milliseconds a write may wait to be batched
+	MaxLagMs int    // Maximum replication lag in ms of a replica serving the read
+	Route    string // "primary", "replica" or a backend name
+	File     string // Source file of the query, set by At
+	Line     int    // Source line of the query, set by At
+}
+
+// At returns the hint with the file and line of a caller, where skip 0 is the
+// caller of At
+func (h Hint) At(skip int) Hint {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		h.File, h.Line = "unknown", 0
+		return h
+	}
+	h.File, h.Line = filepath.Base(file), line
+	return h
+}
+
+// String formats the hint as a comment in the order the proxy parses it, or
+// returns "" when the hint is empty
+func (h Hint) String() string {
+	var parts []string
+	if h.TTL > 0 {
+		parts = append(parts, "ttl:"+strconv.Itoa(h.TTL))
+	}
+	if file := strings.Join(strings.Fields(h.File), "_"); file != "" {
+		parts = append(parts, "file:"+file)
+	}
+	if h.Line > 0 {
+		parts = append(parts, "line:"+strconv.Itoa(h.Line))
+	}
+	if h.BatchMs > 0 {
+		parts = append(parts, "batch:"+strconv.Itoa(h.BatchMs))
+	}
+	if h.MaxLagMs > 0 {
+		parts = append(parts, "maxlag:"+strconv.Itoa(h.MaxLagMs))
+	}
+	if h.Route != "" {
+		parts = append(parts, "route:"+h.Route)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "/* " + strings.Join(parts, " ") + " */"
+}
+
+// Wrap prepends the hint to a query
+func (h Hint) Wrap(query string) string {
+	hint := h.String()
+	if hint == "" {
+		return query
+	}
+	return hint + " " + query
+}
+
+// TTL prepends a ttl hint and the caller to a query
+func TTL(ttl int, query string) string {
+	return Hint{TTL: ttl}.At(1).Wrap(query)
+}
+
+// Batch prepends a batch hint and the caller to a write
+func Batch(ms int, query string) string {
+	return Hint{BatchMs: ms}.At(1).Wrap(query)
+}
+
+// Query runs a query with the hint and the caller through fn, such as
+// QueryContext of a *sql.DB or Query of a pgx connection or pool
+func Query[R any](ctx context.Context, fn func(context.Context, string, ...any) (R, error), h Hint, query string, args ...any) (R, error) {
+	return fn(ctx, h.At(1).Wrap(query), args...)
+}
+
+// QueryRow runs a query that returns at most one row with the hint and the
+// caller through fn, such as QueryRowContext of a *sql.DB or QueryRow of a
+// pgx connection or pool
+func QueryRow[R any](ctx context.Context, fn func(context.Context, string, ...any) R, h Hint, query string, args ...any) R {
+	return fn(ctx, h.At(1).Wrap(query), args...)
+}
+
+// Exec runs a statement with the hint and the caller through fn, such as
+// ExecContext of a *sql.DB or Exec of a pgx connection or pool
+func Exec[R any](ctx context.Context, fn func(context.Context, string, ...any) (R, error), h Hint, query string, args ...any) (R, error) {
+	return fn(ctx, h.At(1).Wrap(query), args...)
+}
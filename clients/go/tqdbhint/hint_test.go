@@ -0,0 +1,66 @@
+package tqdbhint
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+func TestHint_String(t *testing.T) {
+	tests := []struct {
+		hint     Hint
+		expected string
+	}{
+		{Hint{}, ""},
+		{Hint{TTL: 60}, "/* ttl:60 */"},
+		{Hint{TTL: 60, File: "user.go", Line: 42}, "/* ttl:60 file:user.go line:42 */"},
+		{Hint{BatchMs: 10, File: "log.go", Line: 7}, "/* file:log.go line:7 batch:10 */"},
+		{Hint{TTL: 5, MaxLagMs: 500, Route: "replica"}, "/* ttl:5 maxlag:500 route:replica */"},
+		{Hint{File: "my file.go"}, "/* file:my_file.go */"},
+	}
+	for _, tt := range tests {
+		if got := tt.hint.String(); got != tt.expected {
+			t.Errorf("%+v.String() = %q, expected %q", tt.hint, got, tt.expected)
+		}
+	}
+}
+
+// TestHint_Parsed checks that the proxy reads back every field
+func TestHint_Parsed(t *testing.T) {
+	h := Hint{TTL: 60, BatchMs: 10, MaxLagMs: 500, Route: "primary", File: "user.go", Line: 42}
+	parsed := parser.Parse(h.Wrap("SELECT * FROM users"))
+	if parsed.TTL != 60 || parsed.BatchMs != 10 || parsed.MaxLagMs != 500 || parsed.Route != "primary" ||
+		parsed.File != "user.go" || parsed.Line != 42 || parsed.Query != "SELECT * FROM users" {
+		t.Errorf("Hint not parsed back, got %+v", parsed)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	query := TTL(60, "SELECT 1")
+	if !strings.HasPrefix(query, "/* ttl:60 file:hint_test.go line:") || !strings.HasSuffix(query, " */ SELECT 1") {
+		t.Errorf("Expected a ttl hint with the caller, got %q", query)
+	}
+	if query := Batch(10, "INSERT INTO t VALUES (1)"); !strings.Contains(query, "file:hint_test.go") || !strings.Contains(query, "batch:10 */") {
+		t.Errorf("Expected a batch hint with the caller, got %q", query)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	var got string
+	queryContext := func(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+		got = query
+		return nil, nil
+	}
+	Query(context.Background(), queryContext, Hint{TTL: 30}, "SELECT name FROM users WHERE id = $1", 1)
+	if !strings.HasPrefix(got, "/* ttl:30 file:hint_test.go line:") {
+		t.Errorf("Expected the hint with the caller of Query, got %q", got)
+	}
+
+	queryRow := func(ctx context.Context, query string, args ...any) string { return query }
+	if got := QueryRow(context.Background(), queryRow, Hint{Route: "replica"}, "SELECT 1"); !strings.Contains(got, "file:hint_test.go") {
+		t.Errorf("Expected the hint with the caller of QueryRow, got %q", got)
+	}
+}
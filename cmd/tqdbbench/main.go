@@ -0,0 +1,340 @@
+// Command tqdbbench runs a sysbench-like OLTP workload (point selects, range
+// scans, index updates, deletes and inserts) against the proxy, so that the
+// performance of the proxy itself can be compared between releases with a
+// standard workload.
+//
+// Usage:
+//
+//	tqdbbench -driver mysql -prepare
+//	tqdbbench -driver mysql -threads 64 -time 60 -cache-hints 0.5 -batch-hints 1
+//	tqdbbench -driver mysql -cleanup
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+// Default DSNs point at the proxy listeners
+var defaultDSNs = map[string]string{
+	"mysql":    "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy",
+	"postgres": "host=127.0.0.1 port=5433 user=tqdbproxy password=tqdbproxy dbname=tqdbproxy sslmode=disable",
+}
+
+// Operation names, in report order
+var operations = []string{"point_select", "simple_range", "sum_range", "order_range", "distinct_range",
+	"index_update", "non_index_update", "delete", "insert"}
+
+// options holds the workload settings
+type options struct {
+	driver      string
+	tables      int
+	tableSize   int
+	rangeSize   int
+	mode        string
+	tx          bool
+	cacheHints  float64
+	ttl         int
+	batchHints  float64
+	batchMs     int
+	pointSelect int
+}
+
+// stats collects the latencies of one operation type
+type stats struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	errors    atomic.Int64
+}
+
+func (s *stats) add(d time.Duration) {
+	s.mu.Lock()
+	s.latencies = append(s.latencies, d)
+	s.mu.Unlock()
+}
+
+// percentile returns the p-th percentile of the sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func main() {
+	var o options
+	flag.StringVar(&o.driver, "driver", "mysql", "Database driver: mysql or postgres")
+	dsn := flag.String("dsn", "", "Data source name (default: the proxy on localhost)")
+	flag.IntVar(&o.tables, "tables", 1, "Number of sbtest tables")
+	flag.IntVar(&o.tableSize, "table-size", 10000, "Rows per table")
+	flag.IntVar(&o.rangeSize, "range-size", 100, "Rows per range scan")
+	flag.IntVar(&o.pointSelect, "point-selects", 10, "Point selects per event")
+	flag.StringVar(&o.mode, "mode", "read-write", "Workload: read-write, read-only or write-only")
+	flag.BoolVar(&o.tx, "tx", false, "Wrap each event in a transaction (disables batching)")
+	flag.Float64Var(&o.cacheHints, "cache-hints", 0, "Fraction of reads with a ttl hint (0-1)")
+	flag.IntVar(&o.ttl, "ttl", 60, "TTL in seconds for reads with a ttl hint")
+	flag.Float64Var(&o.batchHints, "batch-hints", 0, "Fraction of writes with a batch hint (0-1)")
+	flag.IntVar(&o.batchMs, "batch-ms", 10, "Batch window in ms for writes with a batch hint")
+	threads := flag.Int("threads", 16, "Number of concurrent connections")
+	duration := flag.Duration("time", 10*time.Second, "Duration of the run")
+	prepare := flag.Bool("prepare", false, "Create and fill the tables, then exit")
+	cleanup := flag.Bool("cleanup", false, "Drop the tables, then exit")
+	csvFile := flag.String("csv", "", "Append a result line to this CSV file")
+	flag.Parse()
+
+	if *dsn == "" {
+		*dsn = defaultDSNs[o.driver]
+	}
+	db, err := sql.Open(o.driver, *dsn)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(*threads)
+	db.SetMaxIdleConns(*threads)
+
+	switch {
+	case *prepare:
+		if err := prepareTables(db, o); err != nil {
+			log.Fatalf("Prepare failed: %v", err)
+		}
+		return
+	case *cleanup:
+		for t := 1; t <= o.tables; t++ {
+			if _, err := db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS sbtest%d", t)); err != nil {
+				log.Fatalf("Cleanup failed: %v", err)
+			}
+		}
+		return
+	}
+
+	results := make(map[string]*stats)
+	for _, op := range operations {
+		results[op] = &stats{}
+	}
+	var events atomic.Int64
+
+	fmt.Printf("Running %s workload on %s: %d threads, %s, cache hints %.0f%%, batch hints %.0f%%\n",
+		o.mode, o.driver, *threads, *duration, o.cacheHints*100, o.batchHints*100)
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &worker{db: db, o: o, results: results}
+			for time.Now().Before(deadline) {
+				if err := w.event(); err != nil {
+					log.Printf("Event error: %v", err)
+					continue
+				}
+				events.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	report(o, results, events.Load(), *duration, *csvFile)
+}
+
+// prepareTables creates the sbtest tables and fills them in chunks
+func prepareTables(db *sql.DB, o options) error {
+	for t := 1; t <= o.tables; t++ {
+		table := fmt.Sprintf("sbtest%d", t)
+		ddl := fmt.Sprintf("CREATE TABLE %s (id INTEGER NOT NULL AUTO_INCREMENT, k INTEGER NOT NULL DEFAULT 0, "+
+			"c CHAR(120) NOT NULL DEFAULT '', pad CHAR(60) NOT NULL DEFAULT '', PRIMARY KEY (id), KEY k_%d (k))", table, t)
+		if o.driver == "postgres" {
+			ddl = fmt.Sprintf("CREATE TABLE %s (id SERIAL PRIMARY KEY, k INTEGER NOT NULL DEFAULT 0, "+
+				"c CHAR(120) NOT NULL DEFAULT '', pad CHAR(60) NOT NULL DEFAULT '')", table)
+		}
+		if _, err := db.Exec(ddl); err != nil {
+			return err
+		}
+		if o.driver == "postgres" {
+			if _, err := db.Exec(fmt.Sprintf("CREATE INDEX k_%d ON %s (k)", t, table)); err != nil {
+				return err
+			}
+		}
+
+		const chunk = 1000
+		for start := 0; start < o.tableSize; start += chunk {
+			var values []string
+			var args []interface{}
+			for i := start; i < start+chunk && i < o.tableSize; i++ {
+				values = append(values, "(?, ?, ?)")
+				args = append(args, rand.IntN(o.tableSize)+1, randomChars(120), randomChars(60))
+			}
+			query := fmt.Sprintf("INSERT INTO %s (k, c, pad) VALUES %s", table, strings.Join(values, ", "))
+			if _, err := db.Exec(placeholders(o.driver, query), args...); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Created %s with %d rows\n", table, o.tableSize)
+	}
+	return nil
+}
+
+// worker runs events on one connection at a time
+type worker struct {
+	db      *sql.DB
+	o       options
+	results map[string]*stats
+	conn    interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+		Query(query string, args ...interface{}) (*sql.Rows, error)
+	}
+}
+
+// event runs one sysbench OLTP event, optionally in a transaction
+func (w *worker) event() error {
+	w.conn = w.db
+	var tx *sql.Tx
+	if w.o.tx {
+		var err error
+		if tx, err = w.db.Begin(); err != nil {
+			return err
+		}
+		w.conn = tx
+	}
+
+	table := fmt.Sprintf("sbtest%d", rand.IntN(w.o.tables)+1)
+	if w.o.mode != "write-only" {
+		for i := 0; i < w.o.pointSelect; i++ {
+			w.read("point_select", "SELECT c FROM "+table+" WHERE id = ?", w.id())
+		}
+		start := w.id()
+		end := start + w.o.rangeSize - 1
+		w.read("simple_range", "SELECT c FROM "+table+" WHERE id BETWEEN ? AND ?", start, end)
+		w.read("sum_range", "SELECT SUM(k) FROM "+table+" WHERE id BETWEEN ? AND ?", start, end)
+		w.read("order_range", "SELECT c FROM "+table+" WHERE id BETWEEN ? AND ? ORDER BY c", start, end)
+		w.read("distinct_range", "SELECT DISTINCT c FROM "+table+" WHERE id BETWEEN ? AND ? ORDER BY c", start, end)
+	}
+	if w.o.mode != "read-only" {
+		id := w.id()
+		w.write("index_update", "UPDATE "+table+" SET k = k + 1 WHERE id = ?", w.id())
+		w.write("non_index_update", "UPDATE "+table+" SET c = ? WHERE id = ?", randomChars(120), w.id())
+		w.write("delete", "DELETE FROM "+table+" WHERE id = ?", id)
+		w.write("insert", "INSERT INTO "+table+" (id, k, c, pad) VALUES (?, ?, ?, ?)", id, w.id(), randomChars(120), randomChars(60))
+	}
+
+	if tx != nil {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// id returns a random row id
+func (w *worker) id() int {
+	return rand.IntN(w.o.tableSize) + 1
+}
+
+// read runs a query, with a ttl hint for the configured fraction of reads
+func (w *worker) read(op, query string, args ...interface{}) {
+	if rand.Float64() < w.o.cacheHints {
+		query = fmt.Sprintf("/* ttl:%d */ %s", w.o.ttl, query)
+	}
+	start := time.Now()
+	rows, err := w.conn.Query(placeholders(w.o.driver, query), args...)
+	if err == nil {
+		for rows.Next() {
+		}
+		err = rows.Err()
+		rows.Close()
+	}
+	w.record(op, start, err)
+}
+
+// write runs a statement, with a batch hint for the configured fraction of writes
+func (w *worker) write(op, query string, args ...interface{}) {
+	if rand.Float64() < w.o.batchHints {
+		query = fmt.Sprintf("/* batch:%d */ %s", w.o.batchMs, query)
+	}
+	start := time.Now()
+	_, err := w.conn.Exec(placeholders(w.o.driver, query), args...)
+	w.record(op, start, err)
+}
+
+func (w *worker) record(op string, start time.Time, err error) {
+	if err != nil {
+		w.results[op].errors.Add(1)
+		return
+	}
+	w.results[op].add(time.Since(start))
+}
+
+// placeholders translates '?' placeholders for PostgreSQL
+func placeholders(driver, query string) string {
+	if driver == "postgres" {
+		query, _ = parser.TranslatePlaceholders(query)
+	}
+	return query
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// randomChars returns n random characters, like the sysbench c and pad columns
+func randomChars(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.IntN(len(letters))]
+	}
+	return string(b)
+}
+
+// report prints throughput and latency percentiles per operation, and
+// appends a summary line to the CSV file if set
+func report(o options, results map[string]*stats, events int64, duration time.Duration, csvFile string) {
+	secs := duration.Seconds()
+	var queries, errors int64
+	var all []time.Duration
+
+	fmt.Printf("\n%-18s %10s %10s %10s %10s %10s %8s\n", "Operation", "Count", "QPS", "p50", "p95", "p99", "Errors")
+	fmt.Println(strings.Repeat("-", 82))
+	for _, op := range operations {
+		s := results[op]
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		count := int64(len(s.latencies))
+		if count == 0 && s.errors.Load() == 0 {
+			continue
+		}
+		queries += count
+		errors += s.errors.Load()
+		all = append(all, s.latencies...)
+		fmt.Printf("%-18s %10d %10.0f %10s %10s %10s %8d\n", op, count, float64(count)/secs,
+			percentile(s.latencies, 0.50).Round(time.Microsecond), percentile(s.latencies, 0.95).Round(time.Microsecond),
+			percentile(s.latencies, 0.99).Round(time.Microsecond), s.errors.Load())
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	p95 := percentile(all, 0.95)
+	fmt.Println(strings.Repeat("-", 82))
+	fmt.Printf("Events: %d (%.1f/s), queries: %d (%.0f/s), errors: %d, p95 latency: %s\n",
+		events, float64(events)/secs, queries, float64(queries)/secs, errors, p95.Round(time.Microsecond))
+
+	if csvFile == "" {
+		return
+	}
+	f, err := os.OpenFile(csvFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open CSV file: %v", err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		fmt.Fprintln(f, "Time,Driver,Mode,CacheHints,BatchHints,EventsPerSec,QPS,P95Ms,Errors")
+	}
+	fmt.Fprintf(f, "%s,%s,%s,%.2f,%.2f,%.1f,%.0f,%.3f,%d\n", time.Now().Format(time.RFC3339), o.driver, o.mode,
+		o.cacheHints, o.batchHints, float64(events)/secs, float64(queries)/secs, float64(p95.Microseconds())/1000, errors)
+}
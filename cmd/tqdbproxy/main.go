@@ -8,34 +8,56 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/mevdschee/tqdbproxy/admin"
+	"github.com/mevdschee/tqdbproxy/alert"
+	"github.com/mevdschee/tqdbproxy/audit"
 	"github.com/mevdschee/tqdbproxy/cache"
 	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/killswitch"
+	"github.com/mevdschee/tqdbproxy/logging"
 	"github.com/mevdschee/tqdbproxy/mariadb"
+	"github.com/mevdschee/tqdbproxy/memlimit"
 	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/override"
 	"github.com/mevdschee/tqdbproxy/postgres"
 	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/selftest"
+	"github.com/mevdschee/tqdbproxy/slowlog"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
 )
 
 func main() {
 	configPath := flag.String("config", "config.ini", "Path to configuration file")
 	metricsAddr := flag.String("metrics", ":9090", "Metrics endpoint address")
+	selftestMode := flag.Bool("selftest", false, "Run a self-test through both listeners after startup, print a PASS/FAIL report and exit")
 	flag.Parse()
 
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if err := logging.Configure(logConfig(cfg.Log)); err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
 
 	// Initialize metrics
 	metrics.Init()
+	metrics.SetMaxLabelSets(cfg.Metrics.MaxLabelSets)
+
+	// Initialize alerting
+	alert.Configure(alertConfig(cfg.Alerts))
 
-	// Start metrics HTTP server with pprof
+	// Start metrics HTTP server with pprof and admin endpoints
+	adminServer := admin.New()
 	go func() {
 		http.Handle("/metrics", metrics.Handler())
+		http.Handle("/admin/", adminServer.Handler())
 		log.Printf("Metrics endpoint at http://localhost%s/metrics", *metricsAddr)
+		log.Printf("Admin endpoints at http://localhost%s/admin/", *metricsAddr)
 		log.Printf("Pprof endpoints at http://localhost%s/debug/pprof/", *metricsAddr)
 		if err := http.ListenAndServe(*metricsAddr, nil); err != nil {
 			log.Printf("Metrics server error: %v", err)
@@ -43,18 +65,51 @@ func main() {
 	}()
 
 	// Initialize cache with thundering herd protection
-	queryCache, err := cache.New(cache.DefaultCacheConfig())
+	queryCache, err := cache.New(cacheConfig(cfg.Cache))
 	if err != nil {
 		log.Fatalf("Failed to create cache: %v", err)
 	}
+	adminServer.SetCacheStats(queryCache.Stats())
+
+	// Runtime overrides of query hints, managed through the admin API
+	overrides := override.New()
+	adminServer.SetOverrides(overrides)
+
+	// Kill switches of the proxy features, toggled with SET GLOBAL
+	switches := killswitch.New()
+	configureKillSwitches(switches, cfg.Switches, config.KillSwitchConfig{}, *configPath)
+	adminServer.SetKillSwitches(switches)
+
+	// Soft memory limit, near which cache entries are evicted and batches
+	// and response buffers shrink
+	memory := memlimit.New()
+	memory.Configure(cfg.Memory.SoftLimitMB, cfg.Memory.PressureBufferKB)
+	memory.OnPressure("cache", func() int { return queryCache.Shrink(0.5) })
+
+	// Slow query log of both proxies
+	slowLog := slowlog.New()
+	slowLog.Configure(slowLogConfig(cfg.SlowLog))
+	adminServer.SetSlowLog(slowLog)
+
+	// Audit log of both proxies, written by a background goroutine
+	auditLog := audit.New(cfg.Audit.BufferSize)
+	if err := auditLog.Configure(auditConfig(cfg.Audit)); err != nil {
+		log.Fatalf("Failed to configure audit log: %v", err)
+	}
 
 	// Create MariaDB pools
 	mariadbPools := initPools(cfg.MariaDB.Backends)
+	adminServer.SetPools("mariadb", mariadbPools)
 	log.Printf("[MariaDB] Initialized %d backend pools", len(mariadbPools))
 
 	// Start health checks for all MariaDB pools
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	go alert.StartMemoryMonitor(ctx, 10*time.Second)
+	go memory.Run(ctx, time.Second)
+	go auditLog.Run(ctx)
+	go tlsopt.Watch(ctx, time.Minute)
+	go queryCache.RunRefresh(ctx, 100*time.Millisecond)
 	for name, pool := range mariadbPools {
 		go pool.StartHealthChecks(ctx, 10*time.Second)
 		log.Printf("[MariaDB] Pool %s primary: %s", name, pool.GetPrimary())
@@ -62,12 +117,20 @@ func main() {
 
 	// Start MariaDB proxy with config and pools
 	mariadbProxy := mariadb.New(cfg.MariaDB, mariadbPools, queryCache)
+	mariadbProxy.SetOverrides(overrides)
+	mariadbProxy.SetKillSwitches(switches)
+	mariadbProxy.SetMemory(memory)
+	mariadbProxy.SetSlowLog(slowLog)
+	mariadbProxy.SetAudit(auditLog)
+	adminServer.SetQuotas("mariadb", mariadbProxy.Quotas())
+	adminServer.SetHistories("mariadb", mariadbProxy.Histories())
 	if err := mariadbProxy.Start(); err != nil {
 		log.Fatalf("Failed to start MariaDB proxy: %v", err)
 	}
 
 	// Create PostgreSQL pools
 	pgPools := initPools(cfg.Postgres.Backends)
+	adminServer.SetPools("postgres", pgPools)
 	log.Printf("[PostgreSQL] Initialized %d backend pools", len(pgPools))
 
 	// Start health checks for all PostgreSQL pools
@@ -78,10 +141,30 @@ func main() {
 
 	// Start PostgreSQL proxy with config and pools
 	pgProxy := postgres.New(cfg.Postgres, pgPools, queryCache)
+	pgProxy.SetOverrides(overrides)
+	pgProxy.SetKillSwitches(switches)
+	pgProxy.SetMemory(memory)
+	pgProxy.SetSlowLog(slowLog)
+	pgProxy.SetAudit(auditLog)
+	adminServer.SetQuotas("postgres", pgProxy.Quotas())
+	adminServer.SetHistories("postgres", pgProxy.Histories())
 	if err := pgProxy.Start(); err != nil {
 		log.Fatalf("Failed to start PostgreSQL proxy: %v", err)
 	}
 
+	if *selftestMode {
+		testCtx, testCancel := context.WithTimeout(ctx, time.Minute)
+		report := selftest.Run(testCtx, selftestTargets(cfg))
+		testCancel()
+		report.Print(os.Stdout)
+		shutdownProxies(mariadbProxy, pgProxy, cfg)
+		auditLog.Close()
+		if !report.Passed() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Println("TQDBProxy started. Press Ctrl+C to stop. Send SIGHUP to reload config.")
 
 	// Handle signals
@@ -96,32 +179,172 @@ func main() {
 			newCfg, err := config.Load(*configPath)
 			if err != nil {
 				log.Printf("Failed to reload config: %v", err)
+				alert.Fire(alert.ConfigReloadFailed, "failed to reload configuration", map[string]string{
+					"path":  *configPath,
+					"error": err.Error(),
+				})
 				continue
 			}
 
+			if err := logging.Configure(logConfig(newCfg.Log)); err != nil {
+				log.Printf("Failed to reconfigure logging, keeping the previous settings: %v", err)
+			}
+			alert.Configure(alertConfig(newCfg.Alerts))
+			metrics.SetMaxLabelSets(newCfg.Metrics.MaxLabelSets)
+			configureKillSwitches(switches, newCfg.Switches, cfg.Switches, *configPath)
+			memory.Configure(newCfg.Memory.SoftLimitMB, newCfg.Memory.PressureBufferKB)
+			tlsopt.Reload()
+			slowLog.Configure(slowLogConfig(newCfg.SlowLog))
+			if err := auditLog.Configure(auditConfig(newCfg.Audit)); err != nil {
+				log.Printf("Failed to reconfigure audit log: %v", err)
+			}
+
+			// Apply changed cache settings, which drops the cached results
+			// unless only the limits or the refresh ahead time changed
+			if newCfg.Cache != cfg.Cache {
+				if err := queryCache.Reconfigure(cacheConfig(newCfg.Cache)); err != nil {
+					log.Printf("Failed to reconfigure cache: %v", err)
+				} else if newCfg.Cache.Workers != cfg.Cache.Workers || newCfg.Cache.StaleMultiplier != cfg.Cache.StaleMultiplier {
+					log.Printf("Cache reconfigured - %d MB, cached results dropped", newCfg.Cache.MaxMemoryMB)
+				} else {
+					log.Printf("Cache limits reconfigured - %d MB, %d entries, refresh ahead %d ms", newCfg.Cache.MaxMemoryMB, newCfg.Cache.MaxEntries, newCfg.Cache.RefreshAheadMs)
+				}
+			}
+
 			// Update MariaDB pools
 			mariadbPools = updatePools(mariadbPools, newCfg.MariaDB.Backends, ctx)
 			mariadbProxy.UpdateConfig(newCfg.MariaDB, mariadbPools)
+			adminServer.SetPools("mariadb", mariadbPools)
 			log.Printf("[MariaDB] Reloaded - %d backends", len(newCfg.MariaDB.Backends))
 
 			// Update PostgreSQL pools
 			pgPools = updatePools(pgPools, newCfg.Postgres.Backends, ctx)
 			pgProxy.UpdateConfig(newCfg.Postgres, pgPools)
+			adminServer.SetPools("postgres", pgPools)
 			log.Printf("[PostgreSQL] Reloaded - %d backends", len(newCfg.Postgres.Backends))
 
+			cfg = newCfg
 			log.Println("Configuration reloaded successfully")
 
 		case syscall.SIGINT, syscall.SIGTERM:
-			log.Println("Shutting down...")
+			log.Println("Shutting down, draining client connections...")
+			go func() {
+				// A second signal skips the draining
+				<-sigChan
+				log.Println("Forced shutdown")
+				os.Exit(1)
+			}()
+			shutdownProxies(mariadbProxy, pgProxy, cfg)
+			auditLog.Close()
+			log.Println("Shutdown complete")
 			return
 		}
 	}
 }
 
+// shutdownProxies drains and stops both proxies at the same time
+func shutdownProxies(mariadbProxy *mariadb.Proxy, pgProxy *postgres.Proxy, cfg *config.Config) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go shutdownProxy(&wg, "MariaDB", mariadbProxy, cfg.MariaDB.DrainTimeout)
+	go shutdownProxy(&wg, "PostgreSQL", pgProxy, cfg.Postgres.DrainTimeout)
+	wg.Wait()
+}
+
+// shutdownProxy drains and stops a proxy, allowing its client sessions
+// drainTimeout seconds to end
+func shutdownProxy(wg *sync.WaitGroup, name string, proxy interface{ Shutdown(context.Context) error }, drainTimeout int) {
+	defer wg.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		log.Printf("[%s] Shutdown error: %v", name, err)
+	}
+}
+
+// selftestTargets returns the listeners of both proxies, with the
+// credentials of their default backends
+func selftestTargets(cfg *config.Config) []selftest.Target {
+	mariadbBackend := cfg.MariaDB.Backends[cfg.MariaDB.Default]
+	pgBackend := cfg.Postgres.Backends[cfg.Postgres.Default]
+	return []selftest.Target{
+		{Protocol: selftest.MariaDB, Addr: cfg.MariaDB.Listen, User: mariadbBackend.Username, Password: mariadbBackend.Password, Database: mariadbBackend.Database},
+		{Protocol: selftest.Postgres, Addr: cfg.Postgres.Listen, User: pgBackend.Username, Password: pgBackend.Password, Database: pgBackend.Database},
+	}
+}
+
+func alertConfig(cfg config.AlertConfig) alert.Config {
+	return alert.Config{
+		WebhookURL:            cfg.WebhookURL,
+		Script:                cfg.Script,
+		BatchFailureThreshold: cfg.BatchFailureThreshold,
+		MemoryThresholdMB:     cfg.MemoryThresholdMB,
+	}
+}
+
+// configureKillSwitches applies the [killswitches] section. Only switches
+// that changed in the file since it was last read are set, so that a reload
+// does not undo a switch toggled with SET GLOBAL that was not persisted.
+func configureKillSwitches(switches *killswitch.Switches, cfg, previous config.KillSwitchConfig, configPath string) {
+	persistPath := ""
+	if cfg.Persist {
+		persistPath = configPath
+	}
+	switches.Configure(cfg.AuditFile, persistPath)
+	for _, feature := range killswitch.Features {
+		enabled := cfg.Enabled[feature]
+		if was, ok := previous.Enabled[feature]; (ok && was != enabled) || (!ok && !enabled) {
+			switches.Set(feature, enabled, killswitch.ByConfig)
+		}
+	}
+}
+
+func logConfig(cfg config.LogConfig) logging.Config {
+	return logging.Config{
+		Level:     cfg.Level,
+		Format:    cfg.Format,
+		QueryText: cfg.QueryText,
+	}
+}
+
+func slowLogConfig(cfg config.SlowLogConfig) slowlog.Config {
+	return slowlog.Config{
+		Threshold: time.Duration(cfg.ThresholdMs) * time.Millisecond,
+		Size:      cfg.Size,
+		File:      cfg.File,
+		MaxFileMB: cfg.MaxFileMB,
+		Explain:   cfg.Explain,
+	}
+}
+
+func auditConfig(cfg config.AuditConfig) audit.Config {
+	return audit.Config{
+		Mode:          cfg.Mode,
+		File:          cfg.File,
+		Table:         cfg.Table,
+		TableDriver:   cfg.TableDriver,
+		TableDSN:      cfg.TableDSN,
+		FlushInterval: time.Duration(cfg.FlushIntervalMs) * time.Millisecond,
+		Block:         cfg.Block,
+	}
+}
+
+func cacheConfig(cfg config.CacheConfig) cache.CacheConfig {
+	return cache.CacheConfig{
+		MaxMemory:       int64(cfg.MaxMemoryMB) * 1024 * 1024,
+		MaxEntries:      cfg.MaxEntries,
+		MaxEntrySize:    int64(cfg.MaxEntryKB) * 1024,
+		Workers:         cfg.Workers,
+		StaleMultiplier: cfg.StaleMultiplier,
+		RefreshAhead:    time.Duration(cfg.RefreshAheadMs) * time.Millisecond,
+	}
+}
+
 func initPools(backends map[string]config.BackendConfig) map[string]*replica.Pool {
 	pools := make(map[string]*replica.Pool)
 	for name, backend := range backends {
 		pools[name] = replica.NewPool(backend.Primary, backend.Replicas)
+		pools[name].SetPolicy(backend.ReplicaPolicy, backend.ReplicaWeights)
 	}
 	return pools
 }
@@ -133,9 +356,11 @@ func updatePools(current map[string]*replica.Pool, backends map[string]config.Ba
 	for name, backend := range backends {
 		if pool, exists := current[name]; exists {
 			pool.UpdateReplicas(backend.Primary, backend.Replicas)
+			pool.SetPolicy(backend.ReplicaPolicy, backend.ReplicaWeights)
 			newPools[name] = pool
 		} else {
 			pool := replica.NewPool(backend.Primary, backend.Replicas)
+			pool.SetPolicy(backend.ReplicaPolicy, backend.ReplicaWeights)
 			go pool.StartHealthChecks(ctx, 10*time.Second)
 			newPools[name] = pool
 		}
@@ -1,10 +1,21 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
 
+	"github.com/mevdschee/tqdbproxy/annotate"
+	"github.com/mevdschee/tqdbproxy/conform"
+	"github.com/mevdschee/tqdbproxy/killswitch"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/proxyproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
 	"gopkg.in/ini.v1"
 )
 
@@ -12,6 +23,78 @@ import (
 type Config struct {
 	MariaDB  ProxyConfig
 	Postgres ProxyConfig
+	Alerts   AlertConfig
+	Cache    CacheConfig
+	Switches KillSwitchConfig
+	Memory   MemoryConfig
+	Log      LogConfig
+	SlowLog  SlowLogConfig
+	Audit    AuditConfig
+	Metrics  MetricsConfig
+}
+
+// MetricsConfig holds the settings of the Prometheus metrics
+type MetricsConfig struct {
+	MaxLabelSets int // Label combinations per metric labeled by client hints, beyond which they are recorded as other (default: 10000, 0 = unlimited)
+}
+
+// AuditConfig holds the audit log settings
+type AuditConfig struct {
+	Mode            string // Statements recorded: off, writes or all (default: off)
+	File            string // Append-only file the records are written to as JSON lines (empty = none)
+	Table           string // Table the records are inserted into (empty = none)
+	TableDriver     string // Driver of the table database: mysql or postgres (default: mysql)
+	TableDSN        string // Data source name of the table database
+	BufferSize      int    // Records buffered for the writer, read at startup (default: 10000)
+	FlushIntervalMs int    // Maximum time in ms a record is buffered (default: 1000)
+	Block           bool   // Wait for the writer when the buffer is full instead of dropping records (default: false)
+}
+
+// SlowLogConfig holds the slow query log settings
+type SlowLogConfig struct {
+	ThresholdMs int    // Latency in ms from which a statement is logged (0 = disabled)
+	Size        int    // Slow statements kept in memory for SHOW TQDB SLOW QUERIES (default: 100)
+	File        string // File the slow statements are appended to as JSON lines (empty = memory only)
+	MaxFileMB   int    // Size in MB at which the file is rotated (default: 100)
+	Explain     bool   // Run EXPLAIN for slow SELECTs and record the plan (default: false)
+}
+
+// LogConfig holds the log output settings
+type LogConfig struct {
+	Level     string // Minimum level: debug, info, warn or error (default: info)
+	Format    string // Output format: text or json (default: text)
+	QueryText string // Query text in the logs: none, redacted or full (default: redacted)
+}
+
+// MemoryConfig holds the soft memory limit of the process
+type MemoryConfig struct {
+	SoftLimitMB      int // Memory limit of the Go runtime, near which load is shed, see package memlimit (0 = disabled)
+	PressureBufferKB int // KB of a response buffered in memory under pressure, the rest spills to disk (default: 256)
+}
+
+// KillSwitchConfig holds the kill switches of the proxy features
+type KillSwitchConfig struct {
+	Enabled   map[string]bool // Feature -> enabled, see killswitch.Features (default: all enabled)
+	Persist   bool            // Write switches toggled with SET GLOBAL back to the config file (default: false)
+	AuditFile string          // File the toggled switches are appended to as JSON lines (empty = log only)
+}
+
+// CacheConfig holds configuration for the query cache shared by both proxies
+type CacheConfig struct {
+	MaxMemoryMB     int     // Maximum memory of cached results in MB (default: 64)
+	MaxEntries      int     // Maximum number of cached results (default: 0 = unlimited)
+	MaxEntryKB      int     // Maximum size of a cached result in KB (default: 0 = max_memory_mb)
+	Workers         int     // Number of cache worker goroutines (default: 4)
+	StaleMultiplier float64 // Hard expiry of a result as a multiple of its TTL, serving it stale in between (default: 2.0)
+	RefreshAheadMs  int     // Ms before the TTL of a hot result expires at which it is refreshed in the background (default: 0 = disabled)
+}
+
+// AlertConfig holds configuration for critical event notifications
+type AlertConfig struct {
+	WebhookURL            string // URL that receives a JSON POST per event
+	Script                string // Script executed per event with the JSON on stdin
+	BatchFailureThreshold int    // Failed write batches per minute before alerting (0 = disabled)
+	MemoryThresholdMB     int    // Heap size in MB before alerting (0 = disabled)
 }
 
 // ProxyConfig holds configuration for a protocol proxy with multiple backends
@@ -22,18 +105,266 @@ type ProxyConfig struct {
 	Backends   map[string]BackendConfig // Backend pool configurations
 	DBMap      map[string]string        // Mapping of database names to backend names
 	WriteBatch WriteBatchConfig         // Write batching configuration
+
+	ReplicaDatabases map[string]string // Read-only database name -> database it exposes on the replicas of its backend, from replica_databases
+
+	ImmediateWriteLimit int // Max concurrent non-batched writes across all backends (0 = unlimited)
+	MetadataCacheTTL    int // TTL in seconds for cached schema metadata queries (0 = disabled)
+	MaxConnectionsWait  int // Seconds a new backend connection waits for a free slot (0 = reject immediately)
+	BatchMinMs          int // Lower bound for batch hints in ms (0 = no limit)
+	BatchMaxMs          int // Upper bound for batch hints in ms (0 = no limit)
+	ReadRetries         int // Times a failed non-transactional SELECT is retried on another node (0 = disabled)
+	DrainTimeout        int // Seconds shutdown waits for client sessions to end before closing them
+	QueryHistory        int // Statements kept per connection for SHOW TQDB HISTORY and the admin API (0 = disabled)
+
+	SpillThreshold int    // Bytes of a read response held in memory before the rest is written to a temporary file, see package spill (0 = disabled)
+	SpillDir       string // Directory of the spill files (default: the system temporary directory)
+
+	StrictProtocol string // Checks of the packets exchanged with clients, see package conform: off, log or fault
+
+	AdminUsers []string // Client users allowed to toggle kill switches with SET GLOBAL tqdb_<feature>, see package killswitch
+
+	AllowUsers    []string            // Client users that may connect, see package acl (empty = all)
+	DenyUsers     []string            // Client users that may not connect
+	ReadOnlyUsers []string            // Client users whose writes are rejected by the proxy
+	UserDatabases map[string][]string // User -> databases and backends the user may use, from the [protocol.acl] section (no entry = all)
+
+	CacheVerifySample float64 // Fraction of cache hits also executed on the primary to compare checksums (0 = disabled)
+	CacheBoostQPS     float64 // Rate per second of identical SELECTs without a ttl hint at which they get micro-cached (0 = disabled)
+	CacheBoostMaxMs   int     // TTL in ms of micro-cached SELECTs at twice the boost rate and above
+	CacheNegativeTTL  int     // TTL in seconds of empty results and deterministic errors of SELECTs with a ttl hint but no negcache hint (0 = disabled)
+	CacheNormalize    bool    // Key cached SELECTs on their normalized query and values, see parser.NormalizedKey
+
+	Annotate    string // Comment prefixed to queries sent to backends, see package annotate (empty = disabled)
+	PrepareFile string // Statements prepared on the backends when the pools are created, see package warmup (empty = disabled)
+
+	QuestionPlaceholders bool   // Translate '?' placeholders in prepared statements to $1..$n (PostgreSQL only)
+	Collation            string // Backend collation for the write batch pool and clients with an unknown collation (MariaDB only)
+	Auth                 string // Client authentication: cleartext, md5 or scram-sha-256 (PostgreSQL only)
+	AuthFile             string // User list with the passwords for md5 and scram-sha-256 (PostgreSQL only)
+	BinlogInvalidate     bool   // Follow the binlog of the primaries to invalidate changed tables, see package binlog (MariaDB only)
+	BinlogServerID       int    // Replication server ID of the first binlog listener, counting up per backend (0 = random)
+	LogicalInvalidate    bool   // Consume a logical replication slot of the primaries to invalidate changed tables, see package logical (PostgreSQL only)
+	LogicalPublication   string // Publication streamed to the logical replication slots
+
+	BatchGuard        bool     // Execute batchable UPDATE/DELETE immediately unless they match a key column
+	BatchGuardColumns []string // Key columns for the batch guard, as "column" or "table.column"
+
+	RelaxedDurabilityTables []string // Tables whose batches may commit with the durability hint, "*" for all (PostgreSQL only)
+
+	TCP TCPConfig // TCP options for client connections, and defaults for backend connections
+
+	ProxyProtocol     bool     // Client connections on the TCP listener start with a PROXY protocol header, see package proxyproto
+	ProxyProtocolFrom []string // Addresses and networks of the load balancers that may send the header (empty = all)
+
+	Listeners []ListenerConfig // More listeners, from [protocol.listener.name] sections, see Listener
+
+	TableRoutes []TableRoute // Backends of tables, from the [protocol.routing] section, see RouteTables
+
+	Throttle ThrottleConfig // Limits per client address, user and backend, see package throttle
+
+	Quota  QuotaConfig            // Budgets of each database without its own
+	Quotas map[string]QuotaConfig // Budgets per database, from [protocol.quota.database] sections
+}
+
+// ListenerConfig holds the settings of a listener of a protocol proxy. The
+// listener without name has the listen address and socket of the [protocol]
+// section, the others are configured in [protocol.listener.name] sections.
+// All listeners of a protocol share its backends, cache and write batch.
+type ListenerConfig struct {
+	Name              string
+	Listen            string   // TCP listen address (empty = none)
+	Socket            string   // Unix socket path (empty = none)
+	ProxyProtocol     bool     // Client connections on the TCP listener start with a PROXY protocol header (default: the [protocol] value)
+	ProxyProtocolFrom []string // Addresses and networks of the load balancers that may send the header (default: the [protocol] value)
+	AllowUsers        []string // Client users that may connect to the listener, in addition to the rules of the protocol (empty = all)
+	DenyUsers         []string // Client users that may not connect to the listener
+	TLSCert           string   // Certificate of the listener for TLS clients (empty = no TLS)
+	TLSKey            string   // Key of the certificate
+	TLSMode           string   // disable, prefer (TLS and plaintext clients) or require (TLS clients only) (default: prefer with a certificate)
+}
+
+// Listener returns the settings of the listener with the name, "" for the
+// listener of the [protocol] section
+func (c ProxyConfig) Listener(name string) (ListenerConfig, bool) {
+	if name == "" {
+		return ListenerConfig{
+			Listen:            c.Listen,
+			Socket:            c.Socket,
+			ProxyProtocol:     c.ProxyProtocol,
+			ProxyProtocolFrom: c.ProxyProtocolFrom,
+		}, true
+	}
+	for _, l := range c.Listeners {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return ListenerConfig{}, false
+}
+
+// QuotaConfig holds the resource budgets of a database (0 = unlimited)
+type QuotaConfig struct {
+	CacheBytes    int64   // Bytes of cached results
+	CacheEntries  int     // Number of cached results
+	PendingWrites int     // Batched writes waiting for their batch
+	QPS           float64 // Queries per second
+}
+
+// ThrottleConfig holds the query limits per client address, user and backend
+// (0 = unlimited)
+type ThrottleConfig struct {
+	ClientQPS          float64 // Queries per second of each client address
+	ClientConcurrency  int     // Concurrent queries of each client address
+	UserQPS            float64 // Queries per second of each user
+	UserConcurrency    int     // Concurrent queries of each user
+	BackendQPS         float64 // Queries per second to each backend
+	BackendConcurrency int     // Concurrent queries to each backend
+	WaitMs             int     // Milliseconds a query over a limit waits before it is rejected (0 = reject immediately)
+}
+
+// TCPConfig holds TCP tuning options for a listener or backend
+type TCPConfig struct {
+	KeepAlive   int  // Seconds of idle time between keepalive probes (0 = Go default of 15, -1 = disabled)
+	UserTimeout int  // Seconds sent data may stay unacknowledged before the connection is dropped, Linux only (0 = OS default)
+	NoDelay     bool // Send small packets immediately, disabling Nagle's algorithm (default: true)
+	ReadBuffer  int  // Socket receive buffer size in bytes (0 = OS default)
+	WriteBuffer int  // Socket send buffer size in bytes (0 = OS default)
 }
 
 // WriteBatchConfig holds configuration for write batching
 type WriteBatchConfig struct {
 	MaxBatchSize int  // Maximum batch size
 	UseCopy      bool // Use COPY-style bulk loading: PostgreSQL COPY or MariaDB LOAD DATA LOCAL INFILE (default: false)
+	ExactIDs     bool // Insert one by one in the batch transaction, so that each insert gets its real LAST_INSERT_ID (default: false)
+	Isolate      bool // Execute the writes of a failed batch transaction one by one, so that only the failing writes get an error (default: false)
+	DefaultMs    int  // Batch window in ms for writes without a batch hint (0 = not batched)
+	Normalize    bool // Send batched writes with their values as parameters, so that writes that only differ in their values batch together (default: false)
+
+	QueueSize int // Writes per batch key in open or executing batches, beyond which writes fail (default: 10000, 0 = unlimited)
+	Workers   int // Shard workers that execute the batches (default: 0 = 4 per CPU)
+	TimeoutMs int // Time a batched write may take before it fails with a timeout, removed from its batch if that did not start (0 = no limit)
+
+	AckEarly       bool // Acknowledge batched writes without an ack hint before their batch executed, see parser.AckEarly (default: false)
+	AsyncQueueSize int  // Writes acknowledged early that may be pending, beyond which writes wait for their batch (default: 10000, 0 = unlimited)
+
+	Retries           int // Retries of a batch that failed on a transient error such as a deadlock (default: 3, 0 = disabled)
+	RetryBackoffMs    int // Wait before the first retry in ms, doubled on every next retry (default: 10)
+	RetryMaxBackoffMs int // Maximum wait before a retry in ms (default: 1000)
+
+	SpoolDir   string // Directory of the write-ahead spool for batched writes while the backend is unavailable (empty = disabled)
+	SpoolMaxMB int    // Size limit of the spool in megabytes (default: 64, 0 = unlimited)
+
+	BypassErrorRate float64 // Share of failed batched writes of a query at which its batching is bypassed (0 = disabled)
+	BypassMinWrites int     // Batched writes of a query needed before its error rate is judged (default: 20)
+	BypassCooldown  int     // Seconds batching stays bypassed, also the window the errors are counted in (default: 60)
+
+	Rules []BatchRule // Batch windows per table or query pattern, from [protocol.writebatch.name] sections in file order
+}
+
+// BatchRule holds a server-side batch window for the writes it matches, so
+// that applications get batching without batch hints
+type BatchRule struct {
+	Name     string         // Name of the rule, from its section
+	Table    string         // Table written to (empty = any)
+	Pattern  *regexp.Regexp // Matched against the fingerprint of the write, see parser.Fingerprint (nil = any)
+	WindowMs int            // Batch window in ms for matching writes without a batch hint
+	MaxBatch int            // Maximum writes per batch of matching writes (0 = writebatch_max_batch_size)
+	Ack      string         // Acknowledgement of matching writes without an ack hint: parser.AckEarly or empty (after the batch executed)
+}
+
+// MatchRule returns the first rule matching a write
+func (c WriteBatchConfig) MatchRule(parsed *parser.ParsedQuery) (BatchRule, bool) {
+	if len(c.Rules) == 0 || !parsed.IsWritable() {
+		return BatchRule{}, false
+	}
+	fingerprint := ""
+	for _, rule := range c.Rules {
+		if rule.Table != "" && !slices.Contains(parsed.Tables, rule.Table) {
+			continue
+		}
+		if rule.Pattern != nil {
+			if fingerprint == "" {
+				fingerprint = parser.Fingerprint(parsed.Query)
+			}
+			if !rule.Pattern.MatchString(fingerprint) {
+				continue
+			}
+		}
+		return rule, true
+	}
+	return BatchRule{}, false
+}
+
+// TableRoute routes the statements on a table to a backend
+type TableRoute struct {
+	Table   string // Table name, or a pattern with * and ? wildcards, see path.Match
+	Backend string // Name of the backend
+}
+
+// RouteTables returns the backend of the tables of a statement, or an empty
+// string when none of them has a route. Each table gets the backend of the
+// first route, in the order of the config, that matches it. Tables routed to
+// different backends are an error, as statements do not span backends.
+func (c ProxyConfig) RouteTables(tables []string) (string, error) {
+	backend, routed := "", ""
+	for _, table := range tables {
+		b := c.routeTable(table)
+		if b == "" {
+			continue
+		}
+		if backend != "" && b != backend {
+			return "", fmt.Errorf("tables %s and %s are routed to different backends (%s and %s)", routed, table, backend, b)
+		}
+		backend, routed = b, table
+	}
+	return backend, nil
+}
+
+// routeTable returns the backend of the first route that matches a table, or
+// an empty string
+func (c ProxyConfig) routeTable(table string) string {
+	for _, route := range c.TableRoutes {
+		if ok, _ := path.Match(route.Table, table); ok {
+			return route.Backend
+		}
+	}
+	return ""
 }
 
 // BackendConfig holds configuration for a single backend pool (primary + replicas)
 type BackendConfig struct {
 	Primary  string   // Primary database address
 	Replicas []string // Read replica addresses
+
+	ReplicaPolicy  string         // Replica selection policy, see replica.Policies (default: round_robin)
+	ReplicaWeights map[string]int // Weight per replica address (default: 1)
+
+	ReplicaLagCheck bool // Measure the replication lag of the replicas on health checks, for maxlag hints (default: false)
+	MaxReplicaLagMs int  // Lag in ms above which a replica gets no reads, implies ReplicaLagCheck (0 = no limit)
+
+	Username string // Username for connections opened by the proxy itself, such as write batching
+	Password string // Password for connections opened by the proxy itself
+	Database string // Database (schema) for connections opened by the proxy itself
+
+	ImmediateWriteLimit int // Max concurrent non-batched writes to this backend (0 = unlimited)
+	MaxConnections      int // Max open connections per address of this backend (0 = unlimited)
+	BatchMinMs          int // Lower bound for batch hints in ms, overrides the protocol setting (0 = inherit)
+	BatchMaxMs          int // Upper bound for batch hints in ms, overrides the protocol setting (0 = inherit)
+
+	ReadSplit         bool // Route SELECTs without ttl hint outside transactions to the replicas (default: false)
+	ReadSplitStickyMs int  // Ms a session reads from the primary after its last write or commit, with ReadSplit
+
+	TCP TCPConfig // TCP options for connections to this backend, defaults to the protocol setting
+	TLS TLSConfig // TLS for connections to this backend
+}
+
+// TLSConfig holds the TLS settings for connections to a backend
+type TLSConfig struct {
+	Mode     string // disable, require (not verified), verify-ca or verify-full (default: disable)
+	CAFile   string // CA certificates to verify the backend with (default: system roots)
+	CertFile string // Client certificate, optional
+	KeyFile  string // Key of the client certificate
 }
 
 // Load reads configuration from an INI file with environment variable overrides
@@ -46,6 +377,14 @@ func Load(path string) (*Config, error) {
 	config := &Config{
 		MariaDB:  loadProxyConfig(cfg, "mariadb", ":3307"),
 		Postgres: loadProxyConfig(cfg, "postgres", ":5433"),
+		Alerts:   loadAlertConfig(cfg),
+		Cache:    loadCacheConfig(cfg),
+		Switches: loadKillSwitchConfig(cfg),
+		Memory:   loadMemoryConfig(cfg),
+		Log:      loadLogConfig(cfg),
+		SlowLog:  loadSlowLogConfig(cfg),
+		Audit:    loadAuditConfig(cfg),
+		Metrics:  loadMetricsConfig(cfg),
 	}
 
 	// Environment variable overrides for MariaDB
@@ -60,6 +399,171 @@ func Load(path string) (*Config, error) {
 	return config, nil
 }
 
+func loadAlertConfig(cfg *ini.File) AlertConfig {
+	sec := cfg.Section("alerts")
+	return AlertConfig{
+		WebhookURL:            sec.Key("webhook_url").String(),
+		Script:                sec.Key("script").String(),
+		BatchFailureThreshold: sec.Key("batch_failure_threshold").MustInt(10),
+		MemoryThresholdMB:     sec.Key("memory_threshold_mb").MustInt(0),
+	}
+}
+
+func loadCacheConfig(cfg *ini.File) CacheConfig {
+	sec := cfg.Section("cache")
+	return CacheConfig{
+		MaxMemoryMB:     sec.Key("max_memory_mb").MustInt(64),
+		MaxEntries:      sec.Key("max_entries").MustInt(0),
+		MaxEntryKB:      sec.Key("max_entry_kb").MustInt(0),
+		Workers:         sec.Key("workers").MustInt(4),
+		StaleMultiplier: sec.Key("stale_multiplier").MustFloat64(2.0),
+		RefreshAheadMs:  sec.Key("refresh_ahead_ms").MustInt(0),
+	}
+}
+
+func loadMemoryConfig(cfg *ini.File) MemoryConfig {
+	sec := cfg.Section("memory")
+	return MemoryConfig{
+		SoftLimitMB:      sec.Key("soft_limit_mb").MustInt(0),
+		PressureBufferKB: sec.Key("pressure_buffer_kb").MustInt(256),
+	}
+}
+
+func loadLogConfig(cfg *ini.File) LogConfig {
+	sec := cfg.Section("log")
+	return LogConfig{
+		Level:     sec.Key("level").MustString("info"),
+		Format:    sec.Key("format").MustString("text"),
+		QueryText: sec.Key("query_text").MustString("redacted"),
+	}
+}
+
+func loadSlowLogConfig(cfg *ini.File) SlowLogConfig {
+	sec := cfg.Section("slowlog")
+	return SlowLogConfig{
+		ThresholdMs: sec.Key("threshold_ms").MustInt(0),
+		Size:        sec.Key("size").MustInt(100),
+		File:        sec.Key("file").String(),
+		MaxFileMB:   sec.Key("max_file_mb").MustInt(100),
+		Explain:     sec.Key("explain").MustBool(false),
+	}
+}
+
+func loadMetricsConfig(cfg *ini.File) MetricsConfig {
+	sec := cfg.Section("metrics")
+	return MetricsConfig{
+		MaxLabelSets: sec.Key("max_label_sets").MustInt(10000),
+	}
+}
+
+func loadAuditConfig(cfg *ini.File) AuditConfig {
+	sec := cfg.Section("audit")
+	return AuditConfig{
+		Mode:            sec.Key("mode").MustString("off"),
+		File:            sec.Key("file").String(),
+		Table:           sec.Key("table").String(),
+		TableDriver:     sec.Key("table_driver").MustString("mysql"),
+		TableDSN:        sec.Key("table_dsn").String(),
+		BufferSize:      sec.Key("buffer_size").MustInt(10000),
+		FlushIntervalMs: sec.Key("flush_interval_ms").MustInt(1000),
+		Block:           sec.Key("block").MustBool(false),
+	}
+}
+
+func loadKillSwitchConfig(cfg *ini.File) KillSwitchConfig {
+	sec := cfg.Section(killswitch.Section)
+	kcfg := KillSwitchConfig{
+		Enabled:   make(map[string]bool),
+		Persist:   sec.Key("persist").MustBool(false),
+		AuditFile: sec.Key("audit_file").String(),
+	}
+	for _, feature := range killswitch.Features {
+		kcfg.Enabled[feature] = sec.Key(feature).MustBool(true)
+	}
+	return kcfg
+}
+
+// loadTCPConfig reads the tcp_* keys of a section, using def for missing keys
+func loadTCPConfig(sec *ini.Section, def TCPConfig) TCPConfig {
+	return TCPConfig{
+		KeepAlive:   sec.Key("tcp_keepalive").MustInt(def.KeepAlive),
+		UserTimeout: sec.Key("tcp_user_timeout").MustInt(def.UserTimeout),
+		NoDelay:     sec.Key("tcp_nodelay").MustBool(def.NoDelay),
+		ReadBuffer:  sec.Key("tcp_read_buffer").MustInt(def.ReadBuffer),
+		WriteBuffer: sec.Key("tcp_write_buffer").MustInt(def.WriteBuffer),
+	}
+}
+
+// loadProxyProtocol returns the PROXY protocol settings of a listener section,
+// which is disabled when its load balancers are invalid
+func loadProxyProtocol(sec *ini.Section, name string, enabled bool, from []string) (bool, []string) {
+	enabled = sec.Key("proxy_protocol").MustBool(enabled)
+	if sec.HasKey("proxy_protocol_from") {
+		from = splitList(sec.Key("proxy_protocol_from").String())
+	}
+	if _, err := proxyproto.ParseNetworks(from); err != nil && enabled {
+		log.Printf("Warning: invalid proxy_protocol_from for %s, PROXY protocol disabled: %v", name, err)
+		enabled = false
+	}
+	return enabled, from
+}
+
+// loadListenerTLS reads the TLS settings of a listener. A listener with a
+// certificate accepts TLS clients, also plaintext ones unless the mode is
+// require. TLS is disabled when the certificate or key is missing.
+func loadListenerTLS(sec *ini.Section, name string) (certFile, keyFile, mode string) {
+	certFile, keyFile = sec.Key("tls_cert").String(), sec.Key("tls_key").String()
+	mode = tlsopt.ModeDisable
+	if certFile != "" {
+		mode = tlsopt.ModePrefer
+	}
+	mode = sec.Key("tls_mode").In(mode, tlsopt.ServerModes)
+	if mode != tlsopt.ModeDisable && (certFile == "" || keyFile == "") {
+		log.Printf("Warning: tls_mode %s for %s needs tls_cert and tls_key, TLS disabled", mode, name)
+		mode = tlsopt.ModeDisable
+	}
+	return certFile, keyFile, mode
+}
+
+func loadQuotaConfig(sec *ini.Section, def QuotaConfig) QuotaConfig {
+	return QuotaConfig{
+		CacheBytes:    sec.Key("quota_cache_bytes").MustInt64(def.CacheBytes),
+		CacheEntries:  sec.Key("quota_cache_entries").MustInt(def.CacheEntries),
+		PendingWrites: sec.Key("quota_pending_writes").MustInt(def.PendingWrites),
+		QPS:           sec.Key("quota_qps").MustFloat64(def.QPS),
+	}
+}
+
+// loadBatchRule reads a [protocol.writebatch.name] section
+func loadBatchRule(sec *ini.Section, name string) (BatchRule, error) {
+	rule := BatchRule{
+		Name:     name,
+		Table:    strings.ToLower(sec.Key("table").String()),
+		WindowMs: sec.Key("window_ms").MustInt(0),
+		MaxBatch: sec.Key("max_batch").MustInt(0),
+		Ack:      sec.Key("ack").In("", []string{parser.AckEarly}),
+	}
+	if pattern := sec.Key("pattern").String(); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rule, err
+		}
+		rule.Pattern = re
+	}
+	return rule, nil
+}
+
+// splitList splits a comma separated list, dropping empty values
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func loadProxyConfig(cfg *ini.File, protocol, defaultListen string) ProxyConfig {
 	sec := cfg.Section(protocol)
 
@@ -69,9 +573,153 @@ func loadProxyConfig(cfg *ini.File, protocol, defaultListen string) ProxyConfig
 		Default:  sec.Key("default").MustString("main"),
 		Backends: make(map[string]BackendConfig),
 		DBMap:    make(map[string]string),
+
+		ReplicaDatabases: make(map[string]string),
+
 		WriteBatch: WriteBatchConfig{
 			MaxBatchSize: sec.Key("writebatch_max_batch_size").MustInt(1000),
+			ExactIDs:     sec.Key("writebatch_exact_insert_ids").MustBool(false),
+			Isolate:      sec.Key("writebatch_isolate_failures").MustBool(false),
+			DefaultMs:    sec.Key("writebatch_default_ms").MustInt(0),
+			Normalize:    sec.Key("writebatch_normalize").MustBool(false),
+
+			QueueSize: sec.Key("writebatch_queue_size").MustInt(10000),
+			Workers:   sec.Key("writebatch_workers").MustInt(0),
+			TimeoutMs: sec.Key("writebatch_request_timeout_ms").MustInt(0),
+
+			AckEarly:       sec.Key("writebatch_ack_early").MustBool(false),
+			AsyncQueueSize: sec.Key("writebatch_async_queue_size").MustInt(10000),
+
+			Retries:           sec.Key("writebatch_retries").MustInt(3),
+			RetryBackoffMs:    sec.Key("writebatch_retry_backoff_ms").MustInt(10),
+			RetryMaxBackoffMs: sec.Key("writebatch_retry_max_backoff_ms").MustInt(1000),
+
+			SpoolDir:   sec.Key("writebatch_spool_dir").String(),
+			SpoolMaxMB: sec.Key("writebatch_spool_max_mb").MustInt(64),
+
+			BypassErrorRate: sec.Key("writebatch_bypass_error_rate").MustFloat64(0),
+			BypassMinWrites: sec.Key("writebatch_bypass_min_writes").MustInt(20),
+			BypassCooldown:  sec.Key("writebatch_bypass_cooldown").MustInt(60),
 		},
+		ImmediateWriteLimit: sec.Key("immediate_write_limit").MustInt(0),
+		MetadataCacheTTL:    sec.Key("metadata_cache_ttl").MustInt(0),
+		MaxConnectionsWait:  sec.Key("max_connections_wait").MustInt(5),
+		BatchMinMs:          sec.Key("batch_min_ms").MustInt(0),
+		BatchMaxMs:          sec.Key("batch_max_ms").MustInt(0),
+		ReadRetries:         sec.Key("read_retries").MustInt(1),
+		DrainTimeout:        sec.Key("drain_timeout").MustInt(30),
+		QueryHistory:        sec.Key("query_history_size").MustInt(20),
+		SpillThreshold:      sec.Key("spill_threshold").MustInt(0),
+		SpillDir:            sec.Key("spill_dir").String(),
+		StrictProtocol:      sec.Key("strict_protocol").In(conform.Off, conform.Modes),
+
+		CacheVerifySample: sec.Key("cache_verify_sample").MustFloat64(0),
+		CacheBoostQPS:     sec.Key("cache_boost_qps").MustFloat64(0),
+		CacheBoostMaxMs:   sec.Key("cache_boost_max_ms").MustInt(1000),
+		CacheNegativeTTL:  sec.Key("cache_negative_ttl").MustInt(0),
+		CacheNormalize:    sec.Key("cache_normalize").MustBool(false),
+
+		PrepareFile: sec.Key("prepare_file").String(),
+
+		QuestionPlaceholders: sec.Key("question_placeholders").MustBool(false),
+		Collation:            sec.Key("collation").MustString("utf8mb4_general_ci"),
+		Auth:                 sec.Key("auth").In("cleartext", []string{"cleartext", "md5", "scram-sha-256"}),
+		AuthFile:             sec.Key("auth_file").String(),
+		BinlogInvalidate:     sec.Key("binlog_invalidate").MustBool(false),
+		BinlogServerID:       sec.Key("binlog_server_id").MustInt(0),
+		LogicalInvalidate:    sec.Key("logical_invalidate").MustBool(false),
+		LogicalPublication:   sec.Key("logical_publication").MustString("tqdbproxy"),
+
+		BatchGuard: sec.Key("batch_guard").MustBool(false),
+	}
+	if sec.Key("annotate_queries").MustBool(false) {
+		pcfg.Annotate = sec.Key("annotate_format").MustString(annotate.DefaultFormat)
+	}
+	pcfg.AdminUsers = splitList(sec.Key("admin_users").String())
+	pcfg.AllowUsers = splitList(sec.Key("allow_users").String())
+	pcfg.DenyUsers = splitList(sec.Key("deny_users").String())
+	pcfg.ReadOnlyUsers = splitList(sec.Key("readonly_users").String())
+	for _, table := range splitList(sec.Key("relaxed_durability_tables").String()) {
+		pcfg.RelaxedDurabilityTables = append(pcfg.RelaxedDurabilityTables, strings.ToLower(table))
+	}
+	for _, column := range strings.Split(sec.Key("batch_guard_columns").MustString("id"), ",") {
+		if column = strings.ToLower(strings.TrimSpace(column)); column != "" {
+			pcfg.BatchGuardColumns = append(pcfg.BatchGuardColumns, column)
+		}
+	}
+	pcfg.TCP = loadTCPConfig(sec, TCPConfig{NoDelay: true})
+	pcfg.ProxyProtocol, pcfg.ProxyProtocolFrom = loadProxyProtocol(sec, protocol, false, nil)
+	pcfg.Throttle = ThrottleConfig{
+		ClientQPS:          sec.Key("throttle_client_qps").MustFloat64(0),
+		ClientConcurrency:  sec.Key("throttle_client_concurrency").MustInt(0),
+		UserQPS:            sec.Key("throttle_user_qps").MustFloat64(0),
+		UserConcurrency:    sec.Key("throttle_user_concurrency").MustInt(0),
+		BackendQPS:         sec.Key("throttle_backend_qps").MustFloat64(0),
+		BackendConcurrency: sec.Key("throttle_backend_concurrency").MustInt(0),
+		WaitMs:             sec.Key("throttle_wait_ms").MustInt(0),
+	}
+
+	// Budgets per database [protocol.quota.database], defaulting to the
+	// budgets of the protocol section
+	pcfg.Quota = loadQuotaConfig(sec, QuotaConfig{})
+	pcfg.Quotas = make(map[string]QuotaConfig)
+	quotaPrefix := protocol + ".quota."
+	for _, s := range cfg.Sections() {
+		if db, ok := strings.CutPrefix(s.Name(), quotaPrefix); ok && db != "" {
+			pcfg.Quotas[db] = loadQuotaConfig(s, pcfg.Quota)
+		}
+	}
+
+	// Batch windows per table or query pattern [protocol.writebatch.name]
+	rulePrefix := protocol + ".writebatch."
+	for _, s := range cfg.Sections() {
+		if name, ok := strings.CutPrefix(s.Name(), rulePrefix); ok && name != "" {
+			rule, err := loadBatchRule(s, name)
+			if err != nil {
+				log.Printf("Warning: invalid pattern of write batch rule %s: %v", name, err)
+				continue
+			}
+			pcfg.WriteBatch.Rules = append(pcfg.WriteBatch.Rules, rule)
+		}
+	}
+
+	// Databases and backends per user [protocol.acl]
+	aclSection := protocol + ".acl"
+	pcfg.UserDatabases = make(map[string][]string)
+	if s, err := cfg.GetSection(aclSection); err == nil {
+		for _, key := range s.Keys() {
+			pcfg.UserDatabases[key.Name()] = splitList(key.String())
+		}
+	}
+
+	// More listeners [protocol.listener.name]
+	listenerPrefix := protocol + ".listener."
+	for _, s := range cfg.Sections() {
+		if name, ok := strings.CutPrefix(s.Name(), listenerPrefix); ok && name != "" {
+			l := ListenerConfig{
+				Name:       name,
+				Listen:     s.Key("listen").String(),
+				Socket:     s.Key("socket").String(),
+				AllowUsers: splitList(s.Key("allow_users").String()),
+				DenyUsers:  splitList(s.Key("deny_users").String()),
+			}
+			l.ProxyProtocol, l.ProxyProtocolFrom = loadProxyProtocol(s, s.Name(), pcfg.ProxyProtocol, pcfg.ProxyProtocolFrom)
+			l.TLSCert, l.TLSKey, l.TLSMode = loadListenerTLS(s, s.Name())
+			pcfg.Listeners = append(pcfg.Listeners, l)
+		}
+	}
+
+	// Backends per table [protocol.routing]
+	routingSection := protocol + ".routing"
+	if s, err := cfg.GetSection(routingSection); err == nil {
+		for _, key := range s.Keys() {
+			table := strings.ToLower(key.Name())
+			if _, err := path.Match(table, ""); err != nil {
+				log.Printf("Warning: invalid table pattern %q in [%s]: %v", key.Name(), routingSection, err)
+				continue
+			}
+			pcfg.TableRoutes = append(pcfg.TableRoutes, TableRoute{Table: table, Backend: strings.TrimSpace(key.String())})
+		}
 	}
 
 	// Find all backends for this protocol [protocol.name]
@@ -79,6 +727,9 @@ func loadProxyConfig(cfg *ini.File, protocol, defaultListen string) ProxyConfig
 	prefix := protocol + "."
 	for _, s := range sections {
 		name := s.Name()
+		if strings.HasPrefix(name, quotaPrefix) || strings.HasPrefix(name, rulePrefix) || strings.HasPrefix(name, listenerPrefix) || name == aclSection || name == routingSection {
+			continue
+		}
 		if len(name) > len(prefix) && name[:len(prefix)] == prefix {
 			backendName := name[len(prefix):]
 
@@ -97,10 +748,38 @@ func loadProxyConfig(cfg *ini.File, protocol, defaultListen string) ProxyConfig
 				}
 			}
 
+			// Weights in the order of the replicas
+			weights := make(map[string]int)
+			for i, w := range s.Key("replica_weights").Ints(",") {
+				if i < len(replicas) {
+					weights[replicas[i]] = w
+				}
+			}
+
 			if primary != "" {
 				pcfg.Backends[backendName] = BackendConfig{
-					Primary:  primary,
-					Replicas: replicas,
+					Primary:             primary,
+					Replicas:            replicas,
+					ReplicaPolicy:       s.Key("replica_policy").In(replica.RoundRobin, replica.Policies),
+					ReplicaWeights:      weights,
+					ReplicaLagCheck:     s.Key("replica_lag_check").MustBool(false),
+					MaxReplicaLagMs:     s.Key("max_replica_lag_ms").MustInt(0),
+					Username:            s.Key("username").MustString("tqdbproxy"),
+					Password:            s.Key("password").MustString("tqdbproxy"),
+					Database:            s.Key("database").MustString("tqdbproxy"),
+					ImmediateWriteLimit: s.Key("immediate_write_limit").MustInt(0),
+					MaxConnections:      s.Key("max_connections").MustInt(0),
+					BatchMinMs:          s.Key("batch_min_ms").MustInt(0),
+					BatchMaxMs:          s.Key("batch_max_ms").MustInt(0),
+					ReadSplit:           s.Key("read_split").MustBool(false),
+					ReadSplitStickyMs:   s.Key("read_split_sticky_ms").MustInt(1000),
+					TCP:                 loadTCPConfig(s, pcfg.TCP),
+					TLS: TLSConfig{
+						Mode:     s.Key("tls_mode").In(tlsopt.ModeDisable, tlsopt.Modes),
+						CAFile:   s.Key("tls_ca").String(),
+						CertFile: s.Key("tls_cert").String(),
+						KeyFile:  s.Key("tls_key").String(),
+					},
 				}
 
 				// Map databases to this backend
@@ -111,10 +790,28 @@ func loadProxyConfig(cfg *ini.File, protocol, defaultListen string) ProxyConfig
 						pcfg.DBMap[strings.TrimSpace(db)] = backendName
 					}
 				}
+
+				// Expose databases read-only on the replicas, as name:database
+				for _, pair := range s.Key("replica_databases").Strings(",") {
+					name, db, ok := strings.Cut(pair, ":")
+					name, db = strings.TrimSpace(name), strings.TrimSpace(db)
+					if !ok || name == "" || db == "" {
+						log.Printf("Warning: invalid replica database %q for backend %s, expected name:database", pair, backendName)
+						continue
+					}
+					pcfg.DBMap[name] = backendName
+					pcfg.ReplicaDatabases[name] = db
+				}
 			}
 		}
 	}
 
+	for _, route := range pcfg.TableRoutes {
+		if _, ok := pcfg.Backends[route.Backend]; !ok {
+			log.Printf("Warning: unknown backend %q for table %s in [%s]", route.Backend, route.Table, routingSection)
+		}
+	}
+
 	// Check if at least one backend is defined
 	if len(pcfg.Backends) == 0 {
 		log.Printf("Warning: no backends defined for %s, proxy will have no shards", protocol)
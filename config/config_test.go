@@ -0,0 +1,36 @@
+package config
+
+import "testing"
+
+func TestRouteTables(t *testing.T) {
+	c := ProxyConfig{TableRoutes: []TableRoute{
+		{Table: "orders", Backend: "shard1"},
+		{Table: "order_*", Backend: "shard1"},
+		{Table: "users", Backend: "shard2"},
+		{Table: "*", Backend: "shard3"},
+	}}
+	tests := []struct {
+		tables  []string
+		backend string
+		err     bool
+	}{
+		{nil, "", false},
+		{[]string{"orders"}, "shard1", false},
+		{[]string{"order_items", "orders"}, "shard1", false},
+		{[]string{"users"}, "shard2", false},
+		{[]string{"products"}, "shard3", false},
+		{[]string{"orders", "users"}, "", true},
+	}
+	for _, tt := range tests {
+		backend, err := c.RouteTables(tt.tables)
+		if backend != tt.backend || (err != nil) != tt.err {
+			t.Errorf("RouteTables(%v) = %q, %v, want %q (error %v)", tt.tables, backend, err, tt.backend, tt.err)
+		}
+	}
+
+	// Tables without a route do not conflict with routed tables
+	c.TableRoutes = c.TableRoutes[:3]
+	if backend, err := c.RouteTables([]string{"products", "orders"}); backend != "shard1" || err != nil {
+		t.Errorf("Expected shard1 for a join with a table without a route, got %q, %v", backend, err)
+	}
+}
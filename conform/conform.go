@@ -0,0 +1,144 @@
+// Package conform checks the packets that the proxy exchanges with a client
+// against the expectations of the wire protocol, to diagnose framing bugs that
+// only show with specific drivers, such as a missing EOF packet or a sequence
+// number that is off by one.
+//
+// A Conn wraps a client connection and splits both directions into messages.
+// It checks the length of every message, the sequence numbers of MariaDB
+// packets and the order of the messages: MariaDB responses must answer a
+// command and end before the next command, PostgreSQL ReadyForQuery messages
+// must answer a Query or Sync. A violation is logged with a hexdump of the
+// message and counted in tqdbproxy_protocol_violations_total. In fault mode
+// the connection is also closed, so that the failure is not hidden by a
+// driver that recovers.
+//
+// Checking buffers every message until it is complete, so it is meant for
+// debugging and conformance tests rather than production traffic.
+package conform
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// Modes of strict_protocol
+const (
+	Off   = "off"
+	Log   = "log"   // Log violations
+	Fault = "fault" // Log violations and close the connection
+)
+
+// Modes lists the valid modes, the first is the default
+var Modes = []string{Off, Log, Fault}
+
+// Directions of a message
+const (
+	Inbound  = "inbound"  // From the client
+	Outbound = "outbound" // To the client
+)
+
+// maxDump limits the bytes of a message logged with a violation
+const maxDump = 256
+
+// ErrViolation is returned by the read or write that closed the connection
+// in fault mode
+var ErrViolation = errors.New("protocol violation")
+
+// checker validates the messages of one protocol
+type checker interface {
+	// split returns the length of the first message of data, 0 when it is
+	// not complete yet, or an error when the frame is malformed
+	split(dir string, data []byte) (int, error)
+	// check validates the next complete message of a direction
+	check(dir string, msg []byte) error
+}
+
+// Conn checks the messages read from and written to a client connection
+type Conn struct {
+	net.Conn
+	name     string // Connection, for logging
+	protocol string
+	fault    bool
+
+	mu      sync.Mutex
+	checker checker
+	in, out []byte // Incomplete messages
+	broken  bool   // A malformed frame, the stream can no longer be split
+}
+
+// wrap returns conn checked by c, or conn itself when mode is off
+func wrap(conn net.Conn, protocol, name, mode string, c checker) net.Conn {
+	if mode != Log && mode != Fault {
+		return conn
+	}
+	return &Conn{Conn: conn, name: name, protocol: protocol, fault: mode == Fault, checker: c}
+}
+
+// Read reads from the client and checks the complete messages
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.feed(Inbound, p[:n]) {
+		return 0, ErrViolation
+	}
+	return n, err
+}
+
+// Write checks the complete messages and writes them to the client
+func (c *Conn) Write(p []byte) (int, error) {
+	if !c.feed(Outbound, p) {
+		return 0, ErrViolation
+	}
+	return c.Conn.Write(p)
+}
+
+// feed appends data to the stream of a direction and checks the messages it
+// completes. It reports false when a violation closed the connection.
+func (c *Conn) feed(dir string, data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return true
+	}
+	buf := &c.in
+	if dir == Outbound {
+		buf = &c.out
+	}
+	*buf = append(*buf, data...)
+	for len(*buf) > 0 {
+		n, err := c.checker.split(dir, *buf)
+		if err != nil {
+			c.broken = true
+			return c.violation(dir, err, *buf)
+		}
+		if n == 0 {
+			break
+		}
+		msg := (*buf)[:n]
+		*buf = (*buf)[n:]
+		if err := c.checker.check(dir, msg); err != nil && !c.violation(dir, err, msg) {
+			return false
+		}
+	}
+	if len(*buf) == 0 {
+		*buf = nil
+	}
+	return true
+}
+
+// violation logs a violation with a hexdump of the message. In fault mode it
+// closes the connection and reports false.
+func (c *Conn) violation(dir string, err error, msg []byte) bool {
+	metrics.ProtocolViolations.WithLabelValues(c.protocol, dir).Inc()
+	log.Printf("[Conform] %s %s violation on %s: %v\n%s", c.protocol, dir, c.name, err, hex.Dump(msg[:min(len(msg), maxDump)]))
+	if !c.fault {
+		return true
+	}
+	c.broken = true
+	c.Conn.Close()
+	return false
+}
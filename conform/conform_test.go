@@ -0,0 +1,138 @@
+package conform
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// fakeConn reads what a test sends as the client and discards writes
+type fakeConn struct {
+	net.Conn
+	in     bytes.Buffer
+	closed bool
+}
+
+func (f *fakeConn) Read(p []byte) (int, error)  { return f.in.Read(p) }
+func (f *fakeConn) Write(p []byte) (int, error) { return len(p), nil }
+func (f *fakeConn) Close() error                { f.closed = true; return nil }
+
+// exchange is a message sent by the client (in) or to the client
+type exchange struct {
+	in   bool
+	data []byte
+}
+
+// run passes the exchanges through conn and returns the logged violations
+func run(t *testing.T, conn net.Conn, fake *fakeConn, exchanges []exchange) string {
+	t.Helper()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	for _, e := range exchanges {
+		if e.in {
+			fake.in.Write(e.data)
+			buf := make([]byte, len(e.data))
+			if _, err := conn.Read(buf); err != nil {
+				return logs.String()
+			}
+		} else if _, err := conn.Write(e.data); err != nil {
+			return logs.String()
+		}
+	}
+	return logs.String()
+}
+
+func packet(seq byte, payload ...byte) []byte {
+	return mariadbproto.AppendPacket(nil, seq, payload)
+}
+
+// mariadbSession is a handshake followed by a query with a result set and a
+// ping
+func mariadbSession() []exchange {
+	return []exchange{
+		{false, packet(0, 0x0a, '1', 0)},
+		{true, packet(1, 0, 0, 0, 0)},
+		{false, packet(2, mariadbproto.OKHeader, 0, 0, 2, 0, 0, 0)},
+		{true, packet(0, mariadbproto.ComQuery, '1')},
+		{false, append(append(packet(1, 1), packet(2, 3, 'd', 'e', 'f')...), packet(3, mariadbproto.EOFHeader, 0, 0, 2, 0)...)},
+		{false, append(packet(4, 1, '1'), packet(5, mariadbproto.EOFHeader, 0, 0, 2, 0)...)},
+		{true, packet(0, mariadbproto.ComPing)},
+		{false, packet(1, mariadbproto.OKHeader, 0, 0, 2, 0, 0, 0)},
+	}
+}
+
+func TestMariaDB(t *testing.T) {
+	fake := &fakeConn{}
+	if logs := run(t, NewMariaDB(fake, "conn 1", Log), fake, mariadbSession()); logs != "" {
+		t.Errorf("Expected no violations, got %s", logs)
+	}
+
+	session := mariadbSession()
+	session[7] = exchange{false, packet(2, mariadbproto.OKHeader, 0, 0, 2, 0, 0, 0)}
+	session = append(session, exchange{false, packet(3, mariadbproto.OKHeader, 0, 0, 2, 0, 0, 0)})
+	fake = &fakeConn{}
+	logs := run(t, NewMariaDB(fake, "conn 1", Log), fake, session)
+	for _, want := range []string{"MariaDB outbound violation on conn 1", "sequence number 2, expected 1", "no command is pending", "00000000  07 00 00 03"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Expected the log to contain %q, got %s", want, logs)
+		}
+	}
+}
+
+func TestMariaDB_Fault(t *testing.T) {
+	fake := &fakeConn{}
+	conn := NewMariaDB(fake, "conn 1", Fault)
+	session := mariadbSession()
+	run(t, conn, fake, session[:4])
+	// A command before the response of the previous one ended
+	fake.in.Write(packet(0, mariadbproto.ComPing))
+	if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, ErrViolation) || !fake.closed {
+		t.Errorf("Expected the violation to close the connection, got %v", err)
+	}
+}
+
+func TestMariaDB_Off(t *testing.T) {
+	fake := &fakeConn{}
+	if conn := NewMariaDB(fake, "conn 1", Off); conn != net.Conn(fake) {
+		t.Error("Expected the connection to be returned unchanged")
+	}
+}
+
+func TestPostgreSQL(t *testing.T) {
+	startup := pgproto.StartupMessage{ProtocolVersion: pgproto.ProtocolVersion3, Params: map[string]string{"user": "app"}}.Encode(nil)
+	ready := pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}.Encode(nil)
+	session := []exchange{
+		{true, pgproto.StartupMessage{ProtocolVersion: pgproto.SSLRequestCode}.Encode(nil)},
+		{false, []byte{'N'}},
+		{true, startup},
+		{false, append(pgproto.AppendMessage(nil, pgproto.MsgAuthentication, []byte{0, 0, 0, 0}), ready...)},
+		{true, pgproto.Query{String: "SELECT 1"}.Encode(nil)},
+		{false, pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil)},
+		{false, ready},
+	}
+	fake := &fakeConn{}
+	if logs := run(t, NewPostgreSQL(fake, "conn 1", Log), fake, session); logs != "" {
+		t.Errorf("Expected no violations, got %s", logs)
+	}
+
+	session = append(session,
+		exchange{false, ready},
+		exchange{true, []byte{'?', 0, 0, 0, 4}},
+		exchange{true, []byte{pgproto.MsgQuery, 0, 0, 0, 2}},
+	)
+	fake = &fakeConn{}
+	logs := run(t, NewPostgreSQL(fake, "conn 1", Log), fake, session)
+	for _, want := range []string{"ReadyForQuery without a pending Query or Sync", "unknown message type '?'", "message 'Q' length 2"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("Expected the log to contain %q, got %s", want, logs)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package conform
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+)
+
+// Phases of a MariaDB connection
+const (
+	phaseHandshake = iota // Greeting and authentication
+	phaseIdle             // Waiting for a command
+	phaseResponse         // A command waits for its response
+	phaseInfile           // The client sends a file for LOAD DATA LOCAL INFILE
+	phaseUntracked        // A command whose response is not checked
+)
+
+// NewMariaDB returns conn with the MariaDB packets checked in the given mode,
+// or conn itself when the mode is off
+func NewMariaDB(conn net.Conn, name, mode string) net.Conn {
+	return wrap(conn, "MariaDB", name, mode, &mariadb{})
+}
+
+// mariadb checks the packets of a MariaDB connection. The sequence number
+// counts the packets in both directions and starts at 0 with every command.
+type mariadb struct {
+	packets   int  // Packets seen
+	next      byte // Expected sequence number
+	continued bool // The last packet had the maximum length, the next continues its message
+	phase     int
+	responses int // Packets of the current response
+	tracker   mariadbproto.ResponseTracker
+}
+
+func (m *mariadb) split(dir string, data []byte) (int, error) {
+	if len(data) < mariadbproto.HeaderSize {
+		return 0, nil
+	}
+	n := mariadbproto.HeaderSize + int(uint32(data[0])|uint32(data[1])<<8|uint32(data[2])<<16)
+	if len(data) < n {
+		return 0, nil
+	}
+	return n, nil
+}
+
+func (m *mariadb) check(dir string, packet []byte) error {
+	seq := packet[3]
+	payload := packet[mariadbproto.HeaderSize:]
+	continuation := m.continued
+	m.continued = len(payload) == mariadbproto.MaxPayloadSize
+
+	var errs []error
+	command := dir == Inbound && seq == 0 && !continuation
+	if m.packets > 0 && !command && seq != m.next {
+		errs = append(errs, fmt.Errorf("sequence number %d, expected %d", seq, m.next))
+	}
+	m.packets++
+	m.next = seq + 1
+	if !continuation {
+		errs = append(errs, m.order(dir, command, payload))
+	}
+	return errors.Join(errs...)
+}
+
+// order checks the first packet of a message against the phase of the
+// connection
+func (m *mariadb) order(dir string, command bool, payload []byte) error {
+	switch m.phase {
+	case phaseHandshake:
+		if dir == Outbound && len(payload) > 0 && (payload[0] == mariadbproto.OKHeader || payload[0] == mariadbproto.ErrHeader) {
+			m.phase = phaseIdle
+		}
+	case phaseIdle, phaseUntracked:
+		if command {
+			return m.command(payload)
+		}
+		if dir == Outbound && m.phase == phaseIdle {
+			return errors.New("packet sent while no command is pending")
+		}
+	case phaseResponse:
+		if command {
+			err := m.command(payload)
+			return errors.Join(errors.New("command sent before the response to the previous command ended"), err)
+		}
+		if dir == Outbound {
+			first := m.responses == 0
+			m.responses++
+			if m.tracker.Done(payload) {
+				m.phase = phaseIdle
+				if first && len(payload) > 0 && payload[0] == mariadbproto.LocalInfileHeader {
+					m.phase = phaseInfile
+				}
+			}
+		}
+	case phaseInfile:
+		if dir == Outbound {
+			return errors.New("packet sent while the client sends a LOCAL INFILE file")
+		}
+		if len(payload) == 0 {
+			// The file ended, the server answers with OK or an error
+			m.phase = phaseResponse
+			m.responses = 0
+			m.tracker = mariadbproto.ResponseTracker{}
+		}
+	}
+	return nil
+}
+
+// command starts the response phase of a command
+func (m *mariadb) command(payload []byte) error {
+	m.phase = phaseUntracked
+	if len(payload) == 0 {
+		return errors.New("empty command packet")
+	}
+	switch payload[0] {
+	case mariadbproto.ComQuery, mariadbproto.ComInitDB, mariadbproto.ComPing, mariadbproto.ComStmtReset:
+		m.phase = phaseResponse
+	case mariadbproto.ComStmtExecute:
+		// A cursor is read with COM_STMT_FETCH after the column definitions
+		if len(payload) > 5 && payload[5] == 0 {
+			m.phase = phaseResponse
+		}
+	case mariadbproto.ComQuit, mariadbproto.ComStmtClose, mariadbproto.ComStmtSendLongData:
+		m.phase = phaseIdle
+	}
+	m.responses = 0
+	m.tracker = mariadbproto.ResponseTracker{}
+	return nil
+}
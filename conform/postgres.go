@@ -0,0 +1,145 @@
+package conform
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// maxStartupSize is the largest startup message accepted, as in PostgreSQL
+const maxStartupSize = 10000
+
+// Message types of each direction, including those the proxy does not use
+const (
+	frontendTypes = "QPBEDCSHXpdcfF"
+	backendTypes  = "RSKZTDCIEN123ntGHWAscdvV"
+)
+
+// NewPostgreSQL returns conn with the PostgreSQL messages checked in the given
+// mode, or conn itself when the mode is off
+func NewPostgreSQL(conn net.Conn, name, mode string) net.Conn {
+	return wrap(conn, "PostgreSQL", name, mode, &postgres{startup: true})
+}
+
+// postgres checks the messages of a PostgreSQL connection
+type postgres struct {
+	startup    bool // Waiting for the startup message, which has no type byte
+	answer     bool // An SSLRequest or GSSENCRequest waits for its one byte answer
+	ready      bool // The first ReadyForQuery was sent
+	pending    int  // Query, Sync and FunctionCall messages waiting for their ReadyForQuery
+	terminated bool // The client sent Terminate or a CancelRequest
+}
+
+func (p *postgres) split(dir string, data []byte) (int, error) {
+	if dir == Outbound && p.answer {
+		return 1, nil
+	}
+	if dir == Inbound && p.startup {
+		if len(data) < 4 {
+			return 0, nil
+		}
+		n := binary.BigEndian.Uint32(data)
+		if n < 8 || n > maxStartupSize {
+			return 0, fmt.Errorf("startup message length %d", n)
+		}
+		if len(data) < int(n) {
+			return 0, nil
+		}
+		return int(n), nil
+	}
+	if len(data) < 5 {
+		return 0, nil
+	}
+	n := binary.BigEndian.Uint32(data[1:])
+	if n < 4 || n > pgproto.MaxMessageSize {
+		return 0, fmt.Errorf("message %q length %d", data[0], n)
+	}
+	if len(data) < 1+int(n) {
+		return 0, nil
+	}
+	return 1 + int(n), nil
+}
+
+func (p *postgres) check(dir string, msg []byte) error {
+	if dir == Inbound {
+		return p.checkFrontend(msg)
+	}
+	return p.checkBackend(msg)
+}
+
+// checkFrontend checks a message of the client
+func (p *postgres) checkFrontend(msg []byte) error {
+	if p.startup {
+		switch code := binary.BigEndian.Uint32(msg[4:]); code {
+		case pgproto.SSLRequestCode, pgproto.GSSENCRequestCode:
+			p.answer = true
+		case pgproto.CancelRequestCode:
+			p.startup = false
+			p.terminated = true
+		default:
+			p.startup = false
+			if code>>16 != 3 {
+				return fmt.Errorf("protocol version %d.%d", code>>16, code&0xffff)
+			}
+		}
+		return nil
+	}
+	if p.terminated {
+		return fmt.Errorf("message %q after Terminate", msg[0])
+	}
+	if !strings.ContainsRune(frontendTypes, rune(msg[0])) {
+		return fmt.Errorf("unknown message type %q", msg[0])
+	}
+	switch msg[0] {
+	case pgproto.MsgQuery, pgproto.MsgSync, 'F': // FunctionCall
+		p.pending++
+	case pgproto.MsgTerminate:
+		p.terminated = true
+	}
+	return nil
+}
+
+// checkBackend checks a message sent to the client
+func (p *postgres) checkBackend(msg []byte) error {
+	if p.answer {
+		p.answer = false
+		if msg[0] != 'N' && msg[0] != 'S' {
+			return fmt.Errorf("answer %q to an encryption request, expected N or S", msg[0])
+		}
+		return nil
+	}
+	msgType := msg[0]
+	if p.startup {
+		return fmt.Errorf("message %q sent before the startup message", msgType)
+	}
+	if !strings.ContainsRune(backendTypes, rune(msgType)) {
+		return fmt.Errorf("unknown message type %q", msgType)
+	}
+	if msgType == pgproto.MsgReadyForQuery {
+		if len(msg) != 6 || !strings.ContainsRune("ITE", rune(msg[5])) {
+			return fmt.Errorf("malformed ReadyForQuery % x", msg)
+		}
+	}
+	if !p.ready {
+		switch msgType {
+		case pgproto.MsgReadyForQuery:
+			p.ready = true
+		case pgproto.MsgAuthentication, pgproto.MsgParameterStatus, pgproto.MsgBackendKeyData,
+			pgproto.MsgErrorResponse, pgproto.MsgNoticeResponse, 'v': // NegotiateProtocolVersion
+		default:
+			return fmt.Errorf("message %q sent before the first ReadyForQuery", msgType)
+		}
+		return nil
+	}
+	if msgType == pgproto.MsgReadyForQuery {
+		if p.pending == 0 {
+			return errors.New("ReadyForQuery without a pending Query or Sync")
+		}
+		p.pending--
+	}
+	return nil
+}
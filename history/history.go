@@ -0,0 +1,130 @@
+// Package history keeps the last statements of each client connection in a
+// small ring buffer, so that a single misbehaving application connection can
+// be debugged without enabling global query logging. The history is shown by
+// SHOW TQDB HISTORY (MariaDB), pg_tqdb_history (PostgreSQL) and the admin API.
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxQueryLen is the length at which recorded queries are truncated
+const MaxQueryLen = 1024
+
+// Entry is a statement executed by a connection
+type Entry struct {
+	Time    time.Time     // When the statement was received
+	Query   string        // Statement as sent by the client, truncated to MaxQueryLen
+	Latency time.Duration // Time until the response was sent
+	Backend string        // Routing decision: "primary", "replicas[n]", "cache", "write-batch", "proxy", ...
+	Error   string        // Error returned to the client, if any
+}
+
+// Ring holds the last entries of a connection. A nil *Ring records nothing.
+type Ring struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int // Position of the next entry
+	full    bool
+}
+
+// NewRing creates a ring of size entries, or returns nil when size <= 0
+func NewRing(size int) *Ring {
+	if size <= 0 {
+		return nil
+	}
+	return &Ring{entries: make([]Entry, size)}
+}
+
+// Add records an entry, replacing the oldest one when the ring is full
+func (r *Ring) Add(e Entry) {
+	if r == nil {
+		return
+	}
+	if len(e.Query) > MaxQueryLen {
+		e.Query = e.Query[:MaxQueryLen]
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Entries returns the recorded entries, oldest first
+func (r *Ring) Entries() []Entry {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Entry(nil), r.entries[:r.next]...)
+	}
+	return append(append([]Entry(nil), r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// Conn is a client connection with its history
+type Conn struct {
+	ID      uint32
+	Addr    string    // Remote address of the client
+	User    string    // Client user name
+	Started time.Time // When the connection was accepted
+	History *Ring
+}
+
+// Registry holds the connections of a proxy, so that their history can be
+// retrieved through the admin API
+type Registry struct {
+	mu    sync.RWMutex
+	conns map[uint32]*Conn
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{conns: make(map[uint32]*Conn)}
+}
+
+// Register adds a connection. It returns a function that removes it again,
+// to be called when the connection closes.
+func (reg *Registry) Register(c *Conn) func() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.conns[c.ID] = c
+	return func() {
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		delete(reg.conns, c.ID)
+	}
+}
+
+// Get returns the open connection with the given ID
+func (reg *Registry) Get(id uint32) (*Conn, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	c, ok := reg.conns[id]
+	return c, ok
+}
+
+// Len returns the number of open connections
+func (reg *Registry) Len() int {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return len(reg.conns)
+}
+
+// List returns the open connections, by ID
+func (reg *Registry) List() []*Conn {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	conns := make([]*Conn, 0, len(reg.conns))
+	for _, c := range reg.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
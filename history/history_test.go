@@ -0,0 +1,72 @@
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRing(t *testing.T) {
+	r := NewRing(3)
+	if got := r.Entries(); len(got) != 0 {
+		t.Fatalf("Expected an empty ring, got %v", got)
+	}
+	for _, q := range []string{"q1", "q2"} {
+		r.Add(Entry{Query: q})
+	}
+	if got := queries(r.Entries()); got != "q1,q2" {
+		t.Errorf("Expected q1,q2, got %s", got)
+	}
+
+	// The oldest entries are replaced when the ring is full
+	for _, q := range []string{"q3", "q4", "q5"} {
+		r.Add(Entry{Query: q})
+	}
+	if got := queries(r.Entries()); got != "q3,q4,q5" {
+		t.Errorf("Expected q3,q4,q5, got %s", got)
+	}
+
+	r.Add(Entry{Query: strings.Repeat("x", MaxQueryLen+1)})
+	if entries := r.Entries(); len(entries[2].Query) != MaxQueryLen {
+		t.Errorf("Expected the query truncated to %d bytes, got %d", MaxQueryLen, len(entries[2].Query))
+	}
+}
+
+func TestRing_Disabled(t *testing.T) {
+	r := NewRing(0)
+	if r != nil {
+		t.Fatal("Expected no ring for size 0")
+	}
+	r.Add(Entry{Query: "q1"})
+	if r.Entries() != nil {
+		t.Error("Expected a nil ring to record nothing")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	unregister := reg.Register(&Conn{ID: 2, Started: time.Now(), History: NewRing(1)})
+	defer reg.Register(&Conn{ID: 1, Started: time.Now(), History: NewRing(1)})()
+
+	if conns := reg.List(); len(conns) != 2 || conns[0].ID != 1 || conns[1].ID != 2 {
+		t.Fatalf("Expected connections 1 and 2, got %v", conns)
+	}
+	if _, ok := reg.Get(2); !ok {
+		t.Error("Expected connection 2 to be registered")
+	}
+	unregister()
+	if _, ok := reg.Get(2); ok {
+		t.Error("Expected connection 2 to be removed")
+	}
+	if n := reg.Len(); n != 1 {
+		t.Errorf("Expected 1 open connection, got %d", n)
+	}
+}
+
+func queries(entries []Entry) string {
+	var qs []string
+	for _, e := range entries {
+		qs = append(qs, e.Query)
+	}
+	return strings.Join(qs, ",")
+}
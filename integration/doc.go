@@ -0,0 +1,9 @@
+// Package integration runs the batchsize, cache and sharding suites of the
+// proxy packages end-to-end against MariaDB and PostgreSQL containers, with
+// the proxies running in-process on ephemeral ports:
+//
+//	go test -tags=integration ./integration/...
+//
+// Docker (or another container runtime supported by testcontainers-go) is
+// required; no pre-provisioned databases are needed.
+package integration
@@ -0,0 +1,175 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/mariadb"
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/postgres"
+	"github.com/mevdschee/tqdbproxy/replica"
+
+	"github.com/testcontainers/testcontainers-go"
+	tcmariadb "github.com/testcontainers/testcontainers-go/modules/mariadb"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+)
+
+const (
+	mariadbImage  = "mariadb:11"
+	postgresImage = "postgres:16-alpine"
+
+	// Test names of the batchsize, cache and sharding suites
+	suites = "BatchSize|WriteBatch|BatchKey|Cache|SingleFlight|Shard|InitialHandshake"
+)
+
+// Addresses of the proxies and backends, set by TestMain
+var (
+	mariadbProxyAddr   string
+	mariadbBackendAddr string
+	postgresProxyAddr  string
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	ctx := context.Background()
+	metrics.Init()
+
+	queryCache, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		log.Printf("Failed to create cache: %v", err)
+		return 1
+	}
+
+	// MariaDB backend and proxy
+	mc, err := tcmariadb.Run(ctx, mariadbImage,
+		tcmariadb.WithDatabase("tqdbproxy"),
+		tcmariadb.WithUsername("tqdbproxy"),
+		tcmariadb.WithPassword("tqdbproxy"),
+	)
+	defer testcontainers.TerminateContainer(mc)
+	if err != nil {
+		log.Printf("Failed to start MariaDB container: %v", err)
+		return 1
+	}
+	mariadbBackendAddr, err = mc.PortEndpoint(ctx, "3306/tcp", "")
+	if err != nil {
+		log.Printf("Failed to get MariaDB endpoint: %v", err)
+		return 1
+	}
+	mariadbProxyAddr, err = freeAddr()
+	if err != nil {
+		log.Printf("Failed to find a free port: %v", err)
+		return 1
+	}
+	mcfg, mpools := proxyConfig(mariadbProxyAddr, mariadbBackendAddr)
+	mproxy := mariadb.New(mcfg, mpools, queryCache)
+	if err := mproxy.Start(); err != nil {
+		log.Printf("Failed to start MariaDB proxy: %v", err)
+		return 1
+	}
+	defer mproxy.Stop()
+
+	// PostgreSQL backend and proxy
+	pc, err := tcpostgres.Run(ctx, postgresImage,
+		tcpostgres.WithDatabase("tqdbproxy"),
+		tcpostgres.WithUsername("tqdbproxy"),
+		tcpostgres.WithPassword("tqdbproxy"),
+		tcpostgres.BasicWaitStrategies(),
+	)
+	defer testcontainers.TerminateContainer(pc)
+	if err != nil {
+		log.Printf("Failed to start PostgreSQL container: %v", err)
+		return 1
+	}
+	postgresBackendAddr, err := pc.PortEndpoint(ctx, "5432/tcp", "")
+	if err != nil {
+		log.Printf("Failed to get PostgreSQL endpoint: %v", err)
+		return 1
+	}
+	postgresProxyAddr, err = freeAddr()
+	if err != nil {
+		log.Printf("Failed to find a free port: %v", err)
+		return 1
+	}
+	pcfg, ppools := proxyConfig(postgresProxyAddr, postgresBackendAddr)
+	pproxy := postgres.New(pcfg, ppools, queryCache)
+	if err := pproxy.Start(); err != nil {
+		log.Printf("Failed to start PostgreSQL proxy: %v", err)
+		return 1
+	}
+	defer pproxy.Stop()
+
+	return m.Run()
+}
+
+// proxyConfig returns a single backend config that uses the backend as both
+// primary and replica, so reads with a ttl hint are routed to "replicas"
+func proxyConfig(listen, backend string) (config.ProxyConfig, map[string]*replica.Pool) {
+	pcfg := config.ProxyConfig{
+		Listen:  listen,
+		Default: "main",
+		Backends: map[string]config.BackendConfig{
+			"main": {Primary: backend, Replicas: []string{backend}, TCP: config.TCPConfig{NoDelay: true}},
+		},
+		DBMap:              map[string]string{},
+		WriteBatch:         config.WriteBatchConfig{MaxBatchSize: 1000},
+		MaxConnectionsWait: 5,
+		ReadRetries:        1,
+		TCP:                config.TCPConfig{NoDelay: true},
+	}
+	pools := map[string]*replica.Pool{
+		"main": replica.NewPool(backend, []string{backend}),
+	}
+	return pcfg, pools
+}
+
+// freeAddr returns a loopback address with an ephemeral port that is free
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// runSuites runs the suites of a proxy package against the proxy started by
+// TestMain. The package tests read the addresses from the environment.
+func runSuites(t *testing.T, pkg string, env ...string) {
+	args := []string{"test", "-count=1", "-run", suites}
+	if testing.Verbose() {
+		args = append(args, "-v")
+	}
+	cmd := exec.Command("go", append(args, pkg)...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Suites of %s failed: %v", pkg, err)
+	}
+}
+
+func TestMariaDB(t *testing.T) {
+	runSuites(t, "github.com/mevdschee/tqdbproxy/mariadb",
+		fmt.Sprintf("TQDBPROXY_MARIADB_ADDR=%s", mariadbProxyAddr),
+		fmt.Sprintf("TQDBPROXY_MARIADB_BACKEND=%s", mariadbBackendAddr),
+	)
+}
+
+func TestPostgreSQL(t *testing.T) {
+	runSuites(t, "github.com/mevdschee/tqdbproxy/postgres",
+		fmt.Sprintf("TQDBPROXY_POSTGRES_ADDR=%s", postgresProxyAddr),
+	)
+}
@@ -0,0 +1,211 @@
+// Package killswitch holds switches that disable a feature of the proxy for
+// all connections of both protocols at once, to stop caching or write
+// batching during an incident without a config reload:
+//
+//	SET GLOBAL tqdb_cache = OFF     -- hints are ignored, nothing is cached
+//	SET GLOBAL tqdb_batching = OFF  -- writes execute immediately
+//
+// Only the users listed in admin_users may toggle a switch. Every change is
+// logged and recorded in an audit trail, kept in memory for the admin API and
+// optionally appended to a file as JSON lines. With persist the new state is
+// also written to the [killswitches] section of the configuration file, so
+// that it survives a restart.
+package killswitch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"gopkg.in/ini.v1"
+)
+
+// Features that can be switched off
+const (
+	Cache    = "cache"    // Result caching: ttl hints, the repeated query boost and the metadata cache
+	Batching = "batching" // Write batching: batch hints and the default batch window
+)
+
+// Features lists the features that have a kill switch
+var Features = []string{Cache, Batching}
+
+// Section is the configuration section holding the switches
+const Section = "killswitches"
+
+// ByConfig is the author of changes read from the configuration file, which
+// are not persisted back to it
+const ByConfig = "config"
+
+// maxAudit limits the changes kept in memory
+const maxAudit = 100
+
+// Change is an entry of the audit trail
+type Change struct {
+	Time    time.Time `json:"time"`
+	Feature string    `json:"feature"`
+	Enabled bool      `json:"enabled"`
+	By      string    `json:"by"` // User and client address, or ByConfig
+}
+
+// Switches holds the state of the kill switches. A nil Switches has every
+// feature enabled.
+type Switches struct {
+	mu         sync.RWMutex
+	disabled   map[string]bool
+	audit      []Change
+	auditFile  string // JSON lines file the changes are appended to ("" = none)
+	configFile string // Configuration file the state is persisted to ("" = not persisted)
+	now        func() time.Time
+}
+
+// New creates switches with every feature enabled
+func New() *Switches {
+	s := &Switches{disabled: make(map[string]bool), now: time.Now}
+	for _, feature := range Features {
+		metrics.KillSwitchEnabled.WithLabelValues(feature).Set(1)
+	}
+	return s
+}
+
+// Configure sets the audit file and the configuration file that changes are
+// persisted to, where "" disables either
+func (s *Switches) Configure(auditFile, configFile string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auditFile = auditFile
+	s.configFile = configFile
+}
+
+// Enabled reports whether a feature is enabled
+func (s *Switches) Enabled(feature string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !s.disabled[feature]
+}
+
+// Set enables or disables a feature on behalf of by, which is recorded in the
+// audit trail. Setting the current state records nothing.
+func (s *Switches) Set(feature string, enabled bool, by string) error {
+	if s == nil {
+		return fmt.Errorf("kill switches are not available")
+	}
+	if !slices.Contains(Features, feature) {
+		return fmt.Errorf("unknown feature %q", feature)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disabled[feature] == !enabled {
+		return nil
+	}
+	s.disabled[feature] = !enabled
+	change := Change{Time: s.now(), Feature: feature, Enabled: enabled, By: by}
+	s.audit = append(s.audit, change)
+	if len(s.audit) > maxAudit {
+		s.audit = s.audit[len(s.audit)-maxAudit:]
+	}
+	gauge := 0.0
+	if enabled {
+		gauge = 1
+	}
+	metrics.KillSwitchEnabled.WithLabelValues(feature).Set(gauge)
+	log.Printf("[KillSwitch] %s %s by %s", feature, state(enabled), by)
+	if err := s.appendAudit(change); err != nil {
+		log.Printf("[KillSwitch] Failed to write audit file: %v", err)
+	}
+	if by == ByConfig {
+		return nil
+	}
+	if err := s.persist(feature, enabled); err != nil {
+		log.Printf("[KillSwitch] Failed to persist %s to the config file: %v", feature, err)
+	}
+	return nil
+}
+
+// States returns whether each feature is enabled
+func (s *Switches) States() map[string]bool {
+	states := make(map[string]bool, len(Features))
+	for _, feature := range Features {
+		states[feature] = s.Enabled(feature)
+	}
+	return states
+}
+
+// Audit returns the recorded changes, oldest first
+func (s *Switches) Audit() []Change {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Change(nil), s.audit...)
+}
+
+// Apply returns parsed with the hints of disabled features cleared. The query
+// is copied when it changes, so parsed queries of prepared statements are
+// left alone.
+func (s *Switches) Apply(parsed *parser.ParsedQuery) *parser.ParsedQuery {
+	noCache := (parsed.TTL > 0 || parsed.NegTTL > 0) && !s.Enabled(Cache)
+	noBatch := parsed.BatchMs > 0 && !s.Enabled(Batching)
+	if !noCache && !noBatch {
+		return parsed
+	}
+	switched := *parsed
+	if noCache {
+		switched.TTL = 0
+		switched.NegTTL = 0
+	}
+	if noBatch {
+		switched.BatchMs = 0
+	}
+	return &switched
+}
+
+// appendAudit appends a change to the audit file, with s.mu held
+func (s *Switches) appendAudit(change Change) error {
+	if s.auditFile == "" {
+		return nil
+	}
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.auditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// persist writes the state of a feature to the configuration file, with s.mu
+// held
+func (s *Switches) persist(feature string, enabled bool) error {
+	if s.configFile == "" {
+		return nil
+	}
+	cfg, err := ini.Load(s.configFile)
+	if err != nil {
+		return err
+	}
+	cfg.Section(Section).Key(feature).SetValue(state(enabled))
+	return cfg.SaveTo(s.configFile)
+}
+
+func state(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,75 @@
+package killswitch
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+func TestSwitches(t *testing.T) {
+	s := New()
+	parsed := parser.Parse("/* ttl:60 batch:10 */ SELECT 1")
+	if got := s.Apply(parsed); got != parsed {
+		t.Error("Expected the query to be left alone while all features are enabled")
+	}
+
+	if err := s.Set(Cache, false, "admin@10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled(Cache) || !s.Enabled(Batching) {
+		t.Errorf("Expected only the cache to be disabled, got %v", s.States())
+	}
+	got := s.Apply(parsed)
+	if got.TTL != 0 || got.BatchMs != 10 || parsed.TTL != 60 {
+		t.Errorf("Expected a copy without the ttl hint, got ttl %d batch %d (original ttl %d)", got.TTL, got.BatchMs, parsed.TTL)
+	}
+
+	// Setting the current state is not recorded
+	s.Set(Cache, false, "admin@10.0.0.1")
+	s.Set(Cache, true, ByConfig)
+	audit := s.Audit()
+	if len(audit) != 2 || audit[0].Enabled || audit[1].By != ByConfig {
+		t.Errorf("Expected 2 changes in the audit trail, got %+v", audit)
+	}
+
+	if err := s.Set("replicas", false, "admin"); err == nil {
+		t.Error("Expected an error for an unknown feature")
+	}
+	var none *Switches
+	if !none.Enabled(Cache) || none.Set(Cache, false, "admin") == nil {
+		t.Error("Expected nil switches to have every feature enabled and refuse changes")
+	}
+}
+
+func TestSwitches_AuditAndPersist(t *testing.T) {
+	dir := t.TempDir()
+	auditFile := filepath.Join(dir, "audit.log")
+	configFile := filepath.Join(dir, "config.ini")
+	if err := os.WriteFile(configFile, []byte("[mariadb]\nlisten = :3307\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := New()
+	s.Configure(auditFile, configFile)
+	s.Set(Batching, false, "admin@10.0.0.1")
+
+	audit, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(audit), `"feature":"batching","enabled":false,"by":"admin@10.0.0.1"`) {
+		t.Errorf("Expected the change in the audit file, got %s", audit)
+	}
+	config, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"listen = :3307", "[killswitches]", "batching = off"} {
+		if !strings.Contains(string(config), want) {
+			t.Errorf("Expected the config file to contain %q, got %s", want, config)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/tcpopt"
+)
+
+// ErrTooManyConnections is returned when no connection slot for a backend
+// address became available within the configured wait time
+var ErrTooManyConnections = errors.New("too many backend connections")
+
+// ConnLimiter caps the number of open connections per backend address, across
+// client sessions, write batch managers and internal pools. A connection
+// holds its slot from dial until Close. Addresses use the pool notation:
+// "host:port" for TCP and "unix:/path" for Unix sockets.
+type ConnLimiter struct {
+	mu      sync.RWMutex
+	limits  map[string]int
+	sems    map[string]*Semaphore
+	wait    time.Duration
+	dialer  net.Dialer
+	options map[string]tcpopt.Options // TCP options per address
+}
+
+// NewConnLimiter creates a limiter with per-address limits (<= 0 or missing
+// means unlimited). Dials wait up to wait for a free slot before failing
+// with ErrTooManyConnections.
+func NewConnLimiter(limits map[string]int, wait time.Duration) *ConnLimiter {
+	l := &ConnLimiter{
+		sems:   make(map[string]*Semaphore),
+		dialer: net.Dialer{KeepAlive: 30 * time.Second},
+	}
+	l.Update(limits, wait)
+	return l
+}
+
+// Update replaces the limits, e.g. on config reload. Addresses whose limit
+// changed get a new semaphore; connections opened before the change release
+// their slot in the old one, so the new limit is reached as they close.
+func (l *ConnLimiter) Update(limits map[string]int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for addr := range l.sems {
+		if limits[addr] != l.limits[addr] {
+			delete(l.sems, addr)
+		}
+	}
+	for addr, n := range limits {
+		if _, exists := l.sems[addr]; !exists {
+			if sem := NewSemaphore(n); sem != nil {
+				l.sems[addr] = sem
+			}
+		}
+	}
+	l.limits = limits
+	l.wait = wait
+}
+
+// SetTCPOptions sets the TCP options applied to new connections, per address.
+// Addresses without options use the Go defaults.
+func (l *ConnLimiter) SetTCPOptions(options map[string]tcpopt.Options) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.options = options
+}
+
+// DialContext dials the backend once a connection slot for the address is
+// available. Its signature matches net.Dialer.DialContext.
+func (l *ConnLimiter) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	key := address
+	if network == "unix" {
+		key = "unix:" + address
+	}
+	return l.DialKey(ctx, key, network, address)
+}
+
+// DialKey is like DialContext, but counts the connection against the limit
+// of the pool address key. Use it when the dialed address differs from the
+// configured one, e.g. the socket file inside a configured socket directory.
+func (l *ConnLimiter) DialKey(ctx context.Context, key, network, address string) (net.Conn, error) {
+	l.mu.RLock()
+	sem := l.sems[key]
+	wait := l.wait
+	opts, hasOpts := l.options[key]
+	l.mu.RUnlock()
+
+	wctx, cancel := context.WithTimeout(ctx, wait)
+	err := sem.Acquire(wctx)
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w to %s", ErrTooManyConnections, key)
+	}
+
+	conn, err := l.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		sem.Release()
+		return nil, err
+	}
+	if hasOpts {
+		if err := opts.Apply(conn); err != nil {
+			conn.Close()
+			sem.Release()
+			return nil, fmt.Errorf("setting TCP options for %s: %w", key, err)
+		}
+	}
+	if sem == nil {
+		return conn, nil
+	}
+	return &limitedConn{Conn: conn, sem: sem}, nil
+}
+
+// Open returns the number of open connections to addr, or 0 when addr is
+// unlimited (unlimited connections are not counted)
+func (l *ConnLimiter) Open(addr string) int {
+	l.mu.RLock()
+	sem := l.sems[addr]
+	l.mu.RUnlock()
+	return sem.InUse()
+}
+
+// limitedConn releases its connection slot when closed
+type limitedConn struct {
+	net.Conn
+	sem  *Semaphore
+	once sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.sem.Release)
+	return err
+}
@@ -0,0 +1,158 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/tcpopt"
+)
+
+func listen(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	return ln
+}
+
+func TestConnLimiter_Reject(t *testing.T) {
+	ln := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	l := NewConnLimiter(map[string]int{addr: 2}, 0)
+
+	c1, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("First dial failed: %v", err)
+	}
+	c2, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Second dial failed: %v", err)
+	}
+	if n := l.Open(addr); n != 2 {
+		t.Errorf("Expected 2 open connections, got %d", n)
+	}
+
+	if _, err := l.DialContext(context.Background(), "tcp", addr); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("Expected ErrTooManyConnections, got %v", err)
+	}
+
+	// Closing twice releases only one slot
+	c1.Close()
+	c1.Close()
+	if n := l.Open(addr); n != 1 {
+		t.Errorf("Expected 1 open connection after close, got %d", n)
+	}
+
+	c3, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial after close failed: %v", err)
+	}
+	c2.Close()
+	c3.Close()
+}
+
+func TestConnLimiter_Queue(t *testing.T) {
+	ln := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	l := NewConnLimiter(map[string]int{addr: 1}, time.Second)
+
+	c1, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("First dial failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := l.DialContext(context.Background(), "tcp", addr)
+		if err == nil {
+			c.Close()
+		}
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	c1.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Queued dial failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Queued dial did not complete")
+	}
+}
+
+func TestConnLimiter_Unlimited(t *testing.T) {
+	ln := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	l := NewConnLimiter(nil, 0)
+	for i := 0; i < 5; i++ {
+		c, err := l.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial %d failed: %v", i, err)
+		}
+		defer c.Close()
+	}
+}
+
+func TestConnLimiter_Update(t *testing.T) {
+	ln := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	l := NewConnLimiter(map[string]int{addr: 1}, 0)
+	c1, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("First dial failed: %v", err)
+	}
+	defer c1.Close()
+
+	l.Update(map[string]int{addr: 2}, 0)
+	c2, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial after raising the limit failed: %v", err)
+	}
+	defer c2.Close()
+}
+
+func TestConnLimiter_TCPOptions(t *testing.T) {
+	ln := listen(t)
+	defer ln.Close()
+	addr := ln.Addr().String()
+
+	l := NewConnLimiter(map[string]int{addr: 1}, 0)
+	l.SetTCPOptions(map[string]tcpopt.Options{
+		addr: {KeepAlive: 5 * time.Second, UserTimeout: 10 * time.Second, NoDelay: true, ReadBuffer: 64 * 1024},
+	})
+
+	c, err := l.DialContext(context.Background(), "tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial with TCP options failed: %v", err)
+	}
+	if n := l.Open(addr); n != 1 {
+		t.Errorf("Expected 1 open connection, got %d", n)
+	}
+	c.Close()
+	if n := l.Open(addr); n != 0 {
+		t.Errorf("Expected 0 open connections after close, got %d", n)
+	}
+}
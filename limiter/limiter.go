@@ -0,0 +1,146 @@
+// Package limiter provides fair concurrency limits for backend operations.
+//
+// It is used to cap the number of immediate (non-batched) writes that may be
+// in flight against a backend at the same time. Excess callers are queued and
+// admitted in FIFO order, so a burst of writers during a batching outage is
+// smoothed out instead of hitting the backend all at once.
+package limiter
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Semaphore is a counting semaphore that admits waiters in FIFO order.
+// A nil *Semaphore is valid and never blocks.
+type Semaphore struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	waiters list.List // of chan struct{}
+}
+
+// NewSemaphore creates a semaphore with n slots. It returns nil (unlimited)
+// when n <= 0.
+func NewSemaphore(n int) *Semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return &Semaphore{size: n}
+}
+
+// Acquire waits for a free slot or until ctx is done.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.used < s.size && s.waiters.Len() == 0 {
+		s.used++
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// Slot was handed over just as we gave up; pass it on
+			s.mu.Unlock()
+			s.Release()
+		default:
+			s.waiters.Remove(elem)
+			s.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot, handing it directly to the oldest waiter if any.
+func (s *Semaphore) Release() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if front := s.waiters.Front(); front != nil {
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	s.used--
+}
+
+// InUse returns the number of occupied slots
+func (s *Semaphore) InUse() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Waiting returns the number of queued callers
+func (s *Semaphore) Waiting() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
+
+// WriteLimiter combines a global semaphore with one semaphore per backend.
+// A write must hold a slot in both before it is sent to the backend.
+type WriteLimiter struct {
+	global   *Semaphore
+	backends map[string]*Semaphore
+}
+
+// NewWriteLimiter creates a limiter with a global limit and per-backend
+// limits keyed by backend name. Limits <= 0 mean unlimited.
+func NewWriteLimiter(global int, backends map[string]int) *WriteLimiter {
+	l := &WriteLimiter{
+		global:   NewSemaphore(global),
+		backends: make(map[string]*Semaphore),
+	}
+	for name, n := range backends {
+		if sem := NewSemaphore(n); sem != nil {
+			l.backends[name] = sem
+		}
+	}
+	return l
+}
+
+// Acquire waits for a slot for the given backend. On success it returns a
+// function that must be called to release the slot.
+func (l *WriteLimiter) Acquire(ctx context.Context, backend string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	// Per-backend first so that writers for a saturated backend do not hold
+	// global slots that writers for other backends could use.
+	sem := l.backends[backend]
+	if err := sem.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.global.Acquire(ctx); err != nil {
+		sem.Release()
+		return nil, err
+	}
+	return func() {
+		l.global.Release()
+		sem.Release()
+	}, nil
+}
@@ -0,0 +1,127 @@
+package limiter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSemaphore_NilIsUnlimited(t *testing.T) {
+	s := NewSemaphore(0)
+	if s != nil {
+		t.Fatalf("NewSemaphore(0) should return nil")
+	}
+	for i := 0; i < 100; i++ {
+		if err := s.Acquire(context.Background()); err != nil {
+			t.Fatalf("Acquire on nil semaphore failed: %v", err)
+		}
+	}
+	s.Release()
+}
+
+func TestSemaphore_Limit(t *testing.T) {
+	s := NewSemaphore(2)
+	ctx := context.Background()
+
+	s.Acquire(ctx)
+	s.Acquire(ctx)
+	if s.InUse() != 2 {
+		t.Errorf("Expected 2 slots in use, got %d", s.InUse())
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(timeoutCtx); err == nil {
+		t.Error("Third Acquire should have timed out")
+	}
+	if s.Waiting() != 0 {
+		t.Errorf("Timed out waiter should be removed, got %d waiting", s.Waiting())
+	}
+
+	s.Release()
+	if err := s.Acquire(ctx); err != nil {
+		t.Errorf("Acquire after Release failed: %v", err)
+	}
+}
+
+func TestSemaphore_FIFO(t *testing.T) {
+	s := NewSemaphore(1)
+	ctx := context.Background()
+	s.Acquire(ctx)
+
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			s.Acquire(ctx)
+			mu.Lock()
+			order = append(order, n)
+			mu.Unlock()
+			s.Release()
+		}(i)
+		// Make sure waiters queue up in a known order
+		for s.Waiting() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	s.Release()
+	wg.Wait()
+
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("Waiters admitted out of order: %v", order)
+		}
+	}
+	if s.InUse() != 0 {
+		t.Errorf("Expected 0 slots in use, got %d", s.InUse())
+	}
+}
+
+func TestWriteLimiter_PerBackend(t *testing.T) {
+	l := NewWriteLimiter(0, map[string]int{"main": 1})
+	ctx := context.Background()
+
+	release, err := l.Acquire(ctx, "main")
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	// Other backends are not limited
+	releaseOther, err := l.Acquire(ctx, "shard1")
+	if err != nil {
+		t.Fatalf("Acquire for unlimited backend failed: %v", err)
+	}
+	releaseOther()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(timeoutCtx, "main"); err == nil {
+		t.Error("Second Acquire for main should have timed out")
+	}
+
+	release()
+	release, err = l.Acquire(ctx, "main")
+	if err != nil {
+		t.Fatalf("Acquire after release failed: %v", err)
+	}
+	release()
+}
+
+func TestWriteLimiter_Global(t *testing.T) {
+	l := NewWriteLimiter(1, nil)
+	ctx := context.Background()
+
+	release, _ := l.Acquire(ctx, "main")
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(timeoutCtx, "shard1"); err == nil {
+		t.Error("Global limit should apply across backends")
+	}
+	release()
+}
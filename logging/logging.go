@@ -0,0 +1,203 @@
+// Package logging configures the log output of the proxy: the minimum level,
+// text or JSON records, and whether the text of queries is logged, redacted or
+// left out.
+//
+// The records are written by log/slog. Messages of the standard log package,
+// which the proxy uses throughout, are passed to the same handler: the
+// "[Component]" prefix becomes the component field and the level is derived
+// from the message, so "Failed ..." and "... error" are logged as errors and
+// "Warning ..." and "... retrying" as warnings.
+//
+// At the debug level every statement is also logged as a request record, with
+// structured fields for the connection, backend, shard, query type, duration,
+// cache hit and batch size.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Modes of logging query text
+const (
+	QueryNone     = "none"     // Queries are not logged
+	QueryRedacted = "redacted" // Literals are replaced with ?
+	QueryFull     = "full"     // Queries are logged as sent
+)
+
+// Config is the [log] section of the configuration
+type Config struct {
+	Level     string // debug, info, warn or error
+	Format    string // FormatText or FormatJSON
+	QueryText string // QueryNone, QueryRedacted or QueryFull
+}
+
+var (
+	level     slog.LevelVar
+	queryText atomic.Value // string, one of the Query* modes
+)
+
+func init() {
+	queryText.Store(QueryRedacted)
+}
+
+// Configure installs a handler for the given configuration that writes to
+// stderr. It can be called again on a config reload.
+func Configure(cfg Config) error {
+	handler, err := newHandler(cfg, os.Stderr)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	// After slog.SetDefault, which redirects the log package itself
+	log.SetOutput(&logWriter{handler: handler})
+	log.SetFlags(0)
+	return nil
+}
+
+// newHandler validates cfg, applies its level and query text mode and returns
+// a handler writing to w
+func newHandler(cfg Config, w io.Writer) (slog.Handler, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+	switch cfg.QueryText {
+	case QueryNone, QueryRedacted, QueryFull:
+	default:
+		return nil, fmt.Errorf("invalid query_text %q, expected none, redacted or full", cfg.QueryText)
+	}
+	opts := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	switch cfg.Format {
+	case FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", cfg.Format)
+	}
+	level.Set(lvl)
+	queryText.Store(cfg.QueryText)
+	return handler, nil
+}
+
+// QueryText returns a query as it may be logged: redacted, in full, or "" when
+// query text logging is disabled
+func QueryText(query string) string {
+	switch queryText.Load() {
+	case QueryNone:
+		return ""
+	case QueryFull:
+		return query
+	default:
+		return parser.Fingerprint(query)
+	}
+}
+
+// Request is a statement handled on a client connection
+type Request struct {
+	Protocol  string // "mariadb" or "postgres"
+	ConnID    uint32
+	User      string
+	Database  string
+	Backend   string // Backend that answered, "cache", "write-batch" or "proxy"
+	Shard     string
+	QueryType string
+	Query     string // As sent by the client, passed through QueryText
+	Duration  time.Duration
+	CacheHit  bool
+	BatchSize int // Size of the write batch the statement was part of (0 = not batched)
+	Err       error
+}
+
+// Requests reports whether request records are logged, so that callers can
+// skip collecting their fields
+func Requests() bool {
+	return level.Level() <= slog.LevelDebug
+}
+
+// LogRequest logs a request record at the debug level
+func LogRequest(r Request) {
+	if !Requests() {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("component", "request"),
+		slog.String("protocol", r.Protocol),
+		slog.Uint64("conn_id", uint64(r.ConnID)),
+		slog.String("user", r.User),
+		slog.String("database", r.Database),
+		slog.String("backend", r.Backend),
+		slog.String("shard", r.Shard),
+		slog.String("query_type", r.QueryType),
+		slog.Float64("duration_ms", float64(r.Duration.Microseconds())/1000),
+		slog.Bool("cache_hit", r.CacheHit),
+	}
+	if r.BatchSize > 0 {
+		attrs = append(attrs, slog.Int("batch_size", r.BatchSize))
+	}
+	if query := QueryText(r.Query); query != "" {
+		attrs = append(attrs, slog.String("query", query))
+	}
+	if r.Err != nil {
+		attrs = append(attrs, slog.String("error", r.Err.Error()))
+	}
+	slog.LogAttrs(context.Background(), slog.LevelDebug, "Request", attrs...)
+}
+
+// logWriter passes the messages of the log package to a handler
+type logWriter struct {
+	handler slog.Handler
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	component := ""
+	if strings.HasPrefix(msg, "[") {
+		if end := strings.Index(msg, "] "); end > 0 {
+			component, msg = msg[1:end], msg[end+2:]
+		}
+	}
+	lvl := messageLevel(msg)
+	if !w.handler.Enabled(context.Background(), lvl) {
+		return len(p), nil
+	}
+	record := slog.NewRecord(time.Now(), lvl, msg, 0)
+	if component != "" {
+		record.AddAttrs(slog.String("component", component))
+	}
+	if err := w.handler.Handle(context.Background(), record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// messageLevel derives the level of a message of the log package
+func messageLevel(msg string) slog.Level {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(lower, "warning"), strings.Contains(lower, "retrying"):
+		return slog.LevelWarn
+	case strings.HasPrefix(lower, "failed"), strings.HasPrefix(lower, "cannot"),
+		strings.Contains(lower, " failed"), strings.Contains(lower, "error"):
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
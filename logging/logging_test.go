@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewHandler_Invalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Level: "verbose", Format: FormatText, QueryText: QueryFull},
+		{Level: "info", Format: "xml", QueryText: QueryFull},
+		{Level: "info", Format: FormatText, QueryText: "some"},
+	} {
+		if _, err := newHandler(cfg, &bytes.Buffer{}); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := newHandler(Config{Level: "warn", Format: FormatJSON, QueryText: QueryRedacted}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &logWriter{handler: handler}
+	w.Write([]byte("[MariaDB] Listening on :3307\n"))
+	w.Write([]byte("[PostgreSQL] Client write error: broken pipe\n"))
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Expected a single JSON record, got %s", out.String())
+	}
+	if record["level"] != "ERROR" || record["component"] != "PostgreSQL" || record["msg"] != "Client write error: broken pipe" {
+		t.Errorf("Unexpected record %v", record)
+	}
+}
+
+func TestMessageLevel(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want slog.Level
+	}{
+		{"Listening on :5433", slog.LevelInfo},
+		{"Warning: auth = md5 requires an auth_file", slog.LevelWarn},
+		{"Read on replica1 (10.0.0.2) failed, retrying (1/3): EOF", slog.LevelWarn},
+		{"Failed to persist cache to the config file", slog.LevelError},
+		{"Cache verification failed: timeout", slog.LevelError},
+		{"TQDB status response error: EOF", slog.LevelError},
+	}
+	for _, tt := range tests {
+		if got := messageLevel(tt.msg); got != tt.want {
+			t.Errorf("messageLevel(%q) = %v, expected %v", tt.msg, got, tt.want)
+		}
+	}
+}
+
+func TestQueryText(t *testing.T) {
+	defer queryText.Store(QueryRedacted)
+	query := "SELECT * FROM users WHERE email = 'a@example.com'"
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{QueryNone, ""},
+		{QueryFull, query},
+	}
+	for _, tt := range tests {
+		queryText.Store(tt.mode)
+		if got := QueryText(query); got != tt.want {
+			t.Errorf("QueryText in mode %s = %q, expected %q", tt.mode, got, tt.want)
+		}
+	}
+	queryText.Store(QueryRedacted)
+	if got := QueryText(query); strings.Contains(got, "example.com") {
+		t.Errorf("Expected the literal to be redacted, got %q", got)
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := newHandler(Config{Level: "debug", Format: FormatText, QueryText: QueryRedacted}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer level.Set(slog.LevelInfo)
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	defer func() {
+		slog.SetDefault(previous)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+
+	LogRequest(Request{Protocol: "mariadb", ConnID: 7, Backend: "write-batch", Shard: "main", QueryType: "insert",
+		Query: "INSERT INTO logs VALUES ('secret')", BatchSize: 12})
+	for _, want := range []string{"level=DEBUG", "msg=Request", "conn_id=7", "backend=write-batch", "shard=main", "query_type=insert", "batch_size=12", "cache_hit=false"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected the record to contain %q, got %s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("Expected the query to be redacted, got %s", out.String())
+	}
+}
@@ -0,0 +1,321 @@
+// Package logical consumes a logical replication slot of a PostgreSQL
+// primary, to invalidate cached results of tables that change through writes
+// that do not pass the proxy, such as jobs, other applications or other proxy
+// instances. It is the PostgreSQL counterpart of package binlog.
+//
+// The listener creates a temporary slot with the built-in pgoutput plugin and
+// streams the changes of a publication. Insert, update, delete and truncate
+// messages are mapped to their tables through the preceding relation
+// messages, and the tables of a transaction are invalidated when it commits.
+// A relation message that differs from the last one of its table signals a
+// schema change. Every proxy instance consumes its own slot, so every instance
+// invalidates its own cache. There is no gossip layer that broadcasts the
+// changed tables to peer proxies.
+//
+// A temporary slot is dropped with its connection: after a lost connection the
+// listener creates a new slot, and changes committed in between are not seen.
+// The account needs the REPLICATION attribute, and the publication must exist
+// in the database (CREATE PUBLICATION tqdbproxy FOR ALL TABLES).
+//
+// https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+package logical
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// Messages of the streaming replication protocol, in CopyData
+const (
+	xLogData        = 'w'
+	keepalive       = 'k'
+	standbyStatus   = 'r'
+	pgoutputBegin   = 'B'
+	pgoutputCommit  = 'C'
+	pgoutputRel     = 'R'
+	pgoutputInsert  = 'I'
+	pgoutputUpdate  = 'U'
+	pgoutputDelete  = 'D'
+	pgoutputTrunc   = 'T'
+	xLogDataHeader  = 24 // Start and end LSN, send time
+	keepaliveLength = 17 // End LSN, send time, reply requested
+)
+
+// statusInterval is the interval of the standby status updates that confirm
+// the received changes, so that the primary can recycle its WAL
+const statusInterval = 10 * time.Second
+
+// retryDelay is the delay between reconnects, set by tests
+var retryDelay = 5 * time.Second
+
+// postgresEpoch is the origin of replication timestamps
+var postgresEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Listener consumes a logical replication slot of one primary
+type Listener struct {
+	Name        string                                      // Backend name, for logging
+	Slot        string                                      // Name of the temporary slot, unique on the primary
+	Publication string                                      // Publication to stream the changes of
+	Dial        func(ctx context.Context) (net.Conn, error) // Connects and authenticates a replication connection to the database
+	Invalidate  func(tables []string, ddl bool)             // Called with the lowercase names of changed tables
+
+	relations map[uint32]relation // Relation ID -> last relation message
+	changed   []string            // Tables changed by the current transaction
+}
+
+// relation is a table as described by a relation message
+type relation struct {
+	name string // Lowercase table name, without schema
+	desc []byte // Message body, compared to detect schema changes
+}
+
+// Run consumes the slot until ctx is done, reconnecting after errors
+func (l *Listener) Run(ctx context.Context) {
+	for {
+		err := l.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[Logical] Following %s failed, reconnecting: %v", l.Name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// follow creates the slot and processes changes until an error occurs
+func (l *Listener) follow(ctx context.Context) error {
+	conn, err := l.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	r := bufio.NewReader(conn)
+
+	create := fmt.Sprintf("CREATE_REPLICATION_SLOT %s TEMPORARY LOGICAL pgoutput NOEXPORT_SNAPSHOT", quoteIdent(l.Slot))
+	if err := command(conn, r, create); err != nil {
+		return err
+	}
+	start := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names %s)",
+		quoteIdent(l.Slot), quoteLiteral(quoteIdent(l.Publication)))
+	if _, err := conn.Write(pgproto.Query{String: start}.Encode(nil)); err != nil {
+		return err
+	}
+	for {
+		msgType, _, err := readMessage(r)
+		if err != nil {
+			return err
+		}
+		if msgType == pgproto.MsgCopyBothResponse {
+			break
+		}
+	}
+	log.Printf("[Logical] Following %s with slot %s", l.Name, l.Slot)
+
+	l.relations = make(map[uint32]relation)
+	l.changed = nil
+	status := newStatus(conn)
+	defer status.stop()
+	for {
+		msgType, payload, err := readMessage(r)
+		if err != nil {
+			return err
+		}
+		switch {
+		case msgType == pgproto.MsgCopyDone:
+			return errors.New("replication stream ended")
+		case msgType != pgproto.MsgCopyData || len(payload) == 0:
+			continue
+		case payload[0] == xLogData && len(payload) >= 1+xLogDataHeader:
+			data := payload[1+xLogDataHeader:]
+			l.handle(data)
+			status.received(binary.BigEndian.Uint64(payload[1:]) + uint64(len(data)))
+		case payload[0] == keepalive && len(payload) >= 1+keepaliveLength:
+			status.received(binary.BigEndian.Uint64(payload[1:]))
+			if payload[keepaliveLength] == 1 {
+				status.send()
+			}
+		}
+	}
+}
+
+// handle processes a pgoutput message
+func (l *Listener) handle(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	body := msg[1:]
+	switch msg[0] {
+	case pgoutputBegin:
+		l.changed = l.changed[:0]
+	case pgoutputRel:
+		id, rel, ok := parseRelation(body)
+		if !ok {
+			return
+		}
+		if old, known := l.relations[id]; known && !bytes.Equal(old.desc, rel.desc) {
+			l.Invalidate([]string{rel.name}, true)
+		}
+		l.relations[id] = rel
+	case pgoutputInsert, pgoutputUpdate, pgoutputDelete:
+		if len(body) >= 4 {
+			l.change(binary.BigEndian.Uint32(body))
+		}
+	case pgoutputTrunc:
+		if len(body) < 5 {
+			return
+		}
+		n := int(binary.BigEndian.Uint32(body))
+		ids := body[5:]
+		for i := 0; i < n && len(ids) >= 4*(i+1); i++ {
+			l.change(binary.BigEndian.Uint32(ids[4*i:]))
+		}
+	case pgoutputCommit:
+		if len(l.changed) > 0 {
+			l.Invalidate(l.changed, false)
+			l.changed = nil
+		}
+	}
+}
+
+// change records a change of the relation with the given ID in the current
+// transaction
+func (l *Listener) change(id uint32) {
+	rel, ok := l.relations[id]
+	if !ok {
+		return
+	}
+	for _, table := range l.changed {
+		if table == rel.name {
+			return
+		}
+	}
+	l.changed = append(l.changed, rel.name)
+}
+
+// parseRelation reads the ID and table name of a relation message
+func parseRelation(body []byte) (uint32, relation, bool) {
+	if len(body) < 4 {
+		return 0, relation{}, false
+	}
+	id := binary.BigEndian.Uint32(body)
+	_, rest, ok := bytes.Cut(body[4:], []byte{0}) // Namespace
+	if !ok {
+		return 0, relation{}, false
+	}
+	name, _, ok := bytes.Cut(rest, []byte{0})
+	if !ok || len(name) == 0 {
+		return 0, relation{}, false
+	}
+	return id, relation{name: strings.ToLower(string(name)), desc: bytes.Clone(body)}, true
+}
+
+// readMessage reads a message, returning an ErrorResponse as error
+func readMessage(r *bufio.Reader) (byte, []byte, error) {
+	msgType, payload, err := pgproto.ReadMessage(r)
+	if err == nil && msgType == pgproto.MsgErrorResponse {
+		var e pgproto.ErrorResponse
+		if err := e.Decode(payload); err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, e
+	}
+	return msgType, payload, err
+}
+
+// command runs a replication command and reads its response up to
+// ReadyForQuery
+func command(conn net.Conn, r *bufio.Reader, query string) error {
+	if _, err := conn.Write(pgproto.Query{String: query}.Encode(nil)); err != nil {
+		return err
+	}
+	for {
+		msgType, _, err := readMessage(r)
+		if err != nil {
+			return err
+		}
+		if msgType == pgproto.MsgReadyForQuery {
+			return nil
+		}
+	}
+}
+
+// status confirms the received changes to the primary, on request and every
+// statusInterval
+type status struct {
+	conn  net.Conn
+	mu    sync.Mutex
+	lsn   uint64 // End of the received WAL
+	timer *time.Ticker
+	done  chan struct{}
+}
+
+// newStatus starts sending standby status updates on conn
+func newStatus(conn net.Conn) *status {
+	s := &status{conn: conn, timer: time.NewTicker(statusInterval), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-s.timer.C:
+				s.send()
+			}
+		}
+	}()
+	return s
+}
+
+// received advances the confirmed position to lsn
+func (s *status) received(lsn uint64) {
+	s.mu.Lock()
+	s.lsn = max(s.lsn, lsn)
+	s.mu.Unlock()
+}
+
+// send sends a standby status update. A failed write closes the connection,
+// which ends the stream.
+func (s *status) send() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := []byte{standbyStatus}
+	for range 3 { // Written, flushed and applied
+		msg = binary.BigEndian.AppendUint64(msg, s.lsn)
+	}
+	msg = binary.BigEndian.AppendUint64(msg, uint64(time.Since(postgresEpoch).Microseconds()))
+	msg = append(msg, 0)
+	if err := pgproto.WriteMessage(s.conn, pgproto.MsgCopyData, msg); err != nil {
+		s.conn.Close()
+	}
+}
+
+// stop stops the periodic updates
+func (s *status) stop() {
+	s.timer.Stop()
+	close(s.done)
+}
+
+// quoteIdent quotes an identifier for a replication command
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteLiteral quotes a string literal for a replication command
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
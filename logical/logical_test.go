@@ -0,0 +1,154 @@
+package logical
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// xlog returns CopyData messages with one pgoutput message each, from lsn
+func xlog(lsn uint64, msgs ...[]byte) []byte {
+	var data []byte
+	for _, msg := range msgs {
+		payload := []byte{xLogData}
+		payload = binary.BigEndian.AppendUint64(payload, lsn)
+		payload = binary.BigEndian.AppendUint64(payload, lsn)
+		payload = binary.BigEndian.AppendUint64(payload, 0)
+		data = pgproto.AppendMessage(data, pgproto.MsgCopyData, append(payload, msg...))
+		lsn += uint64(len(msg))
+	}
+	return data
+}
+
+func relationMsg(id uint32, namespace, name string, columns ...string) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{pgoutputRel}, id)
+	msg = append(append(msg, namespace...), 0)
+	msg = append(append(msg, name...), 0)
+	msg = append(msg, 'd', 0, byte(len(columns)))
+	for _, column := range columns {
+		msg = append(append(append(msg, 0), column...), 0)
+	}
+	return msg
+}
+
+func rowMsg(kind byte, id uint32) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{kind}, id), 'N', 0, 0)
+}
+
+// fakePrimary answers the replication commands of a listener and streams
+// changes
+func fakePrimary(conn net.Conn, stream []byte, commands chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		msgType, payload, err := pgproto.ReadMessage(r)
+		if err != nil {
+			return
+		}
+		if msgType != pgproto.MsgQuery {
+			continue
+		}
+		var q pgproto.Query
+		q.Decode(payload)
+		select {
+		case commands <- q.String:
+		default:
+		}
+		if strings.HasPrefix(q.String, "START_REPLICATION") {
+			conn.Write(append(pgproto.AppendMessage(nil, pgproto.MsgCopyBothResponse, []byte{0, 0, 0}), stream...))
+			// The connection is lost after the changes
+			return
+		}
+		conn.Write(pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}.Encode(pgproto.CommandComplete{Tag: "CREATE_REPLICATION_SLOT"}.Encode(nil)))
+	}
+}
+
+func TestListener(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = 10 * time.Millisecond
+
+	var stream []byte
+	stream = append(stream, xlog(100, []byte{pgoutputBegin}, relationMsg(16384, "public", "Orders", "id"), rowMsg(pgoutputInsert, 16384))...)
+	stream = append(stream, xlog(110, rowMsg(pgoutputUpdate, 16384), []byte{pgoutputCommit})...)
+	stream = append(stream, xlog(120, relationMsg(16384, "public", "Orders", "id", "note"))...)
+	truncate := append([]byte{pgoutputTrunc}, 0, 0, 0, 2, 0)
+	truncate = binary.BigEndian.AppendUint32(truncate, 16384)
+	truncate = binary.BigEndian.AppendUint32(truncate, 99999)
+	stream = append(stream, xlog(130, []byte{pgoutputBegin}, truncate, []byte{pgoutputCommit})...)
+
+	type change struct {
+		tables []string
+		ddl    bool
+	}
+	changes := make(chan change, 10)
+	commands := make(chan string, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := &Listener{
+		Name:        "main",
+		Slot:        "tqdbproxy_1",
+		Publication: "tqdbproxy",
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			client, server := net.Pipe()
+			go fakePrimary(server, stream, commands)
+			return client, nil
+		},
+		Invalidate: func(tables []string, ddl bool) {
+			select {
+			case changes <- change{append([]string(nil), tables...), ddl}:
+			default:
+			}
+		},
+	}
+	go l.Run(ctx)
+
+	expect := func(want change) {
+		t.Helper()
+		select {
+		case got := <-changes:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %v, got nothing", want)
+		}
+	}
+	expectCommand := func(want string) {
+		t.Helper()
+		select {
+		case got := <-commands:
+			if got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %q, got nothing", want)
+		}
+	}
+	expectCommand(`CREATE_REPLICATION_SLOT "tqdbproxy_1" TEMPORARY LOGICAL pgoutput NOEXPORT_SNAPSHOT`)
+	expectCommand(`START_REPLICATION SLOT "tqdbproxy_1" LOGICAL 0/0 (proto_version '1', publication_names '"tqdbproxy"')`)
+	// One invalidation per transaction, a changed relation is a schema change,
+	// and unknown relations are skipped
+	expect(change{[]string{"orders"}, false})
+	expect(change{[]string{"orders"}, true})
+	expect(change{[]string{"orders"}, false})
+
+	// After the lost connection the listener creates the slot again
+	expectCommand(`CREATE_REPLICATION_SLOT "tqdbproxy_1" TEMPORARY LOGICAL pgoutput NOEXPORT_SNAPSHOT`)
+}
+
+func TestParseRelation(t *testing.T) {
+	id, rel, ok := parseRelation(relationMsg(7, "shop", "Orders", "id")[1:])
+	if !ok || id != 7 || rel.name != "orders" {
+		t.Errorf("Expected relation 7 orders, got %d %q %v", id, rel.name, ok)
+	}
+	if _, _, ok := parseRelation([]byte{0, 0, 0, 7, 'x'}); ok {
+		t.Error("Expected a truncated relation to be rejected")
+	}
+}
@@ -0,0 +1,40 @@
+package mariadb
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/acl"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+func TestACL(t *testing.T) {
+	p := &Proxy{
+		config: config.ProxyConfig{Default: "main", DBMap: map[string]string{"billing": "shard2"}},
+		pools:  map[string]*replica.Pool{"main": replica.NewPool("127.0.0.1:1", nil), "shard2": replica.NewPool("127.0.0.1:2", nil)},
+		rules: acl.New(acl.Config{
+			ReadOnlyUsers: []string{"report"},
+			Databases:     map[string][]string{"report": {"shop"}},
+			DBMap:         map[string]string{"billing": "shard2"},
+			Default:       "main",
+		}),
+	}
+	conn := &clientConn{proxy: p, user: "report"}
+
+	query := "DELETE FROM users"
+	if err := conn.handleSingleQuery(query, parser.Parse(query), time.Now(), false); !errors.Is(err, acl.ErrReadOnly) {
+		t.Errorf("Expected a write of a read-only user to be rejected, got %v", err)
+	}
+	if err := conn.handlePrepare(query); !errors.Is(err, acl.ErrReadOnly) {
+		t.Errorf("Expected a prepared write of a read-only user to be rejected, got %v", err)
+	}
+	if err := conn.ensureBackend("billing"); !errors.Is(err, acl.ErrDatabaseDenied) {
+		t.Errorf("Expected a database that is not listed to be denied, got %v", err)
+	}
+	if err := conn.ensureRoute("shard2"); !errors.Is(err, acl.ErrDatabaseDenied) {
+		t.Errorf("Expected a route to a backend that is not listed to be denied, got %v", err)
+	}
+}
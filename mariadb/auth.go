@@ -0,0 +1,249 @@
+package mariadb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"sync"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+)
+
+// Authentication plugins
+const (
+	nativePassword      = "mysql_native_password"
+	cachingSHA2Password = "caching_sha2_password"
+)
+
+// AuthMoreData packets of caching_sha2_password
+const (
+	authMoreData     = 0x01
+	requestPublicKey = 0x02
+	fastAuthSuccess  = 0x03
+	performFullAuth  = 0x04
+)
+
+// Capability flags used to parse the client's handshake response
+const (
+	clientConnectWithDB = 0x00000008
+	clientSecureConn    = 0x00008000
+	clientMultiStmts    = 0x00010000
+	clientPluginAuth    = 0x00080000
+	clientLenencAuth    = 0x00200000
+)
+
+// sha2Auth holds the state for caching_sha2_password clients: the RSA key
+// offered for full authentication, and the passwords of clients that passed
+// full authentication, which allow the fast path on their next connection
+type sha2Auth struct {
+	keyOnce sync.Once
+	key     *rsa.PrivateKey
+	keyErr  error
+
+	mu        sync.Mutex
+	passwords map[string]string // user -> password
+}
+
+// privateKey returns the RSA key, generated on first use
+func (a *sha2Auth) privateKey() (*rsa.PrivateKey, error) {
+	a.keyOnce.Do(func() {
+		a.key, a.keyErr = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	return a.key, a.keyErr
+}
+
+// password returns the cached password of a user
+func (a *sha2Auth) password(user string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pw, ok := a.passwords[user]
+	return pw, ok
+}
+
+// remember caches the password of a user that the backend accepted
+func (a *sha2Auth) remember(user, password string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.passwords == nil {
+		a.passwords = make(map[string]string)
+	}
+	a.passwords[user] = password
+}
+
+// forget removes the cached password of a user that the backend rejected
+func (a *sha2Auth) forget(user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.passwords, user)
+}
+
+// authCachingSHA2 authenticates the client with caching_sha2_password on
+// behalf of the backend, to learn the password the driver needs for the full
+// authentication with the backend. Clients whose scramble matches a cached
+// password take the fast path, others are asked for their password, which
+// they encrypt with the proxy's RSA public key.
+func (c *clientConn) authCachingSHA2() error {
+	// The client may have answered the greeting for another plugin
+	if clientAuthPlugin(c.rawAuthPkt) != cachingSHA2Password {
+		auth, err := c.switchClientAuth(cachingSHA2Password)
+		if err != nil {
+			return err
+		}
+		c.auth = auth
+	}
+
+	// An empty scramble is an empty password
+	if len(c.auth) == 0 {
+		c.password, c.hasPassword = "", true
+		return nil
+	}
+
+	sha2 := &c.proxy.sha2
+	if pw, ok := sha2.password(c.user); ok && subtle.ConstantTimeCompare(scrambleSHA256(c.salt, pw), c.auth) == 1 {
+		c.password, c.hasPassword = pw, true
+		return c.writePacket([]byte{authMoreData, fastAuthSuccess})
+	}
+
+	if err := c.writePacket([]byte{authMoreData, performFullAuth}); err != nil {
+		return err
+	}
+	resp, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(resp) == 1 && resp[0] == requestPublicKey {
+		key, err := sha2.privateKey()
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			return err
+		}
+		pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		if err := c.writePacket(append([]byte{authMoreData}, pubPEM...)); err != nil {
+			return err
+		}
+		if resp, err = c.readPacket(); err != nil {
+			return err
+		}
+		if resp, err = rsa.DecryptOAEP(sha1.New(), nil, key, resp, nil); err != nil {
+			return errors.New("failed to decrypt the password")
+		}
+		for i := range resp {
+			resp[i] ^= c.salt[i%len(c.salt)]
+		}
+	}
+	// The password is NUL terminated, both in cleartext and encrypted
+	pw, ok := bytes.CutSuffix(resp, []byte{0})
+	if !ok {
+		return errors.New("malformed caching_sha2_password response")
+	}
+	c.password, c.hasPassword = string(pw), true
+	c.auth = scrambleSHA256(c.salt, c.password)
+	return nil
+}
+
+// switchClientAuth asks the client to authenticate with another plugin and
+// returns its auth response
+// https://mariadb.com/kb/en/connection/#auth-switch-request
+func (c *clientConn) switchClientAuth(plugin string) ([]byte, error) {
+	data := append(append([]byte{}, c.salt...), 0)
+	if err := c.writePacket(mariadbproto.AuthSwitchRequest{Plugin: plugin, Data: data}.Encode()); err != nil {
+		return nil, err
+	}
+	return c.readPacket()
+}
+
+// scrambleSHA256 computes the caching_sha2_password scramble:
+// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + nonce)
+func scrambleSHA256(nonce []byte, password string) []byte {
+	if password == "" {
+		return nil
+	}
+	m1 := sha256.Sum256([]byte(password))
+	m2 := sha256.Sum256(m1[:])
+	h := sha256.New()
+	h.Write(m2[:])
+	h.Write(nonce)
+	m3 := h.Sum(nil)
+	for i := range m3 {
+		m3[i] ^= m1[i]
+	}
+	return m3
+}
+
+// withAuthPlugin replaces the mysql_native_password plugin announced in a
+// server greeting with the given plugin
+func withAuthPlugin(greeting []byte, plugin string) []byte {
+	suffix := []byte(nativePassword + "\x00")
+	if plugin == nativePassword || !bytes.HasSuffix(greeting, suffix) {
+		return greeting
+	}
+	out := append([]byte{}, greeting[:len(greeting)-len(suffix)]...)
+	return append(append(out, plugin...), 0)
+}
+
+// clientAuthPlugin returns the plugin a client used for its handshake
+// response, or mysql_native_password if it did not say
+func clientAuthPlugin(packet []byte) string {
+	if len(packet) < 32 {
+		return nativePassword
+	}
+	capability := binary.LittleEndian.Uint32(packet[0:4])
+	if capability&clientPluginAuth == 0 {
+		return nativePassword
+	}
+
+	// Skip capabilities, max packet size, charset and filler, then the user
+	pos := 32
+	end := bytes.IndexByte(packet[pos:], 0)
+	if end < 0 {
+		return nativePassword
+	}
+	pos += end + 1
+
+	// Skip the auth response
+	switch {
+	case capability&clientLenencAuth != 0:
+		n, _, size := mariadbproto.ReadLenEncInt(packet[pos:])
+		if size == 0 {
+			return nativePassword
+		}
+		pos += size + int(n)
+	case capability&clientSecureConn != 0:
+		if pos >= len(packet) {
+			return nativePassword
+		}
+		pos += 1 + int(packet[pos])
+	default:
+		end = bytes.IndexByte(packet[pos:], 0)
+		if end < 0 {
+			return nativePassword
+		}
+		pos += end + 1
+	}
+
+	// Skip the database
+	if capability&clientConnectWithDB != 0 && pos <= len(packet) {
+		end = bytes.IndexByte(packet[pos:], 0)
+		if end < 0 {
+			return nativePassword
+		}
+		pos += end + 1
+	}
+	if pos >= len(packet) {
+		return nativePassword
+	}
+	if end = bytes.IndexByte(packet[pos:], 0); end >= 0 {
+		return string(packet[pos : pos+end])
+	}
+	return string(packet[pos:])
+}
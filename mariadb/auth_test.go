@@ -0,0 +1,172 @@
+package mariadb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestScrambleSHA256(t *testing.T) {
+	// Test vector from the go-sql-driver/mysql tests
+	nonce := []byte{10, 47, 74, 111, 75, 73, 34, 48, 88, 76, 114, 74, 37, 13, 3, 80, 82, 2, 23, 21}
+	want := "f490e76f66d9d86665ce54d98c78d0acfe2fb0b08b423da807144873d30b312c"
+	if got := hex.EncodeToString(scrambleSHA256(nonce, "secret")); got != want {
+		t.Errorf("scrambleSHA256() = %s, want %s", got, want)
+	}
+	if got := scrambleSHA256(nonce, ""); got != nil {
+		t.Errorf("scrambleSHA256() of an empty password = %x, want nil", got)
+	}
+}
+
+// handshakeResponse builds a HandshakeResponse41 packet for the given plugin
+func handshakeResponse(user string, auth []byte, db, plugin string) []byte {
+	capability := uint32(clientSecureConn | clientPluginAuth | clientConnectWithDB | 0x200)
+	packet := binary.LittleEndian.AppendUint32(nil, capability)
+	packet = binary.LittleEndian.AppendUint32(packet, 1<<24)
+	packet = append(packet, 45)
+	packet = append(packet, make([]byte, 23)...)
+	packet = append(append(packet, user...), 0)
+	packet = append(append(packet, byte(len(auth))), auth...)
+	packet = append(append(packet, db...), 0)
+	return append(append(packet, plugin...), 0)
+}
+
+func TestClientAuthPlugin(t *testing.T) {
+	packet := handshakeResponse("app", bytes.Repeat([]byte{1}, 32), "shop", cachingSHA2Password)
+	if got := clientAuthPlugin(packet); got != cachingSHA2Password {
+		t.Errorf("clientAuthPlugin() = %q, want %q", got, cachingSHA2Password)
+	}
+	if got := clientAuthPlugin(packet[:40]); got != nativePassword {
+		t.Errorf("clientAuthPlugin() of a truncated packet = %q, want %q", got, nativePassword)
+	}
+}
+
+func TestWithAuthPlugin(t *testing.T) {
+	greeting := append([]byte("\x0a5.5.5-10.11\x00salt\x00"), nativePassword+"\x00"...)
+	got := withAuthPlugin(greeting, cachingSHA2Password)
+	if want := append([]byte("\x0a5.5.5-10.11\x00salt\x00"), cachingSHA2Password+"\x00"...); !bytes.Equal(got, want) {
+		t.Errorf("withAuthPlugin() = %q, want %q", got, want)
+	}
+	if got := withAuthPlugin(greeting, nativePassword); !bytes.Equal(got, greeting) {
+		t.Errorf("withAuthPlugin() changed a native greeting: %q", got)
+	}
+}
+
+// testClient is the client end of a pipe, speaking MySQL packets
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	seq  byte
+}
+
+func (tc *testClient) read() []byte {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(tc.conn, header); err != nil {
+		tc.t.Error(err)
+		return nil
+	}
+	tc.seq = header[3]
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(tc.conn, payload); err != nil {
+		tc.t.Error(err)
+	}
+	return payload
+}
+
+func (tc *testClient) write(payload []byte) {
+	tc.seq++
+	header := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), tc.seq}
+	tc.conn.Write(append(header, payload...))
+}
+
+func TestAuthCachingSHA2(t *testing.T) {
+	const password = "s3cret"
+	salt := []byte("abcdefghijklmnopqrst")
+	p := &Proxy{}
+
+	authenticate := func(scramble []byte, client func(tc *testClient)) *clientConn {
+		server, clientEnd := net.Pipe()
+		defer server.Close()
+		defer clientEnd.Close()
+		c := &clientConn{
+			conn:       server,
+			proxy:      p,
+			user:       "app",
+			salt:       salt,
+			auth:       scramble,
+			rawAuthPkt: handshakeResponse("app", scramble, "", cachingSHA2Password),
+			sequence:   1,
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			client(&testClient{t: t, conn: clientEnd, seq: 1})
+		}()
+		if err := c.authCachingSHA2(); err != nil {
+			t.Fatalf("authCachingSHA2() error = %v", err)
+		}
+		<-done
+		return c
+	}
+
+	// Full authentication: the client encrypts its password with the proxy's key
+	c := authenticate(scrambleSHA256(salt, password), func(tc *testClient) {
+		if got := tc.read(); !bytes.Equal(got, []byte{authMoreData, performFullAuth}) {
+			t.Errorf("Expected perform full authentication, got %x", got)
+			return
+		}
+		tc.write([]byte{requestPublicKey})
+		keyPacket := tc.read()
+		block, _ := pem.Decode(keyPacket[1:])
+		if block == nil {
+			t.Error("Expected a PEM public key")
+			return
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		plain := append([]byte(password), 0)
+		for i := range plain {
+			plain[i] ^= salt[i%len(salt)]
+		}
+		enc, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub.(*rsa.PublicKey), plain, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		tc.write(enc)
+	})
+	if !c.hasPassword || c.password != password {
+		t.Fatalf("Expected the password to be known after full authentication, got %q", c.password)
+	}
+	p.sha2.remember("app", password)
+
+	// Fast path: the scramble matches the cached password
+	c = authenticate(scrambleSHA256(salt, password), func(tc *testClient) {
+		if got := tc.read(); !bytes.Equal(got, []byte{authMoreData, fastAuthSuccess}) {
+			t.Errorf("Expected fast authentication success, got %x", got)
+		}
+	})
+	if c.password != password {
+		t.Errorf("Expected the cached password, got %q", c.password)
+	}
+
+	// A changed password falls back to full authentication, in cleartext here
+	c = authenticate(scrambleSHA256(salt, "changed"), func(tc *testClient) {
+		tc.read()
+		tc.write([]byte("changed\x00"))
+	})
+	if c.password != "changed" {
+		t.Errorf("Expected the new password, got %q", c.password)
+	}
+}
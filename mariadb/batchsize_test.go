@@ -14,7 +14,7 @@ func TestBatchSizeReporting(t *testing.T) {
 	// Connect to proxy
 	// Note: Standard db.Exec() uses prepared statements which strip comments
 	// We need to use a connection that forces text protocol
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -152,7 +152,7 @@ func TestBatchSizeReporting(t *testing.T) {
 
 func TestBatchSizeWithDirectQueries(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -289,7 +289,7 @@ func TestBatchSizeWithDirectQueries(t *testing.T) {
 
 func TestBatchSizeWithMultipleBatches(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -408,7 +408,7 @@ func TestBatchSizeWithMultipleBatches(t *testing.T) {
 
 func TestWriteBatchBackendReporting(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -495,7 +495,7 @@ func TestWriteBatchBackendReporting(t *testing.T) {
 
 func TestBatchSizeWithUpdatePrepared(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -601,7 +601,7 @@ func TestBatchSizeWithUpdatePrepared(t *testing.T) {
 
 func TestBatchSizeWithUpdateDirect(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -700,7 +700,7 @@ func TestBatchSizeWithUpdateDirect(t *testing.T) {
 
 func TestBatchSizeWithDeletePrepared(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -806,7 +806,7 @@ func TestBatchSizeWithDeletePrepared(t *testing.T) {
 
 func TestBatchSizeWithDeleteDirect(t *testing.T) {
 	// Connect to proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect: %v", err)
 	}
@@ -0,0 +1,101 @@
+package mariadb
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+
+	mysql "github.com/go-sql-driver/mysql"
+	"github.com/mevdschee/tqdbproxy/binlog"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// binlogRun is a running binlog listener of a backend primary
+type binlogRun struct {
+	backend config.BackendConfig
+	cancel  context.CancelFunc
+}
+
+// syncBinlog starts a binlog listener for the primary of every backend when
+// binlog_invalidate is enabled, and stops the listeners of backends that were
+// removed or whose primary or credentials changed, see package binlog
+func (p *Proxy) syncBinlog(pcfg config.ProxyConfig) {
+	p.binlogMu.Lock()
+	defer p.binlogMu.Unlock()
+
+	if p.binlogs == nil {
+		p.binlogs = make(map[string]*binlogRun)
+	}
+	for name, run := range p.binlogs {
+		backend, ok := pcfg.Backends[name]
+		if !pcfg.BinlogInvalidate || !ok || backend.Primary != run.backend.Primary ||
+			backend.Username != run.backend.Username || backend.Password != run.backend.Password {
+			run.cancel()
+			delete(p.binlogs, name)
+		}
+	}
+	if !pcfg.BinlogInvalidate {
+		return
+	}
+
+	// Backends may share a primary, so each listener gets its own server ID
+	names := make([]string, 0, len(pcfg.Backends))
+	for name := range pcfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	serverID := uint32(pcfg.BinlogServerID)
+	if serverID == 0 {
+		serverID = 1<<16 + rand.Uint32N(1<<30)
+	}
+	for i, name := range names {
+		if _, ok := p.binlogs[name]; ok {
+			continue
+		}
+		backend := pcfg.Backends[name]
+		ctx, cancel := context.WithCancel(context.Background())
+		p.binlogs[name] = &binlogRun{backend: backend, cancel: cancel}
+		l := &binlog.Listener{
+			Name:     fmt.Sprintf("%s (%s)", backend.Primary, name),
+			ServerID: serverID + uint32(i),
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				return p.dialBinlog(ctx, backend)
+			},
+			Invalidate: p.invalidateBinlog,
+		}
+		go l.Run(ctx)
+	}
+}
+
+// dialBinlog connects to the primary of backend for a binlog listener and
+// returns the raw connection
+func (p *Proxy) dialBinlog(ctx context.Context, backend config.BackendConfig) (net.Conn, error) {
+	connector, err := p.backendConnector(backend.Primary, backend)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw := mysql.GetRawConn(conn)
+	if raw == nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get raw connection from driver")
+	}
+	return raw, nil
+}
+
+// invalidateBinlog drops the cached results of tables changed on a primary,
+// and all cached schema metadata after DDL
+func (p *Proxy) invalidateBinlog(tables []string, ddl bool) {
+	if ddl {
+		p.metaCache.Invalidate()
+	}
+	if n := p.cache.InvalidateTables(tables); n > 0 {
+		metrics.CacheReplicationInvalidations.WithLabelValues("binlog").Add(float64(n))
+	}
+}
@@ -15,7 +15,7 @@ import (
 
 func TestCacheHit(t *testing.T) {
 	// Connect to the proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -93,7 +93,7 @@ func TestCacheHit(t *testing.T) {
 // - Other concurrent requests serve stale data
 // - After refresh, fresh data is served
 func TestStaleDataSingleFlight(t *testing.T) {
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -212,7 +212,7 @@ func getStatus(t *testing.T, conn *sql.Conn) map[string]string {
 // - Other concurrent requests BLOCK and wait (not served stale)
 // - All requests get the same result
 func TestColdCacheSingleFlight(t *testing.T) {
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
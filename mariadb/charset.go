@@ -0,0 +1,76 @@
+package mariadb
+
+import (
+	"regexp"
+	"strings"
+)
+
+// defaultCollation is used for proxy-built packets when the client did not
+// negotiate a known collation
+const defaultCollation byte = 45 // utf8mb4_general_ci
+
+// collationNames maps the IDs of common collations to their names, as used in
+// the handshake with the backend
+var collationNames = map[byte]string{
+	8:   "latin1_swedish_ci",
+	11:  "ascii_general_ci",
+	28:  "gbk_chinese_ci",
+	33:  "utf8_general_ci",
+	45:  "utf8mb4_general_ci",
+	46:  "utf8mb4_bin",
+	47:  "latin1_bin",
+	48:  "latin1_general_ci",
+	63:  "binary",
+	83:  "utf8_bin",
+	192: "utf8_unicode_ci",
+	224: "utf8mb4_unicode_ci",
+	255: "utf8mb4_0900_ai_ci",
+}
+
+// charsetCollations maps character sets to the ID of their default collation
+var charsetCollations = map[string]byte{
+	"latin1":  8,
+	"ascii":   11,
+	"gbk":     28,
+	"utf8":    33,
+	"utf8mb3": 33,
+	"utf8mb4": 45,
+	"binary":  63,
+}
+
+// Match SET NAMES charset [COLLATE collation] and SET CHARACTER SET charset
+var setNamesRegex = regexp.MustCompile(`(?i)^\s*SET\s+(?:NAMES|CHARACTER\s+SET|CHARSET)\s+['"]?(\w+)['"]?(?:\s+COLLATE\s+['"]?(\w+)['"]?)?\s*;?\s*$`)
+
+// handshakeCollation returns the collation ID from a HandshakeResponse41
+// packet (capabilities, max packet size, collation), or 0 if it is too short
+func handshakeCollation(packet []byte) byte {
+	if len(packet) < 9 {
+		return 0
+	}
+	return packet[8]
+}
+
+// collationID returns the ID of a collation name, or 0 if it is unknown
+func collationID(name string) byte {
+	name = strings.ToLower(name)
+	for id, n := range collationNames {
+		if n == name {
+			return id
+		}
+	}
+	return 0
+}
+
+// parseSetNames returns the collation ID selected by a SET NAMES or SET
+// CHARACTER SET statement. It returns false for other statements and 0 for
+// unknown character sets.
+func parseSetNames(query string) (byte, bool) {
+	m := setNamesRegex.FindStringSubmatch(query)
+	if m == nil {
+		return 0, false
+	}
+	if m[2] != "" {
+		return collationID(m[2]), true
+	}
+	return charsetCollations[strings.ToLower(m[1])], true
+}
@@ -0,0 +1,38 @@
+package mariadb
+
+import "testing"
+
+func TestParseSetNames(t *testing.T) {
+	tests := []struct {
+		query     string
+		collation byte
+		ok        bool
+	}{
+		{"SET NAMES utf8mb4", 45, true},
+		{"set names 'latin1'", 8, true},
+		{"SET NAMES utf8mb4 COLLATE utf8mb4_unicode_ci;", 224, true},
+		{"SET CHARACTER SET utf8", 33, true},
+		{"SET NAMES klingon", 0, true},
+		{"SET autocommit = 0", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			collation, ok := parseSetNames(tt.query)
+			if collation != tt.collation || ok != tt.ok {
+				t.Errorf("parseSetNames() = (%d, %v), want (%d, %v)", collation, ok, tt.collation, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHandshakeCollation(t *testing.T) {
+	// capabilities (4), max packet size (4), collation (1), filler
+	packet := []byte{0x8d, 0xa6, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x01, 224, 0x00}
+	if got := handshakeCollation(packet); got != 224 {
+		t.Errorf("handshakeCollation() = %d, want 224", got)
+	}
+	if got := handshakeCollation(packet[:4]); got != 0 {
+		t.Errorf("handshakeCollation() of a short packet = %d, want 0", got)
+	}
+}
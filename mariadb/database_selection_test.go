@@ -9,7 +9,7 @@ import (
 
 func TestDatabaseSelectionFromDSN(t *testing.T) {
 	// Connect with database specified in DSN
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -55,7 +55,7 @@ func TestDatabaseSelectionFromDSN(t *testing.T) {
 
 func TestDatabaseSelectionWithoutDSN(t *testing.T) {
 	// Connect WITHOUT database in DSN
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/")
+	db, err := sql.Open("mysql", proxyDSN(""))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
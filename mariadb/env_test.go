@@ -0,0 +1,25 @@
+package mariadb
+
+import (
+	"fmt"
+	"os"
+)
+
+// proxyDSN returns the DSN of the proxy under test for database dbName. The
+// proxy address defaults to 127.0.0.1:3307 and is set by the integration
+// suite through TQDBPROXY_MARIADB_ADDR.
+func proxyDSN(dbName string) string {
+	return fmt.Sprintf("tqdbproxy:tqdbproxy@tcp(%s)/%s", envOr("TQDBPROXY_MARIADB_ADDR", "127.0.0.1:3307"), dbName)
+}
+
+// backendAddr returns the address of the MariaDB server behind the proxy
+func backendAddr() string {
+	return envOr("TQDBPROXY_MARIADB_BACKEND", "127.0.0.1:3306")
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,97 @@
+package mariadb
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// Match KILL [HARD|SOFT] [QUERY|CONNECTION] id. KILL QUERY ID query_id names
+// a query instead of a connection and is passed on unchanged.
+var killRegex = regexp.MustCompile(`(?i)^\s*KILL\s+(?:(?:HARD|SOFT)\s+)?(QUERY\s+|CONNECTION\s+)?(\d+)\s*;?\s*$`)
+
+// backendThread is the backend connection of a client connection, as targeted
+// by KILL
+type backendThread struct {
+	addr string
+	name string
+	pool *replica.Pool
+	id   uint32 // Thread ID on the backend, as returned by CONNECTION_ID()
+}
+
+// parseKill parses a KILL statement and returns the connection ID, and
+// whether only the running query is killed
+func parseKill(query string) (id uint32, queryOnly bool, ok bool) {
+	m := killRegex.FindStringSubmatch(query)
+	if m == nil {
+		return 0, false, false
+	}
+	n, err := strconv.ParseUint(m[2], 10, 32)
+	if err != nil {
+		return 0, false, false
+	}
+	return uint32(n), len(m[1]) > 0 && (m[1][0] == 'q' || m[1][0] == 'Q'), true
+}
+
+// trackThread looks up the thread ID of the backend connection, so that KILL
+// of the client connection can be translated. The caller holds c.mu.
+func (c *clientConn) trackThread() {
+	c.thread.Store(nil)
+	response, err := c.execBackendQuery("SELECT CONNECTION_ID()")
+	if err == nil {
+		var id uint64
+		if id, err = threadID(response); err == nil {
+			c.thread.Store(&backendThread{addr: c.backendAddr, name: c.backendName, pool: c.backendPool, id: uint32(id)})
+			return
+		}
+	}
+	log.Printf("[MariaDB] Cannot get the backend thread ID for conn %d: %v", c.connID, err)
+}
+
+// threadID returns the value of a result set with a single integer value
+func threadID(response []byte) (uint64, error) {
+	packets, err := mariadbproto.SplitPackets(response)
+	if err != nil {
+		return 0, err
+	}
+	// Column count, column definition and EOF precede the row
+	if len(packets) < 4 || mariadbproto.IsErr(packets[0].Payload) || !mariadbproto.IsEOF(packets[2].Payload) {
+		return 0, fmt.Errorf("unexpected response to SELECT CONNECTION_ID()")
+	}
+	values, err := mariadbproto.ParseTextRow(packets[3].Payload, 1)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(string(values[0]), 10, 32)
+}
+
+// handleKill kills the query or connection of another client connection of
+// the proxy: the KILL is sent to the backend of that connection with the
+// credentials of this one, so the backend checks the privileges. After KILL
+// CONNECTION the client connection is closed as well.
+func (c *clientConn) handleKill(target *clientConn, queryOnly bool, moreResults bool) error {
+	thread := target.thread.Load()
+	if thread == nil {
+		return fmt.Errorf("connection %d has no backend connection to kill", target.connID)
+	}
+	if err := c.ensureBackendConn(thread.addr, thread.name, thread.pool); err != nil {
+		return err
+	}
+	kill := fmt.Sprintf("KILL CONNECTION %d", thread.id)
+	if queryOnly {
+		kill = fmt.Sprintf("KILL QUERY %d", thread.id)
+	}
+	response, err := c.execBackendQuery(kill)
+	if err != nil {
+		return err
+	}
+	if !isError(response) && !queryOnly {
+		log.Printf("[MariaDB] Conn %d killed conn %d", c.connID, target.connID)
+		target.conn.Close()
+	}
+	return c.forwardBackendResponse(response, moreResults)
+}
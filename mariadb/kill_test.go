@@ -0,0 +1,29 @@
+package mariadb
+
+import "testing"
+
+func TestParseKill(t *testing.T) {
+	tests := []struct {
+		query     string
+		id        uint32
+		queryOnly bool
+		ok        bool
+	}{
+		{"KILL 12", 12, false, true},
+		{"kill query 7;", 7, true, true},
+		{"KILL HARD CONNECTION 3", 3, false, true},
+		{"KILL SOFT QUERY 4", 4, true, true},
+		{"KILL QUERY ID 5", 0, false, false},
+		{"KILL USER app", 0, false, false},
+		{"SELECT 1", 0, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			id, queryOnly, ok := parseKill(tt.query)
+			if id != tt.id || queryOnly != tt.queryOnly || ok != tt.ok {
+				t.Errorf("parseKill() = (%d, %v, %v), want (%d, %v, %v)", id, queryOnly, ok, tt.id, tt.queryOnly, tt.ok)
+			}
+		})
+	}
+}
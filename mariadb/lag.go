@@ -0,0 +1,108 @@
+package mariadb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// setLagChecks sets the replication lag checks of the pools, for the backends
+// with replica_lag_check or max_replica_lag_ms. The handles of the checks are
+// reopened, as the credentials may have changed.
+func (p *Proxy) setLagChecks(pcfg config.ProxyConfig, pools map[string]*replica.Pool) {
+	p.closeLagDBs()
+	for name, pool := range pools {
+		backend := pcfg.Backends[name]
+		if !backend.ReplicaLagCheck && backend.MaxReplicaLagMs <= 0 {
+			pool.SetLagCheck(nil, 0)
+			continue
+		}
+		pool.SetLagCheck(p.replicaLag(backend), time.Duration(backend.MaxReplicaLagMs)*time.Millisecond)
+	}
+}
+
+// replicaLag returns the lag check of the replicas of backend: the largest
+// Seconds_Behind_Master of SHOW SLAVE STATUS, which has one row per
+// replication source
+func (p *Proxy) replicaLag(backend config.BackendConfig) replica.LagFunc {
+	return func(ctx context.Context, addr string) (time.Duration, error) {
+		db, err := p.lagDB(addr, backend)
+		if err != nil {
+			return 0, err
+		}
+		rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		cols, err := rows.Columns()
+		if err != nil {
+			return 0, err
+		}
+		values := make([]sql.RawBytes, len(cols))
+		dest := make([]any, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		var lag time.Duration
+		sources := 0
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				return 0, err
+			}
+			for i, col := range cols {
+				if col != "Seconds_Behind_Master" {
+					continue
+				}
+				if values[i] == nil {
+					return 0, errors.New("replication is not running")
+				}
+				seconds, err := strconv.Atoi(string(values[i]))
+				if err != nil {
+					return 0, err
+				}
+				lag = max(lag, time.Duration(seconds)*time.Second)
+				sources++
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		if sources == 0 {
+			return 0, errors.New("not a replica")
+		}
+		return lag, nil
+	}
+}
+
+// lagDB returns the database handle for lag checks of the replica at addr
+func (p *Proxy) lagDB(addr string, backend config.BackendConfig) (*sql.DB, error) {
+	key := backend.Username + "@" + addr
+	if db, ok := p.lagDBs.Load(key); ok {
+		return db.(*sql.DB), nil
+	}
+	db, err := p.openBackend(addr, backend)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if actual, loaded := p.lagDBs.LoadOrStore(key, db); loaded {
+		db.Close()
+		return actual.(*sql.DB), nil
+	}
+	return db, nil
+}
+
+// closeLagDBs closes the database handles for lag checks
+func (p *Proxy) closeLagDBs() {
+	p.lagDBs.Range(func(key, db any) bool {
+		p.lagDBs.Delete(key)
+		db.(*sql.DB).Close()
+		return true
+	})
+}
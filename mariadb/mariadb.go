@@ -1,16 +1,23 @@
 package mariadb
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,16 +25,38 @@ import (
 	"time"
 
 	mysql "github.com/go-sql-driver/mysql"
+	"github.com/mevdschee/tqdbproxy/acl"
+	"github.com/mevdschee/tqdbproxy/annotate"
+	"github.com/mevdschee/tqdbproxy/audit"
 	"github.com/mevdschee/tqdbproxy/cache"
 	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/conform"
+	"github.com/mevdschee/tqdbproxy/history"
+	"github.com/mevdschee/tqdbproxy/killswitch"
+	"github.com/mevdschee/tqdbproxy/limiter"
+	"github.com/mevdschee/tqdbproxy/logging"
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+	"github.com/mevdschee/tqdbproxy/memlimit"
 	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/override"
 	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/proxyproto"
+	"github.com/mevdschee/tqdbproxy/quota"
 	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/session"
+	"github.com/mevdschee/tqdbproxy/slowlog"
+	"github.com/mevdschee/tqdbproxy/spill"
+	"github.com/mevdschee/tqdbproxy/tcpopt"
+	"github.com/mevdschee/tqdbproxy/throttle"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
+	"github.com/mevdschee/tqdbproxy/watch"
 	"github.com/mevdschee/tqdbproxy/writebatch"
 )
 
 const (
-	backendTimeout = 30 * time.Second
+	backendTimeout  = 30 * time.Second
+	spillBufferSize = 64 * 1024 // Buffers for reading and sending spilled responses
+	sslRequestSize  = 32        // Capabilities, maximum packet size, collation and filler of an SSLRequest
 )
 
 // isConnectionReset returns true for errors that indicate the client closed
@@ -48,16 +77,62 @@ type Proxy struct {
 	writeBatch *writebatch.Manager
 	wbCtx      context.Context
 	wbCancel   context.CancelFunc
+
+	writeLimiter *limiter.WriteLimiter // Limits concurrent non-batched writes
+	metaCache    *cache.MetadataCache  // Cache for schema metadata queries (nil = disabled)
+	verifier     *cache.Verifier       // Samples cache hits to verify against the primary
+	booster      *cache.Booster        // Micro-caches SELECTs that repeat at a high rate
+	annotator    *annotate.Annotator   // Prefixes queries sent to backends with the proxy identity
+	connLimiter  *limiter.ConnLimiter  // Caps open connections per backend address
+	clampLogged  atomic.Int64          // Unix nanos of the last clamped batch hint warning
+	batchClock   writebatch.Clock      // Time source for batch windows, set by tests (nil = real time)
+	sha2         sha2Auth              // caching_sha2_password key and cached passwords
+	overrides    *override.Set         // Runtime overrides of query hints (nil = none)
+	switches     *killswitch.Switches  // Kill switches of the proxy features (nil = all enabled)
+	memory       *memlimit.Controller  // Soft memory limit (nil = none)
+	slowLog      *slowlog.Log          // Slow query log (nil = none)
+	audit        *audit.Log            // Audit log (nil = none)
+	rules        *acl.Rules            // Users, databases and read-only users allowed by the config
+	bypass       *override.Bypass      // Bypasses batching of writes whose batches keep failing
+	binlogMu     sync.Mutex
+	binlogs      map[string]*binlogRun  // Backend name -> running binlog listener, see syncBinlog
+	quotas       *quota.Quotas          // Resource budgets per database
+	throttle     *throttle.Throttle     // Query limits per client address, user and backend
+	histories    *history.Registry      // Client connections with their query history
+	started      time.Time              // Creation of the proxy, for the uptime in the status
+	sessions     sync.WaitGroup         // Client sessions, waited for by Shutdown
+	clients      sync.Map               // net.Conn -> struct{}, closed when draining times out
+	conns        sync.Map               // Connection ID -> *clientConn, the targets of KILL
+	lagDBs       sync.Map               // "user@addr" -> *sql.DB for replica lag checks
+	refreshConns sync.Map               // "user@addr" -> *refreshConn for background refreshes of cached results
+	verifyConns  sync.Map               // "user@addr" -> *refreshConn for the verification of cache hits
+	verifying    sync.WaitGroup         // Running verifications of cache hits, waited for by Stop
+	routeBatches map[string]*routeBatch // Backend name -> write batching of the tables routed to it, see batchManager
+	schema       cache.Schema           // Tables changed by DDL, whose prepared statements are prepared again
 }
 
 // New creates a new MariaDB proxy
 func New(pcfg config.ProxyConfig, pools map[string]*replica.Pool, c *cache.Cache) *Proxy {
 	p := &Proxy{
-		config: pcfg,
-		pools:  pools,
-		cache:  c,
-		connID: 1000,
-	}
+		config:       pcfg,
+		pools:        pools,
+		cache:        c,
+		connID:       1000,
+		writeLimiter: newWriteLimiter(pcfg),
+		metaCache:    cache.NewMetadataCache(c, "mariadb", time.Duration(pcfg.MetadataCacheTTL)*time.Second),
+		verifier:     cache.NewVerifier(pcfg.CacheVerifySample),
+		booster:      cache.NewBooster(pcfg.CacheBoostQPS, time.Duration(pcfg.CacheBoostMaxMs)*time.Millisecond),
+		bypass:       override.NewBypass(pcfg.WriteBatch.BypassErrorRate, pcfg.WriteBatch.BypassMinWrites, time.Duration(pcfg.WriteBatch.BypassCooldown)*time.Second),
+		annotator:    annotate.New(pcfg.Annotate),
+		connLimiter:  limiter.NewConnLimiter(connLimits(pcfg), time.Duration(pcfg.MaxConnectionsWait)*time.Second),
+		quotas:       quota.New(quotaLimits(pcfg)),
+		throttle:     throttle.New(throttleConfig(pcfg)),
+		rules:        acl.New(aclConfig(pcfg)),
+		histories:    history.NewRegistry(),
+		started:      time.Now(),
+	}
+	p.connLimiter.SetTCPOptions(backendTCPOptions(pcfg))
+	p.setLagChecks(pcfg, pools)
 
 	// Initialize write batching (actual manager created in Start after db connection)
 	p.wbCtx, p.wbCancel = context.WithCancel(context.Background())
@@ -73,64 +148,579 @@ func (p *Proxy) UpdateConfig(pcfg config.ProxyConfig, pools map[string]*replica.
 	defer p.mu.Unlock()
 	p.config = pcfg
 	p.pools = pools
+	p.writeLimiter = newWriteLimiter(pcfg)
+	p.verifier.SetSample(pcfg.CacheVerifySample)
+	p.booster.SetLimits(pcfg.CacheBoostQPS, time.Duration(pcfg.CacheBoostMaxMs)*time.Millisecond)
+	p.bypass.SetLimits(pcfg.WriteBatch.BypassErrorRate, pcfg.WriteBatch.BypassMinWrites, time.Duration(pcfg.WriteBatch.BypassCooldown)*time.Second)
+	p.annotator.SetFormat(pcfg.Annotate)
+	p.connLimiter.Update(connLimits(pcfg), time.Duration(pcfg.MaxConnectionsWait)*time.Second)
+	p.connLimiter.SetTCPOptions(backendTCPOptions(pcfg))
+	p.setLagChecks(pcfg, pools)
+	p.quotas.Update(quotaLimits(pcfg))
+	p.throttle.Update(throttleConfig(pcfg))
+	p.rules = acl.New(aclConfig(pcfg))
+	if p.writeBatch != nil {
+		p.writeBatch.Reconfigure(writeBatchConfig(pcfg, p.batchClock))
+	}
+	for _, manager := range p.routeBatchManagers() {
+		manager.Reconfigure(writeBatchConfig(pcfg, p.batchClock))
+	}
+
+	p.syncBinlog(pcfg)
+
+	// The pools are new, warm them up like at start
+	go p.warmup(pcfg, nil)
+}
+
+// Quotas returns the resource budgets and usage per database, reported
+// through the admin API
+func (p *Proxy) Quotas() *quota.Quotas {
+	return p.quotas
+}
+
+// Histories returns the client connections with their query history,
+// reported through the admin API
+func (p *Proxy) Histories() *history.Registry {
+	return p.histories
+}
+
+// aclConfig returns the access rules of the listener
+func aclConfig(pcfg config.ProxyConfig) acl.Config {
+	return acl.Config{
+		AllowUsers:    pcfg.AllowUsers,
+		DenyUsers:     pcfg.DenyUsers,
+		ReadOnlyUsers: pcfg.ReadOnlyUsers,
+		Databases:     pcfg.UserDatabases,
+		DBMap:         pcfg.DBMap,
+		Default:       pcfg.Default,
+	}
+}
+
+// accessRules returns the access rules of the listener
+func (p *Proxy) accessRules() *acl.Rules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules
+}
+
+// listenerRules returns the users allowed to connect to the listener with the
+// name, in addition to the access rules
+func (p *Proxy) listenerRules(name string) *acl.Rules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	l, _ := p.config.Listener(name)
+	return acl.New(acl.Config{AllowUsers: l.AllowUsers, DenyUsers: l.DenyUsers})
+}
+
+// listenerTLS returns the TLS configuration of the listener with the name,
+// nil without TLS, and whether the listener rejects plaintext clients
+func (p *Proxy) listenerTLS(name string) (*tls.Config, bool) {
+	p.mu.RLock()
+	l, _ := p.config.Listener(name)
+	p.mu.RUnlock()
+	required := l.TLSMode == tlsopt.ModeRequire
+	if l.TLSMode == "" || l.TLSMode == tlsopt.ModeDisable {
+		return nil, false
+	}
+	cfg, err := tlsopt.Server(l.TLSCert, l.TLSKey)
+	if err != nil {
+		log.Printf("[MariaDB] TLS unavailable on listener %s: %v", name, err)
+		return nil, required
+	}
+	return cfg, required
+}
+
+// backendDatabase returns the database on the backend for a database of a
+// client, and whether it is a replica database, which the client uses
+// read-only on the replicas
+func (p *Proxy) backendDatabase(db string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if name, ok := p.config.ReplicaDatabases[db]; ok {
+		return name, true
+	}
+	return db, false
+}
+
+// throttleConfig returns the query limits of the listener
+func throttleConfig(pcfg config.ProxyConfig) throttle.Config {
+	t := pcfg.Throttle
+	return throttle.Config{
+		Client:  throttle.Limits{QPS: t.ClientQPS, Concurrency: t.ClientConcurrency},
+		User:    throttle.Limits{QPS: t.UserQPS, Concurrency: t.UserConcurrency},
+		Backend: throttle.Limits{QPS: t.BackendQPS, Concurrency: t.BackendConcurrency},
+		Wait:    time.Duration(t.WaitMs) * time.Millisecond,
+	}
+}
+
+// quotaLimits returns the default and per-database budgets of the
+// configuration
+func quotaLimits(pcfg config.ProxyConfig) (quota.Limits, map[string]quota.Limits) {
+	limits := make(map[string]quota.Limits, len(pcfg.Quotas))
+	for db, q := range pcfg.Quotas {
+		limits[db] = quota.Limits(q)
+	}
+	return quota.Limits(pcfg.Quota), limits
+}
+
+// SetOverrides sets the runtime overrides of query hints, managed through
+// the admin API
+func (p *Proxy) SetOverrides(overrides *override.Set) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.overrides = overrides
+}
+
+// SetMemory sets the memory controller. Under memory pressure write batches
+// run at a smaller size and large responses spill to disk.
+func (p *Proxy) SetMemory(memory *memlimit.Controller) {
+	p.mu.Lock()
+	p.memory = memory
+	p.mu.Unlock()
+	memory.OnChange(func(pressure bool) {
+		p.mu.RLock()
+		writeBatch := p.writeBatch
+		managers := p.routeBatchManagers()
+		p.mu.RUnlock()
+		if writeBatch != nil {
+			writeBatch.SetShedding(pressure)
+		}
+		for _, manager := range managers {
+			manager.SetShedding(pressure)
+		}
+	})
+}
+
+// SetSlowLog sets the slow query log, shared by both proxies
+func (p *Proxy) SetSlowLog(slowLog *slowlog.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slowLog = slowLog
+}
+
+// slowQueryLog returns the slow query log
+func (p *Proxy) slowQueryLog() *slowlog.Log {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.slowLog
+}
+
+// SetAudit sets the audit log, shared by both proxies
+func (p *Proxy) SetAudit(auditLog *audit.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.audit = auditLog
+}
+
+// auditLog returns the audit log
+func (p *Proxy) auditLog() *audit.Log {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.audit
+}
+
+// SetKillSwitches sets the kill switches of the proxy features, toggled with
+// SET GLOBAL tqdb_<feature> by admin users
+func (p *Proxy) SetKillSwitches(switches *killswitch.Switches) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switches = switches
+}
+
+// enabled reports whether the kill switch of a feature is on
+func (p *Proxy) enabled(feature string) bool {
+	p.mu.RLock()
+	switches := p.switches
+	p.mu.RUnlock()
+	return switches.Enabled(feature)
+}
+
+// applyOverrides applies the batch window and acknowledgement of the first
+// matching batch rule, or else the defaults, to writes without batch or ack
+// hints and disables the hints of a query that a runtime override or a kill
+// switch matches
+func (p *Proxy) applyOverrides(parsed *parser.ParsedQuery) *parser.ParsedQuery {
+	p.mu.RLock()
+	overrides := p.overrides
+	switches := p.switches
+	writeBatch := p.config.WriteBatch
+	p.mu.RUnlock()
+	parsed.BatchMax = 0
+	if rule, ok := writeBatch.MatchRule(parsed); ok {
+		parsed.DefaultBatch(rule.WindowMs)
+		parsed.BatchMax = rule.MaxBatch
+		parsed.DefaultAck(rule.Ack)
+	} else {
+		parsed.DefaultBatch(writeBatch.DefaultMs)
+	}
+	if writeBatch.AckEarly {
+		parsed.DefaultAck(parser.AckEarly)
+	}
+	return switches.Apply(overrides.Apply(parsed))
+}
+
+// recordBatch counts the result of a batched write for the batch bypass.
+// Errors of the write batch manager itself are not held against the query.
+func (p *Proxy) recordBatch(query string, err error) {
+	if err == writebatch.ErrManagerClosed || err == writebatch.ErrTimeout || err == writebatch.ErrQueueFull {
+		return
+	}
+	p.mu.RLock()
+	overrides := p.overrides
+	p.mu.RUnlock()
+	if p.bypass.Record(overrides, query, err != nil) {
+		log.Printf("[MariaDB] Batching bypassed for %s after repeated errors", parser.Fingerprint(query))
+	}
+}
+
+// writeBatchConfig returns the write batch manager configuration
+func writeBatchConfig(pcfg config.ProxyConfig, clock writebatch.Clock) writebatch.Config {
+	return writebatch.Config{
+		MaxBatchSize:     pcfg.WriteBatch.MaxBatchSize,
+		UseCopy:          pcfg.WriteBatch.UseCopy,
+		ExactIDs:         pcfg.WriteBatch.ExactIDs,
+		IsolateFailures:  pcfg.WriteBatch.Isolate,
+		AsyncQueueSize:   pcfg.WriteBatch.AsyncQueueSize,
+		QueueSize:        pcfg.WriteBatch.QueueSize,
+		Workers:          pcfg.WriteBatch.Workers,
+		RequestTimeoutMs: pcfg.WriteBatch.TimeoutMs,
+		Retry: writebatch.RetryPolicy{
+			MaxRetries: pcfg.WriteBatch.Retries,
+			Backoff:    time.Duration(pcfg.WriteBatch.RetryBackoffMs) * time.Millisecond,
+			MaxBackoff: time.Duration(pcfg.WriteBatch.RetryMaxBackoffMs) * time.Millisecond,
+		},
+		Clock: clock,
+	}
+}
+
+// newWriteLimiter builds the immediate write limiter from the global and
+// per-backend limits in the configuration
+func newWriteLimiter(pcfg config.ProxyConfig) *limiter.WriteLimiter {
+	backendLimits := make(map[string]int)
+	for name, backend := range pcfg.Backends {
+		backendLimits[name] = backend.ImmediateWriteLimit
+	}
+	return limiter.NewWriteLimiter(pcfg.ImmediateWriteLimit, backendLimits)
+}
+
+// newSpill returns a buffer for the response of a read, or nil when
+// spilling is disabled
+func (p *Proxy) newSpill() *spill.Buffer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	threshold := p.config.SpillThreshold
+	if limit := p.memory.BufferLimit(); limit > 0 && (threshold <= 0 || limit < threshold) {
+		// Under memory pressure large responses are not held in memory
+		threshold = limit
+	}
+	if threshold <= 0 {
+		return nil
+	}
+	return spill.New(p.config.SpillDir, threshold)
+}
+
+// readRetries returns how often a failed read is retried on another node
+func (p *Proxy) readRetries() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config.ReadRetries
+}
+
+// cacheKey returns the cache key of a SELECT: the query, or its normalized
+// key with cache_normalize, see parser.NormalizedKey
+func (p *Proxy) cacheKey(query string) string {
+	p.mu.RLock()
+	normalize := p.config.CacheNormalize
+	p.mu.RUnlock()
+	if !normalize {
+		return query
+	}
+	return parser.NormalizedKey(query)
+}
+
+// normalizeWrite returns a batched write with its values as parameters when
+// writebatch_normalize is enabled, so that writes that only differ in their
+// values share a batch, see parser.Normalize
+func (p *Proxy) normalizeWrite(query string) (string, []interface{}, bool) {
+	p.mu.RLock()
+	normalize := p.config.WriteBatch.Normalize
+	p.mu.RUnlock()
+	if !normalize {
+		return "", nil, false
+	}
+	return parser.Normalize(query)
+}
+
+// guardBatch returns true when the batch guard is enabled and a batchable
+// UPDATE or DELETE has no equality predicate on a configured key column, so
+// that it is executed immediately instead of holding locks in a batch.
+func (p *Proxy) guardBatch(parsed *parser.ParsedQuery) bool {
+	if parsed.Type != parser.QueryUpdate && parsed.Type != parser.QueryDelete {
+		return false
+	}
+	p.mu.RLock()
+	guard, columns := p.config.BatchGuard, p.config.BatchGuardColumns
+	p.mu.RUnlock()
+	if !guard {
+		return false
+	}
+	for _, column := range parsed.EqualityColumns() {
+		for _, key := range columns {
+			if key == column {
+				return false
+			}
+			for _, table := range parsed.Tables {
+				if key == table+"."+column {
+					return false
+				}
+			}
+		}
+	}
+	metrics.WriteBatchGuarded.Inc()
+	return true
+}
+
+// clampBatch applies the batch window bounds of the backend (or else of the
+// protocol) to the batch hint of a query. Clamped hints are counted and
+// logged, at most once per 10 seconds.
+func (p *Proxy) clampBatch(parsed *parser.ParsedQuery, shard string) (int, bool) {
+	p.mu.RLock()
+	minMs, maxMs := p.config.BatchMinMs, p.config.BatchMaxMs
+	if backend, ok := p.config.Backends[shard]; ok {
+		if backend.BatchMinMs > 0 {
+			minMs = backend.BatchMinMs
+		}
+		if backend.BatchMaxMs > 0 {
+			maxMs = backend.BatchMaxMs
+		}
+	}
+	p.mu.RUnlock()
+
+	hinted, clamped := parsed.ClampBatch(minMs, maxMs)
+	if clamped {
+		metrics.WriteBatchHintClamped.Inc()
+		now := time.Now().UnixNano()
+		if last := p.clampLogged.Load(); now-last >= int64(10*time.Second) && p.clampLogged.CompareAndSwap(last, now) {
+			log.Printf("[MariaDB] Batch hint of %dms clamped to %dms (file: %s, line: %d)", hinted, parsed.BatchMs, parsed.File, parsed.Line)
+		}
+	}
+	return hinted, clamped
+}
+
+// connLimits returns the connection limit per backend address. An address
+// used by several backends gets the lowest of their limits.
+func connLimits(pcfg config.ProxyConfig) map[string]int {
+	limits := make(map[string]int)
+	for _, backend := range pcfg.Backends {
+		if backend.MaxConnections <= 0 {
+			continue
+		}
+		for _, addr := range append([]string{backend.Primary}, backend.Replicas...) {
+			if n, exists := limits[addr]; !exists || backend.MaxConnections < n {
+				limits[addr] = backend.MaxConnections
+			}
+		}
+	}
+	return limits
+}
+
+// tcpOptions converts configured TCP options
+func tcpOptions(c config.TCPConfig) tcpopt.Options {
+	return tcpopt.Options{
+		KeepAlive:   time.Duration(c.KeepAlive) * time.Second,
+		UserTimeout: time.Duration(c.UserTimeout) * time.Second,
+		NoDelay:     c.NoDelay,
+		ReadBuffer:  c.ReadBuffer,
+		WriteBuffer: c.WriteBuffer,
+	}
+}
+
+// proxyOptions returns the PROXY protocol options of connections accepted
+// by the listener with the name, nil when clients connect directly. Unix
+// socket connections never carry a header.
+func proxyOptions(c config.ProxyConfig, name string, listener net.Listener) *proxyproto.Options {
+	l, _ := c.Listener(name)
+	if !l.ProxyProtocol || listener.Addr().Network() != "tcp" {
+		return nil
+	}
+	trusted, _ := proxyproto.ParseNetworks(l.ProxyProtocolFrom) // Checked by the config
+	return &proxyproto.Options{Trusted: trusted}
+}
+
+// backendTCPOptions returns the TCP options per backend address. An address
+// used by several backends gets the options of the first backend by name.
+func backendTCPOptions(pcfg config.ProxyConfig) map[string]tcpopt.Options {
+	names := make([]string, 0, len(pcfg.Backends))
+	for name := range pcfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make(map[string]tcpopt.Options)
+	for _, name := range names {
+		backend := pcfg.Backends[name]
+		for _, addr := range append([]string{backend.Primary}, backend.Replicas...) {
+			if _, exists := options[addr]; !exists {
+				options[addr] = tcpOptions(backend.TCP)
+			}
+		}
+	}
+	return options
+}
+
+// backendTLSConfig returns the TLS settings of the first backend (by name)
+// that uses addr as primary or replica
+func backendTLSConfig(pcfg config.ProxyConfig, addr string) config.TLSConfig {
+	names := make([]string, 0, len(pcfg.Backends))
+	for name := range pcfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		backend := pcfg.Backends[name]
+		for _, a := range append([]string{backend.Primary}, backend.Replicas...) {
+			if a == addr {
+				return backend.TLS
+			}
+		}
+	}
+	return config.TLSConfig{}
+}
+
+// backendTLS returns the TLS configuration for connections to addr, or nil
+// when the backend does not use TLS. Unix sockets never use TLS.
+func (p *Proxy) backendTLS(addr string) (*tls.Config, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return nil, nil
+	}
+	p.mu.RLock()
+	settings := backendTLSConfig(p.config, addr)
+	p.mu.RUnlock()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return tlsopt.Client(settings.Mode, host, settings.CAFile, settings.CertFile, settings.KeyFile)
+}
+
+// openBackend opens a database handle for connections of the proxy itself to
+// addr, with the credentials of backend
+func (p *Proxy) openBackend(addr string, backend config.BackendConfig) (*sql.DB, error) {
+	connector, err := p.backendConnector(addr, backend)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// backendConnector returns a connector for addr with the credentials of
+// backend
+func (p *Proxy) backendConnector(addr string, backend config.BackendConfig) (driver.Connector, error) {
+	dbCfg := mysql.NewConfig()
+	dbCfg.User = backend.Username
+	dbCfg.Passwd = backend.Password
+	dbCfg.DBName = backend.Database
+	p.mu.RLock()
+	dbCfg.Collation = p.config.Collation
+	p.mu.RUnlock()
+	dbCfg.Net = "tcp"
+	dbCfg.Addr = addr
+	if len(addr) > 5 && addr[:5] == "unix:" {
+		dbCfg.Net = "unix"
+		dbCfg.Addr = addr[5:]
+	}
+	dbCfg.DialFunc = p.connLimiter.DialContext
+	tlsCfg, err := p.backendTLS(addr)
+	if err != nil {
+		return nil, err
+	}
+	dbCfg.TLS = tlsCfg
+	return mysql.NewConnector(dbCfg)
 }
 
 // Start begins accepting MariaDB connections
 func (p *Proxy) Start() error {
 	p.mu.RLock()
-	listen := p.config.Listen
-	socket := p.config.Socket
+	main, _ := p.config.Listener("")
+	listeners := append([]config.ListenerConfig{main}, p.config.Listeners...)
 	defaultBackend := p.config.Default
 	defaultPool := p.pools[defaultBackend]
+	backend := p.config.Backends[defaultBackend]
 	p.mu.RUnlock()
 
 	if defaultPool == nil {
 		return fmt.Errorf("default backend pool %q not found", defaultBackend)
 	}
 
-	// Connect to backend MariaDB (using tqdbproxy credentials for testing)
-	addr := defaultPool.GetPrimary()
-	dsn := fmt.Sprintf("tqdbproxy:tqdbproxy@tcp(%s)/tqdbproxy", addr)
-	if len(addr) > 5 && addr[:5] == "unix:" {
-		dsn = fmt.Sprintf("tqdbproxy:tqdbproxy@unix(%s)/tqdbproxy", addr[5:])
-	}
-	db, err := sql.Open("mysql", dsn)
+	// Connect to backend MariaDB with the credentials of the default backend
+	db, err := p.openBackend(defaultPool.GetPrimary(), backend)
 	if err != nil {
 		return fmt.Errorf("failed to connect to backend: %v", err)
 	}
 	p.db = db
 
 	// Initialize write batching
-	wbCfg := writebatch.Config{
-		MaxBatchSize: p.config.WriteBatch.MaxBatchSize,
-		UseCopy:      p.config.WriteBatch.UseCopy,
+	p.mu.Lock()
+	batchConfig := writeBatchConfig(p.config, p.batchClock)
+	spoolDir, spoolMaxMB := p.config.WriteBatch.SpoolDir, p.config.WriteBatch.SpoolMaxMB
+	p.mu.Unlock()
+	if spoolDir != "" {
+		spool, err := writebatch.OpenSpool(spoolDir, int64(spoolMaxMB)<<20)
+		if err != nil {
+			return fmt.Errorf("failed to open write spool: %v", err)
+		}
+		if pending := spool.Pending(); pending > 0 {
+			log.Printf("[MariaDB] Write spool has %d pending writes to replay", pending)
+		}
+		batchConfig.Spool = spool
 	}
-	p.writeBatch = writebatch.New(db, wbCfg)
+	p.mu.Lock()
+	p.writeBatch = writebatch.New(db, batchConfig)
+	p.mu.Unlock()
 	log.Printf("[MariaDB] Write batching started")
+	go p.warmup(p.config, db)
+	p.syncBinlog(p.config)
 
-	// Start TCP listener
-	tcpListener, err := net.Listen("tcp", listen)
-	if err != nil {
-		return err
+	for _, l := range listeners {
+		if err := p.startListener(l); err != nil {
+			return err
+		}
 	}
-	p.listeners = append(p.listeners, tcpListener)
-	log.Printf("[MariaDB] Listening on %s (tcp), forwarding to %v backends", listen, len(p.pools))
+	return nil
+}
 
-	go p.acceptLoop(tcpListener)
+// startListener starts the TCP and Unix socket listeners of a listener config
+func (p *Proxy) startListener(l config.ListenerConfig) error {
+	name := ""
+	if l.Name != "" {
+		name = " for listener " + l.Name
+	}
+
+	// Start TCP listener
+	if l.Listen != "" {
+		tcpListener, err := net.Listen("tcp", l.Listen)
+		if err != nil {
+			return err
+		}
+		p.listeners = append(p.listeners, tcpListener)
+		log.Printf("[MariaDB] Listening on %s (tcp)%s, forwarding to %v backends", l.Listen, name, len(p.pools))
+		go p.acceptLoop(tcpListener, l.Name)
+	}
 
 	// Start Unix socket listener if configured
-	if socket != "" {
+	if l.Socket != "" {
 		// Remove existing socket file if present
-		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		if err := os.Remove(l.Socket); err != nil && !os.IsNotExist(err) {
 			log.Printf("[MariaDB] Warning: could not remove existing socket: %v", err)
 		}
-		unixListener, err := net.Listen("unix", socket)
+		unixListener, err := net.Listen("unix", l.Socket)
 		if err != nil {
 			return fmt.Errorf("failed to listen on unix socket: %v", err)
 		}
 		p.listeners = append(p.listeners, unixListener)
-		log.Printf("[MariaDB] Listening on %s (unix)", socket)
-		go p.acceptLoop(unixListener)
+		log.Printf("[MariaDB] Listening on %s (unix)%s", l.Socket, name)
+		go p.acceptLoop(unixListener, l.Name)
 	}
 
 	return nil
@@ -139,31 +729,41 @@ func (p *Proxy) Start() error {
 // Stop closes all listeners and the database connection
 func (p *Proxy) Stop() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
+	listeners := p.listeners
+	writeBatch := p.writeBatch
+	db := p.db
+	p.listeners = nil
+	p.db = nil
+	p.mu.Unlock()
 
-	// Stop write batching
-	if p.writeBatch != nil {
-		if err := p.writeBatch.Close(); err != nil {
-			log.Printf("[MariaDB] Error closing write batch manager: %v", err)
-		}
-	}
-	if p.wbCancel != nil {
-		p.wbCancel()
-	}
+	p.closeLagDBs()
+	p.verifying.Wait()
+	p.closeRefreshConns()
+
+	p.syncBinlog(config.ProxyConfig{})
 
 	var errs []error
-	for _, listener := range p.listeners {
+	for _, listener := range listeners {
 		if err := listener.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
-	p.listeners = nil
 
-	if p.db != nil {
-		if err := p.db.Close(); err != nil {
+	// Stop write batching, executing the pending batches
+	if writeBatch != nil {
+		if err := writeBatch.Close(); err != nil {
+			log.Printf("[MariaDB] Error closing write batch manager: %v", err)
+		}
+	}
+	p.closeRouteBatches()
+	if p.wbCancel != nil {
+		p.wbCancel()
+	}
+
+	if db != nil {
+		if err := db.Close(); err != nil {
 			errs = append(errs, err)
 		}
-		p.db = nil
 	}
 
 	if len(errs) > 0 {
@@ -172,7 +772,39 @@ func (p *Proxy) Stop() error {
 	return nil
 }
 
-func (p *Proxy) acceptLoop(listener net.Listener) {
+// Shutdown stops accepting connections and waits for the client sessions to
+// end. When ctx is done first, the remaining client connections are closed.
+// Pending write batches are then executed and the backends closed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	listeners := p.listeners
+	p.listeners = nil
+	p.mu.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		closed := 0
+		p.clients.Range(func(key, _ any) bool {
+			key.(net.Conn).Close()
+			closed++
+			return true
+		})
+		log.Printf("[MariaDB] Drain timeout, closed %d client connections", closed)
+	}
+	return p.Stop()
+}
+
+// acceptLoop accepts the client connections of the listener with the name
+func (p *Proxy) acceptLoop(listener net.Listener, name string) {
 	for {
 		client, err := listener.Accept()
 		if err != nil {
@@ -183,38 +815,54 @@ func (p *Proxy) acceptLoop(listener net.Listener) {
 			log.Printf("[MariaDB] Accept error: %v", err)
 			continue
 		}
+		p.mu.RLock()
+		opts := tcpOptions(p.config.TCP)
+		header := proxyOptions(p.config, name, listener)
+		p.mu.RUnlock()
+		if err := opts.Apply(client); err != nil {
+			log.Printf("[MariaDB] Error setting TCP options: %v", err)
+		}
 		connID := atomic.AddUint32(&p.connID, 1)
-		go p.handleConnection(client, connID)
+		p.sessions.Add(1)
+		go func() {
+			defer p.sessions.Done()
+			if header != nil {
+				proxied, err := header.Accept(client)
+				if err != nil {
+					log.Printf("[MariaDB] PROXY protocol error from %s: %v", client.RemoteAddr(), err)
+					client.Close()
+					return
+				}
+				client = proxied
+			}
+			p.handleConnection(client, connID, name)
+		}()
 	}
 }
 
-func (p *Proxy) handleConnection(client net.Conn, connID uint32) {
+func (p *Proxy) handleConnection(client net.Conn, connID uint32, listener string) {
 	defer client.Close()
+	p.clients.Store(client, struct{}{})
+	defer p.clients.Delete(client)
 
-	p.mu.RLock()
-	defaultPool := p.pools[p.config.Default]
-	p.mu.RUnlock()
-
-	conn := &clientConn{
-		conn:               client,
-		backendPool:        defaultPool,
-		proxy:              p,
-		connID:             connID,
-		capability:         0,
-		status:             mysql.StatusInAutocommit,
-		sequence:           0,
-		preparedStatements: make(map[uint32]*parser.ParsedQuery),
-	}
+	conn := p.newClientConn(client, connID, listener)
+	// Closing the watched connection also ends its watcher
+	defer func() { conn.conn.Close() }()
 
 	// For the initial connection, we don't have the username yet.
 	// We must first read the client auth packet to get the username.
 	// But to get the client auth packet, we first need to send a greeting with a salt.
 	// So we connect to the backend FIRST to get its salt.
 
-	addr := defaultPool.GetPrimary()
+	addr := conn.backendPool.GetPrimary()
 	backend, err := conn.dialAndAuth(addr)
 	if err != nil {
 		log.Printf("[MariaDB] Initial connection/auth error (conn %d): %v", connID, err)
+		if errors.Is(err, limiter.ErrTooManyConnections) {
+			// No greeting was sent yet, the error packet takes its place
+			conn.sequence = 255
+			conn.writeError(err)
+		}
 		return
 	}
 	defer backend.Close()
@@ -222,21 +870,84 @@ func (p *Proxy) handleConnection(client net.Conn, connID uint32) {
 	conn.backend = backend
 	conn.backendAddr = addr
 	conn.backendName = "primary"
+	conn.trackThread()
+	p.conns.Store(connID, conn)
+	defer p.conns.Delete(connID)
 
 	// If client specified a database in handshake, select it on backend
 	if conn.db != "" {
-		if _, err := conn.execBackendQuery(fmt.Sprintf("USE `%s`", conn.db)); err != nil {
+		db, replicaDB := p.backendDatabase(conn.db)
+		var err error
+		if replicaDB {
+			// A replica database moves the session to a replica
+			err = conn.ensureBackend(conn.db)
+		}
+		if err == nil {
+			_, err = conn.execBackendQuery(fmt.Sprintf("USE `%s`", db))
+		}
+		if err != nil {
 			log.Printf("[MariaDB] Failed to select initial database %s: %v", conn.db, err)
 		}
 	}
 
 	// Successfully authenticated both client and backend
+	if conn.history != nil {
+		defer p.histories.Register(&history.Conn{
+			ID:      connID,
+			Addr:    client.RemoteAddr().String(),
+			User:    conn.user,
+			Started: time.Now(),
+			History: conn.history,
+		})()
+	}
 	conn.run()
 }
 
+// newClientConn returns the session of a client accepted by the listener
+// with the name, which switches to TLS when the client asks for it and the
+// listener has a certificate
+func (p *Proxy) newClientConn(client net.Conn, connID uint32, listener string) *clientConn {
+	p.mu.RLock()
+	defaultPool := p.pools[p.config.Default]
+	historySize := p.config.QueryHistory
+	strict := p.config.StrictProtocol
+	p.mu.RUnlock()
+
+	name := fmt.Sprintf("conn %d (%s)", connID, client.RemoteAddr())
+	tlsConfig, tlsRequired := p.listenerTLS(listener)
+	conn := &clientConn{
+		conn:               watch.NewConn(conform.NewMariaDB(client, name, strict)),
+		backendPool:        defaultPool,
+		proxy:              p,
+		clientAddr:         client.RemoteAddr().String(),
+		listener:           listener,
+		connID:             connID,
+		capability:         0,
+		status:             mysql.StatusInAutocommit,
+		sequence:           0,
+		preparedStatements: make(map[uint32]*preparedStatement),
+		history:            history.NewRing(historySize),
+		lastAffectedRows:   -1,
+		tlsRequired:        tlsRequired,
+	}
+	if tlsConfig != nil {
+		conn.startTLS = func() error {
+			tlsConn, err := tlsopt.Accept(client, tlsConfig)
+			if err != nil {
+				return err
+			}
+			conn.conn = watch.NewConn(conform.NewMariaDB(tlsConn, name, strict))
+			return nil
+		}
+	}
+	return conn
+}
+
 type clientConn struct {
 	mu          sync.Mutex
 	conn        net.Conn
+	clientAddr  string   // Remote address of the client
+	listener    string   // Name of the listener that accepted the client
 	backend     net.Conn // Raw TCP connection to backend
 	backendPool *replica.Pool
 	proxy       *Proxy
@@ -250,6 +961,11 @@ type clientConn struct {
 	user        string // Client username
 	auth        []byte // Client auth response
 	rawAuthPkt  []byte // Original client auth packet to forward
+	collation   byte   // Collation ID negotiated by the client or set with SET NAMES
+	password    string // Client password, known after caching_sha2_password authentication
+	hasPassword bool
+	startTLS    func() error // Switches the client connection to TLS, nil when the listener has no certificate
+	tlsRequired bool         // The listener rejects plaintext clients
 
 	// Backend connection state
 	backendAddr string
@@ -260,16 +976,70 @@ type clientConn struct {
 	lastQueryShard    string
 	lastQueryCacheHit bool
 	lastBatchSize     int
+	lastAffectedRows  int64 // -1 when unknown, for the audit log
+	lastResultErr     bool  // The last forwarded response ended with an error packet
 
-	// Prepared statements
-	preparedStatements map[uint32]*parser.ParsedQuery
+	// Prepared statements by the statement ID of the client, see handlePrepare
+	preparedStatements map[uint32]*preparedStatement
+	lastStmtID         uint32
 
-	// Transaction state
+	// Transaction state, see pinned
 	inTransaction bool
+
+	// The database is a replica database: statements run on a replica of the
+	// backend, which transactions stay on, and writes are rejected
+	replicaDB bool
+
+	// Last write or commit, reads stay on the primary for read_split_sticky_ms
+	lastWrite time.Time
+
+	// The last statement was sent to another backend by a route hint or a
+	// table route, the next statement without one switches back
+	routedShard bool
+
+	// BEGIN of a transaction without statements on tables yet, and the
+	// backend of the statements on tables of the transaction, see
+	// routeTransaction
+	txBegin   string
+	txBackend string
+
+	// Receives the response of a read beyond the spill threshold, see execReadOn
+	spill *spill.Buffer
+
+	// Orders batched writes in submission order (SET tqdb_ordered_writes = ON)
+	writeOrder *writebatch.Sequence
+
+	// Tracks pending batched writes, which BEGIN waits for
+	writeFence writebatch.Fence
+
+	// Forwards queries with their hint comments (SET tqdb_keep_comments = ON)
+	keepComments bool
+
+	// SET statements of the session, replayed on new backend connections
+	settings session.Settings
+
+	// Reads run uncached in a repeatable read transaction on one replica
+	// (SET tqdb_snapshot = ON)
+	snapshot bool
+
+	// Allows several statements per query, negotiated in the handshake or
+	// set with COM_SET_OPTION
+	multiStatements bool
+
+	// Last statements for SHOW TQDB HISTORY (nil = disabled)
+	history *history.Ring
+	routed  bool // The current statement was served by the cache or a backend
+
+	// Backend connection as targeted by KILL from other connections
+	thread atomic.Pointer[backendThread]
 }
 
-func (c *clientConn) writeServerGreeting() error {
-	payload := mysql.WriteHandshakeV10(c.connID, c.salt, c.capability, c.status)
+func (c *clientConn) writeServerGreeting(plugin string) error {
+	capability := c.capability
+	if c.startTLS != nil {
+		capability |= mysql.ClientSSL // TLS of the listener, the backend connection has its own
+	}
+	payload := withAuthPlugin(mysql.WriteHandshakeV10(c.connID, c.salt, capability, c.status), plugin)
 	c.sequence = 255 // writePacket will increment this to 0
 	return c.writePacket(payload)
 }
@@ -280,6 +1050,23 @@ func (c *clientConn) readClientAuth() error {
 		return err
 	}
 
+	// A client that asks for TLS sends the start of its handshake response,
+	// and the whole response again over TLS
+	if c.startTLS != nil && len(packet) == sslRequestSize && binary.LittleEndian.Uint32(packet)&uint32(mysql.ClientSSL) != 0 {
+		if err := c.startTLS(); err != nil {
+			return err
+		}
+		c.tlsRequired = false
+		if packet, err = c.readPacket(); err != nil {
+			return err
+		}
+	}
+	if c.tlsRequired {
+		err := mariadbproto.Err{Code: mariadbproto.ErAccessDeniedError, State: mariadbproto.StateAccessDenied, Message: "TLS is required on this listener"}
+		c.writeError(err)
+		return err
+	}
+
 	hr, err := mysql.ParseHandshakeResponse(packet)
 	if err != nil {
 		return err
@@ -287,10 +1074,12 @@ func (c *clientConn) readClientAuth() error {
 
 	// Store username and auth for backend connection
 	c.capability = hr.Capability
+	c.multiStatements = hr.Capability&clientMultiStmts != 0
 	c.user = hr.User
 	c.auth = hr.Auth
 	c.db = hr.DB
 	c.rawAuthPkt = packet // Store original packet for forwarding
+	c.collation = handshakeCollation(packet)
 
 	return nil
 }
@@ -313,6 +1102,9 @@ func (c *clientConn) run() {
 		data := packet[1:]
 
 		if err := c.dispatch(cmd, data); err != nil {
+			if errors.Is(err, watch.ErrClientAborted) {
+				return
+			}
 			if err != io.EOF {
 				log.Printf("[MariaDB] Command error (conn %d): %v", c.connID, err)
 			}
@@ -323,6 +1115,18 @@ func (c *clientConn) run() {
 	}
 }
 
+// checkStatement returns an error for the writes of read-only users and in
+// replica databases
+func (c *clientConn) checkStatement(query string) error {
+	if err := c.proxy.accessRules().CheckStatement(c.user, query); err != nil {
+		return err
+	}
+	if c.replicaDB {
+		return acl.CheckReadOnlyDatabase(c.db, query)
+	}
+	return nil
+}
+
 func (c *clientConn) ensureBackend(db string) error {
 	c.proxy.mu.RLock()
 	shardName := c.proxy.config.DBMap[db]
@@ -330,19 +1134,67 @@ func (c *clientConn) ensureBackend(db string) error {
 		shardName = c.proxy.config.Default
 	}
 	targetPool := c.proxy.pools[shardName]
+	rules := c.proxy.rules
 	c.proxy.mu.RUnlock()
 
+	if err := rules.CheckDatabase(c.user, db); err != nil {
+		return err
+	}
+	if err := rules.CheckShard(c.user, shardName); err != nil {
+		return err
+	}
+
 	if targetPool == nil {
 		return fmt.Errorf("no backend pool found for database %q", db)
 	}
+	_, replicaDB := c.proxy.backendDatabase(db)
+	if c.pinned() && !c.snapshot && (targetPool != c.backendPool || replicaDB != c.replicaDB) {
+		return fmt.Errorf("database %q: %w", db, errTransactionPinned)
+	}
+	c.replicaDB = replicaDB
+	return c.switchShard(shardName, targetPool)
+}
+
+// ensureRoute switches the connection to the backend named by a route hint
+// or a table route
+func (c *clientConn) ensureRoute(shardName string) error {
+	c.proxy.mu.RLock()
+	targetPool := c.proxy.pools[shardName]
+	rules := c.proxy.rules
+	c.proxy.mu.RUnlock()
+
+	if err := rules.CheckShard(c.user, shardName); err != nil {
+		return err
+	}
+
+	if targetPool == nil {
+		return fmt.Errorf("unknown backend %q in route", shardName)
+	}
+	return c.switchShard(shardName, targetPool)
+}
 
+// switchShard connects to the primary of targetPool, or to a replica for a
+// replica database, unless the connection already uses the pool
+func (c *clientConn) switchShard(shardName string, targetPool *replica.Pool) error {
 	c.lastQueryShard = shardName
 
-	if targetPool == c.backendPool && c.backend != nil {
+	// A snapshot stays on the connection it started on
+	if c.snapshot {
+		if targetPool != c.backendPool || c.backend == nil {
+			return errSnapshotLost
+		}
+		return nil
+	}
+
+	if targetPool == c.backendPool && c.backend != nil && !(c.replicaDB && c.backendName == "primary") {
 		return nil // Already on the right shard with valid connection
 	}
 
 	// When switching shards or reconnecting, we default to the primary of that shard
+	if c.replicaDB {
+		addr, name := targetPool.GetReplica()
+		return c.ensureBackendConn(addr, name, targetPool)
+	}
 	addr := targetPool.GetPrimary()
 	return c.ensureBackendConn(addr, "primary", targetPool)
 }
@@ -351,6 +1203,9 @@ func (c *clientConn) ensureBackendConn(addr string, name string, pool *replica.P
 	if addr == c.backendAddr && c.backend != nil {
 		return nil // Already on the right connection
 	}
+	if c.pinned() && c.backend != nil {
+		return errTransactionPinned
+	}
 
 	log.Printf("[MariaDB] Switching backend for conn %d: %s -> %s (%s)", c.connID, c.backendAddr, addr, name)
 
@@ -367,10 +1222,136 @@ func (c *clientConn) ensureBackendConn(addr string, name string, pool *replica.P
 	c.backendPool = pool
 	c.backendAddr = addr
 	c.backendName = name
+	c.trackThread()
+	c.restoreSettings()
 
 	return nil
 }
 
+// execRead executes a read on a replica (for cacheable queries, or SELECTs
+// with read splitting, outside of a transaction, and all statements of a
+// replica database) or on the primary. When the backend connection fails, a
+// non-transactional SELECT is retried up to read_retries times, on another
+// healthy replica or on the primary. A response that outgrew the spill
+// threshold is returned as spill buffer instead, which the caller closes.
+func (c *clientConn) execRead(parsed *parser.ParsedQuery) ([]byte, *spill.Buffer, string, error) {
+	outsideTx := !c.pinned()
+	retries := 0
+	if parsed.Type == parser.QuerySelect && outsideTx {
+		retries = c.proxy.readRetries()
+	}
+
+	// A route hint forces a replica for a SELECT, or the primary
+	toReplica := parsed.IsCacheable() || c.splitRead(parsed)
+	if parsed.Route != "" {
+		toReplica = parsed.Route == parser.RouteReplica && parsed.Type == parser.QuerySelect
+	}
+
+	for attempt := 0; ; attempt++ {
+		backendAddr, backendName := c.backendPool.GetPrimary(), "primary"
+		switch {
+		case c.snapshot:
+			// The reads of a snapshot stay on its replica
+			if c.backend == nil {
+				return nil, nil, "", errSnapshotLost
+			}
+			backendAddr, backendName = c.backendAddr, c.backendName
+		case c.replicaDB && !outsideTx && c.backend != nil:
+			// The transaction of a replica database stays on its replica
+			backendAddr, backendName = c.backendAddr, c.backendName
+		case c.replicaDB || (outsideTx && toReplica):
+			backendAddr, backendName = c.backendPool.GetReplicaMaxLag(time.Duration(parsed.MaxLagMs) * time.Millisecond)
+		}
+
+		spilled := c.proxy.newSpill()
+		response, err := c.execReadOn(backendAddr, backendName, c.backendQuery(parsed), spilled)
+		if spilled != nil && (err != nil || !spilled.Spilled()) {
+			spilled.Close()
+			spilled = nil
+		}
+		// Only reads that failed on the connection or an unavailable backend
+		// are retried, not errors of the query itself
+		if attempt >= retries || !isBackendConnError(responseError(response, err)) {
+			return response, spilled, backendName, err
+		}
+
+		// The failed replica is skipped until the next health check passes
+		if backendName != "primary" {
+			c.backendPool.MarkUnhealthy(backendAddr)
+		}
+		c.resetBackend()
+		metrics.ReadRetries.WithLabelValues(backendName).Inc()
+		log.Printf("[MariaDB] Read on %s (%s) failed for conn %d, retrying (%d/%d): %v", backendName, backendAddr, c.connID, attempt+1, retries, err)
+	}
+}
+
+// verifyCacheHit executes a sampled cache hit on the primary of the backend
+// of its tables, or else of the session, and compares the checksum of the
+// response with the checksum of the cached response, logging mismatches. It
+// runs in the background on a connection of the proxy, see verify, so that
+// the client session neither waits for it nor moves its backend connection.
+// Hits sampled while cache.MaxVerifications verifications run are skipped.
+func (c *clientConn) verifyCacheHit(parsed *parser.ParsedQuery, tableBackend string, cached []byte, freshness string) {
+	p := c.proxy
+	if !p.verifier.Sample() {
+		return
+	}
+	if !p.verifier.Acquire() {
+		metrics.CacheVerifications.WithLabelValues("skipped").Inc()
+		return
+	}
+	connID, shard, db := c.connID, tableBackend, c.db
+	if shard == "" {
+		shard = c.shard()
+	}
+	p.verifying.Add(1)
+	go func() {
+		defer p.verifying.Done()
+		defer p.verifier.Release()
+		ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+		defer cancel()
+		response, err := p.verify(ctx, shard, db, parsed.Query)
+		if err != nil {
+			metrics.CacheVerifications.WithLabelValues("error").Inc()
+			log.Printf("[MariaDB] Cache verification failed for conn %d: %v", connID, err)
+			return
+		}
+		cachedSum, primarySum := cache.Checksum(cached), cache.Checksum(response)
+		if cachedSum == primarySum {
+			metrics.CacheVerifications.WithLabelValues("match").Inc()
+			return
+		}
+		metrics.CacheVerifications.WithLabelValues("mismatch").Inc()
+		log.Printf("[MariaDB] Cache verification mismatch for conn %d (shard %s, database %s, %s hit, ttl %ds, file %s, line %d): cached %s (%d bytes), primary %s (%d bytes), query: %s",
+			connID, shard, db, freshness, parsed.TTL, parsed.File, parsed.Line, cachedSum, len(cached), primarySum, len(response), logging.QueryText(parsed.Query))
+	}()
+}
+
+// execReadOn connects to the given backend and executes a query on it,
+// writing the response to spilled when it is not nil, see readBackendResponse
+func (c *clientConn) execReadOn(addr, name, query string, spilled *spill.Buffer) ([]byte, error) {
+	if err := c.ensureBackendConn(addr, name, c.backendPool); err != nil {
+		return nil, err
+	}
+	c.spill = spilled
+	defer func() { c.spill = nil }()
+	// Track reads on replicas, so draining a replica waits for them
+	if name != "primary" {
+		defer c.backendPool.Track(addr)()
+	}
+	return c.execBackendQuery(query)
+}
+
+// watchClient watches the client for a disconnect while the proxy waits on
+// its behalf, see watch.Conn.Watch. Unwrapped connections are not watched.
+func (c *clientConn) watchClient(onAbort func()) func() bool {
+	wc, ok := c.conn.(*watch.Conn)
+	if !ok {
+		return func() bool { return false }
+	}
+	return wc.Watch(onAbort)
+}
+
 // resetBackend clears the backend connection state after an I/O error
 func (c *clientConn) resetBackend() {
 	if c.backend != nil {
@@ -379,6 +1360,7 @@ func (c *clientConn) resetBackend() {
 	}
 	c.backendAddr = ""
 	c.backendName = ""
+	c.thread.Store(nil)
 }
 
 func (c *clientConn) handleLocalInfile(initialResponse []byte, moreResults bool) error {
@@ -406,7 +1388,7 @@ func (c *clientConn) handleLocalInfile(initialResponse []byte, moreResults bool)
 	}
 
 	// 3. Read final OK/ERR from backend
-	finalResponse, err := c.execBackendResponse()
+	finalResponse, err := c.readBackendResponse()
 	if err != nil {
 		return err
 	}
@@ -416,12 +1398,7 @@ func (c *clientConn) handleLocalInfile(initialResponse []byte, moreResults bool)
 
 func (c *clientConn) writePacket(payload []byte) error {
 	c.sequence++
-	packet := make([]byte, 4+len(payload))
-	binary.LittleEndian.PutUint32(packet[0:4], uint32(len(payload)))
-	packet[3] = c.sequence
-	copy(packet[4:], payload)
-	_, err := c.conn.Write(packet)
-	return err
+	return mariadbproto.WritePacket(c.conn, c.sequence, payload)
 }
 
 func (c *clientConn) dialAndAuth(addr string) (net.Conn, error) {
@@ -437,7 +1414,14 @@ func (c *clientConn) dialAndAuth(addr string) (net.Conn, error) {
 	cfg.User = c.user
 	cfg.Net = network
 	cfg.Addr = dialAddr
-	cfg.DBName = c.db
+	cfg.DBName, _ = c.proxy.backendDatabase(c.db)
+	cfg.Collation = c.backendCollation()
+	cfg.DialFunc = c.proxy.connLimiter.DialContext
+	tlsCfg, err := c.proxy.backendTLS(addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TLS = tlsCfg
 
 	// Crucial: define the HandleAuth callback to forward the nonce to the client
 	cfg.HandleAuth = func(backendCfg *mysql.Config, plugin string, salt []byte, serverCapabilities uint32) ([]byte, error) {
@@ -446,27 +1430,50 @@ func (c *clientConn) dialAndAuth(addr string) (net.Conn, error) {
 			// We need to send the Server Greeting to the client with this salt.
 			c.salt = salt
 			c.capability = mysql.CapabilityFlag(serverCapabilities & ^uint32(mysql.ClientSSL|mysql.ClientDeprecateEOF)) // Strip SSL and DeprecateEOF from backend capabilities
-			if err := c.writeServerGreeting(); err != nil {
+			if err := c.writeServerGreeting(plugin); err != nil {
 				return nil, err
 			}
 			// Then read the client's auth response.
 			if err := c.readClientAuth(); err != nil {
 				return nil, err
 			}
+			// Users and databases denied by the proxy never reach the backend
+			rules := c.proxy.accessRules()
+			err := rules.CheckUser(c.user)
+			if err == nil {
+				err = c.proxy.listenerRules(c.listener).CheckUser(c.user)
+			}
+			if err == nil {
+				err = rules.CheckDatabase(c.user, c.db)
+			}
+			if err != nil {
+				c.writeError(err)
+				return nil, err
+			}
 			// IMPORTANT: Update the backend config with the username we just got from the client
 			backendCfg.User = c.user
+			backendCfg.Collation = c.backendCollation()
+			// With caching_sha2_password the backend may ask for full
+			// authentication, which the driver does with the password
+			if plugin == cachingSHA2Password {
+				if err := c.authCachingSHA2(); err != nil {
+					return nil, err
+				}
+				backendCfg.Passwd = c.password
+			}
 			// The driver expects the auth response body.
 			return c.auth, nil
+		} else if plugin == cachingSHA2Password && c.hasPassword {
+			// This is a SHARD SWITCH with a known password: authenticate
+			// without involving the client
+			backendCfg.Passwd = c.password
+			return scrambleSHA256(salt, c.password), nil
 		} else {
 			// This is a SHARD SWITCH.
 			// The client is already connected and authenticated once.
 			// We need to send an Auth Switch Request (0xFE) to the client.
 			// https://mariadb.com/kb/en/connection/#auth-switch-request
-			payload := make([]byte, 1+len(plugin)+1+len(salt))
-			payload[0] = 0xFE
-			copy(payload[1:], plugin)
-			payload[1+len(plugin)] = 0
-			copy(payload[1+len(plugin)+1:], salt)
+			payload := mariadbproto.AuthSwitchRequest{Plugin: plugin, Data: salt}.Encode()
 
 			// Send to client
 			if err := c.writePacket(payload); err != nil {
@@ -490,8 +1497,14 @@ func (c *clientConn) dialAndAuth(addr string) (net.Conn, error) {
 	// connect using the driver
 	dbConn, err := connector.Connect(context.Background())
 	if err != nil {
+		if c.hasPassword {
+			c.proxy.sha2.forget(c.user)
+		}
 		return nil, err
 	}
+	if c.hasPassword {
+		c.proxy.sha2.remember(c.user, c.password)
+	}
 
 	// After successful Connect, we have the auth OK from backend.
 	// But we still need to send the OK packet to the client if this was a shard switch
@@ -532,7 +1545,8 @@ func (c *clientConn) dispatch(cmd byte, data []byte) error {
 		}
 		c.db = dbName
 		// Execute USE database on backend
-		_, err := c.execBackendQuery(fmt.Sprintf("USE `%s`", dbName))
+		backendDB, _ := c.proxy.backendDatabase(dbName)
+		_, err := c.execBackendQuery(fmt.Sprintf("USE `%s`", backendDB))
 		c.mu.Unlock()
 		if err != nil {
 			return err
@@ -562,39 +1576,303 @@ func (c *clientConn) dispatch(cmd byte, data []byte) error {
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		return c.handleStmtReset(data)
+	case mariadbproto.ComSetOption:
+		return c.handleSetOption(data)
+	case mariadbproto.ComStmtFetch:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.handleStmtFetch(data)
 	default:
 		return fmt.Errorf("command %d not supported", cmd)
 	}
 }
 
-func (c *clientConn) handleBegin(moreResults bool) error {
-	_, err := c.execBackendQuery("BEGIN")
+// handleSetOption turns multi-statement queries on or off for the session.
+// The proxy splits them itself, so the backend is not involved.
+func (c *clientConn) handleSetOption(data []byte) error {
+	if len(data) < 2 {
+		return mariadbproto.ErrShortPacket
+	}
+	switch binary.LittleEndian.Uint16(data) {
+	case mariadbproto.OptionMultiStatementsOn:
+		c.multiStatements = true
+	case mariadbproto.OptionMultiStatementsOff:
+		c.multiStatements = false
+	default:
+		return mariadbproto.Err{Code: mariadbproto.ErUnknownComError, State: mariadbproto.StateUnknownCommand, Message: "Unknown command"}
+	}
+	return c.writeEOF()
+}
+
+// handleBegin starts a transaction with BEGIN or START TRANSACTION (with its
+// characteristics, such as READ ONLY), which pins the session, see pinned
+func (c *clientConn) handleBegin(query string, moreResults bool) error {
+	if c.snapshot {
+		return errSnapshotActive
+	}
+	// Batched writes of this connection must commit before the transaction
+	// starts, or they could commit after it
+	c.writeFence.Wait(context.Background())
+	// The transaction runs on the primary (on a replica for a replica
+	// database), where the session stays until it ends
+	if c.backendPool != nil && !c.replicaDB && (c.backend == nil || c.backendName != "primary") {
+		if err := c.ensureBackendConn(c.backendPool.GetPrimary(), "primary", c.backendPool); err != nil {
+			return err
+		}
+	}
+	response, err := c.execBackendQuery(query)
 	if err != nil {
 		return err
 	}
+	if isError(response) {
+		return c.forwardBackendResponse(response, moreResults)
+	}
 	c.status |= mysql.StatusInTrans
 	c.inTransaction = true
+	c.txBegin, c.txBackend = query, ""
 	return c.writeOKWithInfo("", moreResults)
 }
 
-func (c *clientConn) handleCommit(moreResults bool) error {
-	_, err := c.execBackendQuery("COMMIT")
+// pinned reports whether the session is in a transaction, which pins it to
+// its backend connection until COMMIT or ROLLBACK: no cache, replica reads,
+// write batching or backend switches
+func (c *clientConn) pinned() bool {
+	return c.inTransaction || c.status&mysql.StatusInTrans != 0
+}
+
+// backendCollation returns the collation name for backend connections: the
+// one of the client if known, else the configured collation
+func (c *clientConn) backendCollation() string {
+	if name, ok := collationNames[c.collation]; ok {
+		return name
+	}
+	c.proxy.mu.RLock()
+	defer c.proxy.mu.RUnlock()
+	return c.proxy.config.Collation
+}
+
+// resultCollation returns the collation ID for column definitions built by
+// the proxy, so that they match the character set of the client
+func (c *clientConn) resultCollation() byte {
+	if c.collation == 0 {
+		return defaultCollation
+	}
+	return c.collation
+}
+
+// handleSetNames executes SET NAMES or SET CHARACTER SET on the backend and
+// tracks the collation, which is used for backend reconnects and for
+// proxy-built packets
+func (c *clientConn) handleSetNames(query string, collation byte, moreResults bool) error {
+	response, err := c.execBackendQuery(query)
+	if err != nil {
+		return err
+	}
+	if collation != 0 && len(response) > 4 && response[4] == 0x00 {
+		c.collation = collation
+	}
+	if !isError(response) {
+		c.settings.Set(query, []string{"names"})
+	}
+	return c.forwardBackendResponse(response, moreResults)
+}
+
+// handleSessionSet executes a SET of session variables on the backend and
+// tracks it, so that it is replayed when the session moves to another
+// backend connection
+func (c *clientConn) handleSessionSet(query string, names []string, moreResults bool) error {
+	response, err := c.execBackendQuery(query)
+	if err != nil {
+		return err
+	}
+	if !isError(response) {
+		c.settings.Set(query, names)
+	}
+	return c.forwardBackendResponse(response, moreResults)
+}
+
+// restoreSettings replays the SET statements of the session on a new backend
+// connection
+func (c *clientConn) restoreSettings() {
+	for _, query := range c.settings.Queries() {
+		response, err := c.execBackendQuery(query)
+		if err == nil && isError(response) {
+			if e, perr := mariadbproto.ParseErr(response[mariadbproto.HeaderSize:]); perr == nil {
+				err = e
+			} else {
+				err = perr
+			}
+		}
+		if err != nil {
+			log.Printf("[MariaDB] Cannot restore %q on %s for conn %d: %v", query, c.backendName, c.connID, err)
+		}
+	}
+}
+
+// setProxyVariable sets a session variable of the proxy
+func (c *clientConn) setProxyVariable(name, value string) error {
+	switch name {
+	case "tqdb_ordered_writes":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		c.writeOrder = nil
+		if on {
+			c.writeOrder = &writebatch.Sequence{}
+		}
+		return nil
+	case "tqdb_keep_comments":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		c.keepComments = on
+		return nil
+	case "tqdb_snapshot":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if on {
+			return c.startSnapshot()
+		}
+		return c.endSnapshot()
+	}
+	return fmt.Errorf("unknown proxy variable %s", name)
+}
+
+var (
+	// errSnapshotActive is returned for transaction statements in a snapshot
+	errSnapshotActive = errors.New("a snapshot is active, end it with SET tqdb_snapshot = OFF")
+	// errTransactionPinned is returned for statements that would move a
+	// session in a transaction to another backend connection
+	errTransactionPinned = errors.New("cannot switch backends in a transaction, commit or roll back first")
+	// errSnapshotLost is returned for the reads of a snapshot whose backend
+	// connection was lost or that would move to another backend
+	errSnapshotLost = errors.New("the snapshot is no longer available, end it with SET tqdb_snapshot = OFF")
+)
+
+// startSnapshot starts a read-only repeatable read transaction with a
+// consistent snapshot on a replica, which the reads of the session stay on,
+// without the cache, until endSnapshot
+func (c *clientConn) startSnapshot() error {
+	if c.snapshot {
+		return nil
+	}
+	if c.pinned() {
+		return errors.New("tqdb_snapshot: cannot start a snapshot in a transaction")
+	}
+	if c.backendPool == nil {
+		return errors.New("tqdb_snapshot: no backend")
+	}
+	// Batched writes of this connection must commit before the snapshot
+	// starts, or it would not see them
+	c.writeFence.Wait(context.Background())
+	addr, name := c.backendPool.GetReplica()
+	if err := c.ensureBackendConn(addr, name, c.backendPool); err != nil {
+		return err
+	}
+	for _, query := range []string{"SET TRANSACTION ISOLATION LEVEL REPEATABLE READ", "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY"} {
+		response, err := c.execBackendQuery(query)
+		if err != nil {
+			return err
+		}
+		if isError(response) {
+			e, err := mariadbproto.ParseErr(response[mariadbproto.HeaderSize:])
+			if err != nil {
+				return err
+			}
+			return e
+		}
+	}
+	c.snapshot = true
+	c.inTransaction = true
+	c.status |= mysql.StatusInTrans
+	return nil
+}
+
+// endSnapshot commits the transaction of a snapshot, when its backend
+// connection is still there
+func (c *clientConn) endSnapshot() error {
+	if !c.snapshot {
+		return nil
+	}
+	c.snapshot = false
+	c.inTransaction = false
+	c.status &= ^mysql.StatusInTrans
+	if c.backend == nil {
+		return nil
+	}
+	_, err := c.execBackendQuery("COMMIT")
+	return err
+}
+
+// setKillSwitch toggles the kill switch of a feature, when the user is listed
+// in admin_users
+func (c *clientConn) setKillSwitch(name, value string) error {
+	c.proxy.mu.RLock()
+	admin := slices.Contains(c.proxy.config.AdminUsers, c.user)
+	switches := c.proxy.switches
+	c.proxy.mu.RUnlock()
+	if !admin {
+		return mariadbproto.Err{Code: mariadbproto.ErSpecificAccessDenied, State: mariadbproto.StateAccessViolation,
+			Message: fmt.Sprintf("Access denied; user '%s' is not in admin_users for SET GLOBAL %s", c.user, name)}
+	}
+	on, err := parser.ParseSwitch(value)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return switches.Set(strings.TrimPrefix(name, "tqdb_"), on, fmt.Sprintf("%s@%s (MariaDB)", c.user, c.conn.RemoteAddr()))
+}
+
+// backendQuery returns the query text to send to the backend: without hint
+// comments, or as sent by the client when the session keeps comments, and
+// annotated with the proxy identity when configured
+func (c *clientConn) backendQuery(parsed *parser.ParsedQuery) string {
+	if c.keepComments {
+		return c.annotate(parsed.Raw)
+	}
+	return c.annotate(parsed.Query)
+}
+
+// annotate prefixes a query with the proxy identity, when configured
+func (c *clientConn) annotate(query string) string {
+	return c.proxy.annotator.Annotate(query, annotate.Session{
+		ConnID:   c.connID,
+		User:     c.user,
+		Database: c.db,
+		Shard:    c.shard(),
+	})
+}
+
+// handleEnd ends the transaction with COMMIT or ROLLBACK, which unpins the
+// session unless a new transaction is chained to it. A session whose end
+// failed stays pinned.
+func (c *clientConn) handleEnd(query string, tx parser.Transaction, moreResults bool) error {
+	if c.snapshot {
+		return errSnapshotActive
+	}
+	response, err := c.execBackendQuery(query)
 	if err != nil {
 		return err
 	}
-	c.status &= ^mysql.StatusInTrans
-	c.inTransaction = false
+	if isError(response) {
+		return c.forwardBackendResponse(response, moreResults)
+	}
+	if tx.Op == parser.TxCommit {
+		c.lastWrite = time.Now()
+	}
+	if !tx.Chain {
+		c.endTransaction()
+	}
 	return c.writeOKWithInfo("", moreResults)
 }
 
-func (c *clientConn) handleRollback(moreResults bool) error {
-	_, err := c.execBackendQuery("ROLLBACK")
-	if err != nil {
-		return err
-	}
+// endTransaction unpins the session after its transaction ended
+func (c *clientConn) endTransaction() {
 	c.status &= ^mysql.StatusInTrans
 	c.inTransaction = false
-	return c.writeOKWithInfo("", moreResults)
 }
 
 func (c *clientConn) handleQuery(query string) error {
@@ -602,28 +1880,197 @@ func (c *clientConn) handleQuery(query string) error {
 	parsed := parser.Parse(query)
 
 	// Split multi-statement queries
-	statements := splitQueries(parsed.Query)
+	statements, err := splitQueries(parsed.Query, c.multiStatements)
+	if err != nil {
+		c.mu.Lock()
+		c.recordHistory(query, start, false, err)
+		c.mu.Unlock()
+		return err
+	}
 	for i, stmt := range statements {
 		moreResults := (i < len(statements)-1)
 		// Process each statement
-		if err := c.handleSingleQuery(stmt, parsed, start, moreResults); err != nil {
+		stmtStart := time.Now()
+		c.lastResultErr = false
+		err := c.handleSingleQuery(stmt, parsed, start, moreResults)
+		if len(statements) == 1 {
+			stmt = query // Record the hint comments too
+		}
+		c.mu.Lock()
+		c.recordHistory(stmt, stmtStart, c.routed, err)
+		c.mu.Unlock()
+		if err != nil {
 			return err
 		}
+		// An error packet ends the response, the following statements are
+		// not executed, as by the server
+		if c.lastResultErr {
+			return nil
+		}
 	}
 	return nil
 }
 
+// recordHistory adds a statement to the query history of the connection,
+// logs it as a request at the debug level, records it in the slow query log
+// when it was slow and in the audit log. Statements that were not routed were
+// answered by the proxy itself. The caller holds c.mu.
+func (c *clientConn) recordHistory(query string, start time.Time, routed bool, err error) {
+	latency := time.Since(start)
+	affected := c.lastAffectedRows
+	c.lastAffectedRows = -1
+	c.recordAudit(query, start, affected, err)
+	slowLog := c.proxy.slowQueryLog()
+	slow := slowLog.Slow(latency)
+	if c.history == nil && !slow && !logging.Requests() {
+		return
+	}
+	e := history.Entry{Time: start, Query: query, Latency: latency, Backend: "proxy"}
+	if routed {
+		e.Backend = c.lastQueryBackend
+	}
+	if err != nil {
+		e.Backend = ""
+		e.Error = err.Error()
+	}
+	c.history.Add(e)
+	if !slow && !logging.Requests() {
+		return
+	}
+	parsed := parser.Parse(query)
+	var shard string
+	var cacheHit bool
+	var batchSize int
+	if routed {
+		shard, cacheHit = c.lastQueryShard, c.lastQueryCacheHit
+		if e.Backend == "write-batch" {
+			batchSize = c.lastBatchSize
+		}
+	}
+	logging.LogRequest(logging.Request{Protocol: "mariadb", ConnID: c.connID, User: c.user, Database: c.db, Backend: e.Backend,
+		Shard: shard, QueryType: queryTypeLabel(parsed.Type), Query: query, Duration: latency, CacheHit: cacheHit, BatchSize: batchSize, Err: err})
+	if slow {
+		entry := slowlog.Entry{Time: start, Protocol: "mariadb", ConnID: c.connID, User: c.user, Database: c.db, Query: query,
+			Latency: latency, Backend: e.Backend, Shard: shard, File: parsed.File, Line: parsed.Line, BatchSize: batchSize, Error: e.Error}
+		if slowLog.Explain() && parsed.Type == parser.QuerySelect && err == nil {
+			entry.Plan = c.explain(parsed.Query)
+		}
+		slowLog.Add(entry)
+	}
+}
+
+// recordAudit records a statement in the audit log when it is audited. The
+// caller holds c.mu.
+func (c *clientConn) recordAudit(query string, start time.Time, affected int64, err error) {
+	auditLog := c.proxy.auditLog()
+	if auditLog == nil {
+		return
+	}
+	parsed := parser.Parse(query)
+	if !auditLog.Wants(parsed.IsWritable() || parsed.IsDDL()) {
+		return
+	}
+	r := audit.Record{Time: start, Protocol: "mariadb", Client: c.clientAddr, User: c.user, Database: c.db,
+		Query: parser.Fingerprint(parsed.Query), AffectedRows: affected}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	auditLog.Record(r)
+}
+
+// explain runs EXPLAIN for a slow SELECT on the backend connection of the
+// session and returns the plan as tab separated rows under a header, or ""
+// when it fails. The caller holds c.mu.
+func (c *clientConn) explain(query string) string {
+	if c.backend == nil {
+		return ""
+	}
+	response, err := c.execReadOn(c.backendAddr, c.backendName, "EXPLAIN "+query, nil)
+	if err != nil {
+		log.Printf("[MariaDB] EXPLAIN of a slow query failed for conn %d: %v", c.connID, err)
+		return ""
+	}
+	plan, err := explainPlan(response)
+	if err != nil {
+		log.Printf("[MariaDB] EXPLAIN of a slow query failed for conn %d: %v", c.connID, err)
+		return ""
+	}
+	return plan
+}
+
+// explainPlan formats the result set of EXPLAIN as tab separated rows under a
+// header with the column names
+func explainPlan(response []byte) (string, error) {
+	packets, err := mariadbproto.SplitPackets(response)
+	if err != nil {
+		return "", err
+	}
+	if len(packets) == 0 {
+		return "", errors.New("empty response")
+	}
+	if mariadbproto.IsErr(packets[0].Payload) {
+		e, err := mariadbproto.ParseErr(packets[0].Payload)
+		if err != nil {
+			return "", err
+		}
+		return "", e
+	}
+	count, _, _ := mariadbproto.ReadLenEncInt(packets[0].Payload)
+	if count == 0 || len(packets) < 1+int(count) {
+		return "", errors.New("no result set")
+	}
+	var lines []string
+	var names []string
+	for _, p := range packets[1 : 1+count] {
+		col, err := mariadbproto.ParseColumn(p.Payload)
+		if err != nil {
+			return "", err
+		}
+		names = append(names, col.Name)
+	}
+	lines = append(lines, strings.Join(names, "\t"))
+	for _, p := range packets[1+count:] {
+		if mariadbproto.IsEOF(p.Payload) {
+			if len(lines) > 1 {
+				break
+			}
+			continue // EOF after the column definitions
+		}
+		row, err := mariadbproto.ParseTextRow(p.Payload, int(count))
+		if err != nil {
+			return "", err
+		}
+		values := make([]string, len(row))
+		for i, v := range row {
+			if v == nil {
+				values[i] = "NULL"
+			} else {
+				values[i] = string(v)
+			}
+		}
+		lines = append(lines, strings.Join(values, "\t"))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.ParsedQuery, start time.Time, moreResults bool) error {
 	// Re-parse the single statement if it's different from the original
 	parsed := originalParsed
 	if query != originalParsed.Query {
 		parsed = parser.Parse(query)
 	}
+	parsed = c.proxy.applyOverrides(parsed)
+
+	// Writes of read-only users never reach the backend
+	if err := c.checkStatement(query); err != nil {
+		return err
+	}
 
 	// Lock the session for the duration of a single statement processing
 	// This prevents background refreshes from interleaving with the main query stream
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.routed = false
 
 	file := parsed.File
 	if file == "" {
@@ -639,14 +2086,26 @@ func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.Pars
 	queryUpper := strings.ToUpper(strings.TrimSpace(parsed.Query))
 	queryUpper = strings.TrimSuffix(queryUpper, ";")
 
-	// Check for FQN-based sharding
-	if parsed.DB != "" && parsed.DB != c.db {
+	// Check for FQN-based sharding, where the database of a replica database
+	// stays on the replica
+	if backendDB, _ := c.proxy.backendDatabase(c.db); parsed.DB != "" && parsed.DB != c.db && parsed.DB != backendDB {
 		if err := c.ensureBackend(parsed.DB); err != nil {
 			return err
 		}
 		c.db = parsed.DB
 	}
 
+	// Statements run on the backend of a route hint or of their tables
+	tableBackend, err := c.route(parsed)
+	if err != nil {
+		return err
+	}
+	// Route hints apply outside of transactions
+	routeBackend := parsed.RouteBackend()
+	if c.pinned() {
+		routeBackend = ""
+	}
+
 	// Check for USE statement
 	if strings.HasPrefix(queryUpper, "USE ") {
 		parts := strings.Fields(parsed.Query)
@@ -657,7 +2116,8 @@ func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.Pars
 			}
 			c.db = dbName
 			// Execute USE on backend
-			_, err := c.execBackendQuery(fmt.Sprintf("USE `%s`", dbName))
+			backendDB, _ := c.proxy.backendDatabase(dbName)
+			_, err := c.execBackendQuery(fmt.Sprintf("USE `%s`", backendDB))
 			if err != nil {
 				return err
 			}
@@ -665,49 +2125,156 @@ func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.Pars
 		}
 	}
 
-	// Check for transaction commands
-	if queryUpper == "BEGIN" || queryUpper == "START TRANSACTION" {
-		return c.handleBegin(moreResults)
+	// Track the character set of the session
+	if collation, ok := parseSetNames(parsed.Query); ok {
+		return c.handleSetNames(parsed.Query, collation, moreResults)
+	}
+
+	// Session variables of the proxy itself (SET tqdb_...)
+	if name, value, ok := parser.ParseProxySet(parsed.Query); ok {
+		if err := c.setProxyVariable(name, value); err != nil {
+			return err
+		}
+		return c.writeOKWithInfo("", moreResults)
+	}
+
+	// Kill switches of the proxy (SET GLOBAL tqdb_...), for admin users
+	if name, value, ok := parser.ParseProxySetGlobal(parsed.Query); ok {
+		if err := c.setKillSwitch(name, value); err != nil {
+			return err
+		}
+		return c.writeOKWithInfo("", moreResults)
+	}
+
+	// Track session variables (sql_mode, time_zone, isolation level, ...)
+	if names, ok := parser.ParseSessionSet(parsed.Query); ok {
+		return c.handleSessionSet(parsed.Query, names, moreResults)
 	}
-	if queryUpper == "COMMIT" {
-		return c.handleCommit(moreResults)
+
+	// Check for transaction commands. Savepoints run in the transaction like
+	// other statements, statements that commit implicitly end it.
+	if tx, ok := parser.ParseTransaction(parsed.Query); ok {
+		switch tx.Op {
+		case parser.TxBegin:
+			return c.handleBegin(parsed.Query, moreResults)
+		case parser.TxCommit, parser.TxRollback:
+			return c.handleEnd(parsed.Query, tx, moreResults)
+		}
 	}
-	if queryUpper == "ROLLBACK" {
-		return c.handleRollback(moreResults)
+	if c.snapshot && parsed.CommitsImplicitly() {
+		return errSnapshotActive
 	}
 
 	// Check for custom SHOW TQDB STATUS command
 	if queryUpper == "SHOW TQDB STATUS" {
 		return c.handleShowTQDBStatus(moreResults)
 	}
+	if queryUpper == "SHOW TQDB HISTORY" {
+		return c.handleShowTQDBHistory(moreResults)
+	}
+	if queryUpper == "SHOW TQDB SLOW QUERIES" {
+		return c.handleShowTQDBSlowQueries(moreResults)
+	}
+
+	// Execute pending write batches without waiting for their batch windows
+	if queryUpper == "FLUSH TQDB BATCHES" {
+		return c.handleFlushBatches(moreResults)
+	}
+
+	// Drop cache entries by key, table or glob
+	if pattern, ok := parser.ParseCachePurge(parsed.Query); ok {
+		return c.handleCachePurge(pattern, moreResults)
+	}
+
+	// KILL of a client connection of the proxy targets its backend connection
+	if id, queryOnly, ok := parseKill(parsed.Query); ok {
+		if target, ok := c.proxy.conns.Load(id); ok {
+			c.routed = true
+			return c.handleKill(target.(*clientConn), queryOnly, moreResults)
+		}
+	}
+
+	// Queries served by the cache or a backend count against the qps budget
+	// and the throttle limits
+	if err := c.proxy.quotas.Allow(c.db); err != nil {
+		return err
+	}
+	release, err := c.proxy.throttle.Acquire(c.clientAddr, c.user, c.shard())
+	if err != nil {
+		return err
+	}
+	defer release()
+	c.routed = true
+
+	// Serve schema metadata queries from the metadata cache (opt-in)
+	isMetadata := c.proxy.metaCache != nil && !c.pinned() && !parsed.IsCacheable() && parsed.Route == "" && parsed.IsMetadata() && c.proxy.enabled(killswitch.Cache)
+	if isMetadata {
+		if cached, ok := c.proxy.metaCache.Get(c.db, parsed.Query); ok {
+			metrics.CacheHits.WithLabelValues(file, lineStr).Inc()
+			metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "true").Inc()
+			metrics.QueryLatency.WithLabelValues(file, lineStr, queryType).Observe(time.Since(start).Seconds())
+			c.lastQueryBackend = "cache (metadata)"
+			c.lastQueryCacheHit = true
+			return c.forwardBackendResponse(cached, moreResults)
+		}
+	}
+
+	// Route batchable writes to the write batch manager of the backend of
+	// their tables (only outside transactions)
+	if !c.pinned() && parsed.IsWritable() && parsed.IsBatchable() && routeBackend == "" && !c.proxy.guardBatch(parsed) {
+		if wb := c.proxy.batchManager(tableBackend); wb != nil {
+			c.proxy.clampBatch(parsed, c.shard())
+			return c.handleBatchedWrite(wb, parsed, start, file, lineStr, queryType, moreResults)
+		}
+	}
 
-	// Route batchable writes to write batch manager (only outside transactions)
-	if c.proxy.writeBatch != nil && !c.inTransaction && parsed.IsWritable() && parsed.IsBatchable() {
-		return c.handleBatchedWrite(parsed.Query, parsed.BatchMs, start, file, lineStr, queryType, moreResults)
+	// Micro-cache SELECTs without a ttl or route hint that repeat at a high
+	// rate. Cache keys include the backend of routed tables, results of
+	// backends named by route hints are not cached.
+	ttl := time.Duration(parsed.TTL) * time.Second
+	if parsed.TTL == 0 && parsed.Route == "" && !isMetadata && !c.pinned() && parsed.IsRepeatable() && c.proxy.enabled(killswitch.Cache) {
+		ttl = c.proxy.booster.Observe(parsed.Query)
+	}
+	negTTL := c.proxy.negativeTTL(parsed)
+	// Transactions (and snapshots) read their own state, not the cache
+	cacheable := parsed.Type == parser.QuerySelect && (ttl > 0 || negTTL > 0) && routeBackend == "" && !c.pinned()
+	var cacheKey string
+	if cacheable {
+		cacheKey = backendKey(tableBackend, c.proxy.cacheKey(parsed.Query))
 	}
 
 	// Check cache with thundering herd protection
-	if parsed.IsCacheable() {
-		cached, flags, ok := c.proxy.cache.Get(parsed.Query)
+	if cacheable {
+		cached, flags, ok := c.proxy.cache.Get(cacheKey)
 		if ok {
 			if flags == cache.FlagFresh {
 				// Fresh cache hit - serve immediately
 				metrics.CacheHits.WithLabelValues(file, lineStr).Inc()
+				c.proxy.cache.Stats().RecordHit(parsed.Query)
 				metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "true").Inc()
 				metrics.QueryLatency.WithLabelValues(file, lineStr, queryType).Observe(time.Since(start).Seconds())
 				c.lastQueryBackend = "cache"
 				c.lastQueryCacheHit = true
-				return c.forwardBackendResponse(cached, moreResults)
+				if err := c.forwardBackendResponse(cached, moreResults); err != nil {
+					return err
+				}
+				c.verifyCacheHit(parsed, tableBackend, cached, "fresh")
+				return nil
 			}
 
 			if flags == cache.FlagStale {
 				// Stale but another request is already refreshing - serve stale
 				metrics.CacheHits.WithLabelValues(file, lineStr).Inc()
+				c.proxy.cache.Stats().RecordHit(parsed.Query)
 				metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "true").Inc()
 				metrics.QueryLatency.WithLabelValues(file, lineStr, queryType).Observe(time.Since(start).Seconds())
 				c.lastQueryBackend = "cache (stale)"
 				c.lastQueryCacheHit = true
-				return c.forwardBackendResponse(cached, moreResults)
+				if err := c.forwardBackendResponse(cached, moreResults); err != nil {
+					return err
+				}
+				c.verifyCacheHit(parsed, tableBackend, cached, "stale")
+				return nil
 			}
 
 			// FlagRefresh: First stale access - this request does the refresh (sync)
@@ -716,10 +2283,11 @@ func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.Pars
 		metrics.CacheMisses.WithLabelValues(file, lineStr).Inc()
 
 		// Cold cache or stale refresh: use single-flight pattern
-		cached, _, ok, waited := c.proxy.cache.GetOrWait(parsed.Query)
+		cached, _, ok, waited := c.proxy.cache.GetOrWait(cacheKey)
 		if waited && ok {
 			// Another goroutine fetched it for us
 			metrics.CacheHits.WithLabelValues(file, lineStr).Inc()
+			c.proxy.cache.Stats().RecordHit(parsed.Query)
 			c.lastQueryBackend = "cache"
 			c.lastQueryCacheHit = true
 			return c.forwardBackendResponse(cached, moreResults)
@@ -727,36 +2295,51 @@ func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.Pars
 		// We need to fetch from DB (either first request or waited but still miss)
 	}
 
-	// Select backend
-	backendAddr := c.backendPool.GetPrimary()
-	backendName := "primary"
-
-	if parsed.IsCacheable() && (c.status&mysql.StatusInTrans == 0) {
-		backendAddr, backendName = c.backendPool.GetReplica()
-	}
-	// Ensure we are connected to the right backend
-	if err := c.ensureBackendConn(backendAddr, backendName, c.backendPool); err != nil {
-		// Cancel inflight if we were the first request
-		if parsed.IsCacheable() {
-			c.proxy.cache.CancelInflight(parsed.Query)
+	var response []byte
+	var spilled *spill.Buffer
+	var backendName string
+	if parsed.IsWritable() {
+		// Writes always go to the primary
+		backendName = "primary"
+		if err = c.ensureBackendConn(c.backendPool.GetPrimary(), backendName, c.backendPool); err == nil {
+			response, err = c.execBackendWrite(c.backendQuery(parsed))
 		}
-		return err
+	} else {
+		response, spilled, backendName, err = c.execRead(parsed)
 	}
-
-	response, err := c.execBackendQuery(parsed.Query)
 	if err != nil {
 		// Cancel inflight if we were the first request
-		if parsed.IsCacheable() {
-			c.proxy.cache.CancelInflight(parsed.Query)
+		if cacheable {
+			c.proxy.cache.CancelInflight(cacheKey)
 		}
 		return err
 	}
+	if spilled != nil {
+		defer spilled.Close()
+	}
 
 	// Check for LOAD DATA LOCAL INFILE response (0xFB)
-	if len(response) >= 5 && response[4] == 0xFB {
+	if isLocalInfile(response) {
 		return c.handleLocalInfile(response, moreResults)
 	}
 
+	// Schema changes make cached metadata stale
+	if parsed.IsDDL() {
+		c.lastWrite = time.Now()
+		c.proxy.invalidateSchema(parsed)
+	}
+	// Stored procedures may write, later reads of the session stay on the
+	// primary as after other writes
+	if parsed.IsCall() {
+		c.lastWrite = time.Now()
+	}
+	if c.pinned() && parsed.CommitsImplicitly() && !isError(response) {
+		c.endTransaction()
+	}
+	if isMetadata && spilled == nil && !isError(response) {
+		c.proxy.metaCache.Set(c.db, parsed.Query, response)
+	}
+
 	metrics.DatabaseQueries.WithLabelValues(backendName).Inc()
 	metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "false").Inc()
 	metrics.QueryLatency.WithLabelValues(file, lineStr, queryType).Observe(time.Since(start).Seconds())
@@ -764,364 +2347,258 @@ func (c *clientConn) handleSingleQuery(query string, originalParsed *parser.Pars
 	// Track metadata for SHOW TQDB STATUS
 	c.lastQueryBackend = backendName
 	c.lastQueryCacheHit = false
-
-	// Cache if cacheable (SELECT queries) - use SetAndNotify for single-flight
-	if parsed.IsCacheable() {
-		c.proxy.cache.SetAndNotify(parsed.Query, response, time.Duration(parsed.TTL)*time.Second)
+	if spilled == nil {
+		c.lastAffectedRows = affectedRows(response)
+	}
+
+	// Cache if cacheable (SELECT queries) - use SetAndNotify for single-flight.
+	// Spilled responses are too large to cache, see cacheTTL for empty
+	// results and errors.
+	var storeTTL time.Duration
+	if cacheable && spilled == nil {
+		storeTTL = cacheTTL(response, ttl, negTTL)
+	}
+	if storeTTL > 0 {
+		c.proxy.cache.SetAndNotifyFor(c.proxy.quotas, c.db, cacheKey, response, storeTTL)
+		c.proxy.cache.Track(cacheKey, parsed.Tables)
+		c.proxy.cache.Stats().RecordMiss(parsed.Query, time.Since(start))
+		// Results of ttl hints may be refreshed in the background, not
+		// micro-cached results
+		if parsed.TTL > 0 {
+			c.proxy.cache.SetRefresh(cacheKey, c.refreshFunc(parsed, ttl, negTTL))
+		}
+	} else if cacheable {
+		c.proxy.cache.CancelInflight(cacheKey)
 	}
 
 	// Forward the response to client, adjusting sequence numbers
+	if spilled != nil {
+		return c.forwardSpilled(spilled, moreResults)
+	}
 	return c.forwardBackendResponse(response, moreResults)
 }
 
-func (c *clientConn) handlePrepare(query string) error {
-	// 1. Forward COM_STMT_PREPARE to backend
-	payload := make([]byte, 1+len(query))
-	payload[0] = mysql.ComStmtPrepare
-	copy(payload[1:], query)
+// preparedStatement is a statement prepared by the client. The client knows
+// it by an ID of the proxy, as it is prepared again under another ID when the
+// session moves to another backend connection, see backendStatementID.
+type preparedStatement struct {
+	parsed    *parser.ParsedQuery
+	params    uint16
+	types     []byte   // Parameter types of the last execution that sent them
+	bound     bool     // The types were sent for the statement on backend
+	backend   net.Conn // Backend connection the statement is prepared on
+	backendID uint32   // ID of the statement on backend
+	version   uint64   // Schema version the statement was prepared at, see cache.Schema
+}
 
-	c.backendSeq = 255
-	if err := c.writeBackendPacket(payload); err != nil {
+func (c *clientConn) handlePrepare(query string) error {
+	if err := c.checkStatement(query); err != nil {
 		return err
 	}
-
-	// 2. Read STMT_PREPARE_OK response
-	response, err := c.readBackendPacket()
-	if err != nil {
+	// Statements are prepared on the backend of their tables
+	if _, err := c.route(parser.Parse(query)); err != nil {
 		return err
 	}
-
-	// Read and forward the full response chain
-	var fullResponse []byte
-	header := make([]byte, 4)
-	binary.LittleEndian.PutUint32(header[0:4], uint32(len(response)))
-	header[3] = c.backendSeq
-	fullResponse = append(fullResponse, header...)
-	fullResponse = append(fullResponse, response...)
-
-	if len(response) > 0 && response[0] == 0x00 { // OK
-		stmtID := binary.LittleEndian.Uint32(response[1:5])
-		numCols := binary.LittleEndian.Uint16(response[5:7])
-		numParams := binary.LittleEndian.Uint16(response[7:9])
-
-		// Store parsed query with batch hints
-		c.preparedStatements[stmtID] = parser.Parse(query)
-
-		// Read parameters if any
-		if numParams > 0 {
-			for i := uint16(0); i < numParams; i++ {
-				p, err := c.readBackendPacket()
-				if err != nil {
-					return err
-				}
-				binary.LittleEndian.PutUint32(header[0:4], uint32(len(p)))
-				header[3] = c.backendSeq
-				fullResponse = append(fullResponse, header...)
-				fullResponse = append(fullResponse, p...)
-			}
-			// EOF after parameters
-			eof, err := c.readBackendPacket()
-			if err != nil {
-				return err
-			}
-			binary.LittleEndian.PutUint32(header[0:4], uint32(len(eof)))
-			header[3] = c.backendSeq
-			fullResponse = append(fullResponse, header...)
-			fullResponse = append(fullResponse, eof...)
+	if c.backend == nil {
+		if err := c.ensureBackend(c.db); err != nil {
+			return err
 		}
+	}
 
-		// Read columns if any
-		if numCols > 0 {
-			for i := uint16(0); i < numCols; i++ {
-				p, err := c.readBackendPacket()
-				if err != nil {
-					return err
-				}
-				binary.LittleEndian.PutUint32(header[0:4], uint32(len(p)))
-				header[3] = c.backendSeq
-				fullResponse = append(fullResponse, header...)
-				fullResponse = append(fullResponse, p...)
-			}
-			// EOF after columns
-			eof, err := c.readBackendPacket()
-			if err != nil {
-				return err
-			}
-			binary.LittleEndian.PutUint32(header[0:4], uint32(len(eof)))
-			header[3] = c.backendSeq
-			fullResponse = append(fullResponse, header...)
-			fullResponse = append(fullResponse, eof...)
+	version := c.proxy.schema.Version()
+	response, ok, err := c.prepareOnBackend(query)
+	if err != nil {
+		return err
+	}
+	if ok != nil {
+		// Store parsed query with batch hints, under an ID of the proxy
+		c.lastStmtID++
+		c.preparedStatements[c.lastStmtID] = &preparedStatement{
+			parsed:    parser.Parse(query),
+			params:    ok.Params,
+			backend:   c.backend,
+			backendID: ok.StatementID,
+			version:   version,
 		}
+		binary.LittleEndian.PutUint32(response[5:], c.lastStmtID)
 	}
-
-	return c.forwardBackendResponse(fullResponse, false)
+	return c.forwardBackendResponse(response, false)
 }
 
-func (c *clientConn) execQueryOnConn(conn net.Conn, query string) ([]byte, error) {
-	// Build COM_QUERY packet
-	payload := make([]byte, 1+len(query))
-	payload[0] = mysql.ComQuery
-	copy(payload[1:], query)
-
-	// Send packet
-	seq := byte(0)
-	packet := make([]byte, 4+len(payload))
-	binary.LittleEndian.PutUint32(packet[0:4], uint32(len(payload)))
-	packet[3] = seq
-	copy(packet[4:], payload)
-	conn.SetWriteDeadline(time.Now().Add(backendTimeout))
-	if _, err := conn.Write(packet); err != nil {
-		return nil, err
+// prepareOnBackend forwards a COM_STMT_PREPARE to the backend and reads the
+// response. ok is nil when the backend returned an error packet.
+func (c *clientConn) prepareOnBackend(query string) (response []byte, ok *mariadbproto.StmtPrepareOK, err error) {
+	c.backendSeq = 255
+	if err := c.writeBackendPacket(mariadbproto.Command(mariadbproto.ComStmtPrepare, []byte(c.annotate(query)))); err != nil {
+		return nil, nil, err
+	}
+	payload, err := c.readBackendPacket()
+	if err != nil {
+		return nil, nil, err
+	}
+	response = mariadbproto.AppendPacket(nil, c.backendSeq, payload)
+	prepared, err := mariadbproto.ParseStmtPrepareOK(payload)
+	if err != nil {
+		return response, nil, nil
 	}
-	conn.SetWriteDeadline(time.Time{})
-
-	// Read response using a temporary sequence tracker
-	var response []byte
-	eofCount := 0
-	for {
-		header := make([]byte, 4)
-		conn.SetReadDeadline(time.Now().Add(backendTimeout))
-		if _, err := io.ReadFull(conn, header); err != nil {
-			return nil, err
-		}
-		length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
 
-		packetPayload := make([]byte, length)
-		if _, err := io.ReadFull(conn, packetPayload); err != nil {
-			return nil, err
+	// Read parameter and column definitions, each followed by an EOF
+	for _, n := range []uint16{prepared.Params, prepared.Columns} {
+		if n == 0 {
+			continue
 		}
-		conn.SetReadDeadline(time.Time{})
-
-		// Build result
-		response = append(response, header...)
-		response = append(response, packetPayload...)
-
-		if len(packetPayload) > 0 {
-			switch packetPayload[0] {
-			case 0x00, 0xFE, 0xFF:
-				// Simplified end detection for background refresh (usually SELECTs)
-				if packetPayload[0] == 0xFF {
-					return response, nil
-				}
-				if packetPayload[0] == 0x00 || (packetPayload[0] == 0xFE && len(packetPayload) < 9) {
-					// Check for more results or EOF count
-					if packetPayload[0] == 0xFE {
-						eofCount++
-						if eofCount >= 2 {
-							return response, nil
-						}
-					} else {
-						return response, nil
-					}
-				}
+		for i := uint16(0); i <= n; i++ {
+			p, err := c.readBackendPacket()
+			if err != nil {
+				return nil, nil, err
 			}
+			response = mariadbproto.AppendPacket(response, c.backendSeq, p)
 		}
 	}
+	return response, &prepared, nil
 }
 
-// decodeStmtParams decodes parameters from a COM_STMT_EXECUTE packet
-// The data format is:
-// [0:4]   statement ID
-// [4]     flags
-// [5:9]   iteration-count (always 1)
-// [9:]    null-bitmap (ceil(num_params / 8) bytes)
-// [9+N]   new_params_bound_flag (1 byte)
-// [...]   if new_params_bound_flag: parameter types (2 bytes each)
-// [...]   parameter values
-func (c *clientConn) decodeStmtParams(data []byte, parsed *parser.ParsedQuery) ([]interface{}, error) {
-	if len(data) < 10 {
-		return nil, fmt.Errorf("packet too short")
+// statement returns the prepared statement of the client ID at the start of
+// a COM_STMT_* packet
+func (c *clientConn) statement(data []byte) (*preparedStatement, error) {
+	if len(data) < 4 {
+		return nil, mariadbproto.ErrShortPacket
 	}
-
-	// Count the number of parameters by counting placeholders in the query
-	numParams := strings.Count(parsed.Query, "?")
-	if numParams == 0 {
-		return []interface{}{}, nil
+	stmtID := binary.LittleEndian.Uint32(data[0:4])
+	stmt, ok := c.preparedStatements[stmtID]
+	if !ok {
+		return nil, fmt.Errorf("unknown statement ID %d", stmtID)
 	}
+	return stmt, nil
+}
 
-	// Calculate null bitmap size
-	nullBitmapLen := (numParams + 7) / 8
-	if len(data) < 10+nullBitmapLen {
-		return nil, fmt.Errorf("packet too short for null bitmap")
+// backendStatementID returns the ID of the statement on the backend
+// connection. A statement prepared on another connection, lost by a switch to
+// another shard or replica or by a reconnect, is prepared again, as is a
+// statement on tables that a DDL statement changed since it was prepared. A
+// statement that gets another number of parameters fails with
+// ER_NEED_REPREPARE, the client prepares it again.
+func (c *clientConn) backendStatementID(stmt *preparedStatement) (uint32, error) {
+	if c.backend == nil {
+		if err := c.ensureBackend(c.db); err != nil {
+			return 0, err
+		}
 	}
-
-	nullBitmap := data[9 : 9+nullBitmapLen]
-	pos := 9 + nullBitmapLen
-
-	if pos >= len(data) {
-		return nil, fmt.Errorf("packet too short for new_params_bound_flag")
+	stale := c.proxy.schema.Changed(stmt.parsed.Tables, stmt.version)
+	if stmt.backend == c.backend && !stale {
+		return stmt.backendID, nil
 	}
-
-	newParamsBound := data[pos]
-	pos++
-
-	var paramTypes []byte
-	if newParamsBound == 1 {
-		// Read parameter types (2 bytes per parameter)
-		typesLen := numParams * 2
-		if pos+typesLen > len(data) {
-			return nil, fmt.Errorf("packet too short for parameter types")
+	if stmt.backend == c.backend {
+		// COM_STMT_CLOSE has no response
+		c.backendSeq = 255
+		if err := c.writeBackendPacket(mariadbproto.Command(mariadbproto.ComStmtClose, withStmtID(make([]byte, 4), stmt.backendID))); err != nil {
+			return 0, err
 		}
-		paramTypes = data[pos : pos+typesLen]
-		pos += typesLen
+		stmt.backend = nil
 	}
-
-	// Decode parameter values
-	params := make([]interface{}, numParams)
-	for i := 0; i < numParams; i++ {
-		// Check if parameter is NULL
-		bytePos := i / 8
-		bitPos := uint(i % 8)
-		if nullBitmap[bytePos]&(1<<bitPos) != 0 {
-			params[i] = nil
-			continue
-		}
-
-		// Determine parameter type
-		var fieldType byte
-		var unsigned bool
-		if newParamsBound == 1 {
-			fieldType = paramTypes[i*2]
-			unsigned = paramTypes[i*2+1] == 0x80
-		} else {
-			// If types weren't sent, we can't decode properly
-			// This is a limitation - in practice, types are usually sent on first execute
-			return nil, fmt.Errorf("cannot decode parameters without type information")
-		}
-
-		// Decode based on type
-		var err error
-		params[i], pos, err = c.decodeParamValue(data, pos, fieldType, unsigned)
+	version := c.proxy.schema.Version()
+	response, ok, err := c.prepareOnBackend(stmt.parsed.Raw)
+	if err != nil {
+		return 0, err
+	}
+	if ok == nil {
+		e, err := mariadbproto.ParseErr(response[4:])
 		if err != nil {
-			return nil, fmt.Errorf("failed to decode param %d: %v", i, err)
+			return 0, err
 		}
+		return 0, e
 	}
-
-	return params, nil
+	log.Printf("[MariaDB] Prepared statement again on %s (%s) for conn %d", c.backendName, c.backendAddr, c.connID)
+	stmt.backend, stmt.backendID, stmt.bound = c.backend, ok.StatementID, false
+	if stale && ok.Params != stmt.params {
+		return 0, mariadbproto.Err{Code: mariadbproto.ErNeedReprepare, State: mariadbproto.StateGeneralError, Message: "Prepared statement needs to be re-prepared"}
+	}
+	stmt.version = version
+	return ok.StatementID, nil
 }
 
-// decodeParamValue decodes a single parameter value
-func (c *clientConn) decodeParamValue(data []byte, pos int, fieldType byte, unsigned bool) (interface{}, int, error) {
-	const (
-		MYSQL_TYPE_TINY       = 0x01
-		MYSQL_TYPE_SHORT      = 0x02
-		MYSQL_TYPE_LONG       = 0x03
-		MYSQL_TYPE_LONGLONG   = 0x08
-		MYSQL_TYPE_STRING     = 0xfe
-		MYSQL_TYPE_VAR_STRING = 0xfd
-	)
-
-	switch fieldType {
-	case MYSQL_TYPE_TINY:
-		if pos+1 > len(data) {
-			return nil, pos, fmt.Errorf("not enough data for TINY")
-		}
-		if unsigned {
-			return uint64(data[pos]), pos + 1, nil
-		}
-		return int64(int8(data[pos])), pos + 1, nil
-
-	case MYSQL_TYPE_SHORT:
-		if pos+2 > len(data) {
-			return nil, pos, fmt.Errorf("not enough data for SHORT")
-		}
-		val := binary.LittleEndian.Uint16(data[pos : pos+2])
-		if unsigned {
-			return uint64(val), pos + 2, nil
-		}
-		return int64(int16(val)), pos + 2, nil
-
-	case MYSQL_TYPE_LONG:
-		if pos+4 > len(data) {
-			return nil, pos, fmt.Errorf("not enough data for LONG")
-		}
-		val := binary.LittleEndian.Uint32(data[pos : pos+4])
-		if unsigned {
-			return uint64(val), pos + 4, nil
-		}
-		return int64(int32(val)), pos + 4, nil
-
-	case MYSQL_TYPE_LONGLONG:
-		if pos+8 > len(data) {
-			return nil, pos, fmt.Errorf("not enough data for LONGLONG")
-		}
-		val := binary.LittleEndian.Uint64(data[pos : pos+8])
-		if unsigned {
-			return uint64(val), pos + 8, nil
-		}
-		return int64(val), pos + 8, nil
-
-	case MYSQL_TYPE_STRING, MYSQL_TYPE_VAR_STRING:
-		// Length-encoded string
-		strLen, n := c.decodeLengthEncodedInt(data[pos:])
-		if n == 0 {
-			return nil, pos, fmt.Errorf("failed to decode string length")
-		}
-		pos += n
-		if pos+int(strLen) > len(data) {
-			return nil, pos, fmt.Errorf("not enough data for string")
-		}
-		return string(data[pos : pos+int(strLen)]), pos + int(strLen), nil
+// executePacket returns the COM_STMT_EXECUTE data of the client for the
+// statement on its backend connection. The first execution after the
+// statement was prepared again gets the parameter types the client sent
+// before, as the client does not send them again.
+func (s *preparedStatement) executePacket(data []byte) []byte {
+	out := slices.Clone(data)
+	binary.LittleEndian.PutUint32(out, s.backendID)
+	pos := 9 + (int(s.params)+7)/8 // Position of new_params_bound_flag
+	if s.params == 0 || len(data) <= pos {
+		return out
+	}
+	if data[pos] == 1 {
+		s.types = slices.Clone(data[pos+1 : min(len(data), pos+1+2*int(s.params))])
+		s.bound = true
+		return out
+	}
+	if !s.bound && s.types != nil {
+		out = slices.Concat(out[:pos], []byte{1}, s.types, out[pos+1:])
+		s.bound = true
+	}
+	return out
+}
 
-	default:
-		return nil, pos, fmt.Errorf("unsupported field type: 0x%02x", fieldType)
+// invalidateSchema drops cached results, including cached prepared statement
+// results, of the tables changed by a DDL statement, as well as all cached
+// schema metadata, and marks the prepared statements on the tables of all
+// sessions to be prepared again, see backendStatementID
+func (p *Proxy) invalidateSchema(parsed *parser.ParsedQuery) {
+	p.schema.Change(parsed.Tables)
+	p.metaCache.Invalidate()
+	if n := p.cache.InvalidateTables(parsed.Tables); n > 0 {
+		metrics.CacheDDLInvalidations.Add(float64(n))
+		log.Printf("[MariaDB] DDL on %v invalidated %d cached results", parsed.Tables, n)
 	}
 }
 
-// decodeLengthEncodedInt decodes a length-encoded integer and returns the value and number of bytes read
-func (c *clientConn) decodeLengthEncodedInt(data []byte) (uint64, int) {
-	if len(data) == 0 {
-		return 0, 0
+func (c *clientConn) handleExecute(data []byte) (err error) {
+	start := time.Now()
+	stmt, err := c.statement(data)
+	if err != nil {
+		return err
 	}
-
-	switch data[0] {
-	case 0xfb:
-		return 0, 1 // NULL
-	case 0xfc:
-		if len(data) < 3 {
-			return 0, 0
-		}
-		return uint64(data[1]) | uint64(data[2])<<8, 3
-	case 0xfd:
-		if len(data) < 4 {
-			return 0, 0
-		}
-		return uint64(data[1]) | uint64(data[2])<<8 | uint64(data[3])<<16, 4
-	case 0xfe:
-		if len(data) < 9 {
-			return 0, 0
-		}
-		return binary.LittleEndian.Uint64(data[1:9]), 9
-	default:
-		return uint64(data[0]), 1
+	parsed := stmt.parsed
+	defer func(query string) { c.recordHistory(query, start, true, err) }(parsed.Raw)
+	parsed = c.proxy.applyOverrides(parsed)
+	tableBackend, err := c.route(parsed)
+	if err != nil {
+		return err
 	}
-}
-
-func (c *clientConn) handleExecute(data []byte) error {
-	if len(data) < 4 {
-		return fmt.Errorf("malformed COM_STMT_EXECUTE packet")
+	routeBackend := parsed.RouteBackend()
+	if c.pinned() {
+		routeBackend = ""
 	}
-	stmtID := binary.LittleEndian.Uint32(data[0:4])
-	parsed, ok := c.preparedStatements[stmtID]
-	if !ok {
-		return fmt.Errorf("unknown statement ID %d", stmtID)
+	if err := c.proxy.quotas.Allow(c.db); err != nil {
+		return err
+	}
+	release, err := c.proxy.throttle.Acquire(c.clientAddr, c.user, c.shard())
+	if err != nil {
+		return err
 	}
+	defer release()
 
 	// Check if this prepared statement should be batched
 	// Only batch writes outside of transactions
-	if c.proxy.writeBatch != nil && !c.inTransaction && parsed.IsWritable() && parsed.IsBatchable() {
-		// Decode parameters from the binary format
-		params, err := c.decodeStmtParams(data, parsed)
+	wb := c.proxy.batchManager(tableBackend)
+	if wb != nil && !c.pinned() && parsed.IsWritable() && parsed.IsBatchable() && routeBackend == "" && !c.proxy.guardBatch(parsed) {
+		// Decode parameters from the binary format, with the types of an
+		// earlier execution when the client did not send them again
+		params, types, err := mariadbproto.ParseStmtExecuteParams(data, int(stmt.params), stmt.types)
 		if err != nil {
 			log.Printf("[MariaDB] Failed to decode prepared statement parameters: %v, falling back to direct execution", err)
 			// Fall back to direct execution
 		} else {
-			return c.handleBatchedPreparedExecute(stmtID, data, parsed, params)
+			stmt.types = types
+			return c.handleBatchedPreparedExecute(wb, stmt, data, parsed, params)
 		}
 	}
 
+	// The rows of a cursor stay on the backend connection until fetched
+	cursor := len(data) > 4 && data[4]&mariadbproto.CursorTypeReadOnly != 0
 	var cacheKey string
-	if parsed.IsCacheable() {
+	if parsed.IsCacheable() && !c.pinned() && routeBackend == "" && !cursor {
 		// Form a cache key from query, parameters and current database
 		// We use the stripped query to be consistent with COM_QUERY caching.
 		// We hash the parameters and flags (data[4:]) but NOT the stmtID (data[0:4])
@@ -1130,292 +2607,168 @@ func (c *clientConn) handleExecute(data []byte) error {
 		h.Write([]byte(c.db))
 		h.Write([]byte(parsed.Query))
 		h.Write(data[4:])
-		cacheKey = "ps:" + hex.EncodeToString(h.Sum(nil))
+		cacheKey = backendKey(tableBackend, "ps:"+hex.EncodeToString(h.Sum(nil)))
 
 		// Check cache
 		cached, _, ok := c.proxy.cache.Get(cacheKey)
 		if ok {
+			c.proxy.cache.Stats().RecordHit(parsed.Query)
 			c.lastQueryBackend = "cache"
 			c.lastQueryCacheHit = true
 			return c.forwardBackendResponse(cached, false)
 		}
 	}
 
+	// Writes that are not batched count against the immediate write limit
+	if parsed.IsWritable() {
+		release, err := c.acquireWriteSlot()
+		if err != nil {
+			return err
+		}
+		defer release()
+		c.lastWrite = time.Now()
+	}
+	if parsed.IsCall() {
+		c.lastWrite = time.Now()
+	}
+
 	// Forward COM_STMT_EXECUTE to backend
-	payload := make([]byte, 1+len(data))
-	payload[0] = mysql.ComStmtExecute
-	copy(payload[1:], data)
-
-	c.backendSeq = 255
-	if err := c.writeBackendPacket(payload); err != nil {
+	if err := c.executeOnBackend(stmt, data); err != nil {
 		return err
 	}
 
-	response, err := c.execBackendResponse()
+	response, err := c.readBackendResponse()
 	if err != nil {
 		return err
 	}
 
 	// Check for LOAD DATA LOCAL INFILE response (0xFB)
-	if len(response) >= 5 && response[4] == 0xFB {
+	if isLocalInfile(response) {
 		return c.handleLocalInfile(response, false)
 	}
 
-	// Don't cache error responses
-	isError := len(response) >= 5 && response[4] == 0xFF
-	if cacheKey != "" && !isError {
-		c.proxy.cache.Set(cacheKey, response, time.Duration(parsed.TTL)*time.Second)
+	// Don't cache error responses, except deterministic errors with a
+	// negative ttl
+	var ttl time.Duration
+	if cacheKey != "" {
+		ttl = cacheTTL(response, time.Duration(parsed.TTL)*time.Second, c.proxy.negativeTTL(parsed))
+	}
+	if ttl > 0 {
+		c.proxy.cache.SetFor(c.proxy.quotas, c.db, cacheKey, response, ttl)
+		c.proxy.cache.Track(cacheKey, parsed.Tables)
+		c.proxy.cache.Stats().RecordMiss(parsed.Query, time.Since(start))
 	}
 
 	c.lastQueryBackend = c.backendName
 	c.lastQueryCacheHit = false
+	c.lastAffectedRows = affectedRows(response)
 	return c.forwardBackendResponse(response, false)
 }
 
-func (c *clientConn) handleStmtClose(data []byte) error {
-	if len(data) >= 4 {
-		stmtID := binary.LittleEndian.Uint32(data[0:4])
-		delete(c.preparedStatements, stmtID)
+// executeOnBackend forwards a COM_STMT_EXECUTE of the client to the backend,
+// see backendStatementID
+func (c *clientConn) executeOnBackend(stmt *preparedStatement, data []byte) error {
+	if _, err := c.backendStatementID(stmt); err != nil {
+		return err
 	}
+	c.backendSeq = 255
+	return c.writeBackendPacket(mariadbproto.Command(mariadbproto.ComStmtExecute, stmt.executePacket(data)))
+}
 
-	payload := make([]byte, 1+len(data))
-	payload[0] = mysql.ComStmtClose
-	copy(payload[1:], data)
+// handleStmtClose closes a statement, on the backend connection only when it
+// is prepared there. COM_STMT_CLOSE has no response.
+func (c *clientConn) handleStmtClose(data []byte) error {
+	stmt, err := c.statement(data)
+	if err != nil {
+		return nil
+	}
+	delete(c.preparedStatements, binary.LittleEndian.Uint32(data[0:4]))
+	if stmt.backend != c.backend {
+		return nil
+	}
 
 	c.backendSeq = 255
-	return c.writeBackendPacket(payload)
+	return c.writeBackendPacket(mariadbproto.Command(mariadbproto.ComStmtClose, withStmtID(data, stmt.backendID)))
 }
 
-func (c *clientConn) handleStmtReset(data []byte) error {
-	payload := make([]byte, 1+len(data))
-	payload[0] = mysql.ComStmtReset
-	copy(payload[1:], data)
+// withStmtID returns a copy of the data of a COM_STMT_* packet with the ID of
+// the statement on the backend
+func withStmtID(data []byte, stmtID uint32) []byte {
+	out := slices.Clone(data)
+	binary.LittleEndian.PutUint32(out, stmtID)
+	return out
+}
 
+// handleStmtFetch fetches rows of the cursor of a prepared statement, which
+// the backend connection opened for COM_STMT_EXECUTE
+func (c *clientConn) handleStmtFetch(data []byte) error {
+	stmt, err := c.statement(data)
+	if err != nil {
+		return err
+	}
+	if stmt.backend != c.backend {
+		return fmt.Errorf("the cursor of statement %d was lost with its backend connection", binary.LittleEndian.Uint32(data))
+	}
 	c.backendSeq = 255
-	if err := c.writeBackendPacket(payload); err != nil {
+	if err := c.writeBackendPacket(mariadbproto.Command(mariadbproto.ComStmtFetch, withStmtID(data, stmt.backendID))); err != nil {
 		return err
 	}
-
-	response, err := c.readBackendPacket()
+	var tracker mariadbproto.ResponseTracker
+	tracker.Rows()
+	response, err := c.readBackendPackets(tracker)
 	if err != nil {
 		return err
 	}
 	return c.forwardBackendResponse(response, false)
 }
 
-func (c *clientConn) execBackendResponse() ([]byte, error) {
-	// This is similar to execBackendQuery but without sending the command
-	var response []byte
-	eofCount := 0
-	packetCount := 0
-	for {
-		packet, err := c.readBackendPacket()
-		if err != nil {
-			return nil, err
-		}
-		packetCount++
-
-		header := make([]byte, 4)
-		binary.LittleEndian.PutUint32(header[0:4], uint32(len(packet)))
-		header[3] = c.backendSeq
-		response = append(response, header...)
-		response = append(response, packet...)
-
-		if len(packet) > 0 {
-			headerByte := packet[0]
-			switch headerByte {
-			case 0x00: // OK or Binary Row
-				if eofCount == 1 {
-					// After first EOF, 0x00 is a Binary Data Row, not an OK packet.
-					// Keep reading until we see the final EOF/OK.
-					continue
-				}
-				// Otherwise, treat as OK packet
-				statusOffset := 1
-				_, _, n1 := mysql.ReadLengthEncodedInteger(packet[statusOffset:])
-				statusOffset += n1
-				_, _, n2 := mysql.ReadLengthEncodedInteger(packet[statusOffset:])
-				statusOffset += n2
-				if len(packet) >= statusOffset+2 {
-					status := binary.LittleEndian.Uint16(packet[statusOffset:])
-					if status&uint16(mysql.StatusMoreResultsExists) == 0 {
-						return response, nil
-					}
-					eofCount = 0
-					continue
-				}
-				return response, nil
-			case 0xFF: // Error
-				return response, nil
-			case 0xFB: // Local Infile Request
-				if packetCount == 1 {
-					return response, nil // Immediately return on 0xFB as first packet
-				}
-				// Otherwise it's a NULL value in a Row Data packet, continue reading
-			case 0xFE: // EOF
-				if len(packet) < 9 {
-					eofCount++
-					if eofCount >= 2 {
-						// Checked for more results in EOF as well
-						if len(packet) >= 5 {
-							status := binary.LittleEndian.Uint16(packet[3:])
-							if status&uint16(mysql.StatusMoreResultsExists) == 0 {
-								return response, nil
-							}
-							eofCount = 0
-							continue
-						}
-						return response, nil
-					}
-				}
-			}
-		}
-	}
-}
-
-func (c *clientConn) buildResultSet(rows *sql.Rows) ([]byte, error) {
-	columns, err := rows.Columns()
+func (c *clientConn) handleStmtReset(data []byte) error {
+	stmt, err := c.statement(data)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	var result []byte
-
-	// Column count packet
-	colCount := len(columns)
-	packet := make([]byte, 4)
-	packet = append(packet, mysql.AppendLengthEncodedInteger(nil, uint64(colCount))...)
-	binary.LittleEndian.PutUint32(packet[0:4], uint32(len(packet)-4))
-	c.sequence++
-	packet[3] = c.sequence
-	result = append(result, packet...)
-
-	// Column definition packets (simplified - just send column names)
-	for _, col := range columns {
-		packet = make([]byte, 4)
-		packet = append(packet, 0x03, 'd', 'e', 'f') // catalog
-		packet = append(packet, 0)                   // database
-		packet = append(packet, 0)                   // table
-		packet = append(packet, 0)                   // org_table
-		packet = append(packet, mysql.AppendLengthEncodedInteger(nil, uint64(len(col)))...)
-		packet = append(packet, []byte(col)...)
-		packet = append(packet, 0)                      // org_name
-		packet = append(packet, 0x0c)                   // length of fixed fields
-		packet = append(packet, 0x21, 0x00)             // character set
-		packet = append(packet, 0xff, 0xff, 0xff, 0xff) // column length
-		packet = append(packet, 0xfd)                   // type: VAR_STRING
-		packet = append(packet, 0x00, 0x00)             // flags
-		packet = append(packet, 0x00)                   // decimals
-		packet = append(packet, 0x00, 0x00)             // filler
-
-		binary.LittleEndian.PutUint32(packet[0:4], uint32(len(packet)-4))
-		c.sequence++
-		packet[3] = c.sequence
-		result = append(result, packet...)
+	stmtID, err := c.backendStatementID(stmt)
+	if err != nil {
+		return err
 	}
-
-	// EOF packet after columns
-	c.sequence++
-	eofPacket := mysql.WriteEOFPacket(c.status, c.capability)
-	eofPacket[3] = c.sequence
-	result = append(result, eofPacket...)
-
-	// Row data packets
-	values := make([]interface{}, colCount)
-	valuePtrs := make([]interface{}, colCount)
-	for i := range values {
-		valuePtrs[i] = &values[i]
+	c.backendSeq = 255
+	if err := c.writeBackendPacket(mariadbproto.Command(mariadbproto.ComStmtReset, withStmtID(data, stmtID))); err != nil {
+		return err
 	}
 
-	for rows.Next() {
-		if err := rows.Scan(valuePtrs...); err != nil {
-			return nil, err
-		}
-
-		packet = make([]byte, 4)
-		for _, val := range values {
-			if val == nil {
-				packet = append(packet, 0xfb) // NULL
-			} else {
-				var str string
-				// Convert byte arrays to strings
-				switch v := val.(type) {
-				case []byte:
-					str = string(v)
-				default:
-					str = fmt.Sprintf("%v", v)
-				}
-				packet = append(packet, mysql.AppendLengthEncodedInteger(nil, uint64(len(str)))...)
-				packet = append(packet, []byte(str)...)
-			}
-		}
-
-		binary.LittleEndian.PutUint32(packet[0:4], uint32(len(packet)-4))
-		c.sequence++
-		packet[3] = c.sequence
-		result = append(result, packet...)
+	response, err := c.readBackendPacket()
+	if err != nil {
+		return err
 	}
-
-	// EOF packet after rows
-	c.sequence++
-	eofPacket = mysql.WriteEOFPacket(c.status, c.capability)
-	eofPacket[3] = c.sequence
-	result = append(result, eofPacket...)
-
-	return result, nil
+	return c.forwardBackendResponse(mariadbproto.AppendPacket(nil, c.backendSeq, response), false)
 }
 
 func (c *clientConn) readPacket() ([]byte, error) {
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(c.conn, header); err != nil {
-		return nil, err
-	}
-
-	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
 	// Read the client's sequence number and use it as base for our response
-	clientSeq := header[3]
-	c.sequence = clientSeq
-
-	payload := make([]byte, length)
-	if _, err := io.ReadFull(c.conn, payload); err != nil {
+	payload, seq, err := mariadbproto.ReadPacket(c.conn)
+	if err != nil {
 		return nil, err
 	}
-
+	c.sequence = seq
 	return payload, nil
 }
 
 func (c *clientConn) readBackendPacket() ([]byte, error) {
-	header := make([]byte, 4)
 	c.backend.SetReadDeadline(time.Now().Add(backendTimeout))
-	if _, err := io.ReadFull(c.backend, header); err != nil {
-		c.backend.SetReadDeadline(time.Time{})
-		c.resetBackend()
-		return nil, err
-	}
-
-	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
-	c.backendSeq = header[3]
-
-	payload := make([]byte, length)
-	if _, err := io.ReadFull(c.backend, payload); err != nil {
-		c.backend.SetReadDeadline(time.Time{})
+	payload, seq, err := mariadbproto.ReadPacket(c.backend)
+	c.backend.SetReadDeadline(time.Time{})
+	if err != nil {
 		c.resetBackend()
 		return nil, err
 	}
-
-	c.backend.SetReadDeadline(time.Time{})
+	c.backendSeq = seq
 	return payload, nil
 }
 
 func (c *clientConn) writeBackendPacket(payload []byte) error {
 	c.backendSeq++
-	packet := make([]byte, 4+len(payload))
-	binary.LittleEndian.PutUint32(packet[0:4], uint32(len(payload)))
-	packet[3] = c.backendSeq
-	copy(packet[4:], payload)
-
 	c.backend.SetWriteDeadline(time.Now().Add(backendTimeout))
-	_, err := c.backend.Write(packet)
+	err := mariadbproto.WritePacket(c.backend, c.backendSeq, payload)
 	c.backend.SetWriteDeadline(time.Time{})
 	if err != nil {
 		c.resetBackend()
@@ -1426,209 +2779,335 @@ func (c *clientConn) writeBackendPacket(payload []byte) error {
 func (c *clientConn) forwardClientAuth() error {
 	// Forward the original client auth packet directly to backend
 	c.backendSeq++
-	packet := make([]byte, 4+len(c.rawAuthPkt))
-	binary.LittleEndian.PutUint32(packet[0:4], uint32(len(c.rawAuthPkt)))
-	packet[3] = c.backendSeq
-	copy(packet[4:], c.rawAuthPkt)
-	_, err := c.backend.Write(packet)
-	return err
+	return mariadbproto.WritePacket(c.backend, c.backendSeq, c.rawAuthPkt)
 }
 
 // execBackendQuery sends a query to backend and returns the full response
 func (c *clientConn) execBackendQuery(query string) ([]byte, error) {
-	// Build COM_QUERY packet
-	payload := make([]byte, 1+len(query))
-	payload[0] = mysql.ComQuery
-	copy(payload[1:], query)
-
 	// Reset backend sequence for new command
 	c.backendSeq = 255 // Will wrap to 0 on first write
 
-	if err := c.writeBackendPacket(payload); err != nil {
+	if err := c.writeBackendPacket(mariadbproto.Query(query)); err != nil {
 		return nil, err
 	}
 
-	// Read all response packets until we get an EOF or OK or Error
+	// A client that disconnects while waiting closes the backend connection,
+	// so that the result is not read for nobody
+	backend := c.backend
+	stop := c.watchClient(func() { backend.Close() })
+	response, err := c.readBackendResponse()
+	if stop() {
+		c.resetBackend()
+		metrics.ClientAborts.WithLabelValues("query").Inc()
+		log.Printf("[MariaDB] Client disconnected during query (conn %d)", c.connID)
+		return nil, watch.ErrClientAborted
+	}
+	return response, err
+}
+
+// readBackendResponse reads the packets of a command response from the
+// backend, including further results while the backend reports more results
+//
+// With a spill buffer set (see execRead) the packets are written to it. The
+// response is returned when it stayed below the spill threshold, nil when
+// it spilled.
+func (c *clientConn) readBackendResponse() ([]byte, error) {
+	return c.readBackendPackets(mariadbproto.ResponseTracker{})
+}
+
+// readBackendPackets reads the packets of a response from the backend until
+// the tracker finds its last packet, see readBackendResponse
+func (c *clientConn) readBackendPackets(tracker mariadbproto.ResponseTracker) ([]byte, error) {
 	var response []byte
-	eofCount := 0
 	for {
 		packet, err := c.readBackendPacket()
 		if err != nil {
 			return nil, err
 		}
-
-		// Add packet with header to response
-		header := make([]byte, 4)
-		binary.LittleEndian.PutUint32(header[0:4], uint32(len(packet)))
-		header[3] = c.backendSeq
-		response = append(response, header...)
-		response = append(response, packet...)
-
-		// Check packet type
-		if len(packet) > 0 {
-			switch packet[0] {
-			case 0x00: // OK packet
-				// OK packet: 00 <lenenc_rows> <lenenc_id> <status_flags(2)>
-				if eofCount == 0 {
-					statusOffset := 1
-					_, _, n1 := mysql.ReadLengthEncodedInteger(packet[statusOffset:])
-					statusOffset += n1
-					_, _, n2 := mysql.ReadLengthEncodedInteger(packet[statusOffset:])
-					statusOffset += n2
-					if len(packet) >= statusOffset+2 {
-						status := binary.LittleEndian.Uint16(packet[statusOffset:])
-						if status&uint16(mysql.StatusMoreResultsExists) == 0 {
-							return response, nil
-						}
-						// More results coming (e.g. from multi-statement call or procedure)
-						eofCount = 0
-						continue
-					}
-					return response, nil
-				}
-			case 0xFF: // Error packet
-				return response, nil
-			case 0xFE: // EOF packet
-				if len(packet) < 9 {
-					eofCount++
-					// Result sets have 2 EOFs: after columns and after rows
-					if eofCount >= 2 {
-						// EOF packet: FE <warnings(2)> <status_flags(2)>
-						if len(packet) >= 5 {
-							status := binary.LittleEndian.Uint16(packet[3:])
-							if status&uint16(mysql.StatusMoreResultsExists) == 0 {
-								return response, nil
-							}
-							// More results coming
-							eofCount = 0
-							continue
-						}
-						return response, nil
-					}
-				}
+		if c.spill == nil {
+			response = mariadbproto.AppendPacket(response, c.backendSeq, packet)
+		} else {
+			// The response buffer is reused for each packet
+			response = mariadbproto.AppendPacket(response[:0], c.backendSeq, packet)
+			if _, err := c.spill.Write(response); err != nil {
+				// The rest of the response is not read
+				c.resetBackend()
+				return nil, err
 			}
 		}
+		if !tracker.Done(packet) {
+			continue
+		}
+		if c.spill == nil {
+			return response, nil
+		}
+		if c.spill.Spilled() {
+			return nil, nil
+		}
+		return c.spill.Bytes(), nil
+	}
+}
+
+// isLocalInfile reports whether a backend response is a LOAD DATA LOCAL
+// INFILE request
+func isLocalInfile(response []byte) bool {
+	return len(response) > mariadbproto.HeaderSize && response[mariadbproto.HeaderSize] == mariadbproto.LocalInfileHeader
+}
+
+// isError reports whether a backend response is an error packet
+func isError(response []byte) bool {
+	return mariadbproto.IsErr(response[min(len(response), mariadbproto.HeaderSize):])
+}
+
+// unavailableErrors are the error codes of a backend that refuses
+// connections, shuts down or killed the connection, on which reads are retried
+var unavailableErrors = map[uint16]bool{
+	1040: true, // ER_CON_COUNT_ERROR
+	1053: true, // ER_SERVER_SHUTDOWN
+	1927: true, // ER_CONNECTION_KILLED
+}
+
+// responseError returns err, or the error of an error response
+func responseError(response []byte, err error) error {
+	if err != nil || !isError(response) {
+		return err
+	}
+	if e, parseErr := mariadbproto.ParseErr(response[mariadbproto.HeaderSize:]); parseErr == nil {
+		return e
+	}
+	return nil
+}
+
+// isBackendConnError returns true for errors caused by a failing backend
+// connection or an unavailable backend, as opposed to errors in the query
+// itself
+func isBackendConnError(err error) bool {
+	var backendErr mariadbproto.Err
+	if errors.As(err, &backendErr) {
+		return unavailableErrors[backendErr.Code]
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, limiter.ErrTooManyConnections) || errors.As(err, &netErr)
+}
+
+// deterministicErrors are the error codes of SELECTs that fail the same way
+// until the schema, the data or the privileges change, which negative caching
+// may store
+var deterministicErrors = map[uint16]bool{
+	1049: true, // ER_BAD_DB_ERROR
+	1054: true, // ER_BAD_FIELD_ERROR
+	1064: true, // ER_PARSE_ERROR
+	1142: true, // ER_TABLEACCESS_DENIED_ERROR
+	1143: true, // ER_COLUMNACCESS_DENIED_ERROR
+	1146: true, // ER_NO_SUCH_TABLE
+	1305: true, // ER_SP_DOES_NOT_EXIST
+	1365: true, // ER_DIVISION_BY_ZERO
+}
+
+// emptyResult reports whether a backend response is a result set without
+// rows, in any of its results
+func emptyResult(response []byte) bool {
+	packets, err := mariadbproto.SplitPackets(response)
+	if err != nil || len(packets) == 0 || mariadbproto.IsOK(packets[0].Payload) || mariadbproto.IsErr(packets[0].Payload) {
+		return false
+	}
+	eofs := 0
+	for _, packet := range packets {
+		if mariadbproto.IsEOF(packet.Payload) {
+			eofs++
+		} else if eofs%2 == 1 {
+			return false // A row, between the EOF after the columns and the EOF after the rows
+		}
+	}
+	return true
+}
+
+// cacheTTL returns the ttl a response of a cacheable SELECT is cached with
+// (0 = not cached): the negative ttl, when set, for results without rows and
+// deterministic errors, otherwise the ttl for results and 0 for errors
+func cacheTTL(response []byte, ttl, negTTL time.Duration) time.Duration {
+	if isError(response) {
+		e, err := mariadbproto.ParseErr(response[min(len(response), mariadbproto.HeaderSize):])
+		if err != nil || !deterministicErrors[e.Code] {
+			return 0
+		}
+		return negTTL
+	}
+	if negTTL > 0 && emptyResult(response) {
+		return negTTL
+	}
+	return ttl
+}
+
+// negativeTTL returns the ttl of the empty results and deterministic errors
+// of a SELECT: that of its negcache hint, or cache_negative_ttl when it only
+// has a ttl hint
+func (p *Proxy) negativeTTL(parsed *parser.ParsedQuery) time.Duration {
+	if parsed.NegTTL > 0 || parsed.TTL <= 0 {
+		return time.Duration(parsed.NegTTL) * time.Second
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return time.Duration(p.config.CacheNegativeTTL) * time.Second
+}
+
+// affectedRows returns the affected rows of an OK response, or -1 for other
+// responses
+func affectedRows(response []byte) int64 {
+	ok, err := mariadbproto.ParseOK(response[min(len(response), mariadbproto.HeaderSize):])
+	if err != nil {
+		return -1
+	}
+	return int64(ok.AffectedRows)
+}
+
+// execBackendWrite executes a non-batched write on the backend while holding
+// an immediate write slot, so that batching outages do not flood the backend
+func (c *clientConn) execBackendWrite(query string) ([]byte, error) {
+	release, err := c.acquireWriteSlot()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	c.lastWrite = time.Now()
+	return c.execBackendQuery(query)
+}
+
+// splitRead returns true when read splitting of the backend of the connection
+// sends a SELECT to a replica: the backend has read_split enabled, the
+// connection did not write within read_split_sticky_ms, so it reads its own
+// writes, and it has no prepared statements, which a switch of the backend
+// connection would lose
+func (c *clientConn) splitRead(parsed *parser.ParsedQuery) bool {
+	shard := c.shard()
+	c.proxy.mu.RLock()
+	backend := c.proxy.config.Backends[shard]
+	c.proxy.mu.RUnlock()
+	return backend.ReadSplit && parsed.IsReplicaSafe() && len(c.preparedStatements) == 0 &&
+		time.Since(c.lastWrite) >= time.Duration(backend.ReadSplitStickyMs)*time.Millisecond
+}
+
+// shard returns the name of the backend the connection currently uses
+func (c *clientConn) shard() string {
+	if c.lastQueryShard != "" {
+		return c.lastQueryShard
 	}
+	c.proxy.mu.RLock()
+	defer c.proxy.mu.RUnlock()
+	return c.proxy.config.Default
+}
+
+// acquireWriteSlot waits (in FIFO order) for an immediate write slot on the
+// current shard. The returned function releases the slot.
+func (c *clientConn) acquireWriteSlot() (func(), error) {
+	c.proxy.mu.RLock()
+	wl := c.proxy.writeLimiter
+	c.proxy.mu.RUnlock()
+	shard := c.shard()
+
+	ctx, cancel := context.WithTimeout(context.Background(), backendTimeout)
+	defer cancel()
+	release, err := wl.Acquire(ctx, shard)
+	if err != nil {
+		return nil, fmt.Errorf("timeout waiting for write slot on backend %q", shard)
+	}
+	return release, nil
 }
 
 // forwardBackendResponse forwards a backend response to the client with adjusted sequence numbers
 func (c *clientConn) forwardBackendResponse(response []byte, moreResults bool) error {
 	// IMPORTANT: Do NOT mutate the input slice in place if it might be from the cache
-	respCopy := make([]byte, len(response))
-	copy(respCopy, response)
-
-	// Parse and rewrite sequence numbers in the response
-	pos := 0
-	var lastPacketPos int
-	for pos < len(respCopy) {
-		if pos+4 > len(respCopy) {
-			break
-		}
+	respCopy := bytes.Clone(response)
 
-		// Read packet length
-		length := int(uint32(respCopy[pos]) | uint32(respCopy[pos+1])<<8 | uint32(respCopy[pos+2])<<16)
+	var last []byte
+	c.sequence, last = mariadbproto.Resequence(respCopy, c.sequence)
+	c.lastResultErr = mariadbproto.IsErr(last)
 
-		// Update sequence number
-		c.sequence++
-		respCopy[pos+3] = c.sequence
-
-		lastPacketPos = pos
-		// Move to next packet
-		pos += 4 + length
-	}
-
-	// If more results follow, set the StatusMoreResultsExists flag in the last packet
-	if moreResults && lastPacketPos < len(respCopy) {
-		packet := respCopy[lastPacketPos:]
-		if len(packet) > 4 {
-			header := packet[4]
-			if header == 0x00 { // OK_HEADER
-				// OK packet: 00 <lenenc_rows> <lenenc_id> <status_flags(2)>
-				statusOffset := 5
-				_, _, n1 := mysql.ReadLengthEncodedInteger(packet[statusOffset:])
-				statusOffset += n1
-				_, _, n2 := mysql.ReadLengthEncodedInteger(packet[statusOffset:])
-				statusOffset += n2
-				if len(packet) >= statusOffset+2 {
-					status := binary.LittleEndian.Uint16(packet[statusOffset:])
-					status |= uint16(mysql.StatusMoreResultsExists)
-					binary.LittleEndian.PutUint16(packet[statusOffset:], status)
-				}
-			} else if header == 0xfe { // EOF_HEADER
-				// EOF packet: FE <warnings(2)> <status_flags(2)>
-				if len(packet) >= 9 {
-					status := binary.LittleEndian.Uint16(packet[7:9])
-					status |= uint16(mysql.StatusMoreResultsExists)
-					binary.LittleEndian.PutUint16(packet[7:9], status)
-				}
-			}
-		}
+	// If more results follow, set the more results flag in the last packet
+	if moreResults {
+		mariadbproto.AddStatus(last, mariadbproto.StatusMoreResultsExists)
 	}
 
 	_, err := c.conn.Write(respCopy)
 	return err
 }
 
+// forwardSpilled forwards a spilled response to the client packet by packet,
+// see forwardBackendResponse
+func (c *clientConn) forwardSpilled(spilled *spill.Buffer, moreResults bool) error {
+	r := bufio.NewReaderSize(spilled.Reader(), spillBufferSize)
+	w := bufio.NewWriterSize(c.conn, spillBufferSize)
+	payload, _, err := mariadbproto.ReadPacket(r)
+	for err == nil {
+		next, _, nextErr := mariadbproto.ReadPacket(r)
+		if nextErr == io.EOF {
+			c.lastResultErr = mariadbproto.IsErr(payload)
+			if moreResults {
+				mariadbproto.AddStatus(payload, mariadbproto.StatusMoreResultsExists)
+			}
+		}
+		c.sequence++
+		if err := mariadbproto.WritePacket(w, c.sequence, payload); err != nil {
+			return err
+		}
+		payload, err = next, nextErr
+	}
+	if err != io.EOF {
+		return err
+	}
+	return w.Flush()
+}
+
 func (c *clientConn) writeOK() error {
 	return c.writeOKWithInfo("", false)
 }
 
 func (c *clientConn) writeOKWithInfo(info string, moreResults bool) error {
-	c.sequence++
-	status := c.status
+	return c.writeOKAffected(0, moreResults)
+}
+
+// writeOKAffected writes an OK packet with the number of affected rows
+func (c *clientConn) writeOKAffected(affected uint64, moreResults bool) error {
+	return c.writePacket(mariadbproto.OK{AffectedRows: affected, Status: c.statusFlags(moreResults)}.Encode())
+}
+
+// statusFlags returns the status flags to send to the client
+func (c *clientConn) statusFlags(moreResults bool) uint16 {
+	status := uint16(c.status)
 	if moreResults {
-		status |= mysql.StatusMoreResultsExists
-	}
-	packet := mysql.WriteOKPacket(0, 0, status, c.capability)
-	// Add header
-	payload := make([]byte, 4+len(packet))
-	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(packet)))
-	payload[3] = c.sequence
-	copy(payload[4:], packet)
-	_, err := c.conn.Write(payload)
-	return err
+		status |= mariadbproto.StatusMoreResultsExists
+	}
+	return status
 }
 
 func (c *clientConn) writeError(e error) error {
-	c.sequence++
-	packet := mysql.WriteErrorPacket(1105, "HY000", e.Error(), c.capability)
-	// Add header
-	payload := make([]byte, 4+len(packet))
-	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(packet)))
-	payload[3] = c.sequence
-	copy(payload[4:], packet)
-	_, err := c.conn.Write(payload)
-	return err
+	packet := mariadbproto.Err{Code: mariadbproto.ErUnknownError, State: mariadbproto.StateGeneralError, Message: e.Error()}
+	if errors.Is(e, limiter.ErrTooManyConnections) {
+		packet = mariadbproto.Err{Code: mariadbproto.ErConCountError, State: mariadbproto.StateConnectionError, Message: "Too many connections"}
+	}
+	if errors.Is(e, quota.ErrExceeded) || errors.Is(e, throttle.ErrThrottled) {
+		packet = mariadbproto.Err{Code: mariadbproto.ErUserLimitReached, State: mariadbproto.StateAccessViolation, Message: e.Error()}
+	}
+	switch {
+	case errors.Is(e, acl.ErrUserDenied):
+		packet = mariadbproto.Err{Code: mariadbproto.ErAccessDeniedError, State: mariadbproto.StateAccessDenied, Message: e.Error()}
+	case errors.Is(e, acl.ErrDatabaseDenied):
+		packet = mariadbproto.Err{Code: mariadbproto.ErDBAccessDenied, State: mariadbproto.StateAccessViolation, Message: e.Error()}
+	case errors.Is(e, acl.ErrReadOnly):
+		packet = mariadbproto.Err{Code: mariadbproto.ErOptionPreventsStatement, State: mariadbproto.StateGeneralError, Message: e.Error()}
+	}
+	errors.As(e, &packet)
+	return c.writePacket(packet.Encode())
 }
 
 func (c *clientConn) writeAuthError(user string) error {
-	c.sequence++
 	msg := fmt.Sprintf("Access denied for user '%s'@'localhost' (using password: YES)", user)
-	packet := mysql.WriteErrorPacket(1045, "28000", msg, c.capability)
-	// Add header
-	payload := make([]byte, 4+len(packet))
-	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(packet)))
-	payload[3] = c.sequence
-	copy(payload[4:], packet)
-	_, err := c.conn.Write(payload)
-	return err
+	return c.writePacket(mariadbproto.Err{Code: mariadbproto.ErAccessDeniedError, State: mariadbproto.StateAccessDenied, Message: msg}.Encode())
 }
 
 func (c *clientConn) writeEOF() error {
-	c.sequence++
-	packet := mysql.WriteEOFPacket(c.status, c.capability)
-	// Add header
-	payload := make([]byte, 4+len(packet))
-	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(packet)))
-	payload[3] = c.sequence
-	copy(payload[4:], packet)
-	_, err := c.conn.Write(payload)
-	return err
-}
-
-func (c *clientConn) writeRaw(data []byte) error {
-	_, err := c.conn.Write(data)
-	return err
+	return c.writePacket(mariadbproto.EOF{Status: uint16(c.status)}.Encode())
 }
 
 func queryTypeLabel(t parser.QueryType) string {
@@ -1646,11 +3125,35 @@ func queryTypeLabel(t parser.QueryType) string {
 	}
 }
 
+// handleShowTQDBStatus returns the status of the connection, the cache, write
+// batching and the backend pools as a result set built by the proxy, so that
+// it does not load a backend and works when none is reachable
 func (c *clientConn) handleShowTQDBStatus(moreResults bool) error {
-	// Ensure we have a backend connection to execute the synthetic query
-	if err := c.ensureBackend(""); err != nil {
-		return err
+	rs := mariadbproto.ResultSet{Status: c.statusFlags(moreResults)}
+	for _, name := range []string{"Variable_name", "Value"} {
+		rs.Columns = append(rs.Columns, mariadbproto.Column{
+			Name:    name,
+			OrgName: name,
+			Charset: uint16(c.resultCollation()),
+			Length:  1024,
+			Type:    mariadbproto.TypeVarString,
+		})
+	}
+	for _, row := range c.tqdbStatus() {
+		rs.Rows = append(rs.Rows, [][]byte{[]byte(row[0]), []byte(row[1])})
 	}
+	var response []byte
+	response, c.sequence = rs.AppendPackets(nil, c.sequence)
+	_, err := c.conn.Write(response)
+	return err
+}
+
+// tqdbStatus returns the variables of SHOW TQDB STATUS
+func (c *clientConn) tqdbStatus() [][2]string {
+	c.proxy.mu.RLock()
+	defaultShard := c.proxy.config.Default
+	pools := c.proxy.pools
+	c.proxy.mu.RUnlock()
 
 	backend := c.lastQueryBackend
 	if backend == "" {
@@ -1658,38 +3161,225 @@ func (c *clientConn) handleShowTQDBStatus(moreResults bool) error {
 	}
 	shard := c.lastQueryShard
 	if shard == "" {
-		shard = c.proxy.config.Default
+		shard = defaultShard
+	}
+	rows := [][2]string{{"Backend", backend}, {"Shard", shard}}
+	c.mu.Lock()
+	lastBatchSize := c.lastBatchSize
+	c.mu.Unlock()
+	if lastBatchSize > 0 {
+		rows = append(rows, [2]string{"LastBatchSize", strconv.Itoa(lastBatchSize)})
 	}
 
-	// Build a synthetic query that returns the status as a result set
-	query := fmt.Sprintf("SELECT 'Backend' AS `Variable_name`, '%s' AS `Value` UNION ALL SELECT 'Shard', '%s'", backend, shard)
+	rows = append(rows,
+		[2]string{"connection.id", strconv.FormatUint(uint64(c.connID), 10)},
+		[2]string{"connection.last_cache_hit", strconv.FormatBool(c.lastQueryCacheHit)},
+		[2]string{"connection.in_transaction", strconv.FormatBool(c.pinned())},
+		[2]string{"connection.prepared_statements", strconv.Itoa(len(c.preparedStatements))},
+	)
+
+	return append(rows, c.proxy.globalStatus(pools)...)
+}
 
-	// Add batch size if available (from last write batch operation)
-	if c.lastBatchSize > 0 {
-		query = fmt.Sprintf("%s UNION ALL SELECT 'LastBatchSize', '%d'", query, c.lastBatchSize)
+// globalStatus returns the variables of SHOW TQDB STATUS that are shared by
+// all connections
+func (p *Proxy) globalStatus(pools map[string]*replica.Pool) [][2]string {
+	rows := [][2]string{
+		{"connections.active", strconv.Itoa(p.histories.Len())},
+		{"uptime_seconds", strconv.FormatInt(int64(time.Since(p.started).Seconds()), 10)},
 	}
 
-	response, err := c.execBackendQuery(query)
-	if err != nil {
-		return err
+	hits, misses := p.cache.Stats().Totals()
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	rows = append(rows,
+		[2]string{"cache.hits", strconv.FormatInt(hits, 10)},
+		[2]string{"cache.misses", strconv.FormatInt(misses, 10)},
+		[2]string{"cache.hit_ratio", strconv.FormatFloat(ratio, 'f', 4, 64)},
+	)
+	for _, feature := range killswitch.Features {
+		state := "ON"
+		if !p.enabled(feature) {
+			state = "OFF"
+		}
+		rows = append(rows, [2]string{"killswitch." + feature, state})
 	}
 
-	return c.forwardBackendResponse(response, moreResults)
+	if wb := p.writeBatch; wb != nil {
+		stats := wb.GetStats()
+		avg := 0.0
+		if stats.Batches > 0 {
+			avg = float64(stats.Ops) / float64(stats.Batches)
+		}
+		rows = append(rows,
+			[2]string{"writebatch.batches.total", strconv.FormatInt(stats.Batches, 10)},
+			[2]string{"writebatch.ops.total", strconv.FormatInt(stats.Ops, 10)},
+			[2]string{"writebatch.avg_batch_size", strconv.FormatFloat(avg, 'f', 2, 64)},
+			[2]string{"writebatch.queued", strconv.Itoa(stats.Pending)},
+			[2]string{"writebatch.groups", strconv.Itoa(stats.Groups)},
+			[2]string{"writebatch.executing", strconv.Itoa(stats.Executing)},
+			[2]string{"writebatch.rejected.total", strconv.FormatInt(stats.Rejected, 10)},
+			[2]string{"writebatch.withdrawn.total", strconv.FormatInt(stats.Withdrawn, 10)},
+			[2]string{"writebatch.avg_queue_wait_ms", strconv.FormatFloat(float64(stats.AvgQueueWait)/float64(time.Millisecond), 'f', 2, 64)},
+		)
+	}
+
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pool := pools[name]
+		replicas := pool.Replicas()
+		rows = append(rows,
+			[2]string{"pool." + name + ".primary", pool.GetPrimary()},
+			[2]string{"pool." + name + ".replicas_healthy", fmt.Sprintf("%d/%d", pool.GetHealthyCount(), len(replicas))},
+		)
+	}
+	return rows
 }
 
-func (c *clientConn) handleBatchedWrite(query string, batchMs int, start time.Time, file, lineStr, queryType string, moreResults bool) error {
-	// Parse the query to get the batch key
-	parsed := parser.Parse(query)
+// handleShowTQDBHistory returns the query history of the connection, oldest
+// statement first, as a result set built by the proxy
+func (c *clientConn) handleShowTQDBHistory(moreResults bool) error {
+	names := []string{"Time", "Latency_ms", "Backend", "Query", "Error"}
+	rs := mariadbproto.ResultSet{Status: c.statusFlags(moreResults)}
+	for _, name := range names {
+		rs.Columns = append(rs.Columns, mariadbproto.Column{
+			Name:    name,
+			OrgName: name,
+			Charset: uint16(c.resultCollation()),
+			Length:  history.MaxQueryLen,
+			Type:    mariadbproto.TypeVarString,
+		})
+	}
+	for _, e := range c.history.Entries() {
+		rs.Rows = append(rs.Rows, [][]byte{
+			[]byte(e.Time.Format("2006-01-02 15:04:05.000")),
+			[]byte(strconv.FormatFloat(float64(e.Latency)/float64(time.Millisecond), 'f', 3, 64)),
+			[]byte(e.Backend),
+			[]byte(e.Query),
+			[]byte(e.Error),
+		})
+	}
+	var response []byte
+	response, c.sequence = rs.AppendPackets(nil, c.sequence)
+	_, err := c.conn.Write(response)
+	return err
+}
+
+// handleShowTQDBSlowQueries returns the slow queries of all MariaDB
+// connections, oldest first, as a result set built by the proxy
+func (c *clientConn) handleShowTQDBSlowQueries(moreResults bool) error {
+	names := []string{"Time", "Conn_id", "User", "Latency_ms", "Backend", "Shard", "File", "Line", "Batch_size", "Query", "Error", "Plan"}
+	rs := mariadbproto.ResultSet{Status: c.statusFlags(moreResults)}
+	for _, name := range names {
+		rs.Columns = append(rs.Columns, mariadbproto.Column{
+			Name:    name,
+			OrgName: name,
+			Charset: uint16(c.resultCollation()),
+			Length:  slowlog.MaxQueryLen,
+			Type:    mariadbproto.TypeVarString,
+		})
+	}
+	for _, e := range c.proxy.slowQueryLog().Entries("mariadb") {
+		rs.Rows = append(rs.Rows, [][]byte{
+			[]byte(e.Time.Format("2006-01-02 15:04:05.000")),
+			[]byte(strconv.FormatUint(uint64(e.ConnID), 10)),
+			[]byte(e.User),
+			[]byte(strconv.FormatFloat(float64(e.Latency)/float64(time.Millisecond), 'f', 3, 64)),
+			[]byte(e.Backend),
+			[]byte(e.Shard),
+			[]byte(e.File),
+			[]byte(strconv.Itoa(e.Line)),
+			[]byte(strconv.Itoa(e.BatchSize)),
+			[]byte(e.Query),
+			[]byte(e.Error),
+			[]byte(e.Plan),
+		})
+	}
+	var response []byte
+	response, c.sequence = rs.AppendPackets(nil, c.sequence)
+	_, err := c.conn.Write(response)
+	return err
+}
+
+// handleFlushBatches executes all pending write batches and waits for them to
+// complete. The OK packet reports the number of flushed writes as affected
+// rows. Clients use it to read their batched writes without waiting for the
+// batch window.
+func (c *clientConn) handleFlushBatches(moreResults bool) error {
+	c.proxy.mu.RLock()
+	managers := append(c.proxy.routeBatchManagers(), c.proxy.writeBatch)
+	c.proxy.mu.RUnlock()
+	flushed := 0
+	for _, wb := range managers {
+		if wb != nil {
+			flushed += wb.Flush()
+		}
+	}
+	return c.writeOKAffected(uint64(flushed), moreResults)
+}
+
+// handleCachePurge deletes the cache entries matching the pattern (see
+// cache.Purge). The OK packet reports the number of deleted entries as
+// affected rows.
+func (c *clientConn) handleCachePurge(pattern string, moreResults bool) error {
+	purged := c.proxy.cache.Purge(pattern)
+	log.Printf("[MariaDB] Cache purge %q removed %d entries (conn %d)", pattern, purged, c.connID)
+	return c.writeOKAffected(uint64(purged), moreResults)
+}
+
+func (c *clientConn) handleBatchedWrite(wb *writebatch.Manager, parsed *parser.ParsedQuery, start time.Time, file, lineStr, queryType string, moreResults bool) error {
+	query := parsed.Query
+	batchMs := parsed.BatchMs
 	batchKey := parsed.GetBatchKey()
+	batchQuery := query
+	var params []interface{}
+	if normalized, values, ok := c.proxy.normalizeWrite(query); ok {
+		batchQuery, params = normalized, values
+		batchKey = parser.Parse(normalized).GetBatchKey()
+	}
+
+	release, err := c.proxy.quotas.AcquireWrite(c.db)
+	if err != nil {
+		return err
+	}
+	ctx := writebatch.WithMaxBatchSize(context.Background(), parsed.BatchMax)
+
+	// Acknowledge the write before its batch executed, unless too many async
+	// writes are pending
+	if parsed.Ack == parser.AckEarly {
+		err := wb.EnqueueAsync(ctx, &c.writeFence, c.writeOrder, batchKey, batchQuery, params, batchMs, func(result writebatch.WriteResult) {
+			release()
+			c.proxy.recordBatch(query, result.Error)
+		})
+		if err == nil {
+			return c.ackEarly(start, file, lineStr, queryType, moreResults)
+		}
+	}
+	defer release()
 
-	// Enqueue the write (blocks until result is available)
-	ctx := context.Background()
-	result := c.proxy.writeBatch.Enqueue(ctx, batchKey, query, nil, batchMs, func(batchSize int) {
+	// Enqueue the write (blocks until result is available, or the client
+	// disconnects, which withdraws it from the batch)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := c.watchClient(cancel)
+	result := wb.EnqueueFenced(ctx, &c.writeFence, c.writeOrder, batchKey, batchQuery, params, batchMs, func(batchSize int) {
 		// Update this connection's batch size when batch completes
 		c.mu.Lock()
 		c.lastBatchSize = batchSize
 		c.mu.Unlock()
 	})
+	if stop() {
+		metrics.ClientAborts.WithLabelValues("batch_wait").Inc()
+		log.Printf("[MariaDB] Client disconnected during batch window (conn %d)", c.connID)
+		return watch.ErrClientAborted
+	}
+	c.proxy.recordBatch(query, result.Error)
 
 	// Record metrics
 	metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "false").Inc()
@@ -1697,8 +3387,9 @@ func (c *clientConn) handleBatchedWrite(query string, batchMs int, start time.Ti
 
 	// Handle error
 	if result.Error != nil {
-		// Fall back to immediate execution on certain errors
-		if result.Error == writebatch.ErrManagerClosed || result.Error == writebatch.ErrTimeout {
+		// Fall back to immediate execution when the batch did not run. A
+		// timed out write may have executed, so its error is returned.
+		if result.Error == writebatch.ErrManagerClosed {
 			log.Printf("[MariaDB] Write batch error (%v), executing immediately", result.Error)
 			return c.executeImmediateWrite(query, start, file, lineStr, queryType, moreResults)
 		}
@@ -1709,26 +3400,70 @@ func (c *clientConn) handleBatchedWrite(query string, batchMs int, start time.Ti
 	c.lastQueryBackend = "write-batch"
 	c.lastQueryCacheHit = false
 	c.lastBatchSize = result.BatchSize
+	c.lastAffectedRows = result.AffectedRows
+	c.lastWrite = time.Now()
 
 	// Send OK packet with affected rows and last insert ID
 	return c.writeOKWithRowsAndID(result.AffectedRows, result.LastInsertID, moreResults)
 }
 
-func (c *clientConn) handleBatchedPreparedExecute(stmtID uint32, data []byte, parsed *parser.ParsedQuery, params []interface{}) error {
+// ackEarly sends the OK packet of a write that was enqueued with
+// EnqueueAsync. The affected rows and insert ID are not known yet and
+// reported as 0.
+func (c *clientConn) ackEarly(start time.Time, file, lineStr, queryType string, moreResults bool) error {
+	metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "false").Inc()
+	metrics.QueryLatency.WithLabelValues(file, lineStr, queryType).Observe(time.Since(start).Seconds())
+	c.lastQueryBackend = "write-batch (async)"
+	c.lastQueryCacheHit = false
+	c.lastBatchSize = 0
+	c.lastAffectedRows = -1
+	c.lastWrite = time.Now()
+	return c.writeOKWithRowsAndID(0, 0, moreResults)
+}
+
+func (c *clientConn) handleBatchedPreparedExecute(wb *writebatch.Manager, stmt *preparedStatement, data []byte, parsed *parser.ParsedQuery, params []interface{}) error {
 	start := time.Now()
+	c.proxy.clampBatch(parsed, c.shard())
 	batchKey := parsed.GetBatchKey()
 	batchMs := parsed.BatchMs
 	file := parsed.File
 	lineStr := strconv.Itoa(parsed.Line)
 	queryType := queryTypeLabel(parsed.Type)
 
+	releaseQuota, err := c.proxy.quotas.AcquireWrite(c.db)
+	if err != nil {
+		return err
+	}
+	ctx := writebatch.WithMaxBatchSize(context.Background(), parsed.BatchMax)
+
+	// Acknowledge the execution before its batch executed, unless too many
+	// async writes are pending
+	if parsed.Ack == parser.AckEarly {
+		err := wb.EnqueueAsync(ctx, &c.writeFence, c.writeOrder, batchKey, parsed.Query, params, batchMs, func(result writebatch.WriteResult) {
+			releaseQuota()
+			c.proxy.recordBatch(parsed.Query, result.Error)
+		})
+		if err == nil {
+			return c.ackEarly(start, file, lineStr, queryType, false)
+		}
+	}
+	defer releaseQuota()
+
 	// Enqueue the prepared statement execution with decoded parameters
-	ctx := context.Background()
-	result := c.proxy.writeBatch.Enqueue(ctx, batchKey, parsed.Query, params, batchMs, func(batchSize int) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := c.watchClient(cancel)
+	result := wb.EnqueueFenced(ctx, &c.writeFence, c.writeOrder, batchKey, parsed.Query, params, batchMs, func(batchSize int) {
 		c.mu.Lock()
 		c.lastBatchSize = batchSize
 		c.mu.Unlock()
 	})
+	if stop() {
+		metrics.ClientAborts.WithLabelValues("batch_wait").Inc()
+		log.Printf("[MariaDB] Client disconnected during batch window (conn %d)", c.connID)
+		return watch.ErrClientAborted
+	}
+	c.proxy.recordBatch(parsed.Query, result.Error)
 
 	// Record metrics
 	metrics.QueryTotal.WithLabelValues(file, lineStr, queryType, "false").Inc()
@@ -1736,26 +3471,29 @@ func (c *clientConn) handleBatchedPreparedExecute(stmtID uint32, data []byte, pa
 
 	// Handle error
 	if result.Error != nil {
-		// Fall back to executing the prepared statement directly
-		if result.Error == writebatch.ErrManagerClosed || result.Error == writebatch.ErrTimeout {
+		// Fall back to executing the prepared statement directly when the
+		// batch did not run
+		if result.Error == writebatch.ErrManagerClosed {
 			log.Printf("[MariaDB] Write batch error (%v), executing prepared statement directly", result.Error)
-			// Fall back to normal prepared statement execution
-			payload := make([]byte, 1+len(data))
-			payload[0] = mysql.ComStmtExecute
-			copy(payload[1:], data)
+			release, err := c.acquireWriteSlot()
+			if err != nil {
+				return err
+			}
+			defer release()
 
-			c.backendSeq = 255
-			if err := c.writeBackendPacket(payload); err != nil {
+			// Fall back to normal prepared statement execution
+			if err := c.executeOnBackend(stmt, data); err != nil {
 				return err
 			}
 
-			response, err := c.execBackendResponse()
+			response, err := c.readBackendResponse()
 			if err != nil {
 				return err
 			}
 
 			c.lastQueryBackend = c.backendName
 			c.lastQueryCacheHit = false
+			c.lastAffectedRows = affectedRows(response)
 			return c.forwardBackendResponse(response, false)
 		}
 		return c.writeError(result.Error)
@@ -1765,6 +3503,8 @@ func (c *clientConn) handleBatchedPreparedExecute(stmtID uint32, data []byte, pa
 	c.lastQueryBackend = "write-batch"
 	c.lastQueryCacheHit = false
 	c.lastBatchSize = result.BatchSize
+	c.lastAffectedRows = result.AffectedRows
+	c.lastWrite = time.Now()
 
 	// Send OK packet with affected rows and last insert ID
 	return c.writeOKWithRowsAndID(result.AffectedRows, result.LastInsertID, false)
@@ -1779,7 +3519,7 @@ func (c *clientConn) executeImmediateWrite(query string, start time.Time, file,
 		return err
 	}
 
-	response, err := c.execBackendQuery(query)
+	response, err := c.execBackendWrite(query)
 	if err != nil {
 		return err
 	}
@@ -1790,27 +3530,22 @@ func (c *clientConn) executeImmediateWrite(query string, start time.Time, file,
 
 	c.lastQueryBackend = backendName
 	c.lastQueryCacheHit = false
+	c.lastAffectedRows = affectedRows(response)
 
 	return c.forwardBackendResponse(response, moreResults)
 }
 
 func (c *clientConn) writeOKWithRowsAndID(affectedRows, lastInsertID int64, moreResults bool) error {
-	c.sequence++
-	status := c.status
-	if moreResults {
-		status |= mysql.StatusMoreResultsExists
-	}
-	packet := mysql.WriteOKPacket(uint64(affectedRows), uint64(lastInsertID), status, c.capability)
-	// Add header
-	payload := make([]byte, 4+len(packet))
-	binary.LittleEndian.PutUint32(payload[0:4], uint32(len(packet)))
-	payload[3] = c.sequence
-	copy(payload[4:], packet)
-	_, err := c.conn.Write(payload)
-	return err
+	return c.writePacket(mariadbproto.OK{
+		AffectedRows: uint64(affectedRows),
+		LastInsertID: uint64(lastInsertID),
+		Status:       c.statusFlags(moreResults),
+	}.Encode())
 }
 
-func splitQueries(query string) []string {
+// splitQueries splits a query into its statements. Without multiStatements
+// a query of several statements is a syntax error, as on the server.
+func splitQueries(query string, multiStatements bool) ([]string, error) {
 	var queries []string
 	var current strings.Builder
 	inQuote := false
@@ -1850,5 +3585,9 @@ func splitQueries(query string) []string {
 	if q != "" {
 		queries = append(queries, q)
 	}
-	return queries
+	if len(queries) > 1 && !multiStatements {
+		return nil, mariadbproto.Err{Code: mariadbproto.ErParseError, State: mariadbproto.StateAccessViolation,
+			Message: fmt.Sprintf("You have an error in your SQL syntax near '%s'", queries[1])}
+	}
+	return queries, nil
 }
@@ -1,9 +1,23 @@
 package mariadb
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/history"
+	"github.com/mevdschee/tqdbproxy/killswitch"
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
 	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/replica"
 )
 
 func TestPreparedStatement_CacheKey(t *testing.T) {
@@ -36,3 +50,620 @@ func TestPreparedStatement_CacheKey(t *testing.T) {
 		t.Errorf("Prepared statements with same params should have same cache key")
 	}
 }
+
+func TestSplitQueries(t *testing.T) {
+	queries, err := splitQueries("SELECT 1; SELECT ';'; ", true)
+	if err != nil || !reflect.DeepEqual(queries, []string{"SELECT 1", "SELECT ';'"}) {
+		t.Errorf("splitQueries() = %q, %v", queries, err)
+	}
+	if _, err := splitQueries("SELECT 1;", false); err != nil {
+		t.Errorf("Expected a single statement without multi-statements, got %v", err)
+	}
+	var errPacket mariadbproto.Err
+	if _, err := splitQueries("SELECT 1; DROP TABLE users", false); !errors.As(err, &errPacket) || errPacket.Code != mariadbproto.ErParseError {
+		t.Errorf("Expected a syntax error without multi-statements, got %v", err)
+	}
+}
+
+func TestHandleSetOption(t *testing.T) {
+	server, clientEnd := net.Pipe()
+	defer server.Close()
+	defer clientEnd.Close()
+	c := &clientConn{conn: server}
+
+	for _, tt := range []struct {
+		option byte
+		multi  bool
+		header byte
+	}{
+		{mariadbproto.OptionMultiStatementsOn, true, mariadbproto.EOFHeader},
+		{mariadbproto.OptionMultiStatementsOff, false, mariadbproto.EOFHeader},
+		{7, false, mariadbproto.ErrHeader},
+	} {
+		tc := &testClient{t: t, conn: clientEnd}
+		go tc.write([]byte{mariadbproto.ComSetOption, tt.option, 0})
+		packet, err := c.readPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan []byte)
+		go func() { done <- tc.read() }()
+		if err := c.dispatch(packet[0], packet[1:]); err != nil {
+			c.writeError(err)
+		}
+		if got := <-done; len(got) == 0 || got[0] != tt.header {
+			t.Errorf("Option %d: expected packet 0x%02x, got %x", tt.option, tt.header, got)
+		}
+		if c.multiStatements != tt.multi {
+			t.Errorf("Option %d: multiStatements = %v, want %v", tt.option, c.multiStatements, tt.multi)
+		}
+	}
+}
+
+// serveQueries answers n queries on a backend connection with OK packets and
+// sends their text to queries
+func serveQueries(t *testing.T, conn net.Conn, n int, queries chan<- string) {
+	tc := &testClient{t: t, conn: conn}
+	for i := 0; i < n; i++ {
+		packet := tc.read()
+		queries <- string(packet[1:])
+		tc.write([]byte{mariadbproto.OKHeader, 0, 0, 2, 0, 0, 0})
+	}
+}
+
+func TestSessionSettings(t *testing.T) {
+	server, clientEnd := net.Pipe()
+	defer server.Close()
+	defer clientEnd.Close()
+	go io.Copy(io.Discard, clientEnd)
+	backend, backendEnd := net.Pipe()
+	defer backend.Close()
+	c := &clientConn{conn: server, backend: backend}
+
+	queries := make(chan string, 8)
+	go serveQueries(t, backendEnd, 3, queries)
+	for _, query := range []string{"SET sql_mode = 'ANSI', time_zone = '+00:00'", "SET NAMES latin1", "SET sql_mode = ''"} {
+		names, ok := parser.ParseSessionSet(query)
+		if !ok {
+			t.Fatalf("Expected %q to be a session SET", query)
+		}
+		if err := c.handleSessionSet(query, names, false); err != nil {
+			t.Fatal(err)
+		}
+		<-queries
+	}
+
+	// A new backend connection gets the settings in order
+	backend2, backendEnd2 := net.Pipe()
+	defer backend2.Close()
+	c.backend = backend2
+	go serveQueries(t, backendEnd2, 3, queries)
+	c.restoreSettings()
+	var replayed []string
+	for i := 0; i < 3; i++ {
+		replayed = append(replayed, <-queries)
+	}
+	expected := []string{"SET sql_mode = 'ANSI', time_zone = '+00:00'", "SET NAMES latin1", "SET sql_mode = ''"}
+	if !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("Expected replayed settings %q, got %q", expected, replayed)
+	}
+}
+
+func TestTransactionPinning(t *testing.T) {
+	main := replica.NewPool("10.0.0.1:3306", []string{"10.0.0.2:3306"})
+	other := replica.NewPool("10.0.1.1:3306", nil)
+	p := &Proxy{
+		config: config.ProxyConfig{
+			Default:          "main",
+			DBMap:            map[string]string{"shop": "main", "stock": "main", "logs": "other", "shop_ro": "main"},
+			ReplicaDatabases: map[string]string{"shop_ro": "shop"},
+		},
+		pools: map[string]*replica.Pool{"main": main, "other": other},
+	}
+	backend, backendEnd := net.Pipe()
+	defer backend.Close()
+	defer backendEnd.Close()
+	c := &clientConn{proxy: p, db: "shop", backend: backend, backendPool: main, backendAddr: "10.0.0.1:3306", backendName: "primary"}
+
+	// Outside of a transaction the session may move freely
+	if c.pinned() {
+		t.Fatal("Expected a new session not to be pinned")
+	}
+	c.inTransaction = true
+	if !c.pinned() {
+		t.Fatal("Expected a session in a transaction to be pinned")
+	}
+
+	// Databases on the same connection stay usable
+	if err := c.ensureBackend("stock"); err != nil {
+		t.Errorf("Expected a database on the same backend to be usable, got %v", err)
+	}
+	for _, db := range []string{"logs", "shop_ro"} {
+		if err := c.ensureBackend(db); !errors.Is(err, errTransactionPinned) {
+			t.Errorf("Expected %s to fail in a transaction, got %v", db, err)
+		}
+	}
+	if err := c.ensureBackendConn("10.0.0.2:3306", "replica1", main); !errors.Is(err, errTransactionPinned) {
+		t.Errorf("Expected a switch to a replica to fail in a transaction, got %v", err)
+	}
+	if c.backend != backend || c.backendPool != main || c.replicaDB {
+		t.Error("Expected the session to stay on its backend connection")
+	}
+}
+
+func TestTransactionStatements(t *testing.T) {
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, clientEnd := net.Pipe()
+	defer server.Close()
+	defer clientEnd.Close()
+	go io.Copy(io.Discard, clientEnd)
+	backend, backendEnd := net.Pipe()
+	defer backend.Close()
+	defer backendEnd.Close()
+	pool := replica.NewPool("10.0.0.1:3306", nil)
+	conn := &clientConn{
+		proxy:       &Proxy{cache: c, pools: map[string]*replica.Pool{"main": pool}},
+		conn:        server,
+		backend:     backend,
+		backendPool: pool,
+		backendAddr: "10.0.0.1:3306",
+		backendName: "primary",
+	}
+
+	tests := []struct {
+		query  string
+		pinned bool
+	}{
+		{"START TRANSACTION READ ONLY", true},
+		{"SAVEPOINT a", true},
+		{"ROLLBACK TO SAVEPOINT a", true},
+		{"RELEASE SAVEPOINT a", true},
+		{"COMMIT AND CHAIN", true},
+		{"CREATE TEMPORARY TABLE tmp (id INT)", true},
+		{"CREATE TABLE users (id INT)", false},
+		{"BEGIN WORK", true},
+		{"ROLLBACK WORK", false},
+	}
+	queries := make(chan string, len(tests))
+	go serveQueries(t, backendEnd, len(tests), queries)
+	for _, tt := range tests {
+		if err := conn.handleQuery(tt.query); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if query := <-queries; query != tt.query {
+			t.Errorf("Expected %q on the backend, got %q", tt.query, query)
+		}
+		if conn.pinned() != tt.pinned {
+			t.Errorf("%s: expected pinned = %v", tt.query, tt.pinned)
+		}
+	}
+}
+
+func TestMultiResults(t *testing.T) {
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, clientEnd := net.Pipe()
+	defer server.Close()
+	defer clientEnd.Close()
+	backend, backendEnd := net.Pipe()
+	defer backend.Close()
+	defer backendEnd.Close()
+	pool := replica.NewPool("10.0.0.1:3306", nil)
+	conn := &clientConn{
+		proxy:           &Proxy{cache: c, pools: map[string]*replica.Pool{"main": pool}},
+		conn:            server,
+		backend:         backend,
+		backendPool:     pool,
+		backendAddr:     "10.0.0.1:3306",
+		backendName:     "primary",
+		multiStatements: true,
+	}
+
+	// A CALL returns a result set for every SELECT in the procedure, followed
+	// by the OK of the CALL itself
+	col := mariadbproto.Column{Name: "id", Type: mariadbproto.TypeVarString}.Encode()
+	responses := map[string][][]byte{
+		"CALL report()": {
+			{1}, col, mariadbproto.EOF{}.Encode(),
+			mariadbproto.EncodeTextRow([][]byte{[]byte("1")}),
+			mariadbproto.EOF{Status: mariadbproto.StatusMoreResultsExists}.Encode(),
+			mariadbproto.OK{}.Encode(),
+		},
+		"SELECT missing": {mariadbproto.Err{Code: 1054, State: "42S22", Message: "Unknown column 'missing'"}.Encode()},
+	}
+	queries := make(chan string, 3)
+	go func() {
+		tc := &testClient{t: t, conn: backendEnd}
+		for i := 0; i < 2; i++ {
+			packet := tc.read()
+			queries <- string(packet[1:])
+			for _, payload := range responses[string(packet[1:])] {
+				tc.write(payload)
+			}
+		}
+	}()
+	received := make(chan [][]byte, 1)
+	go func() {
+		tc := &testClient{t: t, conn: clientEnd}
+		var packets [][]byte
+		for {
+			packet := tc.read()
+			packets = append(packets, packet)
+			if packet == nil || mariadbproto.IsErr(packet) {
+				break
+			}
+		}
+		received <- packets
+	}()
+
+	if err := conn.handleQuery("CALL report(); SELECT missing; SELECT 3"); err != nil {
+		t.Fatal(err)
+	}
+	packets := <-received
+	if len(packets) != 7 {
+		t.Fatalf("Expected 7 packets, got %d", len(packets))
+	}
+	ok, err := mariadbproto.ParseOK(packets[5])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok.Status&mariadbproto.StatusMoreResultsExists == 0 {
+		t.Error("Expected more results after the CALL")
+	}
+	if !mariadbproto.IsErr(packets[6]) {
+		t.Error("Expected the error of the second statement")
+	}
+
+	// The statements after an error are not executed
+	close(queries)
+	var executed []string
+	for query := range queries {
+		executed = append(executed, query)
+	}
+	if want := []string{"CALL report()", "SELECT missing"}; !reflect.DeepEqual(executed, want) {
+		t.Errorf("Expected %q on the backend, got %q", want, executed)
+	}
+	if conn.lastWrite.IsZero() {
+		t.Error("Expected a CALL to count as a write")
+	}
+}
+
+func TestExecuteInTransaction(t *testing.T) {
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, clientEnd := net.Pipe()
+	defer server.Close()
+	defer clientEnd.Close()
+	go io.Copy(io.Discard, clientEnd)
+	backend, backendEnd := net.Pipe()
+	defer backend.Close()
+	defer backendEnd.Close()
+	parsed := parser.Parse("/* ttl:60 */ SELECT name FROM users WHERE id = ?")
+	conn := &clientConn{
+		proxy:              &Proxy{cache: c},
+		conn:               server,
+		backend:            backend,
+		db:                 "shop",
+		preparedStatements: map[uint32]*preparedStatement{1: {parsed: parsed, params: 1, backend: backend, backendID: 1}},
+		inTransaction:      true,
+	}
+
+	// The result of the statement is cached outside of the transaction
+	data := []byte{1, 0, 0, 0, 0, 1, 0, 0, 0}
+	h := sha1.New()
+	h.Write([]byte("shop"))
+	h.Write([]byte(parsed.Query))
+	h.Write(data[4:])
+	c.Set("ps:"+hex.EncodeToString(h.Sum(nil)), []byte{1, 0, 0, 1, mariadbproto.OKHeader}, time.Minute)
+
+	queries := make(chan string, 1)
+	go serveQueries(t, backendEnd, 1, queries)
+	if err := conn.handleExecute(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-queries:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the statement in a transaction to bypass the cache")
+	}
+	if conn.lastQueryCacheHit {
+		t.Error("Expected no cache hit in a transaction")
+	}
+
+	conn.inTransaction = false
+	if err := conn.handleExecute(data); err != nil {
+		t.Fatal(err)
+	}
+	if !conn.lastQueryCacheHit {
+		t.Error("Expected a cache hit outside of the transaction")
+	}
+}
+
+// serveStatements answers the COM_STMT_PREPARE and COM_STMT_EXECUTE packets
+// of a backend connection, which prepares statements under stmtID, and
+// records them with the COM_STMT_CLOSE packets, which have no response
+func serveStatements(t *testing.T, conn net.Conn, stmtID uint32, n int, packets chan<- []byte) {
+	tc := &testClient{t: t, conn: conn}
+	for i := 0; i < n; i++ {
+		packet := tc.read()
+		packets <- packet
+		if packet[0] == mariadbproto.ComStmtClose {
+			continue
+		}
+		if packet[0] == mariadbproto.ComStmtPrepare {
+			tc.write(mariadbproto.StmtPrepareOK{StatementID: stmtID, Params: 1}.Encode())
+			tc.write(mariadbproto.Column{Name: "?"}.Encode())
+			tc.write(mariadbproto.EOF{}.Encode())
+			continue
+		}
+		tc.write(mariadbproto.OK{}.Encode())
+	}
+}
+
+func TestPreparedStatementSwitch(t *testing.T) {
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, clientEnd := net.Pipe()
+	defer server.Close()
+	defer clientEnd.Close()
+	go io.Copy(io.Discard, clientEnd)
+	backend, backendEnd := net.Pipe()
+	defer backend.Close()
+	defer backendEnd.Close()
+	conn := &clientConn{
+		proxy:              &Proxy{cache: c},
+		conn:               server,
+		backend:            backend,
+		preparedStatements: make(map[uint32]*preparedStatement),
+	}
+
+	packets := make(chan []byte, 3)
+	go serveStatements(t, backendEnd, 7, 2, packets)
+	if err := conn.handlePrepare("SELECT name FROM users WHERE id = ?"); err != nil {
+		t.Fatal(err)
+	}
+	<-packets
+
+	// The client knows the statement by the ID of the proxy, and sends the
+	// parameter types on the first execution only
+	if err := conn.handleExecute([]byte{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 5, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{mariadbproto.ComStmtExecute, 7, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 5, 0, 0, 0, 0, 0, 0, 0}
+	if got := <-packets; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v on the backend, got %v", want, got)
+	}
+
+	// A new backend connection prepares the statement again, under another
+	// ID, and gets the parameter types
+	backend2, backendEnd2 := net.Pipe()
+	defer backend2.Close()
+	defer backendEnd2.Close()
+	conn.backend = backend2
+	go serveStatements(t, backendEnd2, 3, 2, packets)
+	if err := conn.handleExecute([]byte{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 6, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-packets; got[0] != mariadbproto.ComStmtPrepare || !strings.Contains(string(got), "SELECT name FROM users WHERE id = ?") {
+		t.Errorf("Expected the statement to be prepared again, got %q", got)
+	}
+	want = []byte{mariadbproto.ComStmtExecute, 3, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 6, 0, 0, 0, 0, 0, 0, 0}
+	if got := <-packets; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v on the backend, got %v", want, got)
+	}
+
+	// A DDL statement on the table closes the statement on the backend
+	// connection and prepares it again
+	conn.proxy.invalidateSchema(parser.Parse("ALTER TABLE users ADD COLUMN age INT"))
+	go serveStatements(t, backendEnd2, 4, 3, packets)
+	if err := conn.handleExecute([]byte{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-packets; !reflect.DeepEqual(got, []byte{mariadbproto.ComStmtClose, 3, 0, 0, 0}) {
+		t.Errorf("Expected the statement to be closed, got %v", got)
+	}
+	if got := <-packets; got[0] != mariadbproto.ComStmtPrepare {
+		t.Errorf("Expected the statement to be prepared again, got %q", got)
+	}
+	want = []byte{mariadbproto.ComStmtExecute, 4, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0x08, 0, 7, 0, 0, 0, 0, 0, 0, 0}
+	if got := <-packets; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v on the backend, got %v", want, got)
+	}
+}
+
+func TestTQDBStatus(t *testing.T) {
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Stats().RecordHit("SELECT 1")
+	c.Stats().RecordMiss("SELECT 2", 0)
+	pool := replica.NewPool("10.0.0.1:3306", []string{"10.0.0.2:3306", "10.0.0.3:3306"})
+	pool.MarkUnhealthy("10.0.0.3:3306")
+	p := &Proxy{
+		config:    config.ProxyConfig{Default: "main"},
+		pools:     map[string]*replica.Pool{"main": pool},
+		cache:     c,
+		histories: history.NewRegistry(),
+	}
+	conn := &clientConn{proxy: p, connID: 1001, lastQueryBackend: "cache", lastQueryCacheHit: true}
+
+	status := make(map[string]string)
+	for _, row := range conn.tqdbStatus() {
+		status[row[0]] = row[1]
+	}
+	for name, want := range map[string]string{
+		"Backend":                    "cache",
+		"Shard":                      "main",
+		"connection.id":              "1001",
+		"connection.last_cache_hit":  "true",
+		"cache.hit_ratio":            "0.5000",
+		"connections.active":         "0",
+		"pool.main.primary":          "10.0.0.1:3306",
+		"pool.main.replicas_healthy": "1/2",
+	} {
+		if status[name] != want {
+			t.Errorf("Expected %s = %q, got %q", name, want, status[name])
+		}
+	}
+	if _, ok := status["writebatch.batches.total"]; ok {
+		t.Error("Expected no write batch counters without write batching")
+	}
+}
+
+func TestSetKillSwitch(t *testing.T) {
+	switches := killswitch.New()
+	p := &Proxy{config: config.ProxyConfig{AdminUsers: []string{"admin"}}, switches: switches}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := &clientConn{proxy: p, conn: server, user: "app"}
+	var denied mariadbproto.Err
+	if err := conn.setKillSwitch("tqdb_cache", "OFF"); !errors.As(err, &denied) || denied.Code != mariadbproto.ErSpecificAccessDenied {
+		t.Errorf("Expected access denied for a user not in admin_users, got %v", err)
+	}
+	if !switches.Enabled(killswitch.Cache) {
+		t.Fatal("Expected the cache to stay enabled")
+	}
+
+	conn.user = "admin"
+	if err := conn.setKillSwitch("tqdb_cache", "OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if switches.Enabled(killswitch.Cache) {
+		t.Error("Expected the cache to be disabled")
+	}
+	if audit := switches.Audit(); len(audit) != 1 || audit[0].By != "admin@pipe (MariaDB)" {
+		t.Errorf("Expected the change in the audit trail, got %+v", audit)
+	}
+	if parsed := p.applyOverrides(parser.Parse("/* ttl:60 */ SELECT 1")); parsed.TTL != 0 {
+		t.Errorf("Expected the ttl hint to be ignored, got %d", parsed.TTL)
+	}
+	if err := conn.setKillSwitch("tqdb_replicas", "OFF"); err == nil {
+		t.Error("Expected an error for an unknown feature")
+	}
+}
+
+func TestTableRoutes(t *testing.T) {
+	p := &Proxy{
+		config: config.ProxyConfig{
+			Default: "shard1",
+			TableRoutes: []config.TableRoute{
+				{Table: "orders", Backend: "shard1"},
+				{Table: "order_*", Backend: "shard1"},
+				{Table: "users", Backend: "shard2"},
+			},
+		},
+		switches: killswitch.New(),
+	}
+	tests := []struct {
+		query   string
+		backend string
+	}{
+		{"SELECT * FROM orders WHERE id = 1", "shard1"},
+		{"INSERT INTO `shop`.`order_items` (id) VALUES (1)", "shard1"},
+		{"UPDATE users SET name = 'a' WHERE id = 1", "shard2"},
+		{"SELECT * FROM products", ""},
+		{"/* route:shard3 */ SELECT * FROM users", "shard2"},
+	}
+	for _, tt := range tests {
+		parsed := p.applyOverrides(parser.Parse(tt.query))
+		if backend, err := p.tableBackend(parsed.Tables); err != nil || backend != tt.backend {
+			t.Errorf("tableBackend(%q) = %q, %v, want %q", tt.query, backend, err, tt.backend)
+		}
+		if parsed.Route != parser.Parse(tt.query).Route {
+			t.Errorf("applyOverrides(%q) changed the route to %q", tt.query, parsed.Route)
+		}
+	}
+	if _, err := p.tableBackend(parser.Parse("SELECT * FROM orders JOIN users ON users.id = orders.user_id").Tables); err == nil {
+		t.Error("Expected an error for a join of tables on different backends")
+	}
+
+	// A transaction stays on the backend of its first statement on tables
+	c := &clientConn{proxy: p, inTransaction: true, lastQueryShard: "shard1"}
+	for _, query := range []string{"SELECT 1", "SELECT * FROM orders", "SELECT * FROM products"} {
+		if err := c.routeTransaction(parser.Parse(query), mustTableBackend(t, p, query)); err != nil {
+			t.Errorf("routeTransaction(%q) = %v", query, err)
+		}
+	}
+	if c.txBackend != "shard1" {
+		t.Errorf("Expected the transaction on shard1, got %q", c.txBackend)
+	}
+	query := "UPDATE users SET name = 'a' WHERE id = 1"
+	if err := c.routeTransaction(parser.Parse(query), mustTableBackend(t, p, query)); err == nil {
+		t.Error("Expected an error for a statement on another backend in the transaction")
+	}
+}
+
+func mustTableBackend(t *testing.T, p *Proxy, query string) string {
+	t.Helper()
+	backend, err := p.tableBackend(parser.Parse(query).Tables)
+	if err != nil {
+		t.Fatalf("tableBackend(%q): %v", query, err)
+	}
+	return backend
+}
+
+func TestCacheTTL(t *testing.T) {
+	rows := mariadbproto.ResultSet{
+		Columns: []mariadbproto.Column{{Name: "id"}},
+		Rows:    [][][]byte{{[]byte("1")}},
+	}
+	withRows, _ := rows.AppendPackets(nil, 1)
+	empty, _ := mariadbproto.ResultSet{Columns: rows.Columns}.AppendPackets(nil, 1)
+	noTable := mariadbproto.AppendPacket(nil, 1, mariadbproto.Err{Code: 1146, State: "42S02", Message: "Table 'shop.missing' doesn't exist"}.Encode())
+	deadlock := mariadbproto.AppendPacket(nil, 1, mariadbproto.Err{Code: 1213, State: "40001", Message: "Deadlock found"}.Encode())
+
+	tests := []struct {
+		name     string
+		response []byte
+		negTTL   time.Duration
+		expected time.Duration
+	}{
+		{"rows", withRows, 5 * time.Second, time.Minute},
+		{"empty", empty, 5 * time.Second, 5 * time.Second},
+		{"empty without negcache", empty, 0, time.Minute},
+		{"deterministic error", noTable, 5 * time.Second, 5 * time.Second},
+		{"deterministic error without negcache", noTable, 0, 0},
+		{"transient error", deadlock, 5 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := cacheTTL(tt.response, time.Minute, tt.negTTL); got != tt.expected {
+			t.Errorf("%s: cacheTTL() = %v, expected %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestIsBackendConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset")}, true},
+		{mariadbproto.Err{Code: 1053, State: "08S01", Message: "Server shutdown in progress"}, true},
+		{mariadbproto.Err{Code: mariadbproto.ErParseError, State: "42000", Message: "syntax error"}, false},
+		{errors.New("access denied"), false},
+	}
+	for _, tt := range tests {
+		if got := isBackendConnError(tt.err); got != tt.want {
+			t.Errorf("isBackendConnError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	response := append([]byte{0, 0, 0, 1}, mariadbproto.Err{Code: 1053, State: "08S01", Message: "Server shutdown in progress"}.Encode()...)
+	if err := responseError(response, nil); !isBackendConnError(err) {
+		t.Errorf("Expected a shutdown error packet to be retried, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package mariadb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// readResults returns the first column of every row of every result set
+func readResults(t *testing.T, rows *sql.Rows) [][]int {
+	t.Helper()
+	defer rows.Close()
+	var results [][]int
+	for {
+		var values []int
+		for rows.Next() {
+			var v int
+			if err := rows.Scan(&v); err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			values = append(values, v)
+		}
+		results = append(results, values)
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Reading results failed: %v", err)
+	}
+	return results
+}
+
+func TestStoredProcedureCall(t *testing.T) {
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "DROP PROCEDURE IF EXISTS tqdb_two_results"); err != nil {
+		t.Fatalf("Failed to drop procedure: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, "CREATE PROCEDURE tqdb_two_results() BEGIN SELECT 1 UNION SELECT 2; SELECT 3; END"); err != nil {
+		t.Fatalf("Failed to create procedure: %v", err)
+	}
+	defer conn.ExecContext(ctx, "DROP PROCEDURE tqdb_two_results")
+
+	// Twice, so that the connection is still in sync after the first CALL
+	for i := 0; i < 2; i++ {
+		rows, err := conn.QueryContext(ctx, "CALL tqdb_two_results()")
+		if err != nil {
+			t.Fatalf("CALL failed: %v", err)
+		}
+		results := readResults(t, rows)
+		if len(results) < 2 || len(results[0]) != 2 || len(results[1]) != 1 || results[1][0] != 3 {
+			t.Errorf("Expected the result sets [1 2] and [3], got %v", results)
+		}
+	}
+
+	var one int
+	if err := conn.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil || one != 1 {
+		t.Errorf("Expected the connection to be usable after CALL, got %d (%v)", one, err)
+	}
+}
+
+func TestMultiStatementResults(t *testing.T) {
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy")+"?multiStatements=true")
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get connection: %v", err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT 1; SELECT 2 UNION SELECT 3")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	results := readResults(t, rows)
+	if len(results) != 2 || len(results[0]) != 1 || len(results[1]) != 2 {
+		t.Errorf("Expected the result sets [1] and [2 3], got %v", results)
+	}
+
+	// The statements after a failing one are not executed
+	if _, err := conn.ExecContext(ctx, "SELECT 1; SELECT no_such_column; SET @tqdb_after_error = 1"); err == nil {
+		t.Error("Expected the error of the second statement")
+	}
+	var after sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT @tqdb_after_error").Scan(&after); err != nil {
+		t.Fatalf("Query after the error failed: %v", err)
+	}
+	if after.Valid {
+		t.Errorf("Expected the statement after the error not to run, got %d", after.Int64)
+	}
+}
@@ -10,7 +10,7 @@ import (
 )
 
 func TestPreparedStatements(t *testing.T) {
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -36,7 +36,7 @@ func TestPreparedStatements(t *testing.T) {
 }
 
 func TestPreparedStatements_Caching(t *testing.T) {
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -103,7 +103,7 @@ func isCacheHit(t *testing.T, db *sql.DB) bool {
 }
 
 func TestPreparedStatements_ResetClose(t *testing.T) {
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -144,7 +144,7 @@ func TestPreparedStatements_ResetClose(t *testing.T) {
 }
 func TestPreparedStatements_CrossSession(t *testing.T) {
 	// 1. Session A: Executes and caches
-	db1, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db1, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -157,7 +157,7 @@ func TestPreparedStatements_CrossSession(t *testing.T) {
 	}
 
 	// 2. Session B: Should hit cache even with different connection/session
-	db2, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db2, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to second session: %v", err)
 	}
@@ -174,7 +174,7 @@ func TestPreparedStatements_CrossSession(t *testing.T) {
 	}
 }
 func TestPreparedStatements_MultipleIDs(t *testing.T) {
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -0,0 +1,140 @@
+package mariadb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	mysql "github.com/go-sql-driver/mysql"
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// refreshConn is a backend connection of the proxy for the background
+// refreshes of cached results, see refreshFunc, or for the verification of
+// cache hits, see verifyCacheHit
+type refreshConn struct {
+	mu   sync.Mutex
+	conn *clientConn // Connection without a client (nil = not connected)
+}
+
+// refreshFunc returns the function that refreshes a cached result of the
+// session in the background, see cache.RunRefresh. The query runs on a
+// replica of the backend of the session (or the primary when no replica is
+// healthy), in the database of the session, on a connection of the proxy
+// with the credentials of the backend configuration.
+func (c *clientConn) refreshFunc(parsed *parser.ParsedQuery, ttl, negTTL time.Duration) cache.RefreshFunc {
+	p, shard, db, query := c.proxy, c.shard(), c.db, parsed.Query
+	maxLag := time.Duration(parsed.MaxLagMs) * time.Millisecond
+	return func(ctx context.Context) ([]byte, time.Duration, error) {
+		response, err := p.refresh(ctx, shard, db, query, maxLag)
+		if err != nil {
+			return nil, 0, err
+		}
+		return response, cacheTTL(response, ttl, negTTL), nil
+	}
+}
+
+// refresh executes a query for a background refresh and returns the response
+func (p *Proxy) refresh(ctx context.Context, shard, db, query string, maxLag time.Duration) ([]byte, error) {
+	return p.proxyQuery(ctx, &p.refreshConns, shard, db, query, func(pool *replica.Pool) (string, string) {
+		return pool.GetReplicaMaxLag(maxLag)
+	})
+}
+
+// verify executes the query of a sampled cache hit on the primary of the
+// backend and returns the response, see verifyCacheHit
+func (p *Proxy) verify(ctx context.Context, shard, db, query string) ([]byte, error) {
+	return p.proxyQuery(ctx, &p.verifyConns, shard, db, query, func(pool *replica.Pool) (string, string) {
+		return pool.GetPrimary(), "primary"
+	})
+}
+
+// proxyQuery executes a query on a backend connection of the proxy from
+// conns, with the credentials of the backend configuration, on the backend of
+// the shard that pick chooses, and returns the response
+func (p *Proxy) proxyQuery(ctx context.Context, conns *sync.Map, shard, db, query string, pick func(*replica.Pool) (string, string)) ([]byte, error) {
+	p.mu.RLock()
+	pool := p.pools[shard]
+	backend := p.config.Backends[shard]
+	p.mu.RUnlock()
+	if pool == nil {
+		return nil, fmt.Errorf("unknown backend %q", shard)
+	}
+	addr, name := pick(pool)
+
+	v, _ := conns.LoadOrStore(backend.Username+"@"+addr, &refreshConn{})
+	rc := v.(*refreshConn)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.conn == nil || rc.conn.backend == nil {
+		conn, err := p.dialRefresh(ctx, addr, backend)
+		if err != nil {
+			return nil, err
+		}
+		rc.conn = &clientConn{proxy: p, backend: conn, backendAddr: addr, backendName: name, db: backend.Database}
+	}
+	c := rc.conn
+
+	if backendDB, _ := p.backendDatabase(db); backendDB != "" && backendDB != c.db {
+		response, err := c.execBackendQuery(fmt.Sprintf("USE `%s`", backendDB))
+		if err != nil {
+			return nil, err
+		}
+		if isError(response) {
+			return nil, fmt.Errorf("cannot select database %s on %s", backendDB, addr)
+		}
+		c.db = backendDB
+	}
+	if name != "primary" {
+		defer pool.Track(addr)()
+	}
+	response, err := c.execBackendQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	metrics.DatabaseQueries.WithLabelValues(name).Inc()
+	return response, nil
+}
+
+// dialRefresh opens a connection for background refreshes to addr, with the
+// credentials of backend
+func (p *Proxy) dialRefresh(ctx context.Context, addr string, backend config.BackendConfig) (net.Conn, error) {
+	connector, err := p.backendConnector(addr, backend)
+	if err != nil {
+		return nil, err
+	}
+	dbConn, err := connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	raw := mysql.GetRawConn(dbConn)
+	if raw == nil {
+		dbConn.Close()
+		return nil, errors.New("failed to get raw connection from driver")
+	}
+	return raw, nil
+}
+
+// closeRefreshConns closes the connections for background refreshes and for
+// the verification of cache hits
+func (p *Proxy) closeRefreshConns() {
+	for _, conns := range []*sync.Map{&p.refreshConns, &p.verifyConns} {
+		conns.Range(func(key, v any) bool {
+			conns.Delete(key)
+			rc := v.(*refreshConn)
+			rc.mu.Lock()
+			if rc.conn != nil {
+				rc.conn.resetBackend()
+			}
+			rc.mu.Unlock()
+			return true
+		})
+	}
+}
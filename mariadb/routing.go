@@ -0,0 +1,197 @@
+package mariadb
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	mysql "github.com/go-sql-driver/mysql"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/writebatch"
+)
+
+// routeBatch is the write batching of the tables routed to a backend other
+// than the default backend, see batchManager
+type routeBatch struct {
+	db      *sql.DB
+	manager *writebatch.Manager
+}
+
+// tableBackend returns the backend of the tables of a statement, see
+// config.ProxyConfig.RouteTables
+func (p *Proxy) tableBackend(tables []string) (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config.RouteTables(tables)
+}
+
+// databaseShard returns the backend of a database of a client
+func (p *Proxy) databaseShard(db string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if shardName := p.config.DBMap[db]; shardName != "" {
+		return shardName
+	}
+	return p.config.Default
+}
+
+// batchManager returns the write batch manager for the writes on tables
+// routed to a backend, or on tables without a route (empty backend). The
+// manager of the default backend is started with the proxy, the managers of
+// other backends on their first batched write, without spool. It returns nil
+// when write batching is not running.
+func (p *Proxy) batchManager(backend string) *writebatch.Manager {
+	p.mu.RLock()
+	wb, rb := p.writeBatch, p.routeBatches[backend]
+	routed := backend != "" && backend != p.config.Default
+	pool, backendCfg := p.pools[backend], p.config.Backends[backend]
+	p.mu.RUnlock()
+	if wb == nil || !routed {
+		return wb
+	}
+	if rb != nil {
+		return rb.manager
+	}
+	if pool == nil {
+		return nil
+	}
+	db, err := p.openBackend(pool.GetPrimary(), backendCfg)
+	if err != nil {
+		log.Printf("[MariaDB] Cannot start write batching for backend %s: %v", backend, err)
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rb := p.routeBatches[backend]; rb != nil || p.db == nil {
+		// Started by another session meanwhile, or the proxy stopped
+		db.Close()
+		if rb == nil {
+			return nil
+		}
+		return rb.manager
+	}
+	if p.routeBatches == nil {
+		p.routeBatches = make(map[string]*routeBatch)
+	}
+	rb = &routeBatch{db: db, manager: writebatch.New(db, writeBatchConfig(p.config, p.batchClock))}
+	p.routeBatches[backend] = rb
+	log.Printf("[MariaDB] Write batching started for backend %s", backend)
+	return rb.manager
+}
+
+// routeBatchManagers returns the write batch managers of the routed tables.
+// The caller holds p.mu.
+func (p *Proxy) routeBatchManagers() []*writebatch.Manager {
+	managers := make([]*writebatch.Manager, 0, len(p.routeBatches))
+	for _, rb := range p.routeBatches {
+		managers = append(managers, rb.manager)
+	}
+	return managers
+}
+
+// closeRouteBatches stops the write batching of the routed tables, executing
+// the pending batches
+func (p *Proxy) closeRouteBatches() {
+	p.mu.Lock()
+	batches := p.routeBatches
+	p.routeBatches = nil
+	p.mu.Unlock()
+	for backend, rb := range batches {
+		if err := rb.manager.Close(); err != nil {
+			log.Printf("[MariaDB] Error closing write batch manager of backend %s: %v", backend, err)
+		}
+		rb.db.Close()
+	}
+}
+
+// backendKey scopes the cache key of a statement on routed tables to their
+// backend
+func backendKey(backend, key string) string {
+	if backend == "" {
+		return key
+	}
+	return backend + ":" + key
+}
+
+// route switches the connection to the backend of a statement: the backend
+// named by a route hint, or else the backend of its tables, or else the
+// backend of the session. In a transaction, route hints are ignored and the
+// tables decide, see routeTransaction. It returns the backend of the tables,
+// empty when they have no route.
+func (c *clientConn) route(parsed *parser.ParsedQuery) (string, error) {
+	tableBackend, err := c.proxy.tableBackend(parsed.Tables)
+	if err != nil {
+		return "", err
+	}
+	if c.pinned() {
+		return tableBackend, c.routeTransaction(parsed, tableBackend)
+	}
+	c.txBegin, c.txBackend = "", ""
+
+	// A route to a backend applies to its statement only
+	backend := parsed.RouteBackend()
+	if backend == "" {
+		backend = tableBackend
+	}
+	if backend != "" {
+		if err := c.ensureRoute(backend); err != nil {
+			return "", err
+		}
+		c.routedShard = true
+	} else if c.routedShard {
+		c.routedShard = false
+		if err := c.ensureBackend(c.db); err != nil {
+			return "", err
+		}
+	}
+	return tableBackend, nil
+}
+
+// routeTransaction keeps the statements on tables of a transaction on one
+// backend. A transaction that ran no statements on tables yet moves to the
+// backend of the tables of its first one, later statements on the tables of
+// another backend are rejected. Tables without a route are on the backend of
+// the session.
+func (c *clientConn) routeTransaction(parsed *parser.ParsedQuery, tableBackend string) error {
+	if len(parsed.Tables) == 0 {
+		return nil
+	}
+	backend := tableBackend
+	if backend == "" {
+		backend = c.proxy.databaseShard(c.db)
+	}
+	if c.txBackend == "" {
+		if backend != c.shard() && c.txBegin != "" {
+			if err := c.moveTransaction(backend); err != nil {
+				return err
+			}
+		}
+		c.txBegin, c.txBackend = "", c.shard()
+	}
+	if backend != c.txBackend {
+		return fmt.Errorf("statement on tables of backend %q in a transaction on backend %q, a transaction cannot span backends", backend, c.txBackend)
+	}
+	return nil
+}
+
+// moveTransaction starts the transaction of the session, which ran no
+// statements on tables yet, again on another backend. The transaction on the
+// former backend connection ends with it.
+func (c *clientConn) moveTransaction(backend string) error {
+	status := c.status
+	c.endTransaction()
+	if err := c.ensureRoute(backend); err != nil {
+		c.status, c.inTransaction = status, true
+		return err
+	}
+	c.routedShard = true
+	response, err := c.execBackendQuery(c.txBegin)
+	if err := responseError(response, err); err != nil {
+		return err
+	}
+	c.status |= mysql.StatusInTrans
+	c.inTransaction = true
+	log.Printf("[MariaDB] Transaction of conn %d moved to backend %s", c.connID, backend)
+	return nil
+}
@@ -1,15 +1,29 @@
 package mariadb
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	mysql "github.com/go-sql-driver/mysql"
 	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
 	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
 )
 
 // DEFAULT_CAPABILITY is used for testing
@@ -269,6 +283,119 @@ func TestInitialHandshake(t *testing.T) {
 		t.Errorf("Expected user tqdbproxy, got %s", conn.user)
 	}
 }
+
+// writeTestCert writes a self-signed certificate and its key for a listener
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tqdbproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "proxy.pem"), filepath.Join(dir, "proxy-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestListenerTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	pcfg := config.ProxyConfig{Default: "main", Listeners: []config.ListenerConfig{
+		{Name: "tls", TLSCert: certFile, TLSKey: keyFile, TLSMode: tlsopt.ModeRequire},
+	}}
+	proxy := New(pcfg, map[string]*replica.Pool{"main": replica.NewPool("127.0.0.1:3306", nil)}, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// connect runs the greeting and handshake response of a client of the
+	// listener, over TLS when useTLS is set. It returns whether the greeting
+	// offered TLS and the result of reading the handshake response.
+	connect := func(listener string, useTLS bool) (bool, error) {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		c := proxy.newClientConn(server, 1, listener)
+		c.salt = []byte("12345678901234567890")
+		authErr := make(chan error, 1)
+		go func() {
+			if err := c.writeServerGreeting(""); err != nil {
+				authErr <- err
+				return
+			}
+			authErr <- c.readClientAuth()
+		}()
+
+		var conn net.Conn = client
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		greeting, _, err := mariadbproto.ReadPacket(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version := bytes.IndexByte(greeting[1:], 0) + 1
+		offered := binary.LittleEndian.Uint16(greeting[version+1+4+8+1:])&uint16(mysql.ClientSSL) != 0
+
+		capability := DEFAULT_CAPABILITY
+		seq := byte(1)
+		if useTLS {
+			capability |= uint32(mysql.ClientSSL)
+			request := make([]byte, sslRequestSize)
+			binary.LittleEndian.PutUint32(request, capability)
+			request[8] = 33
+			if err := mariadbproto.WritePacket(conn, seq, request); err != nil {
+				t.Fatal(err)
+			}
+			seq++
+			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+		resp := make([]byte, sslRequestSize)
+		binary.LittleEndian.PutUint32(resp, capability)
+		resp[8] = 33
+		resp = append(resp, "tqdbproxy\x00"...)
+		resp = append(resp, 4, 1, 2, 3, 4)
+		if err := mariadbproto.WritePacket(conn, seq, resp); err != nil {
+			t.Fatal(err)
+		}
+		err = <-authErr
+		if err == nil && c.user != "tqdbproxy" {
+			t.Errorf("Expected user tqdbproxy, got %q", c.user)
+		}
+		return offered, err
+	}
+
+	if offered, err := connect("tls", true); !offered || err != nil {
+		t.Errorf("Expected TLS on the TLS listener, got offered %v, error %v", offered, err)
+	}
+	if offered, err := connect("", false); offered || err != nil {
+		t.Errorf("Expected plaintext on the plaintext listener, got offered %v, error %v", offered, err)
+	}
+	if _, err := connect("tls", false); err == nil {
+		t.Error("Expected the TLS listener to reject a plaintext client")
+	}
+}
+
 func TestSharding_Use(t *testing.T) {
 	// Setup two mock backends
 	l1, addr1, stop1 := mockBackend(t, "127.0.0.1:0")
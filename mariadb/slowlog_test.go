@@ -0,0 +1,27 @@
+package mariadb
+
+import (
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/mariadbproto"
+)
+
+func TestExplainPlan(t *testing.T) {
+	rs := mariadbproto.ResultSet{
+		Columns: []mariadbproto.Column{{Name: "id"}, {Name: "table"}, {Name: "key"}},
+		Rows:    [][][]byte{{[]byte("1"), []byte("users"), nil}},
+	}
+	response, _ := rs.AppendPackets(nil, 1)
+	plan, err := explainPlan(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "id\ttable\tkey\n1\tusers\tNULL"; plan != expected {
+		t.Errorf("explainPlan() = %q, expected %q", plan, expected)
+	}
+
+	errResponse := mariadbproto.AppendPacket(nil, 1, mariadbproto.Err{Code: 1064, State: "42000", Message: "syntax error"}.Encode())
+	if _, err := explainPlan(errResponse); err == nil {
+		t.Error("Expected the error of the backend")
+	}
+}
@@ -10,7 +10,7 @@ import (
 
 func TestTransactions(t *testing.T) {
 	// Connect to the proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
@@ -95,7 +95,7 @@ func TestTransactions(t *testing.T) {
 
 func TestTransactionWithCache(t *testing.T) {
 	// Connect to the proxy
-	db, err := sql.Open("mysql", "tqdbproxy:tqdbproxy@tcp(127.0.0.1:3307)/tqdbproxy")
+	db, err := sql.Open("mysql", proxyDSN("tqdbproxy"))
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
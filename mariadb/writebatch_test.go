@@ -22,7 +22,7 @@ func TestWriteBatchIntegration(t *testing.T) {
 		Default: "main",
 		Backends: map[string]config.BackendConfig{
 			"main": {
-				Primary: "127.0.0.1:3306",
+				Primary: backendAddr(),
 			},
 		},
 		WriteBatch: config.WriteBatchConfig{
@@ -32,7 +32,7 @@ func TestWriteBatchIntegration(t *testing.T) {
 
 	pools := map[string]*replica.Pool{
 		"main": replica.NewPool(
-			"127.0.0.1:3306",
+			backendAddr(),
 			[]string{},
 		),
 	}
@@ -197,7 +197,7 @@ func TestWriteBatchManagerLifecycle(t *testing.T) {
 		Listen:  ":13308",
 		Default: "main",
 		Backends: map[string]config.BackendConfig{
-			"main": {Primary: "127.0.0.1:3306"},
+			"main": {Primary: backendAddr()},
 		},
 		WriteBatch: config.WriteBatchConfig{
 			MaxBatchSize: 1000,
@@ -205,7 +205,7 @@ func TestWriteBatchManagerLifecycle(t *testing.T) {
 	}
 
 	pools := map[string]*replica.Pool{
-		"main": replica.NewPool("127.0.0.1:3306", []string{}),
+		"main": replica.NewPool(backendAddr(), []string{}),
 	}
 
 	c, err := cache.New(cache.DefaultCacheConfig())
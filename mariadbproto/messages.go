@@ -0,0 +1,559 @@
+package mariadbproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Commands sent by clients, as the first byte of a command packet
+const (
+	ComQuit             = 0x01
+	ComInitDB           = 0x02
+	ComQuery            = 0x03
+	ComFieldList        = 0x04
+	ComPing             = 0x0E
+	ComStmtPrepare      = 0x16
+	ComStmtExecute      = 0x17
+	ComStmtSendLongData = 0x18
+	ComStmtClose        = 0x19
+	ComStmtReset        = 0x1A
+	ComSetOption        = 0x1B
+	ComStmtFetch        = 0x1C
+)
+
+// Flags of COM_STMT_EXECUTE
+// https://mariadb.com/kb/en/com_stmt_execute/
+const (
+	CursorTypeReadOnly = 0x01
+)
+
+// Commands sent by replicas
+// https://mariadb.com/kb/en/com_binlog_dump/
+const (
+	ComBinlogDump    = 0x12
+	ComRegisterSlave = 0x15
+)
+
+// Options of COM_SET_OPTION
+// https://mariadb.com/kb/en/com_set_option/
+const (
+	OptionMultiStatementsOn  = 0
+	OptionMultiStatementsOff = 1
+)
+
+// Column types, which are also the types of the binary protocol values
+// https://mariadb.com/kb/en/result-set-packets/#field-types
+const (
+	TypeDecimal    = 0x00
+	TypeTiny       = 0x01
+	TypeShort      = 0x02
+	TypeLong       = 0x03
+	TypeFloat      = 0x04
+	TypeDouble     = 0x05
+	TypeNull       = 0x06
+	TypeTimestamp  = 0x07
+	TypeLongLong   = 0x08
+	TypeInt24      = 0x09
+	TypeDate       = 0x0A
+	TypeTime       = 0x0B
+	TypeDateTime   = 0x0C
+	TypeYear       = 0x0D
+	TypeVarChar    = 0x0F
+	TypeBit        = 0x10
+	TypeJSON       = 0xF5
+	TypeNewDecimal = 0xF6
+	TypeEnum       = 0xF7
+	TypeSet        = 0xF8
+	TypeTinyBlob   = 0xF9
+	TypeMediumBlob = 0xFA
+	TypeLongBlob   = 0xFB
+	TypeBlob       = 0xFC
+	TypeVarString  = 0xFD
+	TypeString     = 0xFE
+	TypeGeometry   = 0xFF
+
+	// Flag in the second byte of a parameter type of COM_STMT_EXECUTE
+	ParamUnsigned = 0x80
+)
+
+// Command returns the payload of a command packet with the given arguments
+func Command(cmd byte, data []byte) []byte {
+	return append([]byte{cmd}, data...)
+}
+
+// Query returns the payload of a COM_QUERY packet
+func Query(query string) []byte {
+	return append([]byte{ComQuery}, query...)
+}
+
+// OK is an OK packet
+// https://mariadb.com/kb/en/ok_packet/
+type OK struct {
+	AffectedRows uint64
+	LastInsertID uint64
+	Status       uint16
+	Warnings     uint16
+	Info         string
+}
+
+// Encode returns the payload of the OK packet
+func (m OK) Encode() []byte {
+	payload := []byte{OKHeader}
+	payload = AppendLenEncInt(payload, m.AffectedRows)
+	payload = AppendLenEncInt(payload, m.LastInsertID)
+	payload = binary.LittleEndian.AppendUint16(payload, m.Status)
+	payload = binary.LittleEndian.AppendUint16(payload, m.Warnings)
+	return append(payload, m.Info...)
+}
+
+// ParseOK parses the payload of an OK packet
+func ParseOK(payload []byte) (OK, error) {
+	if !IsOK(payload) {
+		return OK{}, fmt.Errorf("mariadbproto: not an OK packet")
+	}
+	var m OK
+	pos := 1
+	var n int
+	if m.AffectedRows, _, n = ReadLenEncInt(payload[pos:]); n == 0 {
+		return OK{}, ErrShortPacket
+	}
+	pos += n
+	if m.LastInsertID, _, n = ReadLenEncInt(payload[pos:]); n == 0 {
+		return OK{}, ErrShortPacket
+	}
+	pos += n
+	if len(payload) < pos+4 {
+		return OK{}, ErrShortPacket
+	}
+	m.Status = binary.LittleEndian.Uint16(payload[pos:])
+	m.Warnings = binary.LittleEndian.Uint16(payload[pos+2:])
+	m.Info = string(payload[pos+4:])
+	return m, nil
+}
+
+// EOF is an EOF packet
+// https://mariadb.com/kb/en/eof_packet/
+type EOF struct {
+	Warnings uint16
+	Status   uint16
+}
+
+// Encode returns the payload of the EOF packet
+func (m EOF) Encode() []byte {
+	payload := []byte{EOFHeader}
+	payload = binary.LittleEndian.AppendUint16(payload, m.Warnings)
+	return binary.LittleEndian.AppendUint16(payload, m.Status)
+}
+
+// ParseEOF parses the payload of an EOF packet
+func ParseEOF(payload []byte) (EOF, error) {
+	if !IsEOF(payload) {
+		return EOF{}, fmt.Errorf("mariadbproto: not an EOF packet")
+	}
+	if len(payload) < 5 {
+		return EOF{}, ErrShortPacket
+	}
+	return EOF{
+		Warnings: binary.LittleEndian.Uint16(payload[1:]),
+		Status:   binary.LittleEndian.Uint16(payload[3:]),
+	}, nil
+}
+
+// Err is an error packet. It implements error, so that backend errors can
+// be passed on as such.
+// https://mariadb.com/kb/en/err_packet/
+type Err struct {
+	Code    uint16
+	State   string // SQLSTATE, 5 characters
+	Message string
+}
+
+// Generic error codes
+const (
+	ErUnknownError            = 1105
+	ErConCountError           = 1040
+	ErDBAccessDenied          = 1044
+	ErAccessDeniedError       = 1045
+	ErUserLimitReached        = 1226
+	ErSpecificAccessDenied    = 1227
+	ErOptionPreventsStatement = 1290
+	ErUnknownComError         = 1047
+	ErParseError              = 1064
+	ErNeedReprepare           = 1615
+	StateGeneralError         = "HY000"
+	StateConnectionError      = "08004"
+	StateAccessDenied         = "28000"
+	StateAccessViolation      = "42000"
+	StateUnknownCommand       = "08S01"
+)
+
+func (m Err) Error() string {
+	return fmt.Sprintf("Error %d (%s): %s", m.Code, m.State, m.Message)
+}
+
+// Encode returns the payload of the error packet
+func (m Err) Encode() []byte {
+	payload := binary.LittleEndian.AppendUint16([]byte{ErrHeader}, m.Code)
+	state := m.State
+	if len(state) != 5 {
+		state = StateGeneralError
+	}
+	payload = append(append(payload, '#'), state...)
+	return append(payload, m.Message...)
+}
+
+// ParseErr parses the payload of an error packet
+func ParseErr(payload []byte) (Err, error) {
+	if !IsErr(payload) {
+		return Err{}, fmt.Errorf("mariadbproto: not an error packet")
+	}
+	if len(payload) < 3 {
+		return Err{}, ErrShortPacket
+	}
+	m := Err{Code: binary.LittleEndian.Uint16(payload[1:])}
+	rest := payload[3:]
+	if len(rest) >= 6 && rest[0] == '#' {
+		m.State = string(rest[1:6])
+		rest = rest[6:]
+	}
+	m.Message = string(rest)
+	return m, nil
+}
+
+// Column is a column definition packet of a result set
+// https://mariadb.com/kb/en/result-set-packets/#column-definition-packet
+type Column struct {
+	Schema   string
+	Table    string
+	OrgTable string
+	Name     string
+	OrgName  string
+	Charset  uint16
+	Length   uint32
+	Type     byte
+	Flags    uint16
+	Decimals byte
+}
+
+// Encode returns the payload of the column definition
+func (m Column) Encode() []byte {
+	payload := AppendLenEncString(nil, []byte("def"))
+	for _, s := range []string{m.Schema, m.Table, m.OrgTable, m.Name, m.OrgName} {
+		payload = AppendLenEncString(payload, []byte(s))
+	}
+	payload = append(payload, 0x0C) // length of the fixed fields
+	payload = binary.LittleEndian.AppendUint16(payload, m.Charset)
+	payload = binary.LittleEndian.AppendUint32(payload, m.Length)
+	payload = append(payload, m.Type)
+	payload = binary.LittleEndian.AppendUint16(payload, m.Flags)
+	return append(payload, m.Decimals, 0, 0)
+}
+
+// ParseColumn parses the payload of a column definition
+func ParseColumn(payload []byte) (Column, error) {
+	var fields [6]string // catalog, schema, table, org_table, name, org_name
+	pos := 0
+	for i := range fields {
+		s, _, n := ReadLenEncString(payload[pos:])
+		if n == 0 {
+			return Column{}, ErrShortPacket
+		}
+		fields[i] = string(s)
+		pos += n
+	}
+	if len(payload) < pos+13 {
+		return Column{}, ErrShortPacket
+	}
+	fixed := payload[pos+1:]
+	return Column{
+		Schema:   fields[1],
+		Table:    fields[2],
+		OrgTable: fields[3],
+		Name:     fields[4],
+		OrgName:  fields[5],
+		Charset:  binary.LittleEndian.Uint16(fixed[0:]),
+		Length:   binary.LittleEndian.Uint32(fixed[2:]),
+		Type:     fixed[6],
+		Flags:    binary.LittleEndian.Uint16(fixed[7:]),
+		Decimals: fixed[9],
+	}, nil
+}
+
+// EncodeTextRow returns the payload of a text protocol row, with nil values
+// encoded as NULL
+func EncodeTextRow(values [][]byte) []byte {
+	var payload []byte
+	for _, v := range values {
+		if v == nil {
+			payload = append(payload, 0xFB)
+			continue
+		}
+		payload = AppendLenEncString(payload, v)
+	}
+	return payload
+}
+
+// ParseTextRow parses the payload of a text protocol row with the given
+// number of columns, returning nil for NULL values
+func ParseTextRow(payload []byte, columns int) ([][]byte, error) {
+	values := make([][]byte, columns)
+	pos := 0
+	for i := range values {
+		v, null, n := ReadLenEncString(payload[pos:])
+		if n == 0 {
+			return nil, ErrShortPacket
+		}
+		if !null {
+			values[i] = bytes.Clone(v)
+		}
+		pos += n
+	}
+	return values, nil
+}
+
+// ResultSet is a text protocol result set
+// https://mariadb.com/kb/en/result-set-packets/
+type ResultSet struct {
+	Columns []Column
+	Rows    [][][]byte // Values per row, nil for NULL
+	Status  uint16     // Status flags of the EOF packets
+}
+
+// AppendPackets appends the packets of the result set to dst, numbered from
+// seq+1, and returns the sequence number of the last packet
+func (rs ResultSet) AppendPackets(dst []byte, seq byte) ([]byte, byte) {
+	seq++
+	dst = AppendPacket(dst, seq, AppendLenEncInt(nil, uint64(len(rs.Columns))))
+	for _, col := range rs.Columns {
+		seq++
+		dst = AppendPacket(dst, seq, col.Encode())
+	}
+	seq++
+	dst = AppendPacket(dst, seq, EOF{Status: rs.Status}.Encode())
+	for _, row := range rs.Rows {
+		seq++
+		dst = AppendPacket(dst, seq, EncodeTextRow(row))
+	}
+	seq++
+	dst = AppendPacket(dst, seq, EOF{Status: rs.Status}.Encode())
+	return dst, seq
+}
+
+// StmtPrepareOK is the first packet of a successful COM_STMT_PREPARE
+// response, followed by the parameter and column definitions
+// https://mariadb.com/kb/en/com_stmt_prepare/#com_stmt_prepare_ok
+type StmtPrepareOK struct {
+	StatementID uint32
+	Columns     uint16
+	Params      uint16
+	Warnings    uint16
+}
+
+// ParseStmtPrepareOK parses the payload of a COM_STMT_PREPARE OK packet
+func ParseStmtPrepareOK(payload []byte) (StmtPrepareOK, error) {
+	if !IsOK(payload) {
+		return StmtPrepareOK{}, fmt.Errorf("mariadbproto: not a COM_STMT_PREPARE OK packet")
+	}
+	if len(payload) < 9 {
+		return StmtPrepareOK{}, ErrShortPacket
+	}
+	m := StmtPrepareOK{
+		StatementID: binary.LittleEndian.Uint32(payload[1:]),
+		Columns:     binary.LittleEndian.Uint16(payload[5:]),
+		Params:      binary.LittleEndian.Uint16(payload[7:]),
+	}
+	if len(payload) >= 12 {
+		m.Warnings = binary.LittleEndian.Uint16(payload[10:])
+	}
+	return m, nil
+}
+
+// Encode returns the payload of the COM_STMT_PREPARE OK packet
+func (m StmtPrepareOK) Encode() []byte {
+	payload := binary.LittleEndian.AppendUint32([]byte{OKHeader}, m.StatementID)
+	payload = binary.LittleEndian.AppendUint16(payload, m.Columns)
+	payload = binary.LittleEndian.AppendUint16(payload, m.Params)
+	payload = append(payload, 0)
+	return binary.LittleEndian.AppendUint16(payload, m.Warnings)
+}
+
+// ParseStmtExecuteParams decodes the parameter values of the data of a
+// COM_STMT_EXECUTE (the payload after the command byte) of a statement with
+// numParams parameters. Clients send the parameter types on the first
+// execution only, so types holds the types of an earlier execution, which
+// the types in data replace. It returns the values, as nil, int64, uint64,
+// float64, string or []byte, and the types in effect.
+// https://mariadb.com/kb/en/com_stmt_execute/
+func ParseStmtExecuteParams(data []byte, numParams int, types []byte) ([]interface{}, []byte, error) {
+	if numParams == 0 {
+		return nil, types, nil
+	}
+	nullBitmap := 9 // After the statement ID, flags and iteration count
+	pos := nullBitmap + (numParams+7)/8
+	if len(data) <= pos {
+		return nil, nil, ErrShortPacket
+	}
+	pos++
+	if data[pos-1] == 1 {
+		if len(data) < pos+2*numParams {
+			return nil, nil, ErrShortPacket
+		}
+		types = slices.Clone(data[pos : pos+2*numParams])
+		pos += 2 * numParams
+	}
+	if len(types) != 2*numParams {
+		return nil, nil, fmt.Errorf("mariadbproto: no types of %d parameters", numParams)
+	}
+
+	values := make([]interface{}, numParams)
+	for i := range values {
+		if data[nullBitmap+i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		v, n, err := readBinaryValue(data[pos:], types[2*i], types[2*i+1]&ParamUnsigned != 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("mariadbproto: parameter %d: %w", i+1, err)
+		}
+		values[i] = v
+		pos += n
+	}
+	return values, types, nil
+}
+
+// readBinaryValue reads a binary protocol value of the type, returning the
+// value and its length. Dates and times are returned in their text form.
+// https://mariadb.com/kb/en/resultset-row/#binary-resultset-row
+func readBinaryValue(b []byte, typ byte, unsigned bool) (interface{}, int, error) {
+	switch typ {
+	case TypeNull:
+		return nil, 0, nil
+	case TypeTiny:
+		return readBinaryInt(b, 1, unsigned)
+	case TypeShort, TypeYear:
+		return readBinaryInt(b, 2, unsigned)
+	case TypeLong, TypeInt24:
+		return readBinaryInt(b, 4, unsigned)
+	case TypeLongLong:
+		return readBinaryInt(b, 8, unsigned)
+	case TypeFloat:
+		if len(b) < 4 {
+			return nil, 0, ErrShortPacket
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 4, nil
+	case TypeDouble:
+		if len(b) < 8 {
+			return nil, 0, ErrShortPacket
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), 8, nil
+	case TypeDate, TypeDateTime, TypeTimestamp:
+		return readBinaryDateTime(b, typ == TypeDate)
+	case TypeTime:
+		return readBinaryTime(b)
+	case TypeTinyBlob, TypeMediumBlob, TypeLongBlob, TypeBlob, TypeBit, TypeGeometry:
+		v, _, n := ReadLenEncString(b)
+		if n == 0 {
+			return nil, 0, ErrShortPacket
+		}
+		return bytes.Clone(v), n, nil
+	case TypeDecimal, TypeNewDecimal, TypeVarChar, TypeVarString, TypeString, TypeEnum, TypeSet, TypeJSON:
+		v, _, n := ReadLenEncString(b)
+		if n == 0 {
+			return nil, 0, ErrShortPacket
+		}
+		return string(v), n, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type 0x%02X", typ)
+}
+
+// readBinaryInt reads a little endian integer of size bytes, as uint64 when
+// it is unsigned and as int64 otherwise
+func readBinaryInt(b []byte, size int, unsigned bool) (interface{}, int, error) {
+	if len(b) < size {
+		return nil, 0, ErrShortPacket
+	}
+	var v uint64
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	if unsigned {
+		return v, size, nil
+	}
+	shift := 64 - 8*size
+	return int64(v<<shift) >> shift, size, nil
+}
+
+// readBinaryDateTime reads a DATE, DATETIME or TIMESTAMP value, of which the
+// length byte tells which of the fields follow
+func readBinaryDateTime(b []byte, dateOnly bool) (interface{}, int, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, 0, ErrShortPacket
+	}
+	var year, month, day, hour, minute, second, micro int
+	switch b[0] {
+	case 11:
+		micro = int(binary.LittleEndian.Uint32(b[8:]))
+		fallthrough
+	case 7:
+		hour, minute, second = int(b[5]), int(b[6]), int(b[7])
+		fallthrough
+	case 4:
+		year, month, day = int(binary.LittleEndian.Uint16(b[1:])), int(b[3]), int(b[4])
+	case 0:
+	default:
+		return nil, 0, fmt.Errorf("invalid date length %d", b[0])
+	}
+	v := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if !dateOnly {
+		v += fmt.Sprintf(" %02d:%02d:%02d", hour, minute, second)
+		if micro != 0 {
+			v += fmt.Sprintf(".%06d", micro)
+		}
+	}
+	return v, 1 + int(b[0]), nil
+}
+
+// readBinaryTime reads a TIME value, of which the length byte tells which of
+// the fields follow
+func readBinaryTime(b []byte) (interface{}, int, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, 0, ErrShortPacket
+	}
+	var sign string
+	var hours, minute, second, micro int
+	switch b[0] {
+	case 12:
+		micro = int(binary.LittleEndian.Uint32(b[9:]))
+		fallthrough
+	case 8:
+		if b[1] == 1 {
+			sign = "-"
+		}
+		hours = int(binary.LittleEndian.Uint32(b[2:]))*24 + int(b[6])
+		minute, second = int(b[7]), int(b[8])
+	case 0:
+	default:
+		return nil, 0, fmt.Errorf("invalid time length %d", b[0])
+	}
+	v := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, minute, second)
+	if micro != 0 {
+		v += fmt.Sprintf(".%06d", micro)
+	}
+	return v, 1 + int(b[0]), nil
+}
+
+// AuthSwitchRequest asks the client to authenticate with another plugin
+// https://mariadb.com/kb/en/connection/#auth-switch-request
+type AuthSwitchRequest struct {
+	Plugin string
+	Data   []byte // Plugin data, usually the salt
+}
+
+// Encode returns the payload of the auth switch request
+func (m AuthSwitchRequest) Encode() []byte {
+	payload := append([]byte{EOFHeader}, m.Plugin...)
+	payload = append(payload, 0)
+	return append(payload, m.Data...)
+}
@@ -0,0 +1,162 @@
+package mariadbproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestOK(t *testing.T) {
+	want := OK{AffectedRows: 3, LastInsertID: 1 << 20, Status: StatusAutocommit, Warnings: 1, Info: "Rows matched: 3"}
+	got, err := ParseOK(want.Encode())
+	if err != nil || got != want {
+		t.Errorf("ParseOK(Encode()) = %+v, %v", got, err)
+	}
+	if !bytes.Equal(OK{Status: StatusAutocommit}.Encode(), []byte{0, 0, 0, 2, 0, 0, 0}) {
+		t.Errorf("Unexpected encoding %x", OK{Status: StatusAutocommit}.Encode())
+	}
+	if _, err := ParseOK([]byte{OKHeader, 1, 0}); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+}
+
+func TestEOF(t *testing.T) {
+	want := EOF{Warnings: 2, Status: StatusInTrans | StatusMoreResultsExists}
+	got, err := ParseEOF(want.Encode())
+	if err != nil || got != want {
+		t.Errorf("ParseEOF(Encode()) = %+v, %v", got, err)
+	}
+	if _, err := ParseEOF(OK{}.Encode()); err == nil {
+		t.Error("Expected an error for an OK packet")
+	}
+}
+
+func TestErr(t *testing.T) {
+	want := Err{Code: ErAccessDeniedError, State: StateAccessDenied, Message: "Access denied"}
+	payload := want.Encode()
+	if !bytes.Equal(payload, []byte("\xff\x15\x04#28000Access denied")) {
+		t.Errorf("Unexpected encoding %q", payload)
+	}
+	got, err := ParseErr(payload)
+	if err != nil || got != want {
+		t.Errorf("ParseErr(Encode()) = %+v, %v", got, err)
+	}
+	if got := (Err{Code: ErUnknownError, Message: "oops"}).Encode(); !bytes.Contains(got, []byte("#HY000oops")) {
+		t.Errorf("Expected the general SQLSTATE, got %q", got)
+	}
+	if want.Error() != "Error 1045 (28000): Access denied" {
+		t.Errorf("Error() = %q", want.Error())
+	}
+}
+
+func TestColumn(t *testing.T) {
+	want := Column{Schema: "shop", Table: "u", OrgTable: "users", Name: "name", OrgName: "name",
+		Charset: 45, Length: 1020, Type: TypeVarString, Flags: 1, Decimals: 0}
+	got, err := ParseColumn(want.Encode())
+	if err != nil || got != want {
+		t.Errorf("ParseColumn(Encode()) = %+v, %v", got, err)
+	}
+	if _, err := ParseColumn(want.Encode()[:20]); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+}
+
+func TestTextRow(t *testing.T) {
+	want := [][]byte{[]byte("1"), nil, {}}
+	got, err := ParseTextRow(EncodeTextRow(want), 3)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTextRow(EncodeTextRow()) = %q, %v", got, err)
+	}
+	if _, err := ParseTextRow([]byte{1, 'a'}, 2); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+}
+
+func TestResultSet(t *testing.T) {
+	rs := ResultSet{
+		Columns: []Column{{Name: "Variable_name", Type: TypeVarString}, {Name: "Value", Type: TypeVarString}},
+		Rows:    [][][]byte{{[]byte("Backend"), []byte("cache")}},
+		Status:  StatusAutocommit,
+	}
+	data, seq := rs.AppendPackets(nil, 0)
+	packets, err := SplitPackets(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Column count, 2 columns, EOF, 1 row, EOF
+	if len(packets) != 6 || seq != 6 || packets[0].Seq != 1 {
+		t.Fatalf("Expected 6 packets numbered 1..6, got %d ending at %d", len(packets), seq)
+	}
+	var tracker ResponseTracker
+	for i, p := range packets {
+		if done := tracker.Done(p.Payload); done != (i == len(packets)-1) {
+			t.Errorf("ResponseTracker.Done() at packet %d = %v", i, done)
+		}
+	}
+	col, _ := ParseColumn(packets[2].Payload)
+	row, _ := ParseTextRow(packets[4].Payload, 2)
+	if col.Name != "Value" || string(row[1]) != "cache" {
+		t.Errorf("Unexpected column %+v or row %q", col, row)
+	}
+}
+
+func TestStmtPrepareOK(t *testing.T) {
+	want := StmtPrepareOK{StatementID: 7, Columns: 2, Params: 1, Warnings: 0}
+	got, err := ParseStmtPrepareOK(want.Encode())
+	if err != nil || got != want {
+		t.Errorf("ParseStmtPrepareOK(Encode()) = %+v, %v", got, err)
+	}
+	if _, err := ParseStmtPrepareOK([]byte{OKHeader, 1}); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+}
+
+func TestParseStmtExecuteParams(t *testing.T) {
+	types := []byte{
+		TypeTiny, 0, TypeLongLong, ParamUnsigned, TypeDouble, 0, TypeVarString, 0,
+		TypeBlob, 0, TypeDateTime, 0, TypeTime, 0, TypeNull, 0, TypeShort, 0,
+	}
+	data := []byte{7, 0, 0, 0, 0, 1, 0, 0, 0}
+	data = append(data, 0x80, 0) // The 8th parameter is NULL
+	data = append(data, 1)
+	data = append(data, types...)
+	data = append(data, 0xFF)
+	data = binary.LittleEndian.AppendUint64(data, math.MaxUint64)
+	data = binary.LittleEndian.AppendUint64(data, math.Float64bits(1.5))
+	data = AppendLenEncString(data, []byte("tqdb"))
+	data = AppendLenEncString(data, []byte{0, 1})
+	data = append(data, 11, 0xE8, 0x07, 2, 29, 13, 5, 9, 0x40, 0xE2, 0x01, 0x00)
+	data = append(data, 8, 1, 1, 0, 0, 0, 2, 30, 0)
+	data = binary.LittleEndian.AppendUint16(data, 0xFFFE)
+
+	want := []interface{}{int64(-1), uint64(math.MaxUint64), 1.5, "tqdb", []byte{0, 1}, "2024-02-29 13:05:09.123456", "-26:30:00", nil, int64(-2)}
+	got, gotTypes, err := ParseStmtExecuteParams(data, 9, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseStmtExecuteParams() = %#v, want %#v", got, want)
+	}
+	if !bytes.Equal(gotTypes, types) {
+		t.Errorf("Expected the types of the packet, got %v", gotTypes)
+	}
+
+	// Later executions use the types of an earlier one
+	data = []byte{7, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 5, 0, 0, 0}
+	got, _, err = ParseStmtExecuteParams(data, 1, []byte{TypeLong, 0})
+	if err != nil || !reflect.DeepEqual(got, []interface{}{int64(5)}) {
+		t.Errorf("ParseStmtExecuteParams() = %v, %v", got, err)
+	}
+	if _, _, err := ParseStmtExecuteParams(data, 1, nil); err == nil {
+		t.Error("Expected an error without types")
+	}
+}
+
+func TestAuthSwitchRequest(t *testing.T) {
+	got := AuthSwitchRequest{Plugin: "caching_sha2_password", Data: []byte("salt\x00")}.Encode()
+	if !bytes.Equal(got, []byte("\xfecaching_sha2_password\x00salt\x00")) {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+}
@@ -0,0 +1,285 @@
+// Package mariadbproto encodes and decodes packets of the MariaDB/MySQL
+// client/server protocol, as spoken between the proxy and its clients and
+// backends.
+//
+// Packets are framed by a 4 byte header: a 3 byte little endian payload length
+// and a sequence number. The typed messages (OK, EOF, Err, Column, ...) encode
+// to and parse from payloads, without header, so that the caller controls the
+// sequence numbers. Clients are assumed to speak protocol 4.1 with EOF packets
+// (the proxy does not offer CLIENT_DEPRECATE_EOF).
+//
+// https://mariadb.com/kb/en/0-packet/
+package mariadbproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// HeaderSize is the size of a packet header
+const HeaderSize = 4
+
+// MaxPayloadSize is the largest payload of a single packet
+const MaxPayloadSize = 1<<24 - 1
+
+// First bytes of the generic response packets
+const (
+	OKHeader          = 0x00
+	LocalInfileHeader = 0xFB
+	EOFHeader         = 0xFE
+	ErrHeader         = 0xFF
+)
+
+// Server status flags
+const (
+	StatusInTrans           uint16 = 0x0001
+	StatusAutocommit        uint16 = 0x0002
+	StatusMoreResultsExists uint16 = 0x0008
+	StatusCursorExists      uint16 = 0x0040
+	StatusLastRowSent       uint16 = 0x0080
+)
+
+// ErrShortPacket is returned for packets that end before their fields do
+var ErrShortPacket = errors.New("mariadbproto: packet too short")
+
+// ReadPacket reads a packet and returns its payload and sequence number
+func ReadPacket(r io.Reader) ([]byte, byte, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	return payload, header[3], nil
+}
+
+// AppendPacket appends a packet with the given sequence number and payload
+// to dst
+func AppendPacket(dst []byte, seq byte, payload []byte) []byte {
+	dst = append(dst, byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16), seq)
+	return append(dst, payload...)
+}
+
+// WritePacket writes a packet with the given sequence number and payload in
+// a single write
+func WritePacket(w io.Writer, seq byte, payload []byte) error {
+	_, err := w.Write(AppendPacket(make([]byte, 0, HeaderSize+len(payload)), seq, payload))
+	return err
+}
+
+// Packet is a packet within a buffer of consecutive packets
+type Packet struct {
+	Seq     byte
+	Payload []byte // Shares memory with the buffer
+}
+
+// SplitPackets splits a buffer of consecutive packets, as read from a
+// backend or stored in the cache
+func SplitPackets(data []byte) ([]Packet, error) {
+	var packets []Packet
+	for pos := 0; pos < len(data); {
+		if pos+HeaderSize > len(data) {
+			return nil, ErrShortPacket
+		}
+		length := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		end := pos + HeaderSize + length
+		if end > len(data) {
+			return nil, ErrShortPacket
+		}
+		packets = append(packets, Packet{Seq: data[pos+3], Payload: data[pos+HeaderSize : end]})
+		pos = end
+	}
+	return packets, nil
+}
+
+// Resequence renumbers the consecutive packets in data in place, the first
+// one with seq+1, and returns the sequence number of the last packet and the
+// payload of the last packet (sharing memory with data)
+func Resequence(data []byte, seq byte) (byte, []byte) {
+	var last []byte
+	for pos := 0; pos+HeaderSize <= len(data); {
+		length := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		seq++
+		data[pos+3] = seq
+		end := min(pos+HeaderSize+length, len(data))
+		last = data[pos+HeaderSize : end]
+		pos = end
+	}
+	return seq, last
+}
+
+// IsOK reports whether a response payload is an OK packet
+func IsOK(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == OKHeader
+}
+
+// IsEOF reports whether a response payload is an EOF packet, as opposed to a
+// row starting with an 8 byte length encoded integer
+func IsEOF(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == EOFHeader && len(payload) < 9
+}
+
+// IsErr reports whether a response payload is an error packet
+func IsErr(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == ErrHeader
+}
+
+// Status returns the status flags of an OK or EOF packet
+func Status(payload []byte) (uint16, bool) {
+	pos, ok := statusOffset(payload)
+	if !ok {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(payload[pos:]), true
+}
+
+// AddStatus sets status flags of an OK or EOF packet in place, and reports
+// whether the payload has status flags
+func AddStatus(payload []byte, flags uint16) bool {
+	pos, ok := statusOffset(payload)
+	if ok {
+		binary.LittleEndian.PutUint16(payload[pos:], binary.LittleEndian.Uint16(payload[pos:])|flags)
+	}
+	return ok
+}
+
+// statusOffset returns the position of the status flags of an OK or EOF packet
+func statusOffset(payload []byte) (int, bool) {
+	switch {
+	case IsOK(payload):
+		// 00 <lenenc affected rows> <lenenc last insert id> <status(2)>
+		pos := 1
+		for i := 0; i < 2; i++ {
+			_, _, n := ReadLenEncInt(payload[pos:])
+			if n == 0 {
+				return 0, false
+			}
+			pos += n
+		}
+		return pos, len(payload) >= pos+2
+	case IsEOF(payload):
+		// FE <warnings(2)> <status(2)>
+		return 3, len(payload) >= 5
+	}
+	return 0, false
+}
+
+// ResponseTracker finds the last packet of a command response: an OK or error
+// packet, the EOF after the rows of a result set, or a LOCAL INFILE request,
+// following further results while the more results flag is set. A result set
+// of COM_STMT_EXECUTE that opened a cursor ends with the EOF after its
+// columns. Rows of the text and binary protocol are told apart from OK and
+// EOF packets by their position. The zero value is ready for a new response.
+type ResponseTracker struct {
+	packets int
+	eofs    int // EOF packets of the current result set
+}
+
+// Rows prepares the tracker for a response of rows only, as sent for
+// COM_STMT_FETCH
+func (t *ResponseTracker) Rows() {
+	t.packets, t.eofs = 1, 1
+}
+
+// Done consumes the next payload of the response and reports whether it was
+// the last one
+func (t *ResponseTracker) Done(payload []byte) bool {
+	t.packets++
+	if len(payload) == 0 {
+		return false
+	}
+	switch {
+	case IsErr(payload):
+		return true
+	case payload[0] == LocalInfileHeader && t.packets == 1:
+		return true
+	case IsOK(payload) && t.eofs == 0:
+		// A column count is never 0, so this is an OK packet
+		return t.last(payload)
+	case IsEOF(payload):
+		// Result sets have two EOF packets: after the columns and the rows
+		t.eofs++
+		if t.eofs >= 2 {
+			return t.last(payload)
+		}
+		if status, ok := Status(payload); ok && status&StatusCursorExists != 0 {
+			return true // The rows are fetched with COM_STMT_FETCH
+		}
+	}
+	return false
+}
+
+// last reports whether the OK or EOF packet ending a result is the last one
+func (t *ResponseTracker) last(payload []byte) bool {
+	status, ok := Status(payload)
+	if !ok || status&StatusMoreResultsExists == 0 {
+		return true
+	}
+	t.eofs = 0
+	return false
+}
+
+// ReadLenEncInt reads a length encoded integer and returns its value, whether
+// it is NULL and its size, or a size of 0 when data is too short
+func ReadLenEncInt(data []byte) (uint64, bool, int) {
+	if len(data) == 0 {
+		return 0, false, 0
+	}
+	switch data[0] {
+	case 0xFB:
+		return 0, true, 1
+	case 0xFC:
+		if len(data) < 3 {
+			return 0, false, 0
+		}
+		return uint64(binary.LittleEndian.Uint16(data[1:])), false, 3
+	case 0xFD:
+		if len(data) < 4 {
+			return 0, false, 0
+		}
+		return uint64(data[1]) | uint64(data[2])<<8 | uint64(data[3])<<16, false, 4
+	case 0xFE:
+		if len(data) < 9 {
+			return 0, false, 0
+		}
+		return binary.LittleEndian.Uint64(data[1:]), false, 9
+	}
+	return uint64(data[0]), false, 1
+}
+
+// AppendLenEncInt appends a length encoded integer to dst
+func AppendLenEncInt(dst []byte, n uint64) []byte {
+	switch {
+	case n < 0xFB:
+		return append(dst, byte(n))
+	case n <= 0xFFFF:
+		return append(dst, 0xFC, byte(n), byte(n>>8))
+	case n <= 0xFFFFFF:
+		return append(dst, 0xFD, byte(n), byte(n>>8), byte(n>>16))
+	}
+	return binary.LittleEndian.AppendUint64(append(dst, 0xFE), n)
+}
+
+// ReadLenEncString reads a length encoded string and returns it (sharing
+// memory with data), whether it is NULL and its size, or a size of 0 when
+// data is too short
+func ReadLenEncString(data []byte) ([]byte, bool, int) {
+	length, null, n := ReadLenEncInt(data)
+	if n == 0 || null {
+		return nil, null, n
+	}
+	end := n + int(length)
+	if length > uint64(len(data)) || end > len(data) {
+		return nil, false, 0
+	}
+	return data[n:end], false, end
+}
+
+// AppendLenEncString appends a length encoded string to dst
+func AppendLenEncString(dst []byte, s []byte) []byte {
+	return append(AppendLenEncInt(dst, uint64(len(s))), s...)
+}
@@ -0,0 +1,130 @@
+package mariadbproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketFraming(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WritePacket(&buf, 3, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, []byte("\x05\x00\x00\x03hello")) {
+		t.Fatalf("WritePacket() = %q", got)
+	}
+	payload, seq, err := ReadPacket(&buf)
+	if err != nil || seq != 3 || string(payload) != "hello" {
+		t.Errorf("ReadPacket() = %q, %d, %v", payload, seq, err)
+	}
+	if _, _, err := ReadPacket(bytes.NewReader([]byte("\x05\x00\x00\x01hel"))); err == nil {
+		t.Error("Expected an error for a truncated packet")
+	}
+}
+
+func TestSplitAndResequence(t *testing.T) {
+	data := AppendPacket(nil, 1, []byte{0x01})
+	data = AppendPacket(data, 2, EOF{Status: StatusAutocommit}.Encode())
+	packets, err := SplitPackets(data)
+	if err != nil || len(packets) != 2 || packets[1].Seq != 2 || !IsEOF(packets[1].Payload) {
+		t.Fatalf("SplitPackets() = %v, %v", packets, err)
+	}
+	if _, err := SplitPackets(data[:len(data)-1]); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+
+	seq, last := Resequence(data, 6)
+	if seq != 8 || data[3] != 7 || !IsEOF(last) {
+		t.Errorf("Resequence() = %d, %x; first seq %d", seq, last, data[3])
+	}
+	if !AddStatus(last, StatusMoreResultsExists) {
+		t.Fatal("Expected the EOF packet to have status flags")
+	}
+	if status, _ := Status(packets[1].Payload); status != StatusAutocommit|StatusMoreResultsExists {
+		t.Errorf("Expected the status to be set in place, got %x", status)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ok := OK{AffectedRows: 300, LastInsertID: 70000, Status: StatusInTrans}.Encode()
+	if status, found := Status(ok); !found || status != StatusInTrans {
+		t.Errorf("Status() of OK = %x, %v", status, found)
+	}
+	if _, found := Status([]byte{0x03, 'd', 'e', 'f'}); found {
+		t.Error("Expected no status for a column definition")
+	}
+	if _, found := Status([]byte{OKHeader, 0xFC}); found {
+		t.Error("Expected no status for a truncated OK packet")
+	}
+}
+
+func TestResponseTracker(t *testing.T) {
+	col := Column{Name: "id", Type: TypeVarString}.Encode()
+	eof := EOF{}.Encode()
+	more := EOF{Status: StatusMoreResultsExists}.Encode()
+	row := EncodeTextRow([][]byte{[]byte("1")})
+	emptyRow := EncodeTextRow([][]byte{{}}) // starts with 0x00
+	long := append([]byte{EOFHeader}, make([]byte, 8)...)
+
+	tests := []struct {
+		name     string
+		response [][]byte
+	}{
+		{"ok", [][]byte{OK{}.Encode()}},
+		{"error", [][]byte{Err{Code: 1064, Message: "syntax"}.Encode()}},
+		{"local infile", [][]byte{{LocalInfileHeader, 'f'}}},
+		{"result set", [][]byte{{1}, col, eof, row, emptyRow, long, eof}},
+		{"null first value", [][]byte{{1}, col, eof, {0xFB}, eof}},
+		{"more results", [][]byte{{1}, col, eof, row, more, OK{Status: StatusMoreResultsExists}.Encode(), OK{}.Encode()}},
+		{"error after rows", [][]byte{{1}, col, eof, row, Err{Message: "killed"}.Encode()}},
+		{"call", [][]byte{{1}, col, eof, row, more, {1}, col, eof, more, OK{AffectedRows: 1}.Encode()}},
+		{"cursor", [][]byte{{1}, col, EOF{Status: StatusCursorExists}.Encode()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tracker ResponseTracker
+			for i, payload := range tt.response {
+				done := tracker.Done(payload)
+				if last := i == len(tt.response)-1; done != last {
+					t.Fatalf("Done() at packet %d = %v, want %v", i, done, last)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseTracker_Rows(t *testing.T) {
+	binaryRow := []byte{OKHeader, 0x00, 0x01, 0x00, 0x00, 0x00} // Starts like an OK packet
+	response := [][]byte{binaryRow, binaryRow, EOF{Status: StatusCursorExists | StatusLastRowSent}.Encode()}
+	var tracker ResponseTracker
+	tracker.Rows()
+	for i, payload := range response {
+		if done, last := tracker.Done(payload), i == len(response)-1; done != last {
+			t.Fatalf("Done() at packet %d = %v, want %v", i, done, last)
+		}
+	}
+}
+
+func TestLenEnc(t *testing.T) {
+	for _, n := range []uint64{0, 250, 251, 0xFFFF, 0x10000, 0xFFFFFF, 0x1000000, 1 << 40} {
+		b := AppendLenEncInt(nil, n)
+		got, null, size := ReadLenEncInt(b)
+		if got != n || null || size != len(b) {
+			t.Errorf("ReadLenEncInt(AppendLenEncInt(%d)) = %d, %v, %d", n, got, null, size)
+		}
+		if _, _, size := ReadLenEncInt(b[:len(b)-1]); len(b) > 1 && size != 0 {
+			t.Errorf("Expected size 0 for truncated %d, got %d", n, size)
+		}
+	}
+	if _, null, size := ReadLenEncInt([]byte{0xFB}); !null || size != 1 {
+		t.Error("Expected 0xFB to be NULL")
+	}
+
+	s := AppendLenEncString(nil, []byte("tqdb"))
+	if got, _, size := ReadLenEncString(s); string(got) != "tqdb" || size != 5 {
+		t.Errorf("ReadLenEncString() = %q, %d", got, size)
+	}
+	if _, _, size := ReadLenEncString(s[:3]); size != 0 {
+		t.Errorf("Expected size 0 for a truncated string, got %d", size)
+	}
+}
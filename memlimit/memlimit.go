@@ -0,0 +1,181 @@
+// Package memlimit keeps the proxy below a soft memory limit, so that a
+// traffic spike degrades caching and batching instead of getting the proxy
+// OOM-killed in front of every application.
+//
+// The limit is passed to the Go runtime (see runtime/debug.SetMemoryLimit),
+// which collects garbage more often as it is approached. A Controller also
+// checks the memory of the process periodically. Above HighWater of the limit
+// it is under pressure until the memory drops below LowWater. Under pressure
+// it runs the registered shedding actions on every check (such as evicting
+// cache entries) and notifies the listeners, which flush write batches at a
+// smaller size and spill large responses to disk instead of buffering them in
+// memory.
+package memlimit
+
+import (
+	"context"
+	"log"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// Fractions of the limit at which the pressure starts and ends
+const (
+	HighWater = 0.9
+	LowWater  = 0.8
+)
+
+// action is a shedding action run on every check under pressure
+type action struct {
+	name string
+	fn   func() int
+}
+
+// Controller watches the memory of the process against a soft limit. A nil
+// Controller is never under pressure.
+type Controller struct {
+	mu          sync.Mutex
+	limit       int64 // Bytes (0 = disabled)
+	bufferLimit int   // Bytes of a response buffered in memory under pressure
+	actions     []action
+	listeners   []func(pressure bool)
+	initial     int64 // Runtime memory limit before the first Configure, e.g. from GOMEMLIMIT
+
+	pressure atomic.Bool
+	buffer   atomic.Int64 // bufferLimit while under pressure, else 0
+	usage    func() int64 // Memory of the process, replaced by tests
+}
+
+// New creates a controller without a limit
+func New() *Controller {
+	return &Controller{initial: debug.SetMemoryLimit(-1), usage: processMemory}
+}
+
+// Configure sets the soft limit in MB (0 = disabled) and the bytes of a
+// response that may be buffered in memory under pressure. It can be called
+// again on a config reload.
+func (c *Controller) Configure(limitMB, bufferKB int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.limit = int64(limitMB) * 1024 * 1024
+	c.bufferLimit = bufferKB * 1024
+	if c.limit > 0 {
+		debug.SetMemoryLimit(c.limit)
+	} else {
+		debug.SetMemoryLimit(c.initial)
+	}
+	if c.pressure.Load() {
+		c.buffer.Store(int64(c.bufferLimit))
+	}
+}
+
+// OnPressure registers a shedding action that runs on every check under
+// pressure. It returns the number of freed items, counted in
+// tqdbproxy_memory_shed_total with the action name.
+func (c *Controller) OnPressure(name string, fn func() int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actions = append(c.actions, action{name, fn})
+}
+
+// OnChange registers a listener that is called when the pressure starts and
+// when it ends
+func (c *Controller) OnChange(fn func(pressure bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listeners = append(c.listeners, fn)
+}
+
+// Pressure reports whether the memory is above the high water mark
+func (c *Controller) Pressure() bool {
+	return c != nil && c.pressure.Load()
+}
+
+// BufferLimit returns the bytes of a response that may be buffered in memory,
+// or 0 for no limit when not under pressure
+func (c *Controller) BufferLimit() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.buffer.Load())
+}
+
+// Run checks the memory every interval until ctx is done
+func (c *Controller) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.check()
+		}
+	}
+}
+
+// check compares the memory with the limit and sheds load under pressure
+func (c *Controller) check() {
+	c.mu.Lock()
+	limit := c.limit
+	actions := c.actions
+	listeners := c.listeners
+	bufferLimit := c.bufferLimit
+	c.mu.Unlock()
+
+	usage := c.usage()
+	pressure := c.pressure.Load()
+	switch {
+	case limit > 0 && !pressure && float64(usage) >= HighWater*float64(limit):
+		pressure = true
+		c.buffer.Store(int64(bufferLimit))
+		log.Printf("[Memory] Under pressure: %d MB of the %d MB soft limit in use, shedding load", usage>>20, limit>>20)
+	case pressure && (limit <= 0 || float64(usage) < LowWater*float64(limit)):
+		pressure = false
+		c.buffer.Store(0)
+		log.Printf("[Memory] Pressure relieved: %d MB in use", usage>>20)
+	default:
+		if pressure {
+			c.shed(actions)
+		}
+		return
+	}
+	c.pressure.Store(pressure)
+	metrics.MemoryPressure.Set(boolGauge(pressure))
+	for _, fn := range listeners {
+		fn(pressure)
+	}
+	if pressure {
+		c.shed(actions)
+	}
+}
+
+// shed runs the shedding actions
+func (c *Controller) shed(actions []action) {
+	for _, a := range actions {
+		if n := a.fn(); n > 0 {
+			metrics.MemoryShed.WithLabelValues(a.name).Add(float64(n))
+		}
+	}
+}
+
+// processMemory returns the memory of the process as the runtime counts it
+// against its memory limit
+func processMemory() int64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(min(ms.Sys-ms.HeapReleased, math.MaxInt64))
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
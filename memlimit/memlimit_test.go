@@ -0,0 +1,53 @@
+package memlimit
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func TestController(t *testing.T) {
+	c := New()
+	defer c.Configure(0, 0)
+	usage := int64(0)
+	c.usage = func() int64 { return usage }
+	c.Configure(100, 64)
+	if got := debug.SetMemoryLimit(-1); got != 100<<20 {
+		t.Errorf("Expected a runtime memory limit of 100 MB, got %d", got)
+	}
+
+	var changes []bool
+	shed := 0
+	c.OnChange(func(pressure bool) { changes = append(changes, pressure) })
+	c.OnPressure("test", func() int { shed++; return 1 })
+
+	usage = 80 << 20
+	c.check()
+	if c.Pressure() || c.BufferLimit() != 0 || shed != 0 {
+		t.Fatal("Expected no pressure below the high water mark")
+	}
+	usage = 95 << 20
+	c.check()
+	c.check()
+	if !c.Pressure() || c.BufferLimit() != 64<<10 || shed != 2 {
+		t.Errorf("Expected pressure with 2 sheddings, got %v with %d", c.Pressure(), shed)
+	}
+	// Between the water marks the pressure lasts
+	usage = 85 << 20
+	c.check()
+	if !c.Pressure() || shed != 3 {
+		t.Error("Expected the pressure to last above the low water mark")
+	}
+	usage = 70 << 20
+	c.check()
+	if c.Pressure() || c.BufferLimit() != 0 {
+		t.Error("Expected the pressure to end below the low water mark")
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("Expected the listener to see the start and end, got %v", changes)
+	}
+
+	var none *Controller
+	if none.Pressure() || none.BufferLimit() != 0 {
+		t.Error("Expected a nil controller to never be under pressure")
+	}
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultMaxLabelSets is the default number of label combinations of a
+// guarded metric
+const DefaultMaxLabelSets = 10000
+
+// OtherLabel replaces the label values from clients once a guarded metric
+// reached its number of label combinations
+const OtherLabel = "other"
+
+// maxLabelSets is the number of label combinations of a guarded metric
+var maxLabelSets atomic.Int64
+
+func init() {
+	maxLabelSets.Store(DefaultMaxLabelSets)
+}
+
+// SetMaxLabelSets sets the number of label combinations of each guarded
+// metric (0 = unlimited). Lowering it does not remove combinations that
+// were already exported.
+func SetMaxLabelSets(n int) {
+	maxLabelSets.Store(int64(n))
+}
+
+// labelGuard caps the label combinations of a metric whose labels come from
+// clients, such as the file and line hints, and collapses the labels of new
+// combinations beyond the cap into OtherLabel
+type labelGuard struct {
+	name    string
+	guarded []int // Positions of the labels from clients
+	mu      sync.Mutex
+	seen    map[string]struct{}
+}
+
+func newLabelGuard(name string, labels []string, guarded []string) *labelGuard {
+	g := &labelGuard{name: name, seen: make(map[string]struct{})}
+	for i, label := range labels {
+		for _, guardedLabel := range guarded {
+			if label == guardedLabel {
+				g.guarded = append(g.guarded, i)
+			}
+		}
+	}
+	return g
+}
+
+// values returns the label values to export
+func (g *labelGuard) values(lvs []string) []string {
+	key := strings.Join(lvs, "\x00")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.seen[key]; ok {
+		return lvs
+	}
+	if limit := maxLabelSets.Load(); limit <= 0 || int64(len(g.seen)) < limit {
+		g.seen[key] = struct{}{}
+		return lvs
+	}
+	collapsed := append([]string(nil), lvs...)
+	for _, i := range g.guarded {
+		if i < len(collapsed) {
+			collapsed[i] = OtherLabel
+		}
+	}
+	// The collapsed combinations are bounded by the other labels
+	g.seen[strings.Join(collapsed, "\x00")] = struct{}{}
+	LabelSetsDropped.WithLabelValues(g.name).Inc()
+	return collapsed
+}
+
+// GuardedCounterVec is a CounterVec with a cap on its label combinations
+type GuardedCounterVec struct {
+	*prometheus.CounterVec
+	guard *labelGuard
+}
+
+// NewGuardedCounterVec creates a CounterVec whose guarded labels collapse
+// into OtherLabel beyond the maximum number of label combinations
+func NewGuardedCounterVec(opts prometheus.CounterOpts, labels []string, guarded ...string) *GuardedCounterVec {
+	return &GuardedCounterVec{prometheus.NewCounterVec(opts, labels), newLabelGuard(opts.Name, labels, guarded)}
+}
+
+// WithLabelValues returns the counter of the label values, or of the
+// collapsed values when the metric reached its label combinations
+func (v *GuardedCounterVec) WithLabelValues(lvs ...string) prometheus.Counter {
+	return v.CounterVec.WithLabelValues(v.guard.values(lvs)...)
+}
+
+// GuardedHistogramVec is a HistogramVec with a cap on its label combinations
+type GuardedHistogramVec struct {
+	*prometheus.HistogramVec
+	guard *labelGuard
+}
+
+// NewGuardedHistogramVec creates a HistogramVec whose guarded labels collapse
+// into OtherLabel beyond the maximum number of label combinations
+func NewGuardedHistogramVec(opts prometheus.HistogramOpts, labels []string, guarded ...string) *GuardedHistogramVec {
+	return &GuardedHistogramVec{prometheus.NewHistogramVec(opts, labels), newLabelGuard(opts.Name, labels, guarded)}
+}
+
+// WithLabelValues returns the histogram of the label values, or of the
+// collapsed values when the metric reached its label combinations
+func (v *GuardedHistogramVec) WithLabelValues(lvs ...string) prometheus.Observer {
+	return v.HistogramVec.WithLabelValues(v.guard.values(lvs)...)
+}
+
+// GuardedGaugeVec is a GaugeVec with a cap on its label combinations
+type GuardedGaugeVec struct {
+	*prometheus.GaugeVec
+	guard *labelGuard
+}
+
+// NewGuardedGaugeVec creates a GaugeVec whose guarded labels collapse into
+// OtherLabel beyond the maximum number of label combinations
+func NewGuardedGaugeVec(opts prometheus.GaugeOpts, labels []string, guarded ...string) *GuardedGaugeVec {
+	return &GuardedGaugeVec{prometheus.NewGaugeVec(opts, labels), newLabelGuard(opts.Name, labels, guarded)}
+}
+
+// WithLabelValues returns the gauge of the label values, or of the collapsed
+// values when the metric reached its label combinations
+func (v *GuardedGaugeVec) WithLabelValues(lvs ...string) prometheus.Gauge {
+	return v.GaugeVec.WithLabelValues(v.guard.values(lvs)...)
+}
@@ -9,41 +9,121 @@ import (
 )
 
 var (
-	// QueryTotal counts total queries by file, line, query_type, cached
-	QueryTotal = prometheus.NewCounterVec(
+	// QueryTotal counts total queries by file, line, query_type, cached. The
+	// file and line come from client hints and are guarded, see
+	// SetMaxLabelSets.
+	QueryTotal = NewGuardedCounterVec(
 		prometheus.CounterOpts{
 			Name: "tqdbproxy_query_total",
 			Help: "Total number of queries processed",
 		},
 		[]string{"file", "line", "query_type", "cached"},
+		"file", "line",
 	)
 
 	// QueryLatency tracks query latency by file, line, query_type
-	QueryLatency = prometheus.NewHistogramVec(
+	QueryLatency = NewGuardedHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "tqdbproxy_query_latency_seconds",
 			Help:    "Query latency in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
 		[]string{"file", "line", "query_type"},
+		"file", "line",
 	)
 
 	// CacheHits counts cache hits by file, line
-	CacheHits = prometheus.NewCounterVec(
+	CacheHits = NewGuardedCounterVec(
 		prometheus.CounterOpts{
 			Name: "tqdbproxy_cache_hits_total",
 			Help: "Total number of cache hits",
 		},
 		[]string{"file", "line"},
+		"file", "line",
 	)
 
 	// CacheMisses counts cache misses by file, line
-	CacheMisses = prometheus.NewCounterVec(
+	CacheMisses = NewGuardedCounterVec(
 		prometheus.CounterOpts{
 			Name: "tqdbproxy_cache_misses_total",
 			Help: "Total number of cache misses",
 		},
 		[]string{"file", "line"},
+		"file", "line",
+	)
+
+	// CacheDDLInvalidations counts cache entries invalidated by DDL statements
+	CacheDDLInvalidations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_cache_ddl_invalidations_total",
+			Help: "Total cache entries invalidated by DDL statements",
+		},
+	)
+
+	// CacheReplicationInvalidations counts cache entries invalidated by changes
+	// read from the replication stream of a primary
+	CacheReplicationInvalidations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_cache_replication_invalidations_total",
+			Help: "Total cache entries invalidated by table changes read from the replication stream",
+		},
+		[]string{"source"},
+	)
+
+	// CacheVerifications counts sampled cache hits verified against the primary
+	CacheVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_cache_verifications_total",
+			Help: "Total sampled cache hits verified against the primary (result: match, mismatch, error, skipped)",
+		},
+		[]string{"result"},
+	)
+
+	// CacheBytes reports the bytes of the keys and values of the cached
+	// results
+	CacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_cache_bytes",
+			Help: "Bytes of the keys and values of the cached results",
+		},
+	)
+
+	// CacheEntries reports the number of cached results
+	CacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_cache_entries",
+			Help: "Number of cached results",
+		},
+	)
+
+	// CacheEvictions counts cached results evicted to stay within the cache
+	// limits, and results not stored because they exceed the entry size
+	CacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_cache_evictions_total",
+			Help: "Total cached results evicted (reason: memory, entries) or not stored (reason: too_large)",
+		},
+		[]string{"reason"},
+	)
+
+	// CacheRefreshes counts background refreshes of hot cached results, see
+	// cache.RunRefresh
+	CacheRefreshes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_cache_refreshes_total",
+			Help: "Total background refreshes of cached results (result: refreshed, skipped, error)",
+		},
+		[]string{"result"},
+	)
+
+	// TLSCertificateExpiry reports the expiry of the loaded backend TLS
+	// certificates, see package tlsopt
+	TLSCertificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_tls_certificate_expiry_seconds",
+			Help: "Unix time at which a loaded CA file or client certificate for backend TLS expires (file: path of the certificate)",
+		},
+		[]string{"file"},
 	)
 
 	// DatabaseQueries counts queries sent to database by replica
@@ -55,36 +135,175 @@ var (
 		[]string{"replica"},
 	)
 
+	// ReplicaLag is the last measured replication lag per replica
+	ReplicaLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_replica_lag_seconds",
+			Help: "Replication lag of the replica, as measured by the last health check",
+		},
+		[]string{"addr"},
+	)
+
+	// SpillFiles counts responses spilled to a temporary file
+	SpillFiles = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_spill_files_total",
+			Help: "Total responses written to a temporary file because they outgrew the spill threshold",
+		},
+	)
+
+	// SpillBytes counts the bytes written to spill files
+	SpillBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_spill_bytes_total",
+			Help: "Total bytes written to spill files",
+		},
+	)
+
+	// SpillBytesInUse is the size of the spill files that exist
+	SpillBytesInUse = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_spill_bytes",
+			Help: "Bytes in spill files that were not removed yet",
+		},
+	)
+
+	// ReadRetries counts reads retried on another node after a backend failure
+	ReadRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_read_retries_total",
+			Help: "Total reads retried on another node after a backend connection failure",
+		},
+		[]string{"replica"},
+	)
+
+	// ClientAborts counts requests whose client disconnected before the response
+	ClientAborts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_client_aborts_total",
+			Help: "Total requests abandoned because the client disconnected (phase: query, batch_wait)",
+		},
+		[]string{"phase"},
+	)
+
+	// ProtocolViolations counts messages exchanged with clients that violate
+	// the wire protocol, see package conform
+	ProtocolViolations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_protocol_violations_total",
+			Help: "Total protocol violations found in strict protocol mode (direction: inbound, outbound)",
+		},
+		[]string{"protocol", "direction"},
+	)
+
+	// OverridesApplied counts queries whose hints were disabled by a runtime override
+	OverridesApplied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_overrides_applied_total",
+			Help: "Total queries whose hints were disabled by a runtime override (action: no_batch, no_cache)",
+		},
+		[]string{"action"},
+	)
+
+	// KillSwitchEnabled reports whether a feature is enabled, see package
+	// killswitch
+	KillSwitchEnabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_killswitch_enabled",
+			Help: "Whether a feature is enabled (1) or switched off by its kill switch (0)",
+		},
+		[]string{"feature"},
+	)
+
+	// MemoryPressure reports whether the memory is near the soft limit, see
+	// package memlimit
+	MemoryPressure = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_memory_pressure",
+			Help: "Whether the memory of the proxy is near its soft limit (1) or not (0)",
+		},
+	)
+
+	// MemoryShed counts items freed under memory pressure
+	MemoryShed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_memory_shed_total",
+			Help: "Total items freed under memory pressure (action: cache)",
+		},
+		[]string{"action"},
+	)
+
+	// SlowQueries counts the statements recorded in the slow query log
+	SlowQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_slow_queries_total",
+			Help: "Total statements slower than the slow query threshold",
+		},
+		[]string{"protocol"},
+	)
+
+	// LabelSetsDropped counts the observations of guarded metrics whose label
+	// values were collapsed into OtherLabel
+	LabelSetsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_metric_label_sets_dropped_total",
+			Help: "Total observations of a metric beyond its maximum label combinations, recorded under other",
+		},
+		[]string{"metric"},
+	)
+
+	// AuditRecords counts the records of the audit log by result
+	AuditRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_audit_records_total",
+			Help: "Total audit records by result (written, failed, dropped)",
+		},
+		[]string{"result"},
+	)
+
+	// Throttled counts the queries that hit a throttle limit, by the scope
+	// of the limit and whether they were delayed or rejected
+	Throttled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_throttled_total",
+			Help: "Total queries over a throttle limit by scope (client, user, backend) and result (delayed, rejected)",
+		},
+		[]string{"scope", "result"},
+	)
+
 	// Write Batch Metrics
 
 	// WriteBatchSize tracks the number of operations in each write batch
-	WriteBatchSize = prometheus.NewHistogramVec(
+	WriteBatchSize = NewGuardedHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "tqdbproxy_write_batch_size",
 			Help:    "Number of operations in each write batch",
 			Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
 		},
 		[]string{"query"},
+		"query",
 	)
 
 	// WriteBatchDelay tracks time between first enqueue and execution
-	WriteBatchDelay = prometheus.NewHistogramVec(
+	WriteBatchDelay = NewGuardedHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "tqdbproxy_write_batch_delay_seconds",
 			Help:    "Time between first operation enqueue and batch execution",
 			Buckets: []float64{0.00001, 0.0001, 0.001, 0.01, 0.05, 0.1, 0.5, 1.0},
 		},
 		[]string{"query"},
+		"query",
 	)
 
 	// WriteBatchLatency tracks time to execute a batch
-	WriteBatchLatency = prometheus.NewHistogramVec(
+	WriteBatchLatency = NewGuardedHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "tqdbproxy_write_batch_latency_seconds",
 			Help:    "Time to execute a write batch",
 			Buckets: prometheus.DefBuckets,
 		},
 		[]string{"query"},
+		"query",
 	)
 
 	// WriteOpsPerSecond is the current write operations per second
@@ -121,15 +340,126 @@ var (
 		[]string{"query_type"},
 	)
 
+	// WriteBatchHintClamped counts batch hints clamped to the configured bounds
+	WriteBatchHintClamped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_batch_hint_clamped_total",
+			Help: "Total batch hints clamped to the configured minimum or maximum",
+		},
+	)
+
+	// WriteBatchGuarded counts batchable writes executed immediately by the batch guard
+	WriteBatchGuarded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_batch_guarded_total",
+			Help: "Total batchable UPDATE/DELETE executed immediately for lacking a key column predicate",
+		},
+	)
+
+	// WriteBatchBypassed counts query fingerprints whose batching was bypassed after repeated batch errors
+	WriteBatchBypassed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_batch_bypassed_total",
+			Help: "Total times batching was bypassed for a query fingerprint because its batched writes kept failing",
+		},
+	)
+
+	// WriteBatchQueued is the number of writes in open or executing batches, by batch key
+	WriteBatchQueued = NewGuardedGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_write_batch_queued",
+			Help: "Writes in open or executing batches by batch key",
+		},
+		[]string{"query"},
+		"query",
+	)
+
+	// WriteBatchGroups is the number of open batch groups
+	WriteBatchGroups = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_write_batch_groups",
+			Help: "Open batch groups, waiting for their window to end",
+		},
+	)
+
+	// WriteBatchDropped counts writes that left the batch queue without executing, by reason
+	WriteBatchDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_batch_dropped_total",
+			Help: "Total writes not executed in a batch by reason (queue_full when rejected, withdrawn when the client gave up)",
+		},
+		[]string{"reason"},
+	)
+
+	// WriteBatchQueueWait tracks the time writes wait for their batch to start
+	WriteBatchQueueWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "tqdbproxy_write_batch_queue_wait_seconds",
+			Help:    "Time between the enqueue of a write and the start of its batch",
+			Buckets: []float64{0.0001, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1.0, 5.0},
+		},
+	)
+
+	// WriteBatchRetries counts retries of batched writes after transient backend errors, by error code
+	WriteBatchRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_batch_retries_total",
+			Help: "Total retries of batched writes after a transient backend error (deadlock, lock wait timeout, serialization failure) by error code",
+		},
+		[]string{"code"},
+	)
+
 	// WriteBatchMethod counts batches by execution method
 	WriteBatchMethod = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "tqdbproxy_write_batch_method_total",
-			Help: "Total batches executed by method (copy, multi_row_insert, prepared, transaction)",
+			Help: "Total batches executed by method (copy, multi_row_insert, prepared, transaction, isolated)",
 		},
 		[]string{"method"},
 	)
 
+	// WriteAsync counts writes acknowledged before their batch executed, by result
+	WriteAsync = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_async_total",
+			Help: "Total writes acknowledged early by result (accepted, rejected for a full queue, completed, failed)",
+		},
+		[]string{"result"},
+	)
+
+	// WriteAsyncPending is the number of writes acknowledged early that did not complete yet
+	WriteAsyncPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_write_async_pending",
+			Help: "Writes acknowledged early that did not complete yet",
+		},
+	)
+
+	// WriteSpool counts batched writes of the write-ahead spool, by result
+	WriteSpool = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tqdbproxy_write_spool_total",
+			Help: "Total writes of the write-ahead spool by result (spooled, replayed, dropped on a failed replay, rejected for a full spool)",
+		},
+		[]string{"result"},
+	)
+
+	// WriteSpoolPending is the number of spooled writes that did not complete yet
+	WriteSpoolPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_write_spool_pending",
+			Help: "Spooled writes that did not complete yet",
+		},
+	)
+
+	// WriteSpoolBytes is the size of the write-ahead spool files
+	WriteSpoolBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tqdbproxy_write_spool_bytes",
+			Help: "Size of the write-ahead spool files in bytes",
+		},
+	)
+
 	once sync.Once
 )
 
@@ -140,7 +470,30 @@ func Init() {
 		prometheus.MustRegister(QueryLatency)
 		prometheus.MustRegister(CacheHits)
 		prometheus.MustRegister(CacheMisses)
+		prometheus.MustRegister(CacheDDLInvalidations)
+		prometheus.MustRegister(CacheReplicationInvalidations)
 		prometheus.MustRegister(DatabaseQueries)
+		prometheus.MustRegister(ReadRetries)
+		prometheus.MustRegister(ReplicaLag)
+		prometheus.MustRegister(SpillFiles)
+		prometheus.MustRegister(SpillBytes)
+		prometheus.MustRegister(SpillBytesInUse)
+		prometheus.MustRegister(ClientAborts)
+		prometheus.MustRegister(ProtocolViolations)
+		prometheus.MustRegister(OverridesApplied)
+		prometheus.MustRegister(KillSwitchEnabled)
+		prometheus.MustRegister(MemoryPressure)
+		prometheus.MustRegister(MemoryShed)
+		prometheus.MustRegister(SlowQueries)
+		prometheus.MustRegister(AuditRecords)
+		prometheus.MustRegister(Throttled)
+		prometheus.MustRegister(LabelSetsDropped)
+		prometheus.MustRegister(CacheVerifications)
+		prometheus.MustRegister(CacheBytes)
+		prometheus.MustRegister(CacheEntries)
+		prometheus.MustRegister(CacheEvictions)
+		prometheus.MustRegister(CacheRefreshes)
+		prometheus.MustRegister(TLSCertificateExpiry)
 
 		// Write batch metrics
 		prometheus.MustRegister(WriteBatchSize)
@@ -151,6 +504,19 @@ func Init() {
 		prometheus.MustRegister(WriteDelayAdjustments)
 		prometheus.MustRegister(WriteBatchedTotal)
 		prometheus.MustRegister(WriteBatchMethod)
+		prometheus.MustRegister(WriteBatchHintClamped)
+		prometheus.MustRegister(WriteBatchGuarded)
+		prometheus.MustRegister(WriteBatchBypassed)
+		prometheus.MustRegister(WriteBatchRetries)
+		prometheus.MustRegister(WriteBatchQueued)
+		prometheus.MustRegister(WriteBatchGroups)
+		prometheus.MustRegister(WriteBatchDropped)
+		prometheus.MustRegister(WriteBatchQueueWait)
+		prometheus.MustRegister(WriteAsync)
+		prometheus.MustRegister(WriteAsyncPending)
+		prometheus.MustRegister(WriteSpool)
+		prometheus.MustRegister(WriteSpoolPending)
+		prometheus.MustRegister(WriteSpoolBytes)
 	})
 }
 
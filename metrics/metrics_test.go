@@ -5,6 +5,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMetrics_Init(t *testing.T) {
@@ -73,3 +76,29 @@ func TestMetrics_Increment(t *testing.T) {
 		t.Error("Expected label file=test.go in output")
 	}
 }
+
+func TestGuardedCounterVec(t *testing.T) {
+	SetMaxLabelSets(2)
+	defer SetMaxLabelSets(DefaultMaxLabelSets)
+	v := NewGuardedCounterVec(prometheus.CounterOpts{Name: "test_guarded_total"}, []string{"file", "line", "query_type"}, "file", "line")
+	dropped := testutil.ToFloat64(LabelSetsDropped.WithLabelValues("test_guarded_total"))
+
+	v.WithLabelValues("a.go", "1", "select").Inc()
+	v.WithLabelValues("b.go", "2", "select").Inc()
+	v.WithLabelValues("c.go", "3", "insert").Inc()
+	v.WithLabelValues("d.go", "4", "insert").Inc()
+	v.WithLabelValues("a.go", "1", "select").Inc()
+
+	if got := testutil.ToFloat64(v.CounterVec.WithLabelValues("a.go", "1", "select")); got != 2 {
+		t.Errorf("Expected 2 for a known label set, got %v", got)
+	}
+	if got := testutil.ToFloat64(v.CounterVec.WithLabelValues(OtherLabel, OtherLabel, "insert")); got != 2 {
+		t.Errorf("Expected the overflow to collapse into other, got %v", got)
+	}
+	if got := testutil.CollectAndCount(v); got != 3 {
+		t.Errorf("Expected 3 label sets, got %d", got)
+	}
+	if got := testutil.ToFloat64(LabelSetsDropped.WithLabelValues("test_guarded_total")) - dropped; got != 2 {
+		t.Errorf("Expected 2 dropped label sets, got %v", got)
+	}
+}
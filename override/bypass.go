@@ -0,0 +1,104 @@
+package override
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+// Bypass disables batching of writes whose batches keep failing, such as on
+// constraint violations or lock timeouts, since retrying them in a batch
+// hurts the other writes of the batch. It counts the results of batched
+// writes per fingerprint; when the share of errors reaches the error rate
+// within a cooldown period, a no_batch override is added for the cooldown.
+// The writes then execute immediately, failing on their own, until the
+// override expires and batching is tried again. A nil or disabled Bypass
+// does nothing.
+type Bypass struct {
+	mu        sync.Mutex
+	errorRate float64            // Share of failed writes that triggers the bypass (0 = disabled)
+	minWrites int                // Writes needed before the error rate is judged
+	cooldown  time.Duration      // Counting window and duration of the bypass
+	counts    map[string]*counts // fingerprint -> results in the current window
+	swept     time.Time          // Last removal of expired windows
+	now       func() time.Time
+}
+
+// counts holds the results of the batched writes of a fingerprint since start
+type counts struct {
+	start  time.Time
+	writes int
+	failed int
+}
+
+// NewBypass creates a batch bypass, see SetLimits
+func NewBypass(errorRate float64, minWrites int, cooldown time.Duration) *Bypass {
+	b := &Bypass{counts: make(map[string]*counts), now: time.Now}
+	b.SetLimits(errorRate, minWrites, cooldown)
+	return b
+}
+
+// SetLimits sets the error rate (0-1, 0 disables the bypass), the number of
+// writes needed before the error rate is judged and the cooldown, on config
+// reload
+func (b *Bypass) SetLimits(errorRate float64, minWrites int, cooldown time.Duration) {
+	if b == nil {
+		return
+	}
+	if minWrites < 1 {
+		minWrites = 1
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errorRate, b.minWrites, b.cooldown = errorRate, minWrites, cooldown
+}
+
+// Record counts the result of a batched write of query and reports whether
+// its fingerprint entered the bypass, which is added to overrides
+func (b *Bypass) Record(overrides *Set, query string, failed bool) bool {
+	if b == nil || overrides == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.errorRate <= 0 || b.cooldown <= 0 {
+		return false
+	}
+	now := b.now()
+	b.sweep(now)
+	fingerprint := parser.Fingerprint(query)
+	c := b.counts[fingerprint]
+	if c == nil || now.Sub(c.start) >= b.cooldown {
+		c = &counts{start: now}
+		b.counts[fingerprint] = c
+	}
+	c.writes++
+	if failed {
+		c.failed++
+	}
+	if c.writes < b.minWrites || float64(c.failed) < b.errorRate*float64(c.writes) {
+		return false
+	}
+	delete(b.counts, fingerprint)
+	if !overrides.addAuto(fingerprint, b.cooldown) {
+		return false
+	}
+	metrics.WriteBatchBypassed.Inc()
+	return true
+}
+
+// sweep drops the windows that ended, at most once per cooldown, with b.mu
+// held
+func (b *Bypass) sweep(now time.Time) {
+	if now.Sub(b.swept) < b.cooldown {
+		return
+	}
+	b.swept = now
+	for fingerprint, c := range b.counts {
+		if now.Sub(c.start) >= b.cooldown {
+			delete(b.counts, fingerprint)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package override
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+func TestBypass_Record(t *testing.T) {
+	s := New()
+	b := NewBypass(0.5, 4, time.Minute)
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	b.now = func() time.Time { return now }
+
+	query := "UPDATE stock SET n = n - 1 WHERE id = 5"
+	write := parser.Parse("/* batch:10 */ " + query)
+
+	// Errors are not judged before min_writes writes
+	for _, failed := range []bool{true, true, false} {
+		if b.Record(s, query, failed) {
+			t.Fatal("Expected no bypass before 4 writes")
+		}
+	}
+	if !b.Record(s, "UPDATE stock SET n = n - 1 WHERE id = 6", false) {
+		t.Fatal("Expected a bypass at 2 of 4 writes failed")
+	}
+	if got := s.Apply(write); got.BatchMs != 0 {
+		t.Errorf("Expected the batch hint to be disabled, got %d", got.BatchMs)
+	}
+	if rules := s.List(); len(rules) != 1 || !rules[0].Auto || rules[0].Action != NoBatch {
+		t.Errorf("Expected an automatic no_batch override, got %v", rules)
+	}
+
+	// The bypass ends after the cooldown, with fresh counts
+	now = now.Add(2 * time.Minute)
+	if got := s.Apply(write); got.BatchMs != 10 {
+		t.Errorf("Expected batching after the cooldown, got %d", got.BatchMs)
+	}
+	for i := 0; i < 4; i++ {
+		if b.Record(s, query, i == 0) {
+			t.Fatal("Expected no bypass at 1 of 4 writes failed")
+		}
+	}
+
+	// A manual override is not replaced by an automatic one
+	if _, err := s.Add(parser.Fingerprint(query), NoBatch, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if b.Record(s, query, true) {
+			t.Fatal("Expected the manual override to be kept")
+		}
+	}
+	if rules := s.List(); len(rules) != 1 || rules[0].Auto || !rules[0].Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expected the manual override, got %v", rules)
+	}
+
+	// A disabled bypass does nothing
+	b.SetLimits(0, 4, time.Minute)
+	if b.Record(New(), query, true) {
+		t.Error("Expected no bypass when disabled")
+	}
+	var nilBypass *Bypass
+	if nilBypass.Record(s, query, true) {
+		t.Error("Expected no bypass from a nil Bypass")
+	}
+}
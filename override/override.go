@@ -0,0 +1,174 @@
+// Package override holds temporary runtime overrides of query hints, set
+// through the admin API when a hinted query misbehaves in production:
+//
+//	no_batch: writes with the fingerprint execute immediately, ignoring batch hints
+//	no_cache: reads with the fingerprint are not cached, as if their ttl hint were 0
+//
+// Overrides take effect immediately, without a config reload, and expire after
+// their TTL. Queries are matched by fingerprint (see parser.Fingerprint), the
+// same fingerprints the admin cache report lists. The batch bypass adds
+// no_batch overrides by itself for writes whose batches keep failing, see
+// Bypass.
+package override
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+// Override actions
+const (
+	NoBatch = "no_batch"
+	NoCache = "no_cache"
+)
+
+// Actions lists the valid override actions
+var Actions = []string{NoBatch, NoCache}
+
+// Rule is an active override
+type Rule struct {
+	Fingerprint string    `json:"fingerprint"`
+	Action      string    `json:"action"`
+	Expires     time.Time `json:"expires"`
+	Auto        bool      `json:"auto,omitempty"` // Added by the batch bypass, see Bypass
+}
+
+type ruleKey struct {
+	fingerprint string
+	action      string
+}
+
+type rule struct {
+	expires time.Time
+	auto    bool
+}
+
+// Set holds the active overrides. A nil Set has no overrides.
+type Set struct {
+	mu    sync.RWMutex
+	rules map[ruleKey]rule
+	count atomic.Int32 // number of rules, checked before fingerprinting
+	now   func() time.Time
+}
+
+// New creates an empty set of overrides
+func New() *Set {
+	return &Set{rules: make(map[ruleKey]rule), now: time.Now}
+}
+
+// Add adds or extends an override of fingerprint for ttl
+func (s *Set) Add(fingerprint, action string, ttl time.Duration) (Rule, error) {
+	if action != NoBatch && action != NoCache {
+		return Rule{}, fmt.Errorf("unknown action %q", action)
+	}
+	if fingerprint == "" || ttl <= 0 {
+		return Rule{}, fmt.Errorf("fingerprint and a positive ttl are required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires := s.now().Add(ttl)
+	s.rules[ruleKey{fingerprint, action}] = rule{expires: expires}
+	s.count.Store(int32(len(s.rules)))
+	return Rule{Fingerprint: fingerprint, Action: action, Expires: expires}, nil
+}
+
+// addAuto adds a no_batch override of fingerprint for ttl on behalf of the
+// batch bypass. An active override set through the admin API is left alone.
+func (s *Set) addAuto(fingerprint string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ruleKey{fingerprint, NoBatch}
+	now := s.now()
+	if r, ok := s.rules[key]; ok && !r.auto && now.Before(r.expires) {
+		return false
+	}
+	s.rules[key] = rule{expires: now.Add(ttl), auto: true}
+	s.count.Store(int32(len(s.rules)))
+	return true
+}
+
+// Remove removes an override, and reports whether it was active
+func (s *Set) Remove(fingerprint, action string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := ruleKey{fingerprint, action}
+	r, ok := s.rules[key]
+	delete(s.rules, key)
+	s.count.Store(int32(len(s.rules)))
+	return ok && s.now().Before(r.expires)
+}
+
+// List returns the active overrides, sorted by fingerprint and action
+func (s *Set) List() []Rule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	rules := make([]Rule, 0, len(s.rules))
+	for key, r := range s.rules {
+		rules = append(rules, Rule{Fingerprint: key.fingerprint, Action: key.action, Expires: r.expires, Auto: r.auto})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Fingerprint != rules[j].Fingerprint {
+			return rules[i].Fingerprint < rules[j].Fingerprint
+		}
+		return rules[i].Action < rules[j].Action
+	})
+	return rules
+}
+
+// expire removes expired rules, with s.mu held
+func (s *Set) expire() {
+	now := s.now()
+	for key, r := range s.rules {
+		if !now.Before(r.expires) {
+			delete(s.rules, key)
+		}
+	}
+	s.count.Store(int32(len(s.rules)))
+}
+
+// active reports whether an override of fingerprint is active
+func (s *Set) active(fingerprint, action string) bool {
+	s.mu.RLock()
+	r, ok := s.rules[ruleKey{fingerprint, action}]
+	s.mu.RUnlock()
+	if ok && !s.now().Before(r.expires) {
+		s.mu.Lock()
+		s.expire()
+		s.mu.Unlock()
+		return false
+	}
+	return ok
+}
+
+// Apply returns parsed with the hints that an active override disables
+// cleared. The query is copied when it changes, so parsed queries of prepared
+// statements are left alone.
+func (s *Set) Apply(parsed *parser.ParsedQuery) *parser.ParsedQuery {
+	if s == nil || s.count.Load() == 0 || (parsed.TTL <= 0 && parsed.NegTTL <= 0 && parsed.BatchMs <= 0) {
+		return parsed
+	}
+	fingerprint := parser.Fingerprint(parsed.Query)
+	noBatch := parsed.BatchMs > 0 && s.active(fingerprint, NoBatch)
+	noCache := (parsed.TTL > 0 || parsed.NegTTL > 0) && s.active(fingerprint, NoCache)
+	if !noBatch && !noCache {
+		return parsed
+	}
+	overridden := *parsed
+	if noBatch {
+		overridden.BatchMs = 0
+		metrics.OverridesApplied.WithLabelValues(NoBatch).Inc()
+	}
+	if noCache {
+		overridden.TTL = 0
+		overridden.NegTTL = 0
+		metrics.OverridesApplied.WithLabelValues(NoCache).Inc()
+	}
+	return &overridden
+}
@@ -0,0 +1,70 @@
+package override
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+)
+
+func TestSet_Apply(t *testing.T) {
+	s := New()
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	write := parser.Parse("/* batch:10 */ UPDATE users SET seen = 1 WHERE id = 5")
+	read := parser.Parse("/* ttl:60 */ SELECT * FROM users WHERE id = 5")
+	if got := s.Apply(write); got != write {
+		t.Error("Expected no change without overrides")
+	}
+
+	if _, err := s.Add(parser.Fingerprint(write.Query), NoBatch, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("SELECT * FROM users WHERE id = ?", NoCache, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other values share the fingerprint
+	got := s.Apply(parser.Parse("/* batch:10 */ UPDATE users SET seen = 1 WHERE id = 6"))
+	if got.BatchMs != 0 {
+		t.Errorf("Expected the batch hint to be disabled, got %d", got.BatchMs)
+	}
+	if got := s.Apply(read); got.TTL != 0 || read.TTL != 60 {
+		t.Errorf("Expected a copy with ttl 0, got %d (original %d)", got.TTL, read.TTL)
+	}
+	if got := s.Apply(parser.Parse("/* ttl:60 */ SELECT * FROM orders WHERE id = 5")); got.TTL != 60 {
+		t.Errorf("Expected other queries to keep their ttl, got %d", got.TTL)
+	}
+
+	// The no_batch override expires after a minute
+	now = now.Add(2 * time.Minute)
+	if got := s.Apply(write); got.BatchMs != 10 {
+		t.Errorf("Expected the expired override to be ignored, got %d", got.BatchMs)
+	}
+	if rules := s.List(); len(rules) != 1 || rules[0].Action != NoCache {
+		t.Errorf("Expected only the no_cache override to be listed, got %v", rules)
+	}
+
+	if !s.Remove("SELECT * FROM users WHERE id = ?", NoCache) {
+		t.Error("Expected Remove to report the active override")
+	}
+	if got := s.Apply(read); got.TTL != 60 {
+		t.Errorf("Expected the removed override to be ignored, got %d", got.TTL)
+	}
+}
+
+func TestSet_AddErrors(t *testing.T) {
+	s := New()
+	if _, err := s.Add("SELECT ?", "no_logging", time.Minute); err == nil {
+		t.Error("Expected an error for an unknown action")
+	}
+	if _, err := s.Add("SELECT ?", NoCache, 0); err == nil {
+		t.Error("Expected an error for a zero ttl")
+	}
+	var nilSet *Set
+	q := parser.Parse("/* ttl:60 */ SELECT 1")
+	if nilSet.Apply(q) != q {
+		t.Error("Expected a nil set to leave queries alone")
+	}
+}
@@ -0,0 +1,192 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// valueKeywords are the keywords after which a literal is a value
+var valueKeywords = map[string]bool{"LIKE": true, "BETWEEN": true, "LIMIT": true, "OFFSET": true}
+
+// comparisonOps are the operators after which a literal is a value
+var comparisonOps = map[string]bool{"=": true, "<": true, ">": true, "<=": true, ">=": true, "<>": true, "!=": true}
+
+// normalizer holds the state of Normalize while it scans a query
+type normalizer struct {
+	b           strings.Builder
+	params      []interface{}
+	prev        string // Previous token: an uppercase keyword, an operator, "(", ")", "," or "" for other tokens
+	lists       []bool // Per open parenthesis, whether it holds a list of values (VALUES rows and IN lists)
+	valuesDepth int    // Depth of the VALUES keyword while its rows follow, -1 otherwise
+	between     bool   // A BETWEEN waits for its AND
+}
+
+// Normalize replaces the literals of a query that are values by '?'
+// placeholders and returns them as parameters, int64 for integers and string
+// for strings, so that queries that only differ in their values share the
+// normalized query. Values are the literals compared with =, <, >, <=, >=,
+// <> or !=, the operands of LIKE, BETWEEN, LIMIT and OFFSET and the items of
+// VALUES rows and IN lists. Other literals, such as the ordinals of ORDER BY
+// and typed literals (DATE '2024-01-01'), are kept, and so are decimals.
+// Whitespace outside literals is collapsed to single spaces.
+//
+// It returns false for queries it cannot rewrite safely: with placeholders,
+// comments, semicolons, backslashes (which escape quotes on MariaDB
+// only) or dollar quotes.
+func Normalize(query string) (string, []interface{}, bool) {
+	if strings.IndexByte(query, '\\') >= 0 {
+		return "", nil, false
+	}
+	n := &normalizer{valuesDepth: -1}
+	n.b.Grow(len(query))
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case isSpace(c):
+			for i < len(query) && isSpace(query[i]) {
+				i++
+			}
+			if n.b.Len() > 0 && i < len(query) {
+				n.b.WriteByte(' ')
+			}
+			continue
+		case c == '\'':
+			j := skipQuoted(query, i, '\'', false)
+			if j == len(query) && (j-i < 2 || query[j-1] != '\'') {
+				return "", nil, false
+			}
+			if n.isValue() {
+				n.value(strings.ReplaceAll(query[i+1:j-1], "''", "'"))
+			} else {
+				n.token(query[i:j], "")
+			}
+			i = j
+		case c == '"' || c == '`':
+			j := skipQuoted(query, i, c, false)
+			n.word(query[i:j], "")
+			i = j
+		case c == '?' || c == ';' || c == '#' || c == '$',
+			strings.HasPrefix(query[i:], "--"), strings.HasPrefix(query[i:], "/*"):
+			// Placeholders, dollar quotes, statement separators and comments
+			return "", nil, false
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j < len(query) && (isIdentByte(query[j]) || query[j] == '.') {
+				// A decimal, an exponent, a hexadecimal or an identifier
+				// starting with digits
+				for j < len(query) && (isIdentByte(query[j]) || query[j] == '.') {
+					j++
+				}
+				n.token(query[i:j], "")
+			} else if v, err := strconv.ParseInt(query[i:j], 10, 64); err == nil && n.isValue() {
+				n.value(v)
+			} else {
+				n.token(query[i:j], "")
+			}
+			i = j
+		case isIdentByte(c):
+			j := i
+			for j < len(query) && isIdentByte(query[j]) {
+				j++
+			}
+			n.word(query[i:j], strings.ToUpper(query[i:j]))
+			i = j
+		case c == '(':
+			list := n.prev == "IN" || (len(n.lists) == n.valuesDepth && (n.prev == "VALUES" || n.prev == "ROW" || n.prev == ","))
+			n.lists = append(n.lists, list)
+			n.token("(", "(")
+			i++
+		case c == ')':
+			if len(n.lists) > 0 {
+				n.lists = n.lists[:len(n.lists)-1]
+			}
+			n.token(")", ")")
+			i++
+		case strings.IndexByte("=<>!", c) >= 0:
+			j := i
+			for j < len(query) && strings.IndexByte("=<>!", query[j]) >= 0 {
+				j++
+			}
+			n.token(query[i:j], query[i:j])
+			i = j
+		default:
+			n.token(query[i:i+1], query[i:i+1])
+			i++
+		}
+	}
+	return n.b.String(), n.params, true
+}
+
+// isValue reports whether a literal at the current position is a value
+func (n *normalizer) isValue() bool {
+	switch {
+	case comparisonOps[n.prev] || valueKeywords[n.prev]:
+		return true
+	case n.prev == "AND":
+		return n.between
+	case n.prev == "(" || n.prev == ",":
+		return len(n.lists) > 0 && n.lists[len(n.lists)-1]
+	}
+	return false
+}
+
+// value replaces a literal by a placeholder
+func (n *normalizer) value(v interface{}) {
+	if n.prev == "AND" {
+		n.between = false
+	}
+	n.params = append(n.params, v)
+	n.token("?", "")
+}
+
+// word writes an identifier or keyword, which ends the rows of VALUES
+func (n *normalizer) word(text, keyword string) {
+	switch keyword {
+	case "VALUES":
+		n.valuesDepth = len(n.lists)
+	case "ROW":
+	case "BETWEEN":
+		n.between = true
+	default:
+		if len(n.lists) == n.valuesDepth {
+			n.valuesDepth = -1
+		}
+	}
+	n.token(text, keyword)
+}
+
+// token writes a token and remembers it as the previous token
+func (n *normalizer) token(text, prev string) {
+	n.b.WriteString(text)
+	n.prev = prev
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// NormalizedKey returns the normalized query with its values (see
+// Normalize), as a key that is the same for queries that only differ in
+// whitespace, and different for queries with different values. Queries that
+// cannot be normalized are their own key.
+func NormalizedKey(query string) string {
+	normalized, params, ok := Normalize(query)
+	if !ok {
+		return query
+	}
+	var b strings.Builder
+	b.WriteString(normalized)
+	for _, param := range params {
+		b.WriteByte(0)
+		switch v := param.(type) {
+		case int64:
+			b.WriteString(strconv.FormatInt(v, 10))
+		case string:
+			b.WriteString(strconv.Quote(v))
+		}
+	}
+	return b.String()
+}
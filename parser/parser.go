@@ -3,19 +3,23 @@
 //
 // The parser extracts SQL comment hints in the format:
 //
-//	/* ttl:60 file:app.go line:42 batch:10 */
+//	/* ttl:60 negcache:5 file:app.go line:42 batch:10 */
 //
 // Where:
 //   - ttl: Cache TTL in seconds (SELECT queries only)
+//   - negcache: Cache TTL in seconds of empty results and deterministic errors (SELECT queries only)
 //   - file: Source file name (for metrics and debugging)
 //   - line: Line number in source file
 //   - batch: Maximum batching window in milliseconds (write operations only)
+//   - ack: Acknowledgement of a batched write, early to acknowledge it before its batch executed
+//   - durability: Commit durability of the batch, relaxed or local (batched writes to PostgreSQL only)
 //
 // The parser is intentionally lightweight, using regex patterns rather than
 // a full SQL grammar parser to minimize latency in the proxy hot path.
 package parser
 
 import (
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
@@ -34,32 +38,106 @@ const (
 
 // ParsedQuery contains extracted information from a SQL query
 type ParsedQuery struct {
-	Type    QueryType
-	TTL     int    // TTL in seconds, 0 means no caching
-	DB      string // Database name from FQN
-	File    string // Source file from hint
-	Line    int    // Source line from hint
-	BatchMs int    // Maximum wait time for batching in ms (0 = no batching)
-	Query   string // Original query
+	Type       QueryType
+	TTL        int      // TTL in seconds, 0 means no caching
+	NegTTL     int      // TTL in seconds of empty results and deterministic errors, 0 means the TTL applies to empty results and errors are not cached
+	DB         string   // Database name from FQN
+	File       string   // Source file from hint
+	Line       int      // Source line from hint
+	BatchMs    int      // Maximum wait time for batching in ms (0 = no batching)
+	BatchMax   int      // Maximum writes per batch, set by a server-side batch rule (0 = the configured maximum)
+	Ack        string   // Acknowledgement of a batched write: AckEarly or empty (after the batch executed)
+	Durability string   // Commit durability of the batch: DurabilityRelaxed, DurabilityLocal or empty (full)
+	MaxLagMs   int      // Maximum replication lag in ms of a replica serving the read (0 = any replica)
+	Route      string   // Routing override: RoutePrimary, RouteReplica or a backend name (empty = default routing)
+	Query      string   // Query without hint comments
+	Raw        string   // Query as sent by the client, hint comments included
+	Tables     []string // Referenced tables (lowercase, without database prefix)
 }
 
+// Durabilities of the durability hint
+const (
+	DurabilityRelaxed = "relaxed"
+	DurabilityLocal   = "local"
+)
+
+// AckEarly acknowledges a batched write before its batch executed, see the
+// ack hint
+const AckEarly = "early"
+
+// Routing overrides of the route hint, any other value names a backend
+const (
+	RoutePrimary = "primary"
+	RouteReplica = "replica"
+)
+
 var (
-	// Match /* ttl:60 */ or /*ttl:60*/ or /* ttl:60 file:user.go line:42 batch:10 */
-	hintRegex = regexp.MustCompile(`/\*\s*(ttl:(\d+))?\s*(file:(\S+))?\s*(line:(\d+))?\s*(batch:(\d+))?\s*\*/`)
+	// Match /* ttl:60 */ or /*ttl:60*/ or /* ttl:60 negcache:5 file:user.go line:42 batch:10 ack:early durability:relaxed maxlag:500 route:primary */
+	hintRegex = regexp.MustCompile(`/\*\s*(ttl:(\d+))?\s*(negcache:(\d+))?\s*(file:(\S+))?\s*(line:(\d+))?\s*(batch:(\d+))?\s*(ack:([a-z]+))?\s*(durability:([a-z]+))?\s*(maxlag:(\d+))?\s*(route:([A-Za-z0-9_.-]+))?\s*\*/`)
+	// Match the characters allowed in a file hint
+	fileHintRegex = regexp.MustCompile(`^[A-Za-z0-9_.@+~:()/-]+$`)
 	// Match query type (allows comments before keyword)
 	queryTypeRegex = regexp.MustCompile(`(?i)\b(SELECT|INSERT|UPDATE|DELETE)\b`)
 	// Match Fully Qualified Names (FQN) like db.table or `db`.`table`
 	fqnRegex = regexp.MustCompile("(?i)\\b(?:FROM|JOIN|INTO|UPDATE)\\s+(['\"`]?)([a-zA-Z0-9_$]+)['\"`]?\\s*\\.\\s*(['\"`]?)([a-zA-Z0-9_$]+)['\"`]?")
+	// Match single quoted string literals (double quotes may be identifiers)
+	singleQuotedRegex = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	// Match numeric literals and PostgreSQL placeholders ($1)
+	literalNumberRegex = regexp.MustCompile(`\$\d+|\b\d+(?:\.\d+)?\b`)
 	// Match string literals
 	stringLiteralRegex = regexp.MustCompile(`'[^']*'|"[^"]*"`)
 	// Match numbers
 	numberRegex = regexp.MustCompile(`\b\d+\.?\d*\b`)
+	// Match schema metadata statements (SHOW COLUMNS, DESCRIBE, ...)
+	metadataStmtRegex = regexp.MustCompile(`(?i)^\s*(SHOW\s+(FULL\s+)?(COLUMNS|FIELDS|TABLES|INDEX|INDEXES|KEYS|CREATE|DATABASES|SCHEMAS)|DESCRIBE|DESC)\b`)
+	// Match references to system catalogs (information_schema, pg_catalog)
+	catalogRegex = regexp.MustCompile(`(?i)\b(information_schema|pg_catalog)\s*\.|\bpg_(class|attribute|type|namespace|index|constraint|proc|attrdef|description)\b`)
+	// Match row locks and SELECT ... INTO, which make a SELECT more than a read
+	lockingReadRegex = regexp.MustCompile(`(?i)\bFOR\s+(NO\s+KEY\s+)?(UPDATE|SHARE|KEY\s+SHARE)\b|\bLOCK\s+IN\s+SHARE\s+MODE\b|\bINTO\b`)
+	// Match statements that only read: SELECT or WITH, possibly in parentheses
+	readStmtRegex = regexp.MustCompile(`(?i)^[\s(]*(SELECT|WITH)\b`)
+	// Match writes in CTEs, functions with side effects or session state, and
+	// MariaDB variables, which a replica cannot serve for the session
+	sessionReadRegex = regexp.MustCompile(`(?i)\b(INSERT|UPDATE|DELETE|MERGE)\b|\b(nextval|setval|currval|lastval|last_insert_id|found_rows|row_count|get_lock|release_lock|release_all_locks|is_used_lock|is_free_lock|pg_(try_)?advisory_\w+|txid_current|pg_current_xact_id|set_config)\s*\(|@`)
+	// Match DDL statements
+	ddlRegex = regexp.MustCompile(`(?i)^\s*(CREATE|ALTER|DROP|TRUNCATE|RENAME)\b`)
+	// Match the MariaDB statements that commit the open transaction, except
+	// the statements on temporary tables
+	implicitCommitRegex = regexp.MustCompile(`(?i)^\s*(?:CREATE|ALTER|DROP|TRUNCATE|RENAME|GRANT|REVOKE|LOCK\s+TABLES?|ANALYZE|OPTIMIZE|REPAIR|CHECK\s+TABLE|FLUSH|CACHE\s+INDEX|LOAD\s+INDEX|SET\s+PASSWORD|(?:START|STOP)\s+(?:SLAVE|REPLICA)|CHANGE\s+(?:MASTER|REPLICATION))\b`)
+	callRegex           = regexp.MustCompile(`(?i)^\s*CALL\s`)
+	temporaryTableRegex = regexp.MustCompile(`(?i)^\s*(?:CREATE|DROP)\s+(?:OR\s+REPLACE\s+)?TEMPORARY\s+TABLE\b`)
+	// Match tables read or written by a query
+	tableRefRegex = regexp.MustCompile(`(?i)\b(?:FROM|JOIN|INTO|UPDATE)\s+(` + identList + `)`)
+	// Match tables changed by CREATE/ALTER/DROP/RENAME TABLE and TRUNCATE
+	ddlTableRegex = regexp.MustCompile(`(?i)^\s*(?:(?:CREATE|ALTER|DROP|RENAME)\b[^(;]*?\bTABLES?|TRUNCATE(?:\s+TABLE)?)\s+(?:IF\s+(?:NOT\s+)?EXISTS\s+|ONLY\s+)?(` + identList + `)`)
+	// Match the table of CREATE/DROP INDEX ... ON table
+	ddlIndexRegex = regexp.MustCompile(`(?i)^\s*(?:CREATE|DROP)\b[^;]*?\bINDEX\b[^;]*?\bON\s+(` + ident + `)`)
+	// Match the WHERE clause, up to trailing ORDER BY, LIMIT or RETURNING
+	whereRegex = regexp.MustCompile(`(?is)\bWHERE\b(.*?)(?:\bORDER\s+BY\b|\bLIMIT\b|\bRETURNING\b|$)`)
+	// Match equality predicates (col = x or col IN (...)) in a WHERE clause
+	equalityRegex = regexp.MustCompile(`(?i)(` + ident + `)\s*(?:=|\bIN\s*\()`)
+	// Match OR in a WHERE clause
+	orRegex = regexp.MustCompile(`(?i)\bOR\b`)
+	// Match separators in a list of tables ("a, b" or "a TO b")
+	identSepRegex = regexp.MustCompile(`(?i)\s*,\s*|\s+TO\s+`)
+	// Match the alias of an expression in a RETURNING clause
+	returningAliasRegex = regexp.MustCompile(`(?is)\sAS\s+("[^"]+"|[a-zA-Z_][a-zA-Z0-9_$]*)$`)
+	// Match a (possibly table qualified) column in a RETURNING clause
+	returningIdentRegex = regexp.MustCompile(`^` + ident + `$`)
+)
+
+const (
+	// A (possibly quoted and database qualified) table name
+	ident = "[`\"]?[a-zA-Z0-9_$]+[`\"]?(?:\\s*\\.\\s*[`\"]?[a-zA-Z0-9_$]+[`\"]?)?"
+	// A list of table names separated by commas or TO (RENAME TABLE a TO b)
+	identList = ident + "(?:(?:\\s*,\\s*|\\s+(?i:TO)\\s+)" + ident + ")*"
 )
 
 // Parse extracts metadata from a SQL query
 func Parse(query string) *ParsedQuery {
 	p := &ParsedQuery{
 		Query: query,
+		Raw:   query,
 		Type:  QueryUnknown,
 	}
 
@@ -88,36 +166,193 @@ func Parse(query string) *ParsedQuery {
 			p.TTL, _ = strconv.Atoi(matches[2])
 		}
 		if matches[4] != "" {
-			p.File = matches[4]
+			p.NegTTL, _ = strconv.Atoi(matches[4])
 		}
 		if matches[6] != "" {
-			p.Line, _ = strconv.Atoi(matches[6])
+			p.File = sanitizeFile(matches[6])
 		}
 		if matches[8] != "" {
-			batchMs, _ := strconv.Atoi(matches[8])
+			p.Line, _ = strconv.Atoi(matches[8])
+		}
+		if matches[10] != "" {
+			batchMs, _ := strconv.Atoi(matches[10])
 			// Reject negative values - batching delay must be non-negative
 			if batchMs < 0 {
 				batchMs = 0
 			}
 			p.BatchMs = batchMs
 		}
+		if matches[12] == AckEarly {
+			p.Ack = AckEarly
+		}
+		if d := matches[14]; d == DurabilityRelaxed || d == DurabilityLocal {
+			p.Durability = d
+		}
+		if matches[16] != "" {
+			p.MaxLagMs, _ = strconv.Atoi(matches[16])
+		}
+		p.Route = matches[18]
 		// Remove the hint comment from the query so it's not sent to backend
 		// This also ensures identical queries batch together regardless of hint differences
 		p.Query = hintRegex.ReplaceAllString(query, "")
 		p.Query = strings.TrimSpace(p.Query)
 	}
 
+	p.Tables = extractTables(p.Query)
+
 	// TTL is silently ignored for writes - caching only applies to SELECT queries
-	if p.IsWritable() && p.TTL > 0 {
+	if p.IsWritable() {
 		p.TTL = 0
+		p.NegTTL = 0
+		if p.Ack != "" && ReturningColumns(p.Query) != nil {
+			p.Ack = ""
+		}
+	} else {
+		p.Durability = ""
+		p.Ack = ""
 	}
 
 	return p
 }
 
-// IsCacheable returns true if query can be cached
+// maxFileLen is the longest file hint accepted
+const maxFileLen = 255
+
+// sanitizeFile validates a file hint, which ends up in the file label of the
+// metrics and in the logs. Windows separators become slashes and a leading
+// "./" is dropped. Hints that are too long, contain characters that do not
+// occur in file paths or a ".." segment are rejected as "", which is reported
+// as an unknown file.
+func sanitizeFile(file string) string {
+	file = strings.TrimPrefix(strings.ReplaceAll(file, `\`, "/"), "./")
+	if len(file) > maxFileLen || !fileHintRegex.MatchString(file) {
+		return ""
+	}
+	for _, segment := range strings.Split(file, "/") {
+		if segment == ".." {
+			return ""
+		}
+	}
+	return file
+}
+
+// RouteBackend returns the backend named by a route hint, or an empty string
+// when the query has no route hint or one that routes to the primary or a
+// replica
+func (p *ParsedQuery) RouteBackend() string {
+	if p.Route == RoutePrimary || p.Route == RouteReplica {
+		return ""
+	}
+	return p.Route
+}
+
+// IsCacheable returns true if query can be cached, for its ttl or negcache
+// hint
 func (p *ParsedQuery) IsCacheable() bool {
-	return p.Type == QuerySelect && p.TTL > 0
+	return p.Type == QuerySelect && (p.TTL > 0 || p.NegTTL > 0)
+}
+
+// IsMetadata returns true if query reads schema metadata, such as SHOW COLUMNS,
+// DESCRIBE or a SELECT on information_schema or pg_catalog
+func (p *ParsedQuery) IsMetadata() bool {
+	if metadataStmtRegex.MatchString(p.Query) {
+		return true
+	}
+	return p.Type == QuerySelect && catalogRegex.MatchString(p.Query)
+}
+
+// IsRepeatable returns true if query is a plain SELECT of tables, whose result
+// may be reused for an identical query without a ttl hint: it reads at least
+// one table and does not lock rows or store its result
+func (p *ParsedQuery) IsRepeatable() bool {
+	return p.Type == QuerySelect && len(p.Tables) > 0 && !lockingReadRegex.MatchString(p.Query)
+}
+
+// IsReplicaSafe returns true if query is a SELECT that a replica can serve: it
+// does not lock rows, store its result, write in a CTE, or call functions
+// with side effects or session state (nextval, LAST_INSERT_ID, GET_LOCK,
+// advisory locks, ...), and does not use MariaDB variables
+func (p *ParsedQuery) IsReplicaSafe() bool {
+	return p.Type == QuerySelect && readStmtRegex.MatchString(p.Query) &&
+		!lockingReadRegex.MatchString(p.Query) && !sessionReadRegex.MatchString(p.Query)
+}
+
+// IsDDL returns true if query changes the schema (CREATE, ALTER, DROP, TRUNCATE, RENAME)
+func (p *ParsedQuery) IsDDL() bool {
+	return ddlRegex.MatchString(p.Query)
+}
+
+// IsCall returns true if query calls a stored procedure, which may write and
+// return several results
+func (p *ParsedQuery) IsCall() bool {
+	return callRegex.MatchString(p.Query)
+}
+
+// CommitsImplicitly returns true if MariaDB commits the open transaction
+// before it executes the query: DDL (except on temporary tables), account
+// management, LOCK TABLES and administrative statements. PostgreSQL runs DDL
+// in the transaction.
+func (p *ParsedQuery) CommitsImplicitly() bool {
+	return implicitCommitRegex.MatchString(p.Query) && !temporaryTableRegex.MatchString(p.Query)
+}
+
+// extractTables returns the tables a query refers to. For DDL only the
+// changed tables are returned.
+func extractTables(query string) []string {
+	var lists []string
+	if ddlRegex.MatchString(query) {
+		if matches := ddlTableRegex.FindStringSubmatch(query); matches != nil {
+			lists = append(lists, matches[1])
+		} else if matches := ddlIndexRegex.FindStringSubmatch(query); matches != nil {
+			lists = append(lists, matches[1])
+		}
+	} else {
+		for _, matches := range tableRefRegex.FindAllStringSubmatch(query, -1) {
+			lists = append(lists, matches[1])
+		}
+	}
+
+	var tables []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, name := range identSepRegex.Split(list, -1) {
+			name = strings.Map(func(r rune) rune {
+				if r == '`' || r == '"' || r == ' ' || r == '\t' || r == '\n' {
+					return -1
+				}
+				return r
+			}, name)
+			if i := strings.LastIndexByte(name, '.'); i >= 0 {
+				name = name[i+1:]
+			}
+			name = strings.ToLower(name)
+			if name != "" && !seen[name] {
+				seen[name] = true
+				tables = append(tables, name)
+			}
+		}
+	}
+	return tables
+}
+
+// EqualityColumns returns the columns compared for equality (col = x or
+// col IN (...)) in the WHERE clause, lowercase and without table prefix. It
+// returns nil when there is no WHERE clause or it contains OR, as the query
+// may then touch any number of rows.
+func (p *ParsedQuery) EqualityColumns() []string {
+	matches := whereRegex.FindStringSubmatch(singleQuotedRegex.ReplaceAllString(p.Query, "?"))
+	if matches == nil || orRegex.MatchString(matches[1]) {
+		return nil
+	}
+	var columns []string
+	for _, m := range equalityRegex.FindAllStringSubmatch(matches[1], -1) {
+		name := strings.ToLower(strings.Trim(m[1], "`\""))
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = strings.Trim(name[i+1:], "`\" ")
+		}
+		columns = append(columns, name)
+	}
+	return columns
 }
 
 // IsWritable returns true if query is a write operation (INSERT, UPDATE, DELETE)
@@ -138,21 +373,843 @@ func (p *ParsedQuery) IsBatchable() bool {
 	return (p.Type == QueryInsert || p.Type == QueryUpdate || p.Type == QueryDelete) && p.BatchMs > 0
 }
 
+// Fingerprint returns the query with string and numeric literals replaced by
+// '?', so that queries differing only in their values share a fingerprint
+func Fingerprint(query string) string {
+	query = singleQuotedRegex.ReplaceAllString(query, "?")
+	return literalNumberRegex.ReplaceAllStringFunc(query, func(m string) string {
+		if m[0] == '$' {
+			return m // PostgreSQL placeholder
+		}
+		return "?"
+	})
+}
+
+// TranslatePlaceholders replaces '?' placeholders with PostgreSQL style $1..$n
+// placeholders and returns the translated query with the number of
+// placeholders. Question marks in string literals, quoted identifiers,
+// dollar-quoted strings and comments are left alone, and '??' is an escaped
+// literal '?' (for the PostgreSQL JSON operators).
+func TranslatePlaceholders(query string) (string, int) {
+	if strings.IndexByte(query, '?') < 0 {
+		return query, 0
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '?':
+			if i+1 < len(query) && query[i+1] == '?' {
+				b.WriteByte('?')
+				i += 2
+				continue
+			}
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			i++
+			continue
+		case c == '\'':
+			// E'...' strings allow backslash escapes
+			escapes := i > 0 && (query[i-1] == 'E' || query[i-1] == 'e')
+			j := skipQuoted(query, i, '\'', escapes)
+			b.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '"':
+			j := skipQuoted(query, i, '"', false)
+			b.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query) - i
+			}
+			b.WriteString(query[i : i+j])
+			i += j
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := skipBlockComment(query, i)
+			b.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '$' && (i == 0 || !isIdentByte(query[i-1])):
+			if tag := dollarQuoteTag(query[i:]); tag != "" {
+				j := strings.Index(query[i+len(tag):], tag)
+				if j < 0 {
+					j = len(query)
+				} else {
+					j = i + len(tag) + j + len(tag)
+				}
+				b.WriteString(query[i:j])
+				i = j
+				continue
+			}
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), n
+}
+
+// skipQuoted returns the index after the quoted string or identifier starting
+// at i. A doubled quote is an escaped quote.
+func skipQuoted(query string, i int, quote byte, escapes bool) int {
+	for j := i + 1; j < len(query); j++ {
+		switch query[j] {
+		case '\\':
+			if escapes {
+				j++
+			}
+		case quote:
+			if j+1 < len(query) && query[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(query)
+}
+
+// skipBlockComment returns the index after the (possibly nested) block comment
+// starting at i
+func skipBlockComment(query string, i int) int {
+	depth := 0
+	for j := i; j+1 < len(query); j++ {
+		switch {
+		case query[j] == '/' && query[j+1] == '*':
+			depth++
+			j++
+		case query[j] == '*' && query[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(query)
+}
+
+// isIdentByte returns true for bytes that may appear in an unquoted identifier
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// dollarQuoteTag returns the opening tag ($$ or $tag$) when s starts with a
+// dollar-quoted string, or "" otherwise
+func dollarQuoteTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '$':
+			return s[:j+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || j > 1 && c >= '0' && c <= '9':
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// ClampBatch limits the batch window to [minMs, maxMs], where 0 means no
+// limit. It returns the hinted window and whether it was changed. Queries
+// without a batch hint are left alone.
+func (p *ParsedQuery) ClampBatch(minMs, maxMs int) (int, bool) {
+	hinted := p.BatchMs
+	if hinted <= 0 {
+		return hinted, false
+	}
+	if minMs > 0 && p.BatchMs < minMs {
+		p.BatchMs = minMs
+	}
+	if maxMs > 0 && p.BatchMs > maxMs {
+		p.BatchMs = maxMs
+	}
+	return hinted, p.BatchMs != hinted
+}
+
+// DefaultBatch sets the batch window of a write without a batch hint to ms,
+// where 0 leaves it unbatched. It reports whether the window was set.
+func (p *ParsedQuery) DefaultBatch(ms int) bool {
+	if ms <= 0 || p.BatchMs > 0 || (p.Type != QueryInsert && p.Type != QueryUpdate && p.Type != QueryDelete) {
+		return false
+	}
+	p.BatchMs = ms
+	return true
+}
+
+// DefaultAck sets the acknowledgement of a write without an ack hint to ack,
+// where empty leaves it acknowledged after its batch. Writes with a RETURNING
+// clause wait for their batch, as the client needs the returned rows. It
+// reports whether the acknowledgement was set.
+func (p *ParsedQuery) DefaultAck(ack string) bool {
+	if ack == "" || p.Ack != "" || !p.IsWritable() || ReturningColumns(p.Query) != nil {
+		return false
+	}
+	p.Ack = ack
+	return true
+}
+
 // GetBatchKey returns a key for grouping writes for batching
 //
 // The batch key is the normalized query (with hints stripped). This ensures:
 //   - Identical queries batch together, regardless of hint metadata
 //   - Different queries create separate batches
-//   - Parameter values are part of the key (different values = different batches)
+//   - Literal values are part of the key (different values = different batches)
 //
 // Example:
 //
-//	Query 1: "/* batch:10 file:a.go line:1 */ INSERT INTO t VALUES (1)"
-//	Query 2: "/* batch:10 file:b.go line:2 */ INSERT INTO t VALUES (1)"
-//	Both have batch key: "INSERT INTO t VALUES (1)" - they batch together
+//	Query 1: "/* batch:10 file:a.go line:1 */ UPDATE t SET a = 1"
+//	Query 2: "/* batch:10 file:b.go line:2 */ UPDATE t SET a = 1"
+//	Both have batch key: "UPDATE t SET a = 1" - they batch together
 //
-//	Query 3: "/* batch:10 */ INSERT INTO t VALUES (2)"
-//	Has batch key: "INSERT INTO t VALUES (2)" - separate batch
+//	Query 3: "/* batch:10 */ UPDATE t SET a = 2"
+//	Has batch key: "UPDATE t SET a = 2" - separate batch
+//
+// INSERT ... VALUES queries that can be merged (see InsertValues) are keyed by
+// the statement up to VALUES instead, so that inserts into the same table and
+// columns batch together, whatever their values or number of rows. Upserts
+// (see InsertUpsert) are keyed by that statement and their clause, so that
+// they only batch with upserts with the same clause.
 func (p *ParsedQuery) GetBatchKey() string {
+	if p.Type == QueryInsert {
+		if prefix, _, clause, ok := InsertUpsert(p.Query); ok {
+			if clause != "" {
+				return prefix + " " + clause
+			}
+			return prefix
+		}
+	}
 	return p.Query
 }
+
+// InsertValues splits an INSERT ... VALUES query into the statement up to and
+// including VALUES and its row tuples, such as "(1, 'a')". It returns false for
+// other queries and for inserts with a clause after the rows (ON DUPLICATE KEY
+// UPDATE, ON CONFLICT, RETURNING), which cannot be merged with other inserts
+// (upserts are split by InsertUpsert).
+// Queries with line comments or backslashes are not split either, as their
+// meaning differs between MariaDB and PostgreSQL.
+func InsertValues(query string) (prefix string, rows []string, ok bool) {
+	prefix, rows, clause, ok := InsertUpsert(query)
+	if !ok || clause != "" {
+		return "", nil, false
+	}
+	return prefix, rows, true
+}
+
+// upsertClauseRegex matches the start of the clause of an upsert
+var upsertClauseRegex = regexp.MustCompile(`(?is)^ON\s+(DUPLICATE\s+KEY\s+UPDATE|CONFLICT)\b`)
+
+// InsertUpsert splits an INSERT ... VALUES query like InsertValues, and also
+// upserts: inserts with an ON DUPLICATE KEY UPDATE (MariaDB) or ON CONFLICT
+// (PostgreSQL) clause after the rows, which is returned as clause ("" for
+// plain inserts). Upserts are only split when their clause applies to every
+// row the same way, so that the rows of upserts with the same clause can be
+// merged: it may not have placeholders, a RETURNING or another statement.
+func InsertUpsert(query string) (prefix string, rows []string, clause string, ok bool) {
+	q := strings.TrimSpace(query)
+	if len(q) < 6 || !strings.EqualFold(q[:6], "INSERT") || strings.IndexByte(q, '\\') >= 0 {
+		return "", nil, "", false
+	}
+
+	// Find VALUES outside of quotes, comments and parentheses
+	start, depth := -1, 0
+	for i := 0; i < len(q) && start < 0; i++ {
+		if j := skipToken(q, i); j < 0 {
+			return "", nil, "", false
+		} else if j > i {
+			i = j - 1
+			continue
+		}
+		switch c := q[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == 'V' || c == 'v') && (i == 0 || !isIdentByte(q[i-1])) &&
+			len(q) >= i+6 && strings.EqualFold(q[i:i+6], "VALUES") && (len(q) == i+6 || !isIdentByte(q[i+6])):
+			start = i + 6
+		}
+	}
+	if start < 0 {
+		return "", nil, "", false
+	}
+	prefix = strings.TrimSpace(q[:start])
+
+	// Split the rows: parenthesized tuples separated by commas
+	rest := q[start:]
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n")
+		if rest == "" || rest[0] != '(' {
+			return "", nil, "", false
+		}
+		end := closingParen(rest)
+		if end < 0 {
+			return "", nil, "", false
+		}
+		rows = append(rows, rest[:end+1])
+		rest = strings.TrimLeft(rest[end+1:], " \t\r\n")
+		switch {
+		case rest == "" || rest == ";":
+			return prefix, rows, "", true
+		case rest[0] != ',':
+			clause = strings.TrimSpace(strings.TrimSuffix(rest, ";"))
+			if !upsertClauseRegex.MatchString(clause) || !mergeableClause(clause) {
+				return "", nil, "", false
+			}
+			return prefix, rows, clause, true
+		}
+		rest = rest[1:]
+	}
+}
+
+// mergeableClause reports whether the clause of an upsert has no
+// placeholders, RETURNING or semicolons outside of quotes
+func mergeableClause(clause string) bool {
+	for i := 0; i < len(clause); i++ {
+		if j := skipToken(clause, i); j < 0 {
+			return false
+		} else if j > i {
+			i = j - 1
+			continue
+		}
+		switch c := clause[i]; {
+		case c == '?' || c == ';':
+			return false
+		case c == '$' && i+1 < len(clause) && clause[i+1] >= '0' && clause[i+1] <= '9':
+			return false
+		case (c == 'R' || c == 'r') && (i == 0 || !isIdentByte(clause[i-1])) && len(clause) >= i+9 &&
+			strings.EqualFold(clause[i:i+9], "RETURNING") && (len(clause) == i+9 || !isIdentByte(clause[i+9])):
+			return false
+		}
+	}
+	return true
+}
+
+// ReturningColumns returns the names of the columns of the RETURNING clause of
+// a (PostgreSQL) write, as the backend names them, or nil when it has none.
+// Unquoted names are folded to lower case, aliases are used when given and
+// other expressions are named "?column?". A "*" is returned as is.
+func ReturningColumns(query string) []string {
+	q := strings.TrimSpace(query)
+
+	// Find RETURNING outside of quotes, comments and parentheses
+	start, depth := -1, 0
+	for i := 0; i < len(q); i++ {
+		if j := skipToken(q, i); j < 0 {
+			return nil
+		} else if j > i {
+			i = j - 1
+			continue
+		}
+		switch c := q[i]; {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && (c == 'R' || c == 'r') && (i == 0 || !isIdentByte(q[i-1])) &&
+			len(q) >= i+9 && strings.EqualFold(q[i:i+9], "RETURNING") && (len(q) == i+9 || !isIdentByte(q[i+9])):
+			start = i + 9
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	// Split the expressions on commas outside of parentheses
+	var cols []string
+	rest := strings.TrimSuffix(strings.TrimSpace(q[start:]), ";")
+	from := 0
+	depth = 0
+	for i := 0; i <= len(rest); i++ {
+		if i < len(rest) {
+			if j := skipToken(rest, i); j > i {
+				i = j - 1
+				continue
+			}
+			switch rest[i] {
+			case '(':
+				depth++
+				continue
+			case ')':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		cols = append(cols, returningName(strings.TrimSpace(rest[from:i])))
+		from = i + 1
+	}
+	return cols
+}
+
+// returningName returns the column name of an expression of a RETURNING clause
+func returningName(expr string) string {
+	if m := returningAliasRegex.FindStringSubmatch(expr); m != nil {
+		return identName(m[1])
+	}
+	if expr == "*" || returningIdentRegex.MatchString(expr) {
+		if i := strings.LastIndexByte(expr, '.'); i >= 0 {
+			expr = strings.TrimSpace(expr[i+1:])
+		}
+		return identName(expr)
+	}
+	return "?column?"
+}
+
+// identName returns the name of an identifier: unquoted, or folded to lower
+// case when it is not quoted
+func identName(ident string) string {
+	if len(ident) >= 2 && (ident[0] == '"' || ident[0] == '`') {
+		return ident[1 : len(ident)-1]
+	}
+	return strings.ToLower(ident)
+}
+
+// closingParen returns the index of the parenthesis that closes the one at the
+// start of s, or -1 if there is none
+func closingParen(s string) int {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		if j := skipToken(s, i); j < 0 {
+			return -1
+		} else if j > i {
+			i = j - 1
+			continue
+		}
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// skipToken returns the index after the quoted string, quoted identifier or
+// block comment starting at i, i when there is none, or -1 for a line comment
+func skipToken(s string, i int) int {
+	switch c := s[i]; {
+	case c == '\'' || c == '"' || c == '`':
+		return skipQuoted(s, i, c, false)
+	case c == '/' && strings.HasPrefix(s[i:], "/*"):
+		return skipBlockComment(s, i)
+	case c == '#' || c == '-' && strings.HasPrefix(s[i:], "--"):
+		return -1
+	}
+	return i
+}
+
+// ShiftPlaceholders adds offset to the PostgreSQL style $n placeholders in
+// query, so that it can follow a query with offset parameters when the two are
+// combined into one statement
+func ShiftPlaceholders(query string, offset int) string {
+	if offset == 0 || strings.IndexByte(query, '$') < 0 {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"':
+			j := skipQuoted(query, i, c, c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e'))
+			b.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := skipBlockComment(query, i)
+			b.WriteString(query[i:j])
+			i = j
+			continue
+		case c == '$' && (i == 0 || !isIdentByte(query[i-1])):
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				n, _ := strconv.Atoi(query[i+1 : j])
+				b.WriteByte('$')
+				b.WriteString(strconv.Itoa(n + offset))
+				i = j
+				continue
+			}
+			if tag := dollarQuoteTag(query[i:]); tag != "" {
+				j := strings.Index(query[i+len(tag):], tag)
+				if j < 0 {
+					j = len(query)
+				} else {
+					j = i + len(tag) + j + len(tag)
+				}
+				b.WriteString(query[i:j])
+				i = j
+				continue
+			}
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String()
+}
+
+// Match SET of a proxy session variable, such as SET tqdb_ordered_writes = ON
+// or, in the style of PostgreSQL custom parameters, SET tqdb.verbose = on
+var proxySetRegex = regexp.MustCompile(`(?is)^\s*SET\s+(?:SESSION\s+|@@(?:SESSION\.)?)?(tqdb[._][a-z0-9_]+)\s*(?:=|\bTO\b)\s*(?:'([^']*)'|"([^"]*)"|([a-z0-9_.-]+))\s*;?\s*$`)
+
+// Match SET GLOBAL of a proxy variable, such as SET GLOBAL tqdb_cache = OFF
+var proxySetGlobalRegex = regexp.MustCompile(`(?is)^\s*SET\s+(?:GLOBAL\s+|@@GLOBAL\.)(tqdb_[a-z0-9_]+)\s*(?:=|\bTO\b)\s*(?:'([^']*)'|"([^"]*)"|([a-z0-9_.-]+))\s*;?\s*$`)
+
+// ParseProxySetGlobal parses a SET GLOBAL statement for a variable of the
+// proxy itself (prefixed with "tqdb_"), such as a kill switch. It returns the
+// lowercase variable name and the unquoted value.
+func ParseProxySetGlobal(query string) (name, value string, ok bool) {
+	m := proxySetGlobalRegex.FindStringSubmatch(query)
+	if m == nil {
+		return "", "", false
+	}
+	return strings.ToLower(m[1]), m[2] + m[3] + m[4], true
+}
+
+// ParseProxySet parses a SET statement for a session variable of the proxy
+// itself (prefixed with "tqdb_" or "tqdb."), which is handled by the proxy and
+// never sent to the backend. The name is returned in lowercase, with the
+// prefix "tqdb_".
+func ParseProxySet(query string) (name, value string, ok bool) {
+	m := proxySetRegex.FindStringSubmatch(query)
+	if m == nil {
+		return "", "", false
+	}
+	return "tqdb_" + strings.ToLower(m[1][5:]), m[2] + m[3] + m[4], true
+}
+
+// Match the parts of the SET statements that change the session state of a
+// backend connection, see ParseSessionSet and ParsePgSessionSet
+var (
+	setStmtRegex      = regexp.MustCompile(`(?is)^\s*SET\s+(.*?)\s*;?\s*$`)
+	resetStmtRegex    = regexp.MustCompile(`(?is)^\s*RESET\s+("[^"]+"|[a-z_][a-z0-9_.]*)\s*;?\s*$`)
+	setScopeRegex     = regexp.MustCompile(`(?is)^(?:GLOBAL\s|PERSIST\s|PERSIST_ONLY\s|@@GLOBAL\.|@@PERSIST\.|@@PERSIST_ONLY\.)`)
+	setSessionRegex   = regexp.MustCompile(`(?is)^(?:SESSION\s+|LOCAL\s+|@@SESSION\.|@@LOCAL\.|@@)`)
+	setAssignRegex    = regexp.MustCompile(`(?is)^(@?(?:` + "`[^`]+`" + `|[a-z0-9_$.]+))\s*:?=`)
+	setNamesRegex     = regexp.MustCompile(`(?is)^(?:NAMES|CHARACTER\s+SET|CHARSET)\s`)
+	setTxRegex        = regexp.MustCompile(`(?is)^SESSION\s+TRANSACTION\s+(.*)$`)
+	pgSetLocalRegex   = regexp.MustCompile(`(?is)^LOCAL\s`)
+	pgSetSessionRegex = regexp.MustCompile(`(?is)^SESSION\s+`)
+	pgSetAssignRegex  = regexp.MustCompile(`(?is)^("[^"]+"|[a-z_][a-z0-9_.]*)\s*(?:=|TO\s)`)
+)
+
+// pgSetForms maps the special forms of the PostgreSQL SET statement to the
+// parameter they set
+var pgSetForms = []struct {
+	prefix *regexp.Regexp
+	name   string
+}{
+	{regexp.MustCompile(`(?is)^TIME\s+ZONE\s`), "timezone"},
+	{regexp.MustCompile(`(?is)^NAMES\s`), "client_encoding"},
+	{regexp.MustCompile(`(?is)^SCHEMA\s`), "search_path"},
+	{regexp.MustCompile(`(?is)^ROLE\s`), "role"},
+	{regexp.MustCompile(`(?is)^SESSION\s+AUTHORIZATION\s`), "session_authorization"},
+	{regexp.MustCompile(`(?is)^SESSION\s+CHARACTERISTICS\s`), "session_characteristics"},
+}
+
+// ParseSessionSet parses a MySQL SET statement that changes session state,
+// such as SET sql_mode = ..., SET time_zone = ..., SET @var = ..., SET NAMES
+// or SET SESSION TRANSACTION ISOLATION LEVEL. It returns the lowercase names
+// of the variables it sets, user variables with their "@". Statements that
+// change global state, SET TRANSACTION for the next transaction only and
+// proxy variables are not session state.
+func ParseSessionSet(query string) ([]string, bool) {
+	m := setStmtRegex.FindStringSubmatch(query)
+	if m == nil {
+		return nil, false
+	}
+	body := m[1]
+	if setNamesRegex.MatchString(body) {
+		return []string{"names"}, true
+	}
+	parts, ok := splitList(body)
+	if !ok {
+		return nil, false
+	}
+	if tx := setTxRegex.FindStringSubmatch(parts[0]); tx != nil {
+		parts[0] = tx[1]
+		names := make([]string, 0, len(parts))
+		for _, part := range parts {
+			if strings.HasPrefix(strings.ToUpper(part), "ISOLATION") {
+				names = append(names, "transaction_isolation")
+			} else {
+				names = append(names, "transaction_read_only")
+			}
+		}
+		return names, true
+	}
+	names := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if setScopeRegex.MatchString(part) {
+			return nil, false
+		}
+		part = setSessionRegex.ReplaceAllString(part, "")
+		a := setAssignRegex.FindStringSubmatch(part)
+		if a == nil {
+			return nil, false
+		}
+		name := strings.ToLower(strings.ReplaceAll(a[1], "`", ""))
+		if strings.HasPrefix(name, "tqdb_") || strings.HasPrefix(name, "tqdb.") {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// ParsePgSessionSet parses a PostgreSQL SET or RESET statement that changes
+// a run-time parameter of the session, such as SET search_path TO ..., SET
+// TIME ZONE ... or RESET DateStyle. It returns the lowercase name of the
+// parameter, and no names for RESET ALL, which resets all of them. SET
+// LOCAL and SET TRANSACTION only last for the transaction and proxy
+// variables are not sent to the backend, so these are not session state.
+func ParsePgSessionSet(query string) ([]string, bool) {
+	if m := resetStmtRegex.FindStringSubmatch(query); m != nil {
+		name := strings.ToLower(identName(m[1]))
+		if name == "all" && m[1][0] != '"' {
+			return nil, true
+		}
+		return []string{name}, true
+	}
+	m := setStmtRegex.FindStringSubmatch(query)
+	if m == nil {
+		return nil, false
+	}
+	if parts, ok := splitList(m[1]); !ok || len(parts) == 0 {
+		return nil, false
+	}
+	body := m[1]
+	for _, form := range pgSetForms {
+		if form.prefix.MatchString(body) {
+			return []string{form.name}, true
+		}
+	}
+	if pgSetLocalRegex.MatchString(body) {
+		return nil, false
+	}
+	body = pgSetSessionRegex.ReplaceAllString(body, "")
+	for _, form := range pgSetForms {
+		if form.prefix.MatchString(body) {
+			return []string{form.name}, true
+		}
+	}
+	a := pgSetAssignRegex.FindStringSubmatch(body)
+	if a == nil {
+		return nil, false
+	}
+	name := strings.ToLower(identName(a[1]))
+	if strings.HasPrefix(name, "tqdb.") || strings.HasPrefix(name, "tqdb_") {
+		return nil, false
+	}
+	return []string{name}, true
+}
+
+// splitList splits s at the commas outside of parentheses, quotes and
+// comments. It returns false when s holds more than one statement or a line
+// comment.
+func splitList(s string) ([]string, bool) {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		if j := skipToken(s, i); j < 0 {
+			return nil, false
+		} else if j > i {
+			i = j - 1
+			continue
+		}
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ';':
+			return nil, false
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:])), true
+}
+
+// TxOp is the kind of a transaction statement, see ParseTransaction
+type TxOp int
+
+const (
+	TxBegin      TxOp = iota + 1 // BEGIN or START TRANSACTION
+	TxCommit                     // COMMIT or END
+	TxRollback                   // ROLLBACK or ABORT
+	TxSavepoint                  // SAVEPOINT name
+	TxRollbackTo                 // ROLLBACK TO SAVEPOINT name
+	TxRelease                    // RELEASE SAVEPOINT name
+)
+
+// Transaction is a statement that controls the transaction of a session
+type Transaction struct {
+	Op        TxOp
+	Chain     bool   // COMMIT or ROLLBACK AND CHAIN, which starts a new transaction
+	Savepoint string // Name of the savepoint, lowercase unless quoted
+}
+
+// Match the transaction statements of MySQL and PostgreSQL, see
+// ParseTransaction
+var (
+	txStmtRegex       = regexp.MustCompile(`(?is)^\s*(BEGIN|START\s+TRANSACTION|COMMIT|END|ROLLBACK|ABORT|SAVEPOINT|RELEASE)\b(.*?)\s*;?\s*$`)
+	txBeginRegex      = regexp.MustCompile(`(?is)^(?:\s+(?:WORK|TRANSACTION))?(?:\s+(?:ISOLATION|READ|DEFERRABLE|NOT\s+DEFERRABLE|WITH\s+CONSISTENT)\b.*)?$`)
+	txEndRegex        = regexp.MustCompile(`(?is)^(?:\s+(?:WORK|TRANSACTION))?(?:\s+AND\s+(NO\s+)?(CHAIN))?(?:\s+(?:NO\s+)?RELEASE)?$`)
+	txRollbackToRegex = regexp.MustCompile(`(?is)^(?:\s+(?:WORK|TRANSACTION))?\s+TO\s+(?:SAVEPOINT\s+)?(` + savepointName + `)$`)
+	txSavepointRegex  = regexp.MustCompile(`(?is)^\s+(` + savepointName + `)$`)
+	txReleaseRegex    = regexp.MustCompile(`(?is)^\s+(?:SAVEPOINT\s+)?(` + savepointName + `)$`)
+)
+
+const savepointName = `"[^"]+"|` + "`[^`]+`" + `|[a-z_][a-z0-9_$]*`
+
+// ParseTransaction parses a statement that starts, ends or marks a point in
+// the transaction of a session, in MySQL or PostgreSQL syntax: BEGIN [WORK],
+// START TRANSACTION, COMMIT or ROLLBACK [WORK] [AND [NO] CHAIN], END, ABORT,
+// SAVEPOINT, ROLLBACK TO [SAVEPOINT] and RELEASE [SAVEPOINT]. Two-phase
+// commit statements such as COMMIT PREPARED are not transaction statements of
+// the session.
+func ParseTransaction(query string) (Transaction, bool) {
+	m := txStmtRegex.FindStringSubmatch(query)
+	if m == nil || strings.Contains(m[2], ";") {
+		return Transaction{}, false
+	}
+	keyword, rest := strings.ToUpper(strings.Fields(m[1])[0]), m[2]
+	switch keyword {
+	case "BEGIN", "START":
+		// Not a compound statement such as BEGIN NOT ATOMIC ... END
+		if txBeginRegex.MatchString(rest) {
+			return Transaction{Op: TxBegin}, true
+		}
+	case "SAVEPOINT":
+		if n := txSavepointRegex.FindStringSubmatch(rest); n != nil {
+			return Transaction{Op: TxSavepoint, Savepoint: identName(n[1])}, true
+		}
+	case "RELEASE":
+		if n := txReleaseRegex.FindStringSubmatch(rest); n != nil {
+			return Transaction{Op: TxRelease, Savepoint: identName(n[1])}, true
+		}
+	default:
+		op := TxCommit
+		if keyword == "ROLLBACK" || keyword == "ABORT" {
+			op = TxRollback
+			if n := txRollbackToRegex.FindStringSubmatch(rest); n != nil {
+				return Transaction{Op: TxRollbackTo, Savepoint: identName(n[1])}, true
+			}
+		}
+		if n := txEndRegex.FindStringSubmatch(rest); n != nil {
+			return Transaction{Op: op, Chain: n[2] != "" && n[1] == ""}, true
+		}
+	}
+	return Transaction{}, false
+}
+
+// Match the cache purge commands of the proxies: TQDB CACHE PURGE ['pattern']
+// (MariaDB) and SELECT pg_tqdb_cache_purge(['pattern']) (PostgreSQL)
+var (
+	cachePurgeRegex   = regexp.MustCompile(`(?is)^\s*TQDB\s+CACHE\s+PURGE(?:\s+(?:'((?:[^']|'')*)'|"((?:[^"]|"")*)"))?\s*;?\s*$`)
+	pgCachePurgeRegex = regexp.MustCompile(`(?is)^\s*SELECT\s+pg_tqdb_cache_purge\s*\(\s*(?:'((?:[^']|'')*)')?\s*\)\s*;?\s*$`)
+)
+
+// ParseCachePurge parses a TQDB CACHE PURGE command of the MariaDB proxy and
+// returns its pattern, which is empty when the whole cache is purged
+func ParseCachePurge(query string) (pattern string, ok bool) {
+	m := cachePurgeRegex.FindStringSubmatch(query)
+	if m == nil {
+		return "", false
+	}
+	return strings.ReplaceAll(m[1], "''", "'") + strings.ReplaceAll(m[2], `""`, `"`), true
+}
+
+// ParsePgCachePurge parses a SELECT pg_tqdb_cache_purge() call of the
+// PostgreSQL proxy and returns its pattern, which is empty when the whole
+// cache is purged
+func ParsePgCachePurge(query string) (pattern string, ok bool) {
+	m := pgCachePurgeRegex.FindStringSubmatch(query)
+	if m == nil {
+		return "", false
+	}
+	return strings.ReplaceAll(m[1], "''", "'"), true
+}
+
+// Match LISTEN channel and UNLISTEN channel or * (PostgreSQL)
+var listenRegex = regexp.MustCompile(`(?is)^\s*(LISTEN|UNLISTEN)\s+("(?:[^"]|"")+"|[a-z_][a-z0-9_$]*|\*)\s*;?\s*$`)
+
+// ParseListen parses a LISTEN or UNLISTEN statement of PostgreSQL and returns
+// its channel as an identifier that can be sent back: unquoted names in
+// lowercase, quoted names with their quotes, or "*" for UNLISTEN *
+func ParseListen(query string) (channel string, listen bool, ok bool) {
+	m := listenRegex.FindStringSubmatch(query)
+	if m == nil {
+		return "", false, false
+	}
+	listen = strings.EqualFold(m[1], "LISTEN")
+	channel = m[2]
+	if listen && channel == "*" {
+		return "", false, false
+	}
+	if channel[0] != '"' {
+		channel = strings.ToLower(channel)
+	}
+	return channel, listen, true
+}
+
+// Match SELECT currval('sequence') and SELECT lastval() (PostgreSQL)
+var sequenceCallRegex = regexp.MustCompile(`(?is)^\s*SELECT\s+(currval|lastval)\s*\(\s*(?:'([^']+)'(?:\s*::\s*regclass)?)?\s*\)\s*(?:AS\s+[a-z_][a-z0-9_]*\s*)?;?\s*$`)
+
+// ParseSequenceCall parses a query that only calls currval or lastval and
+// returns the function in lowercase and, for currval, the sequence name
+// without schema: unquoted names in lowercase, quoted names without quotes
+func ParseSequenceCall(query string) (fn, sequence string, ok bool) {
+	m := sequenceCallRegex.FindStringSubmatch(query)
+	if m == nil {
+		return "", "", false
+	}
+	fn = strings.ToLower(m[1])
+	if (fn == "currval") != (m[2] != "") {
+		return "", "", false
+	}
+	sequence = strings.TrimSpace(m[2])
+	if strings.HasSuffix(sequence, `"`) && len(sequence) > 1 {
+		sequence = sequence[strings.LastIndexByte(sequence[:len(sequence)-1], '"'):]
+	} else if i := strings.LastIndexByte(sequence, '.'); i >= 0 {
+		sequence = sequence[i+1:]
+	}
+	return fn, identName(sequence), true
+}
+
+// ParseSwitch parses the value of a boolean session variable: ON, OFF,
+// TRUE, FALSE, 1 or 0 (case insensitive)
+func ParseSwitch(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "on", "true", "1":
+		return true, nil
+	case "off", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value %q, expected ON or OFF", value)
+}
@@ -1,6 +1,10 @@
 package parser
 
 import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -49,6 +53,139 @@ func TestParse_TTLHint(t *testing.T) {
 	}
 }
 
+func TestParse_MaxLagHint(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected int
+		stripped string
+	}{
+		{"/* maxlag:500 */ SELECT * FROM users", 500, "SELECT * FROM users"},
+		{"/* ttl:60 file:api.go line:7 maxlag:2000 */ SELECT * FROM users", 2000, "SELECT * FROM users"},
+		{"/* ttl:60 */ SELECT * FROM users", 0, "SELECT * FROM users"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.MaxLagMs != tt.expected || p.Query != tt.stripped {
+				t.Errorf("Parse(%q) = maxlag %d, query %q, want %d, %q", tt.query, p.MaxLagMs, p.Query, tt.expected, tt.stripped)
+			}
+		})
+	}
+}
+
+func TestParse_NegCacheHint(t *testing.T) {
+	tests := []struct {
+		query  string
+		ttl    int
+		negTTL int
+	}{
+		{"/* ttl:60 negcache:5 */ SELECT * FROM users", 60, 5},
+		{"/* negcache:5 file:api.go line:7 */ SELECT * FROM users", 0, 5},
+		{"/* ttl:60 file:api.go */ SELECT * FROM users", 60, 0},
+		{"/* ttl:60 negcache:5 */ DELETE FROM users", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.TTL != tt.ttl || p.NegTTL != tt.negTTL || strings.Contains(p.Query, "negcache") {
+				t.Errorf("Parse(%q) = ttl %d, negcache %d, query %q, want %d, %d", tt.query, p.TTL, p.NegTTL, p.Query, tt.ttl, tt.negTTL)
+			}
+		})
+	}
+}
+
+func TestParse_DurabilityHint(t *testing.T) {
+	tests := []struct {
+		query      string
+		batchMs    int
+		durability string
+	}{
+		{"/* batch:50 durability:relaxed */ INSERT INTO logs (msg) VALUES ('a')", 50, DurabilityRelaxed},
+		{"/* file:api.go line:7 batch:10 durability:local */ UPDATE users SET name = 'x' WHERE id = 1", 10, DurabilityLocal},
+		{"/* batch:10 durability:never */ INSERT INTO logs (msg) VALUES ('a')", 10, ""},
+		{"/* durability:relaxed */ SELECT * FROM logs", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.BatchMs != tt.batchMs || p.Durability != tt.durability || strings.Contains(p.Query, "durability") {
+				t.Errorf("Parse(%q) = batch %d, durability %q, query %q, want %d, %q", tt.query, p.BatchMs, p.Durability, p.Query, tt.batchMs, tt.durability)
+			}
+		})
+	}
+}
+
+func TestParse_AckHint(t *testing.T) {
+	tests := []struct {
+		query   string
+		batchMs int
+		ack     string
+	}{
+		{"/* batch:20 ack:early */ INSERT INTO events (name) VALUES ('a')", 20, AckEarly},
+		{"/* batch:20 ack:early durability:relaxed */ INSERT INTO events (name) VALUES ('a')", 20, AckEarly},
+		{"/* batch:20 ack:late */ INSERT INTO events (name) VALUES ('a')", 20, ""},
+		{"/* batch:20 ack:early */ INSERT INTO events (name) VALUES ('a') RETURNING id", 20, ""},
+		{"/* ack:early */ SELECT * FROM events", 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.BatchMs != tt.batchMs || p.Ack != tt.ack || strings.Contains(p.Query, "ack") {
+				t.Errorf("Parse(%q) = batch %d, ack %q, query %q, want %d, %q", tt.query, p.BatchMs, p.Ack, p.Query, tt.batchMs, tt.ack)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_DefaultAck(t *testing.T) {
+	tests := []struct {
+		query    string
+		ack      string
+		expected string
+	}{
+		{"INSERT INTO events VALUES (1)", AckEarly, AckEarly},
+		{"INSERT INTO events VALUES (1)", "", ""},
+		{"INSERT INTO events VALUES (1) RETURNING id", AckEarly, ""},
+		{"SELECT * FROM events", AckEarly, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			set := p.DefaultAck(tt.ack)
+			if p.Ack != tt.expected || set != (tt.expected != "") {
+				t.Errorf("DefaultAck(%q) = %q, %v, want %q", tt.ack, p.Ack, set, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParse_RouteHint(t *testing.T) {
+	tests := []struct {
+		query   string
+		route   string
+		backend string
+	}{
+		{"/* route:primary */ SELECT * FROM users", RoutePrimary, ""},
+		{"/* ttl:60 maxlag:500 route:replica */ SELECT * FROM users", RouteReplica, ""},
+		{"/* route:shard_2 */ UPDATE users SET name = 'x'", "shard_2", "shard_2"},
+		{"/* ttl:60 */ SELECT * FROM users", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.Route != tt.route || p.RouteBackend() != tt.backend || strings.Contains(p.Query, "route") {
+				t.Errorf("Parse(%q) = route %q, backend %q, query %q, want %q, %q", tt.query, p.Route, p.RouteBackend(), p.Query, tt.route, tt.backend)
+			}
+		})
+	}
+}
+
 func TestParse_FileLineHints(t *testing.T) {
 	tests := []struct {
 		query        string
@@ -77,6 +214,67 @@ func TestParse_FileLineHints(t *testing.T) {
 	}
 }
 
+// TestParse_HintFixtures checks hints as generated by the client libraries
+// and ORM middlewares of several languages, see testdata/hints.json
+func TestParse_HintFixtures(t *testing.T) {
+	data, err := os.ReadFile("testdata/hints.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []struct {
+		Source   string
+		Query    string
+		TTL      int
+		File     string
+		Line     int
+		Batch    int
+		Stripped string
+	}
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		p := Parse(f.Query)
+		if p.TTL != f.TTL || p.File != f.File || p.Line != f.Line || p.BatchMs != f.Batch || p.Query != f.Stripped {
+			t.Errorf("%s: got ttl %d, file %q, line %d, batch %d, query %q, want ttl %d, file %q, line %d, batch %d, query %q",
+				f.Source, p.TTL, p.File, p.Line, p.BatchMs, p.Query, f.TTL, f.File, f.Line, f.Batch, f.Stripped)
+		}
+	}
+}
+
+func TestSanitizeFile(t *testing.T) {
+	tests := []struct {
+		file     string
+		expected string
+	}{
+		{"user.go", "user.go"},
+		{"./src/user.go", "src/user.go"},
+		{`C:\app\user.php`, "C:/app/user.php"},
+		{"Foo.php(12)", "Foo.php(12)"},
+		{"../secret.go", ""},
+		{"app/../../secret.go", ""},
+		{"user.go%0a", ""},
+		{"user.go'", ""},
+		{strings.Repeat("a", maxFileLen) + ".go", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFile(tt.file); got != tt.expected {
+			t.Errorf("sanitizeFile(%q) = %q, want %q", tt.file, got, tt.expected)
+		}
+	}
+}
+
+func TestParse_Raw(t *testing.T) {
+	query := "/* ttl:60 file:api.go line:100 */ SELECT * FROM users /* tag:audit */"
+	p := Parse(query)
+	if p.Raw != query {
+		t.Errorf("Raw = %q, want %q", p.Raw, query)
+	}
+	if want := "SELECT * FROM users /* tag:audit */"; p.Query != want {
+		t.Errorf("Query = %q, want %q", p.Query, want)
+	}
+}
+
 func TestParsedQuery_IsCacheable(t *testing.T) {
 	tests := []struct {
 		query    string
@@ -175,19 +373,27 @@ func TestParsedQuery_GetBatchKey(t *testing.T) {
 	}{
 		{
 			"/* file:app.go line:42 */ INSERT INTO users VALUES (1)",
-			"INSERT INTO users VALUES (1)", // Hint is stripped
+			"INSERT INTO users VALUES", // Hint is stripped
 		},
 		{
 			"/* file:src/handler.go line:100 */ UPDATE users SET active = 1",
 			"UPDATE users SET active = 1",
 		},
 		{
-			"INSERT INTO users VALUES (1)",
-			"INSERT INTO users VALUES (1)",
+			"UPDATE users SET active = 2",
+			"UPDATE users SET active = 2", // Different values = different key
+		},
+		{
+			"INSERT INTO users VALUES (2), (3)",
+			"INSERT INTO users VALUES", // Rows are merged with other inserts
 		},
 		{
-			"INSERT INTO users VALUES (2)",
-			"INSERT INTO users VALUES (2)", // Different values = different key
+			"INSERT INTO users (id) VALUES (1) ON DUPLICATE KEY UPDATE id = id",
+			"INSERT INTO users (id) VALUES ON DUPLICATE KEY UPDATE id = id", // Upserts are merged with the same clause
+		},
+		{
+			"INSERT INTO users (id) VALUES (1) RETURNING id",
+			"INSERT INTO users (id) VALUES (1) RETURNING id",
 		},
 	}
 
@@ -215,37 +421,36 @@ func TestParsedQuery_GetBatchKey_SameQuery(t *testing.T) {
 		t.Errorf("Identical queries should have same batch key: %v != %v", key1, key2)
 	}
 
-	expected := "INSERT INTO users (name) VALUES ('alice')"
+	expected := "INSERT INTO users (name) VALUES"
 	if key1 != expected {
 		t.Errorf("GetBatchKey() = %v, want %v", key1, expected)
 	}
 }
 
 func TestParsedQuery_GetBatchKey_DifferentQueries(t *testing.T) {
-	// Different queries should have different batch keys
+	// Inserts into the same table and columns share a batch key
 	q1 := Parse("INSERT INTO users (name) VALUES ('alice')")
-	q2 := Parse("INSERT INTO users (name) VALUES ('bob')")
-
-	key1 := q1.GetBatchKey()
-	key2 := q2.GetBatchKey()
-
-	if key1 == key2 {
-		t.Errorf("Different queries should have different batch keys")
+	q2 := Parse("INSERT INTO users (name) VALUES ('bob'), ('carol')")
+	if q1.GetBatchKey() != q2.GetBatchKey() {
+		t.Errorf("Inserts into the same columns should have the same batch key: %v != %v", q1.GetBatchKey(), q2.GetBatchKey())
 	}
 
-	if key1 != "INSERT INTO users (name) VALUES ('alice')" {
-		t.Errorf("GetBatchKey() for q1 = %v, want 'INSERT INTO users (name) VALUES ('alice')'", key1)
+	// Inserts into other columns and other writes do not
+	q3 := Parse("INSERT INTO users (email) VALUES ('alice')")
+	q4 := Parse("UPDATE users SET name = 'alice' WHERE id = 1")
+	q5 := Parse("UPDATE users SET name = 'bob' WHERE id = 1")
+	if q1.GetBatchKey() == q3.GetBatchKey() {
+		t.Errorf("Inserts into different columns should have different batch keys")
 	}
-
-	if key2 != "INSERT INTO users (name) VALUES ('bob')" {
-		t.Errorf("GetBatchKey() for q2 = %v, want 'INSERT INTO users (name) VALUES ('bob')'", key2)
+	if q4.GetBatchKey() == q5.GetBatchKey() {
+		t.Errorf("Different queries should have different batch keys")
 	}
 }
 
 func TestParsedQuery_GetBatchKey_ConsistentWithCacheKey(t *testing.T) {
 	// GetBatchKey should use Query field, same as caching does
 	query1 := "/* ttl:60 */ SELECT * FROM users WHERE id = 1"
-	query2 := "INSERT INTO users (name) VALUES ('test')"
+	query2 := "UPDATE users SET name = 'test' WHERE id = 1"
 
 	p1 := Parse(query1)
 	p2 := Parse(query2)
@@ -433,3 +638,700 @@ func TestParsedQuery_BatchMs_InvalidValues(t *testing.T) {
 		})
 	}
 }
+
+func TestParsedQuery_IsMetadata(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"SHOW COLUMNS FROM users", true},
+		{"SHOW FULL COLUMNS FROM users", true},
+		{"show tables", true},
+		{"SHOW CREATE TABLE users", true},
+		{"DESCRIBE users", true},
+		{"SELECT column_name FROM information_schema.columns WHERE table_name = 'users'", true},
+		{"SELECT oid, typname FROM pg_catalog.pg_type", true},
+		{"SELECT relname FROM pg_class WHERE relkind = 'r'", true},
+		{"SHOW STATUS", false},
+		{"SHOW TQDB STATUS", false},
+		{"SELECT * FROM users", false},
+		{"DELETE FROM information_schema_backup WHERE id = 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.IsMetadata() != tt.expected {
+				t.Errorf("Parse(%q).IsMetadata() = %v, want %v", tt.query, p.IsMetadata(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_IsRepeatable(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"SELECT count(*) FROM orders WHERE status = 'open'", true},
+		{"SELECT u.name FROM users u JOIN orders o ON o.user_id = u.id", true},
+		{"SELECT now()", false},
+		{"SELECT nextval('orders_id_seq')", false},
+		{"SELECT * FROM users WHERE id = 1 FOR UPDATE", false},
+		{"SELECT * FROM users FOR NO KEY UPDATE", false},
+		{"SELECT * FROM users LOCK IN SHARE MODE", false},
+		{"SELECT * INTO users_copy FROM users", false},
+		{"UPDATE users SET name = 'x' WHERE id = 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.IsRepeatable() != tt.expected {
+				t.Errorf("Parse(%q).IsRepeatable() = %v, want %v", tt.query, p.IsRepeatable(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_IsReplicaSafe(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"SELECT * FROM users WHERE id = 1", true},
+		{"/* file:app.go line:3 */ SELECT now()", true},
+		{"WITH recent AS (SELECT * FROM orders) SELECT count(*) FROM recent", true},
+		{"(SELECT 1) UNION (SELECT 2)", true},
+		{"SELECT * FROM users WHERE id = 1 FOR UPDATE", false},
+		{"SELECT nextval('orders_id_seq')", false},
+		{"SELECT LAST_INSERT_ID()", false},
+		{"SELECT GET_LOCK('job', 10)", false},
+		{"SELECT pg_advisory_lock(42)", false},
+		{"SELECT @total", false},
+		{"WITH moved AS (DELETE FROM queue RETURNING *) SELECT * FROM moved", false},
+		{"SET @a := (SELECT 1)", false},
+		{"UPDATE users SET name = 'x' WHERE id = 1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.IsReplicaSafe() != tt.expected {
+				t.Errorf("Parse(%q).IsReplicaSafe() = %v, want %v", tt.query, p.IsReplicaSafe(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_IsDDL(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"CREATE TABLE users (id INT)", true},
+		{"ALTER TABLE users ADD COLUMN name TEXT", true},
+		{"drop table users", true},
+		{"TRUNCATE users", true},
+		{"RENAME TABLE a TO b", true},
+		{"SELECT * FROM users", false},
+		{"INSERT INTO logs (msg) VALUES ('ALTER TABLE')", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.IsDDL() != tt.expected {
+				t.Errorf("Parse(%q).IsDDL() = %v, want %v", tt.query, p.IsDDL(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_CommitsImplicitly(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected bool
+	}{
+		{"CREATE TABLE users (id INT)", true},
+		{"alter table users add column name text", true},
+		{"GRANT SELECT ON shop.* TO app", true},
+		{"LOCK TABLES users WRITE", true},
+		{"CREATE TEMPORARY TABLE tmp (id INT)", false},
+		{"DROP TEMPORARY TABLE tmp", false},
+		{"INSERT INTO users (id) VALUES (1)", false},
+		{"SAVEPOINT a", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if p.CommitsImplicitly() != tt.expected {
+				t.Errorf("Parse(%q).CommitsImplicitly() = %v, want %v", tt.query, p.CommitsImplicitly(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestParse_Tables(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"/* ttl:60 */ SELECT * FROM users WHERE id = 1", []string{"users"}},
+		{"SELECT * FROM `shop`.`orders` o JOIN customers c ON o.cid = c.id", []string{"orders", "customers"}},
+		{"SELECT * FROM a, b WHERE a.id = b.id", []string{"a", "b"}},
+		{"INSERT INTO logs (msg) VALUES ('x')", []string{"logs"}},
+		{"UPDATE Users SET name = 'x'", []string{"users"}},
+		{"CREATE TABLE users (id INT)", []string{"users"}},
+		{"CREATE TABLE IF NOT EXISTS \"public\".\"users\" (id INT)", []string{"users"}},
+		{"ALTER TABLE users ADD COLUMN name TEXT", []string{"users"}},
+		{"DROP TABLE IF EXISTS a, b", []string{"a", "b"}},
+		{"DROP TEMPORARY TABLE tmp", []string{"tmp"}},
+		{"TRUNCATE TABLE logs", []string{"logs"}},
+		{"TRUNCATE logs", []string{"logs"}},
+		{"RENAME TABLE a TO b, c TO d", []string{"a", "b", "c", "d"}},
+		{"CREATE UNIQUE INDEX idx_name ON users (name)", []string{"users"}},
+		{"DROP INDEX idx_name ON users", []string{"users"}},
+		{"SELECT 1", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			if !reflect.DeepEqual(p.Tables, tt.expected) {
+				t.Errorf("Parse(%q).Tables = %v, want %v", tt.query, p.Tables, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_DefaultBatch(t *testing.T) {
+	tests := []struct {
+		query    string
+		ms       int
+		expected int
+	}{
+		{"INSERT INTO logs VALUES (1)", 20, 20},
+		{"DELETE FROM logs WHERE id = 1", 20, 20},
+		{"/* batch:5 */ INSERT INTO logs VALUES (1)", 20, 5}, // The hint wins
+		{"INSERT INTO logs VALUES (1)", 0, 0},
+		{"SELECT * FROM logs", 20, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			set := p.DefaultBatch(tt.ms)
+			if p.BatchMs != tt.expected || set != (tt.expected == tt.ms && tt.ms > 0) {
+				t.Errorf("DefaultBatch(%d) = %d, %v, want %d", tt.ms, p.BatchMs, set, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_ClampBatch(t *testing.T) {
+	tests := []struct {
+		query    string
+		minMs    int
+		maxMs    int
+		expected int
+		clamped  bool
+	}{
+		{"/* batch:500 */ INSERT INTO logs VALUES (1)", 0, 100, 100, true},
+		{"/* batch:50 */ INSERT INTO logs VALUES (1)", 0, 100, 50, false},
+		{"/* batch:1 */ INSERT INTO logs VALUES (1)", 5, 100, 5, true},
+		{"/* batch:1000 */ INSERT INTO logs VALUES (1)", 0, 0, 1000, false},
+		{"INSERT INTO logs VALUES (1)", 5, 100, 0, false}, // No hint, no batching
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := Parse(tt.query)
+			hinted, clamped := p.ClampBatch(tt.minMs, tt.maxMs)
+			if p.BatchMs != tt.expected || clamped != tt.clamped {
+				t.Errorf("ClampBatch(%d, %d) = %d, %v, want %d, %v", tt.minMs, tt.maxMs, p.BatchMs, clamped, tt.expected, tt.clamped)
+			}
+			if clamped && hinted == p.BatchMs {
+				t.Errorf("ClampBatch returned hinted value %d equal to clamped value", hinted)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"SELECT * FROM users WHERE id = 42", "SELECT * FROM users WHERE id = ?"},
+		{"SELECT * FROM users WHERE name = 'alice' AND score > 1.5", "SELECT * FROM users WHERE name = ? AND score > ?"},
+		{"SELECT * FROM t1 WHERE id IN (1, 2)", "SELECT * FROM t1 WHERE id IN (?, ?)"},
+		{"SELECT * FROM users WHERE id = ?", "SELECT * FROM users WHERE id = ?"},
+		{`SELECT * FROM "users" WHERE id = $1 AND note = 'it''s'`, `SELECT * FROM "users" WHERE id = $1 AND note = ?`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := Fingerprint(tt.query); got != tt.expected {
+				t.Errorf("Fingerprint(%q) = %q, want %q", tt.query, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTranslatePlaceholders(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		n        int
+	}{
+		{"SELECT * FROM users WHERE id = ?", "SELECT * FROM users WHERE id = $1", 1},
+		{"INSERT INTO t (a, b) VALUES (?, ?)", "INSERT INTO t (a, b) VALUES ($1, $2)", 2},
+		{"SELECT * FROM t WHERE a = '?' AND b = ?", "SELECT * FROM t WHERE a = '?' AND b = $1", 1},
+		{"SELECT * FROM t WHERE a = 'it''s?' AND b = ?", "SELECT * FROM t WHERE a = 'it''s?' AND b = $1", 1},
+		{`SELECT * FROM t WHERE a = E'\'?' AND b = ?`, `SELECT * FROM t WHERE a = E'\'?' AND b = $1`, 1},
+		{`SELECT "col?" FROM t WHERE a = ?`, `SELECT "col?" FROM t WHERE a = $1`, 1},
+		{"SELECT 1 -- why?\nFROM t WHERE a = ?", "SELECT 1 -- why?\nFROM t WHERE a = $1", 1},
+		{"SELECT /* a? /* nested? */ b? */ a FROM t WHERE a = ?", "SELECT /* a? /* nested? */ b? */ a FROM t WHERE a = $1", 1},
+		{"SELECT $$what?$$, $tag$a?$tag$ FROM t WHERE a = ?", "SELECT $$what?$$, $tag$a?$tag$ FROM t WHERE a = $1", 1},
+		{"SELECT data ?? 'key' FROM t WHERE id = ?", "SELECT data ? 'key' FROM t WHERE id = $1", 1},
+		{"SELECT * FROM t WHERE id = $1", "SELECT * FROM t WHERE id = $1", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, n := TranslatePlaceholders(tt.query)
+			if got != tt.expected || n != tt.n {
+				t.Errorf("TranslatePlaceholders(%q) = %q, %d, want %q, %d", tt.query, got, n, tt.expected, tt.n)
+			}
+		})
+	}
+}
+
+func TestParsedQuery_EqualityColumns(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"UPDATE users SET name = 'x' WHERE id = 1", []string{"id"}},
+		{"DELETE FROM users WHERE `users`.`ID` = ?", []string{"id"}},
+		{"DELETE FROM orders WHERE customer_id IN (1, 2) AND status = 'open'", []string{"customer_id", "status"}},
+		{"UPDATE t SET a = 1 WHERE note = 'x OR y' AND id = $1", []string{"note", "id"}},
+		{"UPDATE t SET a = 1 WHERE id = 1 ORDER BY id LIMIT 1", []string{"id"}},
+		{"UPDATE t SET a = 1 WHERE created < NOW()", nil},
+		{"UPDATE t SET a = 1 WHERE id >= 5", nil},
+		{"DELETE FROM t WHERE id = 1 OR name = 'x'", nil},
+		{"DELETE FROM t", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := Parse(tt.query).EqualityColumns(); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("EqualityColumns() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseProxySet(t *testing.T) {
+	tests := []struct {
+		query string
+		name  string
+		value string
+		ok    bool
+	}{
+		{"SET tqdb_ordered_writes = ON", "tqdb_ordered_writes", "ON", true},
+		{"set TQDB_Ordered_Writes to 'off';", "tqdb_ordered_writes", "off", true},
+		{"SET SESSION tqdb_ordered_writes=1", "tqdb_ordered_writes", "1", true},
+		{"SET @@session.tqdb_ordered_writes = true", "tqdb_ordered_writes", "true", true},
+		{"SET tqdb.verbose = on", "tqdb_verbose", "on", true},
+		{"SET TQDB.Verbose TO off", "tqdb_verbose", "off", true},
+		{"SET NAMES utf8mb4", "", "", false},
+		{"SET tqdb_ordered_writes = ON, autocommit = 0", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			name, value, ok := ParseProxySet(tt.query)
+			if name != tt.name || value != tt.value || ok != tt.ok {
+				t.Errorf("ParseProxySet() = (%q, %q, %v), want (%q, %q, %v)", name, value, ok, tt.name, tt.value, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseSessionSet(t *testing.T) {
+	tests := []struct {
+		query string
+		names []string
+		ok    bool
+	}{
+		{"SET sql_mode = 'STRICT_TRANS_TABLES'", []string{"sql_mode"}, true},
+		{"set SESSION time_zone='+00:00', @@session.sql_mode = CONCAT(@@sql_mode, ',ANSI');", []string{"time_zone", "sql_mode"}, true},
+		{"SET @last := (SELECT MAX(id) FROM t), `autocommit` = 0", []string{"@last", "autocommit"}, true},
+		{"SET NAMES utf8mb4 COLLATE utf8mb4_bin", []string{"names"}, true},
+		{"SET SESSION TRANSACTION ISOLATION LEVEL READ COMMITTED, READ ONLY", []string{"transaction_isolation", "transaction_read_only"}, true},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", nil, false},
+		{"SET GLOBAL max_connections = 100", nil, false},
+		{"SET @@global.sql_mode = ''", nil, false},
+		{"SET tqdb_ordered_writes = ON", nil, false},
+		{"SET sql_mode = ''; DROP TABLE t", nil, false},
+		{"SELECT 1", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			names, ok := ParseSessionSet(tt.query)
+			if !reflect.DeepEqual(names, tt.names) || ok != tt.ok {
+				t.Errorf("ParseSessionSet() = (%q, %v), want (%q, %v)", names, ok, tt.names, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParsePgSessionSet(t *testing.T) {
+	tests := []struct {
+		query string
+		names []string
+		ok    bool
+	}{
+		{"SET search_path TO app, public", []string{"search_path"}, true},
+		{"set SESSION \"DateStyle\" = 'ISO, DMY';", []string{"datestyle"}, true},
+		{"SET TIME ZONE 'UTC'", []string{"timezone"}, true},
+		{"SET SESSION CHARACTERISTICS AS TRANSACTION ISOLATION LEVEL SERIALIZABLE", []string{"session_characteristics"}, true},
+		{"RESET statement_timeout", []string{"statement_timeout"}, true},
+		{"RESET ALL", nil, true},
+		{"SET LOCAL statement_timeout = 0", nil, false},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", nil, false},
+		{"SET tqdb.verbose = on", nil, false},
+		{"SET work_mem = '64MB'; SELECT 1", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			names, ok := ParsePgSessionSet(tt.query)
+			if !reflect.DeepEqual(names, tt.names) || ok != tt.ok {
+				t.Errorf("ParsePgSessionSet() = (%q, %v), want (%q, %v)", names, ok, tt.names, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseTransaction(t *testing.T) {
+	tests := []struct {
+		query string
+		tx    Transaction
+		ok    bool
+	}{
+		{"BEGIN", Transaction{Op: TxBegin}, true},
+		{"begin work;", Transaction{Op: TxBegin}, true},
+		{"BEGIN ISOLATION LEVEL SERIALIZABLE", Transaction{Op: TxBegin}, true},
+		{"START TRANSACTION READ ONLY", Transaction{Op: TxBegin}, true},
+		{"START TRANSACTION WITH CONSISTENT SNAPSHOT", Transaction{Op: TxBegin}, true},
+		{"COMMIT WORK", Transaction{Op: TxCommit}, true},
+		{"END", Transaction{Op: TxCommit}, true},
+		{"COMMIT AND CHAIN", Transaction{Op: TxCommit, Chain: true}, true},
+		{"ROLLBACK AND NO CHAIN NO RELEASE", Transaction{Op: TxRollback}, true},
+		{"ABORT TRANSACTION", Transaction{Op: TxRollback}, true},
+		{"SAVEPOINT Before_Import", Transaction{Op: TxSavepoint, Savepoint: "before_import"}, true},
+		{"ROLLBACK TO SAVEPOINT before_import", Transaction{Op: TxRollbackTo, Savepoint: "before_import"}, true},
+		{"rollback work to `A`", Transaction{Op: TxRollbackTo, Savepoint: "A"}, true},
+		{"RELEASE SAVEPOINT \"A\"", Transaction{Op: TxRelease, Savepoint: "A"}, true},
+		{"BEGIN NOT ATOMIC SELECT 1 END", Transaction{}, false},
+		{"COMMIT PREPARED 'tx1'", Transaction{}, false},
+		{"COMMIT; DROP TABLE users", Transaction{}, false},
+		{"SELECT 1", Transaction{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			tx, ok := ParseTransaction(tt.query)
+			if tx != tt.tx || ok != tt.ok {
+				t.Errorf("ParseTransaction() = (%+v, %v), want (%+v, %v)", tx, ok, tt.tx, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseProxySetGlobal(t *testing.T) {
+	tests := []struct {
+		query string
+		name  string
+		value string
+		ok    bool
+	}{
+		{"SET GLOBAL tqdb_cache = OFF", "tqdb_cache", "OFF", true},
+		{"set global TQDB_Batching to 'on';", "tqdb_batching", "on", true},
+		{"SET @@global.tqdb_cache=0", "tqdb_cache", "0", true},
+		{"SET tqdb_cache = OFF", "", "", false},
+		{"SET GLOBAL max_connections = 100", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			name, value, ok := ParseProxySetGlobal(tt.query)
+			if name != tt.name || value != tt.value || ok != tt.ok {
+				t.Errorf("ParseProxySetGlobal() = (%q, %q, %v), want (%q, %q, %v)", name, value, ok, tt.name, tt.value, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseCachePurge(t *testing.T) {
+	tests := []struct {
+		query   string
+		pattern string
+		ok      bool
+	}{
+		{"TQDB CACHE PURGE", "", true},
+		{"tqdb cache purge;", "", true},
+		{"TQDB CACHE PURGE 'table:users'", "table:users", true},
+		{`TQDB CACHE PURGE "SELECT * FROM users WHERE name = 'a'"`, "SELECT * FROM users WHERE name = 'a'", true},
+		{"TQDB CACHE PURGE 'it''s'", "it's", true},
+		{"TQDB CACHE PURGE users", "", false},
+		{"SELECT 'TQDB CACHE PURGE'", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			pattern, ok := ParseCachePurge(tt.query)
+			if pattern != tt.pattern || ok != tt.ok {
+				t.Errorf("ParseCachePurge() = (%q, %v), want (%q, %v)", pattern, ok, tt.pattern, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParsePgCachePurge(t *testing.T) {
+	tests := []struct {
+		query   string
+		pattern string
+		ok      bool
+	}{
+		{"SELECT pg_tqdb_cache_purge()", "", true},
+		{"select PG_TQDB_CACHE_PURGE( 'SELECT * FROM t*' );", "SELECT * FROM t*", true},
+		{"SELECT pg_tqdb_cache_purge('it''s')", "it's", true},
+		{"SELECT pg_tqdb_cache_purge(users)", "", false},
+		{"SELECT pg_tqdb_cache_purge('a'), 1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			pattern, ok := ParsePgCachePurge(tt.query)
+			if pattern != tt.pattern || ok != tt.ok {
+				t.Errorf("ParsePgCachePurge() = (%q, %v), want (%q, %v)", pattern, ok, tt.pattern, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		query   string
+		channel string
+		listen  bool
+		ok      bool
+	}{
+		{"LISTEN orders", "orders", true, true},
+		{"listen Orders;", "orders", true, true},
+		{`LISTEN "New Orders"`, `"New Orders"`, true, true},
+		{"UNLISTEN orders", "orders", false, true},
+		{"UNLISTEN *", "*", false, true},
+		{"LISTEN *", "", false, false},
+		{"LISTEN orders; SELECT 1", "", false, false},
+		{"NOTIFY orders", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			channel, listen, ok := ParseListen(tt.query)
+			if channel != tt.channel || listen != tt.listen || ok != tt.ok {
+				t.Errorf("ParseListen() = (%q, %v, %v), want (%q, %v, %v)", channel, listen, ok, tt.channel, tt.listen, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseSwitch(t *testing.T) {
+	for value, want := range map[string]bool{"ON": true, "true": true, "1": true, "off": false, "FALSE": false, "0": false} {
+		got, err := ParseSwitch(value)
+		if err != nil || got != want {
+			t.Errorf("ParseSwitch(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	if _, err := ParseSwitch("maybe"); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+}
+
+func TestInsertValues(t *testing.T) {
+	tests := []struct {
+		query  string
+		prefix string
+		rows   []string
+	}{
+		{"INSERT INTO t (a, b) VALUES (?, ?)", "INSERT INTO t (a, b) VALUES", []string{"(?, ?)"}},
+		{"insert into t values (1, 'x'),(2, 'y, (z)');", "insert into t values", []string{"(1, 'x')", "(2, 'y, (z)')"}},
+		{"INSERT INTO values_log (`values`) VALUES (NOW()), ($1)", "INSERT INTO values_log (`values`) VALUES", []string{"(NOW())", "($1)"}},
+		{"INSERT INTO t (a) VALUES ('it''s')", "INSERT INTO t (a) VALUES", []string{"('it''s')"}},
+		// Not mergeable
+		{"INSERT INTO t (a) VALUES (1) RETURNING id", "", nil},
+		{"INSERT INTO t (a) VALUES (1) ON CONFLICT DO NOTHING", "", nil},
+		{"INSERT INTO t (a) SELECT a FROM u", "", nil},
+		{"INSERT INTO t SET a = 1", "", nil},
+		{"INSERT INTO t (a) VALUES ('a\\'), ('b')", "", nil},
+		{"INSERT INTO t (a) VALUES (1) -- , (2)", "", nil},
+		{"INSERT INTO t (a) VALUES (1", "", nil},
+		{"UPDATE t SET a = 1", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			prefix, rows, ok := InsertValues(tt.query)
+			if ok != (tt.rows != nil) || prefix != tt.prefix || !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("InsertValues() = %q, %q, %v; want %q, %q", prefix, rows, ok, tt.prefix, tt.rows)
+			}
+		})
+	}
+}
+
+func TestInsertUpsert(t *testing.T) {
+	tests := []struct {
+		query  string
+		prefix string
+		rows   []string
+		clause string
+	}{
+		{"INSERT INTO t (a) VALUES (1)", "INSERT INTO t (a) VALUES", []string{"(1)"}, ""},
+		{"INSERT INTO t (id, v) VALUES (?, ?) ON DUPLICATE KEY UPDATE v = VALUES(v)",
+			"INSERT INTO t (id, v) VALUES", []string{"(?, ?)"}, "ON DUPLICATE KEY UPDATE v = VALUES(v)"},
+		{"INSERT INTO t (id, v) VALUES ($1, $2), (3, 'x')\n  ON CONFLICT (id) DO UPDATE SET v = EXCLUDED.v;",
+			"INSERT INTO t (id, v) VALUES", []string{"($1, $2)", "(3, 'x')"}, "ON CONFLICT (id) DO UPDATE SET v = EXCLUDED.v"},
+		{"INSERT INTO t (a) VALUES (1) on conflict do nothing", "INSERT INTO t (a) VALUES", []string{"(1)"}, "on conflict do nothing"},
+		{"INSERT INTO t (a) VALUES (1) ON CONFLICT DO UPDATE SET a = 'returning ?'",
+			"INSERT INTO t (a) VALUES", []string{"(1)"}, "ON CONFLICT DO UPDATE SET a = 'returning ?'"},
+		// Not mergeable
+		{"INSERT INTO t (a) VALUES (1) ON CONFLICT (a) DO UPDATE SET a = 2 RETURNING a", "", nil, ""},
+		{"INSERT INTO t (a) VALUES (?) ON DUPLICATE KEY UPDATE a = ?", "", nil, ""},
+		{"INSERT INTO t (a) VALUES ($1) ON CONFLICT (a) DO UPDATE SET a = $1", "", nil, ""},
+		{"INSERT INTO t (a) VALUES (1) ON CONFLICT DO NOTHING; DELETE FROM t", "", nil, ""},
+		{"INSERT INTO t (a) VALUES (1) RETURNING a", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			prefix, rows, clause, ok := InsertUpsert(tt.query)
+			if ok != (tt.rows != nil) || prefix != tt.prefix || !reflect.DeepEqual(rows, tt.rows) || clause != tt.clause {
+				t.Errorf("InsertUpsert() = %q, %q, %q, %v; want %q, %q, %q", prefix, rows, clause, ok, tt.prefix, tt.rows, tt.clause)
+			}
+		})
+	}
+}
+
+func TestShiftPlaceholders(t *testing.T) {
+	tests := []struct {
+		query  string
+		offset int
+		want   string
+	}{
+		{"($1, $2)", 2, "($3, $4)"},
+		{"($1, '$1', $tag$ $1 $tag$, $10)", 5, "($6, '$1', $tag$ $1 $tag$, $15)"},
+		{"(a$1, $1)", 1, "(a$1, $2)"},
+		{"(?, ?)", 3, "(?, ?)"},
+	}
+	for _, tt := range tests {
+		if got := ShiftPlaceholders(tt.query, tt.offset); got != tt.want {
+			t.Errorf("ShiftPlaceholders(%q, %d) = %q, want %q", tt.query, tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestReturningColumns(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"INSERT INTO t (a) VALUES (1)", nil},
+		{"INSERT INTO t (a) VALUES (1) RETURNING id", []string{"id"}},
+		{"INSERT INTO t (a) VALUES ($1) returning ID, t.created_at;", []string{"id", "created_at"}},
+		{`UPDATE t SET a = 1 RETURNING "Id", a + 1 AS next, coalesce(b, 0)`, []string{"Id", "next", "?column?"}},
+		{"DELETE FROM t WHERE id = 1 RETURNING *", []string{"*"}},
+		{"INSERT INTO t (a) VALUES ('x RETURNING y')", nil},
+	}
+	for _, tt := range tests {
+		if got := ReturningColumns(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReturningColumns(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseSequenceCall(t *testing.T) {
+	tests := []struct {
+		query    string
+		fn       string
+		sequence string
+		ok       bool
+	}{
+		{"SELECT currval('orders_id_seq')", "currval", "orders_id_seq", true},
+		{"select CURRVAL('public.Orders_id_seq'::regclass);", "currval", "orders_id_seq", true},
+		{`SELECT currval('public."Orders_id_seq"')`, "currval", "Orders_id_seq", true},
+		{"SELECT lastval() AS id", "lastval", "", true},
+		{"SELECT lastval('orders_id_seq')", "", "", false},
+		{"SELECT currval()", "", "", false},
+		{"SELECT nextval('orders_id_seq')", "", "", false},
+		{"SELECT currval('orders_id_seq') + 1", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			fn, sequence, ok := ParseSequenceCall(tt.query)
+			if fn != tt.fn || sequence != tt.sequence || ok != tt.ok {
+				t.Errorf("ParseSequenceCall() = (%q, %q, %v), want (%q, %q, %v)", fn, sequence, ok, tt.fn, tt.sequence, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		query      string
+		normalized string
+		params     []interface{}
+		ok         bool
+	}{
+		{"SELECT * FROM users WHERE id = 42", "SELECT * FROM users WHERE id = ?", []interface{}{int64(42)}, true},
+		{"SELECT *\n  FROM users WHERE name='it''s' AND age >= 18", "SELECT * FROM users WHERE name=? AND age >= ?", []interface{}{"it's", int64(18)}, true},
+		{"UPDATE users SET name = 'x' WHERE id IN (1, 2)", "UPDATE users SET name = ? WHERE id IN (?, ?)", []interface{}{"x", int64(1), int64(2)}, true},
+		{"INSERT INTO t (a, b) VALUES (1, 'a'), (2, lower('B'))", "INSERT INTO t (a, b) VALUES (?, ?), (?, lower('B'))", []interface{}{int64(1), "a", int64(2)}, true},
+		{"INSERT INTO t (a) VALUES (1) ON DUPLICATE KEY UPDATE a = a + 1, b = 2", "INSERT INTO t (a) VALUES (?) ON DUPLICATE KEY UPDATE a = a + 1, b = ?", []interface{}{int64(1), int64(2)}, true},
+		{"SELECT a, 2 FROM t WHERE d BETWEEN 1 AND 5 AND e = DATE '2024-01-01' ORDER BY 1 LIMIT 10", "SELECT a, 2 FROM t WHERE d BETWEEN ? AND ? AND e = DATE '2024-01-01' ORDER BY 1 LIMIT ?", []interface{}{int64(1), int64(5), int64(10)}, true},
+		{"SELECT * FROM t2 WHERE x = 1.5 AND y = 0x1F AND z = -3", "SELECT * FROM t2 WHERE x = 1.5 AND y = 0x1F AND z = -3", nil, true},
+		{"SELECT * FROM t WHERE a = '#;?--'", "SELECT * FROM t WHERE a = ?", []interface{}{"#;?--"}, true},
+		{"SELECT * FROM t WHERE id = ?", "", nil, false},
+		{"SELECT * FROM t WHERE id = $1", "", nil, false},
+		{"SELECT * FROM t WHERE a = 'x\\'y'", "", nil, false},
+		{"SELECT 1; DELETE FROM t", "", nil, false},
+		{"SELECT 1 -- comment", "", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			normalized, params, ok := Normalize(tt.query)
+			if normalized != tt.normalized || !reflect.DeepEqual(params, tt.params) || ok != tt.ok {
+				t.Errorf("Normalize() = (%q, %v, %v), want (%q, %v, %v)", normalized, params, ok, tt.normalized, tt.params, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNormalizedKey(t *testing.T) {
+	a := NormalizedKey("SELECT * FROM users WHERE id = 42")
+	if b := NormalizedKey("SELECT *  FROM users\nWHERE id = 42"); a != b {
+		t.Errorf("Expected queries that differ in whitespace to share a key, got %q and %q", a, b)
+	}
+	if b := NormalizedKey("SELECT * FROM users WHERE id = '42'"); a == b {
+		t.Errorf("Expected an integer and a string to have different keys, got %q", a)
+	}
+	if b := NormalizedKey("SELECT * FROM users WHERE id = 43"); a == b {
+		t.Errorf("Expected different values to have different keys, got %q", a)
+	}
+	if key := NormalizedKey("SELECT * FROM users WHERE id = ?"); key != "SELECT * FROM users WHERE id = ?" {
+		t.Errorf("Expected a query that cannot be normalized to be its own key, got %q", key)
+	}
+}
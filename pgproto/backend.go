@@ -0,0 +1,326 @@
+package pgproto
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Authentication request types
+const (
+	AuthOK                = 0
+	AuthCleartextPassword = 3
+	AuthMD5Password       = 5
+	AuthSASL              = 10
+	AuthSASLContinue      = 11
+	AuthSASLFinal         = 12
+)
+
+// Transaction status of ReadyForQuery
+const (
+	TxIdle          = 'I'
+	TxInTransaction = 'T'
+	TxFailed        = 'E'
+)
+
+// Authentication is an authentication request, or AuthenticationOk
+type Authentication struct {
+	Type uint32
+	Data []byte // Salt, SASL mechanisms or SASL data, depending on the type
+}
+
+// Decode decodes the payload of an Authentication message
+func (m *Authentication) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Type = r.uint32()
+	m.Data = r.buf
+	return r.err
+}
+
+// Encode appends the Authentication message to dst
+func (m Authentication) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgAuthentication)
+	dst = binary.BigEndian.AppendUint32(dst, m.Type)
+	return finish(append(dst, m.Data...), pos)
+}
+
+// ParameterStatus reports the value of a run-time parameter
+type ParameterStatus struct {
+	Name  string
+	Value string
+}
+
+// Decode decodes the payload of a ParameterStatus message
+func (m *ParameterStatus) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Name = r.string()
+	m.Value = r.string()
+	return r.err
+}
+
+// Encode appends the ParameterStatus message to dst
+func (m ParameterStatus) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgParameterStatus)
+	return finish(appendString(appendString(dst, m.Name), m.Value), pos)
+}
+
+// BackendKeyData identifies the session in cancel requests
+type BackendKeyData struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+// Decode decodes the payload of a BackendKeyData message
+func (m *BackendKeyData) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.ProcessID = r.uint32()
+	m.SecretKey = r.uint32()
+	return r.err
+}
+
+// Encode appends the BackendKeyData message to dst
+func (m BackendKeyData) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgBackendKeyData)
+	dst = binary.BigEndian.AppendUint32(dst, m.ProcessID)
+	return finish(binary.BigEndian.AppendUint32(dst, m.SecretKey), pos)
+}
+
+// ReadyForQuery ends the response to a simple query or Sync
+type ReadyForQuery struct {
+	TxStatus byte // TxIdle, TxInTransaction or TxFailed
+}
+
+// Decode decodes the payload of a ReadyForQuery message
+func (m *ReadyForQuery) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.TxStatus = r.byte()
+	return r.err
+}
+
+// Encode appends the ReadyForQuery message to dst
+func (m ReadyForQuery) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgReadyForQuery)
+	return finish(append(dst, m.TxStatus), pos)
+}
+
+// FieldDescription describes a column of a RowDescription
+type FieldDescription struct {
+	Name         string
+	TableOID     uint32
+	ColumnNumber uint16
+	TypeOID      uint32
+	TypeSize     int16 // -1 for variable size
+	TypeModifier int32
+	Format       int16
+}
+
+// TextField returns the description of a text column
+func TextField(name string) FieldDescription {
+	return FieldDescription{Name: name, TypeOID: OIDText, TypeSize: -1, TypeModifier: -1, Format: FormatText}
+}
+
+// RowDescription describes the columns of the rows that follow
+type RowDescription struct {
+	Fields []FieldDescription
+}
+
+// Decode decodes the payload of a RowDescription message
+func (m *RowDescription) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	n := int(r.uint16())
+	m.Fields = make([]FieldDescription, 0, min(n, len(r.buf)/19))
+	for i := 0; i < n && r.err == nil; i++ {
+		m.Fields = append(m.Fields, FieldDescription{
+			Name:         r.string(),
+			TableOID:     r.uint32(),
+			ColumnNumber: r.uint16(),
+			TypeOID:      r.uint32(),
+			TypeSize:     int16(r.uint16()),
+			TypeModifier: int32(r.uint32()),
+			Format:       int16(r.uint16()),
+		})
+	}
+	return r.err
+}
+
+// Encode appends the RowDescription message to dst
+func (m RowDescription) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgRowDescription)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m.Fields)))
+	for _, f := range m.Fields {
+		dst = appendString(dst, f.Name)
+		dst = binary.BigEndian.AppendUint32(dst, f.TableOID)
+		dst = binary.BigEndian.AppendUint16(dst, f.ColumnNumber)
+		dst = binary.BigEndian.AppendUint32(dst, f.TypeOID)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(f.TypeSize))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(f.TypeModifier))
+		dst = binary.BigEndian.AppendUint16(dst, uint16(f.Format))
+	}
+	return finish(dst, pos)
+}
+
+// DataRow is a row of a result
+type DataRow struct {
+	Values [][]byte // nil for NULL
+}
+
+// Decode decodes the payload of a DataRow message
+func (m *DataRow) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Values = r.values()
+	return r.err
+}
+
+// Encode appends the DataRow message to dst
+func (m DataRow) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgDataRow)
+	return finish(appendValues(dst, m.Values), pos)
+}
+
+// CommandComplete ends the result of a command
+type CommandComplete struct {
+	Tag string // Such as "SELECT 3" or "INSERT 0 1"
+}
+
+// Decode decodes the payload of a CommandComplete message
+func (m *CommandComplete) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Tag = r.string()
+	return r.err
+}
+
+// Encode appends the CommandComplete message to dst
+func (m CommandComplete) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgCommandComplete)
+	return finish(appendString(dst, m.Tag), pos)
+}
+
+// ErrorResponse reports an error. Fields other than the ones below are
+// ignored when decoding.
+type ErrorResponse struct {
+	Severity string // ERROR, FATAL or PANIC
+	Code     string // SQLSTATE
+	Message  string
+	Detail   string
+	Hint     string
+}
+
+// Error implements error, so that errors can be passed on as such
+func (m ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s (SQLSTATE %s)", m.Severity, m.Message, m.Code)
+}
+
+// Decode decodes the payload of an ErrorResponse message
+func (m *ErrorResponse) Decode(payload []byte) error {
+	return decodeFields(payload, m)
+}
+
+// Encode appends the ErrorResponse message to dst
+func (m ErrorResponse) Encode(dst []byte) []byte {
+	return encodeFields(dst, MsgErrorResponse, m)
+}
+
+// NoticeResponse is a warning or notice, with the fields of an ErrorResponse
+type NoticeResponse ErrorResponse
+
+// Decode decodes the payload of a NoticeResponse message
+func (m *NoticeResponse) Decode(payload []byte) error {
+	return decodeFields(payload, (*ErrorResponse)(m))
+}
+
+// Encode appends the NoticeResponse message to dst
+func (m NoticeResponse) Encode(dst []byte) []byte {
+	return encodeFields(dst, MsgNoticeResponse, ErrorResponse(m))
+}
+
+// decodeFields decodes the fields of an ErrorResponse or NoticeResponse
+func decodeFields(payload []byte, m *ErrorResponse) error {
+	*m = ErrorResponse{}
+	r := reader{buf: payload}
+	for {
+		code := r.byte()
+		if code == 0 || r.err != nil {
+			return r.err
+		}
+		value := r.string()
+		switch code {
+		case 'S':
+			m.Severity = value
+		case 'C':
+			m.Code = value
+		case 'M':
+			m.Message = value
+		case 'D':
+			m.Detail = value
+		case 'H':
+			m.Hint = value
+		}
+	}
+}
+
+// encodeFields appends an ErrorResponse or NoticeResponse, leaving out empty
+// optional fields
+func encodeFields(dst []byte, msgType byte, m ErrorResponse) []byte {
+	dst, pos := begin(dst, msgType)
+	dst = appendString(append(dst, 'S'), m.Severity)
+	dst = appendString(append(dst, 'C'), m.Code)
+	dst = appendString(append(dst, 'M'), m.Message)
+	if m.Detail != "" {
+		dst = appendString(append(dst, 'D'), m.Detail)
+	}
+	if m.Hint != "" {
+		dst = appendString(append(dst, 'H'), m.Hint)
+	}
+	return finish(append(dst, 0), pos)
+}
+
+// ParameterDescription describes the parameters of a prepared statement
+type ParameterDescription struct {
+	ParamOIDs []uint32 // 0 for unspecified
+}
+
+// Decode decodes the payload of a ParameterDescription message
+func (m *ParameterDescription) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	n := int(r.uint16())
+	m.ParamOIDs = make([]uint32, 0, min(n, len(r.buf)/4))
+	for i := 0; i < n && r.err == nil; i++ {
+		m.ParamOIDs = append(m.ParamOIDs, r.uint32())
+	}
+	return r.err
+}
+
+// Encode appends the ParameterDescription message to dst
+func (m ParameterDescription) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgParameterDescription)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m.ParamOIDs)))
+	for _, oid := range m.ParamOIDs {
+		dst = binary.BigEndian.AppendUint32(dst, oid)
+	}
+	return finish(dst, pos)
+}
+
+// Messages without fields
+type (
+	ParseComplete      struct{}
+	BindComplete       struct{}
+	CloseComplete      struct{}
+	NoData             struct{}
+	EmptyQueryResponse struct{}
+)
+
+// Encode appends the ParseComplete message to dst
+func (ParseComplete) Encode(dst []byte) []byte { return AppendMessage(dst, MsgParseComplete, nil) }
+
+// Encode appends the BindComplete message to dst
+func (BindComplete) Encode(dst []byte) []byte { return AppendMessage(dst, MsgBindComplete, nil) }
+
+// Encode appends the CloseComplete message to dst
+func (CloseComplete) Encode(dst []byte) []byte { return AppendMessage(dst, MsgCloseComplete, nil) }
+
+// Encode appends the NoData message to dst
+func (NoData) Encode(dst []byte) []byte { return AppendMessage(dst, MsgNoData, nil) }
+
+// Encode appends the EmptyQueryResponse message to dst
+func (EmptyQueryResponse) Encode(dst []byte) []byte {
+	return AppendMessage(dst, MsgEmptyQueryResponse, nil)
+}
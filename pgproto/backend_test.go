@@ -0,0 +1,45 @@
+package pgproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBackendMessages(t *testing.T) {
+	roundTrip(t, Authentication{Type: AuthMD5Password, Data: []byte{1, 2, 3, 4}}, MsgAuthentication, &Authentication{})
+	roundTrip(t, ParameterStatus{Name: "server_version", Value: "16.0"}, MsgParameterStatus, &ParameterStatus{})
+	roundTrip(t, BackendKeyData{ProcessID: 7, SecretKey: 12345}, MsgBackendKeyData, &BackendKeyData{})
+	roundTrip(t, ReadyForQuery{TxStatus: TxInTransaction}, MsgReadyForQuery, &ReadyForQuery{})
+	roundTrip(t, RowDescription{Fields: []FieldDescription{
+		TextField("name"),
+		{Name: "id", TableOID: 16384, ColumnNumber: 1, TypeOID: OIDInt4, TypeSize: 4, TypeModifier: -1, Format: FormatBinary},
+	}}, MsgRowDescription, &RowDescription{})
+	roundTrip(t, DataRow{Values: [][]byte{[]byte("1"), nil, {}}}, MsgDataRow, &DataRow{})
+	roundTrip(t, CommandComplete{Tag: "INSERT 0 1"}, MsgCommandComplete, &CommandComplete{})
+	roundTrip(t, ErrorResponse{Severity: "ERROR", Code: "42P01", Message: "relation does not exist", Hint: "check"}, MsgErrorResponse, &ErrorResponse{})
+	roundTrip(t, NoticeResponse{Severity: "WARNING", Code: "01000", Message: "batch hint clamped"}, MsgNoticeResponse, &NoticeResponse{})
+	roundTrip(t, ParameterDescription{ParamOIDs: []uint32{0, OIDText}}, MsgParameterDescription, &ParameterDescription{})
+}
+
+func TestEmptyMessages(t *testing.T) {
+	var buf []byte
+	for _, m := range []Encoder{ParseComplete{}, BindComplete{}, CloseComplete{}, NoData{}, EmptyQueryResponse{}} {
+		buf = m.Encode(buf)
+	}
+	want := "1\x00\x00\x00\x042\x00\x00\x00\x043\x00\x00\x00\x04n\x00\x00\x00\x04I\x00\x00\x00\x04"
+	if string(buf) != want {
+		t.Errorf("Encode() = %q, want %q", buf, want)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	got := ErrorResponse{Severity: "FATAL", Code: "28P01", Message: "password authentication failed"}.Encode(nil)
+	want := "E\x00\x00\x00\x33SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("Encode() = %q, want %q", got, want)
+	}
+	m := ErrorResponse{Severity: "ERROR", Code: "42000", Message: "syntax error"}
+	if m.Error() != "ERROR: syntax error (SQLSTATE 42000)" {
+		t.Errorf("Error() = %q", m.Error())
+	}
+}
@@ -0,0 +1,345 @@
+package pgproto
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Request codes of startup messages, in place of the protocol version
+const (
+	ProtocolVersion3  = 196608 // 3.0
+	SSLRequestCode    = 80877103
+	CancelRequestCode = 80877102
+	GSSENCRequestCode = 80877104
+)
+
+// Format codes of parameters and result columns
+const (
+	FormatText   = 0
+	FormatBinary = 1
+)
+
+// Describe and Close target a prepared statement or a portal
+const (
+	TargetStatement = 'S'
+	TargetPortal    = 'P'
+)
+
+// StartupMessage opens a session, or requests SSL or cancellation when the
+// protocol version is one of the request codes
+type StartupMessage struct {
+	ProtocolVersion uint32
+	Params          map[string]string
+}
+
+// Decode decodes the payload of a startup message
+func (m *StartupMessage) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.ProtocolVersion = r.uint32()
+	m.Params = make(map[string]string)
+	if m.ProtocolVersion != ProtocolVersion3 {
+		return r.err
+	}
+	for r.err == nil && len(r.buf) > 0 && r.buf[0] != 0 {
+		key := r.string()
+		m.Params[key] = r.string()
+	}
+	return r.err
+}
+
+// Encode appends the startup message, which has no type byte, to dst
+func (m StartupMessage) Encode(dst []byte) []byte {
+	pos := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, m.ProtocolVersion)
+	if m.ProtocolVersion == ProtocolVersion3 {
+		for key, value := range m.Params {
+			dst = appendString(appendString(dst, key), value)
+		}
+		dst = append(dst, 0)
+	}
+	return finish(dst, pos)
+}
+
+// CancelRequest asks to cancel the query running in the session identified by
+// its BackendKeyData. It is sent on a new connection instead of a startup
+// message.
+type CancelRequest struct {
+	ProcessID uint32
+	SecretKey uint32
+}
+
+// Decode decodes the payload of a cancel request, including the request code
+func (m *CancelRequest) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	if code := r.uint32(); r.err == nil && code != CancelRequestCode {
+		return fmt.Errorf("pgproto: not a cancel request")
+	}
+	m.ProcessID = r.uint32()
+	m.SecretKey = r.uint32()
+	return r.err
+}
+
+// Encode appends the cancel request, which has no type byte, to dst
+func (m CancelRequest) Encode(dst []byte) []byte {
+	pos := len(dst)
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, CancelRequestCode)
+	dst = binary.BigEndian.AppendUint32(dst, m.ProcessID)
+	dst = binary.BigEndian.AppendUint32(dst, m.SecretKey)
+	return finish(dst, pos)
+}
+
+// Query is a simple query
+type Query struct {
+	String string
+}
+
+// Decode decodes the payload of a Query message
+func (m *Query) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.String = r.string()
+	return r.err
+}
+
+// Encode appends the Query message to dst
+func (m Query) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgQuery)
+	return finish(appendString(dst, m.String), pos)
+}
+
+// Parse creates a prepared statement
+type Parse struct {
+	Name      string
+	Query     string
+	ParamOIDs []uint32 // Types of the parameters, 0 for unspecified
+}
+
+// Decode decodes the payload of a Parse message
+func (m *Parse) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Name = r.string()
+	m.Query = r.string()
+	n := int(r.uint16())
+	m.ParamOIDs = make([]uint32, 0, min(n, len(r.buf)/4))
+	for i := 0; i < n && r.err == nil; i++ {
+		m.ParamOIDs = append(m.ParamOIDs, r.uint32())
+	}
+	return r.err
+}
+
+// Encode appends the Parse message to dst
+func (m Parse) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgParse)
+	dst = appendString(appendString(dst, m.Name), m.Query)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(m.ParamOIDs)))
+	for _, oid := range m.ParamOIDs {
+		dst = binary.BigEndian.AppendUint32(dst, oid)
+	}
+	return finish(dst, pos)
+}
+
+// Bind binds parameter values to a prepared statement, creating a portal
+type Bind struct {
+	Portal        string
+	Statement     string
+	ParamFormats  []int16  // None (all text), one for all, or one per parameter
+	Params        [][]byte // nil for NULL
+	ResultFormats []int16  // None (all text), one for all, or one per column
+}
+
+// Decode decodes the payload of a Bind message
+func (m *Bind) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Portal = r.string()
+	m.Statement = r.string()
+	m.ParamFormats = r.int16s()
+	m.Params = r.values()
+	m.ResultFormats = r.int16s()
+	return r.err
+}
+
+// Encode appends the Bind message to dst
+func (m Bind) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgBind)
+	dst = appendString(appendString(dst, m.Portal), m.Statement)
+	dst = appendInt16s(dst, m.ParamFormats)
+	dst = appendValues(dst, m.Params)
+	dst = appendInt16s(dst, m.ResultFormats)
+	return finish(dst, pos)
+}
+
+// ParamFormat returns the format code of parameter i
+func (m Bind) ParamFormat(i int) int16 {
+	return formatOf(m.ParamFormats, i)
+}
+
+// ResultFormat returns the format code of result column i
+func (m Bind) ResultFormat(i int) int16 {
+	return formatOf(m.ResultFormats, i)
+}
+
+// formatOf returns the format code of field i from a list of format codes
+func formatOf(formats []int16, i int) int16 {
+	switch {
+	case len(formats) == 0:
+		return FormatText
+	case len(formats) == 1:
+		return formats[0]
+	case i < len(formats):
+		return formats[i]
+	}
+	return FormatText
+}
+
+// appendInt16s appends a count followed by 16 bit integers
+func appendInt16s(dst []byte, values []int16) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(values)))
+	for _, v := range values {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(v))
+	}
+	return dst
+}
+
+// Describe asks for the description of a prepared statement or portal
+type Describe struct {
+	Target byte // TargetStatement or TargetPortal
+	Name   string
+}
+
+// Decode decodes the payload of a Describe message
+func (m *Describe) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Target = r.byte()
+	m.Name = r.string()
+	if r.err == nil && m.Target != TargetStatement && m.Target != TargetPortal {
+		return fmt.Errorf("pgproto: unknown describe target %q", m.Target)
+	}
+	return r.err
+}
+
+// Encode appends the Describe message to dst
+func (m Describe) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgDescribe)
+	return finish(appendString(append(dst, m.Target), m.Name), pos)
+}
+
+// Execute executes a portal
+type Execute struct {
+	Portal  string
+	MaxRows uint32 // 0 for no limit
+}
+
+// Decode decodes the payload of an Execute message
+func (m *Execute) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Portal = r.string()
+	m.MaxRows = r.uint32()
+	return r.err
+}
+
+// Encode appends the Execute message to dst
+func (m Execute) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgExecute)
+	dst = appendString(dst, m.Portal)
+	return finish(binary.BigEndian.AppendUint32(dst, m.MaxRows), pos)
+}
+
+// Close closes a prepared statement or portal
+type Close struct {
+	Target byte // TargetStatement or TargetPortal
+	Name   string
+}
+
+// Decode decodes the payload of a Close message
+func (m *Close) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Target = r.byte()
+	m.Name = r.string()
+	if r.err == nil && m.Target != TargetStatement && m.Target != TargetPortal {
+		return fmt.Errorf("pgproto: unknown close target %q", m.Target)
+	}
+	return r.err
+}
+
+// Encode appends the Close message to dst
+func (m Close) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgClose)
+	return finish(appendString(append(dst, m.Target), m.Name), pos)
+}
+
+// SASLInitialResponse starts a SASL exchange with the chosen mechanism
+type SASLInitialResponse struct {
+	Mechanism string
+	Data      []byte // nil when there is no initial response
+}
+
+// Decode decodes the payload of a SASLInitialResponse message
+func (m *SASLInitialResponse) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Mechanism = r.string()
+	length := int32(r.uint32())
+	m.Data = nil
+	if length >= 0 {
+		m.Data = r.take(int(length))
+	}
+	return r.err
+}
+
+// Encode appends the SASLInitialResponse message to dst
+func (m SASLInitialResponse) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgPassword)
+	dst = appendString(dst, m.Mechanism)
+	if m.Data == nil {
+		return finish(binary.BigEndian.AppendUint32(dst, 0xFFFFFFFF), pos)
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(m.Data)))
+	return finish(append(dst, m.Data...), pos)
+}
+
+// PasswordMessage is a password in response to AuthenticationCleartextPassword,
+// or its salted hash in response to AuthenticationMD5Password
+type PasswordMessage struct {
+	Password string
+}
+
+// Decode decodes the payload of a PasswordMessage
+func (m *PasswordMessage) Decode(payload []byte) error {
+	r := reader{buf: payload}
+	m.Password = r.string()
+	return r.err
+}
+
+// Encode appends the PasswordMessage to dst
+func (m PasswordMessage) Encode(dst []byte) []byte {
+	dst, pos := begin(dst, MsgPassword)
+	return finish(appendString(dst, m.Password), pos)
+}
+
+// SASLResponse continues a SASL exchange
+type SASLResponse struct {
+	Data []byte
+}
+
+// Decode decodes the payload of a SASLResponse message
+func (m *SASLResponse) Decode(payload []byte) error {
+	m.Data = payload
+	return nil
+}
+
+// Encode appends the SASLResponse message to dst
+func (m SASLResponse) Encode(dst []byte) []byte {
+	return AppendMessage(dst, MsgPassword, m.Data)
+}
+
+// Messages without fields sent by clients
+type (
+	Sync      struct{}
+	Terminate struct{}
+)
+
+// Encode appends the Sync message to dst
+func (Sync) Encode(dst []byte) []byte { return AppendMessage(dst, MsgSync, nil) }
+
+// Encode appends the Terminate message to dst
+func (Terminate) Encode(dst []byte) []byte { return AppendMessage(dst, MsgTerminate, nil) }
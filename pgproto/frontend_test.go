@@ -0,0 +1,70 @@
+package pgproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrontendMessages(t *testing.T) {
+	roundTrip(t, Query{String: "SELECT 1"}, MsgQuery, &Query{})
+	roundTrip(t, Parse{Name: "s1", Query: "SELECT $1", ParamOIDs: []uint32{OIDInt4}}, MsgParse, &Parse{})
+	roundTrip(t, Parse{Query: "SELECT 1", ParamOIDs: []uint32{}}, MsgParse, &Parse{})
+	roundTrip(t, Bind{
+		Portal:        "p1",
+		Statement:     "s1",
+		ParamFormats:  []int16{FormatText, FormatBinary},
+		Params:        [][]byte{[]byte("42"), nil, {}},
+		ResultFormats: []int16{FormatBinary},
+	}, MsgBind, &Bind{})
+	roundTrip(t, Describe{Target: TargetStatement, Name: "s1"}, MsgDescribe, &Describe{})
+	roundTrip(t, Execute{Portal: "p1", MaxRows: 100}, MsgExecute, &Execute{})
+	roundTrip(t, Close{Target: TargetPortal, Name: "p1"}, MsgClose, &Close{})
+	roundTrip(t, SASLInitialResponse{Mechanism: "SCRAM-SHA-256", Data: []byte("n,,n=,r=abc")}, MsgPassword, &SASLInitialResponse{})
+	roundTrip(t, SASLInitialResponse{Mechanism: "SCRAM-SHA-256"}, MsgPassword, &SASLInitialResponse{})
+	roundTrip(t, PasswordMessage{Password: "md5abc"}, MsgPassword, &PasswordMessage{})
+	roundTrip(t, SASLResponse{Data: []byte("c=biws,r=abc,p=xyz")}, MsgPassword, &SASLResponse{})
+}
+
+func TestCancelRequest(t *testing.T) {
+	msg := CancelRequest{ProcessID: 7, SecretKey: 12345}.Encode(nil)
+	payload, err := ReadStartupMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m CancelRequest
+	if err := m.Decode(payload); err != nil || m.ProcessID != 7 || m.SecretKey != 12345 {
+		t.Errorf("Decode() = %+v, %v", m, err)
+	}
+	if err := m.Decode(StartupMessage{ProtocolVersion: SSLRequestCode}.Encode(nil)[4:]); err == nil {
+		t.Error("Expected an error for an SSL request")
+	}
+}
+
+func TestDescribeUnknownTarget(t *testing.T) {
+	var m Describe
+	if err := m.Decode([]byte("Xname\x00")); err == nil {
+		t.Error("Expected an error for an unknown describe target")
+	}
+}
+
+func TestBindFormats(t *testing.T) {
+	tests := []struct {
+		formats []int16
+		want    []int16
+	}{
+		{nil, []int16{FormatText, FormatText}},
+		{[]int16{FormatBinary}, []int16{FormatBinary, FormatBinary}},
+		{[]int16{FormatText, FormatBinary}, []int16{FormatText, FormatBinary}},
+	}
+	for _, tt := range tests {
+		m := Bind{ParamFormats: tt.formats, ResultFormats: tt.formats}
+		for i, want := range tt.want {
+			if got := m.ParamFormat(i); got != want {
+				t.Errorf("ParamFormat(%d) with %v = %d, want %d", i, tt.formats, got, want)
+			}
+			if got := m.ResultFormat(i); got != want {
+				t.Errorf("ResultFormat(%d) with %v = %d, want %d", i, tt.formats, got, want)
+			}
+		}
+	}
+}
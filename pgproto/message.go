@@ -0,0 +1,267 @@
+// Package pgproto encodes and decodes messages of the PostgreSQL
+// frontend/backend protocol (version 3), as spoken between clients and the
+// proxy, and between the proxy and its backends.
+//
+// Messages are framed by a type byte and a 4 byte big endian length that
+// includes itself; the startup message has no type byte. Typed messages
+// decode from a payload (without type and length) and encode by appending the
+// framed message to a buffer, so that responses can be built in one buffer and
+// written, or cached, at once.
+//
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+package pgproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Types of messages sent by clients
+const (
+	MsgQuery     = 'Q'
+	MsgParse     = 'P'
+	MsgBind      = 'B'
+	MsgExecute   = 'E'
+	MsgDescribe  = 'D'
+	MsgClose     = 'C'
+	MsgSync      = 'S'
+	MsgFlush     = 'H'
+	MsgTerminate = 'X'
+	MsgPassword  = 'p' // Also SASLInitialResponse and SASLResponse
+	MsgCopyData  = 'd' // Also sent by servers
+	MsgCopyDone  = 'c' // Also sent by servers
+	MsgCopyFail  = 'f'
+)
+
+// Types of messages sent by servers
+const (
+	MsgAuthentication       = 'R'
+	MsgParameterStatus      = 'S'
+	MsgBackendKeyData       = 'K'
+	MsgReadyForQuery        = 'Z'
+	MsgRowDescription       = 'T'
+	MsgDataRow              = 'D'
+	MsgCommandComplete      = 'C'
+	MsgEmptyQueryResponse   = 'I'
+	MsgErrorResponse        = 'E'
+	MsgNoticeResponse       = 'N'
+	MsgParseComplete        = '1'
+	MsgBindComplete         = '2'
+	MsgCloseComplete        = '3'
+	MsgNoData               = 'n'
+	MsgParameterDescription = 't'
+	MsgCopyInResponse       = 'G'
+	MsgCopyOutResponse      = 'H'
+	MsgCopyBothResponse     = 'W' // Starts streaming replication
+	MsgNotification         = 'A'
+	MsgPortalSuspended      = 's'
+)
+
+// MaxMessageSize is the largest message accepted, as in PostgreSQL
+const MaxMessageSize = 1 << 30
+
+// ErrShortMessage is returned for messages that end before their fields do
+var ErrShortMessage = errors.New("pgproto: message too short")
+
+// Encoder is a message that can be sent
+type Encoder interface {
+	// Encode appends the framed message to dst
+	Encode(dst []byte) []byte
+}
+
+// ReadMessage reads a message and returns its type and payload
+func ReadMessage(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload, err := readPayload(r, binary.BigEndian.Uint32(header[1:]))
+	return header[0], payload, err
+}
+
+// ReadStartupMessage reads a message without type byte, as sent first by
+// clients (StartupMessage, SSLRequest or CancelRequest), and returns its
+// payload
+func ReadStartupMessage(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	return readPayload(r, binary.BigEndian.Uint32(header[:]))
+}
+
+// readPayload reads the payload of a message with the given length
+func readPayload(r io.Reader, length uint32) ([]byte, error) {
+	if length < 4 || length > MaxMessageSize {
+		return nil, fmt.Errorf("pgproto: invalid message length %d", length)
+	}
+	payload := make([]byte, length-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// AppendMessage appends a message with the given type and payload to dst
+func AppendMessage(dst []byte, msgType byte, payload []byte) []byte {
+	dst = append(dst, msgType)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)+4))
+	return append(dst, payload...)
+}
+
+// WriteMessage writes a message with the given type and payload in a single
+// write
+func WriteMessage(w io.Writer, msgType byte, payload []byte) error {
+	_, err := w.Write(AppendMessage(make([]byte, 0, 5+len(payload)), msgType, payload))
+	return err
+}
+
+// Message is a message within a buffer of consecutive messages
+type Message struct {
+	Type    byte
+	Payload []byte // Shares memory with the buffer
+}
+
+// SplitMessages splits a buffer of consecutive messages, as read from a
+// backend or stored in the cache
+func SplitMessages(data []byte) ([]Message, error) {
+	var msgs []Message
+	for pos := 0; pos < len(data); {
+		if pos+5 > len(data) {
+			return nil, ErrShortMessage
+		}
+		length := int(binary.BigEndian.Uint32(data[pos+1:]))
+		end := pos + 1 + length
+		if length < 4 || end > len(data) {
+			return nil, ErrShortMessage
+		}
+		msgs = append(msgs, Message{Type: data[pos], Payload: data[pos+5 : end]})
+		pos = end
+	}
+	return msgs, nil
+}
+
+// begin appends the type and a length placeholder of a message to dst and
+// returns the position of the length
+func begin(dst []byte, msgType byte) ([]byte, int) {
+	dst = append(dst, msgType, 0, 0, 0, 0)
+	return dst, len(dst) - 4
+}
+
+// finish sets the length of the message started at pos
+func finish(dst []byte, pos int) []byte {
+	binary.BigEndian.PutUint32(dst[pos:], uint32(len(dst)-pos))
+	return dst
+}
+
+// appendString appends a NUL terminated string
+func appendString(dst []byte, s string) []byte {
+	return append(append(dst, s...), 0)
+}
+
+// reader reads the fields of a payload, remembering the first error
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.buf) {
+		r.err = ErrShortMessage
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) byte() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// string reads a NUL terminated string
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(r.buf, 0)
+	if end < 0 {
+		r.err = ErrShortMessage
+		return ""
+	}
+	s := string(r.buf[:end])
+	r.buf = r.buf[end+1:]
+	return s
+}
+
+// int16s reads a count followed by that many 16 bit integers
+func (r *reader) int16s() []int16 {
+	n := int(r.uint16())
+	if r.err != nil || n*2 > len(r.buf) {
+		r.err = ErrShortMessage
+		return nil
+	}
+	values := make([]int16, n)
+	for i := range values {
+		values[i] = int16(r.uint16())
+	}
+	return values
+}
+
+// values reads a count followed by that many length prefixed values, of
+// which a length of -1 is NULL (nil)
+func (r *reader) values() [][]byte {
+	n := int(r.uint16())
+	if r.err != nil {
+		return nil
+	}
+	values := make([][]byte, n)
+	for i := range values {
+		length := int32(r.uint32())
+		if length == -1 {
+			continue
+		}
+		values[i] = bytes.Clone(r.take(int(length)))
+	}
+	if r.err != nil {
+		return nil
+	}
+	return values
+}
+
+// appendValues appends a count followed by length prefixed values
+func appendValues(dst []byte, values [][]byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			dst = binary.BigEndian.AppendUint32(dst, 0xFFFFFFFF)
+			continue
+		}
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(v)))
+		dst = append(dst, v...)
+	}
+	return dst
+}
@@ -0,0 +1,110 @@
+package pgproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte('Q')
+	binary.Write(&buf, binary.BigEndian, uint32(14)) // Length includes itself
+	buf.WriteString("SELECT 1;\x00")
+
+	msgType, payload, err := ReadMessage(&buf)
+	if err != nil || msgType != 'Q' || string(payload) != "SELECT 1;\x00" {
+		t.Errorf("ReadMessage() = %c, %q, %v", msgType, payload, err)
+	}
+
+	for _, length := range []uint32{0, 3, MaxMessageSize + 1} {
+		data := binary.BigEndian.AppendUint32([]byte{'Q'}, length)
+		if _, _, err := ReadMessage(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected an error for length %d", length)
+		}
+	}
+}
+
+func TestWriteMessage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, 'Q', []byte("SELECT 1;\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "Q\x00\x00\x00\x0eSELECT 1;\x00" {
+		t.Errorf("WriteMessage() wrote %q", got)
+	}
+	msgType, payload, err := ReadMessage(&buf)
+	if err != nil || msgType != 'Q' || string(payload) != "SELECT 1;\x00" {
+		t.Errorf("ReadMessage() = %c, %q, %v", msgType, payload, err)
+	}
+}
+
+func TestSplitMessages(t *testing.T) {
+	data := CommandComplete{Tag: "SELECT 1"}.Encode(nil)
+	data = ReadyForQuery{TxStatus: TxIdle}.Encode(data)
+	msgs, err := SplitMessages(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].Type != MsgCommandComplete || string(msgs[0].Payload) != "SELECT 1\x00" ||
+		msgs[1].Type != MsgReadyForQuery || string(msgs[1].Payload) != "I" {
+		t.Errorf("SplitMessages() = %+v", msgs)
+	}
+	if _, err := SplitMessages(data[:len(data)-1]); err != ErrShortMessage {
+		t.Errorf("Expected ErrShortMessage for a truncated buffer, got %v", err)
+	}
+}
+
+func TestReadStartupMessage(t *testing.T) {
+	data := StartupMessage{ProtocolVersion: ProtocolVersion3, Params: map[string]string{"user": "app", "database": "shop"}}.Encode(nil)
+	payload, err := ReadStartupMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m StartupMessage
+	if err := m.Decode(payload); err != nil || m.Params["user"] != "app" || m.Params["database"] != "shop" || len(m.Params) != 2 {
+		t.Errorf("Decode() = %+v, %v", m, err)
+	}
+
+	ssl := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), SSLRequestCode)
+	payload, err = ReadStartupMessage(bytes.NewReader(ssl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Decode(payload); err != nil || m.ProtocolVersion != SSLRequestCode || len(m.Params) != 0 {
+		t.Errorf("Decode() of SSLRequest = %+v, %v", m, err)
+	}
+}
+
+// decoder is a message that decodes from its payload
+type decoder interface {
+	Decode(payload []byte) error
+}
+
+// roundTrip encodes a message, reads it back and decodes it into out
+func roundTrip(t *testing.T, in Encoder, msgType byte, out decoder) {
+	t.Helper()
+	msgTypeRead, payload, err := ReadMessage(bytes.NewReader(in.Encode([]byte("prefix"))[6:]))
+	if err != nil {
+		t.Fatalf("ReadMessage() of %T: %v", in, err)
+	}
+	if msgTypeRead != msgType {
+		t.Errorf("Expected type %c for %T, got %c", msgType, in, msgTypeRead)
+	}
+	if err := out.Decode(payload); err != nil {
+		t.Fatalf("Decode() of %T: %v", in, err)
+	}
+	if got := reflect.ValueOf(out).Elem().Interface(); !reflect.DeepEqual(got, in) {
+		t.Errorf("Round trip of %T = %+v, want %+v", in, got, in)
+	}
+}
+
+func TestDecodeShortMessages(t *testing.T) {
+	for _, m := range []decoder{&Query{}, &Parse{}, &Bind{}, &Describe{}, &Execute{}, &Close{},
+		&RowDescription{}, &DataRow{}, &CommandComplete{}, &BackendKeyData{}, &ParameterStatus{}} {
+		if err := m.Decode([]byte{0x01}); err == nil {
+			t.Errorf("Expected an error decoding a truncated %T", m)
+		}
+	}
+}
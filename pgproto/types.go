@@ -0,0 +1,387 @@
+package pgproto
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Type OIDs of the built-in types the proxy encodes values of
+const (
+	OIDBool        = 16
+	OIDBytea       = 17
+	OIDInt8        = 20
+	OIDInt2        = 21
+	OIDInt4        = 23
+	OIDText        = 25
+	OIDJSON        = 114
+	OIDFloat4      = 700
+	OIDFloat8      = 701
+	OIDBpchar      = 1042
+	OIDVarchar     = 1043
+	OIDDate        = 1082
+	OIDTime        = 1083
+	OIDTimestamp   = 1114
+	OIDTimestampTZ = 1184
+	OIDNumeric     = 1700
+	OIDUUID        = 2950
+	OIDJSONB       = 3802
+)
+
+// typeOIDs maps type names, as database/sql drivers report them (lib/pq
+// reports "INT4"), to OIDs
+var typeOIDs = map[string]uint32{
+	"BOOL":        OIDBool,
+	"BYTEA":       OIDBytea,
+	"INT8":        OIDInt8,
+	"INT2":        OIDInt2,
+	"INT4":        OIDInt4,
+	"TEXT":        OIDText,
+	"JSON":        OIDJSON,
+	"FLOAT4":      OIDFloat4,
+	"FLOAT8":      OIDFloat8,
+	"BPCHAR":      OIDBpchar,
+	"VARCHAR":     OIDVarchar,
+	"DATE":        OIDDate,
+	"TIME":        OIDTime,
+	"TIMESTAMP":   OIDTimestamp,
+	"TIMESTAMPTZ": OIDTimestampTZ,
+	"NUMERIC":     OIDNumeric,
+	"UUID":        OIDUUID,
+	"JSONB":       OIDJSONB,
+}
+
+// TypeOID returns the OID of a type name, or OIDText for types the proxy
+// does not know, of which values are sent as they are
+func TypeOID(name string) uint32 {
+	if oid, ok := typeOIDs[strings.ToUpper(name)]; ok {
+		return oid
+	}
+	return OIDText
+}
+
+// typeSize returns the size of the values of a type, -1 for variable size
+func typeSize(oid uint32) int16 {
+	switch oid {
+	case OIDBool:
+		return 1
+	case OIDInt2:
+		return 2
+	case OIDInt4, OIDFloat4, OIDDate:
+		return 4
+	case OIDInt8, OIDFloat8, OIDTime, OIDTimestamp, OIDTimestampTZ:
+		return 8
+	case OIDUUID:
+		return 16
+	}
+	return -1
+}
+
+// TypeField returns the description of a column of the type, in the format
+func TypeField(name string, oid uint32, format int16) FieldDescription {
+	return FieldDescription{Name: name, TypeOID: oid, TypeSize: typeSize(oid), TypeModifier: -1, Format: format}
+}
+
+// pgEpoch is the zero of binary dates and timestamps
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// timeLayouts are the text forms of dates and times, of timestamps with time
+// zone in zones at a whole hour
+var timeLayouts = map[uint32]string{
+	OIDDate:        "2006-01-02",
+	OIDTime:        "15:04:05.999999",
+	OIDTimestamp:   "2006-01-02 15:04:05.999999",
+	OIDTimestampTZ: "2006-01-02 15:04:05.999999-07",
+}
+
+// AppendValue appends a value, as returned by a database/sql driver, in the
+// text or binary format of the type. Strings and byte slices hold the text
+// form of the value. A nil value is NULL and appends nothing, see DataRow.
+func AppendValue(dst []byte, v interface{}, oid uint32, format int16) ([]byte, error) {
+	text := appendText(nil, v, oid)
+	if format != FormatBinary {
+		return append(dst, text...), nil
+	}
+	s := string(text)
+	switch oid {
+	case OIDBool:
+		if s == "t" {
+			return append(dst, 1), nil
+		}
+		return append(dst, 0), nil
+	case OIDInt2, OIDInt4, OIDInt8:
+		n, err := strconv.ParseInt(s, 10, int(typeSize(oid))*8)
+		if err != nil {
+			return nil, err
+		}
+		switch oid {
+		case OIDInt2:
+			return binary.BigEndian.AppendUint16(dst, uint16(n)), nil
+		case OIDInt4:
+			return binary.BigEndian.AppendUint32(dst, uint32(n)), nil
+		}
+		return binary.BigEndian.AppendUint64(dst, uint64(n)), nil
+	case OIDFloat4:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint32(dst, math.Float32bits(float32(f))), nil
+	case OIDFloat8:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(dst, math.Float64bits(f)), nil
+	case OIDBytea:
+		b, err := hex.DecodeString(strings.TrimPrefix(s, `\x`))
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, b...), nil
+	case OIDUUID:
+		b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+		if err != nil || len(b) != 16 {
+			return nil, fmt.Errorf("invalid uuid %q", s)
+		}
+		return append(dst, b...), nil
+	case OIDDate, OIDTime, OIDTimestamp, OIDTimestampTZ:
+		return appendBinaryTime(dst, v, s, oid)
+	case OIDNumeric:
+		return appendBinaryNumeric(dst, s)
+	case OIDJSONB:
+		return append(append(dst, 1), text...), nil
+	}
+	return append(dst, text...), nil
+}
+
+// appendText appends the text form of a value of the type
+func appendText(dst []byte, v interface{}, oid uint32) []byte {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return append(dst, 't')
+		}
+		return append(dst, 'f')
+	case int64:
+		return strconv.AppendInt(dst, v, 10)
+	case float64:
+		bits := 64
+		if oid == OIDFloat4 {
+			bits = 32
+		}
+		return strconv.AppendFloat(dst, v, 'g', -1, bits)
+	case time.Time:
+		layout, ok := timeLayouts[oid]
+		if !ok {
+			layout = timeLayouts[OIDTimestampTZ]
+		}
+		if _, offset := v.Zone(); oid == OIDTimestampTZ && offset%3600 != 0 {
+			layout += ":00"
+		}
+		return v.AppendFormat(dst, layout)
+	case []byte:
+		if oid == OIDBytea && !strings.HasPrefix(string(v), `\x`) {
+			return hex.AppendEncode(append(dst, `\x`...), v)
+		}
+		return append(dst, v...)
+	case string:
+		return append(dst, v...)
+	}
+	return fmt.Appendf(dst, "%v", v)
+}
+
+// appendBinaryTime appends a date as days and a time or timestamp as
+// microseconds, since midnight or since 2000-01-01
+func appendBinaryTime(dst []byte, v interface{}, s string, oid uint32) ([]byte, error) {
+	t, ok := v.(time.Time)
+	if !ok {
+		var err error
+		if t, err = time.Parse(timeLayouts[oid], s); err != nil {
+			return nil, err
+		}
+	}
+	switch oid {
+	case OIDDate:
+		days := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Sub(pgEpoch).Hours() / 24
+		return binary.BigEndian.AppendUint32(dst, uint32(int32(days))), nil
+	case OIDTime:
+		midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		return binary.BigEndian.AppendUint64(dst, uint64(t.Sub(midnight).Microseconds())), nil
+	case OIDTimestamp:
+		// The wall clock time, without time zone
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	}
+	return binary.BigEndian.AppendUint64(dst, uint64(t.Sub(pgEpoch).Microseconds())), nil
+}
+
+// appendBinaryNumeric appends a numeric in its binary form: the number of
+// digits, the weight of the first digit, the sign and the display scale,
+// followed by the digits in base 10000
+func appendBinaryNumeric(dst []byte, s string) ([]byte, error) {
+	var sign uint16
+	switch s {
+	case "NaN":
+		return append(dst, 0, 0, 0, 0, 0xC0, 0, 0, 0), nil
+	case "Infinity":
+		return append(dst, 0, 0, 0, 0, 0xD0, 0, 0, 0), nil
+	case "-Infinity":
+		return append(dst, 0, 0, 0, 0, 0xF0, 0, 0, 0), nil
+	}
+	if strings.HasPrefix(s, "-") {
+		sign, s = 0x4000, s[1:]
+	}
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" || strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return nil, fmt.Errorf("invalid numeric %q", s)
+	}
+	scale := len(fracPart)
+
+	// Align the digits to groups of 4 around the decimal point
+	intPart = strings.Repeat("0", (4-len(intPart)%4)%4) + intPart
+	fracPart += strings.Repeat("0", (4-len(fracPart)%4)%4)
+	all := intPart + fracPart
+	weight := len(intPart)/4 - 1
+	var digits []uint16
+	for i := 0; i < len(all); i += 4 {
+		d, _ := strconv.Atoi(all[i : i+4])
+		digits = append(digits, uint16(d))
+	}
+	for len(digits) > 0 && digits[0] == 0 {
+		digits = digits[1:]
+		weight--
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		weight, sign = 0, 0
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(digits)))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(int16(weight)))
+	dst = binary.BigEndian.AppendUint16(dst, sign)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(scale))
+	for _, d := range digits {
+		dst = binary.BigEndian.AppendUint16(dst, d)
+	}
+	return dst, nil
+}
+
+// ParseValue returns a parameter value, sent in the text or binary format of
+// the type, as a value for a database/sql driver. Text values and binary
+// values of types the proxy does not know are returned as strings.
+func ParseValue(b []byte, oid uint32, format int16) (interface{}, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if format != FormatBinary {
+		return string(b), nil
+	}
+	if size := typeSize(oid); size > 0 && len(b) != int(size) {
+		return nil, fmt.Errorf("invalid binary value of type %d: %d bytes", oid, len(b))
+	}
+	switch oid {
+	case OIDBool:
+		return b[0] != 0, nil
+	case OIDInt2:
+		return int64(int16(binary.BigEndian.Uint16(b))), nil
+	case OIDInt4:
+		return int64(int32(binary.BigEndian.Uint32(b))), nil
+	case OIDInt8:
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case OIDFloat4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case OIDFloat8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case OIDBytea:
+		return append([]byte{}, b...), nil
+	case OIDUUID:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+	case OIDDate:
+		switch days := int32(binary.BigEndian.Uint32(b)); days {
+		case math.MaxInt32:
+			return "infinity", nil
+		case math.MinInt32:
+			return "-infinity", nil
+		default:
+			return pgEpoch.AddDate(0, 0, int(days)), nil
+		}
+	case OIDTime:
+		us := int64(binary.BigEndian.Uint64(b))
+		return time.UnixMicro(us).UTC().Format(timeLayouts[OIDTime]), nil
+	case OIDTimestamp, OIDTimestampTZ:
+		switch us := int64(binary.BigEndian.Uint64(b)); us {
+		case math.MaxInt64:
+			return "infinity", nil
+		case math.MinInt64:
+			return "-infinity", nil
+		default:
+			return time.UnixMicro(pgEpoch.UnixMicro() + us).UTC(), nil
+		}
+	case OIDNumeric:
+		return parseBinaryNumeric(b)
+	case OIDJSONB:
+		if len(b) == 0 || b[0] != 1 {
+			return nil, fmt.Errorf("invalid binary jsonb")
+		}
+		return string(b[1:]), nil
+	}
+	return string(b), nil
+}
+
+// parseBinaryNumeric returns the text form of a binary numeric, see
+// appendBinaryNumeric
+func parseBinaryNumeric(b []byte) (string, error) {
+	if len(b) < 8 {
+		return "", fmt.Errorf("invalid binary numeric")
+	}
+	ndigits := int(binary.BigEndian.Uint16(b))
+	weight := int(int16(binary.BigEndian.Uint16(b[2:])))
+	sign := binary.BigEndian.Uint16(b[4:])
+	scale := int(binary.BigEndian.Uint16(b[6:]))
+	switch sign {
+	case 0xC000:
+		return "NaN", nil
+	case 0xD000:
+		return "Infinity", nil
+	case 0xF000:
+		return "-Infinity", nil
+	}
+	if len(b) != 8+2*ndigits {
+		return "", fmt.Errorf("invalid binary numeric")
+	}
+	digit := func(i int) uint16 {
+		if i < 0 || i >= ndigits {
+			return 0
+		}
+		return binary.BigEndian.Uint16(b[8+2*i:])
+	}
+
+	var s []byte
+	if sign == 0x4000 {
+		s = append(s, '-')
+	}
+	if weight < 0 {
+		s = append(s, '0')
+	}
+	for i := 0; i <= weight; i++ {
+		if i == 0 {
+			s = strconv.AppendUint(s, uint64(digit(i)), 10)
+		} else {
+			s = fmt.Appendf(s, "%04d", digit(i))
+		}
+	}
+	if scale > 0 {
+		var frac []byte
+		for i := weight + 1; len(frac) < scale; i++ {
+			frac = fmt.Appendf(frac, "%04d", digit(i))
+		}
+		s = append(append(s, '.'), frac[:scale]...)
+	}
+	return string(s), nil
+}
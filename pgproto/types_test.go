@@ -0,0 +1,109 @@
+package pgproto
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTypeOID(t *testing.T) {
+	if oid := TypeOID("int4"); oid != OIDInt4 {
+		t.Errorf("Expected int4, got %d", oid)
+	}
+	if oid := TypeOID("INTERVAL"); oid != OIDText {
+		t.Errorf("Expected unknown types as text, got %d", oid)
+	}
+	if f := TypeField("id", OIDInt8, FormatBinary); f.TypeSize != 8 || f.TypeModifier != -1 || f.Format != FormatBinary {
+		t.Errorf("Unexpected field %+v", f)
+	}
+}
+
+func TestAppendValue(t *testing.T) {
+	ts := time.Date(2000, 1, 2, 0, 0, 1, 0, time.UTC)
+	tests := []struct {
+		v      interface{}
+		oid    uint32
+		format int16
+		want   []byte
+	}{
+		{true, OIDBool, FormatText, []byte("t")},
+		{true, OIDBool, FormatBinary, []byte{1}},
+		{int64(-2), OIDInt2, FormatBinary, []byte{0xff, 0xfe}},
+		{int64(7), OIDInt4, FormatBinary, []byte{0, 0, 0, 7}},
+		{[]byte("7"), OIDInt8, FormatBinary, []byte{0, 0, 0, 0, 0, 0, 0, 7}},
+		{float64(1.5), OIDFloat8, FormatText, []byte("1.5")},
+		{[]byte{0xde, 0xad}, OIDBytea, FormatText, []byte(`\xdead`)},
+		{[]byte{0xde, 0xad}, OIDBytea, FormatBinary, []byte{0xde, 0xad}},
+		{ts, OIDTimestamp, FormatText, []byte("2000-01-02 00:00:01")},
+		{ts, OIDTimestampTZ, FormatBinary, []byte{0, 0, 0, 0x14, 0x1d, 0xe6, 0xa2, 0x40}},
+		{ts, OIDDate, FormatBinary, []byte{0, 0, 0, 1}},
+		{[]byte("-12345.6"), OIDNumeric, FormatBinary, []byte{0, 3, 0, 1, 0x40, 0, 0, 1, 0, 1, 0x09, 0x29, 0x17, 0x70}},
+		{[]byte("0"), OIDNumeric, FormatBinary, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{[]byte(`{"a":1}`), OIDJSONB, FormatBinary, []byte("\x01{\"a\":1}")},
+		{[]byte("5 days"), OIDText, FormatBinary, []byte("5 days")},
+	}
+	for _, tt := range tests {
+		got, err := AppendValue(nil, tt.v, tt.oid, tt.format)
+		if err != nil {
+			t.Errorf("AppendValue(%v, %d, %d) failed: %v", tt.v, tt.oid, tt.format, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("AppendValue(%v, %d, %d) = %v, want %v", tt.v, tt.oid, tt.format, got, tt.want)
+		}
+	}
+
+	if _, err := AppendValue(nil, "x", OIDInt4, FormatBinary); err == nil {
+		t.Error("Expected an error for a malformed int4")
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	ts := time.Date(2024, 2, 29, 12, 30, 0, 500000000, time.UTC)
+	tests := []struct {
+		v   interface{}
+		oid uint32
+	}{
+		{true, OIDBool},
+		{int64(-2), OIDInt2},
+		{int64(-70000), OIDInt4},
+		{int64(1) << 40, OIDInt8},
+		{float64(1.5), OIDFloat4},
+		{float64(-0.1), OIDFloat8},
+		{[]byte{0xde, 0xad}, OIDBytea},
+		{"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", OIDUUID},
+		{time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), OIDDate},
+		{ts, OIDTimestamp},
+		{ts, OIDTimestampTZ},
+		{"-12345.6", OIDNumeric},
+		{"0.0001", OIDNumeric},
+		{"10000", OIDNumeric},
+		{`{"a":1}`, OIDJSONB},
+		{"5 days", OIDText},
+	}
+	for _, tt := range tests {
+		b, err := AppendValue(nil, tt.v, tt.oid, FormatBinary)
+		if err != nil {
+			t.Fatalf("AppendValue(%v, %d) failed: %v", tt.v, tt.oid, err)
+		}
+		got, err := ParseValue(b, tt.oid, FormatBinary)
+		if err != nil {
+			t.Errorf("ParseValue(%v, %d) failed: %v", b, tt.oid, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.v) {
+			t.Errorf("ParseValue(%v, %d) = %v, want %v", b, tt.oid, got, tt.v)
+		}
+	}
+
+	if v, _ := ParseValue([]byte("42"), OIDInt4, FormatText); v != "42" {
+		t.Errorf("Expected a text value as string, got %v", v)
+	}
+	if v, _ := ParseValue(nil, OIDInt4, FormatBinary); v != nil {
+		t.Errorf("Expected NULL as nil, got %v", v)
+	}
+	if _, err := ParseValue([]byte{0, 1}, OIDInt4, FormatBinary); err == nil {
+		t.Error("Expected an error for a short int4")
+	}
+}
@@ -0,0 +1,70 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/acl"
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+func TestHandleQueryReadOnlyUser(t *testing.T) {
+	queries := 0
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries++
+		return readyIdle.Encode(pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil))
+	})
+	state.user = "report"
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c, rules: acl.New(acl.Config{ReadOnlyUsers: []string{"report"}})}
+
+	conn := newMockConn()
+	p.handleQuery(pgproto.Query{String: "DELETE FROM users"}.Encode(nil)[5:], conn, state)
+	if types := messageTypes(t, conn); types != "EZ" {
+		t.Errorf("Expected an ErrorResponse and ReadyForQuery, got %q", types)
+	}
+	if queries != 0 {
+		t.Errorf("Expected the write not to reach the backend, got %d queries", queries)
+	}
+
+	conn = newMockConn()
+	p.handleQuery(pgproto.Query{String: "SELECT * FROM users"}.Encode(nil)[5:], conn, state)
+	if types := messageTypes(t, conn); types != "CZ" {
+		t.Errorf("Expected the backend response to a read, got %q", types)
+	}
+}
+
+func TestHandleQueryReplicaDatabase(t *testing.T) {
+	queries := 0
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries++
+		return readyIdle.Encode(pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil))
+	})
+	state.database, state.replicaDB, state.primaryName = "shop_ro", true, "replicas[0]"
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	conn := newMockConn()
+	p.handleQuery(pgproto.Query{String: "UPDATE users SET name = 'x'"}.Encode(nil)[5:], conn, state)
+	if types := messageTypes(t, conn); types != "EZ" {
+		t.Errorf("Expected an ErrorResponse and ReadyForQuery, got %q", types)
+	}
+	if queries != 0 {
+		t.Errorf("Expected the write not to reach the backend, got %d queries", queries)
+	}
+
+	conn = newMockConn()
+	p.handleQuery(pgproto.Query{String: "SELECT * FROM users"}.Encode(nil)[5:], conn, state)
+	if types := messageTypes(t, conn); types != "CZ" {
+		t.Errorf("Expected the backend response to a read, got %q", types)
+	}
+	if state.lastBackend != "replicas[0]" {
+		t.Errorf("Expected the read on the replica of the session, got %s", state.lastBackend)
+	}
+}
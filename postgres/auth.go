@@ -0,0 +1,276 @@
+package postgres
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// Client authentication methods
+const (
+	authCleartext = "cleartext"
+	authMD5       = "md5"
+	authSCRAM     = "scram-sha-256"
+)
+
+// scramIterations is the PBKDF2 iteration count offered to clients, the
+// PostgreSQL default
+const scramIterations = 4096
+
+// errAuthFailed is returned when a client sent a wrong password
+var errAuthFailed = errors.New("password authentication failed")
+
+// loadAuthFile reads a user list in the PgBouncer userlist.txt format: one
+// "user" "password" pair per line, lines starting with ';' or '#' are comments
+func loadAuthFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		fields, err := splitQuoted(line)
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"user\" \"password\"", path, n)
+		}
+		users[fields[0]] = fields[1]
+	}
+	return users, scanner.Err()
+}
+
+// splitQuoted splits a line of double-quoted fields, where "" is an escaped
+// double quote
+func splitQuoted(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] != '"' {
+			return nil, errors.New("field is not quoted")
+		}
+		var field strings.Builder
+		i := 1
+		for {
+			if i >= len(line) {
+				return nil, errors.New("unterminated quote")
+			}
+			if line[i] == '"' {
+				if i+1 < len(line) && line[i+1] == '"' {
+					field.WriteByte('"')
+					i += 2
+					continue
+				}
+				break
+			}
+			field.WriteByte(line[i])
+			i++
+		}
+		fields = append(fields, field.String())
+		line = line[i+1:]
+	}
+}
+
+// authenticate authenticates the client with the configured method and
+// returns the password to connect to the backend with. With cleartext the
+// client's password is passed through, with md5 and scram-sha-256 the client
+// is verified against the password from the auth file. AuthenticationOk is
+// sent by the caller once the backend accepted the password.
+func (p *Proxy) authenticate(client net.Conn, user string) (string, error) {
+	p.mu.RLock()
+	method := p.config.Auth
+	password, known := p.users[user]
+	p.mu.RUnlock()
+
+	switch method {
+	case authMD5, authSCRAM:
+		if !known {
+			// Run the exchange with a random password, so that unknown
+			// users cannot be told apart from wrong passwords
+			password = randomString(18)
+		}
+		var err error
+		if method == authMD5 {
+			err = p.authMD5(client, user, password)
+		} else {
+			err = p.authSCRAM(client, password)
+		}
+		if err == nil && !known {
+			err = errAuthFailed
+		}
+		return password, err
+	default:
+		return p.authCleartext(client)
+	}
+}
+
+// authCleartext requests the password in cleartext
+func (p *Proxy) authCleartext(client net.Conn) (string, error) {
+	p.send(client, pgproto.Authentication{Type: pgproto.AuthCleartextPassword})
+	payload, err := p.readPasswordMessage(client)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(payload), "\x00"), nil
+}
+
+// authMD5 verifies the salted MD5 hash of the password sent by the client
+func (p *Proxy) authMD5(client net.Conn, user, password string) error {
+	salt := make([]byte, 4)
+	rand.Read(salt)
+	p.send(client, pgproto.Authentication{Type: pgproto.AuthMD5Password, Data: salt})
+
+	payload, err := p.readPasswordMessage(client)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSuffix(string(payload), "\x00")), []byte(md5Password(user, password, salt))) != 1 {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// md5Password returns the MD5 response to a salt: "md5" followed by
+// md5(md5(password + user) + salt) in hex
+func md5Password(user, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// authSCRAM runs a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677) without
+// channel binding, as PostgreSQL does for connections without TLS
+func (p *Proxy) authSCRAM(client net.Conn, password string) error {
+	p.send(client, pgproto.Authentication{Type: pgproto.AuthSASL, Data: []byte("SCRAM-SHA-256\x00\x00")})
+
+	// SASLInitialResponse: mechanism and client-first-message
+	payload, err := p.readPasswordMessage(client)
+	if err != nil {
+		return err
+	}
+	var initial pgproto.SASLInitialResponse
+	if err := initial.Decode(payload); err != nil || initial.Mechanism != "SCRAM-SHA-256" {
+		return errors.New("unsupported SASL mechanism")
+	}
+	if initial.Data == nil {
+		return errors.New("malformed SASL initial response")
+	}
+	clientFirst := string(initial.Data)
+
+	// The GS2 header must not request channel binding; the user name in the
+	// message is ignored, as in PostgreSQL
+	var gs2Header string
+	switch {
+	case strings.HasPrefix(clientFirst, "n,,"), strings.HasPrefix(clientFirst, "y,,"):
+		gs2Header = clientFirst[:3]
+	default:
+		return errors.New("SCRAM channel binding is not supported")
+	}
+	clientFirstBare := clientFirst[3:]
+	clientNonce := scramAttribute(clientFirstBare, 'r')
+	if clientNonce == "" {
+		return errors.New("malformed SCRAM client-first-message")
+	}
+
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	nonce := clientNonce + randomString(18)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), scramIterations)
+	p.send(client, pgproto.Authentication{Type: pgproto.AuthSASLContinue, Data: []byte(serverFirst)})
+
+	// SASLResponse: client-final-message
+	payload, err = p.readPasswordMessage(client)
+	if err != nil {
+		return err
+	}
+	clientFinal := string(payload)
+	withoutProof, proofAttr, ok := strings.Cut(clientFinal, ",p=")
+	if !ok {
+		return errors.New("malformed SCRAM client-final-message")
+	}
+	if scramAttribute(withoutProof, 'c') != base64.StdEncoding.EncodeToString([]byte(gs2Header)) ||
+		scramAttribute(withoutProof, 'r') != nonce {
+		return errors.New("SCRAM channel binding or nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(proofAttr)
+	if err != nil || len(proof) != sha256.Size {
+		return errors.New("malformed SCRAM proof")
+	}
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, scramIterations, sha256.Size)
+	if err != nil {
+		return err
+	}
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	if proofKey := sha256.Sum256(proof); subtle.ConstantTimeCompare(proofKey[:], storedKey[:]) != 1 {
+		return errAuthFailed
+	}
+
+	serverSignature := hmacSHA256(hmacSHA256(saltedPassword, "Server Key"), authMessage)
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+	p.send(client, pgproto.Authentication{Type: pgproto.AuthSASLFinal, Data: []byte(serverFinal)})
+	return nil
+}
+
+// readPasswordMessage reads a PasswordMessage (also used for SASL responses)
+func (p *Proxy) readPasswordMessage(client net.Conn) ([]byte, error) {
+	msgType, payload, err := pgproto.ReadMessage(client)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != pgproto.MsgPassword {
+		return nil, fmt.Errorf("expected password message, got %c", msgType)
+	}
+	return payload, nil
+}
+
+// scramAttribute returns the value of an attribute (such as r=) in a
+// comma-separated SCRAM message
+func scramAttribute(msg string, name byte) string {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// randomString returns n random bytes encoded as base64, for nonces
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
@@ -0,0 +1,114 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// startAuthServer accepts connections, authenticates them with p and then
+// answers every simple query with an empty result
+func startAuthServer(t *testing.T, p *Proxy) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := pgproto.ReadStartupMessage(conn); err != nil {
+					return
+				}
+				if _, err := p.authenticate(conn, "app"); err != nil {
+					p.sendFatalError(conn, "28P01", err.Error())
+					return
+				}
+				p.send(conn, pgproto.Authentication{Type: pgproto.AuthOK}, readyIdle)
+				for {
+					msgType, _, err := pgproto.ReadMessage(conn)
+					if err != nil || msgType == pgproto.MsgTerminate {
+						return
+					}
+					p.send(conn, pgproto.EmptyQueryResponse{}, readyIdle)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, method := range []string{authCleartext, authMD5, authSCRAM} {
+		for _, password := range []string{"s3cret pass", "wrong"} {
+			t.Run(fmt.Sprintf("%s/%s", method, password), func(t *testing.T) {
+				p := &Proxy{
+					config: config.ProxyConfig{Auth: method},
+					users:  map[string]string{"app": "s3cret pass"},
+				}
+				host, port, _ := net.SplitHostPort(startAuthServer(t, p))
+				db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=app password=%s dbname=app sslmode=disable",
+					host, port, dsnQuote(password)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer db.Close()
+
+				// Cleartext passes any password on to the backend
+				wantOK := method == authCleartext || password == "s3cret pass"
+				if err := db.Ping(); (err == nil) != wantOK {
+					t.Errorf("Ping() error = %v, want ok = %v", err, wantOK)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthenticate_UnknownUser(t *testing.T) {
+	p := &Proxy{config: config.ProxyConfig{Auth: authSCRAM}}
+	host, port, _ := net.SplitHostPort(startAuthServer(t, p))
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%s user=app password=x dbname=app sslmode=disable", host, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err == nil {
+		t.Error("Expected an unknown user to be rejected")
+	}
+}
+
+func TestLoadAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "userlist.txt")
+	content := "; comment\n\"app\" \"s3cret\"\n\n\"quote\" \"a\"\"b\"\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := loadAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"app": "s3cret", "quote": `a"b`}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("loadAuthFile() = %v, want %v", users, want)
+	}
+
+	if err := os.WriteFile(path, []byte("app s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAuthFile(path); err == nil {
+		t.Error("Expected an error for unquoted fields")
+	}
+}
@@ -0,0 +1,703 @@
+package postgres
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/spill"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
+	"github.com/mevdschee/tqdbproxy/watch"
+)
+
+// copyFlushSize is the amount of a COPY response that is buffered before it
+// is written to the client
+const copyFlushSize = 64 * 1024
+
+// backendConn is a connection to a PostgreSQL backend, on which the proxy
+// speaks the wire protocol on behalf of a client session. Responses are
+// passed on as the backend sent them, so that clients get the column types
+// and result formats of the backend.
+type backendConn struct {
+	net.Conn
+	r        *bufio.Reader
+	addr     string
+	txStatus byte                   // Transaction status of the last ReadyForQuery
+	params   map[string]string      // Run-time parameters reported at startup
+	key      pgproto.BackendKeyData // Identifies the backend session in cancel requests
+	settings uint64                 // Version of the session settings it has, see restoreSettings
+}
+
+func newBackendConn(conn net.Conn, addr string) *backendConn {
+	return &backendConn{
+		Conn:     conn,
+		r:        bufio.NewReader(conn),
+		addr:     addr,
+		txStatus: pgproto.TxIdle,
+		params:   make(map[string]string),
+	}
+}
+
+// backendNetwork returns the network and address to dial for a backend
+// address in the pool notation. A Unix socket address names the socket
+// directory, as the host parameter of libpq does.
+func backendNetwork(addr string) (string, string) {
+	if dir, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", filepath.Join(dir, ".s.PGSQL.5432")
+	}
+	if addr == "" {
+		return "tcp", "127.0.0.1:5432"
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "tcp", net.JoinHostPort(addr, "5432")
+	}
+	return "tcp", addr
+}
+
+// backendTLS returns the TLS configuration for connections to addr, or nil
+// when the backend does not use TLS. Unix sockets never use TLS.
+func (p *Proxy) backendTLS(addr string) (*tls.Config, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return nil, nil
+	}
+	p.mu.RLock()
+	settings := backendTLSConfig(p.config, addr)
+	p.mu.RUnlock()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return tlsopt.Client(settings.Mode, host, settings.CAFile, settings.CertFile, settings.KeyFile)
+}
+
+// dialBackend connects to the backend at addr and starts a session with the
+// startup parameters of the client (including user and database),
+// authenticating with password. Errors reported by the backend are returned
+// as pgproto.ErrorResponse.
+func (p *Proxy) dialBackend(addr string, params map[string]string, password string) (*backendConn, error) {
+	tlsConfig, err := p.backendTLS(addr)
+	if err != nil {
+		return nil, err
+	}
+	network, address := backendNetwork(addr)
+	conn, err := p.connLimiter.DialKey(context.Background(), addr, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		if conn, err = startTLS(conn, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	b := newBackendConn(conn, addr)
+	if err := b.startup(params, password); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// startTLS requests TLS with an SSLRequest and runs the handshake. The
+// connection is closed on errors.
+func startTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	if _, err := conn.Write(pgproto.StartupMessage{ProtocolVersion: pgproto.SSLRequestCode}.Encode(nil)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		conn.Close()
+		return nil, errors.New("backend does not support TLS")
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// startup sends the startup message and authenticates, up to the first
+// ReadyForQuery
+func (b *backendConn) startup(params map[string]string, password string) error {
+	if err := b.send(pgproto.StartupMessage{ProtocolVersion: pgproto.ProtocolVersion3, Params: params}); err != nil {
+		return err
+	}
+	for {
+		msgType, payload, err := b.readMessage()
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case pgproto.MsgAuthentication:
+			var auth pgproto.Authentication
+			if err := auth.Decode(payload); err != nil {
+				return err
+			}
+			if err := b.authenticate(auth, params["user"], password); err != nil {
+				return err
+			}
+		case pgproto.MsgParameterStatus:
+			var status pgproto.ParameterStatus
+			if err := status.Decode(payload); err != nil {
+				return err
+			}
+			b.params[status.Name] = status.Value
+		case pgproto.MsgBackendKeyData:
+			if err := b.key.Decode(payload); err != nil {
+				return err
+			}
+		case pgproto.MsgReadyForQuery:
+			var ready pgproto.ReadyForQuery
+			if err := ready.Decode(payload); err != nil {
+				return err
+			}
+			b.txStatus = ready.TxStatus
+			return nil
+		}
+	}
+}
+
+// authenticate answers an authentication request of the backend
+func (b *backendConn) authenticate(auth pgproto.Authentication, user, password string) error {
+	switch auth.Type {
+	case pgproto.AuthOK:
+		return nil
+	case pgproto.AuthCleartextPassword:
+		return b.send(pgproto.PasswordMessage{Password: password})
+	case pgproto.AuthMD5Password:
+		if len(auth.Data) < 4 {
+			return errors.New("malformed MD5 authentication request")
+		}
+		return b.send(pgproto.PasswordMessage{Password: md5Password(user, password, auth.Data[:4])})
+	case pgproto.AuthSASL:
+		return b.authSCRAM(auth.Data, password)
+	}
+	return fmt.Errorf("backend requested unsupported authentication method %d", auth.Type)
+}
+
+// authSCRAM runs the client side of a SCRAM-SHA-256 exchange without channel
+// binding, the counterpart of Proxy.authSCRAM
+func (b *backendConn) authSCRAM(mechanisms []byte, password string) error {
+	if !slices.Contains(strings.Split(string(mechanisms), "\x00"), "SCRAM-SHA-256") {
+		return errors.New("backend offered no supported SASL mechanism")
+	}
+	clientNonce := randomString(18)
+	clientFirstBare := "n=,r=" + clientNonce
+	if err := b.send(pgproto.SASLInitialResponse{Mechanism: "SCRAM-SHA-256", Data: []byte("n,," + clientFirstBare)}); err != nil {
+		return err
+	}
+
+	serverFirst, err := b.readSASL(pgproto.AuthSASLContinue)
+	if err != nil {
+		return err
+	}
+	nonce := scramAttribute(serverFirst, 'r')
+	salt, saltErr := base64.StdEncoding.DecodeString(scramAttribute(serverFirst, 's'))
+	iterations, iterErr := strconv.Atoi(scramAttribute(serverFirst, 'i'))
+	if !strings.HasPrefix(nonce, clientNonce) || saltErr != nil || iterErr != nil || iterations < 1 {
+		return errors.New("malformed SCRAM server-first-message")
+	}
+
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return err
+	}
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	if err := b.send(pgproto.SASLResponse{Data: []byte(clientFinal)}); err != nil {
+		return err
+	}
+
+	serverFinal, err := b.readSASL(pgproto.AuthSASLFinal)
+	if err != nil {
+		return err
+	}
+	serverSignature := hmacSHA256(hmacSHA256(saltedPassword, "Server Key"), authMessage)
+	if scramAttribute(serverFinal, 'v') != base64.StdEncoding.EncodeToString(serverSignature) {
+		return errors.New("SCRAM server signature mismatch")
+	}
+	return nil
+}
+
+// readSASL reads an authentication message of the given SASL type and
+// returns its data
+func (b *backendConn) readSASL(authType uint32) (string, error) {
+	msgType, payload, err := b.readMessage()
+	if err != nil {
+		return "", err
+	}
+	var auth pgproto.Authentication
+	if msgType != pgproto.MsgAuthentication || auth.Decode(payload) != nil || auth.Type != authType {
+		return "", fmt.Errorf("expected SASL authentication message %d, got %c", authType, msgType)
+	}
+	return string(auth.Data), nil
+}
+
+// readMessage reads a message of the backend, returning an ErrorResponse as
+// error
+func (b *backendConn) readMessage() (byte, []byte, error) {
+	msgType, payload, err := pgproto.ReadMessage(b.r)
+	if err == nil && msgType == pgproto.MsgErrorResponse {
+		var e pgproto.ErrorResponse
+		if err := e.Decode(payload); err != nil {
+			return 0, nil, err
+		}
+		return msgType, payload, e
+	}
+	return msgType, payload, err
+}
+
+// send writes messages to the backend in a single write
+func (b *backendConn) send(msgs ...pgproto.Encoder) error {
+	var buf []byte
+	for _, m := range msgs {
+		buf = m.Encode(buf)
+	}
+	_, err := b.Write(buf)
+	return err
+}
+
+// terminate ends the backend session and closes the connection
+func (b *backendConn) terminate() {
+	b.send(pgproto.Terminate{})
+	b.Close()
+}
+
+// exchange sends messages to the backend and reads the response up to and
+// including ReadyForQuery. In extended mode the messages end with Sync, and
+// ParseComplete, BindComplete and ReadyForQuery are left out of the
+// response, as the proxy answers those client messages itself.
+//
+// COPY FROM STDIN data is relayed from the client. Once a COPY started, the
+// response is written to the client as it arrives instead of being returned,
+// so that COPY data is not held in memory. A client that disconnects while
+// the proxy waits closes the backend connection and yields
+// watch.ErrClientAborted.
+//
+// With a spill buffer the response is written to it instead. A response that
+// outgrew the spill threshold is sent to the client from the buffer once it
+// is complete, and nil is returned.
+func (b *backendConn) exchange(client net.Conn, msgs []byte, extended bool, spilled *spill.Buffer) ([]byte, error) {
+	if _, err := b.Write(msgs); err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	streaming := false
+	stop := watchClient(client, func() { b.Close() })
+	for {
+		msgType, payload, err := pgproto.ReadMessage(b.r)
+		if err != nil {
+			if stop() {
+				return nil, watch.ErrClientAborted
+			}
+			return nil, err
+		}
+
+		switch msgType {
+		case pgproto.MsgReadyForQuery:
+			if len(payload) > 0 {
+				b.txStatus = payload[0]
+			}
+		case pgproto.MsgCopyInResponse, pgproto.MsgCopyOutResponse:
+			streaming = true
+			if spilled != nil {
+				// COPY is streamed, after the response read before it
+				if _, err := io.Copy(client, spilled.Reader()); err != nil {
+					stop()
+					return nil, err
+				}
+				spilled = nil
+			}
+		}
+		switch {
+		case extended && (msgType == pgproto.MsgParseComplete || msgType == pgproto.MsgBindComplete || msgType == pgproto.MsgReadyForQuery):
+		case spilled != nil:
+			response = pgproto.AppendMessage(response[:0], msgType, payload)
+			if _, err := spilled.Write(response); err != nil {
+				stop()
+				return nil, err
+			}
+			response = response[:0]
+		default:
+			response = pgproto.AppendMessage(response, msgType, payload)
+		}
+
+		done := msgType == pgproto.MsgReadyForQuery
+		if streaming && (done || msgType == pgproto.MsgCopyInResponse || len(response) >= copyFlushSize) {
+			if _, err := client.Write(response); err != nil {
+				stop()
+				return nil, err
+			}
+			response = response[:0]
+		}
+		if msgType == pgproto.MsgCopyInResponse {
+			// The client is read while relaying, so it is not watched
+			if stop() {
+				return nil, watch.ErrClientAborted
+			}
+			if err := b.relayCopyIn(client, extended); err != nil {
+				return nil, err
+			}
+			stop = watchClient(client, func() { b.Close() })
+		}
+		if done {
+			if stop() {
+				return nil, watch.ErrClientAborted
+			}
+			if streaming {
+				return nil, nil
+			}
+			if spilled == nil {
+				return response, nil
+			}
+			if !spilled.Spilled() {
+				return spilled.Bytes(), nil
+			}
+			_, err := io.Copy(client, spilled.Reader())
+			return nil, err
+		}
+	}
+}
+
+// relayCopyIn forwards the COPY data of the client to the backend, up to and
+// including CopyDone or CopyFail. In extended mode the backend ignored the
+// Sync sent with the Execute, so another Sync follows.
+func (b *backendConn) relayCopyIn(client net.Conn, extended bool) error {
+	for {
+		msgType, payload, err := pgproto.ReadMessage(client)
+		if err != nil {
+			return err
+		}
+		msg := pgproto.AppendMessage(nil, msgType, payload)
+		done := msgType == pgproto.MsgCopyDone || msgType == pgproto.MsgCopyFail
+		if done && extended {
+			msg = pgproto.Sync{}.Encode(msg)
+		}
+		if _, err := b.Write(msg); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// portalMessages returns the messages that recreate a portal of the client as
+// the unnamed statement and portal of the backend, followed by more messages
+// and Sync
+func portalMessages(query string, paramOIDs []uint32, bind pgproto.Bind, more ...pgproto.Encoder) []byte {
+	bind.Portal, bind.Statement = "", ""
+	msgs := pgproto.Parse{Query: query, ParamOIDs: paramOIDs}.Encode(nil)
+	msgs = bind.Encode(msgs)
+	for _, m := range more {
+		msgs = m.Encode(msgs)
+	}
+	return pgproto.Sync{}.Encode(msgs)
+}
+
+// responseError returns the first ErrorResponse of a backend response, or nil
+func responseError(response []byte) error {
+	msgs, _ := pgproto.SplitMessages(response)
+	for _, m := range msgs {
+		if m.Type == pgproto.MsgErrorResponse {
+			var e pgproto.ErrorResponse
+			e.Decode(m.Payload)
+			return e
+		}
+	}
+	return nil
+}
+
+// deterministicError reports whether an error of a SELECT repeats until the
+// schema, the data or the privileges change, which negative caching may
+// store: a data exception (class 22) or a syntax error or access rule
+// violation (class 42)
+func deterministicError(err error) bool {
+	var e pgproto.ErrorResponse
+	return errors.As(err, &e) && (strings.HasPrefix(e.Code, "22") || strings.HasPrefix(e.Code, "42"))
+}
+
+// cacheTTL returns the ttl a response of a cacheable SELECT is cached with
+// (0 = not cached): the negative ttl, when set, for results without rows and,
+// with cacheErrors, for deterministic errors, otherwise the ttl for results
+// and 0 for errors
+func cacheTTL(response []byte, ttl, negTTL time.Duration, cacheErrors bool) time.Duration {
+	if err := responseError(response); err != nil {
+		if !cacheErrors || !deterministicError(err) {
+			return 0
+		}
+		return negTTL
+	}
+	if negTTL > 0 && affectedRows(response) == 0 {
+		return negTTL
+	}
+	return ttl
+}
+
+// negativeTTL returns the ttl of the empty results and deterministic errors
+// of a SELECT: that of its negcache hint, or cache_negative_ttl when it only
+// has a ttl hint
+func (p *Proxy) negativeTTL(parsed *parser.ParsedQuery) time.Duration {
+	if parsed.NegTTL > 0 || parsed.TTL <= 0 {
+		return time.Duration(parsed.NegTTL) * time.Second
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return time.Duration(p.config.CacheNegativeTTL) * time.Second
+}
+
+// affectedRows returns the rows affected by a statement from the tag of the
+// last CommandComplete in its response, or -1 when the tag has no count
+func affectedRows(response []byte) int64 {
+	msgs, _ := pgproto.SplitMessages(response)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Type != pgproto.MsgCommandComplete {
+			continue
+		}
+		var cc pgproto.CommandComplete
+		if cc.Decode(msgs[i].Payload) != nil {
+			return -1
+		}
+		n, err := strconv.ParseInt(cc.Tag[strings.LastIndexByte(cc.Tag, ' ')+1:], 10, 64)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	return -1
+}
+
+// backend returns the connection of the session to the backend at addr,
+// connecting when needed
+func (p *Proxy) backend(state *connState, addr string) (*backendConn, error) {
+	if b := state.backends[addr]; b != nil {
+		restoreSettings(state, b)
+		return b, nil
+	}
+	b, err := p.dialBackend(addr, state.params, state.password)
+	if err != nil {
+		return nil, err
+	}
+	if state.backends == nil {
+		state.backends = make(map[string]*backendConn)
+	}
+	state.backends[addr] = b
+	state.cancel.add(addr, b.key)
+	restoreSettings(state, b)
+	return b, nil
+}
+
+// closeBackends ends the backend sessions of a client session
+func closeBackends(state *connState) {
+	state.listener.close()
+	for addr, b := range state.backends {
+		b.terminate()
+		delete(state.backends, addr)
+	}
+}
+
+// ready returns the ReadyForQuery message with the transaction status of the
+// session on the primary
+func ready(state *connState) pgproto.ReadyForQuery {
+	if b := state.backends[state.primaryAddr]; b != nil {
+		return pgproto.ReadyForQuery{TxStatus: b.txStatus}
+	}
+	return readyIdle
+}
+
+// queryBackend sends messages to a replica (for cacheable queries, or SELECTs
+// with read splitting, outside of a transaction) or to the primary and
+// returns the response, see exchange. A response that outgrows the spill
+// threshold is sent to the client from its spill file, and nil is returned.
+// When the backend connection fails, a SELECT outside of a transaction is
+// retried up to read_retries times, on another healthy replica or on the
+// primary.
+func (p *Proxy) queryBackend(client net.Conn, state *connState, parsed *parser.ParsedQuery, msgs []byte, extended bool) ([]byte, string, error) {
+	pool, err := p.routePool(state, parsed)
+	if err != nil {
+		return nil, "", err
+	}
+	if pool == nil {
+		pool = state.pool
+	}
+	if state.snapshot != "" && state.backends[state.snapshot] == nil {
+		return nil, "", errSnapshotLost
+	}
+	retries := 0
+	if parsed.Type == parser.QuerySelect && !state.inTransaction {
+		retries = p.readRetries()
+	}
+
+	for attempt := 0; ; attempt++ {
+		addr, backendName := p.selectBackend(state, parsed)
+		response, err := p.queryOn(client, state, addr, msgs, extended, p.newSpill())
+		if err == nil && (parsed.IsWritable() || parsed.IsDDL()) {
+			state.lastWrite = time.Now()
+		}
+		if err == nil {
+			trackSettings(state, addr, parsed.Query, response)
+		}
+		if err == nil || attempt >= retries || !isBackendConnError(err) {
+			return response, backendName, err
+		}
+
+		// The failed replica is skipped until the next health check passes
+		if backendName != "primary" {
+			pool.MarkUnhealthy(addr)
+		}
+		metrics.ReadRetries.WithLabelValues(backendName).Inc()
+		log.Printf("[PostgreSQL] Read on %s (%s) failed, retrying (%d/%d): %v", backendName, addr, attempt+1, retries, err)
+	}
+}
+
+// selectBackend returns the address and name of the backend to run a query on
+func (p *Proxy) selectBackend(state *connState, parsed *parser.ParsedQuery) (string, string) {
+	if state.snapshot != "" {
+		return state.snapshot, state.snapshotName
+	}
+	pool := state.pool
+	if routed, _ := p.routePool(state, parsed); routed != nil {
+		// A route hint runs on the primary of its backend
+		if parsed.RouteBackend() != "" {
+			return routed.GetPrimary(), "primary"
+		}
+		pool = routed
+	}
+	// A route hint forces a replica for a SELECT, or the primary
+	toReplica := parsed.IsCacheable() || p.splitRead(state, parsed)
+	if parsed.Route != "" {
+		toReplica = parsed.Route == parser.RouteReplica && parsed.Type == parser.QuerySelect
+	}
+	if state.inTransaction || !toReplica {
+		return p.primaryAddr(state, parsed), primaryName(state, pool)
+	}
+	addr, name := pool.GetReplicaMaxLag(time.Duration(parsed.MaxLagMs) * time.Millisecond)
+	if name == "primary" {
+		return p.primaryAddr(state, parsed), primaryName(state, pool)
+	}
+	return addr, name
+}
+
+// primaryAddr returns the address of the primary a statement runs on: the
+// primary of the backend of its route hint or its tables, or else the
+// primary of the session
+func (p *Proxy) primaryAddr(state *connState, parsed *parser.ParsedQuery) string {
+	if pool, _ := p.routePool(state, parsed); pool != nil && pool != state.pool {
+		return pool.GetPrimary()
+	}
+	return state.primaryAddr
+}
+
+// primaryName returns the name of the primary of a pool, which is a replica
+// for the pool of a replica database session
+func primaryName(state *connState, pool *replica.Pool) string {
+	if pool == state.pool && state.primaryName != "" {
+		return state.primaryName
+	}
+	return "primary"
+}
+
+// primaryBackend returns the address and name of the backend the session
+// connected to, which is a replica for a replica database
+func primaryBackend(state *connState) (string, string) {
+	if state.primaryName != "" {
+		return state.primaryAddr, state.primaryName
+	}
+	return state.primaryAddr, "primary"
+}
+
+// routePool returns the pool of the backend named by a route hint, or else
+// the pool of the backend of the tables of the query, or nil when the query
+// has no such hint or routed tables, or runs in a transaction. A statement
+// with a route hint runs on the primary of that backend.
+func (p *Proxy) routePool(state *connState, parsed *parser.ParsedQuery) (*replica.Pool, error) {
+	if state.inTransaction {
+		return nil, nil
+	}
+	p.mu.RLock()
+	name := parsed.RouteBackend()
+	if name == "" {
+		name, _ = p.config.RouteTables(parsed.Tables)
+	}
+	pool := p.pools[name]
+	rules := p.rules
+	p.mu.RUnlock()
+	if name == "" {
+		return nil, nil
+	}
+	if pool == nil {
+		return nil, fmt.Errorf("unknown backend %q in route", name)
+	}
+	if err := rules.CheckShard(state.user, name); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// queryOn sends messages to the backend at addr and returns the response,
+// see exchange. A failed connection is closed, the next query on the backend
+// connects again.
+func (p *Proxy) queryOn(client net.Conn, state *connState, addr string, msgs []byte, extended bool, spilled *spill.Buffer) ([]byte, error) {
+	if spilled != nil {
+		defer spilled.Close()
+	}
+	b, err := p.backend(state, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Track reads on replicas, so draining a replica waits for them
+	if addr != state.primaryAddr {
+		defer state.pool.Track(addr)()
+	}
+
+	wasInTransaction := b.txStatus != pgproto.TxIdle
+	response, err := b.exchange(client, msgs, extended, spilled)
+	if err != nil {
+		b.Close()
+		delete(state.backends, addr)
+		state.cancel.remove(addr)
+		return nil, err
+	}
+	if wasInTransaction && b.txStatus == pgproto.TxIdle {
+		endTransaction(state, b, response)
+	}
+	if addr == state.primaryAddr {
+		inTransaction := b.txStatus != pgproto.TxIdle
+		if state.inTransaction && !inTransaction {
+			// The transaction ended, its writes are on the primary only
+			state.lastWrite = time.Now()
+		}
+		state.inTransaction = inTransaction
+	}
+	return response, nil
+}
@@ -0,0 +1,732 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/annotate"
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/limiter"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// scriptedConn is a mockConn that reads the messages of the client from in
+type scriptedConn struct {
+	*mockConn
+	in io.Reader
+}
+
+func (c scriptedConn) Read(b []byte) (int, error) { return c.in.Read(b) }
+
+// listenBackend accepts a connection on a local port and serves it with
+// serve, returning the address
+func listenBackend(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return listener.Addr().String()
+}
+
+// fakeBackendState returns a session whose primary is a fake backend that
+// answers each message with the response returned by respond
+func fakeBackendState(t *testing.T, respond func(msgType byte, payload []byte) []byte) *connState {
+	t.Helper()
+	addr := listenBackend(t, func(conn net.Conn) {
+		for {
+			msgType, payload, err := pgproto.ReadMessage(conn)
+			if err != nil || msgType == pgproto.MsgTerminate {
+				return
+			}
+			if response := respond(msgType, payload); response != nil {
+				if _, err := conn.Write(response); err != nil {
+					return
+				}
+			}
+		}
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &connState{
+		pool:               replica.NewPool(addr, nil),
+		primaryAddr:        addr,
+		backends:           map[string]*backendConn{addr: newBackendConn(conn, addr)},
+		preparedStatements: make(map[string]string),
+		paramOIDs:          make(map[string][]uint32),
+		boundParams:        make(map[string][]interface{}),
+		portalStatements:   make(map[string]string),
+		binds:              make(map[string]pgproto.Bind),
+	}
+}
+
+// messageTypes reads the messages written to conn and returns their types
+func messageTypes(t *testing.T, conn *mockConn) string {
+	t.Helper()
+	var types []byte
+	for conn.Len() > 0 {
+		msgType, _, err := pgproto.ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msgType)
+	}
+	return string(types)
+}
+
+func TestDialBackend(t *testing.T) {
+	for _, method := range []string{authCleartext, authMD5, authSCRAM} {
+		t.Run(method, func(t *testing.T) {
+			for _, password := range []string{"secret", "wrong"} {
+				server := &Proxy{}
+				addr := listenBackend(t, func(conn net.Conn) {
+					payload, err := pgproto.ReadStartupMessage(conn)
+					if err != nil {
+						return
+					}
+					var startup pgproto.StartupMessage
+					if startup.Decode(payload) != nil || startup.Params["user"] != "app" || startup.Params["application_name"] != "shop" {
+						server.sendFatalError(conn, "08P01", "unexpected startup parameters")
+						return
+					}
+					switch method {
+					case authCleartext:
+						var got string
+						if got, err = server.authCleartext(conn); err == nil && got != "secret" {
+							err = errAuthFailed
+						}
+					case authMD5:
+						err = server.authMD5(conn, "app", "secret")
+					case authSCRAM:
+						err = server.authSCRAM(conn, "secret")
+					}
+					if err != nil {
+						server.sendFatalError(conn, "28P01", "password authentication failed for user \"app\"")
+						return
+					}
+					server.send(conn,
+						pgproto.Authentication{Type: pgproto.AuthOK},
+						pgproto.ParameterStatus{Name: "server_version", Value: "16.4"},
+						pgproto.BackendKeyData{ProcessID: 42, SecretKey: 7},
+						readyIdle,
+					)
+				})
+
+				p := &Proxy{connLimiter: limiter.NewConnLimiter(nil, time.Second)}
+				b, err := p.dialBackend(addr, map[string]string{"user": "app", "database": "shop", "application_name": "shop"}, password)
+				if password == "wrong" {
+					var backendErr pgproto.ErrorResponse
+					if !errors.As(err, &backendErr) || backendErr.Code != "28P01" {
+						t.Errorf("Expected the backend's authentication error, got %v", err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("dialBackend() error = %v", err)
+				}
+				if b.params["server_version"] != "16.4" || b.key.ProcessID != 42 || b.txStatus != pgproto.TxIdle {
+					t.Errorf("Expected the session of the backend, got params %v, key %+v, status %c", b.params, b.key, b.txStatus)
+				}
+				b.terminate()
+			}
+		})
+	}
+}
+
+func TestHandleQueryForwardsBackendResponse(t *testing.T) {
+	queries := 0
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries++
+		field := pgproto.FieldDescription{Name: "id", TypeOID: pgproto.OIDInt4, TypeSize: 4, TypeModifier: -1}
+		response := pgproto.RowDescription{Fields: []pgproto.FieldDescription{field}}.Encode(nil)
+		response = pgproto.DataRow{Values: [][]byte{[]byte("1")}}.Encode(response)
+		response = pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response)
+		return readyIdle.Encode(response)
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	query := pgproto.Query{String: "/* ttl:60 */ SELECT id FROM users"}.Encode(nil)[5:]
+	var responses []string
+	for i := 0; i < 2; i++ {
+		conn := newMockConn()
+		p.handleQuery(query, conn, state)
+		responses = append(responses, conn.String())
+	}
+	if queries != 1 {
+		t.Errorf("Expected the second query to be served from the cache, the backend got %d queries", queries)
+	}
+	if responses[0] != responses[1] {
+		t.Errorf("Expected the cached response to equal the backend response")
+	}
+
+	msgType, payload, err := pgproto.ReadMessage(strings.NewReader(responses[0]))
+	var rowDesc pgproto.RowDescription
+	if err != nil || msgType != pgproto.MsgRowDescription || rowDesc.Decode(payload) != nil {
+		t.Fatalf("Expected a RowDescription, got %c (%v)", msgType, err)
+	}
+	if rowDesc.Fields[0].TypeOID != pgproto.OIDInt4 {
+		t.Errorf("Expected the column type of the backend, got OID %d", rowDesc.Fields[0].TypeOID)
+	}
+}
+
+func TestHandleQueryVerbose(t *testing.T) {
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		response := pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil)
+		return readyIdle.Encode(response)
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+	state.shard = "main"
+
+	p.handleQuery(pgproto.Query{String: "SET tqdb.verbose = on"}.Encode(nil)[5:], newMockConn(), state)
+	if !state.verbose {
+		t.Fatal("Expected SET tqdb.verbose = on to enable verbose mode")
+	}
+	query := pgproto.Query{String: "/* ttl:60 */ SELECT id FROM users"}.Encode(nil)[5:]
+	for _, expected := range []string{"tqdb: cache miss (ttl 1m0s), executed on primary of backend main", "tqdb: cache hit"} {
+		conn := newMockConn()
+		p.handleQuery(query, conn, state)
+		msgType, payload, err := pgproto.ReadMessage(strings.NewReader(conn.String()))
+		var notice pgproto.NoticeResponse
+		if err != nil || msgType != pgproto.MsgNoticeResponse || notice.Decode(payload) != nil {
+			t.Fatalf("Expected a NoticeResponse, got %c (%v)", msgType, err)
+		}
+		if notice.Severity != "NOTICE" || notice.Message != expected {
+			t.Errorf("Expected notice %q, got %+v", expected, notice)
+		}
+	}
+}
+
+func TestHandleQueryNegativeCache(t *testing.T) {
+	queries := map[string]int{}
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		query := strings.TrimRight(string(payload), "\x00")
+		queries[query]++
+		var response []byte
+		switch query {
+		case "SELECT * FROM missing":
+			response = pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: `relation "missing" does not exist`}.Encode(nil)
+		case "SELECT * FROM locked":
+			response = pgproto.ErrorResponse{Severity: "ERROR", Code: "55P03", Message: "could not obtain lock"}.Encode(nil)
+		case "SELECT id FROM users":
+			response = pgproto.DataRow{Values: [][]byte{[]byte("1")}}.Encode(nil)
+			response = pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response)
+		default:
+			response = pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil)
+		}
+		return readyIdle.Encode(response)
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	tests := []struct {
+		query   string
+		backend int // Queries reaching the backend out of 2
+	}{
+		{"/* negcache:60 */ SELECT * FROM missing", 1},
+		{"/* negcache:60 */ SELECT * FROM locked", 2},
+		{"/* negcache:60 */ SELECT id FROM users", 2},
+		{"/* negcache:60 */ SELECT id FROM empty", 1},
+	}
+	for _, tt := range tests {
+		query := pgproto.Query{String: tt.query}.Encode(nil)[5:]
+		for i := 0; i < 2; i++ {
+			p.handleQuery(query, newMockConn(), state)
+		}
+		if n := queries[parser.Parse(tt.query).Query]; n != tt.backend {
+			t.Errorf("%s: expected %d queries on the backend, got %d", tt.query, tt.backend, n)
+		}
+	}
+
+	// A cached error is not served in a transaction, as it would not abort it
+	state.inTransaction = true
+	p.handleQuery(pgproto.Query{String: tests[0].query}.Encode(nil)[5:], newMockConn(), state)
+	if n := queries["SELECT * FROM missing"]; n != 2 {
+		t.Errorf("Expected the query in a transaction to reach the backend, the backend got %d", n)
+	}
+}
+
+func TestHandleQueryTransactionCache(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	state := fakeBackendState(t, sessionBackend(&mu, &queries))
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	// Statements of a transaction neither read nor fill the cache
+	for _, tt := range []struct {
+		query   string
+		backend int // Queries that reached the backend
+	}{
+		{"BEGIN", 1},
+		{"/* ttl:60 */ SELECT name FROM users", 2},
+		{"/* ttl:60 */ SELECT name FROM users", 3},
+		{"COMMIT", 4},
+		{"/* ttl:60 */ SELECT name FROM users", 5},
+		{"/* ttl:60 */ SELECT name FROM users", 5},
+	} {
+		p.handleQuery(pgproto.Query{String: tt.query}.Encode(nil)[5:], newMockConn(), state)
+		mu.Lock()
+		n := len(queries)
+		mu.Unlock()
+		if n != tt.backend {
+			t.Errorf("%s: expected %d queries on the backend, got %d", tt.query, tt.backend, n)
+		}
+	}
+}
+
+func TestHandleQueryNormalizedCache(t *testing.T) {
+	var queries atomic.Int32
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries.Add(1)
+		response := pgproto.DataRow{Values: [][]byte{[]byte("1")}}.Encode(nil)
+		return readyIdle.Encode(pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response))
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c, config: config.ProxyConfig{CacheNormalize: true}}
+
+	for i, tt := range []struct {
+		query   string
+		backend int32 // Queries that reached the backend
+	}{
+		{"/* ttl:60 */ SELECT id FROM users WHERE id = 1", 1},
+		{"/* ttl:60 */ SELECT id\n  FROM users WHERE id = 1", 1},
+		{"/* ttl:60 */ SELECT id FROM users WHERE id = 2", 2},
+		{"/* ttl:60 */ SELECT id FROM users WHERE id = '1'", 3},
+	} {
+		p.handleQuery(pgproto.Query{String: tt.query}.Encode(nil)[5:], newMockConn(), state)
+		time.Sleep(10 * time.Millisecond)
+		if n := queries.Load(); n != tt.backend {
+			t.Errorf("Query %d: expected %d queries on the backend, got %d", i, tt.backend, n)
+		}
+	}
+}
+
+func TestHandleQuerySnapshot(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		query := strings.TrimSuffix(string(payload), "\x00")
+		mu.Lock()
+		queries = append(queries, query)
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(query, "BEGIN"):
+			return pgproto.ReadyForQuery{TxStatus: pgproto.TxInTransaction}.Encode(pgproto.CommandComplete{Tag: "BEGIN"}.Encode(nil))
+		case query == "COMMIT":
+			return readyIdle.Encode(pgproto.CommandComplete{Tag: "COMMIT"}.Encode(nil))
+		}
+		response := pgproto.DataRow{Values: [][]byte{[]byte("1")}}.Encode(nil)
+		return pgproto.ReadyForQuery{TxStatus: pgproto.TxInTransaction}.Encode(pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response))
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	// Cacheable reads in the snapshot all reach its backend, in one
+	// transaction, which the client cannot end itself
+	for _, query := range []string{
+		"SET tqdb_snapshot = ON",
+		"/* ttl:60 */ SELECT id FROM users",
+		"/* ttl:60 */ SELECT id FROM users",
+		"COMMIT",
+		"SET tqdb_snapshot = OFF",
+	} {
+		p.handleQuery(pgproto.Query{String: query}.Encode(nil)[5:], newMockConn(), state)
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY", "SELECT id FROM users", "SELECT id FROM users", "COMMIT"}
+	if strings.Join(queries, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("Expected backend queries %q, got %q", expected, queries)
+	}
+	if state.snapshot != "" || state.inTransaction {
+		t.Errorf("Expected the snapshot to end, got snapshot %q, in transaction %v", state.snapshot, state.inTransaction)
+	}
+}
+
+func TestHandleQueryRefresh(t *testing.T) {
+	var queries atomic.Int32
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries.Add(1)
+		response := pgproto.DataRow{Values: [][]byte{[]byte("1")}}.Encode(nil)
+		return readyIdle.Encode(pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response))
+	})
+	state.shard = "main"
+	cfg := cache.DefaultCacheConfig()
+	cfg.RefreshAhead = time.Hour
+	c, err := cache.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c, pools: map[string]*replica.Pool{"main": state.pool}}
+	// The refresh uses the backend connection of the session
+	p.refreshConns.Store("@"+state.primaryAddr+"/", &refreshConn{b: state.backends[state.primaryAddr]})
+
+	// The second query is a cache hit, which makes the result hot
+	query := pgproto.Query{String: "/* ttl:60 */ SELECT id FROM users"}.Encode(nil)[5:]
+	p.handleQuery(query, newMockConn(), state)
+	time.Sleep(10 * time.Millisecond)
+	p.handleQuery(query, newMockConn(), state)
+	if state.lastBackend != "cache" {
+		t.Fatalf("Expected a cache hit, got %s", state.lastBackend)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.RunRefresh(ctx, 5*time.Millisecond)
+	for i := 0; i < 100 && queries.Load() < 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected the hot result to be refreshed on the backend once, got %d queries", n)
+	}
+}
+
+func TestHandleQuerySpill(t *testing.T) {
+	queries := 0
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries++
+		response := pgproto.RowDescription{Fields: []pgproto.FieldDescription{pgproto.TextField("note")}}.Encode(nil)
+		for i := 0; i < 100; i++ {
+			response = pgproto.DataRow{Values: [][]byte{bytes.Repeat([]byte("x"), 100)}}.Encode(response)
+		}
+		response = pgproto.CommandComplete{Tag: "SELECT 100"}.Encode(response)
+		return readyIdle.Encode(response)
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	p := &Proxy{cache: c, config: config.ProxyConfig{SpillThreshold: 1000, SpillDir: dir}}
+
+	query := pgproto.Query{String: "/* ttl:60 */ SELECT note FROM notes"}.Encode(nil)[5:]
+	for i := 1; i <= 2; i++ {
+		conn := newMockConn()
+		p.handleQuery(query, conn, state)
+		if types := messageTypes(t, conn); types != "T"+strings.Repeat("D", 100)+"CZ" {
+			t.Fatalf("Expected the whole response from the spill file, got %q", types)
+		}
+		if queries != i {
+			t.Errorf("Expected the spilled response not to be cached, the backend got %d queries", queries)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the spill files to be removed, found %d", len(entries))
+	}
+}
+
+func TestHandleQueryBackendError(t *testing.T) {
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		response := pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: "relation \"missing\" does not exist"}.Encode(nil)
+		return readyIdle.Encode(response)
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	conn := newMockConn()
+	p.handleQuery(pgproto.Query{String: "/* ttl:60 */ SELECT * FROM missing"}.Encode(nil)[5:], conn, state)
+	if types := messageTypes(t, conn); types != "EZ" {
+		t.Errorf("Expected the backend's ErrorResponse and ReadyForQuery, got %q", types)
+	}
+	if _, _, ok := c.Get("SELECT * FROM missing"); ok {
+		t.Error("Expected the error not to be cached")
+	}
+}
+
+func TestHandleMessagesForwardsPortal(t *testing.T) {
+	var received []byte
+	var bind pgproto.Bind
+	field := pgproto.FieldDescription{Name: "n", TypeOID: pgproto.OIDInt4, TypeSize: 4, TypeModifier: -1, Format: pgproto.FormatBinary}
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		received = append(received, msgType)
+		switch msgType {
+		case pgproto.MsgParse:
+			return pgproto.ParseComplete{}.Encode(nil)
+		case pgproto.MsgBind:
+			bind.Decode(payload)
+			return pgproto.BindComplete{}.Encode(nil)
+		case pgproto.MsgDescribe:
+			return pgproto.RowDescription{Fields: []pgproto.FieldDescription{field}}.Encode(nil)
+		case pgproto.MsgExecute:
+			response := pgproto.DataRow{Values: [][]byte{{0, 0, 0, 42}}}.Encode(nil)
+			return pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response)
+		case pgproto.MsgSync:
+			return pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}.Encode(nil)
+		}
+		return nil
+	})
+	p := &Proxy{}
+
+	clientBind := pgproto.Bind{
+		Portal:        "p1",
+		Statement:     "s1",
+		ParamFormats:  []int16{pgproto.FormatBinary},
+		Params:        [][]byte{{0, 0, 0, 42}},
+		ResultFormats: []int16{pgproto.FormatBinary},
+	}
+	in := pgproto.Parse{Name: "s1", Query: "SELECT $1::int4 AS n", ParamOIDs: []uint32{pgproto.OIDInt4}}.Encode(nil)
+	in = clientBind.Encode(in)
+	in = pgproto.Describe{Target: pgproto.TargetPortal, Name: "p1"}.Encode(in)
+	in = pgproto.Execute{Portal: "p1"}.Encode(in)
+	in = pgproto.Sync{}.Encode(in)
+	in = pgproto.Terminate{}.Encode(in)
+
+	conn := newMockConn()
+	p.handleMessages(scriptedConn{mockConn: conn, in: bytes.NewReader(in)}, 1, state)
+
+	if types := messageTypes(t, conn); types != "12TDCZ" {
+		t.Errorf("Expected ParseComplete, BindComplete, RowDescription, DataRow, CommandComplete and ReadyForQuery, got %q", types)
+	}
+	if string(received) != "PBDSPBES" {
+		t.Errorf("Expected the backend to get the portal for Describe and Execute, got %q", received)
+	}
+	if bind.Portal != "" || bind.Statement != "" || !bytes.Equal(bind.Params[0], clientBind.Params[0]) ||
+		bind.ParamFormat(0) != pgproto.FormatBinary || bind.ResultFormat(0) != pgproto.FormatBinary {
+		t.Errorf("Expected the parameters and formats of the client, got %+v", bind)
+	}
+}
+
+func TestHandleQueryCopyIn(t *testing.T) {
+	var data []byte
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		switch msgType {
+		case pgproto.MsgQuery:
+			// Text format, no columns
+			return pgproto.AppendMessage(nil, pgproto.MsgCopyInResponse, []byte{0, 0, 0})
+		case pgproto.MsgCopyData:
+			data = append(data, payload...)
+		case pgproto.MsgCopyDone:
+			response := pgproto.CommandComplete{Tag: "COPY 2"}.Encode(nil)
+			return readyIdle.Encode(response)
+		}
+		return nil
+	})
+	p := &Proxy{}
+
+	in := pgproto.AppendMessage(nil, pgproto.MsgCopyData, []byte("a\n"))
+	in = pgproto.AppendMessage(in, pgproto.MsgCopyData, []byte("b\n"))
+	in = pgproto.AppendMessage(in, pgproto.MsgCopyDone, nil)
+	conn := newMockConn()
+	query := pgproto.Query{String: "COPY logs (message) FROM STDIN"}.Encode(nil)[5:]
+	p.handleQuery(query, scriptedConn{mockConn: conn, in: bytes.NewReader(in)}, state)
+
+	if types := messageTypes(t, conn); types != "GCZ" {
+		t.Errorf("Expected CopyInResponse, CommandComplete and ReadyForQuery, got %q", types)
+	}
+	if string(data) != "a\nb\n" {
+		t.Errorf("Expected the COPY data of the client, got %q", data)
+	}
+}
+
+func TestHandleQueryBoost(t *testing.T) {
+	queries := 0
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries++
+		response := pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil)
+		return readyIdle.Encode(response)
+	})
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c, booster: cache.NewBooster(1, time.Minute)}
+
+	// The first executions measure the rate, the following are boosted
+	query := pgproto.Query{String: "SELECT count(*) FROM orders"}.Encode(nil)[5:]
+	for i := 0; i < 5; i++ {
+		p.handleQuery(query, newMockConn(), state)
+	}
+	if queries != 2 {
+		t.Errorf("Expected the repeated query to be micro-cached after 2 executions, the backend got %d", queries)
+	}
+
+	// Queries in a transaction are not boosted
+	state.inTransaction = true
+	p.handleQuery(query, newMockConn(), state)
+	if queries != 3 {
+		t.Errorf("Expected the query in a transaction to reach the backend, the backend got %d", queries)
+	}
+}
+
+func TestHandleQueryAnnotation(t *testing.T) {
+	var received string
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		var query pgproto.Query
+		query.Decode(payload)
+		received = query.String
+		response := pgproto.CommandComplete{Tag: "SELECT 0"}.Encode(nil)
+		return readyIdle.Encode(response)
+	})
+	state.connID, state.user, state.database = 123, "app1", "shop"
+	p := &Proxy{annotator: annotate.New("/* tqdb c={conn} u={user} db={db} */")}
+
+	p.handleQuery(pgproto.Query{String: "/* ttl:0 */ SELECT * FROM users"}.Encode(nil)[5:], newMockConn(), state)
+	if want := "/* tqdb c=123 u=app1 db=shop */ SELECT * FROM users"; received != want {
+		t.Errorf("Expected the backend to get %q, got %q", want, received)
+	}
+}
+
+func TestSelectBackendReadSplit(t *testing.T) {
+	p := &Proxy{config: config.ProxyConfig{Backends: map[string]config.BackendConfig{
+		"main": {Primary: "primary:5432", ReadSplit: true, ReadSplitStickyMs: 1000},
+	}}}
+	state := &connState{shard: "main", pool: replica.NewPool("primary:5432", []string{"replica:5432"}), primaryAddr: "primary:5432"}
+	tests := []struct {
+		name      string
+		query     string
+		lastWrite time.Duration // Time since the last write (0 = never)
+		inTx      bool
+		want      string
+	}{
+		{"select", "SELECT * FROM users", 0, false, "replicas[0]"},
+		{"after a write", "SELECT * FROM users", 100 * time.Millisecond, false, "primary"},
+		{"after the sticky window", "SELECT * FROM users", 2 * time.Second, false, "replicas[0]"},
+		{"in a transaction", "SELECT * FROM users", 0, true, "primary"},
+		{"locking read", "SELECT * FROM users FOR UPDATE", 0, false, "primary"},
+		{"write", "UPDATE users SET name = 'x'", 0, false, "primary"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state.lastWrite = time.Time{}
+			if tt.lastWrite > 0 {
+				state.lastWrite = time.Now().Add(-tt.lastWrite)
+			}
+			state.inTransaction = tt.inTx
+			if _, name := p.selectBackend(state, parser.Parse(tt.query)); name != tt.want {
+				t.Errorf("selectBackend() = %s, want %s", name, tt.want)
+			}
+		})
+	}
+
+	// Without read_split only cacheable SELECTs use the replicas
+	p.config.Backends["main"] = config.BackendConfig{Primary: "primary:5432"}
+	state.lastWrite, state.inTransaction = time.Time{}, false
+	if _, name := p.selectBackend(state, parser.Parse("SELECT * FROM users")); name != "primary" {
+		t.Errorf("Expected the primary without read_split, got %s", name)
+	}
+	if _, name := p.selectBackend(state, parser.Parse("/* ttl:60 */ SELECT * FROM users")); name != "replicas[0]" {
+		t.Errorf("Expected a replica for a cacheable SELECT, got %s", name)
+	}
+}
+
+func TestSelectBackendRoute(t *testing.T) {
+	p := &Proxy{
+		config: config.ProxyConfig{Backends: map[string]config.BackendConfig{"main": {Primary: "primary:5432"}}},
+		pools:  map[string]*replica.Pool{"other": replica.NewPool("other:5432", []string{"other-replica:5432"})},
+	}
+	state := &connState{shard: "main", pool: replica.NewPool("primary:5432", []string{"replica:5432"}), primaryAddr: "primary:5432"}
+	tests := []struct {
+		query    string
+		inTx     bool
+		wantAddr string
+	}{
+		{"/* route:replica */ SELECT * FROM users", false, "replica:5432"},
+		{"/* route:replica */ SELECT * FROM users", true, "primary:5432"},
+		{"/* route:replica */ UPDATE users SET name = 'x'", false, "primary:5432"},
+		{"/* ttl:60 route:primary */ SELECT * FROM users", false, "primary:5432"},
+		{"/* route:other */ UPDATE users SET name = 'x'", false, "other:5432"},
+		{"/* route:other */ SELECT * FROM users", true, "primary:5432"},
+	}
+	for _, tt := range tests {
+		state.inTransaction = tt.inTx
+		if addr, _ := p.selectBackend(state, parser.Parse(tt.query)); addr != tt.wantAddr {
+			t.Errorf("selectBackend(%q, in transaction %v) = %s, want %s", tt.query, tt.inTx, addr, tt.wantAddr)
+		}
+	}
+
+	state.inTransaction = false
+	if _, _, err := p.queryBackend(nil, state, parser.Parse("/* route:missing */ SELECT 1"), nil, false); err == nil || !strings.Contains(err.Error(), `unknown backend "missing"`) {
+		t.Errorf("Expected an unknown backend error, got %v", err)
+	}
+}
+
+func TestSelectBackendTableRoute(t *testing.T) {
+	p := &Proxy{
+		config: config.ProxyConfig{
+			Backends:    map[string]config.BackendConfig{"main": {Primary: "primary:5432"}},
+			TableRoutes: []config.TableRoute{{Table: "orders", Backend: "other"}},
+		},
+		pools: map[string]*replica.Pool{"other": replica.NewPool("other:5432", []string{"other-replica:5432"})},
+	}
+	state := &connState{shard: "main", pool: replica.NewPool("primary:5432", []string{"replica:5432"}), primaryAddr: "primary:5432"}
+	tests := []struct {
+		query    string
+		inTx     bool
+		wantAddr string
+	}{
+		{"UPDATE orders SET paid = 1", false, "other:5432"},
+		{"/* ttl:60 */ SELECT * FROM orders", false, "other-replica:5432"},
+		{"/* ttl:60 */ SELECT * FROM users", false, "replica:5432"},
+		{"/* route:main */ UPDATE orders SET paid = 1", false, "primary:5432"},
+		{"UPDATE orders SET paid = 1", true, "primary:5432"},
+	}
+	for _, tt := range tests {
+		state.inTransaction = tt.inTx
+		if addr, _ := p.selectBackend(state, parser.Parse(tt.query)); addr != tt.wantAddr {
+			t.Errorf("selectBackend(%q, in transaction %v) = %s, want %s", tt.query, tt.inTx, addr, tt.wantAddr)
+		}
+	}
+
+	// A transaction stays on the backend of its first statement on tables
+	state.inTransaction = true
+	for _, query := range []string{"SELECT 1", "SELECT * FROM users"} {
+		if _, err := p.route(state, parser.Parse(query)); err != nil {
+			t.Errorf("route(%q) = %v", query, err)
+		}
+	}
+	if state.txBackend != "main" {
+		t.Errorf("Expected the transaction on main, got %q", state.txBackend)
+	}
+	if _, err := p.route(state, parser.Parse("UPDATE orders SET paid = 1")); err == nil || !strings.Contains(err.Error(), "cannot span backends") {
+		t.Errorf("Expected an error for a statement on another backend in the transaction, got %v", err)
+	}
+}
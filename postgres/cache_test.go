@@ -12,7 +12,7 @@ import (
 
 func TestCacheHit(t *testing.T) {
 	// Connect to the proxy
-	db, err := sql.Open("postgres", "host=127.0.0.1 port=5433 user=tqdbproxy password=tqdbproxy dbname=tqdbproxy sslmode=disable")
+	db, err := sql.Open("postgres", proxyDSN())
 	if err != nil {
 		t.Fatalf("Failed to connect to proxy: %v", err)
 	}
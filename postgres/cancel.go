@@ -0,0 +1,88 @@
+package postgres
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// cancelTarget is the session as targeted by cancel requests: the secret key
+// the client got in its BackendKeyData and the keys of its backend sessions.
+// Cancel requests arrive on other connections, hence the mutex.
+type cancelTarget struct {
+	secret uint32
+	mu     sync.Mutex
+	keys   map[string]pgproto.BackendKeyData // backend address -> key
+}
+
+// newCancelTarget creates a cancel target with a random secret key
+func newCancelTarget() *cancelTarget {
+	var secret [4]byte
+	rand.Read(secret[:])
+	return &cancelTarget{secret: binary.BigEndian.Uint32(secret[:]), keys: make(map[string]pgproto.BackendKeyData)}
+}
+
+// add records the key of the backend session at addr
+func (t *cancelTarget) add(addr string, key pgproto.BackendKeyData) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[addr] = key
+}
+
+// remove forgets the backend session at addr
+func (t *cancelTarget) remove(addr string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, addr)
+}
+
+// handleCancel translates the cancel request of a client into cancel
+// requests for the backend sessions of the targeted session. As in
+// PostgreSQL, the request is not answered and unknown keys are ignored.
+func (p *Proxy) handleCancel(payload []byte) {
+	var request pgproto.CancelRequest
+	if err := request.Decode(payload); err != nil {
+		log.Printf("[PostgreSQL] Malformed cancel request: %v", err)
+		return
+	}
+	v, ok := p.cancels.Load(request.ProcessID)
+	if !ok {
+		return
+	}
+	target := v.(*cancelTarget)
+	if subtle.ConstantTimeEq(int32(target.secret), int32(request.SecretKey)) != 1 {
+		log.Printf("[PostgreSQL] Cancel request for conn %d with a wrong secret key", request.ProcessID)
+		return
+	}
+	target.mu.Lock()
+	keys := make(map[string]pgproto.BackendKeyData, len(target.keys))
+	for addr, key := range target.keys {
+		keys[addr] = key
+	}
+	target.mu.Unlock()
+
+	// Only the backend that runs a query acts on the request, so it is sent
+	// to all backend sessions, unencrypted like libpq does
+	for addr, key := range keys {
+		network, address := backendNetwork(addr)
+		conn, err := net.DialTimeout(network, address, 5*time.Second)
+		if err != nil {
+			log.Printf("[PostgreSQL] Cancel request to %s failed: %v", addr, err)
+			continue
+		}
+		conn.Write(pgproto.CancelRequest{ProcessID: key.ProcessID, SecretKey: key.SecretKey}.Encode(nil))
+		conn.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package postgres
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+func TestHandleCancel(t *testing.T) {
+	requests := make(chan pgproto.CancelRequest, 1)
+	addr := listenBackend(t, func(conn net.Conn) {
+		payload, err := pgproto.ReadStartupMessage(conn)
+		if err != nil {
+			return
+		}
+		var request pgproto.CancelRequest
+		if err := request.Decode(payload); err == nil {
+			requests <- request
+		}
+	})
+
+	p := &Proxy{}
+	target := newCancelTarget()
+	target.add(addr, pgproto.BackendKeyData{ProcessID: 4242, SecretKey: 99})
+	p.cancels.Store(uint32(7), target)
+
+	// A wrong secret key is ignored
+	p.handleCancel(pgproto.CancelRequest{ProcessID: 7, SecretKey: target.secret + 1}.Encode(nil)[4:])
+	select {
+	case request := <-requests:
+		t.Fatalf("Expected no cancel request with a wrong secret, got %+v", request)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The backend gets a cancel request with the key of its session
+	p.handleCancel(pgproto.CancelRequest{ProcessID: 7, SecretKey: target.secret}.Encode(nil)[4:])
+	select {
+	case request := <-requests:
+		if request.ProcessID != 4242 || request.SecretKey != 99 {
+			t.Errorf("Expected the backend key 4242/99, got %+v", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a cancel request on the backend")
+	}
+}
@@ -0,0 +1,17 @@
+package postgres
+
+import (
+	"fmt"
+	"os"
+)
+
+// proxyDSN returns the DSN of the proxy under test. The proxy address
+// defaults to 127.0.0.1:5433 and is set by the integration suite through
+// TQDBPROXY_POSTGRES_ADDR.
+func proxyDSN() string {
+	addr := "127.0.0.1:5433"
+	if v := os.Getenv("TQDBPROXY_POSTGRES_ADDR"); v != "" {
+		addr = v
+	}
+	return fmt.Sprintf("postgres://tqdbproxy:tqdbproxy@%s/tqdbproxy?sslmode=disable", addr)
+}
@@ -0,0 +1,78 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// setLagChecks sets the replication lag checks of the pools, for the backends
+// with replica_lag_check or max_replica_lag_ms. The handles of the checks are
+// reopened, as the credentials may have changed.
+func (p *Proxy) setLagChecks(pcfg config.ProxyConfig, pools map[string]*replica.Pool) {
+	p.closeLagDBs()
+	for name, pool := range pools {
+		backend := pcfg.Backends[name]
+		if !backend.ReplicaLagCheck && backend.MaxReplicaLagMs <= 0 {
+			pool.SetLagCheck(nil, 0)
+			continue
+		}
+		pool.SetLagCheck(p.replicaLag(backend), time.Duration(backend.MaxReplicaLagMs)*time.Millisecond)
+	}
+}
+
+// replicaLagQuery measures the replay lag of a standby. A standby that has
+// replayed all WAL it received has no lag, even when the primary is idle.
+const replicaLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN NULL
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END`
+
+// replicaLag returns the lag check of the replicas of backend
+func (p *Proxy) replicaLag(backend config.BackendConfig) replica.LagFunc {
+	return func(ctx context.Context, addr string) (time.Duration, error) {
+		db, err := p.lagDB(addr, backend)
+		if err != nil {
+			return 0, err
+		}
+		var seconds sql.NullFloat64
+		if err := db.QueryRowContext(ctx, replicaLagQuery).Scan(&seconds); err != nil {
+			return 0, err
+		}
+		if !seconds.Valid {
+			return 0, errors.New("not a standby")
+		}
+		return time.Duration(seconds.Float64 * float64(time.Second)), nil
+	}
+}
+
+// lagDB returns the database handle for lag checks of the replica at addr
+func (p *Proxy) lagDB(addr string, backend config.BackendConfig) (*sql.DB, error) {
+	key := backend.Username + "@" + addr
+	if db, ok := p.lagDBs.Load(key); ok {
+		return db.(*sql.DB), nil
+	}
+	db, err := p.connectToBackend(addr, backend.Username, backend.Password, backend.Database)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if actual, loaded := p.lagDBs.LoadOrStore(key, db); loaded {
+		db.Close()
+		return actual.(*sql.DB), nil
+	}
+	return db, nil
+}
+
+// closeLagDBs closes the database handles for lag checks
+func (p *Proxy) closeLagDBs() {
+	p.lagDBs.Range(func(key, db any) bool {
+		p.lagDBs.Delete(key)
+		db.(*sql.DB).Close()
+		return true
+	})
+}
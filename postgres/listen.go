@@ -0,0 +1,238 @@
+package postgres
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// listenRetry is the delay between attempts to reconnect a listener, set by
+// tests
+var listenRetry = time.Second
+
+// errListenerDown is returned for LISTEN and UNLISTEN while the listener
+// connection is being reconnected
+var errListenerDown = errors.New("listener connection to the backend is reconnecting")
+
+// listener is the dedicated backend connection of a session that executes its
+// LISTEN and UNLISTEN commands. It is read continuously, so notifications
+// reach the client while the session is idle. When it fails it is reconnected
+// to the primary of the pool, which follows a failover, and listens on the
+// same channels again.
+type listener struct {
+	client   net.Conn
+	pool     *replica.Pool
+	dial     func(addr string) (*backendConn, error)
+	mu       sync.Mutex
+	conn     *backendConn        // nil while reconnecting
+	channels map[string]bool     // Channels listened on, see parser.ParseListen
+	pending  chan listenResponse // Receives the response of the command in flight
+	closed   bool
+}
+
+type listenResponse struct {
+	response []byte
+	err      error
+}
+
+// listener returns the listener of the session, connecting it when needed
+func (p *Proxy) listener(client net.Conn, state *connState) (*listener, error) {
+	if state.listener != nil {
+		return state.listener, nil
+	}
+	l := &listener{
+		client:   client,
+		pool:     state.pool,
+		channels: make(map[string]bool),
+		dial: func(addr string) (*backendConn, error) {
+			return p.dialBackend(addr, state.params, state.password)
+		},
+	}
+	conn, err := l.dial(l.pool.GetPrimary())
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	state.listener = l
+	go l.run(conn)
+	return l, nil
+}
+
+// listen executes a LISTEN or UNLISTEN command on the listener of the session
+// and returns the response without its ReadyForQuery
+func (p *Proxy) listen(client net.Conn, state *connState, query, channel string, listen bool) ([]byte, error) {
+	l, err := p.listener(client, state)
+	if err != nil {
+		return nil, err
+	}
+	response, err := l.exec(query)
+	if err != nil || responseError(response) != nil {
+		return response, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case listen:
+		l.channels[channel] = true
+	case channel == "*":
+		clear(l.channels)
+	default:
+		delete(l.channels, channel)
+	}
+	return response, nil
+}
+
+// exec sends a query on the listener connection and waits for its response
+func (l *listener) exec(query string) ([]byte, error) {
+	l.mu.Lock()
+	if l.conn == nil {
+		l.mu.Unlock()
+		return nil, errListenerDown
+	}
+	pending := make(chan listenResponse, 1)
+	l.pending = pending
+	_, err := l.conn.Write(pgproto.Query{String: query}.Encode(nil))
+	l.mu.Unlock()
+	if err != nil {
+		// The reader sees the failure as well and reconnects
+		return nil, err
+	}
+	r := <-pending
+	return r.response, r.err
+}
+
+// run reads the listener connection: notifications are written to the
+// client, other messages make up the response of the command in flight. A
+// failed connection is reconnected until the listener is closed.
+func (l *listener) run(conn *backendConn) {
+	for {
+		err := l.read(conn)
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return
+		}
+		if l.pending != nil {
+			l.pending <- listenResponse{err: err}
+			l.pending = nil
+		}
+		l.conn = nil
+		l.mu.Unlock()
+		conn.Close()
+		log.Printf("[PostgreSQL] Listener connection failed, reconnecting: %v", err)
+
+		if conn = l.reconnect(); conn == nil {
+			return
+		}
+	}
+}
+
+// read reads messages from the listener connection until it fails
+func (l *listener) read(conn *backendConn) error {
+	var response []byte
+	for {
+		msgType, payload, err := pgproto.ReadMessage(conn.r)
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case pgproto.MsgNotification:
+			// The client may have gone, the session ends the listener then
+			l.client.Write(pgproto.AppendMessage(nil, msgType, payload))
+		case pgproto.MsgReadyForQuery:
+			l.mu.Lock()
+			if l.pending != nil {
+				l.pending <- listenResponse{response: response}
+				l.pending = nil
+			}
+			l.mu.Unlock()
+			response = nil
+		default:
+			response = pgproto.AppendMessage(response, msgType, payload)
+		}
+	}
+}
+
+// reconnect connects the listener to the primary again and listens on its
+// channels, retrying until it succeeds or the listener is closed, in which
+// case it returns nil
+func (l *listener) reconnect() *backendConn {
+	for {
+		time.Sleep(listenRetry)
+		l.mu.Lock()
+		closed := l.closed
+		var query []byte
+		for channel := range l.channels {
+			query = append(query, "LISTEN "+channel+";"...)
+		}
+		l.mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		addr := l.pool.GetPrimary()
+		conn, err := l.dial(addr)
+		if err == nil && len(query) > 0 {
+			if _, err = conn.Write(pgproto.Query{String: string(query)}.Encode(nil)); err == nil {
+				err = l.relisten(conn)
+			}
+			if err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("[PostgreSQL] Listener reconnect to %s failed: %v", addr, err)
+			continue
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.terminate()
+			return nil
+		}
+		l.conn = conn
+		l.mu.Unlock()
+		log.Printf("[PostgreSQL] Listener reconnected to %s", addr)
+		return conn
+	}
+}
+
+// relisten reads the response to the LISTEN commands sent after reconnecting
+func (l *listener) relisten(conn *backendConn) error {
+	var listenErr error
+	for {
+		msgType, payload, err := pgproto.ReadMessage(conn.r)
+		if err != nil {
+			return err
+		}
+		switch msgType {
+		case pgproto.MsgNotification:
+			l.client.Write(pgproto.AppendMessage(nil, msgType, payload))
+		case pgproto.MsgErrorResponse:
+			var e pgproto.ErrorResponse
+			e.Decode(payload)
+			listenErr = e
+		case pgproto.MsgReadyForQuery:
+			return listenErr
+		}
+	}
+}
+
+// close ends the listener connection
+func (l *listener) close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.conn != nil {
+		l.conn.terminate()
+	}
+}
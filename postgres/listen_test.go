@@ -0,0 +1,143 @@
+package postgres
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/limiter"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// notification returns a NotificationResponse message
+func notification(channel, payload string) []byte {
+	msg := []byte{0, 0, 0, 1}
+	msg = append(append(msg, channel...), 0)
+	msg = append(append(msg, payload...), 0)
+	return pgproto.AppendMessage(nil, pgproto.MsgNotification, msg)
+}
+
+func TestListen(t *testing.T) {
+	defer func(retry time.Duration) { listenRetry = retry }(listenRetry)
+	listenRetry = 10 * time.Millisecond
+
+	// The backend accepts listener connections and records their queries
+	queries := make(chan string, 10)
+	var mu sync.Mutex
+	var conns []net.Conn
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go func() {
+				defer conn.Close()
+				if _, err := pgproto.ReadStartupMessage(conn); err != nil {
+					return
+				}
+				(&Proxy{}).send(conn, pgproto.Authentication{Type: pgproto.AuthOK}, readyIdle)
+				for {
+					msgType, payload, err := pgproto.ReadMessage(conn)
+					if err != nil || msgType != pgproto.MsgQuery {
+						return
+					}
+					var query pgproto.Query
+					query.Decode(payload)
+					queries <- query.String
+					response := pgproto.CommandComplete{Tag: "LISTEN"}.Encode(nil)
+					conn.Write(readyIdle.Encode(response))
+				}
+			}()
+		}
+	}()
+	addr := ln.Addr().String()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	received := make(chan byte, 10)
+	go func() {
+		for {
+			msgType, _, err := pgproto.ReadMessage(client)
+			if err != nil {
+				return
+			}
+			received <- msgType
+		}
+	}()
+	expect := func(types string) {
+		t.Helper()
+		for _, want := range []byte(types) {
+			select {
+			case got := <-received:
+				if got != want {
+					t.Fatalf("Expected message %c, got %c", want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected message %c, got none", want)
+			}
+		}
+	}
+	expectQuery := func(want string) {
+		t.Helper()
+		select {
+		case got := <-queries:
+			if got != want {
+				t.Fatalf("Expected the backend to get %q, got %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the backend to get %q, got nothing", want)
+		}
+	}
+
+	p := &Proxy{connLimiter: limiter.NewConnLimiter(nil, time.Second)}
+	state := &connState{pool: replica.NewPool(addr, nil), primaryAddr: addr, params: map[string]string{"user": "app"}}
+	defer closeBackends(state)
+
+	p.handleQuery(pgproto.Query{String: "LISTEN Orders"}.Encode(nil)[5:], server, state)
+	expectQuery("LISTEN Orders")
+	expect("CZ")
+
+	// Notifications reach the idle client
+	mu.Lock()
+	conns[0].Write(notification("orders", "42"))
+	mu.Unlock()
+	expect("A")
+
+	// A failed listener connection is reconnected and listens again
+	mu.Lock()
+	conns[0].Close()
+	mu.Unlock()
+	expectQuery("LISTEN orders;")
+	mu.Lock()
+	conns[1].Write(notification("orders", "43"))
+	mu.Unlock()
+	expect("A")
+
+	// UNLISTEN * forgets the channels
+	for {
+		state.listener.mu.Lock()
+		up := state.listener.conn != nil
+		state.listener.mu.Unlock()
+		if up {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.handleQuery(pgproto.Query{String: "UNLISTEN *"}.Encode(nil)[5:], server, state)
+	expectQuery("UNLISTEN *")
+	expect("CZ")
+	if len(state.listener.channels) != 0 {
+		t.Errorf("Expected no channels after UNLISTEN *, got %v", state.listener.channels)
+	}
+}
@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/logical"
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// logicalRun is a running slot consumer of a backend primary
+type logicalRun struct {
+	backend     config.BackendConfig
+	publication string
+	cancel      context.CancelFunc
+}
+
+// syncLogical starts a slot consumer for the primary of every backend when
+// logical_invalidate is enabled, and stops the consumers of backends that were
+// removed or whose primary, credentials or publication changed, see package
+// logical
+func (p *Proxy) syncLogical(pcfg config.ProxyConfig) {
+	p.logicalMu.Lock()
+	defer p.logicalMu.Unlock()
+
+	if p.logicals == nil {
+		p.logicals = make(map[string]*logicalRun)
+	}
+	for name, run := range p.logicals {
+		backend, ok := pcfg.Backends[name]
+		if !pcfg.LogicalInvalidate || !ok || backend.Primary != run.backend.Primary ||
+			backend.Username != run.backend.Username || backend.Password != run.backend.Password ||
+			backend.Database != run.backend.Database || pcfg.LogicalPublication != run.publication {
+			run.cancel()
+			delete(p.logicals, name)
+		}
+	}
+	if !pcfg.LogicalInvalidate {
+		return
+	}
+
+	for name, backend := range pcfg.Backends {
+		if _, ok := p.logicals[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		p.logicals[name] = &logicalRun{backend: backend, publication: pcfg.LogicalPublication, cancel: cancel}
+		l := &logical.Listener{
+			Name:        fmt.Sprintf("%s (%s)", backend.Primary, name),
+			Slot:        slotName(),
+			Publication: pcfg.LogicalPublication,
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				return p.dialLogical(backend)
+			},
+			Invalidate: p.invalidateLogical,
+		}
+		go l.Run(ctx)
+	}
+}
+
+// slotName returns a random name for a temporary replication slot, so that
+// proxy instances and backends sharing a primary do not collide
+func slotName() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "tqdbproxy_" + hex.EncodeToString(b)
+}
+
+// dialLogical opens a logical replication connection to the database of the
+// primary of backend
+func (p *Proxy) dialLogical(backend config.BackendConfig) (net.Conn, error) {
+	params := map[string]string{
+		"user":             backend.Username,
+		"database":         backend.Database,
+		"replication":      "database",
+		"application_name": "tqdbproxy",
+	}
+	b, err := p.dialBackend(backend.Primary, params, backend.Password)
+	if err != nil {
+		return nil, err
+	}
+	// Nothing is buffered after ReadyForQuery, the listener reads the
+	// connection itself
+	return b.Conn, nil
+}
+
+// invalidateLogical drops the cached results of tables changed on a primary,
+// and all cached schema metadata after a schema change
+func (p *Proxy) invalidateLogical(tables []string, ddl bool) {
+	if ddl {
+		p.metaCache.Invalidate()
+	}
+	if n := p.cache.InvalidateTables(tables); n > 0 {
+		metrics.CacheReplicationInvalidations.WithLabelValues("logical").Add(float64(n))
+	}
+}
@@ -0,0 +1,91 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// pipelineFlushSize is the amount of responses to extended query messages
+// that is buffered before it is written to the client ahead of Sync or Flush
+const pipelineFlushSize = 64 * 1024
+
+// pipeline is the client connection as seen by the messages of the extended
+// query protocol. Like the server, it buffers their responses until Sync or
+// Flush, so that a client that pipelines Parse, Bind, Describe and Execute
+// messages without waiting gets the responses in few writes. An
+// ErrorResponse fails the pipeline: the messages after it are discarded until
+// Sync, see handleMessages.
+type pipeline struct {
+	net.Conn // The client
+	buf      []byte
+	failed   bool
+	header   []byte // Header of the response message being written
+	rest     int    // Bytes of the response message being written after header
+}
+
+// Write buffers responses, following their message boundaries to find an
+// ErrorResponse
+func (pl *pipeline) Write(b []byte) (int, error) {
+	pl.scan(b)
+	pl.buf = append(pl.buf, b...)
+	if len(pl.buf) >= pipelineFlushSize {
+		if err := pl.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Read writes the buffered responses before reading, as the client may wait
+// for them, such as for the CopyInResponse before it sends COPY data
+func (pl *pipeline) Read(b []byte) (int, error) {
+	if err := pl.Flush(); err != nil {
+		return 0, err
+	}
+	return pl.Conn.Read(b)
+}
+
+// Flush writes the buffered responses to the client
+func (pl *pipeline) Flush() error {
+	if len(pl.buf) == 0 {
+		return nil
+	}
+	_, err := pl.Conn.Write(pl.buf)
+	pl.buf = pl.buf[:0]
+	return err
+}
+
+// scan follows the messages in b, which may start or end within a message,
+// and fails the pipeline on an ErrorResponse
+func (pl *pipeline) scan(b []byte) {
+	for len(b) > 0 {
+		if pl.rest > 0 {
+			n := min(pl.rest, len(b))
+			pl.rest -= n
+			b = b[n:]
+			continue
+		}
+		n := min(5-len(pl.header), len(b))
+		pl.header = append(pl.header, b[:n]...)
+		b = b[n:]
+		if len(pl.header) < 5 {
+			return
+		}
+		if pl.header[0] == pgproto.MsgErrorResponse {
+			pl.failed = true
+		}
+		pl.rest = int(binary.BigEndian.Uint32(pl.header[1:])) - 4
+		pl.header = pl.header[:0]
+	}
+}
+
+// unbuffered returns the client connection under a pipeline, for watching
+// the client and for notifications, which do not wait for Sync
+func unbuffered(client net.Conn) net.Conn {
+	if pl, ok := client.(*pipeline); ok {
+		return pl.Conn
+	}
+	return client
+}
@@ -0,0 +1,92 @@
+package postgres
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+func TestPipeline(t *testing.T) {
+	conn := newMockConn()
+	pl := &pipeline{Conn: conn}
+
+	// Responses are held until Flush, an ErrorResponse is found also when
+	// it is written in pieces
+	response := pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(nil)
+	response = pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01", Message: "relation does not exist"}.Encode(response)
+	for _, b := range response {
+		pl.Write([]byte{b})
+	}
+	if conn.Len() != 0 {
+		t.Error("Expected the responses to be buffered")
+	}
+	if !pl.failed {
+		t.Error("Expected the ErrorResponse to fail the pipeline")
+	}
+	if err := pl.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.Bytes(), response) {
+		t.Errorf("Expected the responses on Flush, got %q", conn.Bytes())
+	}
+}
+
+func TestHandleMessagesPipeline(t *testing.T) {
+	var received []byte
+	var query string
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		received = append(received, msgType)
+		switch msgType {
+		case pgproto.MsgParse:
+			var parse pgproto.Parse
+			parse.Decode(payload)
+			query = parse.Query
+			return pgproto.ParseComplete{}.Encode(nil)
+		case pgproto.MsgBind:
+			return pgproto.BindComplete{}.Encode(nil)
+		case pgproto.MsgExecute:
+			if strings.Contains(query, "missing") {
+				return pgproto.ErrorResponse{Severity: "ERROR", Code: "42703", Message: `column "missing" does not exist`}.Encode(nil)
+			}
+			response := pgproto.DataRow{Values: [][]byte{[]byte("1")}}.Encode(nil)
+			return pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response)
+		case pgproto.MsgSync:
+			return pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}.Encode(nil)
+		}
+		return nil
+	})
+	p := &Proxy{}
+
+	// Two portals are open at once, the messages after the error are
+	// discarded until Sync
+	in := pgproto.Parse{Name: "s1", Query: "SELECT 1"}.Encode(nil)
+	in = pgproto.Bind{Portal: "p1", Statement: "s1"}.Encode(in)
+	in = pgproto.Parse{Name: "s2", Query: "SELECT missing"}.Encode(in)
+	in = pgproto.Bind{Portal: "p2", Statement: "s2"}.Encode(in)
+	in = pgproto.Execute{Portal: "p1"}.Encode(in)
+	in = pgproto.Execute{Portal: "p2"}.Encode(in)
+	in = pgproto.Execute{Portal: "p1"}.Encode(in)
+	in = pgproto.Parse{Name: "s3", Query: "SELECT 3"}.Encode(in)
+	in = pgproto.Sync{}.Encode(in)
+
+	// An error of the proxy itself skips the rest of the pipeline as well
+	in = pgproto.Bind{Portal: "p3", Statement: "s3"}.Encode(in)
+	in = pgproto.Execute{Portal: "p1"}.Encode(in)
+	in = pgproto.Sync{}.Encode(in)
+	in = pgproto.Terminate{}.Encode(in)
+
+	conn := newMockConn()
+	p.handleMessages(scriptedConn{mockConn: conn, in: bytes.NewReader(in)}, 1, state)
+
+	if types := messageTypes(t, conn); types != "1212DCEZEZ" {
+		t.Errorf("Expected the responses up to the errors and ReadyForQuery per Sync, got %q", types)
+	}
+	if string(received) != "PBESPBES" {
+		t.Errorf("Expected the backend to execute the portals before the error only, got %q", received)
+	}
+	if _, ok := state.preparedStatements["s3"]; ok {
+		t.Error("Expected the Parse after the error to be discarded")
+	}
+}
@@ -1,54 +1,55 @@
 package postgres
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"database/sql"
-	"encoding/binary"
+	"database/sql/driver"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/mevdschee/tqdbproxy/acl"
+	"github.com/mevdschee/tqdbproxy/annotate"
+	"github.com/mevdschee/tqdbproxy/audit"
 	"github.com/mevdschee/tqdbproxy/cache"
 	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/conform"
+	"github.com/mevdschee/tqdbproxy/history"
+	"github.com/mevdschee/tqdbproxy/killswitch"
+	"github.com/mevdschee/tqdbproxy/limiter"
+	"github.com/mevdschee/tqdbproxy/logging"
+	"github.com/mevdschee/tqdbproxy/memlimit"
 	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/override"
 	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/proxyproto"
+	"github.com/mevdschee/tqdbproxy/quota"
 	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/session"
+	"github.com/mevdschee/tqdbproxy/slowlog"
+	"github.com/mevdschee/tqdbproxy/spill"
+	"github.com/mevdschee/tqdbproxy/tcpopt"
+	"github.com/mevdschee/tqdbproxy/throttle"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
+	"github.com/mevdschee/tqdbproxy/watch"
 	"github.com/mevdschee/tqdbproxy/writebatch"
 
-	_ "github.com/lib/pq"
-)
-
-const (
-	msgQuery                = 'Q'
-	msgParse                = 'P'
-	msgBind                 = 'B'
-	msgExecute              = 'E'
-	msgDescribe             = 'D'
-	msgSync                 = 'S'
-	msgTerminate            = 'X'
-	msgReadyForQuery        = 'Z'
-	msgCommandComplete      = 'C'
-	msgRowDescription       = 'T'
-	msgDataRow              = 'D'
-	msgErrorResponse        = 'E'
-	msgAuthentication       = 'R'
-	msgParameterStatus      = 'S'
-	msgBackendKeyData       = 'K'
-	msgParseComplete        = '1'
-	msgBindComplete         = '2'
-	msgCloseComplete        = '3'
-	msgNoData               = 'n'
-	msgParameterDescription = 't'
+	"github.com/lib/pq"
 )
 
 var connCounter uint32
@@ -79,14 +80,50 @@ type Proxy struct {
 	config     config.ProxyConfig
 	pools      map[string]*replica.Pool
 	cache      *cache.Cache
+	db         *sql.DB // Write batch connection to the default backend
+	listeners  []net.Listener
 	mu         sync.RWMutex
 	writeBatch *writebatch.Manager
 	wbCtx      context.Context
 	wbCancel   context.CancelFunc
+
+	writeLimiter *limiter.WriteLimiter // Limits concurrent non-batched writes
+	metaCache    *cache.MetadataCache  // Cache for schema metadata queries (nil = disabled)
+	verifier     *cache.Verifier       // Samples cache hits to verify against the primary
+	booster      *cache.Booster        // Micro-caches SELECTs that repeat at a high rate
+	annotator    *annotate.Annotator   // Prefixes queries sent to backends with the proxy identity
+	connLimiter  *limiter.ConnLimiter  // Caps open connections per backend address
+	clampLogged  atomic.Int64          // Unix nanos of the last clamped batch hint warning
+	batchClock   writebatch.Clock      // Time source for batch windows, set by tests (nil = real time)
+	users        map[string]string     // Passwords from the auth file, for md5 and scram-sha-256
+	overrides    *override.Set         // Runtime overrides of query hints (nil = none)
+	switches     *killswitch.Switches  // Kill switches of the proxy features (nil = all enabled)
+	memory       *memlimit.Controller  // Soft memory limit (nil = none)
+	slowLog      *slowlog.Log          // Slow query log (nil = none)
+	audit        *audit.Log            // Audit log (nil = none)
+	rules        *acl.Rules            // Users, databases and read-only users allowed by the config
+	bypass       *override.Bypass      // Bypasses batching of writes whose batches keep failing
+	quotas       *quota.Quotas         // Resource budgets per database
+	throttle     *throttle.Throttle    // Query limits per client address, user and backend
+	histories    *history.Registry     // Client connections with their query history
+	started      time.Time             // Creation of the proxy, for the uptime in the status
+	sessions     sync.WaitGroup        // Client sessions, waited for by Shutdown
+	clients      sync.Map              // net.Conn -> struct{}, closed when draining times out
+	cancels      sync.Map              // Connection ID -> *cancelTarget
+	logicalMu    sync.Mutex
+	logicals     map[string]*logicalRun // Backend name -> running slot consumer, see syncLogical
+	lagDBs       sync.Map               // "user@addr" -> *sql.DB for replica lag checks
+	refreshConns sync.Map               // "user@addr/database" -> *refreshConn for background refreshes of cached results
+	verifyConns  sync.Map               // "user@addr/database" -> *refreshConn for the verification of cache hits
+	verifying    sync.WaitGroup         // Running verifications of cache hits, waited for by Stop
+	routeBatches map[string]*routeBatch // Backend name -> write batching of the tables routed to it, see batchManager
+	schema       cache.Schema           // Tables changed by DDL, whose described statements are checked again
 }
 
 // connState tracks per-connection state for TQDB status
 type connState struct {
+	connID             uint32
+	clientAddr         string // remote address of the client
 	lastBackend        string
 	shard              string
 	lastCacheHit       bool
@@ -94,23 +131,61 @@ type connState struct {
 	user               string
 	password           string
 	database           string
-	primaryDB          *sql.DB
-	replicaDBs         map[string]*sql.DB
+	params             map[string]string        // startup parameters of the client, sent to the backends
+	primaryAddr        string                   // address of the primary of the session, a replica for a replica database
+	primaryName        string                   // name of the backend at primaryAddr when it is a replica ("" = primary)
+	replicaDB          bool                     // the database is a replica database, whose writes are rejected
+	backends           map[string]*backendConn  // backend address -> connection of the session
+	listener           *listener                // connection for LISTEN and UNLISTEN (nil = none yet)
+	sequences          sequences                // sequence values consumed by batched inserts
+	lastWrite          time.Time                // last write or end of a transaction, for read splitting
+	cancel             *cancelTarget            // keys of the backend sessions for cancel requests
 	preparedStatements map[string]string        // statement name -> query SQL
+	paramOIDs          map[string][]uint32      // statement name -> parameter types
 	boundParams        map[string][]interface{} // portal name -> parameters
 	portalStatements   map[string]string        // portal name -> statement name
+	binds              map[string]pgproto.Bind  // portal name -> Bind message, forwarded to the backend
 	writeBatch         *writebatch.Manager      // write batching manager for this connection
 	inTransaction      bool                     // track transaction state
 	lastBatchSize      int                      // batch size from last write-batch operation
+	lastAffectedRows   int64                    // rows affected by the last statement, -1 when unknown
+	writeOrder         *writebatch.Sequence     // orders batched writes (SET tqdb_ordered_writes = ON)
+	writeFence         writebatch.Fence         // tracks pending batched writes, which BEGIN waits for
+	keepComments       bool                     // forwards queries with their hint comments (SET tqdb_keep_comments = ON)
+	settings           session.Settings         // SET statements of the session, replayed on its other backend connections
+	snapshot           string                   // backend of the snapshot the reads run in, uncached (SET tqdb_snapshot = ON)
+	snapshotName       string                   // name of the snapshot backend
+	verbose            bool                     // describes the routing of each statement in a NoticeResponse (SET tqdb.verbose = on)
+	history            *history.Ring            // last statements for pg_tqdb_history (nil = disabled)
+	routed             bool                     // the current statement was served by the cache or a backend
+	home               *homeBackend             // backend of the session while a transaction runs on another one (nil = none)
+	txBegin            string                   // BEGIN of a transaction without statements on tables yet, see routeTransaction
+	txBackend          string                   // backend of the statements on tables of the transaction
+	described          map[string]described     // statement name -> result columns described to the client, see checkResultType
 }
 
 // New creates a new PostgreSQL proxy
 func New(pcfg config.ProxyConfig, pools map[string]*replica.Pool, c *cache.Cache) *Proxy {
 	p := &Proxy{
-		config: pcfg,
-		pools:  pools,
-		cache:  c,
-	}
+		config:       pcfg,
+		pools:        pools,
+		cache:        c,
+		writeLimiter: newWriteLimiter(pcfg),
+		metaCache:    cache.NewMetadataCache(c, "postgres", time.Duration(pcfg.MetadataCacheTTL)*time.Second),
+		verifier:     cache.NewVerifier(pcfg.CacheVerifySample),
+		booster:      cache.NewBooster(pcfg.CacheBoostQPS, time.Duration(pcfg.CacheBoostMaxMs)*time.Millisecond),
+		bypass:       override.NewBypass(pcfg.WriteBatch.BypassErrorRate, pcfg.WriteBatch.BypassMinWrites, time.Duration(pcfg.WriteBatch.BypassCooldown)*time.Second),
+		annotator:    annotate.New(pcfg.Annotate),
+		connLimiter:  limiter.NewConnLimiter(connLimits(pcfg), time.Duration(pcfg.MaxConnectionsWait)*time.Second),
+		quotas:       quota.New(quotaLimits(pcfg)),
+		throttle:     throttle.New(throttleConfig(pcfg)),
+		rules:        acl.New(aclConfig(pcfg)),
+		histories:    history.NewRegistry(),
+		started:      time.Now(),
+	}
+	p.connLimiter.SetTCPOptions(backendTCPOptions(pcfg))
+	p.setLagChecks(pcfg, pools)
+	p.users = loadUsers(pcfg)
 
 	// Initialize write batching context
 	p.wbCtx, p.wbCancel = context.WithCancel(context.Background())
@@ -126,14 +201,580 @@ func (p *Proxy) UpdateConfig(pcfg config.ProxyConfig, pools map[string]*replica.
 	defer p.mu.Unlock()
 	p.config = pcfg
 	p.pools = pools
+	p.writeLimiter = newWriteLimiter(pcfg)
+	p.verifier.SetSample(pcfg.CacheVerifySample)
+	p.booster.SetLimits(pcfg.CacheBoostQPS, time.Duration(pcfg.CacheBoostMaxMs)*time.Millisecond)
+	p.bypass.SetLimits(pcfg.WriteBatch.BypassErrorRate, pcfg.WriteBatch.BypassMinWrites, time.Duration(pcfg.WriteBatch.BypassCooldown)*time.Second)
+	p.annotator.SetFormat(pcfg.Annotate)
+	p.connLimiter.Update(connLimits(pcfg), time.Duration(pcfg.MaxConnectionsWait)*time.Second)
+	p.connLimiter.SetTCPOptions(backendTCPOptions(pcfg))
+	p.setLagChecks(pcfg, pools)
+	p.users = loadUsers(pcfg)
+	p.quotas.Update(quotaLimits(pcfg))
+	p.throttle.Update(throttleConfig(pcfg))
+	p.rules = acl.New(aclConfig(pcfg))
+	if p.writeBatch != nil {
+		p.writeBatch.Reconfigure(writeBatchConfig(pcfg, p.batchClock))
+	}
+	for _, manager := range p.routeBatchManagers() {
+		manager.Reconfigure(writeBatchConfig(pcfg, p.batchClock))
+	}
+
+	p.syncLogical(pcfg)
+
+	// The pools are new, warm them up like at start
+	go p.warmup(pcfg, nil)
+}
+
+// Quotas returns the resource budgets and usage per database, reported
+// through the admin API
+func (p *Proxy) Quotas() *quota.Quotas {
+	return p.quotas
+}
+
+// Histories returns the client connections with their query history,
+// reported through the admin API
+func (p *Proxy) Histories() *history.Registry {
+	return p.histories
+}
+
+// aclConfig returns the access rules of the listener
+func aclConfig(pcfg config.ProxyConfig) acl.Config {
+	return acl.Config{
+		AllowUsers:    pcfg.AllowUsers,
+		DenyUsers:     pcfg.DenyUsers,
+		ReadOnlyUsers: pcfg.ReadOnlyUsers,
+		Databases:     pcfg.UserDatabases,
+		DBMap:         pcfg.DBMap,
+		Default:       pcfg.Default,
+	}
+}
+
+// accessRules returns the access rules of the listener
+func (p *Proxy) accessRules() *acl.Rules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rules
+}
+
+// listenerRules returns the users allowed to connect to the listener with the
+// name, in addition to the access rules
+func (p *Proxy) listenerRules(name string) *acl.Rules {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	l, _ := p.config.Listener(name)
+	return acl.New(acl.Config{AllowUsers: l.AllowUsers, DenyUsers: l.DenyUsers})
+}
+
+// listenerTLS returns the TLS configuration of the listener with the name,
+// nil without TLS, and whether the listener rejects plaintext clients
+func (p *Proxy) listenerTLS(name string) (*tls.Config, bool) {
+	p.mu.RLock()
+	l, _ := p.config.Listener(name)
+	p.mu.RUnlock()
+	required := l.TLSMode == tlsopt.ModeRequire
+	if l.TLSMode == "" || l.TLSMode == tlsopt.ModeDisable {
+		return nil, false
+	}
+	cfg, err := tlsopt.Server(l.TLSCert, l.TLSKey)
+	if err != nil {
+		log.Printf("[PostgreSQL] TLS unavailable on listener %s: %v", name, err)
+		return nil, required
+	}
+	return cfg, required
+}
+
+// checkStatement returns an error for the writes of read-only users and in
+// replica databases
+func (p *Proxy) checkStatement(state *connState, query string) error {
+	if err := p.accessRules().CheckStatement(state.user, query); err != nil {
+		return err
+	}
+	if state.replicaDB {
+		return acl.CheckReadOnlyDatabase(state.database, query)
+	}
+	return nil
+}
+
+// throttleConfig returns the query limits of the listener
+func throttleConfig(pcfg config.ProxyConfig) throttle.Config {
+	t := pcfg.Throttle
+	return throttle.Config{
+		Client:  throttle.Limits{QPS: t.ClientQPS, Concurrency: t.ClientConcurrency},
+		User:    throttle.Limits{QPS: t.UserQPS, Concurrency: t.UserConcurrency},
+		Backend: throttle.Limits{QPS: t.BackendQPS, Concurrency: t.BackendConcurrency},
+		Wait:    time.Duration(t.WaitMs) * time.Millisecond,
+	}
+}
+
+// quotaLimits returns the default and per-database budgets of the
+// configuration
+func quotaLimits(pcfg config.ProxyConfig) (quota.Limits, map[string]quota.Limits) {
+	limits := make(map[string]quota.Limits, len(pcfg.Quotas))
+	for db, q := range pcfg.Quotas {
+		limits[db] = quota.Limits(q)
+	}
+	return quota.Limits(pcfg.Quota), limits
+}
+
+// SetOverrides sets the runtime overrides of query hints, managed through
+// the admin API
+func (p *Proxy) SetOverrides(overrides *override.Set) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.overrides = overrides
+}
+
+// SetMemory sets the memory controller. Under memory pressure write batches
+// run at a smaller size and large responses spill to disk.
+func (p *Proxy) SetMemory(memory *memlimit.Controller) {
+	p.mu.Lock()
+	p.memory = memory
+	p.mu.Unlock()
+	memory.OnChange(func(pressure bool) {
+		p.mu.RLock()
+		writeBatch := p.writeBatch
+		managers := p.routeBatchManagers()
+		p.mu.RUnlock()
+		if writeBatch != nil {
+			writeBatch.SetShedding(pressure)
+		}
+		for _, manager := range managers {
+			manager.SetShedding(pressure)
+		}
+	})
+}
+
+// SetSlowLog sets the slow query log, shared by both proxies
+func (p *Proxy) SetSlowLog(slowLog *slowlog.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slowLog = slowLog
+}
+
+// slowQueryLog returns the slow query log
+func (p *Proxy) slowQueryLog() *slowlog.Log {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.slowLog
+}
+
+// SetAudit sets the audit log, shared by both proxies
+func (p *Proxy) SetAudit(auditLog *audit.Log) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.audit = auditLog
+}
+
+// auditLog returns the audit log
+func (p *Proxy) auditLog() *audit.Log {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.audit
+}
+
+// SetKillSwitches sets the kill switches of the proxy features, toggled with
+// SET GLOBAL tqdb_<feature> by admin users
+func (p *Proxy) SetKillSwitches(switches *killswitch.Switches) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.switches = switches
+}
+
+// enabled reports whether the kill switch of a feature is on
+func (p *Proxy) enabled(feature string) bool {
+	p.mu.RLock()
+	switches := p.switches
+	p.mu.RUnlock()
+	return switches.Enabled(feature)
+}
+
+// applyOverrides applies the batch window and acknowledgement of the first
+// matching batch rule, or else the defaults, to writes without batch or ack
+// hints and disables the hints of a query that a runtime override or a kill
+// switch matches
+func (p *Proxy) applyOverrides(parsed *parser.ParsedQuery) *parser.ParsedQuery {
+	p.mu.RLock()
+	overrides := p.overrides
+	switches := p.switches
+	writeBatch := p.config.WriteBatch
+	p.mu.RUnlock()
+	parsed.BatchMax = 0
+	if rule, ok := writeBatch.MatchRule(parsed); ok {
+		parsed.DefaultBatch(rule.WindowMs)
+		parsed.BatchMax = rule.MaxBatch
+		parsed.DefaultAck(rule.Ack)
+	} else {
+		parsed.DefaultBatch(writeBatch.DefaultMs)
+	}
+	if writeBatch.AckEarly {
+		parsed.DefaultAck(parser.AckEarly)
+	}
+	return switches.Apply(overrides.Apply(parsed))
+}
+
+// recordBatch counts the result of a batched write for the batch bypass.
+// Errors of the write batch manager itself are not held against the query.
+func (p *Proxy) recordBatch(query string, err error) {
+	if err == writebatch.ErrManagerClosed || err == writebatch.ErrTimeout || err == writebatch.ErrQueueFull {
+		return
+	}
+	p.mu.RLock()
+	overrides := p.overrides
+	p.mu.RUnlock()
+	if p.bypass.Record(overrides, query, err != nil) {
+		log.Printf("[PostgreSQL] Batching bypassed for %s after repeated errors", parser.Fingerprint(query))
+	}
+}
+
+// loadUsers reads the auth file when the auth method needs it. On errors no
+// users are returned, so that all clients are rejected.
+func loadUsers(pcfg config.ProxyConfig) map[string]string {
+	if pcfg.Auth != authMD5 && pcfg.Auth != authSCRAM {
+		return nil
+	}
+	if pcfg.AuthFile == "" {
+		log.Printf("[PostgreSQL] Warning: auth = %s requires an auth_file, all clients will be rejected", pcfg.Auth)
+		return nil
+	}
+	users, err := loadAuthFile(pcfg.AuthFile)
+	if err != nil {
+		log.Printf("[PostgreSQL] Error loading auth file: %v", err)
+		return nil
+	}
+	return users
+}
+
+// writeBatchConfig returns the write batch manager configuration
+func writeBatchConfig(pcfg config.ProxyConfig, clock writebatch.Clock) writebatch.Config {
+	return writebatch.Config{
+		MaxBatchSize:     pcfg.WriteBatch.MaxBatchSize,
+		IsolateFailures:  pcfg.WriteBatch.Isolate,
+		AsyncQueueSize:   pcfg.WriteBatch.AsyncQueueSize,
+		QueueSize:        pcfg.WriteBatch.QueueSize,
+		Workers:          pcfg.WriteBatch.Workers,
+		RequestTimeoutMs: pcfg.WriteBatch.TimeoutMs,
+		Retry: writebatch.RetryPolicy{
+			MaxRetries: pcfg.WriteBatch.Retries,
+			Backoff:    time.Duration(pcfg.WriteBatch.RetryBackoffMs) * time.Millisecond,
+			MaxBackoff: time.Duration(pcfg.WriteBatch.RetryMaxBackoffMs) * time.Millisecond,
+		},
+		Clock: clock,
+	}
+}
+
+// newWriteLimiter builds the immediate write limiter from the global and
+// per-backend limits in the configuration
+func newWriteLimiter(pcfg config.ProxyConfig) *limiter.WriteLimiter {
+	backendLimits := make(map[string]int)
+	for name, backend := range pcfg.Backends {
+		backendLimits[name] = backend.ImmediateWriteLimit
+	}
+	return limiter.NewWriteLimiter(pcfg.ImmediateWriteLimit, backendLimits)
+}
+
+// newSpill returns a buffer for the response of a query, or nil when
+// spilling is disabled
+func (p *Proxy) newSpill() *spill.Buffer {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	threshold := p.config.SpillThreshold
+	if limit := p.memory.BufferLimit(); limit > 0 && (threshold <= 0 || limit < threshold) {
+		// Under memory pressure large responses are not held in memory
+		threshold = limit
+	}
+	if threshold <= 0 {
+		return nil
+	}
+	return spill.New(p.config.SpillDir, threshold)
+}
+
+// readRetries returns how often a failed read is retried on another node
+func (p *Proxy) readRetries() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config.ReadRetries
+}
+
+// splitRead returns true when read splitting of the backend of the session
+// sends a SELECT to a replica: the backend has read_split enabled and the
+// session did not write within read_split_sticky_ms, so it reads its own
+// writes
+func (p *Proxy) splitRead(state *connState, parsed *parser.ParsedQuery) bool {
+	p.mu.RLock()
+	backend := p.config.Backends[state.shard]
+	p.mu.RUnlock()
+	return backend.ReadSplit && parsed.IsReplicaSafe() &&
+		time.Since(state.lastWrite) >= time.Duration(backend.ReadSplitStickyMs)*time.Millisecond
+}
+
+// cacheKey returns the cache key of a SELECT: the query, or its normalized
+// key with cache_normalize, see parser.NormalizedKey
+func (p *Proxy) cacheKey(query string) string {
+	p.mu.RLock()
+	normalize := p.config.CacheNormalize
+	p.mu.RUnlock()
+	if !normalize {
+		return query
+	}
+	return parser.NormalizedKey(query)
+}
+
+// normalizeWrite returns a batched write with its values as parameters when
+// writebatch_normalize is enabled, so that writes that only differ in their
+// values share a batch, see parser.Normalize
+func (p *Proxy) normalizeWrite(query string) (string, []interface{}, bool) {
+	p.mu.RLock()
+	normalize := p.config.WriteBatch.Normalize
+	p.mu.RUnlock()
+	if !normalize {
+		return "", nil, false
+	}
+	normalized, params, ok := parser.Normalize(query)
+	if !ok {
+		return "", nil, false
+	}
+	normalized, _ = parser.TranslatePlaceholders(normalized)
+	return normalized, params, true
+}
+
+// guardBatch returns true when the batch guard is enabled and a batchable
+// UPDATE or DELETE has no equality predicate on a configured key column, so
+// that it is executed immediately instead of holding locks in a batch.
+func (p *Proxy) guardBatch(parsed *parser.ParsedQuery) bool {
+	if parsed.Type != parser.QueryUpdate && parsed.Type != parser.QueryDelete {
+		return false
+	}
+	p.mu.RLock()
+	guard, columns := p.config.BatchGuard, p.config.BatchGuardColumns
+	p.mu.RUnlock()
+	if !guard {
+		return false
+	}
+	for _, column := range parsed.EqualityColumns() {
+		for _, key := range columns {
+			if key == column {
+				return false
+			}
+			for _, table := range parsed.Tables {
+				if key == table+"."+column {
+					return false
+				}
+			}
+		}
+	}
+	metrics.WriteBatchGuarded.Inc()
+	return true
+}
+
+// durability returns the durability of a batched write: that of its
+// durability hint when relaxed_durability_tables lists "*" or all tables of
+// the write, and otherwise full, with false when a hint was ignored
+func (p *Proxy) durability(parsed *parser.ParsedQuery) (writebatch.Durability, bool) {
+	if parsed.Durability == "" {
+		return writebatch.DurabilityFull, true
+	}
+	p.mu.RLock()
+	tables := p.config.RelaxedDurabilityTables
+	p.mu.RUnlock()
+	if !slices.Contains(tables, "*") {
+		if len(parsed.Tables) == 0 {
+			return writebatch.DurabilityFull, false
+		}
+		for _, table := range parsed.Tables {
+			if !slices.Contains(tables, table) {
+				return writebatch.DurabilityFull, false
+			}
+		}
+	}
+	return writebatch.Durability(parsed.Durability), true
+}
+
+// clampBatch applies the batch window bounds of the backend (or else of the
+// protocol) to the batch hint of a query. Clamped hints are counted and
+// logged, at most once per 10 seconds.
+func (p *Proxy) clampBatch(parsed *parser.ParsedQuery, shard string) (int, bool) {
+	p.mu.RLock()
+	minMs, maxMs := p.config.BatchMinMs, p.config.BatchMaxMs
+	if backend, ok := p.config.Backends[shard]; ok {
+		if backend.BatchMinMs > 0 {
+			minMs = backend.BatchMinMs
+		}
+		if backend.BatchMaxMs > 0 {
+			maxMs = backend.BatchMaxMs
+		}
+	}
+	p.mu.RUnlock()
+
+	hinted, clamped := parsed.ClampBatch(minMs, maxMs)
+	if clamped {
+		metrics.WriteBatchHintClamped.Inc()
+		now := time.Now().UnixNano()
+		if last := p.clampLogged.Load(); now-last >= int64(10*time.Second) && p.clampLogged.CompareAndSwap(last, now) {
+			log.Printf("[PostgreSQL] Batch hint of %dms clamped to %dms (file: %s, line: %d)", hinted, parsed.BatchMs, parsed.File, parsed.Line)
+		}
+	}
+	return hinted, clamped
+}
+
+// connLimits returns the connection limit per backend address. An address
+// used by several backends gets the lowest of their limits.
+func connLimits(pcfg config.ProxyConfig) map[string]int {
+	limits := make(map[string]int)
+	for _, backend := range pcfg.Backends {
+		if backend.MaxConnections <= 0 {
+			continue
+		}
+		for _, addr := range append([]string{backend.Primary}, backend.Replicas...) {
+			if n, exists := limits[addr]; !exists || backend.MaxConnections < n {
+				limits[addr] = backend.MaxConnections
+			}
+		}
+	}
+	return limits
+}
+
+// backendDialer counts lib/pq connections against the connection limiter
+type backendDialer struct {
+	limiter *limiter.ConnLimiter
+}
+
+func (d backendDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d backendDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d backendDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	key := address
+	if network == "unix" {
+		// lib/pq dials the socket file inside the configured directory
+		key = "unix:" + filepath.Dir(address)
+	}
+	return d.limiter.DialKey(ctx, key, network, address)
+}
+
+// openBackend opens a database handle whose connections count against the
+// connection limiter
+func (p *Proxy) openBackend(dsn string) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector.Dialer(backendDialer{limiter: p.connLimiter})
+	return sql.OpenDB(connector), nil
+}
+
+// acquireWriteSlot waits (in FIFO order) for an immediate write slot on the
+// connection's backend. The returned function releases the slot.
+func (p *Proxy) acquireWriteSlot(state *connState) (func(), error) {
+	p.mu.RLock()
+	wl := p.writeLimiter
+	p.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	release, err := wl.Acquire(ctx, state.shard)
+	if err != nil {
+		return nil, fmt.Errorf("timeout waiting for write slot on backend %q", state.shard)
+	}
+	return release, nil
+}
+
+// tcpOptions converts configured TCP options
+func tcpOptions(c config.TCPConfig) tcpopt.Options {
+	return tcpopt.Options{
+		KeepAlive:   time.Duration(c.KeepAlive) * time.Second,
+		UserTimeout: time.Duration(c.UserTimeout) * time.Second,
+		NoDelay:     c.NoDelay,
+		ReadBuffer:  c.ReadBuffer,
+		WriteBuffer: c.WriteBuffer,
+	}
+}
+
+// proxyOptions returns the PROXY protocol options of connections accepted
+// by the listener with the name, nil when clients connect directly. Unix
+// socket connections never carry a header.
+func proxyOptions(c config.ProxyConfig, name string, listener net.Listener) *proxyproto.Options {
+	l, _ := c.Listener(name)
+	if !l.ProxyProtocol || listener.Addr().Network() != "tcp" {
+		return nil
+	}
+	trusted, _ := proxyproto.ParseNetworks(l.ProxyProtocolFrom) // Checked by the config
+	return &proxyproto.Options{Trusted: trusted}
+}
+
+// backendTCPOptions returns the TCP options per backend address. An address
+// used by several backends gets the options of the first backend by name.
+func backendTCPOptions(pcfg config.ProxyConfig) map[string]tcpopt.Options {
+	names := make([]string, 0, len(pcfg.Backends))
+	for name := range pcfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := make(map[string]tcpopt.Options)
+	for _, name := range names {
+		backend := pcfg.Backends[name]
+		for _, addr := range append([]string{backend.Primary}, backend.Replicas...) {
+			if _, exists := options[addr]; !exists {
+				options[addr] = tcpOptions(backend.TCP)
+			}
+		}
+	}
+	return options
+}
+
+// backendTLSConfig returns the TLS settings of the first backend (by name)
+// that uses addr as primary or replica
+func backendTLSConfig(pcfg config.ProxyConfig, addr string) config.TLSConfig {
+	names := make([]string, 0, len(pcfg.Backends))
+	for name := range pcfg.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		backend := pcfg.Backends[name]
+		for _, a := range append([]string{backend.Primary}, backend.Replicas...) {
+			if a == addr {
+				return backend.TLS
+			}
+		}
+	}
+	return config.TLSConfig{}
+}
+
+// sslParams returns the connection string parameters for the TLS settings of
+// the backend at addr. Unix sockets never use TLS.
+func (p *Proxy) sslParams(addr string) string {
+	p.mu.RLock()
+	settings := backendTLSConfig(p.config, addr)
+	p.mu.RUnlock()
+	if settings.Mode == "" || strings.HasPrefix(addr, "unix:") {
+		return "sslmode=disable"
+	}
+	params := "sslmode=" + settings.Mode
+	if settings.CAFile != "" {
+		params += " sslrootcert=" + dsnQuote(settings.CAFile)
+	}
+	if settings.CertFile != "" {
+		params += " sslcert=" + dsnQuote(settings.CertFile) + " sslkey=" + dsnQuote(settings.KeyFile)
+	}
+	return params
 }
 
 // Start begins accepting PostgreSQL connections
 func (p *Proxy) Start() error {
 	p.mu.RLock()
-	listen := p.config.Listen
-	socket := p.config.Socket
+	main, _ := p.config.Listener("")
+	listeners := append([]config.ListenerConfig{main}, p.config.Listeners...)
 	defaultBackend := p.config.Default
+	backend := p.config.Backends[defaultBackend]
 	p.mu.RUnlock()
 
 	// Get default pool for write batch manager
@@ -142,126 +783,281 @@ func (p *Proxy) Start() error {
 		return fmt.Errorf("default backend pool %q not found", defaultBackend)
 	}
 
-	// Connect to backend PostgreSQL for write batch manager
+	// Connect to backend PostgreSQL for write batch manager, with the
+	// credentials of the default backend
 	addr := defaultPool.GetPrimary()
-
-	// Parse host and port from address
-	host := addr
-	port := "5432" // default PostgreSQL port
-	if colonIdx := strings.LastIndex(addr, ":"); colonIdx != -1 {
-		host = addr[:colonIdx]
-		port = addr[colonIdx+1:]
-	}
-
-	dsn := fmt.Sprintf("host=%s port=%s user=tqdbproxy password=tqdbproxy dbname=tqdbproxy sslmode=disable", host, port)
-	if len(addr) > 5 && addr[:5] == "unix:" {
-		dsn = fmt.Sprintf("host=%s user=tqdbproxy password=tqdbproxy dbname=tqdbproxy sslmode=disable", addr[5:])
-	}
-	db, err := sql.Open("postgres", dsn)
+	db, err := p.connectToBackend(addr, backend.Username, backend.Password, backend.Database)
 	if err != nil {
 		return fmt.Errorf("failed to connect to backend for write batching: %v", err)
 	}
+	p.db = db
 
 	// Initialize write batching
-	wbCfg := writebatch.Config{
-		MaxBatchSize: p.config.WriteBatch.MaxBatchSize,
+	p.mu.Lock()
+	batchConfig := writeBatchConfig(p.config, p.batchClock)
+	spoolDir, spoolMaxMB := p.config.WriteBatch.SpoolDir, p.config.WriteBatch.SpoolMaxMB
+	p.mu.Unlock()
+	if spoolDir != "" {
+		spool, err := writebatch.OpenSpool(spoolDir, int64(spoolMaxMB)<<20)
+		if err != nil {
+			return fmt.Errorf("failed to open write spool: %v", err)
+		}
+		if pending := spool.Pending(); pending > 0 {
+			log.Printf("[PostgreSQL] Write spool has %d pending writes to replay", pending)
+		}
+		batchConfig.Spool = spool
 	}
-	p.writeBatch = writebatch.New(db, wbCfg)
+	p.mu.Lock()
+	p.writeBatch = writebatch.New(db, batchConfig)
+	p.mu.Unlock()
 	log.Printf("[PostgreSQL] Write batching started")
+	go p.warmup(p.config, db)
+	p.syncLogical(p.config)
 
-	// Start TCP listener
-	tcpListener, err := net.Listen("tcp", listen)
-	if err != nil {
-		return err
+	for _, l := range listeners {
+		if err := p.startListener(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startListener starts the TCP and Unix socket listeners of a listener config
+func (p *Proxy) startListener(l config.ListenerConfig) error {
+	name := ""
+	if l.Name != "" {
+		name = " for listener " + l.Name
 	}
-	log.Printf("[PostgreSQL] Listening on %s (tcp), forwarding to %v backends", listen, len(p.pools))
 
-	go p.acceptLoop(tcpListener)
+	// Start TCP listener
+	if l.Listen != "" {
+		tcpListener, err := net.Listen("tcp", l.Listen)
+		if err != nil {
+			return err
+		}
+		p.listeners = append(p.listeners, tcpListener)
+		log.Printf("[PostgreSQL] Listening on %s (tcp)%s, forwarding to %v backends", l.Listen, name, len(p.pools))
+		go p.acceptLoop(tcpListener, l.Name)
+	}
 
 	// Start Unix socket listener if configured
-	if socket != "" {
+	if l.Socket != "" {
 		// Remove existing socket file if present
-		if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		if err := os.Remove(l.Socket); err != nil && !os.IsNotExist(err) {
 			log.Printf("[PostgreSQL] Warning: could not remove existing socket: %v", err)
 		}
-		unixListener, err := net.Listen("unix", socket)
+		unixListener, err := net.Listen("unix", l.Socket)
 		if err != nil {
 			return fmt.Errorf("failed to listen on unix socket: %v", err)
 		}
-		log.Printf("[PostgreSQL] Listening on %s (unix)", socket)
-		go p.acceptLoop(unixListener)
+		p.listeners = append(p.listeners, unixListener)
+		log.Printf("[PostgreSQL] Listening on %s (unix)%s", l.Socket, name)
+		go p.acceptLoop(unixListener, l.Name)
 	}
 
 	return nil
 }
 
-func (p *Proxy) acceptLoop(listener net.Listener) {
+// Stop closes all listeners and the write batch connection
+func (p *Proxy) Stop() error {
+	p.mu.Lock()
+	listeners := p.listeners
+	writeBatch := p.writeBatch
+	db := p.db
+	p.listeners = nil
+	p.db = nil
+	p.mu.Unlock()
+
+	p.closeLagDBs()
+	p.verifying.Wait()
+	p.closeRefreshConns()
+	p.syncLogical(config.ProxyConfig{})
+
+	var errs []error
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Stop write batching, executing the pending batches
+	if writeBatch != nil {
+		if err := writeBatch.Close(); err != nil {
+			log.Printf("[PostgreSQL] Error closing write batch manager: %v", err)
+		}
+	}
+	p.closeRouteBatches()
+	if p.wbCancel != nil {
+		p.wbCancel()
+	}
+
+	if db != nil {
+		if err := db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("errors during shutdown: %v", errs)
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for the client sessions to
+// end. When ctx is done first, the remaining client connections are closed.
+// Pending write batches are then executed and the backends closed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	listeners := p.listeners
+	p.listeners = nil
+	p.mu.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		closed := 0
+		p.clients.Range(func(key, _ any) bool {
+			key.(net.Conn).Close()
+			closed++
+			return true
+		})
+		log.Printf("[PostgreSQL] Drain timeout, closed %d client connections", closed)
+	}
+	return p.Stop()
+}
+
+// acceptLoop accepts the client connections of the listener with the name
+func (p *Proxy) acceptLoop(listener net.Listener, name string) {
 	for {
 		client, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("[PostgreSQL] Accept error: %v", err)
 			continue
 		}
+		p.mu.RLock()
+		opts := tcpOptions(p.config.TCP)
+		header := proxyOptions(p.config, name, listener)
+		p.mu.RUnlock()
+		if err := opts.Apply(client); err != nil {
+			log.Printf("[PostgreSQL] Error setting TCP options: %v", err)
+		}
 		connID := atomic.AddUint32(&connCounter, 1)
-		go p.handleConnection(client, connID)
+		p.sessions.Add(1)
+		go func() {
+			defer p.sessions.Done()
+			if header != nil {
+				proxied, err := header.Accept(client)
+				if err != nil {
+					log.Printf("[PostgreSQL] PROXY protocol error from %s: %v", client.RemoteAddr(), err)
+					client.Close()
+					return
+				}
+				client = proxied
+			}
+			p.handleConnection(client, connID, name)
+		}()
 	}
 }
 
-func (p *Proxy) handleConnection(client net.Conn, connID uint32) {
-	defer client.Close()
+func (p *Proxy) handleConnection(conn net.Conn, connID uint32, listener string) {
+	p.mu.RLock()
+	strict := p.config.StrictProtocol
+	p.mu.RUnlock()
+	name := fmt.Sprintf("conn %d (%s)", connID, conn.RemoteAddr())
+	client := watch.NewConn(conform.NewPostgreSQL(conn, name, strict))
+	defer func() { client.Close() }()
+	p.clients.Store(conn, struct{}{})
+	defer p.clients.Delete(conn)
 
 	// Read startup message from client
-	startupMsg, err := p.readStartupMessage(client)
+	startupMsg, err := pgproto.ReadStartupMessage(client)
 	if err != nil {
 		log.Printf("[PostgreSQL] Startup read error (conn %d): %v", connID, err)
 		return
 	}
+	var startup pgproto.StartupMessage
+	if err := startup.Decode(startupMsg); err != nil {
+		log.Printf("[PostgreSQL] Malformed startup message (conn %d): %v", connID, err)
+		return
+	}
 
-	// Check for SSL request
-	if len(startupMsg) == 8 {
-		code := binary.BigEndian.Uint32(startupMsg[4:8])
-		if code == 80877103 { // SSLRequest
-			// Deny SSL
-			if _, err := client.Write([]byte{'N'}); err != nil {
-				return
-			}
-			// Read actual startup message
-			startupMsg, err = p.readStartupMessage(client)
+	// A cancel request arrives on a connection of its own
+	if startup.ProtocolVersion == pgproto.CancelRequestCode {
+		p.handleCancel(startupMsg)
+		return
+	}
+
+	// Check for SSL request, accepted by listeners with a certificate
+	tlsConfig, tlsRequired := p.listenerTLS(listener)
+	if startup.ProtocolVersion == pgproto.SSLRequestCode {
+		answer := byte('N')
+		if tlsConfig != nil {
+			answer = 'S'
+		}
+		if _, err := client.Write([]byte{answer}); err != nil {
+			return
+		}
+		if tlsConfig != nil {
+			tlsConn, err := tlsopt.Accept(conn, tlsConfig)
 			if err != nil {
+				log.Printf("[PostgreSQL] %v (conn %d)", err, connID)
 				return
 			}
+			client = watch.NewConn(conform.NewPostgreSQL(tlsConn, name, strict))
+			tlsRequired = false
+		}
+		// Read actual startup message
+		startupMsg, err = pgproto.ReadStartupMessage(client)
+		if err != nil {
+			return
+		}
+		if err := startup.Decode(startupMsg); err != nil {
+			log.Printf("[PostgreSQL] Malformed startup message (conn %d): %v", connID, err)
+			return
+		}
+		// Clients send their cancel requests over TLS too
+		if startup.ProtocolVersion == pgproto.CancelRequestCode {
+			p.handleCancel(startupMsg)
+			return
 		}
 	}
 
-	// Parse startup message to get user and database
-	params := p.parseStartupParams(startupMsg)
-	user := params["user"]
-	database := params["database"]
+	if tlsRequired {
+		log.Printf("[PostgreSQL] Plaintext client rejected by listener %s (conn %d)", listener, connID)
+		p.sendFatalError(client, "28000", "TLS is required on this listener")
+		return
+	}
+
+	// Get user and database from the startup parameters
+	user := startup.Params["user"]
+	database := startup.Params["database"]
 	if database == "" {
 		database = user
 	}
 
-	// Request cleartext password from client (AuthenticationCleartextPassword)
-	p.writeMessage(client, msgAuthentication, []byte{0, 0, 0, 3})
-
-	// Read password message from client
-	msgType, payload, err := p.readMessage(client)
+	// Authenticate the client, this yields the password for the backend
+	password, err := p.authenticate(client, user)
 	if err != nil {
-		log.Printf("[PostgreSQL] Password read error (conn %d): %v", connID, err)
-		return
-	}
-	if msgType != 'p' {
-		log.Printf("[PostgreSQL] Expected password message, got %c (conn %d)", msgType, connID)
-		p.sendError(client, "08P01", "expected password message")
+		log.Printf("[PostgreSQL] Authentication error for user %s (conn %d): %v", user, connID, err)
+		if errors.Is(err, errAuthFailed) {
+			p.sendFatalError(client, "28P01", fmt.Sprintf("password authentication failed for user \"%s\"", user))
+		} else if !errors.Is(err, io.EOF) {
+			p.sendFatalError(client, "08P01", err.Error())
+		}
 		return
 	}
 
-	// Password is null-terminated
-	password := string(payload)
-	if len(password) > 0 && password[len(password)-1] == 0 {
-		password = password[:len(password)-1]
-	}
-
 	// Determine backend pool based on database
 	p.mu.RLock()
 	backendName := p.config.DBMap[database]
@@ -269,162 +1065,376 @@ func (p *Proxy) handleConnection(client net.Conn, connID uint32) {
 		backendName = p.config.Default
 	}
 	pool := p.pools[backendName]
+	backendDB, replicaDB := p.config.ReplicaDatabases[database]
+	historySize := p.config.QueryHistory
+	rules := p.rules
 	p.mu.RUnlock()
 
+	// Users and databases denied by the proxy never reach the backend
+	err = rules.CheckUser(user)
+	if err == nil {
+		err = p.listenerRules(listener).CheckUser(user)
+	}
+	if err == nil {
+		err = rules.CheckDatabase(user, database)
+	}
+	if err == nil {
+		err = rules.CheckShard(user, backendName)
+	}
+	if err != nil {
+		log.Printf("[PostgreSQL] %v (conn %d)", err, connID)
+		p.sendFatalError(client, errorCode(err), err.Error())
+		return
+	}
+
 	if pool == nil {
 		log.Printf("[PostgreSQL] No pool found for database %s (backend %s)", database, backendName)
 		p.sendFatalError(client, "08006", "no backend pool configured")
 		return
 	}
 
-	// Connect to backend using the client's credentials
-	addr := pool.GetPrimary()
-	db, err := p.connectToBackend(addr, user, password, database)
+	// Connect to the primary with the client's credentials and startup
+	// parameters, or to a replica for a replica database
+	params := make(map[string]string, len(startup.Params))
+	for key, value := range startup.Params {
+		params[key] = value
+	}
+	params["database"] = database
+	addr, primaryName := pool.GetPrimary(), ""
+	if replicaDB {
+		params["database"] = backendDB
+		addr, primaryName = pool.GetReplica()
+	}
+	primary, err := p.dialBackend(addr, params, password)
 	if err != nil {
 		log.Printf("[PostgreSQL] Backend connection error (conn %d): %v", connID, err)
-		p.sendError(client, "08006", fmt.Sprintf("cannot connect to backend: %v", err))
+		var backendErr pgproto.ErrorResponse
+		switch {
+		case errors.As(err, &backendErr):
+			// Such as a wrong password, as the backend reported it
+			p.send(client, backendErr)
+		case errors.Is(err, limiter.ErrTooManyConnections):
+			p.sendFatalError(client, "53300", "sorry, too many clients already")
+		default:
+			p.sendFatalError(client, "08006", fmt.Sprintf("cannot connect to backend: %v", err))
+		}
 		return
 	}
-	defer db.Close()
 
 	// Use the global write batching manager (shared across all connections)
 	// This allows batching to consolidate queries from multiple concurrent connections
 	connWriteBatch := p.writeBatch
 
-	if err := db.Ping(); err != nil {
-		log.Printf("[PostgreSQL] Backend ping error (conn %d): %v", connID, err)
-		// Strip "pq: " prefix from error message to match native PostgreSQL
-		errMsg := err.Error()
-		if strings.HasPrefix(errMsg, "pq: ") {
-			errMsg = errMsg[4:]
-		}
-		p.sendFatalError(client, "28P01", errMsg)
-		return
-	}
-
-	// Send AuthenticationOk
-	p.writeMessage(client, msgAuthentication, []byte{0, 0, 0, 0})
-
-	// Send some parameter statuses
-	p.sendParameterStatus(client, "server_version", "16.0")
-	p.sendParameterStatus(client, "client_encoding", "UTF8")
-	p.sendParameterStatus(client, "DateStyle", "ISO, MDY")
-	p.sendParameterStatus(client, "TimeZone", "UTC")
-
-	// Send BackendKeyData (fake)
-	keyData := make([]byte, 8)
-	binary.BigEndian.PutUint32(keyData[0:4], connID)
-	binary.BigEndian.PutUint32(keyData[4:8], 12345)
-	p.writeMessage(client, msgBackendKeyData, keyData)
-
-	// Send ReadyForQuery
-	p.writeMessage(client, msgReadyForQuery, []byte{'I'})
+	// Cancel requests of the client are translated for the backend sessions
+	cancel := newCancelTarget()
+	cancel.add(addr, primary.key)
+	p.cancels.Store(connID, cancel)
+	defer p.cancels.Delete(connID)
+
+	// Send AuthenticationOk, the parameter statuses of the backend,
+	// BackendKeyData of the proxy session and ReadyForQuery
+	response := []pgproto.Encoder{pgproto.Authentication{Type: pgproto.AuthOK}}
+	names := make([]string, 0, len(primary.params))
+	for name := range primary.params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		response = append(response, pgproto.ParameterStatus{Name: name, Value: primary.params[name]})
+	}
+	response = append(response,
+		pgproto.BackendKeyData{ProcessID: connID, SecretKey: cancel.secret},
+		pgproto.ReadyForQuery{TxStatus: primary.txStatus},
+	)
+	p.send(client, response...)
 
 	// Handle messages
 	state := &connState{
+		connID:             connID,
+		clientAddr:         conn.RemoteAddr().String(),
+		lastAffectedRows:   -1,
 		shard:              backendName,
 		pool:               pool,
 		user:               user,
 		password:           password,
 		database:           database,
-		primaryDB:          db,
-		replicaDBs:         make(map[string]*sql.DB),
+		params:             params,
+		primaryAddr:        addr,
+		primaryName:        primaryName,
+		replicaDB:          replicaDB,
+		backends:           map[string]*backendConn{addr: primary},
+		cancel:             cancel,
 		preparedStatements: make(map[string]string),
+		paramOIDs:          make(map[string][]uint32),
 		boundParams:        make(map[string][]interface{}),
 		portalStatements:   make(map[string]string),
+		binds:              make(map[string]pgproto.Bind),
 		writeBatch:         connWriteBatch,
 		inTransaction:      false,
-	}
-	defer func() {
-		for _, rdb := range state.replicaDBs {
-			rdb.Close()
-		}
-	}()
-	p.handleMessages(client, db, connID, state)
+		history:            history.NewRing(historySize),
+	}
+	if state.history != nil {
+		defer p.histories.Register(&history.Conn{
+			ID:      connID,
+			Addr:    conn.RemoteAddr().String(),
+			User:    user,
+			Started: time.Now(),
+			History: state.history,
+		})()
+	}
+	defer closeBackends(state)
+	p.handleMessages(client, connID, state)
 }
 
 func (p *Proxy) connectToBackend(addr, user, password, database string) (*sql.DB, error) {
-	dsn := fmt.Sprintf("host=%s port=5432 user=%s password=%s dbname=%s sslmode=disable",
-		"127.0.0.1", user, password, database)
+	credentials := fmt.Sprintf("user=%s password=%s dbname=%s %s",
+		dsnQuote(user), dsnQuote(password), dsnQuote(database), p.sslParams(addr))
+	dsn := "host=127.0.0.1 port=5432 " + credentials
 
 	if len(addr) > 5 && addr[:5] == "unix:" {
-		dsn = fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
-			addr[5:], user, password, database)
+		dsn = fmt.Sprintf("host=%s %s", dsnQuote(addr[5:]), credentials)
 	} else if h, prt, err := net.SplitHostPort(addr); err == nil {
-		dsn = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-			h, prt, user, password, database)
+		dsn = fmt.Sprintf("host=%s port=%s %s", dsnQuote(h), prt, credentials)
+	} else if addr != "" {
+		dsn = fmt.Sprintf("host=%s port=5432 %s", dsnQuote(addr), credentials)
 	}
-	return sql.Open("postgres", dsn)
+	return p.openBackend(dsn)
+}
+
+// dsnQuote quotes a value for a key=value connection string, so that
+// passwords may contain spaces, quotes and backslashes
+func dsnQuote(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
 }
 
-func (p *Proxy) parseStartupParams(msg []byte) map[string]string {
-	params := make(map[string]string)
-	if len(msg) < 8 {
-		return params
+// setProxyVariable sets a session variable of the proxy
+func (p *Proxy) setProxyVariable(state *connState, name, value string) error {
+	switch name {
+	case "tqdb_ordered_writes":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		state.writeOrder = nil
+		if on {
+			state.writeOrder = &writebatch.Sequence{}
+		}
+		return nil
+	case "tqdb_keep_comments":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		state.keepComments = on
+		return nil
+	case "tqdb_verbose":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		state.verbose = on
+		return nil
+	case "tqdb_snapshot":
+		on, err := parser.ParseSwitch(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if on {
+			return p.startSnapshot(state)
+		}
+		return p.endSnapshot(state)
+	}
+	return fmt.Errorf("unknown proxy variable %s", name)
+}
+
+var (
+	// errSnapshotActive is returned for transaction statements in a snapshot
+	errSnapshotActive = errors.New("a snapshot is active, end it with SET tqdb_snapshot = OFF")
+	// errSnapshotLost is returned for the statements of a snapshot whose
+	// backend connection was lost
+	errSnapshotLost = errors.New("the snapshot is no longer available, end it with SET tqdb_snapshot = OFF")
+)
+
+// startSnapshot starts a read-only repeatable read transaction on a replica,
+// which the statements of the session stay on, without the cache, until
+// endSnapshot
+func (p *Proxy) startSnapshot(state *connState) error {
+	if state.snapshot != "" {
+		return nil
+	}
+	if state.inTransaction {
+		return errors.New("tqdb_snapshot: cannot start a snapshot in a transaction")
+	}
+	// Batched writes of this connection must commit before the snapshot
+	// starts, or it would not see them
+	state.writeFence.Wait(context.Background())
+	addr, name := state.pool.GetReplica()
+	if name == "primary" {
+		addr, name = primaryBackend(state)
 	}
-	// Skip length (4 bytes) and protocol version (4 bytes)
-	data := msg[4:]
-	if len(data) < 4 {
-		return params
+	b, err := p.backend(state, addr)
+	if err != nil {
+		return err
+	}
+	response, err := b.exchange(nil, pgproto.Query{String: "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY"}.Encode(nil), false, nil)
+	if err != nil {
+		b.Close()
+		delete(state.backends, addr)
+		state.cancel.remove(addr)
+		return err
+	}
+	if err := responseError(response); err != nil {
+		return err
 	}
-	data = data[4:] // Skip protocol version
+	state.snapshot, state.snapshotName = addr, name
+	state.inTransaction = true
+	return nil
+}
 
-	// Parse null-terminated key-value pairs
-	for len(data) > 0 {
-		// Find key
-		keyEnd := bytes.IndexByte(data, 0)
-		if keyEnd <= 0 {
-			break
-		}
-		key := string(data[:keyEnd])
-		data = data[keyEnd+1:]
+// endSnapshot commits the transaction of a snapshot, when its backend
+// connection is still there
+func (p *Proxy) endSnapshot(state *connState) error {
+	if state.snapshot == "" {
+		return nil
+	}
+	b := state.backends[state.snapshot]
+	state.snapshot, state.snapshotName = "", ""
+	state.inTransaction = false
+	if b == nil {
+		return nil
+	}
+	response, err := b.exchange(nil, pgproto.Query{String: "COMMIT"}.Encode(nil), false, nil)
+	if err != nil {
+		return err
+	}
+	endTransaction(state, b, response)
+	return responseError(response)
+}
 
-		// Find value
-		valEnd := bytes.IndexByte(data, 0)
-		if valEnd < 0 {
-			break
-		}
-		value := string(data[:valEnd])
-		data = data[valEnd+1:]
+// backendQuery returns the query text to send to the backend: without hint
+// comments, or as sent by the client when the session keeps comments, and
+// annotated with the proxy identity when configured
+func (p *Proxy) backendQuery(state *connState, parsed *parser.ParsedQuery) string {
+	query := parsed.Query
+	if state.keepComments {
+		query = parsed.Raw
+	}
+	return p.annotator.Annotate(query, annotate.Session{
+		ConnID:   state.connID,
+		User:     state.user,
+		Database: state.database,
+		Shard:    state.shard,
+	})
+}
 
-		params[key] = value
+// watchClient watches the client for a disconnect while the proxy waits on
+// its behalf, see watch.Conn.Watch. Unwrapped connections are not watched.
+func watchClient(client net.Conn, onAbort func()) func() bool {
+	wc, ok := unbuffered(client).(*watch.Conn)
+	if !ok {
+		return func() bool { return false }
 	}
-	return params
+	return wc.Watch(onAbort)
+}
+
+// isBackendConnError returns true for errors caused by a failing backend
+// connection, as opposed to errors in the query itself
+func isBackendConnError(err error) bool {
+	var backendErr pgproto.ErrorResponse
+	if errors.As(err, &backendErr) {
+		// Connection exceptions and server shutdown
+		return strings.HasPrefix(backendErr.Code, "08") || backendErr.Code == "57P01" || backendErr.Code == "57P02" || backendErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, limiter.ErrTooManyConnections) || errors.As(err, &netErr)
+}
+
+// readyIdle is the ReadyForQuery message sent outside of transactions
+var readyIdle = pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}
+
+// send writes messages to the client in a single write
+func (p *Proxy) send(client net.Conn, msgs ...pgproto.Encoder) error {
+	var buf []byte
+	for _, m := range msgs {
+		buf = m.Encode(buf)
+	}
+	_, err := client.Write(buf)
+	return err
 }
 
-func (p *Proxy) sendParameterStatus(client net.Conn, name, value string) {
-	payload := append([]byte(name), 0)
-	payload = append(payload, []byte(value)...)
-	payload = append(payload, 0)
-	p.writeMessage(client, msgParameterStatus, payload)
+// errorCode returns the SQLSTATE sent for an error of a query
+func errorCode(err error) string {
+	var backendErr pgproto.ErrorResponse
+	switch {
+	case errors.As(err, &backendErr):
+		return backendErr.Code
+	case errors.Is(err, quota.ErrExceeded), errors.Is(err, throttle.ErrThrottled):
+		return "53400" // configuration_limit_exceeded
+	case errors.Is(err, acl.ErrUserDenied):
+		return "28000" // invalid_authorization_specification
+	case errors.Is(err, acl.ErrDatabaseDenied):
+		return "42501" // insufficient_privilege
+	case errors.Is(err, acl.ErrReadOnly):
+		return "25006" // read_only_sql_transaction
+	case isBackendConnError(err):
+		return "08006" // connection_failure
+	case errors.Is(err, errResultTypeChanged):
+		return "0A000" // feature_not_supported
+	}
+	return "42000"
 }
 
 func (p *Proxy) sendError(client net.Conn, code, message string) {
-	p.sendErrorWithSeverity(client, "ERROR", code, message)
+	p.send(client, pgproto.ErrorResponse{Severity: "ERROR", Code: code, Message: message})
 }
 
 func (p *Proxy) sendFatalError(client net.Conn, code, message string) {
-	p.sendErrorWithSeverity(client, "FATAL", code, message)
+	p.send(client, pgproto.ErrorResponse{Severity: "FATAL", Code: code, Message: message})
 }
 
-func (p *Proxy) sendErrorWithSeverity(client net.Conn, severity, code, message string) {
-	var payload bytes.Buffer
-	payload.WriteByte('S') // Severity
-	payload.WriteString(severity)
-	payload.WriteByte(0)
-	payload.WriteByte('C') // Code
-	payload.WriteString(code)
-	payload.WriteByte(0)
-	payload.WriteByte('M') // Message
-	payload.WriteString(message)
-	payload.WriteByte(0)
-	payload.WriteByte(0) // Terminator
-	p.writeMessage(client, msgErrorResponse, payload.Bytes())
+// sendNotice sends a NoticeResponse with severity WARNING
+func (p *Proxy) sendNotice(client net.Conn, code, message string) {
+	p.send(client, pgproto.NoticeResponse{Severity: "WARNING", Code: code, Message: message})
 }
 
-func (p *Proxy) handleMessages(client net.Conn, db *sql.DB, connID uint32, state *connState) {
+// sendVerbose sends a NoticeResponse with severity NOTICE describing the
+// routing of a statement, when the session has SET tqdb.verbose = on
+func (p *Proxy) sendVerbose(client net.Conn, state *connState, format string, args ...any) {
+	if !state.verbose {
+		return
+	}
+	p.send(client, pgproto.NoticeResponse{Severity: "NOTICE", Code: "00000", Message: "tqdb: " + fmt.Sprintf(format, args...)})
+}
+
+// forwardedRoute describes where a statement that was not served by the cache
+// or the write batch manager was executed, for verbose sessions. The ttl is 0
+// when the result is not cached.
+func forwardedRoute(state *connState, parsed *parser.ParsedQuery, tableBackend string, ttl time.Duration, backendName string) string {
+	backend := state.shard
+	if name := parsed.RouteBackend(); name != "" && !state.inTransaction {
+		backend = name
+	} else if tableBackend != "" && !state.inTransaction {
+		backend = tableBackend
+	}
+	route := fmt.Sprintf("executed on %s of backend %s", backendName, backend)
+	if ttl > 0 {
+		route = fmt.Sprintf("cache miss (ttl %s), %s", ttl, route)
+	}
+	if parsed.IsWritable() && parsed.BatchMs > 0 {
+		if state.inTransaction {
+			route += ", not batched in a transaction"
+		} else {
+			route += ", not batched"
+		}
+	}
+	return route
+}
+
+func (p *Proxy) handleMessages(client net.Conn, connID uint32, state *connState) {
+	pl := &pipeline{Conn: client}
 	for {
-		msgType, payload, err := p.readMessage(client)
+		msgType, payload, err := pgproto.ReadMessage(client)
 		if err != nil {
 			if err != io.EOF && !isConnectionReset(err) {
 				log.Printf("[PostgreSQL] Read error (conn %d): %v", connID, err)
@@ -432,54 +1442,76 @@ func (p *Proxy) handleMessages(client net.Conn, db *sql.DB, connID uint32, state
 			return
 		}
 
+		// After an error in the extended query protocol the messages are
+		// discarded until Sync, as by the server
+		if pl.failed && msgType != pgproto.MsgSync && msgType != pgproto.MsgTerminate {
+			continue
+		}
+
 		switch msgType {
-		case msgQuery:
-			p.handleQuery(payload, client, db, state)
-		case msgParse:
-			if err := p.handleParse(payload, client, state); err != nil {
+		case pgproto.MsgQuery:
+			if err := pl.Flush(); err != nil {
+				return
+			}
+			p.handleQuery(payload, client, state)
+		case pgproto.MsgParse:
+			if err := p.handleParse(payload, pl, state); err != nil {
 				log.Printf("[PostgreSQL] Parse error (conn %d): %v", connID, err)
-				p.sendError(client, "42000", err.Error())
-				p.writeMessage(client, msgReadyForQuery, []byte{'I'})
+				p.sendError(pl, errorCode(err), err.Error())
 			}
-		case msgBind:
-			if err := p.handleBind(payload, client, state); err != nil {
+		case pgproto.MsgBind:
+			if err := p.handleBind(payload, pl, state); err != nil {
 				log.Printf("[PostgreSQL] Bind error (conn %d): %v", connID, err)
-				p.sendError(client, "42000", err.Error())
-				p.writeMessage(client, msgReadyForQuery, []byte{'I'})
+				p.sendError(pl, "42000", err.Error())
 			}
-		case msgDescribe:
-			if err := p.handleDescribe(payload, client, state); err != nil {
+		case pgproto.MsgDescribe:
+			if err := p.handleDescribe(payload, pl, state); err != nil {
 				log.Printf("[PostgreSQL] Describe error (conn %d): %v", connID, err)
-				p.sendError(client, "42000", err.Error())
+				p.sendError(pl, errorCode(err), err.Error())
 			}
-		case msgExecute:
-			if err := p.handleExecute(payload, client, db, connID, state); err != nil {
+		case pgproto.MsgExecute:
+			if err := p.handleExecute(payload, pl, connID, state); err != nil {
+				if errors.Is(err, watch.ErrClientAborted) {
+					return
+				}
 				log.Printf("[PostgreSQL] Execute error (conn %d): %v", connID, err)
-				p.sendError(client, "42000", err.Error())
+				p.sendError(pl, errorCode(err), err.Error())
 			}
-		case 'C': // Close
-			p.handleClose(payload, client, state)
-		case msgSync:
-			// Send ReadyForQuery
-			p.writeMessage(client, msgReadyForQuery, []byte{'I'})
-		case msgTerminate:
+		case pgproto.MsgClose:
+			p.handleClose(payload, pl, state)
+		case pgproto.MsgSync:
+			// Send ReadyForQuery with the responses of the pipeline
+			pl.failed = false
+			p.send(pl, ready(state))
+			if err := pl.Flush(); err != nil {
+				return
+			}
+		case pgproto.MsgFlush:
+			if err := pl.Flush(); err != nil {
+				return
+			}
+		case pgproto.MsgTerminate:
 			return
 		default:
 			// For unhandled messages, send ReadyForQuery
-			p.writeMessage(client, msgReadyForQuery, []byte{'I'})
+			p.send(pl, ready(state))
+			if err := pl.Flush(); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func (p *Proxy) handleQuery(payload []byte, client net.Conn, db *sql.DB, state *connState) {
+func (p *Proxy) handleQuery(payload []byte, client net.Conn, state *connState) {
 	start := time.Now()
 
-	// Query is null-terminated string
-	queryBytes := payload
-	if len(queryBytes) > 0 && queryBytes[len(queryBytes)-1] == 0 {
-		queryBytes = queryBytes[:len(queryBytes)-1]
+	var msg pgproto.Query
+	if err := msg.Decode(payload); err != nil {
+		p.sendError(client, "08P01", err.Error())
+		p.send(client, ready(state))
+		return
 	}
-	query := string(queryBytes)
+	query := msg.String
 
 	// Check for TQDB status query (PostgreSQL style: pg_tqdb_status)
 	queryUpper := strings.ToUpper(strings.TrimSpace(query))
@@ -487,16 +1519,71 @@ func (p *Proxy) handleQuery(payload []byte, client net.Conn, db *sql.DB, state *
 		p.handleShowTQDBStatus(client, state)
 		return
 	}
+	if strings.Contains(queryUpper, "PG_TQDB_HISTORY") {
+		p.handleShowTQDBHistory(client, state)
+		return
+	}
+	if strings.Contains(queryUpper, "PG_TQDB_SLOW_QUERIES") {
+		p.handleShowTQDBSlowQueries(client, state)
+		return
+	}
+	if strings.Contains(queryUpper, "PG_TQDB_FLUSH") {
+		p.handleTQDBFlush(client, state)
+		return
+	}
+	if pattern, ok := parser.ParsePgCachePurge(query); ok {
+		p.handleTQDBCachePurge(client, state, pattern)
+		return
+	}
+
+	// Record the statement in the history when it was answered
+	var queryErr error
+	state.routed = false
+	defer func() { p.recordHistory(state, query, start, queryErr) }()
+
+	// Writes of read-only users never reach the backend
+	if err := p.checkStatement(state, query); err != nil {
+		queryErr = err
+		p.sendError(client, errorCode(err), err.Error())
+		p.send(client, ready(state))
+		return
+	}
 
-	// Track transaction state
-	if queryUpper == "BEGIN" || strings.HasPrefix(queryUpper, "BEGIN ") || queryUpper == "START TRANSACTION" {
+	parsed := p.applyOverrides(parser.Parse(query))
+
+	// Statements on routed tables run on the backend of their tables
+	tableBackend, err := p.route(state, parsed)
+	if err != nil {
+		queryErr = err
+		p.sendError(client, errorCode(err), err.Error())
+		p.send(client, ready(state))
+		return
+	}
+
+	// A snapshot is a transaction of the proxy, that the client ends with
+	// SET tqdb_snapshot = OFF. Savepoints are part of the transaction.
+	tx, _ := parser.ParseTransaction(parsed.Query)
+	begin := tx.Op == parser.TxBegin
+	end := (tx.Op == parser.TxCommit || tx.Op == parser.TxRollback) && !tx.Chain
+	if state.snapshot != "" && (begin || tx.Op == parser.TxCommit || tx.Op == parser.TxRollback) {
+		queryErr = errSnapshotActive
+		p.sendError(client, "25001", queryErr.Error()) // active_sql_transaction
+		p.send(client, ready(state))
+		return
+	}
+
+	// Track transaction state, which queryOn corrects with the status of the
+	// backend
+	if begin {
+		// Batched writes of this connection must commit before the
+		// transaction starts, or they could commit after it
+		state.writeFence.Wait(context.Background())
 		state.inTransaction = true
-	} else if queryUpper == "COMMIT" || queryUpper == "ROLLBACK" {
+	} else if end {
 		state.inTransaction = false
+		state.lastWrite = time.Now()
 	}
 
-	parsed := parser.Parse(query)
-
 	file := parsed.File
 	if file == "" {
 		file = "unknown"
@@ -507,33 +1594,156 @@ func (p *Proxy) handleQuery(payload []byte, client net.Conn, db *sql.DB, state *
 	}
 	queryType := queryTypeLabel(parsed.Type)
 
+	// Session variables of the proxy itself (SET tqdb_...)
+	if name, value, ok := parser.ParseProxySet(parsed.Query); ok {
+		if err := p.setProxyVariable(state, name, value); err != nil {
+			p.sendError(client, "22023", err.Error())
+		} else {
+			p.send(client, pgproto.CommandComplete{Tag: "SET"})
+		}
+		p.send(client, ready(state))
+		return
+	}
+
+	// Kill switches of the proxy (SET GLOBAL tqdb_...), for admin users
+	if name, value, ok := parser.ParseProxySetGlobal(parsed.Query); ok {
+		p.mu.RLock()
+		admin := slices.Contains(p.config.AdminUsers, state.user)
+		switches := p.switches
+		p.mu.RUnlock()
+		if !admin {
+			p.sendError(client, "42501", fmt.Sprintf("permission denied: user %q is not in admin_users for SET GLOBAL %s", state.user, name))
+		} else if on, err := parser.ParseSwitch(value); err != nil {
+			p.sendError(client, "22023", fmt.Sprintf("%s: %v", name, err))
+		} else if err := switches.Set(strings.TrimPrefix(name, "tqdb_"), on, fmt.Sprintf("%s@%s (PostgreSQL)", state.user, client.RemoteAddr())); err != nil {
+			p.sendError(client, "22023", err.Error())
+		} else {
+			p.send(client, pgproto.CommandComplete{Tag: "SET"})
+		}
+		p.send(client, ready(state))
+		return
+	}
+
+	// Queries served by the cache or a backend count against the qps budget
+	// and the throttle limits
+	if err := p.quotas.Allow(state.database); err != nil {
+		queryErr = err
+		p.sendError(client, errorCode(err), err.Error())
+		p.send(client, ready(state))
+		return
+	}
+	release, err := p.throttle.Acquire(state.clientAddr, state.user, state.shard)
+	if err != nil {
+		queryErr = err
+		p.sendError(client, errorCode(err), err.Error())
+		p.send(client, ready(state))
+		return
+	}
+	defer release()
+	state.routed = true
+
+	// LISTEN and UNLISTEN run on the listener connection of the session
+	if channel, listen, ok := parser.ParseListen(parsed.Query); ok {
+		state.lastBackend = "primary"
+		state.lastCacheHit = false
+		response, err := p.listen(client, state, parsed.Query, channel, listen)
+		if err != nil {
+			queryErr = err
+			p.sendError(client, errorCode(err), err.Error())
+			p.send(client, ready(state))
+			return
+		}
+		queryErr = responseError(response)
+		if _, err := client.Write(ready(state).Encode(response)); err != nil {
+			log.Printf("[PostgreSQL] Client write error: %v", err)
+		}
+		return
+	}
+
+	// currval() and lastval() of sequences used by batched inserts
+	if fn, sequence, ok := parser.ParseSequenceCall(parsed.Query); ok {
+		if value, ok, err := state.sequences.lookup(fn, sequence); ok {
+			state.lastBackend = "write-batch"
+			state.lastCacheHit = false
+			if err != nil {
+				queryErr = err
+				p.send(client, errSequenceBatched, ready(state))
+				return
+			}
+			field := pgproto.FieldDescription{Name: fn, TypeOID: pgproto.OIDInt8, TypeSize: 8, TypeModifier: -1, Format: pgproto.FormatText}
+			p.send(client, pgproto.RowDescription{Fields: []pgproto.FieldDescription{field}}, sequenceRow(value, pgproto.Bind{}),
+				pgproto.CommandComplete{Tag: "SELECT 1"}, ready(state))
+			return
+		}
+	}
+
+	// Serve schema metadata queries from the metadata cache (opt-in)
+	isMetadata := p.metaCache != nil && !state.inTransaction && !parsed.IsCacheable() && parsed.Route == "" && parsed.IsMetadata() && p.enabled(killswitch.Cache)
+	if isMetadata {
+		if cached, ok := p.metaCache.Get(state.database, parsed.Query); ok {
+			metrics.CacheHits.WithLabelValues(file, line).Inc()
+			metrics.QueryTotal.WithLabelValues(file, line, queryType, "true").Inc()
+			metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
+			state.lastBackend = "cache (metadata)"
+			state.lastCacheHit = true
+			p.sendVerbose(client, state, "served by the metadata cache")
+			if _, err := client.Write(cached); err != nil {
+				log.Printf("[PostgreSQL] Cache response error: %v", err)
+			}
+			return
+		}
+	}
+
+	// Micro-cache SELECTs without a ttl or route hint that repeat at a high
+	// rate. Cache keys include the backend of routed tables, results of
+	// backends named by route hints are not cached.
+	ttl := time.Duration(parsed.TTL) * time.Second
+	if parsed.TTL == 0 && parsed.Route == "" && !isMetadata && !state.inTransaction && parsed.IsRepeatable() && p.enabled(killswitch.Cache) {
+		ttl = p.booster.Observe(parsed.Query)
+	}
+	negTTL := p.negativeTTL(parsed)
+	// Transactions (and snapshots) read their own state, not the cache
+	cacheable := parsed.Type == parser.QuerySelect && (ttl > 0 || negTTL > 0) && parsed.RouteBackend() == "" && !state.inTransaction
+	var cacheKey string
+	if cacheable {
+		cacheKey = backendKey(tableBackend, p.cacheKey(parsed.Query))
+	}
+
 	// Check cache with thundering herd protection
-	if parsed.IsCacheable() {
-		cached, flags, ok := p.cache.Get(parsed.Query)
+	if cacheable {
+		cached, flags, ok := p.cache.Get(cacheKey)
 		if ok {
 			if flags == cache.FlagFresh {
 				// Fresh cache hit - serve immediately
 				metrics.CacheHits.WithLabelValues(file, line).Inc()
+				p.cache.Stats().RecordHit(parsed.Query)
 				metrics.QueryTotal.WithLabelValues(file, line, queryType, "true").Inc()
 				metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 				state.lastBackend = "cache"
 				state.lastCacheHit = true
+				p.sendVerbose(client, state, "cache hit")
 				if _, err := client.Write(cached); err != nil {
 					log.Printf("[PostgreSQL] Cache response error: %v", err)
+					return
 				}
+				p.verifyCacheHit(state, parsed, tableBackend, cached, "fresh")
 				return
 			}
 
 			if flags == cache.FlagStale {
 				// Stale but another request is already refreshing - serve stale
 				metrics.CacheHits.WithLabelValues(file, line).Inc()
+				p.cache.Stats().RecordHit(parsed.Query)
 				metrics.QueryTotal.WithLabelValues(file, line, queryType, "true").Inc()
 				metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 				state.lastBackend = "cache (stale)"
 				state.lastCacheHit = true
+				p.sendVerbose(client, state, "cache hit (stale, refreshed by another query)")
 				if _, err := client.Write(cached); err != nil {
 					log.Printf("[PostgreSQL] Cache response error: %v", err)
+					return
 				}
+				p.verifyCacheHit(state, parsed, tableBackend, cached, "stale")
 				return
 			}
 
@@ -543,12 +1753,14 @@ func (p *Proxy) handleQuery(payload []byte, client net.Conn, db *sql.DB, state *
 		metrics.CacheMisses.WithLabelValues(file, line).Inc()
 
 		// Cold cache or stale refresh: use single-flight pattern
-		cached, _, ok, waited := p.cache.GetOrWait(parsed.Query)
+		cached, _, ok, waited := p.cache.GetOrWait(cacheKey)
 		if waited && ok {
 			// Another goroutine fetched it for us
 			metrics.CacheHits.WithLabelValues(file, line).Inc()
+			p.cache.Stats().RecordHit(parsed.Query)
 			state.lastBackend = "cache"
 			state.lastCacheHit = true
+			p.sendVerbose(client, state, "cache hit (after waiting for the same query)")
 			if _, err := client.Write(cached); err != nil {
 				log.Printf("[PostgreSQL] Cache response error: %v", err)
 			}
@@ -557,26 +1769,73 @@ func (p *Proxy) handleQuery(payload []byte, client net.Conn, db *sql.DB, state *
 		// We need to fetch from DB (either first request or waited but still miss)
 	}
 
-	// Check if write batching should be used
-	if state.writeBatch != nil && !state.inTransaction && parsed.IsWritable() && parsed.IsBatchable() {
+	// Check if write batching should be used, with the write batch manager
+	// of the backend of the tables
+	wb := p.batchManager(state, tableBackend)
+	if wb != nil && !state.inTransaction && parsed.IsWritable() && parsed.IsBatchable() && parsed.RouteBackend() == "" && !p.guardBatch(parsed) {
 		// Use write batching
+		if hinted, clamped := p.clampBatch(parsed, state.shard); clamped {
+			p.sendNotice(client, "01000", fmt.Sprintf("batch hint of %dms clamped to %dms", hinted, parsed.BatchMs))
+		}
 		batchKey := parsed.GetBatchKey()
 		batchMs := parsed.BatchMs
+		batchQuery, params := parsed.Query, []interface{}{}
+		if normalized, values, ok := p.normalizeWrite(parsed.Query); ok {
+			batchQuery, params = normalized, values
+			batchKey = parser.Parse(normalized).GetBatchKey()
+		}
+		release, err := p.quotas.AcquireWrite(state.database)
+		if err != nil {
+			queryErr = err
+			p.sendError(client, errorCode(err), err.Error())
+			p.send(client, ready(state))
+			return
+		}
 
-		// Enqueue the write (blocks until result is available)
-		ctx := context.Background()
-		result := state.writeBatch.Enqueue(ctx, batchKey, parsed.Query, []interface{}{}, batchMs, func(batchSize int) {
+		durability, ok := p.durability(parsed)
+		if !ok {
+			p.sendNotice(client, "01000", "durability hint ignored, the table is not in relaxed_durability_tables")
+		}
+		ctx := writebatch.WithMaxBatchSize(writebatch.WithDurability(context.Background(), durability), parsed.BatchMax)
+
+		// Acknowledge the write before its batch executed, unless too many
+		// async writes are pending
+		if parsed.Ack == parser.AckEarly {
+			err := wb.EnqueueAsync(ctx, &state.writeFence, state.writeOrder, batchKey, batchQuery, params, batchMs, func(result writebatch.WriteResult) {
+				release()
+				p.recordBatch(parsed.Query, result.Error)
+			})
+			if err == nil {
+				p.send(client, p.ackEarly(client, state, parsed, start, file, line, queryType), ready(state))
+				return
+			}
+		}
+		defer release()
+
+		// Enqueue the write (blocks until result is available, or the client
+		// disconnects, which withdraws it from the batch)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := watchClient(client, cancel)
+		result := wb.EnqueueFenced(ctx, &state.writeFence, state.writeOrder, batchKey, batchQuery, params, batchMs, func(batchSize int) {
 			// Update this connection's batch size when batch completes
 			state.lastBatchSize = batchSize
 		})
+		if stop() {
+			metrics.ClientAborts.WithLabelValues("batch_wait").Inc()
+			log.Printf("[PostgreSQL] Client disconnected during batch window")
+			return
+		}
+		p.recordBatch(parsed.Query, result.Error)
 
 		// Update metrics
 		metrics.QueryTotal.WithLabelValues(file, line, queryType, "false").Inc()
 		metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 
 		if result.Error != nil {
+			queryErr = result.Error
 			p.sendError(client, "42000", result.Error.Error())
-			p.writeMessage(client, msgReadyForQuery, []byte{'I'})
+			p.send(client, ready(state))
 			return
 		}
 
@@ -584,491 +1843,785 @@ func (p *Proxy) handleQuery(payload []byte, client net.Conn, db *sql.DB, state *
 		state.lastBackend = "write-batch"
 		state.lastCacheHit = false
 		state.lastBatchSize = result.BatchSize
+		state.lastAffectedRows = result.AffectedRows
+		trackInsert(state, parsed, true, result.ReturningCols, result.ReturningRows)
+		state.lastWrite = time.Now()
+		p.sendVerbose(client, state, "batched write with a %dms window, executed in a batch of %d", batchMs, result.BatchSize)
 
 		// Success - send result to client
-		var response bytes.Buffer
+		var response []pgproto.Encoder
 
 		// Check if query has RETURNING clause
-		if len(result.ReturningValues) > 0 {
-			// RETURNING query - send row data
-			cols := []string{"id"} // TODO: extract column name from query
-			rowDesc := p.buildRowDescription(cols)
-			response.Write(rowDesc)
-
-			// Send the returned value as a DataRow
-			textValues := make([]interface{}, len(result.ReturningValues))
-			for i, v := range result.ReturningValues {
-				textValues[i] = fmt.Sprintf("%v", v)
+		if len(result.ReturningCols) > 0 {
+			// RETURNING query - send row data, in the types of the columns
+			desc := returningDescription(result, pgproto.Bind{})
+			response = append(response, desc)
+			for _, values := range result.ReturningRows {
+				row, err := returningRow(desc.Fields, values)
+				if err != nil {
+					p.sendError(client, "XX000", err.Error())
+					p.send(client, ready(state))
+					return
+				}
+				response = append(response, row)
 			}
-			dataRow := p.buildDataRow(textValues)
-			response.Write(dataRow)
-
-			// Send CommandComplete with row count
-			cmdPayload := append([]byte(fmt.Sprintf("INSERT 0 1")), 0)
-			response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
-		} else {
-			// Non-RETURNING query - send CommandComplete
-			cmdPayload := append([]byte(fmt.Sprintf("INSERT 0 %d", result.AffectedRows)), 0)
-			response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
 		}
+		response = append(response, pgproto.CommandComplete{Tag: writeTag(parsed, result.AffectedRows)})
 
 		// Send ReadyForQuery
-		response.Write(p.encodeMessage(msgReadyForQuery, []byte{'I'}))
+		response = append(response, ready(state))
 
 		// Send response to client
-		if _, err := client.Write(response.Bytes()); err != nil {
+		if err := p.send(client, response...); err != nil {
 			log.Printf("[PostgreSQL] Client write error: %v", err)
 		}
 
 		return
 	}
 
-	// Execute query
-	var response bytes.Buffer
-
-	// Select backend
-	targetDB := state.primaryDB
-	backendName := "primary"
-
-	if parsed.IsCacheable() {
-		addr, name := state.pool.GetReplica()
-		if name != "primary" {
-			backendName = name
-			rdb := state.replicaDBs[addr]
-			if rdb == nil {
-				var err error
-				rdb, err = p.connectToBackend(addr, state.user, state.password, state.database)
-				if err != nil {
-					log.Printf("[PostgreSQL] Error connecting to replica %s: %v", addr, err)
-				} else {
-					state.replicaDBs[addr] = rdb
-				}
-			}
-			if rdb != nil {
-				targetDB = rdb
-			}
+	// Writes that are not batched count against the immediate write limit
+	if parsed.IsWritable() {
+		release, err := p.acquireWriteSlot(state)
+		if err != nil {
+			queryErr = err
+			p.sendError(client, "53000", err.Error())
+			p.send(client, ready(state))
+			return
 		}
+		defer release()
 	}
 
-	rows, err := targetDB.Query(parsed.Query)
+	// Forward the query, a client that disconnects while waiting closes the
+	// backend connection
+	msgs := pgproto.Query{String: p.backendQuery(state, parsed)}.Encode(nil)
+	response, backendName, err := p.queryBackend(client, state, parsed, msgs, false)
+	if errors.Is(err, watch.ErrClientAborted) {
+		if cacheable {
+			p.cache.CancelInflight(cacheKey)
+		}
+		metrics.ClientAborts.WithLabelValues("query").Inc()
+		log.Printf("[PostgreSQL] Client disconnected during query")
+		return
+	}
 	if err != nil {
 		// Cancel inflight if we were the first request
-		if parsed.IsCacheable() {
-			p.cache.CancelInflight(parsed.Query)
+		if cacheable {
+			p.cache.CancelInflight(cacheKey)
 		}
 		// Send error response
-		p.sendError(client, "42000", err.Error())
-		p.writeMessage(client, msgReadyForQuery, []byte{'I'})
+		queryErr = err
+		p.sendError(client, errorCode(err), err.Error())
+		p.send(client, ready(state))
 		return
 	}
-	defer rows.Close()
+	queryErr = responseError(response)
+
+	// Track state
+	state.lastBackend = backendName
+	state.lastCacheHit = false
+	state.lastAffectedRows = affectedRows(response)
 
-	// Get column info
-	cols, _ := rows.Columns()
-	if len(cols) > 0 {
-		// Send RowDescription
-		rowDesc := p.buildRowDescription(cols)
-		response.Write(rowDesc)
+	metrics.DatabaseQueries.WithLabelValues(backendName).Inc()
+	metrics.QueryTotal.WithLabelValues(file, line, queryType, "false").Inc()
+	metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 
-		// Send data rows
-		values := make([]interface{}, len(cols))
-		valuePtrs := make([]interface{}, len(cols))
-		for i := range values {
-			valuePtrs[i] = &values[i]
+	if queryErr == nil {
+		trackInsert(state, parsed, false, nil, nil)
+		// Schema changes make cached metadata stale
+		if parsed.IsDDL() {
+			p.invalidateSchema(parsed)
 		}
+		if isMetadata && response != nil {
+			p.metaCache.Set(state.database, parsed.Query, response)
+		}
+	}
 
-		rowCount := 0
-		for rows.Next() {
-			rows.Scan(valuePtrs...)
-			dataRow := p.buildDataRow(values)
-			response.Write(dataRow)
-			rowCount++
+	// Cache response if cacheable - use SetAndNotify for single-flight.
+	// Spilled responses (nil, already sent) are not cached, see cacheTTL for
+	// empty results and errors.
+	var storeTTL time.Duration
+	if cacheable && response != nil {
+		storeTTL = cacheTTL(response, ttl, negTTL, true)
+	}
+	if storeTTL > 0 {
+		p.cache.SetAndNotifyFor(p.quotas, state.database, cacheKey, response, storeTTL)
+		p.cache.Track(cacheKey, parsed.Tables)
+		p.cache.Stats().RecordMiss(parsed.Query, time.Since(start))
+		// Results of ttl hints may be refreshed in the background, not
+		// micro-cached results
+		if parsed.TTL > 0 {
+			p.cache.SetRefresh(cacheKey, p.refreshFunc(state, parsed, ttl, negTTL))
+		}
+	} else if cacheable {
+		p.cache.CancelInflight(cacheKey)
+	}
+
+	// Send response to client, a ttl without caching is not reported
+	p.sendVerbose(client, state, "%s", forwardedRoute(state, parsed, tableBackend, storeTTL, backendName))
+	if _, err := client.Write(response); err != nil {
+		log.Printf("[PostgreSQL] Client write error: %v", err)
+	}
+}
+
+// verifyCacheHit executes a sampled cache hit on the primary of the backend
+// of its tables, or else of the session, and compares the checksum of the
+// response with the checksum of the cached response, logging mismatches. It
+// runs in the background on a session of the proxy, see verify, so that the
+// client session neither waits for it nor sees its effects. Hits sampled
+// while cache.MaxVerifications verifications run are skipped.
+func (p *Proxy) verifyCacheHit(state *connState, parsed *parser.ParsedQuery, tableBackend string, cached []byte, freshness string) {
+	if !p.verifier.Sample() {
+		return
+	}
+	if !p.verifier.Acquire() {
+		metrics.CacheVerifications.WithLabelValues("skipped").Inc()
+		return
+	}
+	shard, database, user := state.shard, state.database, state.user
+	if tableBackend != "" {
+		shard = tableBackend
+	}
+	p.verifying.Add(1)
+	go func() {
+		defer p.verifying.Done()
+		defer p.verifier.Release()
+		ctx, cancel := context.WithTimeout(context.Background(), verifyTimeout)
+		defer cancel()
+		response, err := p.verify(ctx, shard, database, parsed.Query)
+		if err != nil {
+			metrics.CacheVerifications.WithLabelValues("error").Inc()
+			log.Printf("[PostgreSQL] Cache verification failed: %v", err)
+			return
+		}
+		cachedSum, primarySum := cache.Checksum(cached), cache.Checksum(response)
+		if cachedSum == primarySum {
+			metrics.CacheVerifications.WithLabelValues("match").Inc()
+			return
 		}
+		metrics.CacheVerifications.WithLabelValues("mismatch").Inc()
+		log.Printf("[PostgreSQL] Cache verification mismatch (shard %s, database %s, user %s, %s hit, ttl %ds, file %s, line %d): cached %s (%d bytes), primary %s (%d bytes), query: %s",
+			shard, database, user, freshness, parsed.TTL, parsed.File, parsed.Line, cachedSum, len(cached), primarySum, len(response), logging.QueryText(parsed.Query))
+	}()
+}
 
-		// Send CommandComplete
-		cmdComplete := fmt.Sprintf("SELECT %d", rowCount)
-		cmdPayload := append([]byte(cmdComplete), 0)
-		response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
-	} else {
-		// Non-SELECT query
-		cmdPayload := append([]byte("OK"), 0)
-		response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
+// textRowDescription describes result columns, all sent as text
+func textRowDescription(cols []string) pgproto.RowDescription {
+	fields := make([]pgproto.FieldDescription, len(cols))
+	for i, col := range cols {
+		fields[i] = pgproto.TextField(col)
 	}
+	return pgproto.RowDescription{Fields: fields}
+}
 
-	// Send ReadyForQuery
-	response.Write(p.encodeMessage(msgReadyForQuery, []byte{'I'}))
-
-	// Track state
-	state.lastBackend = backendName
-	state.lastCacheHit = false
-
-	metrics.DatabaseQueries.WithLabelValues(backendName).Inc()
-	metrics.QueryTotal.WithLabelValues(file, line, queryType, "false").Inc()
-	metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
+// textDataRow formats the values of a row as text
+func textDataRow(values []interface{}) pgproto.DataRow {
+	row := make([][]byte, len(values))
+	for i, v := range values {
+		if v != nil {
+			row[i] = fmt.Appendf(nil, "%v", v)
+		}
+	}
+	return pgproto.DataRow{Values: row}
+}
 
-	// Cache response if cacheable - use SetAndNotify for single-flight
-	if parsed.IsCacheable() {
-		p.cache.SetAndNotify(parsed.Query, response.Bytes(), time.Duration(parsed.TTL)*time.Second)
+func (p *Proxy) handleShowTQDBStatus(client net.Conn, state *connState) {
+	// Prepare data
+	backend := state.lastBackend
+	if backend == "" {
+		backend = "none"
 	}
 
-	// Send response to client
-	if _, err := client.Write(response.Bytes()); err != nil {
-		log.Printf("[PostgreSQL] Client write error: %v", err)
+	// Build result set with columns: variable_name, value
+	response := []pgproto.Encoder{
+		textRowDescription([]string{"variable_name", "value"}),
+		textDataRow([]interface{}{"Shard", state.shard}),
+		textDataRow([]interface{}{"Backend", backend}),
 	}
-}
 
-func (p *Proxy) buildRowDescription(cols []string) []byte {
-	var buf bytes.Buffer
+	// LastBatchSize (if available)
+	if state.lastBatchSize > 0 {
+		response = append(response, textDataRow([]interface{}{"LastBatchSize", state.lastBatchSize}))
+	}
 
-	// Number of fields
-	fieldCount := make([]byte, 2)
-	binary.BigEndian.PutUint16(fieldCount, uint16(len(cols)))
-	buf.Write(fieldCount)
+	// Sequences (if values were consumed by batched inserts)
+	if status := state.sequences.status(); status != "session" {
+		response = append(response, textDataRow([]interface{}{"Sequences", status}))
+	}
 
-	for _, col := range cols {
-		buf.WriteString(col)
-		buf.WriteByte(0)                      // null terminator
-		buf.Write([]byte{0, 0, 0, 0})         // table OID
-		buf.Write([]byte{0, 0})               // column attr number
-		buf.Write([]byte{0, 0, 0, 25})        // data type OID (25 = text)
-		buf.Write([]byte{255, 255})           // data type size (-1)
-		buf.Write([]byte{255, 255, 255, 255}) // type modifier
-		buf.Write([]byte{0, 0})               // format code (text)
+	for _, row := range p.globalStatus() {
+		response = append(response, textDataRow([]interface{}{row[0], row[1]}))
 	}
 
-	return p.encodeMessage(msgRowDescription, buf.Bytes())
+	response = append(response, pgproto.CommandComplete{Tag: fmt.Sprintf("SELECT %d", len(response)-1)}, ready(state))
+	if err := p.send(client, response...); err != nil {
+		log.Printf("[PostgreSQL] TQDB status response error: %v", err)
+	}
 }
 
-func (p *Proxy) buildDataRow(values []interface{}) []byte {
-	var buf bytes.Buffer
-
-	// Number of columns
-	colCount := make([]byte, 2)
-	binary.BigEndian.PutUint16(colCount, uint16(len(values)))
-	buf.Write(colCount)
+// globalStatus returns the variables of pg_tqdb_status that are shared by all
+// connections. They are counted by the proxy, so the status does not load a
+// backend.
+func (p *Proxy) globalStatus() [][2]string {
+	p.mu.RLock()
+	pools := p.pools
+	writeBatch := p.writeBatch
+	p.mu.RUnlock()
 
-	for _, v := range values {
-		if v == nil {
-			buf.Write([]byte{255, 255, 255, 255}) // NULL (-1)
-		} else {
-			str := fmt.Sprintf("%v", v)
-			lenBytes := make([]byte, 4)
-			binary.BigEndian.PutUint32(lenBytes, uint32(len(str)))
-			buf.Write(lenBytes)
-			buf.WriteString(str)
+	rows := [][2]string{
+		{"connections.active", strconv.Itoa(p.histories.Len())},
+		{"uptime_seconds", strconv.FormatInt(int64(time.Since(p.started).Seconds()), 10)},
+	}
+
+	hits, misses := p.cache.Stats().Totals()
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	rows = append(rows,
+		[2]string{"cache.hits", strconv.FormatInt(hits, 10)},
+		[2]string{"cache.misses", strconv.FormatInt(misses, 10)},
+		[2]string{"cache.hit_ratio", strconv.FormatFloat(ratio, 'f', 4, 64)},
+	)
+	for _, feature := range killswitch.Features {
+		state := "ON"
+		if !p.enabled(feature) {
+			state = "OFF"
 		}
+		rows = append(rows, [2]string{"killswitch." + feature, state})
 	}
 
-	return p.encodeMessage(msgDataRow, buf.Bytes())
+	if writeBatch != nil {
+		stats := writeBatch.GetStats()
+		avg := 0.0
+		if stats.Batches > 0 {
+			avg = float64(stats.Ops) / float64(stats.Batches)
+		}
+		rows = append(rows,
+			[2]string{"writebatch.batches.total", strconv.FormatInt(stats.Batches, 10)},
+			[2]string{"writebatch.ops.total", strconv.FormatInt(stats.Ops, 10)},
+			[2]string{"writebatch.avg_batch_size", strconv.FormatFloat(avg, 'f', 2, 64)},
+			[2]string{"writebatch.queued", strconv.Itoa(stats.Pending)},
+			[2]string{"writebatch.groups", strconv.Itoa(stats.Groups)},
+			[2]string{"writebatch.executing", strconv.Itoa(stats.Executing)},
+			[2]string{"writebatch.rejected.total", strconv.FormatInt(stats.Rejected, 10)},
+			[2]string{"writebatch.withdrawn.total", strconv.FormatInt(stats.Withdrawn, 10)},
+			[2]string{"writebatch.avg_queue_wait_ms", strconv.FormatFloat(float64(stats.AvgQueueWait)/float64(time.Millisecond), 'f', 2, 64)},
+		)
+	}
+
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pool := pools[name]
+		rows = append(rows,
+			[2]string{"pool." + name + ".primary", pool.GetPrimary()},
+			[2]string{"pool." + name + ".replicas_healthy", fmt.Sprintf("%d/%d", pool.GetHealthyCount(), len(pool.Replicas()))},
+		)
+	}
+	return rows
 }
 
-func (p *Proxy) encodeMessage(msgType byte, payload []byte) []byte {
-	length := uint32(len(payload) + 4)
-	msg := make([]byte, 1+4+len(payload))
-	msg[0] = msgType
-	binary.BigEndian.PutUint32(msg[1:5], length)
-	copy(msg[5:], payload)
-	return msg
+// handleShowTQDBHistory returns the query history of the connection, oldest
+// statement first
+func (p *Proxy) handleShowTQDBHistory(client net.Conn, state *connState) {
+	entries := state.history.Entries()
+	response := []pgproto.Encoder{textRowDescription([]string{"time", "latency_ms", "backend", "query", "error"})}
+	for _, e := range entries {
+		response = append(response, textDataRow([]interface{}{
+			e.Time.Format("2006-01-02 15:04:05.000"),
+			strconv.FormatFloat(float64(e.Latency)/float64(time.Millisecond), 'f', 3, 64),
+			e.Backend,
+			e.Query,
+			e.Error,
+		}))
+	}
+	response = append(response, pgproto.CommandComplete{Tag: fmt.Sprintf("SELECT %d", len(entries))}, ready(state))
+	if err := p.send(client, response...); err != nil {
+		log.Printf("[PostgreSQL] TQDB history response error: %v", err)
+	}
 }
 
-func (p *Proxy) readStartupMessage(conn net.Conn) ([]byte, error) {
-	lengthBuf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-		return nil, err
+// handleShowTQDBSlowQueries returns the slow queries of all PostgreSQL
+// connections, oldest first
+func (p *Proxy) handleShowTQDBSlowQueries(client net.Conn, state *connState) {
+	entries := p.slowQueryLog().Entries("postgres")
+	response := []pgproto.Encoder{textRowDescription([]string{"time", "conn_id", "user", "latency_ms", "backend", "shard", "file", "line", "batch_size", "query", "error", "plan"})}
+	for _, e := range entries {
+		response = append(response, textDataRow([]interface{}{
+			e.Time.Format("2006-01-02 15:04:05.000"),
+			strconv.FormatUint(uint64(e.ConnID), 10),
+			e.User,
+			strconv.FormatFloat(float64(e.Latency)/float64(time.Millisecond), 'f', 3, 64),
+			e.Backend,
+			e.Shard,
+			e.File,
+			strconv.Itoa(e.Line),
+			strconv.Itoa(e.BatchSize),
+			e.Query,
+			e.Error,
+			e.Plan,
+		}))
+	}
+	response = append(response, pgproto.CommandComplete{Tag: fmt.Sprintf("SELECT %d", len(entries))}, ready(state))
+	if err := p.send(client, response...); err != nil {
+		log.Printf("[PostgreSQL] TQDB slow queries response error: %v", err)
 	}
+}
 
-	length := binary.BigEndian.Uint32(lengthBuf)
-	payload := make([]byte, length-4)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return nil, err
+// recordHistory adds a statement to the query history of the connection,
+// logs it as a request at the debug level, records it in the slow query log
+// when it was slow and in the audit log. Statements that were not routed were
+// answered by the proxy itself.
+func (p *Proxy) recordHistory(state *connState, query string, start time.Time, err error) {
+	latency := time.Since(start)
+	affected := state.lastAffectedRows
+	state.lastAffectedRows = -1
+	p.recordAudit(state, query, start, affected, err)
+	slowLog := p.slowQueryLog()
+	slow := slowLog.Slow(latency)
+	if state.history == nil && !slow && !logging.Requests() {
+		return
+	}
+	e := history.Entry{Time: start, Query: query, Latency: latency, Backend: "proxy"}
+	if state.routed {
+		e.Backend = state.lastBackend
+	}
+	if err != nil {
+		e.Backend = ""
+		e.Error = err.Error()
+	}
+	state.history.Add(e)
+	if !slow && !logging.Requests() {
+		return
+	}
+	parsed := parser.Parse(query)
+	var shard string
+	var cacheHit bool
+	var batchSize int
+	if state.routed {
+		shard, cacheHit = state.shard, state.lastCacheHit
+		if e.Backend == "write-batch" {
+			batchSize = state.lastBatchSize
+		}
+	}
+	logging.LogRequest(logging.Request{Protocol: "postgres", ConnID: state.connID, User: state.user, Database: state.database, Backend: e.Backend,
+		Shard: shard, QueryType: queryTypeLabel(parsed.Type), Query: query, Duration: latency, CacheHit: cacheHit, BatchSize: batchSize, Err: err})
+	if slow {
+		entry := slowlog.Entry{Time: start, Protocol: "postgres", ConnID: state.connID, User: state.user, Database: state.database, Query: query,
+			Latency: latency, Backend: e.Backend, Shard: shard, File: parsed.File, Line: parsed.Line, BatchSize: batchSize, Error: e.Error}
+		if slowLog.Explain() && parsed.Type == parser.QuerySelect && err == nil {
+			entry.Plan = p.explain(state, parsed.Query)
+		}
+		slowLog.Add(entry)
 	}
-
-	return append(lengthBuf, payload...), nil
 }
 
-func (p *Proxy) readMessage(conn net.Conn) (byte, []byte, error) {
-	typeBuf := make([]byte, 1)
-	if _, err := io.ReadFull(conn, typeBuf); err != nil {
-		return 0, nil, err
+// recordAudit records a statement in the audit log when it is audited
+func (p *Proxy) recordAudit(state *connState, query string, start time.Time, affected int64, err error) {
+	auditLog := p.auditLog()
+	if auditLog == nil {
+		return
 	}
-
-	lengthBuf := make([]byte, 4)
-	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
-		return 0, nil, err
+	parsed := parser.Parse(query)
+	if !auditLog.Wants(parsed.IsWritable() || parsed.IsDDL()) {
+		return
 	}
-
-	length := binary.BigEndian.Uint32(lengthBuf)
-	payload := make([]byte, length-4)
-	if _, err := io.ReadFull(conn, payload); err != nil {
-		return 0, nil, err
+	r := audit.Record{Time: start, Protocol: "postgres", Client: state.clientAddr, User: state.user, Database: state.database,
+		Query: parser.Fingerprint(parsed.Query), AffectedRows: affected}
+	if err != nil {
+		r.Error = err.Error()
 	}
-
-	return typeBuf[0], payload, nil
+	auditLog.Record(r)
 }
 
-func (p *Proxy) writeMessage(conn net.Conn, msgType byte, payload []byte) error {
-	length := uint32(len(payload) + 4)
-
-	if _, err := conn.Write([]byte{msgType}); err != nil {
-		return err
+// explain runs EXPLAIN for a slow SELECT on the primary connection of the
+// session and returns the plan, one line per row, or "" when it fails
+func (p *Proxy) explain(state *connState, query string) string {
+	if state.primaryAddr == "" {
+		return ""
 	}
-
-	lengthBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lengthBuf, length)
-	if _, err := conn.Write(lengthBuf); err != nil {
-		return err
+	msgs := pgproto.Query{String: "EXPLAIN " + query}.Encode(nil)
+	response, err := p.queryOn(nil, state, state.primaryAddr, msgs, false, nil)
+	if err == nil {
+		err = responseError(response)
 	}
-
-	if _, err := conn.Write(payload); err != nil {
-		return err
+	if err != nil {
+		log.Printf("[PostgreSQL] EXPLAIN of a slow query failed (conn %d): %v", state.connID, err)
+		return ""
 	}
-
-	return nil
+	messages, err := pgproto.SplitMessages(response)
+	if err != nil {
+		return ""
+	}
+	var lines []string
+	for _, m := range messages {
+		var row pgproto.DataRow
+		if m.Type != pgproto.MsgDataRow || row.Decode(m.Payload) != nil || len(row.Values) == 0 {
+			continue
+		}
+		lines = append(lines, string(row.Values[0]))
+	}
+	return strings.Join(lines, "\n")
 }
 
-func (p *Proxy) handleShowTQDBStatus(client net.Conn, state *connState) {
-	var response bytes.Buffer
-
-	// Prepare data
-	backend := state.lastBackend
-	if backend == "" {
-		backend = "none"
+// handleTQDBFlush executes all pending write batches and waits for them to
+// complete, returning the number of flushed writes. Clients use it to read
+// their batched writes without waiting for the batch window.
+func (p *Proxy) handleTQDBFlush(client net.Conn, state *connState) {
+	p.mu.RLock()
+	managers := append(p.routeBatchManagers(), state.writeBatch)
+	p.mu.RUnlock()
+	flushed := 0
+	for _, wb := range managers {
+		if wb != nil {
+			flushed += wb.Flush()
+		}
 	}
 
-	// Build result set with columns: variable_name, value
-	cols := []string{"variable_name", "value"}
-	response.Write(p.buildRowDescription(cols))
-
-	// Row 1: Shard
-	response.Write(p.buildDataRow([]interface{}{"Shard", state.shard}))
-
-	// Row 2: Backend
-	response.Write(p.buildDataRow([]interface{}{"Backend", backend}))
-
-	// Row 3: LastBatchSize (if available)
-	rows := 2
-	if state.lastBatchSize > 0 {
-		response.Write(p.buildDataRow([]interface{}{"LastBatchSize", fmt.Sprintf("%d", state.lastBatchSize)}))
-		rows++
+	err := p.send(client,
+		textRowDescription([]string{"pg_tqdb_flush"}),
+		textDataRow([]interface{}{flushed}),
+		pgproto.CommandComplete{Tag: "SELECT 1"},
+		ready(state),
+	)
+	if err != nil {
+		log.Printf("[PostgreSQL] TQDB flush response error: %v", err)
 	}
+}
 
-	// CommandComplete
-	cmdPayload := append([]byte(fmt.Sprintf("SELECT %d", rows)), 0)
-	response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
-
-	// ReadyForQuery
-	response.Write(p.encodeMessage(msgReadyForQuery, []byte{'I'}))
-
-	if _, err := client.Write(response.Bytes()); err != nil {
-		log.Printf("[PostgreSQL] TQDB status response error: %v", err)
+// handleTQDBCachePurge deletes the cache entries matching the pattern (see
+// cache.Purge), returning the number of deleted entries
+func (p *Proxy) handleTQDBCachePurge(client net.Conn, state *connState, pattern string) {
+	purged := p.cache.Purge(pattern)
+	log.Printf("[PostgreSQL] Cache purge %q removed %d entries", pattern, purged)
+
+	err := p.send(client,
+		textRowDescription([]string{"pg_tqdb_cache_purge"}),
+		textDataRow([]interface{}{purged}),
+		pgproto.CommandComplete{Tag: "SELECT 1"},
+		ready(state),
+	)
+	if err != nil {
+		log.Printf("[PostgreSQL] TQDB cache purge response error: %v", err)
 	}
 }
 
 // handleParse handles the Parse message (prepared statement creation)
-// Parse message format: stmt_name\0 + query\0 + num_params(int16) + param_types[]
 func (p *Proxy) handleParse(payload []byte, client net.Conn, state *connState) error {
-	// Extract statement name (null-terminated)
-	stmtNameEnd := bytes.IndexByte(payload, 0)
-	if stmtNameEnd < 0 {
-		return fmt.Errorf("malformed Parse message: no statement name terminator")
+	var msg pgproto.Parse
+	if err := msg.Decode(payload); err != nil {
+		return fmt.Errorf("malformed Parse message: %w", err)
+	}
+	stmtName, query := msg.Name, msg.Query
+	if err := p.checkStatement(state, query); err != nil {
+		return err
 	}
-	stmtName := string(payload[:stmtNameEnd])
 
-	// Extract query (null-terminated after statement name)
-	queryStart := stmtNameEnd + 1
-	queryEnd := bytes.IndexByte(payload[queryStart:], 0)
-	if queryEnd < 0 {
-		return fmt.Errorf("malformed Parse message: no query terminator")
+	// Clients of cross-database libraries may send '?' placeholders
+	p.mu.RLock()
+	translate := p.config.QuestionPlaceholders
+	p.mu.RUnlock()
+	if translate {
+		query, _ = parser.TranslatePlaceholders(query)
 	}
-	query := string(payload[queryStart : queryStart+queryEnd])
 
 	// Store the prepared statement
 	state.preparedStatements[stmtName] = query
+	state.paramOIDs[stmtName] = msg.ParamOIDs
+	delete(state.described, stmtName)
 
 	// Send ParseComplete
-	return p.writeMessage(client, msgParseComplete, []byte{})
+	return p.send(client, pgproto.ParseComplete{})
 }
 
-// handleDescribe handles the Describe message
-// Describe message format: 'S' or 'P' + name\0
-// 'S' = describe Statement, 'P' = describe Portal
+// handleDescribe handles the Describe message of a prepared statement or
+// portal. Statements are described by the primary of the backend of their
+// tables. Batchable writes are
+// described by the primary as a statement, as their portals only exist in the
+// write batch, and their described parameter types are kept to decode the
+// parameters of Bind.
 func (p *Proxy) handleDescribe(payload []byte, client net.Conn, state *connState) error {
-	if len(payload) < 2 {
-		return fmt.Errorf("malformed Describe message: too short")
+	var msg pgproto.Describe
+	if err := msg.Decode(payload); err != nil {
+		return fmt.Errorf("malformed Describe message: %w", err)
 	}
 
-	descType := payload[0] // 'S' for statement, 'P' for portal
-	nameEnd := bytes.IndexByte(payload[1:], 0)
-	if nameEnd < 0 {
-		return fmt.Errorf("malformed Describe message: no name terminator")
+	stmtName := msg.Name
+	if msg.Target == pgproto.TargetPortal {
+		stmtName = state.portalStatements[msg.Name]
+	}
+	query, ok := state.preparedStatements[stmtName]
+	if !ok {
+		return fmt.Errorf("unknown prepared statement: %s", stmtName)
 	}
-	name := string(payload[1 : 1+nameEnd])
 
-	if descType == 'S' {
-		// Describe Statement - need to send ParameterDescription and RowDescription (or NoData)
-		query, ok := state.preparedStatements[name]
-		if !ok {
-			return fmt.Errorf("unknown prepared statement: %s", name)
+	parsed := p.applyOverrides(parser.Parse(query))
+	tableBackend, err := p.route(state, parsed)
+	if err != nil {
+		return err
+	}
+	version := p.schema.Version()
+	if !(p.batchManager(state, tableBackend) != nil && !state.inTransaction && parsed.IsWritable() && parsed.IsBatchable() && parsed.RouteBackend() == "") {
+		var msgs []byte
+		if msg.Target == pgproto.TargetPortal {
+			msgs = portalMessages(p.backendQuery(state, parsed), state.paramOIDs[stmtName], state.binds[msg.Name],
+				pgproto.Describe{Target: pgproto.TargetPortal})
+		} else {
+			msgs = pgproto.Parse{Query: p.backendQuery(state, parsed), ParamOIDs: state.paramOIDs[stmtName]}.Encode(nil)
+			msgs = pgproto.Describe{Target: pgproto.TargetStatement}.Encode(msgs)
+			msgs = pgproto.Sync{}.Encode(msgs)
 		}
-
-		// Count parameters ($1, $2, etc.) in the query
-		numParams := countPostgresParams(query)
-
-		// Send ParameterDescription message
-		// Format: int16 (num params) + int32[] (parameter OIDs, 0 = unknown)
-		paramDesc := make([]byte, 2+numParams*4)
-		binary.BigEndian.PutUint16(paramDesc[0:2], uint16(numParams))
-		// Leave OIDs as 0 (unknown type) - PostgreSQL will infer from context
-		if err := p.writeMessage(client, msgParameterDescription, paramDesc); err != nil {
+		response, err := p.queryOn(client, state, p.primaryAddr(state, parsed), msgs, true, nil)
+		if err != nil {
 			return err
 		}
+		if _, fields, err := describeResponse(response); err == nil {
+			state.describe(stmtName, version, fields)
+		}
+		_, err = client.Write(response)
+		return err
+	}
 
-		// Check if query has RETURNING clause
-		queryUpper := strings.ToUpper(query)
-		if strings.Contains(queryUpper, " RETURNING ") {
-			// For RETURNING queries, send RowDescription
-			// Parse RETURNING column names
-			returningIdx := strings.Index(queryUpper, " RETURNING ")
-			if returningIdx != -1 {
-				returningClause := query[returningIdx+11:] // Skip " RETURNING "
-				// Simple column name extraction (assumes single column)
-				colName := strings.TrimSpace(returningClause)
-				if idx := strings.IndexAny(colName, " ,;"); idx != -1 {
-					colName = colName[:idx]
-				}
-
-				// Build minimal RowDescription for single column
-				// Format: int16 (num fields) + field descriptions
-				// Field: name\0 + tableOID(4) + colNum(2) + typeOID(4) + typeSize(2) + typeMod(4) + formatCode(2)
-				var rowDesc bytes.Buffer
-				binary.Write(&rowDesc, binary.BigEndian, uint16(1)) // 1 column
-				rowDesc.WriteString(colName)
-				rowDesc.WriteByte(0)                                 // null terminator
-				binary.Write(&rowDesc, binary.BigEndian, uint32(0))  // table OID
-				binary.Write(&rowDesc, binary.BigEndian, uint16(0))  // column number
-				binary.Write(&rowDesc, binary.BigEndian, uint32(23)) // type OID (23 = int4)
-				binary.Write(&rowDesc, binary.BigEndian, int16(4))   // type size
-				binary.Write(&rowDesc, binary.BigEndian, int32(-1))  // type modifier
-				binary.Write(&rowDesc, binary.BigEndian, uint16(0))  // format code (text)
-
-				return p.writeMessage(client, msgRowDescription, rowDesc.Bytes())
+	// A write without RETURNING clause returns no rows
+	if msg.Target == pgproto.TargetPortal && parser.ReturningColumns(query) == nil {
+		return p.send(client, pgproto.NoData{})
+	}
+	paramDesc, fields, err := p.describeOnPrimary(client, state, parsed, state.paramOIDs[stmtName])
+	if err != nil {
+		return err
+	}
+	state.describe(stmtName, version, fields)
+	var rowDesc pgproto.Encoder = pgproto.NoData{}
+	if fields != nil {
+		if msg.Target == pgproto.TargetPortal {
+			bind := state.binds[msg.Name]
+			for i := range fields {
+				fields[i].Format = bind.ResultFormat(i)
 			}
 		}
-
-		// For non-SELECT and non-RETURNING queries, send NoData
-		return p.writeMessage(client, msgNoData, []byte{})
-	} else if descType == 'P' {
-		// Describe Portal - we just send NoData for non-SELECT portals
-		return p.writeMessage(client, msgNoData, []byte{})
+		rowDesc = pgproto.RowDescription{Fields: fields}
+	}
+	if msg.Target == pgproto.TargetPortal {
+		return p.send(client, rowDesc)
 	}
+	state.paramOIDs[stmtName] = paramDesc.ParamOIDs
+	return p.send(client, paramDesc, rowDesc)
+}
 
-	return fmt.Errorf("unknown describe type: %c", descType)
+// describeOnPrimary returns the parameters and the columns of a batchable
+// write as the primary describes them, without executing it
+func (p *Proxy) describeOnPrimary(client net.Conn, state *connState, parsed *parser.ParsedQuery, paramOIDs []uint32) (pgproto.ParameterDescription, []pgproto.FieldDescription, error) {
+	var paramDesc pgproto.ParameterDescription
+	msgs := pgproto.Parse{Query: p.backendQuery(state, parsed), ParamOIDs: paramOIDs}.Encode(nil)
+	msgs = pgproto.Describe{Target: pgproto.TargetStatement}.Encode(msgs)
+	msgs = pgproto.Sync{}.Encode(msgs)
+	response, err := p.queryOn(client, state, p.primaryAddr(state, parsed), msgs, true, nil)
+	if err != nil {
+		return paramDesc, nil, err
+	}
+	return describeResponse(response)
 }
 
-// countPostgresParams counts $1, $2, etc. placeholders in a query
-func countPostgresParams(query string) int {
-	maxParam := 0
-	for i := 0; i < len(query)-1; i++ {
-		if query[i] == '$' && query[i+1] >= '0' && query[i+1] <= '9' {
-			// Parse the number after $
-			j := i + 1
-			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
-				j++
-			}
-			if num, err := strconv.Atoi(query[i+1 : j]); err == nil {
-				if num > maxParam {
-					maxParam = num
-				}
-			}
+// describeResponse returns the parameters and the columns of the response to
+// a Describe message, or the error of the backend
+func describeResponse(response []byte) (pgproto.ParameterDescription, []pgproto.FieldDescription, error) {
+	var paramDesc pgproto.ParameterDescription
+	if err := responseError(response); err != nil {
+		return paramDesc, nil, err
+	}
+	backendMsgs, err := pgproto.SplitMessages(response)
+	if err != nil {
+		return paramDesc, nil, err
+	}
+	var desc pgproto.RowDescription
+	for _, m := range backendMsgs {
+		switch m.Type {
+		case pgproto.MsgParameterDescription:
+			err = paramDesc.Decode(m.Payload)
+		case pgproto.MsgRowDescription:
+			err = desc.Decode(m.Payload)
+		}
+		if err != nil {
+			return paramDesc, nil, err
 		}
 	}
-	return maxParam
+	return paramDesc, desc.Fields, nil
 }
 
-// handleBind handles the Bind message (bind parameters to a prepared statement)
-// Bind message format: portal_name\0 + stmt_name\0 + format_codes + num_params + param_values + result_format_codes
-func (p *Proxy) handleBind(payload []byte, client net.Conn, state *connState) error {
-	// Extract portal name (null-terminated)
-	portalNameEnd := bytes.IndexByte(payload, 0)
-	if portalNameEnd < 0 {
-		return fmt.Errorf("malformed Bind message: no portal name terminator")
+// described are the result columns of a prepared statement as described to
+// the client, see checkResultType
+type described struct {
+	version uint64                     // schema version of the description, see cache.Schema
+	fields  []pgproto.FieldDescription // nil = no rows
+}
+
+// errResultTypeChanged is returned for a prepared statement whose columns a
+// DDL statement changed after the client got their description, as
+// PostgreSQL does
+var errResultTypeChanged = errors.New("cached plan must not change result type")
+
+// describe records the result columns of a prepared statement as described
+// to the client
+func (state *connState) describe(stmtName string, version uint64, fields []pgproto.FieldDescription) {
+	if state.described == nil {
+		state.described = make(map[string]described)
 	}
-	portalName := string(payload[:portalNameEnd])
+	state.described[stmtName] = described{version: version, fields: fields}
+}
 
-	// Extract statement name (null-terminated after portal name)
-	stmtStart := portalNameEnd + 1
-	stmtNameEnd := bytes.IndexByte(payload[stmtStart:], 0)
-	if stmtNameEnd < 0 {
-		return fmt.Errorf("malformed Bind message: no statement name terminator")
+// checkResultType describes a prepared statement again when a DDL statement
+// changed one of its tables after the client got its description. The
+// statement fails when its columns changed, until the client prepares it
+// again.
+func (p *Proxy) checkResultType(client net.Conn, state *connState, stmtName string, parsed *parser.ParsedQuery) error {
+	desc, ok := state.described[stmtName]
+	if !ok || !p.schema.Changed(parsed.Tables, desc.version) {
+		return nil
+	}
+	version := p.schema.Version()
+	_, fields, err := p.describeOnPrimary(client, state, parsed, state.paramOIDs[stmtName])
+	if err != nil {
+		return err
 	}
-	stmtName := string(payload[stmtStart : stmtStart+stmtNameEnd])
+	if !sameColumns(desc.fields, fields) {
+		return errResultTypeChanged
+	}
+	state.describe(stmtName, version, desc.fields)
+	return nil
+}
 
-	// Verify the prepared statement exists
-	if _, ok := state.preparedStatements[stmtName]; !ok {
-		return fmt.Errorf("unknown prepared statement: %s", stmtName)
+// sameColumns reports whether two descriptions have the same column names
+// and types, in any result format
+func sameColumns(a, b []pgproto.FieldDescription) bool {
+	return slices.EqualFunc(a, b, func(x, y pgproto.FieldDescription) bool {
+		return x.Name == y.Name && x.TypeOID == y.TypeOID && x.TypeModifier == y.TypeModifier
+	})
+}
+
+// returningDescription describes the rows returned by the RETURNING clause of
+// a batched write, in the types reported by the driver and the result formats
+// requested by Bind
+func returningDescription(result writebatch.WriteResult, formats pgproto.Bind) pgproto.RowDescription {
+	fields := make([]pgproto.FieldDescription, len(result.ReturningCols))
+	for i, col := range result.ReturningCols {
+		oid := uint32(pgproto.OIDText)
+		if i < len(result.ReturningTypes) {
+			oid = pgproto.TypeOID(result.ReturningTypes[i])
+		}
+		fields[i] = pgproto.TypeField(col, oid, formats.ResultFormat(i))
 	}
+	return pgproto.RowDescription{Fields: fields}
+}
 
-	// Parse the rest of the Bind message to extract parameters
-	pos := stmtStart + stmtNameEnd + 1
+// returningRow encodes a row returned by a RETURNING clause in the types and
+// formats of the fields
+func returningRow(fields []pgproto.FieldDescription, values []interface{}) (pgproto.DataRow, error) {
+	row := make([][]byte, len(values))
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		oid, format := uint32(pgproto.OIDText), int16(pgproto.FormatText)
+		if i < len(fields) {
+			oid, format = fields[i].TypeOID, fields[i].Format
+		}
+		b, err := pgproto.AppendValue([]byte{}, v, oid, format)
+		if err != nil {
+			return pgproto.DataRow{}, fmt.Errorf("column %d: %w", i+1, err)
+		}
+		row[i] = b
+	}
+	return pgproto.DataRow{Values: row}, nil
+}
 
-	// Read parameter format codes count
-	if pos+2 > len(payload) {
-		return fmt.Errorf("malformed Bind message: incomplete format codes")
+// writeTag returns the CommandComplete tag of a write that affected n rows
+func writeTag(parsed *parser.ParsedQuery, n int64) string {
+	switch parsed.Type {
+	case parser.QueryUpdate:
+		return fmt.Sprintf("UPDATE %d", n)
+	case parser.QueryDelete:
+		return fmt.Sprintf("DELETE %d", n)
 	}
-	numFormatCodes := int(binary.BigEndian.Uint16(payload[pos : pos+2]))
-	pos += 2
+	return fmt.Sprintf("INSERT 0 %d", n)
+}
 
-	// Skip format codes
-	pos += numFormatCodes * 2
+// ackEarly tracks a write that was enqueued with EnqueueAsync and returns its
+// CommandComplete. The affected rows are not known yet and reported as 0.
+func (p *Proxy) ackEarly(client net.Conn, state *connState, parsed *parser.ParsedQuery, start time.Time, file, line, queryType string) pgproto.Encoder {
+	metrics.QueryTotal.WithLabelValues(file, line, queryType, "false").Inc()
+	metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
+	state.lastBackend = "write-batch (async)"
+	state.lastCacheHit = false
+	state.lastBatchSize = 0
+	state.lastAffectedRows = -1
+	trackInsert(state, parsed, true, nil, nil)
+	state.lastWrite = time.Now()
+	p.sendVerbose(client, state, "batched write with a %dms window, acknowledged before the batch executed", parsed.BatchMs)
+	return pgproto.CommandComplete{Tag: writeTag(parsed, 0)}
+}
 
-	// Read number of parameters
-	if pos+2 > len(payload) {
-		return fmt.Errorf("malformed Bind message: incomplete parameter count")
+// handleBind handles the Bind message (bind parameters to a prepared statement)
+func (p *Proxy) handleBind(payload []byte, client net.Conn, state *connState) error {
+	var msg pgproto.Bind
+	if err := msg.Decode(payload); err != nil {
+		return fmt.Errorf("malformed Bind message: %w", err)
 	}
-	numParams := int(binary.BigEndian.Uint16(payload[pos : pos+2]))
-	pos += 2
 
-	// Extract parameter values
-	params := make([]interface{}, numParams)
-	for i := 0; i < numParams; i++ {
-		if pos+4 > len(payload) {
-			return fmt.Errorf("malformed Bind message: incomplete parameter length")
+	// Verify the prepared statement exists
+	if _, ok := state.preparedStatements[msg.Statement]; !ok {
+		return fmt.Errorf("unknown prepared statement: %s", msg.Statement)
+	}
+
+	// Store parameters as values of their types, NULL as nil. Binary
+	// parameters of unspecified type are kept as sent.
+	oids := state.paramOIDs[msg.Statement]
+	params := make([]interface{}, len(msg.Params))
+	for i, v := range msg.Params {
+		var oid uint32
+		if i < len(oids) {
+			oid = oids[i]
 		}
-		paramLen := int(binary.BigEndian.Uint32(payload[pos : pos+4]))
-		pos += 4
-
-		if paramLen == -1 {
-			// NULL parameter
-			params[i] = nil
-		} else {
-			if pos+paramLen > len(payload) {
-				return fmt.Errorf("malformed Bind message: incomplete parameter value")
-			}
-			// Store parameter as string for simplicity
-			params[i] = string(payload[pos : pos+paramLen])
-			pos += paramLen
+		value, err := pgproto.ParseValue(v, oid, msg.ParamFormat(i))
+		if err != nil {
+			return fmt.Errorf("invalid parameter $%d: %w", i+1, err)
 		}
+		params[i] = value
 	}
 
 	// Store the portal-to-statement mapping and bound parameters
-	state.portalStatements[portalName] = stmtName
-	state.boundParams[portalName] = params
+	state.portalStatements[msg.Portal] = msg.Statement
+	state.boundParams[msg.Portal] = params
+	state.binds[msg.Portal] = msg
 
 	// Send BindComplete
-	return p.writeMessage(client, msgBindComplete, []byte{})
+	return p.send(client, pgproto.BindComplete{})
+}
+
+// invalidateSchema drops cached results, including cached prepared statement
+// results, of the tables changed by a DDL statement, as well as all cached
+// schema metadata, and marks the described prepared statements on the tables
+// of all sessions to be checked again, see checkResultType
+func (p *Proxy) invalidateSchema(parsed *parser.ParsedQuery) {
+	p.schema.Change(parsed.Tables)
+	p.metaCache.Invalidate()
+	if n := p.cache.InvalidateTables(parsed.Tables); n > 0 {
+		metrics.CacheDDLInvalidations.Add(float64(n))
+		log.Printf("[PostgreSQL] DDL on %v invalidated %d cached results", parsed.Tables, n)
+	}
 }
 
 // handleExecute handles the Execute message (execute a bound portal)
-// Execute message format: portal_name\0 + max_rows(int32)
-func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connID uint32, state *connState) error {
+func (p *Proxy) handleExecute(payload []byte, client net.Conn, connID uint32, state *connState) (err error) {
 	start := time.Now()
 
-	// Extract portal name (null-terminated)
-	portalNameEnd := bytes.IndexByte(payload, 0)
-	if portalNameEnd < 0 {
-		return fmt.Errorf("malformed Execute message: no portal name terminator")
+	var msg pgproto.Execute
+	if err := msg.Decode(payload); err != nil {
+		return fmt.Errorf("malformed Execute message: %w", err)
 	}
-	portalName := string(payload[:portalNameEnd])
+	portalName := msg.Portal
 
 	// Get bound parameters
 	params, ok := state.boundParams[portalName]
@@ -1077,11 +2630,10 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 		params = []interface{}{}
 	}
 
-	// Get the statement name for this portal
+	// Get the statement name for this portal, of which several may be open
 	stmtName, ok := state.portalStatements[portalName]
-	if !ok {
-		// Try unnamed statement for unnamed portal
-		stmtName = ""
+	if !ok && portalName != "" {
+		return fmt.Errorf("portal %q does not exist", portalName)
 	}
 
 	// Get the query from the statement
@@ -1090,8 +2642,27 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 		return fmt.Errorf("no prepared statement for portal: %s (statement: %s)", portalName, stmtName)
 	}
 
+	// Errors reported by the backend are forwarded with its response, they
+	// are only recorded in the history
+	var backendErr error
+	state.routed = true
+	defer func() {
+		historyErr := err
+		if historyErr == nil {
+			historyErr = backendErr
+		}
+		p.recordHistory(state, query, start, historyErr)
+	}()
+
 	// Parse the query
-	parsed := parser.Parse(query)
+	parsed := p.applyOverrides(parser.Parse(query))
+	tableBackend, err := p.route(state, parsed)
+	if err != nil {
+		return err
+	}
+	if err := p.checkResultType(client, state, stmtName, parsed); err != nil {
+		return err
+	}
 
 	file := parsed.File
 	if file == "" {
@@ -1103,9 +2674,66 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 	}
 	queryType := queryTypeLabel(parsed.Type)
 
+	// Queries served by the cache or a backend count against the qps budget
+	// and the throttle limits
+	if err := p.quotas.Allow(state.database); err != nil {
+		return err
+	}
+	release, err := p.throttle.Acquire(state.clientAddr, state.user, state.shard)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// LISTEN and UNLISTEN run on the listener connection of the session
+	if channel, listen, ok := parser.ParseListen(parsed.Query); ok {
+		state.lastBackend = "primary"
+		state.lastCacheHit = false
+		response, err := p.listen(unbuffered(client), state, parsed.Query, channel, listen)
+		if err != nil {
+			return err
+		}
+		backendErr = responseError(response)
+		_, err = client.Write(response)
+		return err
+	}
+
+	// currval() and lastval() of sequences used by batched inserts, the
+	// backend described them as int8
+	if fn, sequence, ok := parser.ParseSequenceCall(parsed.Query); ok {
+		if value, ok, err := state.sequences.lookup(fn, sequence); ok {
+			state.lastBackend = "write-batch"
+			state.lastCacheHit = false
+			if err != nil {
+				backendErr = err
+				return p.send(client, errSequenceBatched)
+			}
+			return p.send(client, sequenceRow(value, state.binds[portalName]), pgproto.CommandComplete{Tag: "SELECT 1"})
+		}
+	}
+
+	// Serve schema metadata queries from the metadata cache (opt-in)
+	isMetadata := p.metaCache != nil && !state.inTransaction && !parsed.IsCacheable() && parsed.Route == "" && parsed.IsMetadata() && p.enabled(killswitch.Cache)
+	bind := state.binds[portalName]
+	metaKey := fmt.Sprintf("%s %v %v %v", parsed.Query, params, bind.ParamFormats, bind.ResultFormats)
+	if isMetadata {
+		if cached, ok := p.metaCache.Get(state.database, metaKey); ok {
+			metrics.CacheHits.WithLabelValues(file, line).Inc()
+			metrics.QueryTotal.WithLabelValues(file, line, queryType, "true").Inc()
+			metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
+			state.lastBackend = "cache (metadata)"
+			state.lastCacheHit = true
+			p.sendVerbose(client, state, "served by the metadata cache")
+			if _, err := client.Write(cached); err != nil {
+				log.Printf("[PostgreSQL] Cache response error: %v", err)
+			}
+			return nil
+		}
+	}
+
 	// Build cache key including parameters
 	var cacheKey string
-	if parsed.IsCacheable() && len(params) > 0 {
+	if parsed.IsCacheable() && len(params) > 0 && parsed.RouteBackend() == "" && !state.inTransaction {
 		// Create a cache key that includes the query and parameters
 		h := sha1.New()
 		h.Write([]byte(state.database))
@@ -1113,17 +2741,21 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 		for _, param := range params {
 			h.Write([]byte(fmt.Sprintf("%v", param)))
 		}
-		cacheKey = "ps:" + hex.EncodeToString(h.Sum(nil))
+		// Values and rows are encoded in the formats of the Bind
+		fmt.Fprintf(h, "%v %v", bind.ParamFormats, bind.ResultFormats)
+		cacheKey = backendKey(tableBackend, "ps:"+hex.EncodeToString(h.Sum(nil)))
 
 		// Check cache
 		cached, flags, ok := p.cache.Get(cacheKey)
 		if ok {
 			if flags == cache.FlagFresh {
 				metrics.CacheHits.WithLabelValues(file, line).Inc()
+				p.cache.Stats().RecordHit(parsed.Query)
 				metrics.QueryTotal.WithLabelValues(file, line, queryType, "true").Inc()
 				metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 				state.lastBackend = "cache"
 				state.lastCacheHit = true
+				p.sendVerbose(client, state, "cache hit")
 				if _, err := client.Write(cached); err != nil {
 					log.Printf("[PostgreSQL] Cache response error: %v", err)
 				}
@@ -1132,10 +2764,12 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 
 			if flags == cache.FlagStale {
 				metrics.CacheHits.WithLabelValues(file, line).Inc()
+				p.cache.Stats().RecordHit(parsed.Query)
 				metrics.QueryTotal.WithLabelValues(file, line, queryType, "true").Inc()
 				metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 				state.lastBackend = "cache (stale)"
 				state.lastCacheHit = true
+				p.sendVerbose(client, state, "cache hit (stale, refreshed by another query)")
 				if _, err := client.Write(cached); err != nil {
 					log.Printf("[PostgreSQL] Cache response error: %v", err)
 				}
@@ -1145,20 +2779,56 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 		metrics.CacheMisses.WithLabelValues(file, line).Inc()
 	}
 
-	// Check if write batching should be used
-	if state.writeBatch != nil && !state.inTransaction && parsed.IsWritable() && parsed.IsBatchable() {
+	// Check if write batching should be used, with the write batch manager
+	// of the backend of the tables
+	wb := p.batchManager(state, tableBackend)
+	if wb != nil && !state.inTransaction && parsed.IsWritable() && parsed.IsBatchable() && parsed.RouteBackend() == "" && !p.guardBatch(parsed) {
 		// Use write batching - execute via db.Exec() which handles its own prepared statements
+		if hinted, clamped := p.clampBatch(parsed, state.shard); clamped {
+			p.sendNotice(client, "01000", fmt.Sprintf("batch hint of %dms clamped to %dms", hinted, parsed.BatchMs))
+		}
 		batchKey := parsed.GetBatchKey()
 		batchMs := parsed.BatchMs
+		release, err := p.quotas.AcquireWrite(state.database)
+		if err != nil {
+			return err
+		}
+
+		durability, ok := p.durability(parsed)
+		if !ok {
+			p.sendNotice(client, "01000", "durability hint ignored, the table is not in relaxed_durability_tables")
+		}
+		ctx := writebatch.WithMaxBatchSize(writebatch.WithDurability(context.Background(), durability), parsed.BatchMax)
+
+		// Acknowledge the execution before its batch executed, unless too
+		// many async writes are pending
+		if parsed.Ack == parser.AckEarly {
+			err := wb.EnqueueAsync(ctx, &state.writeFence, state.writeOrder, batchKey, parsed.Query, params, batchMs, func(result writebatch.WriteResult) {
+				release()
+				p.recordBatch(parsed.Query, result.Error)
+			})
+			if err == nil {
+				return p.send(client, p.ackEarly(client, state, parsed, start, file, line, queryType))
+			}
+		}
+		defer release()
 
 		// Enqueue the write (blocks until result is available)
 		// The writebatch executor will call db.Exec(parsed.Query, params...)
 		// which creates its own prepared statement on the backend
-		ctx := context.Background()
-		result := state.writeBatch.Enqueue(ctx, batchKey, parsed.Query, params, batchMs, func(batchSize int) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := watchClient(client, cancel)
+		result := wb.EnqueueFenced(ctx, &state.writeFence, state.writeOrder, batchKey, parsed.Query, params, batchMs, func(batchSize int) {
 			// Update this connection's batch size when batch completes
 			state.lastBatchSize = batchSize
 		})
+		if stop() {
+			metrics.ClientAborts.WithLabelValues("batch_wait").Inc()
+			log.Printf("[PostgreSQL] Client disconnected during batch window (conn %d)", connID)
+			return watch.ErrClientAborted
+		}
+		p.recordBatch(parsed.Query, result.Error)
 
 		// Update metrics
 		metrics.QueryTotal.WithLabelValues(file, line, queryType, "false").Inc()
@@ -1172,56 +2842,32 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 		state.lastBackend = "write-batch"
 		state.lastCacheHit = false
 		state.lastBatchSize = result.BatchSize
+		state.lastAffectedRows = result.AffectedRows
+		trackInsert(state, parsed, true, result.ReturningCols, result.ReturningRows)
+		state.lastWrite = time.Now()
+		p.sendVerbose(client, state, "batched write with a %dms window, executed in a batch of %d", batchMs, result.BatchSize)
 
 		// Success - send result to client
-		var response bytes.Buffer
+		var response []pgproto.Encoder
 
 		// Check if query has RETURNING clause
-		if len(result.ReturningValues) > 0 {
-			// RETURNING query - send row data in binary format
-			// In extended query protocol (Execute message), client already has
-			// RowDescription from Describe, so we only send DataRow
-
-			// Encode the returned value in binary format (int32)
-			// DataRow: int16 (num cols) + [int32 (len) + bytes (data)]
-			var dataRow bytes.Buffer
-			binary.Write(&dataRow, binary.BigEndian, uint16(1)) // 1 column
-
-			// Encode the integer value in binary format (4 bytes for int32)
-			val := result.ReturningValues[0]
-			var valInt32 int32
-			switch v := val.(type) {
-			case int64:
-				valInt32 = int32(v)
-			case int32:
-				valInt32 = v
-			case int:
-				valInt32 = int32(v)
-			default:
-				// Fallback: try to parse as string
-				str := fmt.Sprintf("%v", v)
-				if i, err := strconv.ParseInt(str, 10, 32); err == nil {
-					valInt32 = int32(i)
+		if len(result.ReturningCols) > 0 {
+			// RETURNING query - in extended query protocol (Execute message),
+			// the client already has the RowDescription from Describe, so we
+			// only send DataRows, encoded as described
+			fields := returningDescription(result, bind).Fields
+			for _, values := range result.ReturningRows {
+				row, err := returningRow(fields, values)
+				if err != nil {
+					return err
 				}
+				response = append(response, row)
 			}
-
-			// Write length (4 bytes) and value in binary format
-			binary.Write(&dataRow, binary.BigEndian, int32(4)) // length of int32
-			binary.Write(&dataRow, binary.BigEndian, valInt32) // the actual value
-
-			response.Write(p.encodeMessage(msgDataRow, dataRow.Bytes()))
-
-			// Send CommandComplete with row count
-			cmdPayload := append([]byte(fmt.Sprintf("INSERT 0 1")), 0)
-			response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
-		} else {
-			// Non-RETURNING query - send CommandComplete
-			cmdPayload := append([]byte(fmt.Sprintf("INSERT 0 %d", result.AffectedRows)), 0)
-			response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
 		}
+		response = append(response, pgproto.CommandComplete{Tag: writeTag(parsed, result.AffectedRows)})
 
 		// Send response to client
-		if _, err := client.Write(response.Bytes()); err != nil {
+		if err := p.send(client, response...); err != nil {
 			log.Printf("[PostgreSQL] Client write error: %v", err)
 			return err
 		}
@@ -1229,91 +2875,75 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 		return nil
 	}
 
-	// Non-batched execution: use direct query execution
+	// Non-batched execution: the portal is recreated on the backend
 	// This also handles the case where batching is disabled or fails
-	var response bytes.Buffer
-
-	// Select backend
-	targetDB := state.primaryDB
-	backendName := "primary"
-
-	if parsed.IsCacheable() {
-		addr, name := state.pool.GetReplica()
-		if name != "primary" {
-			backendName = name
-			rdb := state.replicaDBs[addr]
-			if rdb == nil {
-				var err error
-				rdb, err = p.connectToBackend(addr, state.user, state.password, state.database)
-				if err != nil {
-					log.Printf("[PostgreSQL] Error connecting to replica %s: %v", addr, err)
-				} else {
-					state.replicaDBs[addr] = rdb
-				}
-			}
-			if rdb != nil {
-				targetDB = rdb
-			}
+
+	// Writes that are not batched count against the immediate write limit
+	if parsed.IsWritable() {
+		release, err := p.acquireWriteSlot(state)
+		if err != nil {
+			return err
 		}
+		defer release()
 	}
 
-	// Execute the prepared statement with parameters
-	rows, err := targetDB.Query(parsed.Query, params...)
-	if err != nil {
+	// Execute the portal, a client that disconnects while waiting closes the
+	// backend connection
+	msgs := portalMessages(p.backendQuery(state, parsed), state.paramOIDs[stmtName], bind, pgproto.Execute{})
+	response, backendName, err := p.queryBackend(client, state, parsed, msgs, true)
+	if errors.Is(err, watch.ErrClientAborted) {
 		if cacheKey != "" {
 			p.cache.CancelInflight(cacheKey)
 		}
+		metrics.ClientAborts.WithLabelValues("query").Inc()
+		log.Printf("[PostgreSQL] Client disconnected during query (conn %d)", connID)
 		return err
 	}
-	defer rows.Close()
-
-	// Get column info
-	cols, _ := rows.Columns()
-	if len(cols) > 0 {
-		// Send RowDescription
-		rowDesc := p.buildRowDescription(cols)
-		response.Write(rowDesc)
-
-		// Send data rows
-		values := make([]interface{}, len(cols))
-		valuePtrs := make([]interface{}, len(cols))
-		for i := range values {
-			valuePtrs[i] = &values[i]
-		}
-
-		rowCount := 0
-		for rows.Next() {
-			rows.Scan(valuePtrs...)
-			dataRow := p.buildDataRow(values)
-			response.Write(dataRow)
-			rowCount++
+	if err != nil {
+		if cacheKey != "" {
+			p.cache.CancelInflight(cacheKey)
 		}
-
-		// Send CommandComplete
-		cmdComplete := fmt.Sprintf("SELECT %d", rowCount)
-		cmdPayload := append([]byte(cmdComplete), 0)
-		response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
-	} else {
-		// Non-SELECT query
-		cmdPayload := append([]byte("INSERT 0 1"), 0)
-		response.Write(p.encodeMessage(msgCommandComplete, cmdPayload))
+		return err
 	}
+	backendErr = responseError(response)
 
 	// Track state
 	state.lastBackend = backendName
 	state.lastCacheHit = false
+	state.lastAffectedRows = affectedRows(response)
 
 	metrics.DatabaseQueries.WithLabelValues(backendName).Inc()
 	metrics.QueryTotal.WithLabelValues(file, line, queryType, "false").Inc()
 	metrics.QueryLatency.WithLabelValues(file, line, queryType).Observe(time.Since(start).Seconds())
 
-	// Cache response if cacheable
-	if cacheKey != "" {
-		p.cache.SetAndNotify(cacheKey, response.Bytes(), time.Duration(parsed.TTL)*time.Second)
+	if backendErr == nil {
+		trackInsert(state, parsed, false, nil, nil)
+		// Schema changes make cached metadata stale
+		if parsed.IsDDL() {
+			p.invalidateSchema(parsed)
+		}
+		if isMetadata && response != nil {
+			p.metaCache.Set(state.database, metaKey, response)
+		}
+	}
+
+	// Cache response if cacheable, errors and spilled responses (nil, already
+	// sent) are not cached, as an error ends the extended query on the backend
+	var ttl time.Duration
+	if cacheKey != "" && response != nil {
+		ttl = cacheTTL(response, time.Duration(parsed.TTL)*time.Second, p.negativeTTL(parsed), false)
+	}
+	if ttl > 0 {
+		p.cache.SetAndNotifyFor(p.quotas, state.database, cacheKey, response, ttl)
+		p.cache.Track(cacheKey, parsed.Tables)
+		p.cache.Stats().RecordMiss(parsed.Query, time.Since(start))
+	} else if cacheKey != "" {
+		p.cache.CancelInflight(cacheKey)
 	}
 
 	// Send response to client
-	if _, err := client.Write(response.Bytes()); err != nil {
+	p.sendVerbose(client, state, "%s", forwardedRoute(state, parsed, tableBackend, ttl, backendName))
+	if _, err := client.Write(response); err != nil {
 		log.Printf("[PostgreSQL] Client write error: %v", err)
 		return err
 	}
@@ -1322,31 +2952,22 @@ func (p *Proxy) handleExecute(payload []byte, client net.Conn, db *sql.DB, connI
 }
 
 // handleClose handles the Close message (close a prepared statement or portal)
-// Close message format: type('S' for statement, 'P' for portal) + name\0
 func (p *Proxy) handleClose(payload []byte, client net.Conn, state *connState) {
-	if len(payload) < 2 {
-		log.Printf("[PostgreSQL] Malformed Close message")
-		p.writeMessage(client, msgCloseComplete, []byte{})
-		return
-	}
-
-	closeType := payload[0] // 'S' for statement, 'P' for portal
-	nameEnd := bytes.IndexByte(payload[1:], 0)
-	if nameEnd < 0 {
-		nameEnd = len(payload) - 1
-	} else {
-		nameEnd += 1
-	}
-	name := string(payload[1:nameEnd])
-
-	if closeType == 'S' {
+	var msg pgproto.Close
+	if err := msg.Decode(payload); err != nil {
+		log.Printf("[PostgreSQL] Malformed Close message: %v", err)
+	} else if msg.Target == pgproto.TargetStatement {
 		// Close prepared statement
-		delete(state.preparedStatements, name)
-	} else if closeType == 'P' {
+		delete(state.preparedStatements, msg.Name)
+		delete(state.paramOIDs, msg.Name)
+		delete(state.described, msg.Name)
+	} else {
 		// Close portal
-		delete(state.boundParams, name)
+		delete(state.portalStatements, msg.Name)
+		delete(state.boundParams, msg.Name)
+		delete(state.binds, msg.Name)
 	}
 
 	// Send CloseComplete
-	p.writeMessage(client, msgCloseComplete, []byte{})
+	p.send(client, pgproto.CloseComplete{})
 }
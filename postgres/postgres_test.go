@@ -2,13 +2,41 @@ package postgres
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/pem"
+	"errors"
 	"io"
+	"log"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/history"
+	"github.com/mevdschee/tqdbproxy/limiter"
+	"github.com/mevdschee/tqdbproxy/metrics"
 	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/tlsopt"
+	"github.com/mevdschee/tqdbproxy/writebatch"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // mockConn wraps a bytes.Buffer to implement net.Conn for testing
@@ -27,158 +55,500 @@ func newMockConn() *mockConn {
 	return &mockConn{Buffer: &bytes.Buffer{}}
 }
 
-func TestReadMessage(t *testing.T) {
-	// Create a test message: Type 'Q', Length 14 (4 + 10), Payload "SELECT 1;\x00"
-	conn := newMockConn()
-	conn.WriteByte('Q')                              // Type
-	binary.Write(conn, binary.BigEndian, uint32(14)) // Length (includes itself)
-	conn.WriteString("SELECT 1;")                    // Payload
-	conn.WriteByte(0)                                // Null terminator
+func TestQueryTypeLabel(t *testing.T) {
+	tests := []struct {
+		queryType parser.QueryType
+		expected  string
+	}{
+		{parser.QuerySelect, "select"},
+		{parser.QueryInsert, "insert"},
+		{parser.QueryUpdate, "update"},
+		{parser.QueryDelete, "delete"},
+		{parser.QueryUnknown, "unknown"},
+	}
+
+	for _, tt := range tests {
+		result := queryTypeLabel(tt.queryType)
+		if result != tt.expected {
+			t.Errorf("queryTypeLabel(%v) = %q, expected %q", tt.queryType, result, tt.expected)
+		}
+	}
+}
+
+func TestIsBackendConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{driver.ErrBadConn, true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{pgproto.ErrorResponse{Severity: "FATAL", Code: "08006"}, true},
+		{pgproto.ErrorResponse{Severity: "FATAL", Code: "57P01"}, true},
+		{pgproto.ErrorResponse{Severity: "ERROR", Code: "57014"}, false}, // query_canceled
+		{pgproto.ErrorResponse{Severity: "ERROR", Code: "42P01"}, false}, // undefined_table
+		{errors.New("sql: expected 1 arguments, got 0"), false},
+	}
+	for _, tt := range tests {
+		if got := isBackendConnError(tt.err); got != tt.want {
+			t.Errorf("isBackendConnError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestDSNQuote(t *testing.T) {
+	tests := map[string]string{
+		"tqdbproxy": `'tqdbproxy'`,
+		"":          `''`,
+		"p@ss word": `'p@ss word'`,
+		`it's\`:     `'it\'s\\'`,
+	}
+	for in, want := range tests {
+		if got := dsnQuote(in); got != want {
+			t.Errorf("dsnQuote(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
 
+func TestShutdownClosesIdleSessionsAfterDrainTimeout(t *testing.T) {
 	p := &Proxy{}
-	msgType, payload, err := p.readMessage(conn)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.listeners = append(p.listeners, listener)
+	go p.acceptLoop(listener, "")
 
+	// A client that connected but never sends its startup message
+	client, err := net.Dial("tcp", listener.Addr().String())
 	if err != nil {
-		t.Fatalf("readMessage failed: %v", err)
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for registered := false; !registered; {
+		p.clients.Range(func(_, _ any) bool { registered = true; return false })
+		time.Sleep(time.Millisecond)
 	}
 
-	if msgType != 'Q' {
-		t.Errorf("Expected message type 'Q', got %c", msgType)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Expected Shutdown to wait for the drain timeout, took %v", elapsed)
 	}
 
-	expectedPayload := "SELECT 1;\x00"
-	if string(payload) != expectedPayload {
-		t.Errorf("Expected payload %q, got %q", expectedPayload, string(payload))
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the session to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("Expected the listener to be closed")
 	}
 }
 
-func TestWriteMessage(t *testing.T) {
-	conn := newMockConn()
-	p := &Proxy{}
+func TestListenerOptions(t *testing.T) {
+	p := &Proxy{config: config.ProxyConfig{Listeners: []config.ListenerConfig{
+		{Name: "lb", ProxyProtocol: true, AllowUsers: []string{"app"}},
+	}}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.listeners = append(p.listeners, listener)
+	go p.acceptLoop(listener, "lb")
+	defer p.Shutdown(context.Background())
 
-	payload := []byte("SELECT 1;\x00")
-	err := p.writeMessage(conn, 'Q', payload)
+	// The session sees the client address of the PROXY protocol header
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 12345 5432\r\n"))
+	var remote string
+	for remote == "" {
+		p.clients.Range(func(key, _ any) bool { remote = key.(net.Conn).RemoteAddr().String(); return false })
+		time.Sleep(time.Millisecond)
+	}
+	if remote != "192.0.2.1:12345" {
+		t.Errorf("Expected the client address of the header, got %s", remote)
+	}
+
+	if err := p.listenerRules("lb").CheckUser("other"); err == nil {
+		t.Error("Expected the listener to deny users it does not allow")
+	}
+	if err := p.listenerRules("").CheckUser("other"); err != nil {
+		t.Errorf("Expected the main listener to allow all users, got %v", err)
+	}
+}
 
+// writeTestCert writes a self-signed certificate and its key for a listener
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		t.Fatalf("writeMessage failed: %v", err)
+		t.Fatal(err)
 	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tqdbproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "proxy.pem"), filepath.Join(dir, "proxy-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
 
-	// Verify the written data
-	data := conn.Bytes()
+func TestListenerTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	p := &Proxy{config: config.ProxyConfig{Listeners: []config.ListenerConfig{
+		{Name: "tls", TLSCert: certFile, TLSKey: keyFile, TLSMode: tlsopt.ModeRequire},
+	}}}
+	// Shut down after the clients below closed, which ends their sessions
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	listen := func(name string) string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.listeners = append(p.listeners, listener)
+		go p.acceptLoop(listener, name)
+		return listener.Addr().String()
+	}
+	tlsAddr, plainAddr := listen("tls"), listen("")
+	dial := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	// send writes a startup message and returns the first byte of the answer
+	send := func(conn net.Conn, msg pgproto.StartupMessage) byte {
+		if _, err := conn.Write(msg.Encode(nil)); err != nil {
+			t.Fatal(err)
+		}
+		answer := make([]byte, 1)
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			t.Fatal(err)
+		}
+		return answer[0]
+	}
+	sslRequest := pgproto.StartupMessage{ProtocolVersion: pgproto.SSLRequestCode}
+	startup := pgproto.StartupMessage{ProtocolVersion: pgproto.ProtocolVersion3, Params: map[string]string{"user": "alice"}}
 
-	// Check type byte
-	if data[0] != 'Q' {
-		t.Errorf("Expected type 'Q', got %c", data[0])
+	// The TLS listener accepts the SSLRequest and asks for the password over TLS
+	raw := dial(tlsAddr)
+	if answer := send(raw, sslRequest); answer != 'S' {
+		t.Fatalf("Expected the TLS listener to accept the SSLRequest, got %q", answer)
+	}
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	if answer := send(conn, startup); answer != pgproto.MsgAuthentication {
+		t.Errorf("Expected an authentication request over TLS, got %q", answer)
 	}
 
-	// Check length (should be 4 + len(payload))
-	length := binary.BigEndian.Uint32(data[1:5])
-	expectedLength := uint32(4 + len(payload))
-	if length != expectedLength {
-		t.Errorf("Expected length %d, got %d", expectedLength, length)
+	// The plaintext listener denies the SSLRequest and continues in plaintext
+	plain := dial(plainAddr)
+	if answer := send(plain, sslRequest); answer != 'N' {
+		t.Fatalf("Expected the plaintext listener to deny the SSLRequest, got %q", answer)
+	}
+	if answer := send(plain, startup); answer != pgproto.MsgAuthentication {
+		t.Errorf("Expected an authentication request in plaintext, got %q", answer)
 	}
 
-	// Check payload
-	if string(data[5:]) != string(payload) {
-		t.Errorf("Expected payload %q, got %q", payload, data[5:])
+	// The TLS listener requires TLS
+	if answer := send(dial(tlsAddr), startup); answer != pgproto.MsgErrorResponse {
+		t.Errorf("Expected the TLS listener to reject a plaintext client, got %q", answer)
 	}
 }
 
-func TestReadStartupMessage(t *testing.T) {
-	// Create a test startup message: Length 8, Protocol 196608
-	conn := newMockConn()
-	binary.Write(conn, binary.BigEndian, uint32(8))      // Length
-	binary.Write(conn, binary.BigEndian, uint32(196608)) // Protocol version
+func TestVerifyCacheHit(t *testing.T) {
+	var name atomic.Value
+	name.Store("alice")
+	response := func() []byte {
+		response := pgproto.RowDescription{Fields: []pgproto.FieldDescription{pgproto.TextField("name")}}.Encode(nil)
+		response = pgproto.DataRow{Values: [][]byte{[]byte(name.Load().(string))}}.Encode(response)
+		response = pgproto.CommandComplete{Tag: "SELECT 1"}.Encode(response)
+		return readyIdle.Encode(response)
+	}
+	// The primary accepts the sessions of the proxy for the verification
+	var sessions atomic.Int32
+	addr := listenBackend(t, func(conn net.Conn) {
+		sessions.Add(1)
+		if _, err := pgproto.ReadStartupMessage(conn); err != nil {
+			return
+		}
+		conn.Write(readyIdle.Encode(pgproto.Authentication{Type: pgproto.AuthOK}.Encode(nil)))
+		for {
+			msgType, _, err := pgproto.ReadMessage(conn)
+			if err != nil || msgType == pgproto.MsgTerminate {
+				return
+			}
+			conn.Write(response())
+		}
+	})
 
-	p := &Proxy{}
-	msg, err := p.readStartupMessage(conn)
+	p := &Proxy{
+		config:      config.ProxyConfig{Backends: map[string]config.BackendConfig{"main": {Username: "proxy", Database: "shop"}}},
+		pools:       map[string]*replica.Pool{"main": replica.NewPool(addr, nil)},
+		verifier:    cache.NewVerifier(1),
+		connLimiter: limiter.NewConnLimiter(nil, time.Second),
+	}
+	defer p.closeRefreshConns()
+	// The session has no backend connection, the verification does not use it
+	state := &connState{shard: "main", database: "shop", user: "app"}
+	parsed := parser.Parse("/* ttl:60 file:app.php line:7 */ SELECT name FROM users WHERE id = 1")
+	cached := response()
 
-	if err != nil {
-		t.Fatalf("readStartupMessage failed: %v", err)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	p.verifyCacheHit(state, parsed, "", cached, "fresh")
+	p.verifying.Wait()
+	if logs.Len() != 0 {
+		t.Errorf("Expected no mismatch for unchanged data, got %q", logs.String())
 	}
 
-	// Verify length
-	length := binary.BigEndian.Uint32(msg[0:4])
-	if length != 8 {
-		t.Errorf("Expected length 8, got %d", length)
+	name.Store("bob")
+	p.verifyCacheHit(state, parsed, "", cached, "stale")
+	p.verifying.Wait()
+	for _, want := range []string{"Cache verification mismatch", "stale hit", "file app.php, line 7", "SELECT name FROM users"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("Expected the mismatch log to contain %q, got %q", want, logs.String())
+		}
+	}
+	if n := sessions.Load(); n != 1 {
+		t.Errorf("Expected the verifications to share one session of the proxy, got %d", n)
+	}
+	if len(state.backends) != 0 {
+		t.Error("Expected the session to keep its backend connections")
 	}
 
-	// Verify protocol version
-	protocol := binary.BigEndian.Uint32(msg[4:8])
-	if protocol != 196608 {
-		t.Errorf("Expected protocol 196608, got %d", protocol)
+	// Sampled hits beyond the running verifications are skipped
+	for p.verifier.Acquire() {
+	}
+	skipped := testutil.ToFloat64(metrics.CacheVerifications.WithLabelValues("skipped"))
+	p.verifyCacheHit(state, parsed, "", cached, "fresh")
+	if testutil.ToFloat64(metrics.CacheVerifications.WithLabelValues("skipped")) != skipped+1 {
+		t.Error("Expected the hit to be skipped while all verifications run")
 	}
 }
 
-func TestQueryTypeLabel(t *testing.T) {
-	tests := []struct {
-		queryType parser.QueryType
-		expected  string
-	}{
-		{parser.QuerySelect, "select"},
-		{parser.QueryInsert, "insert"},
-		{parser.QueryUpdate, "update"},
-		{parser.QueryDelete, "delete"},
-		{parser.QueryUnknown, "unknown"},
+func TestHandleTQDBFlush(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE logs (message TEXT)"); err != nil {
+		t.Fatal(err)
 	}
+	wb := writebatch.New(db, writebatch.DefaultConfig())
+	defer wb.Close()
 
-	for _, tt := range tests {
-		result := queryTypeLabel(tt.queryType)
-		if result != tt.expected {
-			t.Errorf("queryTypeLabel(%v) = %q, expected %q", tt.queryType, result, tt.expected)
-		}
+	done := make(chan writebatch.WriteResult, 1)
+	go func() {
+		done <- wb.Enqueue(context.Background(), "logs", "INSERT INTO logs (message) VALUES ('a')", nil, 60000, nil)
+	}()
+	for wb.Pending() < 1 {
+		time.Sleep(time.Millisecond)
 	}
-}
 
-func TestMessageConstants(t *testing.T) {
-	// Verify message type constants are correct
-	if msgQuery != 'Q' {
-		t.Errorf("msgQuery should be 'Q', got %c", msgQuery)
+	p := &Proxy{}
+	conn := newMockConn()
+	p.handleTQDBFlush(conn, &connState{writeBatch: wb})
+	if result := <-done; result.Error != nil {
+		t.Fatalf("Expected the flushed write to succeed, got %v", result.Error)
 	}
-	if msgParse != 'P' {
-		t.Errorf("msgParse should be 'P', got %c", msgParse)
+
+	var types []byte
+	for conn.Len() > 0 {
+		msgType, payload, err := pgproto.ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msgType)
+		if msgType == pgproto.MsgDataRow && !bytes.HasSuffix(payload, []byte("\x00\x00\x00\x011")) {
+			t.Errorf("Expected 1 flushed write, got row %q", payload)
+		}
 	}
-	if msgBind != 'B' {
-		t.Errorf("msgBind should be 'B', got %c", msgBind)
+	if string(types) != "TDCZ" {
+		t.Errorf("Expected RowDescription, DataRow, CommandComplete and ReadyForQuery, got %q", types)
 	}
-	if msgExecute != 'E' {
-		t.Errorf("msgExecute should be 'E', got %c", msgExecute)
+}
+
+func TestHandleShowTQDBStatus(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if msgSync != 'S' {
-		t.Errorf("msgSync should be 'S', got %c", msgSync)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE logs (message TEXT)"); err != nil {
+		t.Fatal(err)
 	}
-	if msgTerminate != 'X' {
-		t.Errorf("msgTerminate should be 'X', got %c", msgTerminate)
+	wb := writebatch.New(db, writebatch.DefaultConfig())
+	defer wb.Close()
+	done := make(chan writebatch.WriteResult, 2)
+	for _, message := range []string{"a", "b"} {
+		go func() {
+			done <- wb.Enqueue(context.Background(), "logs", "INSERT INTO logs (message) VALUES ('"+message+"')", nil, 60000, nil)
+		}()
 	}
-	if msgReadyForQuery != 'Z' {
-		t.Errorf("msgReadyForQuery should be 'Z', got %c", msgReadyForQuery)
+	for wb.Pending() < 2 {
+		time.Sleep(time.Millisecond)
 	}
-}
+	wb.Flush()
+	<-done
+	<-done
 
-func TestRoundTripMessage(t *testing.T) {
-	// Test writing and reading back a message
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Stats().RecordHit("SELECT 1")
+	c.Stats().RecordMiss("SELECT 2", 0)
+	pool := replica.NewPool("10.0.0.1:5432", []string{"10.0.0.2:5432"})
+	p := &Proxy{
+		pools:      map[string]*replica.Pool{"main": pool},
+		cache:      c,
+		writeBatch: wb,
+		histories:  history.NewRegistry(),
+		started:    time.Now().Add(-time.Minute),
+	}
 	conn := newMockConn()
-	p := &Proxy{}
+	p.handleShowTQDBStatus(conn, &connState{shard: "main", lastBackend: "primary"})
 
-	originalPayload := []byte("SELECT * FROM users WHERE id = $1\x00")
+	status := make(map[string]string)
+	for conn.Len() > 0 {
+		msgType, payload, err := pgproto.ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != pgproto.MsgDataRow {
+			continue
+		}
+		var row pgproto.DataRow
+		if err := row.Decode(payload); err != nil {
+			t.Fatal(err)
+		}
+		status[string(row.Values[0])] = string(row.Values[1])
+	}
+	for name, want := range map[string]string{
+		"Shard":                      "main",
+		"Backend":                    "primary",
+		"connections.active":         "0",
+		"uptime_seconds":             "60",
+		"cache.hits":                 "1",
+		"cache.misses":               "1",
+		"cache.hit_ratio":            "0.5000",
+		"writebatch.batches.total":   "1",
+		"writebatch.ops.total":       "2",
+		"writebatch.avg_batch_size":  "2.00",
+		"writebatch.queued":          "0",
+		"pool.main.primary":          "10.0.0.1:5432",
+		"pool.main.replicas_healthy": "1/1",
+	} {
+		if status[name] != want {
+			t.Errorf("Expected %s = %q, got %q", name, want, status[name])
+		}
+	}
+}
 
-	// Write message
-	err := p.writeMessage(conn, 'Q', originalPayload)
+func TestHandleQueryBatchedReturning(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
-		t.Fatalf("writeMessage failed: %v", err)
+		t.Fatal(err)
 	}
-
-	// Read it back
-	msgType, payload, err := p.readMessage(conn)
-	if err != nil && err != io.EOF {
-		t.Fatalf("readMessage failed: %v", err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE logs (id INTEGER PRIMARY KEY AUTOINCREMENT, message TEXT)"); err != nil {
+		t.Fatal(err)
 	}
+	wb := writebatch.New(db, writebatch.DefaultConfig())
+	defer wb.Close()
+
+	p := &Proxy{}
+	conn := newMockConn()
+	query := pgproto.Query{String: "/* batch:1 */ INSERT INTO logs (message) VALUES ('a') RETURNING id, message"}
+	p.handleQuery(query.Encode(nil)[5:], conn, &connState{writeBatch: wb})
 
-	if msgType != 'Q' {
-		t.Errorf("Expected message type 'Q', got %c", msgType)
+	var types []byte
+	var rowDesc pgproto.RowDescription
+	var row pgproto.DataRow
+	var tag pgproto.CommandComplete
+	for conn.Len() > 0 {
+		msgType, payload, err := pgproto.ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, msgType)
+		switch msgType {
+		case pgproto.MsgRowDescription:
+			err = rowDesc.Decode(payload)
+		case pgproto.MsgDataRow:
+			err = row.Decode(payload)
+		case pgproto.MsgCommandComplete:
+			err = tag.Decode(payload)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(types) != "TDCZ" {
+		t.Fatalf("Expected RowDescription, DataRow, CommandComplete and ReadyForQuery, got %q", types)
 	}
+	if len(rowDesc.Fields) != 2 || rowDesc.Fields[0].Name != "id" || rowDesc.Fields[1].Name != "message" {
+		t.Errorf("Expected columns id and message, got %+v", rowDesc.Fields)
+	}
+	if len(row.Values) != 2 || string(row.Values[0]) != "1" || string(row.Values[1]) != "a" {
+		t.Errorf("Expected row (1, a), got %q", row.Values)
+	}
+	if tag.Tag != "INSERT 0 1" {
+		t.Errorf("Expected tag INSERT 0 1, got %q", tag.Tag)
+	}
+}
 
-	if !bytes.Equal(payload, originalPayload) {
-		t.Errorf("Payload mismatch.\nExpected: %q\nGot: %q", originalPayload, payload)
+func TestHandleQueryHistory(t *testing.T) {
+	p := &Proxy{}
+	conn := newMockConn()
+	state := &connState{history: history.NewRing(10)}
+
+	p.handleQuery(pgproto.Query{String: "SET tqdb_keep_comments = ON"}.Encode(nil)[5:], conn, state)
+	conn.Reset()
+	p.handleQuery(pgproto.Query{String: "SELECT * FROM pg_tqdb_history()"}.Encode(nil)[5:], conn, state)
+
+	var rows []string
+	for conn.Len() > 0 {
+		msgType, payload, err := pgproto.ReadMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType == pgproto.MsgDataRow {
+			rows = append(rows, string(payload))
+		}
+	}
+	if len(rows) != 1 {
+		t.Fatalf("Expected 1 statement in the history, got %d", len(rows))
+	}
+	if !strings.Contains(rows[0], "proxy") || !strings.Contains(rows[0], "SET tqdb_keep_comments = ON") {
+		t.Errorf("Expected the SET statement answered by the proxy, got %q", rows[0])
 	}
 }
@@ -2,14 +2,20 @@ package postgres
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/binary"
+	"errors"
 	"testing"
+
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/writebatch"
 )
 
 // TestPreparedStatementProtocol tests that the proxy handles prepared statement messages correctly
 func TestPreparedStatementProtocol(t *testing.T) {
 	conn := newMockConn()
-	p := &Proxy{}
 
 	// Simulate a Parse message with a batch hint
 	// Parse message format: 'P' + length + stmt_name\0 + query\0 + num_params + param_types
@@ -21,18 +27,18 @@ func TestPreparedStatementProtocol(t *testing.T) {
 	payload = append(payload, 0, 0) // num_params = 0 (uint16 big endian)
 
 	// Write Parse message
-	err := p.writeMessage(conn, msgParse, payload)
+	err := pgproto.WriteMessage(conn, pgproto.MsgParse, payload)
 	if err != nil {
-		t.Fatalf("writeMessage failed: %v", err)
+		t.Fatalf("WriteMessage failed: %v", err)
 	}
 
 	// Read it back
-	msgType, readPayload, err := p.readMessage(conn)
+	msgType, readPayload, err := pgproto.ReadMessage(conn)
 	if err != nil {
-		t.Fatalf("readMessage failed: %v", err)
+		t.Fatalf("ReadMessage failed: %v", err)
 	}
 
-	if msgType != msgParse {
+	if msgType != pgproto.MsgParse {
 		t.Errorf("Expected message type 'P' (Parse), got %c", msgType)
 	}
 
@@ -112,7 +118,6 @@ func TestParseBatchHintExtraction(t *testing.T) {
 // TestHandleMessagesWithPreparedStatements tests that handleMessages doesn't crash on prepared statement protocol
 func TestHandleMessagesWithPreparedStatements(t *testing.T) {
 	conn := newMockConn()
-	p := &Proxy{}
 
 	// Simulate Parse message
 	query := "/* batch:10 */ INSERT INTO test VALUES ($1)\x00"
@@ -122,15 +127,15 @@ func TestHandleMessagesWithPreparedStatements(t *testing.T) {
 	binary.Write(&payload, binary.BigEndian, uint16(1)) // 1 param
 	binary.Write(&payload, binary.BigEndian, int32(23)) // param type OID (int4)
 
-	p.writeMessage(conn, msgParse, payload.Bytes())
+	pgproto.WriteMessage(conn, pgproto.MsgParse, payload.Bytes())
 
 	// Now try to read and handle it
-	msgType, readPayload, err := p.readMessage(conn)
+	msgType, readPayload, err := pgproto.ReadMessage(conn)
 	if err != nil {
-		t.Fatalf("readMessage failed: %v", err)
+		t.Fatalf("ReadMessage failed: %v", err)
 	}
 
-	if msgType != msgParse {
+	if msgType != pgproto.MsgParse {
 		t.Errorf("Expected Parse message, got %c", msgType)
 	}
 
@@ -172,3 +177,167 @@ func TestPreparedStatementProtocolIsSupported(t *testing.T) {
 
 	t.Log("PostgreSQL proxy now supports prepared statement protocol")
 }
+
+// TestHandleBindNullParams verifies that NULL parameters (length -1) are bound
+// as nil instead of failing the Bind
+func TestHandleBindNullParams(t *testing.T) {
+	conn := newMockConn()
+	p := &Proxy{}
+	state := &connState{
+		preparedStatements: map[string]string{"stmt1": "INSERT INTO test VALUES ($1, $2)"},
+		boundParams:        make(map[string][]interface{}),
+		portalStatements:   make(map[string]string),
+		binds:              make(map[string]pgproto.Bind),
+	}
+
+	bind := pgproto.Bind{Statement: "stmt1", Params: [][]byte{[]byte("42"), nil}}
+	payload := bind.Encode(nil)[5:] // strip type and length
+	if err := p.handleBind(payload, conn, state); err != nil {
+		t.Fatalf("handleBind failed: %v", err)
+	}
+
+	got := state.boundParams[""]
+	if len(got) != 2 || got[0] != "42" || got[1] != nil {
+		t.Errorf("Expected params [42 <nil>], got %v", got)
+	}
+	if msgType, _, err := pgproto.ReadMessage(conn); err != nil || msgType != pgproto.MsgBindComplete {
+		t.Errorf("Expected BindComplete, got %c (%v)", msgType, err)
+	}
+}
+
+// TestReturningRow verifies that rows of a RETURNING clause are described
+// and encoded in the types of the columns, in the result formats requested by
+// Bind
+func TestReturningRow(t *testing.T) {
+	result := writebatch.WriteResult{ReturningCols: []string{"id", "name"}, ReturningTypes: []string{"INT8", "VARCHAR"}}
+	fields := returningDescription(result, pgproto.Bind{ResultFormats: []int16{pgproto.FormatBinary}}).Fields
+	if len(fields) != 2 || fields[0].TypeOID != pgproto.OIDInt8 || fields[1].TypeOID != pgproto.OIDVarchar {
+		t.Fatalf("Expected int8 id and varchar name, got %+v", fields)
+	}
+	row, err := returningRow(fields, []interface{}{int64(7), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(row.Values[0], []byte{0, 0, 0, 0, 0, 0, 0, 7}) || row.Values[1] != nil {
+		t.Errorf("Expected binary int8 7 and NULL, got %v", row.Values)
+	}
+
+	fields = returningDescription(result, pgproto.Bind{}).Fields
+	row, err = returningRow(fields, []interface{}{int64(7), []byte("x")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(row.Values[0]) != "7" || string(row.Values[1]) != "x" {
+		t.Errorf("Expected text 7 and x, got %q", row.Values)
+	}
+
+	// Columns of which the driver reported no type are text
+	fields = returningDescription(writebatch.WriteResult{ReturningCols: []string{"id"}}, pgproto.Bind{}).Fields
+	if fields[0].TypeOID != pgproto.OIDText {
+		t.Errorf("Expected a text column, got %+v", fields[0])
+	}
+}
+
+// TestDescribeBatchableWrite verifies that a batchable write is described by
+// the primary without executing it, and that its parameters are decoded in
+// the described types
+func TestDescribeBatchableWrite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	wb := writebatch.New(db, writebatch.DefaultConfig())
+	defer wb.Close()
+
+	var received []byte
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		received = append(received, msgType)
+		switch msgType {
+		case pgproto.MsgParse:
+			return pgproto.ParseComplete{}.Encode(nil)
+		case pgproto.MsgDescribe:
+			response := pgproto.ParameterDescription{ParamOIDs: []uint32{pgproto.OIDInt4}}.Encode(nil)
+			return pgproto.RowDescription{Fields: []pgproto.FieldDescription{pgproto.TypeField("id", pgproto.OIDInt8, pgproto.FormatText)}}.Encode(response)
+		case pgproto.MsgSync:
+			return pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}.Encode(nil)
+		}
+		return nil
+	})
+	state.writeBatch = wb
+	p := &Proxy{}
+
+	conn := newMockConn()
+	if err := p.handleParse(pgproto.Parse{Name: "s1", Query: "/* batch:10 */ INSERT INTO t (a) VALUES ($1) RETURNING id"}.Encode(nil)[5:], conn, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handleDescribe(pgproto.Describe{Target: pgproto.TargetStatement, Name: "s1"}.Encode(nil)[5:], conn, state); err != nil {
+		t.Fatal(err)
+	}
+	if types := messageTypes(t, conn); types != "1tT" {
+		t.Errorf("Expected ParseComplete, ParameterDescription and RowDescription, got %q", types)
+	}
+	if string(received) != "PDS" {
+		t.Errorf("Expected the primary to describe the statement only, got %q", received)
+	}
+
+	bind := pgproto.Bind{Portal: "p1", Statement: "s1", ParamFormats: []int16{pgproto.FormatBinary}, Params: [][]byte{{0, 0, 0, 42}}}
+	if err := p.handleBind(bind.Encode(nil)[5:], conn, state); err != nil {
+		t.Fatal(err)
+	}
+	if params := state.boundParams["p1"]; len(params) != 1 || params[0] != int64(42) {
+		t.Errorf("Expected the binary int4 parameter 42, got %v", params)
+	}
+}
+
+func TestCheckResultType(t *testing.T) {
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nameType := uint32(pgproto.OIDText)
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		switch msgType {
+		case pgproto.MsgParse:
+			return pgproto.ParseComplete{}.Encode(nil)
+		case pgproto.MsgDescribe:
+			response := pgproto.ParameterDescription{ParamOIDs: []uint32{pgproto.OIDInt4}}.Encode(nil)
+			return pgproto.RowDescription{Fields: []pgproto.FieldDescription{pgproto.TypeField("name", nameType, pgproto.FormatText)}}.Encode(response)
+		case pgproto.MsgSync:
+			return pgproto.ReadyForQuery{TxStatus: pgproto.TxIdle}.Encode(nil)
+		}
+		return nil
+	})
+	p := &Proxy{cache: c}
+
+	conn := newMockConn()
+	query := "SELECT name FROM users WHERE id = $1"
+	if err := p.handleParse(pgproto.Parse{Name: "s1", Query: query}.Encode(nil)[5:], conn, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.handleDescribe(pgproto.Describe{Target: pgproto.TargetStatement, Name: "s1"}.Encode(nil)[5:], conn, state); err != nil {
+		t.Fatal(err)
+	}
+
+	// A DDL statement that keeps the columns passes
+	p.invalidateSchema(parser.Parse("CREATE INDEX users_name ON users (name)"))
+	if err := p.checkResultType(conn, state, "s1", parser.Parse(query)); err != nil {
+		t.Errorf("Expected the statement to pass with the same columns, got %v", err)
+	}
+
+	// A DDL statement that changes the columns fails the statement, until
+	// the client prepares it again
+	nameType = pgproto.OIDInt8
+	p.invalidateSchema(parser.Parse("ALTER TABLE users ALTER COLUMN name TYPE bigint"))
+	for range 2 {
+		if err := p.checkResultType(conn, state, "s1", parser.Parse(query)); !errors.Is(err, errResultTypeChanged) {
+			t.Errorf("Expected the result type change to fail the statement, got %v", err)
+		}
+	}
+	if err := p.handleParse(pgproto.Parse{Name: "s1", Query: query}.Encode(nil)[5:], conn, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkResultType(conn, state, "s1", parser.Parse(query)); err != nil {
+		t.Errorf("Expected the statement prepared again to pass, got %v", err)
+	}
+}
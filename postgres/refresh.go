@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+)
+
+// verifyTimeout limits the verification of a cache hit, see verifyCacheHit
+const verifyTimeout = 30 * time.Second
+
+// refreshConn is a backend session of the proxy for the background
+// refreshes of cached results, see refreshFunc, or for the verification of
+// cache hits, see verifyCacheHit
+type refreshConn struct {
+	mu sync.Mutex
+	b  *backendConn // nil = not connected
+}
+
+// refreshFunc returns the function that refreshes a cached result of the
+// session in the background, see cache.RunRefresh. The query runs on a
+// replica of the backend of its tables, or else of the session (or the
+// primary when no replica is healthy), in the database of the session, on a
+// session of the proxy with the credentials of the backend configuration.
+func (p *Proxy) refreshFunc(state *connState, parsed *parser.ParsedQuery, ttl, negTTL time.Duration) cache.RefreshFunc {
+	shard, database, query := state.shard, state.database, parsed.Query
+	if backend, _ := p.tableBackend(parsed.Tables); backend != "" {
+		shard = backend
+	}
+	maxLag := time.Duration(parsed.MaxLagMs) * time.Millisecond
+	return func(ctx context.Context) ([]byte, time.Duration, error) {
+		response, err := p.refresh(ctx, shard, database, query, maxLag)
+		if err != nil {
+			return nil, 0, err
+		}
+		return response, cacheTTL(response, ttl, negTTL, true), nil
+	}
+}
+
+// refresh executes a query for a background refresh and returns the response
+func (p *Proxy) refresh(ctx context.Context, shard, database, query string, maxLag time.Duration) ([]byte, error) {
+	return p.proxyQuery(ctx, &p.refreshConns, shard, database, query, func(pool *replica.Pool) (string, string) {
+		return pool.GetReplicaMaxLag(maxLag)
+	})
+}
+
+// verify executes the query of a sampled cache hit on the primary of the
+// backend and returns the response, see verifyCacheHit
+func (p *Proxy) verify(ctx context.Context, shard, database, query string) ([]byte, error) {
+	return p.proxyQuery(ctx, &p.verifyConns, shard, database, query, func(pool *replica.Pool) (string, string) {
+		return pool.GetPrimary(), "primary"
+	})
+}
+
+// proxyQuery executes a query on a backend session of the proxy from conns,
+// with the credentials of the backend configuration, on the backend of the
+// shard that pick chooses, and returns the response
+func (p *Proxy) proxyQuery(ctx context.Context, conns *sync.Map, shard, database, query string, pick func(*replica.Pool) (string, string)) ([]byte, error) {
+	p.mu.RLock()
+	pool := p.pools[shard]
+	backend := p.config.Backends[shard]
+	if name, ok := p.config.ReplicaDatabases[database]; ok {
+		database = name
+	}
+	p.mu.RUnlock()
+	if pool == nil {
+		return nil, fmt.Errorf("unknown backend %q", shard)
+	}
+	addr, name := pick(pool)
+
+	// A session is bound to its database, so there is one per database
+	v, _ := conns.LoadOrStore(backend.Username+"@"+addr+"/"+database, &refreshConn{})
+	rc := v.(*refreshConn)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if rc.b == nil {
+		params := map[string]string{"user": backend.Username, "database": database}
+		b, err := p.dialBackend(addr, params, backend.Password)
+		if err != nil {
+			return nil, err
+		}
+		rc.b = b
+	}
+	if name != "primary" {
+		defer pool.Track(addr)()
+	}
+	response, err := rc.b.exchange(nil, pgproto.Query{String: query}.Encode(nil), false, nil)
+	if err != nil {
+		rc.b.Close()
+		rc.b = nil
+		return nil, err
+	}
+	metrics.DatabaseQueries.WithLabelValues(name).Inc()
+	return response, nil
+}
+
+// closeRefreshConns ends the sessions for background refreshes and for the
+// verification of cache hits
+func (p *Proxy) closeRefreshConns() {
+	for _, conns := range []*sync.Map{&p.refreshConns, &p.verifyConns} {
+		conns.Range(func(key, v any) bool {
+			conns.Delete(key)
+			rc := v.(*refreshConn)
+			rc.mu.Lock()
+			if rc.b != nil {
+				rc.b.terminate()
+				rc.b = nil
+			}
+			rc.mu.Unlock()
+			return true
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+	"github.com/mevdschee/tqdbproxy/replica"
+	"github.com/mevdschee/tqdbproxy/writebatch"
+)
+
+// routeBatch is the write batching of the tables routed to a backend other
+// than the default backend, see batchManager
+type routeBatch struct {
+	db      *sql.DB
+	manager *writebatch.Manager
+}
+
+// homeBackend is the backend of a session while a transaction runs on the
+// backend of its tables, see moveTransaction
+type homeBackend struct {
+	pool        *replica.Pool
+	shard       string
+	primaryAddr string
+	primaryName string
+}
+
+// tableBackend returns the backend of the tables of a statement, see
+// config.ProxyConfig.RouteTables
+func (p *Proxy) tableBackend(tables []string) (string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config.RouteTables(tables)
+}
+
+// batchManager returns the write batch manager for the writes of a session
+// on tables routed to a backend, or on tables without a route (empty
+// backend). The manager of the default backend is started with the proxy,
+// the managers of other backends on their first batched write, without
+// spool. It returns nil when write batching is not running.
+func (p *Proxy) batchManager(state *connState, backend string) *writebatch.Manager {
+	p.mu.RLock()
+	rb := p.routeBatches[backend]
+	routed := backend != "" && backend != p.config.Default
+	pool, backendCfg := p.pools[backend], p.config.Backends[backend]
+	p.mu.RUnlock()
+	if state.writeBatch == nil || !routed {
+		return state.writeBatch
+	}
+	if rb != nil {
+		return rb.manager
+	}
+	if pool == nil {
+		return nil
+	}
+	db, err := p.connectToBackend(pool.GetPrimary(), backendCfg.Username, backendCfg.Password, backendCfg.Database)
+	if err != nil {
+		log.Printf("[PostgreSQL] Cannot start write batching for backend %s: %v", backend, err)
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rb := p.routeBatches[backend]; rb != nil || p.db == nil {
+		// Started by another session meanwhile, or the proxy stopped
+		db.Close()
+		if rb == nil {
+			return nil
+		}
+		return rb.manager
+	}
+	if p.routeBatches == nil {
+		p.routeBatches = make(map[string]*routeBatch)
+	}
+	rb = &routeBatch{db: db, manager: writebatch.New(db, writeBatchConfig(p.config, p.batchClock))}
+	p.routeBatches[backend] = rb
+	log.Printf("[PostgreSQL] Write batching started for backend %s", backend)
+	return rb.manager
+}
+
+// routeBatchManagers returns the write batch managers of the routed tables.
+// The caller holds p.mu.
+func (p *Proxy) routeBatchManagers() []*writebatch.Manager {
+	managers := make([]*writebatch.Manager, 0, len(p.routeBatches))
+	for _, rb := range p.routeBatches {
+		managers = append(managers, rb.manager)
+	}
+	return managers
+}
+
+// closeRouteBatches stops the write batching of the routed tables, executing
+// the pending batches
+func (p *Proxy) closeRouteBatches() {
+	p.mu.Lock()
+	batches := p.routeBatches
+	p.routeBatches = nil
+	p.mu.Unlock()
+	for backend, rb := range batches {
+		if err := rb.manager.Close(); err != nil {
+			log.Printf("[PostgreSQL] Error closing write batch manager of backend %s: %v", backend, err)
+		}
+		rb.db.Close()
+	}
+}
+
+// backendKey scopes the cache key of a statement on routed tables to their
+// backend
+func backendKey(backend, key string) string {
+	if backend == "" {
+		return key
+	}
+	return backend + ":" + key
+}
+
+// route checks the backend of the tables of a statement, which runs on the
+// primary of that backend, see routePool. In a transaction the tables decide,
+// see routeTransaction. It returns the backend of the tables, empty when they
+// have no route.
+func (p *Proxy) route(state *connState, parsed *parser.ParsedQuery) (string, error) {
+	tableBackend, err := p.tableBackend(parsed.Tables)
+	if err != nil {
+		return "", err
+	}
+	if state.inTransaction {
+		return tableBackend, p.routeTransaction(state, parsed, tableBackend)
+	}
+
+	// The session returns to its backend after a transaction on another one
+	if home := state.home; home != nil {
+		state.pool, state.shard, state.primaryAddr, state.primaryName = home.pool, home.shard, home.primaryAddr, home.primaryName
+		state.home = nil
+	}
+	state.txBegin, state.txBackend = "", ""
+	if tx, _ := parser.ParseTransaction(parsed.Query); tx.Op == parser.TxBegin {
+		state.txBegin = parsed.Query
+	}
+	return tableBackend, nil
+}
+
+// routeTransaction keeps the statements on tables of a transaction on one
+// backend. A transaction that ran no statements on tables yet moves to the
+// backend of the tables of its first one, later statements on the tables of
+// another backend are rejected. Tables without a route are on the backend of
+// the session.
+func (p *Proxy) routeTransaction(state *connState, parsed *parser.ParsedQuery, tableBackend string) error {
+	if len(parsed.Tables) == 0 {
+		return nil
+	}
+	backend := tableBackend
+	if backend == "" {
+		backend = state.shard
+		if state.home != nil {
+			backend = state.home.shard
+		}
+	}
+	if state.txBackend == "" {
+		if backend != state.shard && state.txBegin != "" && state.snapshot == "" {
+			if err := p.moveTransaction(state, backend); err != nil {
+				return err
+			}
+		}
+		state.txBegin, state.txBackend = "", state.shard
+	}
+	if backend != state.txBackend {
+		return fmt.Errorf("statement on tables of backend %q in a transaction on backend %q, a transaction cannot span backends", backend, state.txBackend)
+	}
+	return nil
+}
+
+// moveTransaction starts the transaction of the session, which ran no
+// statements on tables yet, again on the primary of another backend, which is
+// the primary of the session until the transaction ends. The transaction on
+// the former backend is rolled back.
+func (p *Proxy) moveTransaction(state *connState, backend string) error {
+	p.mu.RLock()
+	pool := p.pools[backend]
+	rules := p.rules
+	p.mu.RUnlock()
+	if pool == nil {
+		return fmt.Errorf("unknown backend %q in route", backend)
+	}
+	if err := rules.CheckShard(state.user, backend); err != nil {
+		return err
+	}
+
+	response, err := p.queryOn(nil, state, state.primaryAddr, pgproto.Query{String: "ROLLBACK"}.Encode(nil), false, nil)
+	if err == nil {
+		err = responseError(response)
+	}
+	if err != nil {
+		return err
+	}
+	if state.home == nil {
+		state.home = &homeBackend{pool: state.pool, shard: state.shard, primaryAddr: state.primaryAddr, primaryName: state.primaryName}
+	}
+	state.pool, state.shard, state.primaryAddr, state.primaryName = pool, backend, pool.GetPrimary(), ""
+	response, err = p.queryOn(nil, state, state.primaryAddr, pgproto.Query{String: state.txBegin}.Encode(nil), false, nil)
+	if err == nil {
+		err = responseError(response)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("[PostgreSQL] Transaction of conn %d moved to backend %s", state.connID, backend)
+	return nil
+}
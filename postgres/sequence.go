@@ -0,0 +1,162 @@
+package postgres
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// sequences tracks the sequence values of a session that the backend session
+// does not know, because the inserts that consumed them ran in the write
+// batch. Values are captured from the RETURNING rows of batched inserts: an
+// integer column col of table is taken to come from the sequence
+// table_col_seq, as for serial and identity columns, and the first integer
+// column is taken for lastval(). Batched inserts without RETURNING leave the
+// values unknown, currval() and lastval() then fail instead of returning the
+// stale value of the backend session.
+type sequences struct {
+	values  map[string]int64 // sequence name -> value captured from a batched insert
+	unknown map[string]bool  // tables with batched inserts whose values are unknown
+	lastval *int64           // Captured lastval() (nil = none)
+	// lastval() is unknown after a batched insert without captured value
+	lastvalUnknown bool
+}
+
+// errSequenceBatched is returned for currval() and lastval() after batched
+// inserts without RETURNING clause
+var errSequenceBatched = pgproto.ErrorResponse{
+	Severity: "ERROR",
+	Code:     "55000", // object_not_in_prerequisite_state
+	Message:  "sequence value is not available in this session, the insert that used it was batched",
+	Hint:     "Add a RETURNING clause to the batched insert, or disable batching for it.",
+}
+
+// batched records a batched insert into table and its RETURNING result
+func (s *sequences) batched(table string, cols []string, rows [][]interface{}) {
+	s.forget(table)
+	if len(rows) == 0 {
+		s.unknown[table] = true
+		s.lastval, s.lastvalUnknown = nil, true
+		return
+	}
+	// The last row has the last values handed out by the sequences
+	captured := false
+	for i, col := range cols {
+		if i >= len(rows[len(rows)-1]) {
+			break
+		}
+		n, ok := sequenceValue(rows[len(rows)-1][i])
+		if !ok {
+			continue
+		}
+		s.values[table+"_"+col+"_seq"] = n
+		if !captured {
+			s.lastval, s.lastvalUnknown = &n, false
+			captured = true
+		}
+	}
+	if !captured {
+		s.unknown[table] = true
+		s.lastval, s.lastvalUnknown = nil, true
+	}
+}
+
+// direct records an insert into table on the backend session, which knows
+// its sequence values again
+func (s *sequences) direct(table string) {
+	s.forget(table)
+	s.lastval, s.lastvalUnknown = nil, false
+}
+
+// forget drops what is known about the sequences of table
+func (s *sequences) forget(table string) {
+	if s.values == nil {
+		s.values = make(map[string]int64)
+		s.unknown = make(map[string]bool)
+	}
+	for name := range s.values {
+		if strings.HasPrefix(name, table+"_") {
+			delete(s.values, name)
+		}
+	}
+	delete(s.unknown, table)
+}
+
+// lookup answers a currval() or lastval() call (see parser.ParseSequenceCall)
+// when the session tracks the value: it returns the value, or
+// errSequenceBatched when it is unknown. It returns ok false when the call is
+// answered by the backend session.
+func (s *sequences) lookup(fn, sequence string) (value int64, ok bool, err error) {
+	if fn == "lastval" {
+		switch {
+		case s.lastval != nil:
+			return *s.lastval, true, nil
+		case s.lastvalUnknown:
+			return 0, true, errSequenceBatched
+		}
+		return 0, false, nil
+	}
+	if n, ok := s.values[sequence]; ok {
+		return n, true, nil
+	}
+	for table := range s.unknown {
+		if strings.HasPrefix(sequence, table+"_") {
+			return 0, true, errSequenceBatched
+		}
+	}
+	return 0, false, nil
+}
+
+// status describes where currval() and lastval() come from, for SHOW TQDB
+// STATUS: "session" (the backend session), "captured" (RETURNING values of
+// batched inserts) or "unknown" (batched inserts without RETURNING)
+func (s *sequences) status() string {
+	switch {
+	case len(s.unknown) > 0 || s.lastvalUnknown:
+		return "unknown"
+	case len(s.values) > 0 || s.lastval != nil:
+		return "captured"
+	}
+	return "session"
+}
+
+// sequenceValue returns the value of a RETURNING column as integer
+func sequenceValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case []byte:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// trackInsert records a successful insert for the sequence values of the
+// session
+func trackInsert(state *connState, parsed *parser.ParsedQuery, batched bool, cols []string, rows [][]interface{}) {
+	if parsed.Type != parser.QueryInsert || len(parsed.Tables) == 0 {
+		return
+	}
+	if batched {
+		state.sequences.batched(parsed.Tables[0], cols, rows)
+	} else {
+		state.sequences.direct(parsed.Tables[0])
+	}
+}
+
+// sequenceRow encodes the value of a currval() or lastval() call, an int8, in
+// the result format requested by Bind
+func sequenceRow(value int64, formats pgproto.Bind) pgproto.DataRow {
+	if formats.ResultFormat(0) == pgproto.FormatBinary {
+		return pgproto.DataRow{Values: [][]byte{binary.BigEndian.AppendUint64(nil, uint64(value))}}
+	}
+	return pgproto.DataRow{Values: [][]byte{fmt.Appendf(nil, "%d", value)}}
+}
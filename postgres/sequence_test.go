@@ -0,0 +1,60 @@
+package postgres
+
+import (
+	"testing"
+
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+func TestHandleQuerySequences(t *testing.T) {
+	queries := 0
+	state := fakeBackendState(t, func(msgType byte, payload []byte) []byte {
+		queries++
+		response := pgproto.CommandComplete{Tag: "INSERT 0 1"}.Encode(nil)
+		return readyIdle.Encode(response)
+	})
+	p := &Proxy{}
+	query := func(sql string) string {
+		t.Helper()
+		client := newMockConn()
+		p.handleQuery(pgproto.Query{String: sql}.Encode(nil)[5:], client, state)
+		return messageTypes(t, client)
+	}
+
+	// Values captured from the RETURNING rows of a batched insert
+	state.sequences.batched("orders", []string{"id", "note"}, [][]interface{}{{int64(41), "a"}, {int64(42), "b"}})
+	if value, ok, err := state.sequences.lookup("currval", "orders_id_seq"); value != 42 || !ok || err != nil {
+		t.Errorf("lookup(currval) = (%d, %v, %v), want (42, true, nil)", value, ok, err)
+	}
+	if types := query("SELECT currval('orders_id_seq')"); types != "TDCZ" {
+		t.Errorf("Expected a local result for currval(), got %q", types)
+	}
+	if types := query("SELECT lastval()"); types != "TDCZ" {
+		t.Errorf("Expected a local result for lastval(), got %q", types)
+	}
+	if queries != 0 {
+		t.Errorf("Expected currval() and lastval() to be answered by the proxy, the backend got %d", queries)
+	}
+	if status := state.sequences.status(); status != "captured" {
+		t.Errorf("Expected status captured, got %q", status)
+	}
+
+	// A batched insert without RETURNING makes the values unknown
+	state.sequences.batched("items", nil, nil)
+	if types := query("SELECT currval('items_id_seq')"); types != "EZ" {
+		t.Errorf("Expected an error for currval() after a batched insert without RETURNING, got %q", types)
+	}
+	if types := query("SELECT lastval()"); types != "EZ" {
+		t.Errorf("Expected an error for lastval() after a batched insert without RETURNING, got %q", types)
+	}
+	if status := state.sequences.status(); status != "unknown" {
+		t.Errorf("Expected status unknown, got %q", status)
+	}
+
+	// An insert on the backend session makes the backend answer again
+	query("INSERT INTO items (name) VALUES ('x')")
+	query("SELECT currval('items_id_seq')")
+	if queries != 2 {
+		t.Errorf("Expected the insert and currval() to reach the backend, the backend got %d", queries)
+	}
+}
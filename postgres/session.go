@@ -0,0 +1,100 @@
+package postgres
+
+import (
+	"log"
+
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// trackSettings tracks a SET or RESET of the client that succeeded on the
+// backend at addr, so that it is replayed on the other backend connections of
+// the session. A SET in a transaction takes effect once it commits, as in
+// PostgreSQL, and is undone by a rollback to a savepoint before it.
+func trackSettings(state *connState, addr, query string, response []byte) {
+	b := state.backends[addr]
+	if b == nil || responseError(response) != nil {
+		return
+	}
+	if tx, ok := parser.ParseTransaction(query); ok {
+		trackTransaction(state, b, tx, response)
+		return
+	}
+	names, ok := parser.ParsePgSessionSet(query)
+	if !ok {
+		return
+	}
+	if b.txStatus != pgproto.TxIdle {
+		state.settings.Stage(query, names)
+		return
+	}
+	state.settings.Set(query, names)
+	b.settings = state.settings.Version()
+}
+
+// trackTransaction tracks the savepoints of a transaction on b, and the end
+// of a transaction that is chained to a new one, so that b does not become
+// idle, see queryOn
+func trackTransaction(state *connState, b *backendConn, tx parser.Transaction, response []byte) {
+	switch tx.Op {
+	case parser.TxSavepoint:
+		state.settings.Savepoint(tx.Savepoint)
+	case parser.TxRollbackTo:
+		state.settings.RollbackTo(tx.Savepoint)
+	case parser.TxRelease:
+		state.settings.Release(tx.Savepoint)
+	case parser.TxCommit, parser.TxRollback:
+		if tx.Chain {
+			endTransaction(state, b, response)
+		}
+	}
+}
+
+// endTransaction applies or drops the settings staged in a transaction that
+// ended on b, depending on the command tag of its end
+func endTransaction(state *connState, b *backendConn, response []byte) {
+	if commandTag(response) != "COMMIT" {
+		state.settings.Rollback()
+		return
+	}
+	stale := b.settings != state.settings.Version()
+	state.settings.Commit()
+	if !stale {
+		b.settings = state.settings.Version()
+	}
+}
+
+// restoreSettings replays the SET statements of the session on a backend
+// connection that missed some of them, unless it is in a transaction
+func restoreSettings(state *connState, b *backendConn) {
+	if b.settings == state.settings.Version() || b.txStatus != pgproto.TxIdle {
+		return
+	}
+	for _, query := range state.settings.Queries() {
+		response, err := b.exchange(nil, pgproto.Query{String: query}.Encode(nil), false, nil)
+		if err != nil {
+			log.Printf("[PostgreSQL] Cannot restore %q on %s for conn %d: %v", query, b.addr, state.connID, err)
+			return
+		}
+		if err := responseError(response); err != nil {
+			log.Printf("[PostgreSQL] Cannot restore %q on %s for conn %d: %v", query, b.addr, state.connID, err)
+		}
+	}
+	b.settings = state.settings.Version()
+}
+
+// commandTag returns the tag of the last CommandComplete of a response
+func commandTag(response []byte) string {
+	msgs, _ := pgproto.SplitMessages(response)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Type != pgproto.MsgCommandComplete {
+			continue
+		}
+		var cc pgproto.CommandComplete
+		if cc.Decode(msgs[i].Payload) != nil {
+			return ""
+		}
+		return cc.Tag
+	}
+	return ""
+}
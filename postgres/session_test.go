@@ -0,0 +1,134 @@
+package postgres
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/cache"
+	"github.com/mevdschee/tqdbproxy/pgproto"
+)
+
+// sessionBackend answers simple queries like a backend that tracks its
+// transaction status, and records them
+func sessionBackend(mu *sync.Mutex, queries *[]string) func(msgType byte, payload []byte) []byte {
+	txStatus := byte(pgproto.TxIdle)
+	return func(msgType byte, payload []byte) []byte {
+		query := strings.TrimSuffix(string(payload), "\x00")
+		mu.Lock()
+		*queries = append(*queries, query)
+		mu.Unlock()
+		tag := strings.Fields(query)[0]
+		if tag == "END" {
+			tag = "COMMIT"
+		}
+		switch tag {
+		case "BEGIN":
+			txStatus = pgproto.TxInTransaction
+		case "COMMIT", "ROLLBACK":
+			if !strings.Contains(query, " TO ") && !strings.HasSuffix(query, " AND CHAIN") {
+				txStatus = pgproto.TxIdle
+			}
+		}
+		return pgproto.ReadyForQuery{TxStatus: txStatus}.Encode(pgproto.CommandComplete{Tag: tag}.Encode(nil))
+	}
+}
+
+func TestHandleQuerySettings(t *testing.T) {
+	var mu sync.Mutex
+	var primary, replica []string
+	state := fakeBackendState(t, sessionBackend(&mu, &primary))
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	for _, query := range []string{
+		"SET search_path TO app",
+		"BEGIN",
+		"SET work_mem = '64MB'",
+		"ROLLBACK",
+		"BEGIN",
+		"SET TIME ZONE 'UTC'",
+		"COMMIT",
+	} {
+		p.handleQuery(pgproto.Query{String: query}.Encode(nil)[5:], newMockConn(), state)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A backend connection of the session that missed the settings gets the
+	// committed ones before its next query, once
+	addr := listenBackend(t, func(conn net.Conn) {
+		respond := sessionBackend(&mu, &replica)
+		for {
+			msgType, payload, err := pgproto.ReadMessage(conn)
+			if err != nil || msgType == pgproto.MsgTerminate {
+				return
+			}
+			conn.Write(respond(msgType, payload))
+		}
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state.backends[addr] = newBackendConn(conn, addr)
+	for i := 0; i < 2; i++ {
+		if _, err := p.backend(state, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := p.backend(state, state.primaryAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"SET search_path TO app", "SET TIME ZONE 'UTC'"}
+	if strings.Join(replica, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("Expected replayed settings %q, got %q", expected, replica)
+	}
+	if len(primary) != 7 {
+		t.Errorf("Expected no replay on the primary, got %q", primary)
+	}
+}
+
+func TestHandleQuerySavepoints(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	state := fakeBackendState(t, sessionBackend(&mu, &queries))
+	c, err := cache.New(cache.DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{cache: c}
+
+	for _, tt := range []struct {
+		query         string
+		inTransaction bool
+		settings      []string
+	}{
+		{"BEGIN", true, nil},
+		{"SET work_mem = '64MB'", true, nil},
+		{"SAVEPOINT a", true, nil},
+		{"SET search_path TO app", true, nil},
+		{"ROLLBACK TO SAVEPOINT a", true, nil},
+		{"COMMIT AND CHAIN", true, []string{"SET work_mem = '64MB'"}},
+		{"SET TIME ZONE 'UTC'", true, []string{"SET work_mem = '64MB'"}},
+		{"SAVEPOINT b", true, []string{"SET work_mem = '64MB'"}},
+		{"RELEASE SAVEPOINT b", true, []string{"SET work_mem = '64MB'"}},
+		{"END", false, []string{"SET work_mem = '64MB'", "SET TIME ZONE 'UTC'"}},
+	} {
+		p.handleQuery(pgproto.Query{String: tt.query}.Encode(nil)[5:], newMockConn(), state)
+		if state.inTransaction != tt.inTransaction {
+			t.Errorf("%s: expected in transaction = %v", tt.query, tt.inTransaction)
+		}
+		if got := state.settings.Queries(); strings.Join(got, "; ") != strings.Join(tt.settings, "; ") {
+			t.Errorf("%s: expected settings %q, got %q", tt.query, tt.settings, got)
+		}
+	}
+}
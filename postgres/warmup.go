@@ -0,0 +1,49 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/mevdschee/tqdbproxy/config"
+	"github.com/mevdschee/tqdbproxy/warmup"
+)
+
+// warmup prepares the statements of the prepare file on the write batch
+// connection db (nil = skip) and on every address of the backend pools, see
+// package warmup
+func (p *Proxy) warmup(pcfg config.ProxyConfig, db *sql.DB) {
+	if pcfg.PrepareFile == "" {
+		return
+	}
+	statements, err := warmup.Load(pcfg.PrepareFile)
+	if err != nil {
+		log.Printf("[PostgreSQL] Cannot read prepare file: %v", err)
+		return
+	}
+	ctx := context.Background()
+	if db != nil {
+		n, err := warmup.Prepare(ctx, db, statements)
+		logWarmup("write batch", n, len(statements), err)
+	}
+	for name, backend := range pcfg.Backends {
+		for _, addr := range append([]string{backend.Primary}, backend.Replicas...) {
+			db, err := p.connectToBackend(addr, backend.Username, backend.Password, backend.Database)
+			if err != nil {
+				log.Printf("[PostgreSQL] Warm-up of %s (%s) failed: %v", addr, name, err)
+				continue
+			}
+			n, err := warmup.Prepare(ctx, db, statements)
+			db.Close()
+			logWarmup(addr+" ("+name+")", n, len(statements), err)
+		}
+	}
+}
+
+// logWarmup logs the result of a warm-up
+func logWarmup(target string, prepared, total int, err error) {
+	log.Printf("[PostgreSQL] Prepared %d/%d statements on %s", prepared, total, target)
+	if err != nil {
+		log.Printf("[PostgreSQL] Warm-up of %s failed: %v", target, err)
+	}
+}
@@ -0,0 +1,205 @@
+// Package proxyproto reads the PROXY protocol header, version 1 (text) or 2
+// (binary), that load balancers such as HAProxy and cloud network load
+// balancers send ahead of the data of a client connection. The client address
+// of the header replaces the address of the load balancer, so that logs,
+// metrics, access rules and limits see the real client.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the time a client has to send the header
+const DefaultTimeout = 5 * time.Second
+
+var (
+	// ErrNoHeader is returned for a connection that does not start with a
+	// PROXY protocol header
+	ErrNoHeader = errors.New("no PROXY protocol header")
+	// ErrUntrusted is returned for a connection from an address that may
+	// not send a header
+	ErrUntrusted = errors.New("PROXY protocol header not allowed from this address")
+)
+
+// v2Signature starts a version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the maximum length of a version 1 header, CRLF included
+const v1MaxLength = 107
+
+// Options holds the PROXY protocol settings of a listener
+type Options struct {
+	Trusted []*net.IPNet  // Networks of the load balancers that may send a header (empty = all)
+	Timeout time.Duration // Time to read the header (0 = DefaultTimeout)
+}
+
+// ParseNetworks parses a list of addresses and CIDR networks, such as
+// 10.0.0.1 and 10.0.0.0/8
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Conn is a client connection with the client address of its PROXY protocol
+// header
+type Conn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the address of the client
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Accept reads the header of a new connection and returns the connection
+// with the client address of the header as remote address. The header is
+// read without reading beyond it. A LOCAL (version 2) or UNKNOWN (version 1)
+// header, as sent by health checks of load balancers, keeps the address of
+// the connection.
+func (o Options) Accept(conn net.Conn) (*Conn, error) {
+	if !o.trusted(conn.RemoteAddr()) {
+		return nil, ErrUntrusted
+	}
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	// The shortest header is "PROXY UNKNOWN\r\n" of 15 bytes
+	header := make([]byte, 15, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	var err error
+	switch {
+	case bytes.HasPrefix(header, v2Signature):
+		remote, err = readV2(conn, header)
+	case bytes.HasPrefix(header, []byte("PROXY ")):
+		remote, err = readV1(conn, header)
+	default:
+		err = ErrNoHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &Conn{Conn: conn, remote: remote}, nil
+}
+
+// trusted reports whether addr may send a header
+func (o Options) trusted(addr net.Addr) bool {
+	if len(o.Trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range o.Trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readV1 reads the rest of a version 1 header, of which the first bytes are
+// read, and returns the source address, nil for UNKNOWN
+func readV1(conn net.Conn, line []byte) (net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= v1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads the rest of a version 2 header, of which the first bytes are
+// read, and returns the source address, nil for LOCAL and for address
+// families other than TCP over IPv4 and IPv6
+func readV2(conn net.Conn, header []byte) (net.Addr, error) {
+	header = header[:16]
+	if _, err := io.ReadFull(conn, header[15:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+	switch command := header[12] & 0x0F; command {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", command)
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY protocol v2 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,89 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// accept sends data over a connection from 127.0.0.1 and returns the
+// accepted connection
+func accept(t *testing.T, o Options, data []byte) (*Conn, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write(data)
+		conn.Close()
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return o.Accept(conn)
+}
+
+func TestAccept(t *testing.T) {
+	v2 := append([]byte{}, v2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x0c, 0xea)
+	tests := []struct {
+		name   string
+		header string
+		remote string
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 3306\r\n", "192.0.2.1:12345"},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 5432\r\n", "[2001:db8::1]:12345"},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "127.0.0.1"},
+		{"v2 TCP4", string(v2), "192.0.2.1:12345"},
+		{"v2 LOCAL", string(append(append([]byte{}, v2Signature...), 0x20, 0, 0, 0)), "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := accept(t, Options{}, []byte(tt.header+"data"))
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+			remote := conn.RemoteAddr().String()
+			if host, _, _ := net.SplitHostPort(remote); tt.remote == "127.0.0.1" {
+				remote = host
+			}
+			if remote != tt.remote {
+				t.Errorf("Expected remote address %s, got %s", tt.remote, remote)
+			}
+			// The data after the header is left for the client protocol
+			data, err := io.ReadAll(conn)
+			if err != nil || string(data) != "data" {
+				t.Errorf("Expected the data after the header, got %q (%v)", data, err)
+			}
+		})
+	}
+}
+
+func TestAcceptErrors(t *testing.T) {
+	if _, err := accept(t, Options{}, []byte("\x16\x03\x01 client hello..")); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("Expected ErrNoHeader, got %v", err)
+	}
+	if _, err := accept(t, Options{}, []byte("PROXY TCP4 192.0.2.1\r\n")); err == nil {
+		t.Error("Expected an error for a malformed header")
+	}
+
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accept(t, Options{Trusted: trusted}, []byte("PROXY UNKNOWN\r\n")); !errors.Is(err, ErrUntrusted) {
+		t.Errorf("Expected ErrUntrusted, got %v", err)
+	}
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("Expected an error for an invalid network")
+	}
+}
@@ -0,0 +1,231 @@
+// Package quota enforces per-database budgets, so that one tenant of a shared
+// proxy cannot starve the others: bytes and entries in the result cache,
+// pending batched writes and queries per second.
+//
+// Budgets that are exceeded are enforced gracefully: queries and batched
+// writes over budget fail with an Error, results over the cache budget are
+// served without being cached. A nil *Quotas enforces nothing.
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrExceeded matches the errors returned for queries and writes over budget
+var ErrExceeded = errors.New("quota exceeded")
+
+// Resources with a budget, as reported in an Error
+const (
+	ResourceQPS           = "qps"
+	ResourcePendingWrites = "pending_writes"
+)
+
+// Error reports the database and resource of an exceeded budget
+type Error struct {
+	Database string
+	Resource string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("quota exceeded: database '%s' reached its %s limit", e.Database, e.Resource)
+}
+
+// Is makes errors.Is(err, ErrExceeded) true
+func (e *Error) Is(target error) bool {
+	return target == ErrExceeded
+}
+
+// Limits are the budgets of a database. Zero values are unlimited.
+type Limits struct {
+	CacheBytes    int64   `json:"cache_bytes"`    // Bytes of cached results
+	CacheEntries  int     `json:"cache_entries"`  // Number of cached results
+	PendingWrites int     `json:"pending_writes"` // Batched writes waiting for their batch
+	QPS           float64 `json:"qps"`            // Queries per second, with a burst of one second
+}
+
+// Usage is the resource usage of a database
+type Usage struct {
+	Database      string     `json:"database"`
+	Limits        Limits     `json:"limits"`
+	CacheBytes    int64      `json:"cache_bytes"`
+	CacheEntries  int        `json:"cache_entries"`
+	PendingWrites int        `json:"pending_writes"`
+	Queries       uint64     `json:"queries"`
+	Rejected      Rejections `json:"rejected"`
+}
+
+// Rejections counts what a database was denied because of its budgets
+type Rejections struct {
+	Queries     uint64 `json:"queries"`      // Queries over the qps budget
+	Writes      uint64 `json:"writes"`       // Batched writes over the pending writes budget
+	CacheStores uint64 `json:"cache_stores"` // Results not cached because of the cache budgets
+}
+
+// Quotas tracks the usage of each database against its budgets
+type Quotas struct {
+	mu       sync.Mutex
+	defaults Limits            // Budgets of databases without their own
+	limits   map[string]Limits // Budgets per database
+	tenants  map[string]*tenant
+	now      func() time.Time // Time source for the qps budget, set by tests
+}
+
+// tenant is the usage of a database
+type tenant struct {
+	usage    Usage
+	tokens   float64 // Queries allowed before the qps budget is exceeded
+	refilled time.Time
+}
+
+// New creates quotas with default budgets and budgets per database
+func New(defaults Limits, limits map[string]Limits) *Quotas {
+	q := &Quotas{tenants: make(map[string]*tenant), now: time.Now}
+	q.Update(defaults, limits)
+	return q
+}
+
+// Update replaces the budgets, e.g. on config reload. Usage is kept, so
+// lowered budgets are reached as cached results expire and writes complete.
+func (q *Quotas) Update(defaults Limits, limits map[string]Limits) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.defaults = defaults
+	q.limits = limits
+	for db, t := range q.tenants {
+		t.usage.Limits = q.limitsOf(db)
+	}
+}
+
+// limitsOf returns the budgets of a database
+func (q *Quotas) limitsOf(db string) Limits {
+	if l, ok := q.limits[db]; ok {
+		return l
+	}
+	return q.defaults
+}
+
+// tenant returns the usage of a database, creating it when needed
+func (q *Quotas) tenant(db string) *tenant {
+	t := q.tenants[db]
+	if t == nil {
+		l := q.limitsOf(db)
+		t = &tenant{usage: Usage{Database: db, Limits: l}, tokens: max(l.QPS, 1), refilled: q.now()}
+		q.tenants[db] = t
+	}
+	return t
+}
+
+// Allow counts a query of a database and returns an Error when it exceeds
+// the qps budget
+func (q *Quotas) Allow(db string) error {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenant(db)
+	t.usage.Queries++
+	qps := t.usage.Limits.QPS
+	if qps <= 0 {
+		return nil
+	}
+	now := q.now()
+	t.tokens = min(t.tokens+now.Sub(t.refilled).Seconds()*qps, max(qps, 1))
+	t.refilled = now
+	if t.tokens < 1 {
+		t.usage.Rejected.Queries++
+		return &Error{Database: db, Resource: ResourceQPS}
+	}
+	t.tokens--
+	return nil
+}
+
+// AcquireWrite reserves a pending batched write of a database, or returns an
+// Error when the pending writes budget is used up. The returned function
+// releases the reservation once the write completed.
+func (q *Quotas) AcquireWrite(db string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenant(db)
+	if n := t.usage.Limits.PendingWrites; n > 0 && t.usage.PendingWrites >= n {
+		t.usage.Rejected.Writes++
+		return nil, &Error{Database: db, Resource: ResourcePendingWrites}
+	}
+	t.usage.PendingWrites++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			t.usage.PendingWrites--
+			q.mu.Unlock()
+		})
+	}, nil
+}
+
+// ChargeCache charges a cached result of size bytes to a database and
+// reports whether it fits the cache budgets. It implements cache.Budget.
+func (q *Quotas) ChargeCache(db string, size int) bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenant(db)
+	l := t.usage.Limits
+	if (l.CacheEntries > 0 && t.usage.CacheEntries+1 > l.CacheEntries) ||
+		(l.CacheBytes > 0 && t.usage.CacheBytes+int64(size) > l.CacheBytes) {
+		return false
+	}
+	t.usage.CacheEntries++
+	t.usage.CacheBytes += int64(size)
+	return true
+}
+
+// RejectCache counts a result of a database that was not cached, because it
+// did not fit the cache budgets. It implements cache.Budget.
+func (q *Quotas) RejectCache(db string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tenant(db).usage.Rejected.CacheStores++
+}
+
+// ReleaseCache releases a cached result of size bytes that was charged to a
+// database, after it expired or was deleted. It implements cache.Budget.
+func (q *Quotas) ReleaseCache(db string, size int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tenant(db)
+	t.usage.CacheEntries--
+	t.usage.CacheBytes -= int64(size)
+}
+
+// Usage returns the usage of each database that was seen, by name
+func (q *Quotas) Usage() []Usage {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	usage := make([]Usage, 0, len(q.tenants))
+	for _, t := range q.tenants {
+		usage = append(usage, t.usage)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Database < usage[j].Database })
+	return usage
+}
@@ -0,0 +1,123 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotas_Allow(t *testing.T) {
+	now := time.Now()
+	q := New(Limits{QPS: 2}, map[string]Limits{"reports": {}})
+	q.now = func() time.Time { return now }
+
+	// The burst is one second of queries
+	for i := 0; i < 2; i++ {
+		if err := q.Allow("app"); err != nil {
+			t.Fatalf("Query %d: unexpected error: %v", i, err)
+		}
+	}
+	err := q.Allow("app")
+	if !errors.Is(err, ErrExceeded) {
+		t.Fatalf("Expected ErrExceeded, got %v", err)
+	}
+	var qerr *Error
+	if !errors.As(err, &qerr) || qerr.Database != "app" || qerr.Resource != ResourceQPS {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// A database with its own (unlimited) budget is not limited
+	for i := 0; i < 10; i++ {
+		if err := q.Allow("reports"); err != nil {
+			t.Fatalf("Unexpected error for unlimited database: %v", err)
+		}
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if err := q.Allow("app"); err != nil {
+		t.Errorf("Expected a query to be allowed after refill, got %v", err)
+	}
+
+	usage := q.Usage()
+	if len(usage) != 2 || usage[0].Database != "app" || usage[1].Database != "reports" {
+		t.Fatalf("Unexpected usage: %+v", usage)
+	}
+	if usage[0].Queries != 4 || usage[0].Rejected.Queries != 1 {
+		t.Errorf("Expected 4 queries with 1 rejected, got %+v", usage[0])
+	}
+}
+
+func TestQuotas_AcquireWrite(t *testing.T) {
+	q := New(Limits{PendingWrites: 1}, nil)
+
+	release, err := q.AcquireWrite("app")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := q.AcquireWrite("app"); !errors.Is(err, ErrExceeded) {
+		t.Fatalf("Expected ErrExceeded, got %v", err)
+	}
+	if _, err := q.AcquireWrite("other"); err != nil {
+		t.Errorf("Expected other databases to have their own budget, got %v", err)
+	}
+
+	release()
+	release() // Releasing twice releases once
+	if u := q.Usage()[0]; u.PendingWrites != 0 || u.Rejected.Writes != 1 {
+		t.Errorf("Unexpected usage: %+v", u)
+	}
+	if _, err := q.AcquireWrite("app"); err != nil {
+		t.Errorf("Expected a write after release, got %v", err)
+	}
+}
+
+func TestQuotas_Cache(t *testing.T) {
+	q := New(Limits{CacheBytes: 100, CacheEntries: 2}, nil)
+
+	if !q.ChargeCache("app", 60) {
+		t.Fatal("Expected the first entry to fit")
+	}
+	if q.ChargeCache("app", 60) {
+		t.Error("Expected an entry over the byte budget to be rejected")
+	}
+	if !q.ChargeCache("app", 40) {
+		t.Fatal("Expected an entry within the byte budget to fit")
+	}
+	if q.ChargeCache("app", 0) {
+		t.Error("Expected an entry over the entry budget to be rejected")
+	}
+	q.ReleaseCache("app", 60)
+	if !q.ChargeCache("app", 10) {
+		t.Error("Expected a released entry to make room")
+	}
+	if u := q.Usage()[0]; u.CacheBytes != 50 || u.CacheEntries != 2 {
+		t.Errorf("Unexpected usage: %+v", u)
+	}
+
+	// Lowered budgets apply to the usage so far
+	q.Update(Limits{CacheEntries: 1}, nil)
+	if q.ChargeCache("app", 1) {
+		t.Error("Expected the lowered budget to be exceeded")
+	}
+	if u := q.Usage()[0]; u.Limits.CacheEntries != 1 {
+		t.Errorf("Expected the usage to report the new budget, got %+v", u.Limits)
+	}
+}
+
+func TestQuotas_Nil(t *testing.T) {
+	var q *Quotas
+	if err := q.Allow("app"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	release, err := q.AcquireWrite("app")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release()
+	if !q.ChargeCache("app", 1<<30) {
+		t.Error("Expected nil quotas not to limit the cache")
+	}
+	if q.Usage() != nil {
+		t.Error("Expected no usage")
+	}
+}
@@ -0,0 +1,88 @@
+package replica
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// LagFunc measures the replication lag of the replica at addr
+type LagFunc func(ctx context.Context, addr string) (time.Duration, error)
+
+// lagTimeout bounds a lag check
+const lagTimeout = 2 * time.Second
+
+// SetLagCheck sets the function that measures the replication lag of the
+// replicas on every health check (nil = no lag checks), and the lag above
+// which a replica gets no reads (0 = no limit). A replica whose lag cannot be
+// measured stays in rotation, but is not used for reads with a maxlag hint.
+func (p *Pool) SetLagCheck(check LagFunc, maxLag time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lagCheck = check
+	p.maxLag = maxLag
+	if check == nil {
+		for addr := range p.lag {
+			metrics.ReplicaLag.DeleteLabelValues(addr)
+		}
+		p.lag = make(map[string]time.Duration)
+	}
+}
+
+// Lag returns the last measured replication lag of the replica at addr, and
+// whether it is known
+func (p *Pool) Lag(addr string) (time.Duration, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	lag, ok := p.lag[addr]
+	return lag, ok
+}
+
+// checkLag measures the replication lag of the replica at addr. Failures are
+// logged when the lag was known before.
+func (p *Pool) checkLag(addr string) {
+	p.mu.RLock()
+	check := p.lagCheck
+	p.mu.RUnlock()
+	if check == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lagTimeout)
+	defer cancel()
+	lag, err := check(ctx, addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.healthy[addr]; !exists {
+		return
+	}
+	_, known := p.lag[addr]
+	if err != nil {
+		if known {
+			log.Printf("[Replica] Lag check of %s failed: %v", addr, err)
+		}
+		delete(p.lag, addr)
+		metrics.ReplicaLag.DeleteLabelValues(addr)
+		return
+	}
+	if p.maxLag > 0 && lag > p.maxLag && (!known || p.lag[addr] <= p.maxLag) {
+		log.Printf("[Replica] %s lags %v behind, more than %v, excluded from reads", addr, lag, p.maxLag)
+	}
+	p.lag[addr] = lag
+	metrics.ReplicaLag.WithLabelValues(addr).Set(lag.Seconds())
+}
+
+// withinLag reports whether the replica at addr may serve a read with the
+// maximum lag maxLag (0 = any), with p.mu held: its measured lag must not
+// exceed the limit of the pool, nor maxLag, for which it must be known
+func (p *Pool) withinLag(addr string, maxLag time.Duration) bool {
+	lag, known := p.lag[addr]
+	if known && p.maxLag > 0 && lag > p.maxLag {
+		return false
+	}
+	return maxLag <= 0 || known && lag <= maxLag
+}
@@ -0,0 +1,69 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetReplicaMaxLag(t *testing.T) {
+	replicas := []string{"localhost:3307", "localhost:3308"}
+	pool := NewPool("localhost:3306", replicas)
+	lags := map[string]time.Duration{replicas[0]: 100 * time.Millisecond, replicas[1]: 3 * time.Second}
+	pool.SetLagCheck(func(ctx context.Context, addr string) (time.Duration, error) {
+		lag, ok := lags[addr]
+		if !ok {
+			return 0, errors.New("not a replica")
+		}
+		return lag, nil
+	}, 5*time.Second)
+	for _, addr := range replicas {
+		pool.checkLag(addr)
+	}
+	if lag, ok := pool.Lag(replicas[1]); !ok || lag != 3*time.Second {
+		t.Errorf("Expected a lag of 3s, got %v (known %v)", lag, ok)
+	}
+
+	// Both replicas are within the limit of the pool
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		addr, _ := pool.GetReplica()
+		seen[addr] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected both replicas, got %v", seen)
+	}
+
+	// A maxlag hint excludes the lagging replica, or all replicas
+	for i := 0; i < 3; i++ {
+		if addr, _ := pool.GetReplicaMaxLag(500 * time.Millisecond); addr != replicas[0] {
+			t.Errorf("Expected the replica within 500ms, got %s", addr)
+		}
+	}
+	if addr, name := pool.GetReplicaMaxLag(50 * time.Millisecond); name != "primary" || addr != "localhost:3306" {
+		t.Errorf("Expected the primary, got %s (%s)", addr, name)
+	}
+	if pool.failedOver {
+		t.Error("Expected a maxlag hint not to count as failover")
+	}
+
+	// Replicas above the limit of the pool are excluded
+	lags[replicas[0]] = 10 * time.Second
+	pool.checkLag(replicas[0])
+	for i := 0; i < 3; i++ {
+		if addr, _ := pool.GetReplica(); addr != replicas[1] {
+			t.Errorf("Expected the replica within the limit, got %s", addr)
+		}
+	}
+
+	// A replica with unknown lag serves reads, but not with a maxlag hint
+	delete(lags, replicas[0])
+	pool.checkLag(replicas[0])
+	if _, ok := pool.Lag(replicas[0]); ok {
+		t.Error("Expected the lag to be unknown after a failed check")
+	}
+	if addr, _ := pool.GetReplicaMaxLag(time.Minute); addr != replicas[1] {
+		t.Errorf("Expected the replica with known lag, got %s", addr)
+	}
+}
@@ -0,0 +1,174 @@
+package replica
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// Replica selection policies, see SetPolicy
+const (
+	RoundRobin       = "round_robin"       // Each replica in turn
+	Random           = "random"            // A random replica
+	LeastConnections = "least_connections" // The replica with the fewest queries in flight
+	LowestLatency    = "latency"           // The replica with the lowest average health check ping time
+)
+
+// Policies lists the valid replica selection policies
+var Policies = []string{RoundRobin, Random, LeastConnections, LowestLatency}
+
+// latencyWeight is the weight of a new ping time in the moving average
+const latencyWeight = 0.3
+
+// SetPolicy sets how GetReplica selects among the healthy replicas, and the
+// weight of each replica (default 1). Round-robin and random selection hand a
+// replica with weight 2 twice as many reads as one with weight 1, the other
+// policies divide its queries in flight or its latency by the weight. An
+// unknown policy falls back to round-robin.
+func (p *Pool) SetPolicy(policy string, weights map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch policy {
+	case RoundRobin, Random, LeastConnections, LowestLatency:
+	default:
+		log.Printf("[Replica] Unknown replica policy %q, using %s", policy, RoundRobin)
+		policy = RoundRobin
+	}
+	p.policy = policy
+	p.weights = make(map[string]int, len(weights))
+	for addr, weight := range weights {
+		if weight > 1 {
+			p.weights[addr] = weight
+		}
+	}
+	p.credit = make(map[string]int)
+}
+
+// Policy returns the replica selection policy of the pool
+func (p *Pool) Policy() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.policy
+}
+
+// Latency returns the moving average of the health check ping times of the
+// replica at addr, 0 before the first successful check
+func (p *Pool) Latency(addr string) time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.latency[addr]
+}
+
+// observeLatency adds a health check ping time to the moving average of addr
+func (p *Pool) observeLatency(addr string, ping time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.healthy[addr]; !exists {
+		return
+	}
+	if avg, ok := p.latency[addr]; ok {
+		ping = avg + time.Duration(latencyWeight*float64(ping-avg))
+	}
+	p.latency[addr] = ping
+}
+
+// weight returns the weight of the replica at addr, with p.mu held
+func (p *Pool) weight(addr string) int {
+	if weight, ok := p.weights[addr]; ok {
+		return weight
+	}
+	return 1
+}
+
+// pick selects one of the candidates (indexes into p.replicas) according to
+// the policy, with p.mu held
+func (p *Pool) pick(candidates []int) int {
+	switch p.policy {
+	case Random:
+		return p.pickRandom(candidates)
+	case LeastConnections:
+		return p.pickLowest(candidates, func(addr string) float64 { return float64(p.inflight[addr]) })
+	case LowestLatency:
+		return p.pickLowest(candidates, func(addr string) float64 { return float64(p.latency[addr]) })
+	}
+	if len(p.weights) > 0 {
+		return p.pickWeighted(candidates)
+	}
+	return p.pickNext(candidates)
+}
+
+// pickNext selects the first candidate at or after the round-robin index
+func (p *Pool) pickNext(candidates []int) int {
+	best := candidates[0]
+	for _, idx := range candidates {
+		if idx >= p.current {
+			best = idx
+			break
+		}
+	}
+	p.current = (best + 1) % len(p.replicas)
+	return best
+}
+
+// pickWeighted selects a candidate by smooth weighted round-robin: each
+// candidate earns its weight in credit, the one with the most credit is
+// selected and pays the total weight
+func (p *Pool) pickWeighted(candidates []int) int {
+	total := 0
+	best := candidates[0]
+	for _, idx := range candidates {
+		addr := p.replicas[idx]
+		weight := p.weight(addr)
+		total += weight
+		p.credit[addr] += weight
+		if p.credit[addr] > p.credit[p.replicas[best]] {
+			best = idx
+		}
+	}
+	p.credit[p.replicas[best]] -= total
+	return best
+}
+
+// pickRandom selects a random candidate, with a chance proportional to its
+// weight
+func (p *Pool) pickRandom(candidates []int) int {
+	total := 0
+	for _, idx := range candidates {
+		total += p.weight(p.replicas[idx])
+	}
+	n := rand.IntN(total)
+	for _, idx := range candidates {
+		n -= p.weight(p.replicas[idx])
+		if n < 0 {
+			return idx
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickLowest selects the candidate with the lowest cost divided by its
+// weight. Ties are broken in round-robin order, so that equal replicas share
+// the load.
+func (p *Pool) pickLowest(candidates []int, cost func(addr string) float64) int {
+	best, bestCost := -1, 0.0
+	n := len(candidates)
+	start := 0
+	for i, idx := range candidates {
+		if idx >= p.current {
+			start = i
+			break
+		}
+	}
+	for i := 0; i < n; i++ {
+		idx := candidates[(start+i)%n]
+		addr := p.replicas[idx]
+		c := cost(addr) / float64(p.weight(addr))
+		if best < 0 || c < bestCost {
+			best, bestCost = idx, c
+		}
+	}
+	p.current = (best + 1) % len(p.replicas)
+	return best
+}
@@ -0,0 +1,102 @@
+package replica
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetReplicaWeighted(t *testing.T) {
+	replicas := []string{"localhost:3307", "localhost:3308"}
+	pool := NewPool("localhost:3306", replicas)
+	pool.SetPolicy(RoundRobin, map[string]int{replicas[0]: 3})
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		addr, _ := pool.GetReplica()
+		counts[addr]++
+	}
+	if counts[replicas[0]] != 6 || counts[replicas[1]] != 2 {
+		t.Errorf("Expected a 3:1 split, got %v", counts)
+	}
+
+	// Weighted random selection stays in proportion
+	pool.SetPolicy(Random, map[string]int{replicas[0]: 3})
+	counts = make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		addr, _ := pool.GetReplica()
+		counts[addr]++
+	}
+	if counts[replicas[0]] < 2700 || counts[replicas[0]] > 3300 {
+		t.Errorf("Expected about 3000 of 4000 reads on the heavier replica, got %v", counts)
+	}
+}
+
+func TestGetReplicaLeastConnections(t *testing.T) {
+	replicas := []string{"localhost:3307", "localhost:3308", "localhost:3309"}
+	pool := NewPool("localhost:3306", replicas)
+	pool.SetPolicy(LeastConnections, nil)
+
+	done0 := pool.Track(replicas[0])
+	done1 := pool.Track(replicas[1])
+	pool.Track(replicas[1])
+	if addr, _ := pool.GetReplica(); addr != replicas[2] {
+		t.Errorf("Expected the idle replica, got %s", addr)
+	}
+	done := pool.Track(replicas[2])
+	defer done()
+	if addr, _ := pool.GetReplica(); addr != replicas[0] {
+		t.Errorf("Expected a replica with one query in flight, got %s", addr)
+	}
+
+	// Ties are shared
+	done0()
+	done1()
+	pool.Track(replicas[0])
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		addr, _ := pool.GetReplica()
+		seen[addr] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected tied replicas to take turns, got %v", seen)
+	}
+}
+
+func TestGetReplicaLowestLatency(t *testing.T) {
+	replicas := []string{"localhost:3307", "localhost:3308"}
+	pool := NewPool("localhost:3306", replicas)
+	pool.SetPolicy(LowestLatency, nil)
+
+	pool.observeLatency(replicas[0], 10*time.Millisecond)
+	pool.observeLatency(replicas[1], 2*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if addr, _ := pool.GetReplica(); addr != replicas[1] {
+			t.Errorf("Expected the fastest replica, got %s", addr)
+		}
+	}
+
+	// The moving average follows slower pings
+	for i := 0; i < 10; i++ {
+		pool.observeLatency(replicas[1], 20*time.Millisecond)
+	}
+	if latency := pool.Latency(replicas[1]); latency < 15*time.Millisecond {
+		t.Errorf("Expected the average to approach 20ms, got %v", latency)
+	}
+	if addr, _ := pool.GetReplica(); addr != replicas[0] {
+		t.Errorf("Expected the now faster replica, got %s", addr)
+	}
+
+	// Unhealthy replicas are skipped regardless of latency
+	pool.MarkUnhealthy(replicas[0])
+	if addr, _ := pool.GetReplica(); addr != replicas[1] {
+		t.Errorf("Expected the healthy replica, got %s", addr)
+	}
+}
+
+func TestSetPolicyUnknown(t *testing.T) {
+	pool := NewPool("localhost:3306", []string{"localhost:3307"})
+	pool.SetPolicy("fastest", nil)
+	if pool.Policy() != RoundRobin {
+		t.Errorf("Expected %s for an unknown policy, got %s", RoundRobin, pool.Policy())
+	}
+}
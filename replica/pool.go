@@ -2,11 +2,15 @@ package replica
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"slices"
 	"sync"
 	"time"
+
+	"github.com/mevdschee/tqdbproxy/alert"
 )
 
 // Pool manages a primary database and multiple read replicas
@@ -16,8 +20,25 @@ type Pool struct {
 	healthy  map[string]bool
 	current  int // round-robin index
 	mu       sync.RWMutex
+
+	policy  string                   // Replica selection policy, see SetPolicy
+	weights map[string]int           // Replica weights other than 1
+	credit  map[string]int           // Smooth weighted round-robin credit per replica
+	latency map[string]time.Duration // Moving average of health check ping times
+
+	lagCheck LagFunc                  // Measures the replication lag on health checks (nil = none)
+	maxLag   time.Duration            // Lag above which a replica gets no reads (0 = no limit)
+	lag      map[string]time.Duration // Last measured lag per replica
+
+	failedOver bool            // true while reads fall back to the primary
+	draining   map[string]bool // replicas excluded from routing for maintenance
+	inflight   map[string]int  // queries currently running per replica
 }
 
+// ErrUnknownReplica is returned when draining an address that is not a
+// replica of the pool
+var ErrUnknownReplica = errors.New("not a replica of this pool")
+
 // NewPool creates a new replica pool
 func NewPool(primary string, replicas []string) *Pool {
 	p := &Pool{
@@ -25,6 +46,13 @@ func NewPool(primary string, replicas []string) *Pool {
 		replicas: replicas,
 		healthy:  make(map[string]bool),
 		current:  0,
+		draining: make(map[string]bool),
+		inflight: make(map[string]int),
+		policy:   RoundRobin,
+		weights:  make(map[string]int),
+		credit:   make(map[string]int),
+		latency:  make(map[string]time.Duration),
+		lag:      make(map[string]time.Duration),
 	}
 
 	// Initially mark all replicas as healthy
@@ -45,16 +73,32 @@ func (p *Pool) UpdateReplicas(primary string, replicas []string) {
 
 	// Build new healthy map, preserving status of existing replicas
 	newHealthy := make(map[string]bool)
+	newDraining := make(map[string]bool)
+	newLatency := make(map[string]time.Duration)
+	newLag := make(map[string]time.Duration)
 	for _, r := range replicas {
 		if status, exists := p.healthy[r]; exists {
 			newHealthy[r] = status
 		} else {
 			newHealthy[r] = true // New replicas start as healthy
 		}
+		if p.draining[r] {
+			newDraining[r] = true
+		}
+		if latency, exists := p.latency[r]; exists {
+			newLatency[r] = latency
+		}
+		if lag, exists := p.lag[r]; exists {
+			newLag[r] = lag
+		}
 	}
 
 	p.replicas = replicas
 	p.healthy = newHealthy
+	p.draining = newDraining
+	p.latency = newLatency
+	p.lag = newLag
+	p.credit = make(map[string]int)
 
 	// Reset round-robin index if it's now out of bounds
 	if len(replicas) > 0 {
@@ -69,9 +113,18 @@ func (p *Pool) GetPrimary() string {
 	return p.primary
 }
 
-// GetReplica returns the next healthy replica using round-robin,
-// or the primary if no replicas are healthy. It returns (address, name).
+// GetReplica returns a healthy replica that is not draining, selected by the
+// policy of the pool (round-robin by default, see SetPolicy), or the primary
+// if there is none. It returns (address, name).
 func (p *Pool) GetReplica() (string, string) {
+	return p.GetReplicaMaxLag(0)
+}
+
+// GetReplicaMaxLag returns a replica like GetReplica, among the replicas with
+// a measured replication lag of at most maxLag (0 = any, see SetLagCheck).
+// When replicas are only excluded by maxLag, the read goes to the primary
+// without counting as a failover.
+func (p *Pool) GetReplicaMaxLag(maxLag time.Duration) (string, string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -79,21 +132,35 @@ func (p *Pool) GetReplica() (string, string) {
 		return p.primary, "primary"
 	}
 
-	// Try to find a healthy replica
-	attempts := 0
-	for attempts < len(p.replicas) {
-		idx := p.current
-		replica := p.replicas[idx]
-		p.current = (p.current + 1) % len(p.replicas)
-		attempts++
-
-		if p.healthy[replica] {
-			return replica, fmt.Sprintf("replicas[%d]", idx)
+	// Select among the healthy replicas within the lag limits
+	candidates := make([]int, 0, len(p.replicas))
+	usable := false
+	for idx, replica := range p.replicas {
+		if !p.healthy[replica] || p.draining[replica] || !p.withinLag(replica, 0) {
+			continue
+		}
+		usable = true
+		if p.withinLag(replica, maxLag) {
+			candidates = append(candidates, idx)
 		}
 	}
+	if len(candidates) > 0 {
+		idx := p.pick(candidates)
+		p.failedOver = false
+		return p.replicas[idx], fmt.Sprintf("replicas[%d]", idx)
+	}
+	if usable {
+		return p.primary, "primary"
+	}
 
 	// No healthy replicas, fall back to primary
 	log.Printf("[Replica] No healthy replicas available, using primary")
+	if !p.failedOver {
+		p.failedOver = true
+		alert.Fire(alert.Failover, "no healthy replicas, reads failed over to primary", map[string]string{
+			"primary": p.primary,
+		})
+	}
 	return p.primary, "primary"
 }
 
@@ -106,6 +173,7 @@ func (p *Pool) MarkUnhealthy(addr string) {
 		p.healthy[addr] = false
 		if wasHealthy {
 			log.Printf("[Replica] Marked %s as unhealthy", addr)
+			alert.Fire(alert.BackendDown, "backend marked unhealthy", map[string]string{"addr": addr})
 		}
 	}
 }
@@ -119,6 +187,7 @@ func (p *Pool) MarkHealthy(addr string) {
 		p.healthy[addr] = true
 		if !wasUnhealthy {
 			log.Printf("[Replica] Marked %s as healthy", addr)
+			alert.Fire(alert.BackendUp, "backend marked healthy", map[string]string{"addr": addr})
 		}
 	}
 }
@@ -144,6 +213,95 @@ func (p *Pool) GetHealthyCount() int {
 	return count
 }
 
+// Track marks the start of a query on the replica at addr and returns a
+// function that marks its end. Drain waits for tracked queries to finish.
+func (p *Pool) Track(addr string) func() {
+	p.mu.Lock()
+	p.inflight[addr]++
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		p.inflight[addr]--
+		if p.inflight[addr] <= 0 {
+			delete(p.inflight, addr)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// InFlight returns the number of tracked queries running on addr
+func (p *Pool) InFlight(addr string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.inflight[addr]
+}
+
+// Replicas returns the addresses of the replicas
+func (p *Pool) Replicas() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.replicas)
+}
+
+// HasReplica returns whether addr is a replica of this pool
+func (p *Pool) HasReplica(addr string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, exists := p.healthy[addr]
+	return exists
+}
+
+// Drain stops routing new queries to the replica at addr and waits until its
+// in-flight queries have finished or ctx is done. The replica stays excluded,
+// regardless of health checks, until Undrain is called.
+func (p *Pool) Drain(ctx context.Context, addr string) error {
+	p.mu.Lock()
+	if _, exists := p.healthy[addr]; !exists {
+		p.mu.Unlock()
+		return ErrUnknownReplica
+	}
+	if !p.draining[addr] {
+		p.draining[addr] = true
+		log.Printf("[Replica] Draining %s", addr)
+	}
+	p.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for p.InFlight(addr) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	log.Printf("[Replica] Drained %s", addr)
+	return nil
+}
+
+// Undrain puts a drained replica back into rotation
+func (p *Pool) Undrain(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.healthy[addr]; !exists {
+		return ErrUnknownReplica
+	}
+	if p.draining[addr] {
+		delete(p.draining, addr)
+		log.Printf("[Replica] Undrained %s", addr)
+	}
+	return nil
+}
+
+// IsDraining returns whether the replica at addr is draining or drained
+func (p *Pool) IsDraining(addr string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.draining[addr]
+}
+
 // StartHealthChecks begins periodic health checks for all replicas
 func (p *Pool) StartHealthChecks(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
@@ -176,12 +334,15 @@ func (p *Pool) checkReplica(addr string) {
 		dialAddr = addr[5:]
 	}
 
-	// Simple connection check
+	// Simple connection check, its duration feeds the latency average
+	start := time.Now()
 	conn, err := net.DialTimeout(network, dialAddr, 2*time.Second)
 	if err != nil {
 		p.MarkUnhealthy(addr)
 		return
 	}
+	p.observeLatency(addr, time.Since(start))
 	conn.Close()
 	p.MarkHealthy(addr)
+	p.checkLag(addr)
 }
@@ -178,3 +178,81 @@ func TestGetHealthyCount(t *testing.T) {
 		t.Errorf("Expected 0 healthy replicas, got %d", pool.GetHealthyCount())
 	}
 }
+
+func TestDrain(t *testing.T) {
+	pool := NewPool("localhost:3306", []string{"localhost:3307", "localhost:3308"})
+
+	done := pool.Track("localhost:3307")
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- pool.Drain(context.Background(), "localhost:3307")
+	}()
+
+	// Wait until draining is in effect
+	for !pool.IsDraining("localhost:3307") {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Draining replica is no longer selected
+	for i := 0; i < 4; i++ {
+		if addr, _ := pool.GetReplica(); addr != "localhost:3308" {
+			t.Errorf("Expected localhost:3308, got %s", addr)
+		}
+	}
+
+	// Health checks do not put it back into rotation
+	pool.MarkHealthy("localhost:3307")
+	if addr, _ := pool.GetReplica(); addr != "localhost:3308" {
+		t.Errorf("Expected localhost:3308 after MarkHealthy, got %s", addr)
+	}
+
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned before in-flight query finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("Drain returned error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not return after in-flight query finished")
+	}
+
+	if err := pool.Undrain("localhost:3307"); err != nil {
+		t.Fatalf("Undrain returned error: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		addr, _ := pool.GetReplica()
+		seen[addr] = true
+	}
+	if !seen["localhost:3307"] {
+		t.Error("Expected localhost:3307 back in rotation after Undrain")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	pool := NewPool("localhost:3306", []string{"localhost:3307"})
+	defer pool.Track("localhost:3307")()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Drain(ctx, "localhost:3307"); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+	if !pool.IsDraining("localhost:3307") {
+		t.Error("Replica should stay draining after timeout")
+	}
+}
+
+func TestDrainUnknown(t *testing.T) {
+	pool := NewPool("localhost:3306", []string{"localhost:3307"})
+	if err := pool.Drain(context.Background(), "localhost:3306"); err != ErrUnknownReplica {
+		t.Errorf("Expected ErrUnknownReplica for primary, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+// Package selftest connects to the listeners of a running proxy as a client
+// and runs a scripted set of statements through each protocol: the
+// handshake, a cacheable SELECT, hinted batch inserts, a transaction and a
+// prepared statement. It verifies the results and the routing reported by
+// the proxy, as a fast smoke test for deployments and CI images.
+//
+// The statements use the table tqdbproxy_selftest in the database of the
+// target, which is created and dropped by the test.
+package selftest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql" // Client of the MariaDB listener
+	_ "github.com/lib/pq"              // Client of the PostgreSQL listener
+)
+
+// Protocols of the targets
+const (
+	MariaDB  = "mariadb"
+	Postgres = "postgres"
+)
+
+// table is created, filled and dropped by the test
+const table = "tqdbproxy_selftest"
+
+// Target is a listener of the proxy with the credentials to connect to it
+type Target struct {
+	Protocol string // MariaDB or Postgres
+	Addr     string // Listen address of the proxy, where an empty or unspecified host means the local host
+	User     string
+	Password string
+	Database string
+}
+
+// dsn returns the data source name of the target for its driver
+func (t Target) dsn() (driver, dsn string) {
+	host, port, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		host, port = t.Addr, ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	if t.Protocol == Postgres {
+		dsn = fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+			quote(host), quote(port), quote(t.User), quote(t.Password), quote(t.Database))
+		return "postgres", dsn
+	}
+	return "mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s", t.User, t.Password, net.JoinHostPort(host, port), t.Database)
+}
+
+// quote quotes a value of a PostgreSQL connection string
+func quote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// Result is the outcome of a step of the test
+type Result struct {
+	Protocol string
+	Step     string
+	Duration time.Duration
+	Err      error // nil when the step passed
+}
+
+// Report holds the results of the steps, in the order they ran
+type Report struct {
+	Results []Result
+}
+
+// Passed reports whether all steps passed
+func (r Report) Passed() bool {
+	for _, result := range r.Results {
+		if result.Err != nil {
+			return false
+		}
+	}
+	return len(r.Results) > 0
+}
+
+// Print writes a line per step and a summary line
+func (r Report) Print(w io.Writer) {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(w, "FAIL %-8s %-16s %v\n", result.Protocol, result.Step, result.Err)
+		} else {
+			fmt.Fprintf(w, "PASS %-8s %-16s %v\n", result.Protocol, result.Step, result.Duration.Round(time.Microsecond))
+		}
+	}
+	if r.Passed() {
+		fmt.Fprintf(w, "PASS %d steps\n", len(r.Results))
+	} else {
+		fmt.Fprintf(w, "FAIL %d of %d steps\n", failed, len(r.Results))
+	}
+}
+
+// Run runs the steps against each target. The steps of a target stop at its
+// first failure, after which the table is dropped.
+func Run(ctx context.Context, targets []Target) Report {
+	var report Report
+	for _, target := range targets {
+		report.Results = append(report.Results, run(ctx, target)...)
+	}
+	return report
+}
+
+// session is the connection of a target, with the protocol specific syntax
+type session struct {
+	conn        *sql.Conn
+	placeholder string // Placeholder of the first parameter of a prepared statement
+	status      string // Query of the routing status of the last statement
+}
+
+// step is a named part of the test
+type step struct {
+	name string
+	run  func(ctx context.Context, s *session) error
+}
+
+var steps = []step{
+	{"cacheable select", cacheableSelect},
+	{"batch insert", batchInsert},
+	{"transaction", transaction},
+	{"prepared", prepared},
+}
+
+// run runs the steps against a target
+func run(ctx context.Context, target Target) []Result {
+	var results []Result
+	record := func(name string, start time.Time, err error) bool {
+		results = append(results, Result{Protocol: target.Protocol, Step: name, Duration: time.Since(start), Err: err})
+		return err == nil
+	}
+
+	start := time.Now()
+	s, db, err := connect(ctx, target)
+	if !record("handshake", start, err) {
+		return results
+	}
+	defer db.Close()
+	defer s.conn.Close()
+
+	start = time.Now()
+	_, err = s.conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+table)
+	if err == nil {
+		_, err = s.conn.ExecContext(ctx, "CREATE TABLE "+table+" (id INT PRIMARY KEY, value VARCHAR(64))")
+	}
+	if !record("create table", start, err) {
+		return results
+	}
+	for _, st := range steps {
+		start = time.Now()
+		if !record(st.name, start, st.run(ctx, s)) {
+			break
+		}
+	}
+	start = time.Now()
+	_, err = s.conn.ExecContext(ctx, "DROP TABLE "+table)
+	record("drop table", start, err)
+	return results
+}
+
+// connect opens a connection to a target and checks it
+func connect(ctx context.Context, target Target) (*session, *sql.DB, error) {
+	driver, dsn := target.dsn()
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err == nil {
+		err = conn.PingContext(ctx)
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	s := &session{conn: conn, placeholder: "?", status: "SHOW TQDB STATUS"}
+	if target.Protocol == Postgres {
+		s.placeholder, s.status = "$1", "SELECT * FROM pg_tqdb_status"
+	}
+	return s, db, nil
+}
+
+// backend returns the backend that served the last statement, as reported
+// by the proxy
+func (s *session) backend(ctx context.Context) (string, error) {
+	rows, err := s.conn.QueryContext(ctx, s.status)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return "", err
+		}
+		if name == "Backend" {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("no Backend in the status")
+}
+
+// expectBackend checks the backend that served the last statement
+func (s *session) expectBackend(ctx context.Context, prefix string) error {
+	backend, err := s.backend(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(backend, prefix) {
+		return fmt.Errorf("expected backend %s, got %s", prefix, backend)
+	}
+	return nil
+}
+
+// count returns the number of rows in the table
+func count(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}) (int, error) {
+	var n int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n)
+	return n, err
+}
+
+// cacheableSelect runs a SELECT with a ttl hint and repeats it until it is
+// served by the cache, as the cache stores results in the background. The
+// value makes the query unique, so that a result cached by an earlier run is
+// not hit the first time.
+func cacheableSelect(ctx context.Context, s *session) error {
+	value := time.Now().UnixNano() % 1_000_000_000
+	query := fmt.Sprintf("/* ttl:60 file:selftest line:1 */ SELECT %d", value)
+	var err error
+	for i := range 10 {
+		var got int64
+		if err := s.conn.QueryRowContext(ctx, query).Scan(&got); err != nil {
+			return err
+		}
+		if got != value {
+			return fmt.Errorf("expected %d, got %d", value, got)
+		}
+		if i == 0 {
+			continue
+		}
+		if err = s.expectBackend(ctx, "cache"); err == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// batchInsert inserts rows with a batch hint and expects them to be written
+// by the write batch manager
+func batchInsert(ctx context.Context, s *session) error {
+	for i, value := range []string{"a", "b", "c"} {
+		query := fmt.Sprintf("/* batch:10 file:selftest line:2 */ INSERT INTO %s (id, value) VALUES (%d, '%s')", table, i+1, value)
+		result, err := s.conn.ExecContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n != 1 {
+			return fmt.Errorf("expected 1 affected row, got %d (%v)", n, err)
+		}
+		if err := s.expectBackend(ctx, "write-batch"); err != nil {
+			return err
+		}
+	}
+	n, err := count(ctx, s.conn)
+	if err == nil && n != 3 {
+		err = fmt.Errorf("expected 3 rows, got %d", n)
+	}
+	return err
+}
+
+// transaction inserts a row in a transaction, expects it to be visible in
+// the transaction only, and rolls it back
+func transaction(ctx context.Context, s *session) error {
+	tx, err := s.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "/* batch:10 */ INSERT INTO "+table+" (id, value) VALUES (4, 'd')"); err != nil {
+		return err
+	}
+	if n, err := count(ctx, tx); err != nil || n != 4 {
+		return fmt.Errorf("expected 4 rows in the transaction, got %d (%v)", n, err)
+	}
+	if err := tx.Rollback(); err != nil {
+		return err
+	}
+	if n, err := count(ctx, s.conn); err != nil || n != 3 {
+		return fmt.Errorf("expected 3 rows after rollback, got %d (%v)", n, err)
+	}
+	return nil
+}
+
+// prepared reads a row with a prepared statement
+func prepared(ctx context.Context, s *session) error {
+	stmt, err := s.conn.PrepareContext(ctx, "SELECT value FROM "+table+" WHERE id = "+s.placeholder)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, expected := range map[int]string{1: "a", 2: "b"} {
+		var value string
+		if err := stmt.QueryRowContext(ctx, id).Scan(&value); err != nil {
+			return err
+		}
+		if value != expected {
+			return fmt.Errorf("expected %q for id %d, got %q", expected, id, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package selftest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTarget_DSN(t *testing.T) {
+	tests := []struct {
+		target      Target
+		driver, dsn string
+	}{
+		{Target{Protocol: MariaDB, Addr: ":3307", User: "app", Password: "secret", Database: "shop"},
+			"mysql", "app:secret@tcp(127.0.0.1:3307)/shop"},
+		{Target{Protocol: MariaDB, Addr: "10.0.0.1:3307", User: "app", Database: "shop"},
+			"mysql", "app:@tcp(10.0.0.1:3307)/shop"},
+		{Target{Protocol: Postgres, Addr: "0.0.0.0:5433", User: "app", Password: "it's", Database: "shop"},
+			"postgres", `host='127.0.0.1' port='5433' user='app' password='it\'s' dbname='shop' sslmode=disable`},
+	}
+	for _, tt := range tests {
+		driver, dsn := tt.target.dsn()
+		if driver != tt.driver || dsn != tt.dsn {
+			t.Errorf("dsn() = %s %q, expected %s %q", driver, dsn, tt.driver, tt.dsn)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	report := Report{Results: []Result{
+		{Protocol: MariaDB, Step: "handshake"},
+		{Protocol: Postgres, Step: "handshake", Err: errors.New("connection refused")},
+	}}
+	if report.Passed() {
+		t.Error("Expected a report with a failed step to fail")
+	}
+	var sb strings.Builder
+	report.Print(&sb)
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "PASS mariadb") ||
+		!strings.Contains(lines[1], "connection refused") || lines[2] != "FAIL 1 of 2 steps" {
+		t.Errorf("Unexpected report:\n%s", sb.String())
+	}
+	if (Report{}).Passed() {
+		t.Error("Expected an empty report to fail")
+	}
+}
+
+func TestRun_Unreachable(t *testing.T) {
+	report := Run(context.Background(), []Target{{Protocol: Postgres, Addr: "127.0.0.1:1", User: "app", Database: "shop"}})
+	if report.Passed() || len(report.Results) != 1 || report.Results[0].Step != "handshake" {
+		t.Errorf("Expected the handshake to fail and the other steps to be skipped, got %+v", report.Results)
+	}
+}
@@ -0,0 +1,123 @@
+// Package session tracks the session state a client changed with SET
+// statements, such as the character set, sql_mode, time zone, search_path
+// or isolation level. A proxy session moves between backend connections: to
+// another shard, to a replica for a read, or to a new connection after a
+// failure. The proxies replay the tracked statements on every backend
+// connection the session moves to, so that the settings survive the move.
+package session
+
+import "slices"
+
+// Settings holds the SET statements of a session that are in effect, in the
+// order they were executed. It is not safe for concurrent use.
+type Settings struct {
+	applied    []setting   // In effect, replayed by Queries
+	staged     []setting   // Executed in the open transaction, see Stage
+	savepoints []savepoint // Savepoints of the open transaction, innermost last
+	version    uint64      // Incremented on every change of applied
+}
+
+// savepoint is a savepoint of the open transaction and the number of
+// statements staged before it
+type savepoint struct {
+	name   string
+	staged int
+}
+
+// setting is a SET statement and the variables it still determines
+type setting struct {
+	query string
+	names []string // Lowercase variable names, nil for a statement that resets all variables
+}
+
+// Set records a statement that set the variables of names, or reset all
+// variables when names is nil. Earlier statements are dropped once every
+// variable they set is set again.
+func (s *Settings) Set(query string, names []string) {
+	s.version++
+	if names == nil {
+		s.applied = []setting{{query: query}}
+		return
+	}
+	kept := s.applied[:0]
+	for _, old := range s.applied {
+		if old.names != nil {
+			old.names = slices.DeleteFunc(slices.Clone(old.names), func(name string) bool {
+				return slices.Contains(names, name)
+			})
+			if len(old.names) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, old)
+	}
+	s.applied = append(kept, setting{query: query, names: names})
+}
+
+// Stage records a statement executed in a transaction, which takes effect
+// when the transaction commits, as SET does in PostgreSQL
+func (s *Settings) Stage(query string, names []string) {
+	s.staged = append(s.staged, setting{query: query, names: names})
+}
+
+// Commit applies the statements staged in the transaction that committed
+func (s *Settings) Commit() {
+	for _, st := range s.staged {
+		s.Set(st.query, st.names)
+	}
+	s.staged, s.savepoints = nil, nil
+}
+
+// Rollback drops the statements staged in the transaction that rolled back
+func (s *Settings) Rollback() {
+	s.staged, s.savepoints = nil, nil
+}
+
+// Savepoint marks a savepoint in the open transaction
+func (s *Settings) Savepoint(name string) {
+	s.savepoints = append(s.savepoints, savepoint{name: name, staged: len(s.staged)})
+}
+
+// RollbackTo drops the statements staged after the innermost savepoint with
+// the name, and the savepoints after it. The savepoint itself remains.
+func (s *Settings) RollbackTo(name string) {
+	if i := s.findSavepoint(name); i >= 0 {
+		s.staged = s.staged[:s.savepoints[i].staged]
+		s.savepoints = s.savepoints[:i+1]
+	}
+}
+
+// Release removes the innermost savepoint with the name and the savepoints
+// after it, keeping the statements staged after them
+func (s *Settings) Release(name string) {
+	if i := s.findSavepoint(name); i >= 0 {
+		s.savepoints = s.savepoints[:i]
+	}
+}
+
+// findSavepoint returns the index of the innermost savepoint with the name,
+// or -1
+func (s *Settings) findSavepoint(name string) int {
+	for i := len(s.savepoints) - 1; i >= 0; i-- {
+		if s.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Queries returns the statements to replay on a backend connection, in the
+// order they were executed
+func (s *Settings) Queries() []string {
+	queries := make([]string, len(s.applied))
+	for i, st := range s.applied {
+		queries[i] = st.query
+	}
+	return queries
+}
+
+// Version returns a number that changes whenever the statements returned by
+// Queries change, so that a backend connection can tell it missed a change
+func (s *Settings) Version() uint64 {
+	return s.version
+}
@@ -0,0 +1,79 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSettings_Set(t *testing.T) {
+	var s Settings
+	s.Set("SET sql_mode = '', time_zone = '+00:00'", []string{"sql_mode", "time_zone"})
+	s.Set("SET NAMES utf8mb4", []string{"names"})
+	s.Set("SET sql_mode = 'ANSI'", []string{"sql_mode"})
+	want := []string{"SET sql_mode = '', time_zone = '+00:00'", "SET NAMES utf8mb4", "SET sql_mode = 'ANSI'"}
+	if got := s.Queries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Queries() = %q, want %q", got, want)
+	}
+
+	// Statements whose variables are all set again are dropped
+	s.Set("SET time_zone = 'UTC'", []string{"time_zone"})
+	want = []string{"SET NAMES utf8mb4", "SET sql_mode = 'ANSI'", "SET time_zone = 'UTC'"}
+	if got := s.Queries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Queries() = %q, want %q", got, want)
+	}
+
+	// A reset of all variables replaces all statements
+	version := s.Version()
+	s.Set("RESET ALL", nil)
+	s.Set("SET search_path TO app", []string{"search_path"})
+	want = []string{"RESET ALL", "SET search_path TO app"}
+	if got := s.Queries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Queries() = %q, want %q", got, want)
+	}
+	if s.Version() == version {
+		t.Error("Expected the version to change")
+	}
+}
+
+func TestSettings_Stage(t *testing.T) {
+	var s Settings
+	s.Stage("SET work_mem = '64MB'", []string{"work_mem"})
+	if len(s.Queries()) != 0 || s.Version() != 0 {
+		t.Errorf("Expected staged statements to wait for the commit, got %q", s.Queries())
+	}
+	s.Rollback()
+	s.Commit()
+	if len(s.Queries()) != 0 {
+		t.Errorf("Expected rolled back statements to be dropped, got %q", s.Queries())
+	}
+
+	s.Stage("SET work_mem = '64MB'", []string{"work_mem"})
+	s.Commit()
+	if got := s.Queries(); !reflect.DeepEqual(got, []string{"SET work_mem = '64MB'"}) || s.Version() != 1 {
+		t.Errorf("Expected the committed statement, got %q (version %d)", got, s.Version())
+	}
+}
+
+func TestSettings_Savepoint(t *testing.T) {
+	var s Settings
+	s.Stage("SET work_mem = '64MB'", []string{"work_mem"})
+	s.Savepoint("a")
+	s.Stage("SET search_path TO app", []string{"search_path"})
+	s.Savepoint("b")
+	s.Stage("SET TIME ZONE 'UTC'", []string{"timezone"})
+
+	// Rolling back to a savepoint drops the statements after it, also after
+	// the savepoints it contains, and keeps the savepoint
+	s.RollbackTo("a")
+	s.Stage("SET statement_timeout = 0", []string{"statement_timeout"})
+	s.RollbackTo("a")
+	s.RollbackTo("b")
+	s.Stage("SET search_path TO public", []string{"search_path"})
+	s.Savepoint("c")
+	s.Release("c")
+	s.Commit()
+	want := []string{"SET work_mem = '64MB'", "SET search_path TO public"}
+	if got := s.Queries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Queries() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+// Package slowlog records the statements whose latency, as measured by the
+// proxy, exceeds a threshold. The last entries are kept in memory for SHOW
+// TQDB SLOW QUERIES (MariaDB), pg_tqdb_slow_queries (PostgreSQL) and the admin
+// API, and are optionally appended to a file as JSON lines, which is rotated
+// when it grows beyond a maximum size. With explain the proxy runs EXPLAIN on
+// the primary for slow SELECTs and attaches the plan to the entry.
+package slowlog
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// MaxQueryLen is the length at which recorded queries are truncated
+const MaxQueryLen = 4096
+
+// Entry is a slow statement
+type Entry struct {
+	Time      time.Time     `json:"time"` // When the statement was received
+	Protocol  string        `json:"protocol"`
+	ConnID    uint32        `json:"conn_id"`
+	User      string        `json:"user"`
+	Database  string        `json:"database"`
+	Query     string        `json:"query"` // Truncated to MaxQueryLen
+	Latency   time.Duration `json:"-"`     // Encoded as latency_ms
+	Backend   string        `json:"backend"`
+	Shard     string        `json:"shard,omitempty"`
+	File      string        `json:"file,omitempty"` // From the file hint
+	Line      int           `json:"line,omitempty"` // From the line hint
+	BatchSize int           `json:"batch_size,omitempty"`
+	Error     string        `json:"error,omitempty"`
+	Plan      string        `json:"plan,omitempty"` // Output of EXPLAIN, one row per line
+}
+
+// MarshalJSON encodes the entry with the latency in milliseconds
+func (e Entry) MarshalJSON() ([]byte, error) {
+	type entry Entry
+	return json.Marshal(struct {
+		entry
+		LatencyMs float64 `json:"latency_ms"`
+	}{entry(e), float64(e.Latency) / float64(time.Millisecond)})
+}
+
+// Config holds the settings of the slow query log
+type Config struct {
+	Threshold time.Duration // Latency from which a statement is slow (0 = disabled)
+	Size      int           // Entries kept in memory
+	File      string        // JSON lines file the entries are appended to ("" = memory only)
+	MaxFileMB int           // Size at which the file is rotated to File + ".1"
+	Explain   bool          // Attach the plan of slow SELECTs
+}
+
+// Log is the slow query log. A nil Log records nothing.
+type Log struct {
+	mu       sync.Mutex
+	config   Config
+	entries  []Entry
+	next     int // Position of the next entry
+	full     bool
+	file     *os.File
+	fileSize int64
+}
+
+// New creates a disabled slow query log
+func New() *Log {
+	return &Log{}
+}
+
+// Configure applies the settings. It can be called again on a config reload,
+// which keeps the entries unless the size changes.
+func (l *Log) Configure(cfg Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg.Size != l.config.Size {
+		l.entries, l.next, l.full = nil, 0, false
+		if cfg.Size > 0 {
+			l.entries = make([]Entry, cfg.Size)
+		}
+	}
+	if cfg.File != l.config.File {
+		l.closeFile()
+	}
+	l.config = cfg
+}
+
+// Slow reports whether a statement with this latency is recorded
+func (l *Log) Slow(latency time.Duration) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config.Threshold > 0 && latency >= l.config.Threshold
+}
+
+// Explain reports whether plans are attached to slow SELECTs
+func (l *Log) Explain() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config.Explain
+}
+
+// Add records an entry in memory and in the file
+func (l *Log) Add(e Entry) {
+	if l == nil {
+		return
+	}
+	if len(e.Query) > MaxQueryLen {
+		e.Query = e.Query[:MaxQueryLen]
+	}
+	metrics.SlowQueries.WithLabelValues(e.Protocol).Inc()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) > 0 {
+		l.entries[l.next] = e
+		l.next = (l.next + 1) % len(l.entries)
+		if l.next == 0 {
+			l.full = true
+		}
+	}
+	if err := l.write(e); err != nil {
+		log.Printf("[SlowLog] Failed to write %s: %v", l.config.File, err)
+		l.closeFile()
+	}
+}
+
+// Entries returns the entries in memory of a protocol ("" = all), oldest
+// first
+func (l *Log) Entries(protocol string) []Entry {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ordered := l.entries[:l.next]
+	if l.full {
+		ordered = append(append([]Entry(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+	}
+	var entries []Entry
+	for _, e := range ordered {
+		if protocol == "" || e.Protocol == protocol {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// write appends an entry to the file, rotating it when it is full, with l.mu
+// held
+func (l *Log) write(e Entry) error {
+	if l.config.File == "" {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	maxSize := int64(l.config.MaxFileMB) * 1024 * 1024
+	if l.file != nil && maxSize > 0 && l.fileSize+int64(len(line)) > maxSize {
+		l.closeFile()
+		if err := os.Rename(l.config.File, l.config.File+".1"); err != nil {
+			return err
+		}
+	}
+	if l.file == nil {
+		f, err := os.OpenFile(l.config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		l.file, l.fileSize = f, info.Size()
+	}
+	n, err := l.file.Write(line)
+	l.fileSize += int64(n)
+	return err
+}
+
+// closeFile closes the file, with l.mu held
+func (l *Log) closeFile() {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
@@ -0,0 +1,67 @@
+package slowlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	l := New()
+	if l.Slow(time.Hour) {
+		t.Error("Expected a new log to be disabled")
+	}
+	l.Configure(Config{Threshold: 100 * time.Millisecond, Size: 2})
+	if l.Slow(99*time.Millisecond) || !l.Slow(100*time.Millisecond) {
+		t.Error("Expected statements from the threshold to be slow")
+	}
+
+	for i := range 3 {
+		l.Add(Entry{Protocol: "mariadb", Query: fmt.Sprintf("SELECT %d", i)})
+	}
+	l.Add(Entry{Protocol: "postgres", Query: strings.Repeat("x", MaxQueryLen+1)})
+	entries := l.Entries("")
+	if len(entries) != 2 || entries[0].Query != "SELECT 2" || len(entries[1].Query) != MaxQueryLen {
+		t.Errorf("Expected the last 2 entries, oldest first, got %+v", entries)
+	}
+	if entries := l.Entries("mariadb"); len(entries) != 1 || entries[0].Query != "SELECT 2" {
+		t.Errorf("Expected the MariaDB entry, got %+v", entries)
+	}
+
+	var none *Log
+	none.Add(Entry{})
+	if none.Slow(time.Hour) || none.Entries("") != nil {
+		t.Error("Expected a nil log to record nothing")
+	}
+}
+
+func TestLog_File(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "slow.log")
+	l := New()
+	l.Configure(Config{Threshold: time.Millisecond, File: file, MaxFileMB: 1})
+	l.Add(Entry{Protocol: "postgres", Query: "SELECT pg_sleep(1)", Latency: time.Second, File: "report.go", Line: 12, Plan: "Result"})
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"query":"SELECT pg_sleep(1)"`, `"latency_ms":1000`, `"file":"report.go"`, `"line":12`, `"plan":"Result"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected the file to contain %s, got %s", want, data)
+		}
+	}
+
+	// Entries beyond the maximum size rotate the file
+	for range 300 {
+		l.Add(Entry{Protocol: "postgres", Query: strings.Repeat("x", MaxQueryLen)})
+	}
+	if _, err := os.Stat(file + ".1"); err != nil {
+		t.Errorf("Expected the file to be rotated: %v", err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Size() > 1024*1024 {
+		t.Errorf("Expected the file to stay below 1 MB, got %v", info)
+	}
+}
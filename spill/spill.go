@@ -0,0 +1,91 @@
+// Package spill bounds the memory used for responses that the proxy must
+// read completely before sending them, so that a failed read can be retried
+// on another node. A Buffer holds a response in memory up to a threshold and
+// writes the rest to a temporary file, which is removed when the buffer is
+// closed. Spilled responses are too large to cache and are sent from the
+// file.
+package spill
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// Buffer holds a response in memory up to a threshold and in a temporary
+// file beyond it
+type Buffer struct {
+	dir       string
+	threshold int
+	mem       []byte
+	file      *os.File
+	size      int64 // Bytes in the file
+}
+
+// New returns a buffer that spills to a file in dir (empty = the system
+// temporary directory) beyond threshold bytes
+func New(dir string, threshold int) *Buffer {
+	return &Buffer{dir: dir, threshold: threshold}
+}
+
+// Write appends p to the buffer. Once the buffer outgrew the threshold,
+// everything written after goes to the file.
+func (b *Buffer) Write(p []byte) (int, error) {
+	if b.file == nil && len(b.mem)+len(p) <= b.threshold {
+		b.mem = append(b.mem, p...)
+		return len(p), nil
+	}
+	if b.file == nil {
+		f, err := os.CreateTemp(b.dir, "tqdbproxy-spill-*")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+		metrics.SpillFiles.Inc()
+	}
+	n, err := b.file.Write(p)
+	b.size += int64(n)
+	metrics.SpillBytes.Add(float64(n))
+	metrics.SpillBytesInUse.Add(float64(n))
+	return n, err
+}
+
+// Spilled reports whether the buffer outgrew the threshold
+func (b *Buffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Len returns the number of bytes written
+func (b *Buffer) Len() int64 {
+	return int64(len(b.mem)) + b.size
+}
+
+// Bytes returns the part of the buffer held in memory, all of it when the
+// buffer did not spill
+func (b *Buffer) Bytes() []byte {
+	return b.mem
+}
+
+// Reader returns a reader of the whole buffer, from the start
+func (b *Buffer) Reader() io.Reader {
+	if b.file == nil {
+		return bytes.NewReader(b.mem)
+	}
+	return io.MultiReader(bytes.NewReader(b.mem), io.NewSectionReader(b.file, 0, b.size))
+}
+
+// Close removes the file, the buffer must not be used after
+func (b *Buffer) Close() error {
+	b.mem = nil
+	if b.file == nil {
+		return nil
+	}
+	metrics.SpillBytesInUse.Sub(float64(b.size))
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	b.size = 0
+	return err
+}
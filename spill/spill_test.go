@@ -0,0 +1,47 @@
+package spill
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestBuffer(t *testing.T) {
+	dir := t.TempDir()
+	b := New(dir, 8)
+	b.Write([]byte("abcd"))
+	b.Write([]byte("efgh"))
+	if b.Spilled() {
+		t.Fatal("Expected a buffer within the threshold to stay in memory")
+	}
+	if string(b.Bytes()) != "abcdefgh" {
+		t.Errorf("Expected abcdefgh in memory, got %q", b.Bytes())
+	}
+
+	b.Write([]byte("ijkl"))
+	b.Write([]byte("mn"))
+	if !b.Spilled() || b.Len() != 14 {
+		t.Fatalf("Expected 14 spilled bytes, got %d (spilled %v)", b.Len(), b.Spilled())
+	}
+	data, err := io.ReadAll(b.Reader())
+	if err != nil || !bytes.Equal(data, []byte("abcdefghijklmn")) {
+		t.Errorf("Expected the whole buffer, got %q (%v)", data, err)
+	}
+	// The reader starts over
+	data, _ = io.ReadAll(b.Reader())
+	if string(data) != "abcdefghijklmn" {
+		t.Errorf("Expected the whole buffer again, got %q", data)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Expected the spill file to be removed, found %d files", len(entries))
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("Expected a second close to do nothing, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+// Package tcpopt applies TCP tuning options, such as keepalive and the
+// user timeout, to client and backend connections.
+package tcpopt
+
+import (
+	"net"
+	"time"
+)
+
+// Options holds TCP tuning options for a connection
+type Options struct {
+	KeepAlive   time.Duration // Keepalive idle time and probe interval (0 = Go default, < 0 = disabled)
+	UserTimeout time.Duration // Max time sent data may stay unacknowledged, Linux only (0 = OS default)
+	NoDelay     bool          // Send small packets immediately (disables Nagle's algorithm)
+	ReadBuffer  int           // Socket receive buffer in bytes (0 = OS default)
+	WriteBuffer int           // Socket send buffer in bytes (0 = OS default)
+}
+
+// Default returns the options Go uses for new TCP connections
+func Default() Options {
+	return Options{NoDelay: true}
+}
+
+// Apply sets the options on conn. Connections that are not TCP, such as Unix
+// socket connections, are left alone.
+func (o Options) Apply(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if o.KeepAlive < 0 {
+		if err := tcp.SetKeepAlive(false); err != nil {
+			return err
+		}
+	} else if o.KeepAlive > 0 {
+		err := tcp.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.KeepAlive,
+			Interval: o.KeepAlive,
+			Count:    -1, // OS default
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tcp.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	if o.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if o.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+	if o.UserTimeout > 0 {
+		if err := setUserTimeout(tcp, o.UserTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
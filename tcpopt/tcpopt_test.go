@@ -0,0 +1,49 @@
+package tcpopt
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestApply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	opts := Options{
+		KeepAlive:   5 * time.Second,
+		UserTimeout: 10 * time.Second,
+		NoDelay:     false,
+		ReadBuffer:  64 * 1024,
+		WriteBuffer: 64 * 1024,
+	}
+	if err := opts.Apply(conn); err != nil {
+		t.Errorf("Apply failed: %v", err)
+	}
+	if err := (Options{KeepAlive: -1}).Apply(conn); err != nil {
+		t.Errorf("Apply with keepalive disabled failed: %v", err)
+	}
+}
+
+func TestApplyNonTCP(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := Default().Apply(a); err != nil {
+		t.Errorf("Apply on non-TCP connection should be a no-op, got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package tcpopt
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT from linux/tcp.h
+const tcpUserTimeout = 0x12
+
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, int(timeout.Milliseconds()))
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package tcpopt
+
+import (
+	"net"
+	"time"
+)
+
+// setUserTimeout is a no-op, TCP_USER_TIMEOUT is only supported on Linux
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return nil
+}
@@ -0,0 +1,243 @@
+// Package throttle limits the queries of each client address, user and
+// backend, so that a single misbehaving application instance cannot overload
+// the backends: queries per second and concurrent queries per scope.
+//
+// A query over a limit waits up to the configured wait time for the limit to
+// allow it, and then fails with an Error, the SQL counterpart of HTTP 429.
+// A nil *Throttle limits nothing.
+package throttle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/limiter"
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// ErrThrottled matches the errors returned for queries over a limit
+var ErrThrottled = errors.New("too many queries")
+
+// Scopes of the limits, as reported in an Error
+const (
+	ScopeClient  = "client"  // Per client address, without the port
+	ScopeUser    = "user"    // Per client user
+	ScopeBackend = "backend" // Per backend pool
+)
+
+// Limits, as reported in an Error
+const (
+	LimitQPS         = "qps"
+	LimitConcurrency = "concurrency"
+)
+
+// idleTimeout is the time after which the state of an idle key is removed
+const idleTimeout = time.Minute
+
+// Error reports the scope, key and limit of a throttled query
+type Error struct {
+	Scope string
+	Key   string
+	Limit string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("too many queries: %s '%s' reached its %s limit", e.Scope, e.Key, e.Limit)
+}
+
+// Is makes errors.Is(err, ErrThrottled) true
+func (e *Error) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// Limits are the limits of each key of a scope. Zero values are unlimited.
+type Limits struct {
+	QPS         float64 // Queries per second, with a burst of one second
+	Concurrency int     // Queries executing at the same time
+}
+
+// Config holds the limits per scope
+type Config struct {
+	Client  Limits
+	User    Limits
+	Backend Limits
+	Wait    time.Duration // Time a query waits for its limits before it is rejected (0 = reject immediately)
+}
+
+// scopes returns the limits in the order they are acquired
+func (c Config) scopes() [3]Limits {
+	return [3]Limits{c.Client, c.User, c.Backend}
+}
+
+var scopeNames = [3]string{ScopeClient, ScopeUser, ScopeBackend}
+
+// Throttle tracks the queries of each key against the limits of its scope
+type Throttle struct {
+	mu     sync.Mutex
+	config Config
+	keys   map[key]*state
+	swept  time.Time
+	now    func() time.Time // Time source for the qps limits, set by tests
+}
+
+// key is a client address, user or backend
+type key struct {
+	scope int
+	name  string
+}
+
+// state is the usage of a key
+type state struct {
+	sem      *limiter.Semaphore // Concurrency slots (nil = unlimited)
+	tokens   float64            // Queries allowed before the qps limit is exceeded, negative when queries wait
+	refilled time.Time
+	used     time.Time
+}
+
+// New creates a throttle with the limits of cfg
+func New(cfg Config) *Throttle {
+	return &Throttle{config: cfg, keys: make(map[key]*state), now: time.Now}
+}
+
+// Update replaces the limits, e.g. on config reload. When they changed, the
+// usage starts over; queries that are executing release their slot in the
+// old semaphores, so lowered concurrency limits may briefly be exceeded.
+func (t *Throttle) Update(cfg Config) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cfg != t.config {
+		t.config = cfg
+		t.keys = make(map[key]*state)
+	}
+}
+
+// state returns the usage of a key, creating it when needed, with t.mu held
+func (t *Throttle) state(k key, l Limits, now time.Time) *state {
+	s := t.keys[k]
+	if s == nil {
+		s = &state{sem: limiter.NewSemaphore(l.Concurrency), tokens: max(l.QPS, 1), refilled: now}
+		t.keys[k] = s
+	}
+	s.used = now
+	return s
+}
+
+// sweep removes the state of keys that were idle long enough for their
+// usage to be forgotten, with t.mu held
+func (t *Throttle) sweep(now time.Time) {
+	if now.Sub(t.swept) < idleTimeout {
+		return
+	}
+	t.swept = now
+	for k, s := range t.keys {
+		if now.Sub(s.used) > idleTimeout && s.sem.InUse() == 0 && s.sem.Waiting() == 0 {
+			delete(t.keys, k)
+		}
+	}
+}
+
+// Acquire admits a query of a client address, user and backend, waiting up
+// to the configured wait time when it is over a limit. It returns an Error
+// when the query is rejected, or a function that must be called once the
+// query completed.
+func (t *Throttle) Acquire(client, user, backend string) (func(), error) {
+	if t == nil {
+		return func() {}, nil
+	}
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	names := [3]string{client, user, backend}
+
+	t.mu.Lock()
+	cfg := t.config
+	now := t.now()
+	t.sweep(now)
+	var states [3]*state
+	var delay time.Duration
+	delayed := 0 // Scope with the longest delay
+	for i, l := range cfg.scopes() {
+		if l.QPS <= 0 && l.Concurrency <= 0 {
+			continue
+		}
+		states[i] = t.state(key{i, names[i]}, l, now)
+		if l.QPS > 0 {
+			s := states[i]
+			s.tokens = min(s.tokens+now.Sub(s.refilled).Seconds()*l.QPS, max(l.QPS, 1))
+			s.refilled = now
+			if s.tokens < 1 {
+				wait := time.Duration((1 - s.tokens) / l.QPS * float64(time.Second))
+				if wait > cfg.Wait {
+					t.mu.Unlock()
+					return nil, reject(i, names[i], LimitQPS)
+				}
+				if wait > delay {
+					delay, delayed = wait, i
+				}
+			}
+		}
+	}
+	// Take the tokens of all scopes only once the query is admitted, so that
+	// a rejected query does not count
+	for i, l := range cfg.scopes() {
+		if l.QPS > 0 {
+			states[i].tokens--
+		}
+	}
+	t.mu.Unlock()
+
+	deadline := time.Now().Add(cfg.Wait)
+	if delay > 0 {
+		metrics.Throttled.WithLabelValues(scopeNames[delayed], "delayed").Inc()
+		time.Sleep(delay)
+	}
+
+	released := make([]*limiter.Semaphore, 0, len(states))
+	release := func() {
+		for _, sem := range released {
+			sem.Release()
+		}
+	}
+	for i, s := range states {
+		if s == nil || s.sem == nil {
+			continue
+		}
+		if err := acquire(s.sem, i, deadline); err != nil {
+			release()
+			return nil, reject(i, names[i], LimitConcurrency)
+		}
+		released = append(released, s.sem)
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// acquire takes a slot of a semaphore, waiting until the deadline when no
+// slot is free
+func acquire(sem *limiter.Semaphore, scope int, deadline time.Time) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sem.Acquire(ctx) == nil {
+		return nil
+	}
+	if !time.Now().Before(deadline) {
+		return ErrThrottled
+	}
+	metrics.Throttled.WithLabelValues(scopeNames[scope], "delayed").Inc()
+	ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	return sem.Acquire(ctx)
+}
+
+// reject counts a rejected query and returns its Error
+func reject(scope int, name, limit string) error {
+	metrics.Throttled.WithLabelValues(scopeNames[scope], "rejected").Inc()
+	return &Error{Scope: scopeNames[scope], Key: name, Limit: limit}
+}
@@ -0,0 +1,104 @@
+package throttle
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottle_QPS(t *testing.T) {
+	now := time.Now()
+	th := New(Config{Client: Limits{QPS: 2}})
+	th.now = func() time.Time { return now }
+
+	// The burst is one second of queries, per client address
+	for i := 0; i < 2; i++ {
+		if _, err := th.Acquire("10.0.0.1:5000", "app", "main"); err != nil {
+			t.Fatalf("Query %d: unexpected error: %v", i, err)
+		}
+	}
+	_, err := th.Acquire("10.0.0.1:5001", "app", "main")
+	if !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Expected ErrThrottled, got %v", err)
+	}
+	var terr *Error
+	if !errors.As(err, &terr) || terr.Scope != ScopeClient || terr.Key != "10.0.0.1" || terr.Limit != LimitQPS {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := th.Acquire("10.0.0.2:5000", "app", "main"); err != nil {
+		t.Errorf("Expected other clients to have their own limit, got %v", err)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if _, err := th.Acquire("10.0.0.1:5000", "app", "main"); err != nil {
+		t.Errorf("Expected a query to be allowed after refill, got %v", err)
+	}
+}
+
+func TestThrottle_QPSWait(t *testing.T) {
+	th := New(Config{User: Limits{QPS: 100}, Wait: time.Second})
+	start := time.Now()
+	for i := 0; i < 102; i++ {
+		if _, err := th.Acquire("10.0.0.1:5000", "app", "main"); err != nil {
+			t.Fatalf("Query %d: expected to wait for the limit, got %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected the queries over the burst to be delayed, took %v", elapsed)
+	}
+}
+
+func TestThrottle_Concurrency(t *testing.T) {
+	th := New(Config{Backend: Limits{Concurrency: 1}, Wait: 20 * time.Millisecond})
+
+	release, err := th.Acquire("10.0.0.1:5000", "app", "main")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = th.Acquire("10.0.0.2:5000", "report", "main")
+	var terr *Error
+	if !errors.As(err, &terr) || terr.Scope != ScopeBackend || terr.Limit != LimitConcurrency {
+		t.Fatalf("Expected the backend concurrency limit, got %v", err)
+	}
+	if _, err := th.Acquire("10.0.0.1:5000", "app", "shard1"); err != nil {
+		t.Errorf("Expected other backends to have their own limit, got %v", err)
+	}
+
+	// A waiting query gets the slot once it is released
+	first := release
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		first()
+		first() // Releasing twice releases once
+	}()
+	release, err = th.Acquire("10.0.0.2:5000", "report", "main")
+	if err != nil {
+		t.Fatalf("Expected the query to get the released slot, got %v", err)
+	}
+	release()
+	if _, err := th.Acquire("10.0.0.2:5000", "report", "main"); err != nil {
+		t.Errorf("Expected a query after release, got %v", err)
+	}
+}
+
+func TestThrottle_Update(t *testing.T) {
+	th := New(Config{User: Limits{Concurrency: 1}})
+	if _, err := th.Acquire("", "app", "main"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := th.Acquire("", "app", "main"); !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Expected ErrThrottled, got %v", err)
+	}
+	th.Update(Config{})
+	if _, err := th.Acquire("", "app", "main"); err != nil {
+		t.Errorf("Expected the removed limit not to apply, got %v", err)
+	}
+
+	var none *Throttle
+	release, err := none.Acquire("", "app", "main")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release()
+	none.Update(Config{})
+}
@@ -0,0 +1,313 @@
+// Package tlsopt builds TLS client configurations for backend connections
+// from the verification modes of the configuration, which follow the sslmode
+// values of PostgreSQL, and TLS server configurations for the listeners.
+//
+// The CA and certificate files are loaded once and reloaded when they
+// change on disk, so that rotated certificates apply to new connections
+// without a restart, while existing connections keep theirs. A file that
+// fails to reload, e.g. because it is half written, keeps the certificates
+// loaded before.
+package tlsopt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// Verification modes for backend TLS
+const (
+	ModeDisable    = "disable"     // No TLS
+	ModeRequire    = "require"     // Encrypted, the certificate is not verified
+	ModeVerifyCA   = "verify-ca"   // The certificate must be signed by a trusted CA
+	ModeVerifyFull = "verify-full" // As verify-ca, and the certificate must match the host name
+)
+
+// Modes lists the valid verification modes
+var Modes = []string{ModeDisable, ModeRequire, ModeVerifyCA, ModeVerifyFull}
+
+// ModePrefer accepts TLS and plaintext clients on a listener, ModeRequire
+// rejects the plaintext ones
+const ModePrefer = "prefer"
+
+// ServerModes lists the valid modes of a listener
+var ServerModes = []string{ModeDisable, ModePrefer, ModeRequire}
+
+// Server returns the TLS configuration of a listener with the certificate and
+// key files. The files are read through the cache of loaded files, and again
+// on each handshake when they changed.
+func Server(certFile, keyFile string) (*tls.Config, error) {
+	if _, err := loaded.keyPair(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loaded.keyPair(certFile, keyFile)
+		},
+	}, nil
+}
+
+// Client returns the TLS configuration to connect to host in the given mode,
+// or nil for ModeDisable. The CA file defaults to the system roots, a client
+// certificate is only sent when certFile and keyFile are set. The files are
+// read through the cache of loaded files, and again on each handshake when
+// they changed.
+func Client(mode, host, caFile, certFile, keyFile string) (*tls.Config, error) {
+	if mode == "" || mode == ModeDisable {
+		return nil, nil
+	}
+	if mode != ModeRequire && mode != ModeVerifyCA && mode != ModeVerifyFull {
+		return nil, fmt.Errorf("unknown TLS mode %q", mode)
+	}
+
+	cfg := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		if _, err := loaded.caPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		if _, err := loaded.keyPair(certFile, keyFile); err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loaded.keyPair(certFile, keyFile)
+		}
+	}
+
+	switch mode {
+	case ModeRequire:
+		cfg.InsecureSkipVerify = true
+	case ModeVerifyCA, ModeVerifyFull:
+		if caFile == "" && mode == ModeVerifyFull {
+			break // The system roots, verified by crypto/tls
+		}
+		// Verify the chain ourselves, with the CA pool loaded at the time of
+		// the handshake, and the host name for verify-full
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("backend sent no certificate")
+			}
+			opts := x509.VerifyOptions{Intermediates: x509.NewCertPool()}
+			if mode == ModeVerifyFull {
+				opts.DNSName = host
+			}
+			if caFile != "" {
+				roots, err := loaded.caPool(caFile)
+				if err != nil {
+					return err
+				}
+				opts.Roots = roots
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return cfg, nil
+}
+
+// HandshakeTimeout limits the TLS handshake of a client of a listener
+const HandshakeTimeout = 10 * time.Second
+
+// Accept runs the TLS handshake of a client that asked a listener for TLS
+func Accept(conn net.Conn, cfg *tls.Config) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// loaded caches the files read by Client and Server
+var loaded = &files{cas: make(map[string]*caFile), pairs: make(map[[2]string]*pairFile)}
+
+// files holds the loaded CA files and key pairs
+type files struct {
+	mu    sync.Mutex
+	cas   map[string]*caFile
+	pairs map[[2]string]*pairFile // Certificate and key file -> key pair
+}
+
+// stamp identifies the content of a file by its modification time and size
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// stampOf returns the stamp of a file
+func stampOf(path string) (stamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp{}, err
+	}
+	return stamp{info.ModTime(), info.Size()}, nil
+}
+
+// caFile is a loaded CA file
+type caFile struct {
+	stamp stamp
+	pool  *x509.CertPool
+}
+
+// pairFile is a loaded certificate and key
+type pairFile struct {
+	cert, key stamp
+	pair      *tls.Certificate
+}
+
+// caPool returns the certificates of a CA file, (re)loading it when it is new
+// or changed. A failed reload keeps the certificates loaded before.
+func (f *files) caPool(path string) (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	loadedFile := f.cas[path]
+	st, err := stampOf(path)
+	if err == nil && loadedFile != nil && st == loadedFile.stamp {
+		return loadedFile.pool, nil
+	}
+	var pool *x509.CertPool
+	var expiry time.Time
+	if err != nil {
+		err = fmt.Errorf("read CA file: %v", err)
+	} else {
+		pool, expiry, err = readCA(path)
+	}
+	if err != nil {
+		if loadedFile != nil {
+			log.Printf("[TLS] Failed to reload CA file %s, keeping the loaded certificates: %v", path, err)
+			loadedFile.stamp = st // Do not retry until the file changes again
+			return loadedFile.pool, nil
+		}
+		return nil, err
+	}
+	if loadedFile != nil {
+		log.Printf("[TLS] Reloaded CA file %s, expires %s", path, expiry.Format(time.RFC3339))
+	}
+	f.cas[path] = &caFile{stamp: st, pool: pool}
+	metrics.TLSCertificateExpiry.WithLabelValues(path).Set(float64(expiry.Unix()))
+	return pool, nil
+}
+
+// readCA reads the certificates of a CA file and returns them with the
+// earliest expiry
+func readCA(path string) (*x509.CertPool, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("read CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	var expiry time.Time
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if block.Type != "CERTIFICATE" || err != nil {
+			continue
+		}
+		pool.AddCert(cert)
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	if expiry.IsZero() {
+		return nil, time.Time{}, fmt.Errorf("no certificates found in CA file %s", path)
+	}
+	return pool, expiry, nil
+}
+
+// keyPair returns the certificate of a certificate and key file,
+// (re)loading it when it is new or one of the files changed. A failed reload
+// keeps the certificate loaded before.
+func (f *files) keyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	k := [2]string{certFile, keyFile}
+	loadedPair := f.pairs[k]
+	certStamp, err := stampOf(certFile)
+	var keyStamp stamp
+	if err == nil {
+		keyStamp, err = stampOf(keyFile)
+	}
+	if err == nil && loadedPair != nil && certStamp == loadedPair.cert && keyStamp == loadedPair.key {
+		return loadedPair.pair, nil
+	}
+	var pair tls.Certificate
+	if err == nil {
+		pair, err = tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	if err != nil {
+		if loadedPair != nil {
+			log.Printf("[TLS] Failed to reload certificate %s, keeping the loaded certificate: %v", certFile, err)
+			loadedPair.cert, loadedPair.key = certStamp, keyStamp // Do not retry until the files change again
+			return loadedPair.pair, nil
+		}
+		return nil, fmt.Errorf("load certificate: %v", err)
+	}
+	if loadedPair != nil {
+		log.Printf("[TLS] Reloaded certificate %s, expires %s", certFile, pair.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	f.pairs[k] = &pairFile{cert: certStamp, key: keyStamp, pair: &pair}
+	metrics.TLSCertificateExpiry.WithLabelValues(certFile).Set(float64(pair.Leaf.NotAfter.Unix()))
+	return &pair, nil
+}
+
+// reload reloads the loaded files that changed
+func (f *files) reload() {
+	f.mu.Lock()
+	cas := make([]string, 0, len(f.cas))
+	for path := range f.cas {
+		cas = append(cas, path)
+	}
+	pairs := make([][2]string, 0, len(f.pairs))
+	for k := range f.pairs {
+		pairs = append(pairs, k)
+	}
+	f.mu.Unlock()
+	for _, path := range cas {
+		f.caPool(path)
+	}
+	for _, k := range pairs {
+		f.keyPair(k[0], k[1])
+	}
+}
+
+// Reload reloads the CA and certificate files that changed since they were
+// loaded, e.g. on SIGHUP, so that the expiry metrics are current also when no
+// new connection is made
+func Reload() {
+	loaded.reload()
+}
+
+// Watch calls Reload at every interval until ctx is done
+func Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Reload()
+		}
+	}
+}
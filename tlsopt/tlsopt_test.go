@@ -0,0 +1,260 @@
+package tlsopt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCert creates a certificate for the given DNS names, signed by parent
+// (self-signed when parent is nil)
+func newCert(t *testing.T, cn string, dnsNames []string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestClient(t *testing.T) {
+	ca, caKey, caPEM := newCert(t, "test ca", nil, nil, nil)
+	_, _, otherPEM := newCert(t, "other ca", nil, nil, nil)
+	server, serverKey, _ := newCert(t, "db", []string{"db.internal"}, ca, caKey)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	otherFile := filepath.Join(dir, "other.pem")
+	os.WriteFile(caFile, caPEM, 0600)
+	os.WriteFile(otherFile, otherPEM, 0600)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		mode   string
+		host   string
+		caFile string
+		ok     bool
+	}{
+		{"require without CA", ModeRequire, "127.0.0.1", "", true},
+		{"verify-ca ignores host", ModeVerifyCA, "127.0.0.1", caFile, true},
+		{"verify-ca wrong CA", ModeVerifyCA, "127.0.0.1", otherFile, false},
+		{"verify-full", ModeVerifyFull, "db.internal", caFile, true},
+		{"verify-full wrong host", ModeVerifyFull, "127.0.0.1", caFile, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Client(tt.mode, tt.host, tt.caFile, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := tls.Client(raw, cfg)
+			defer conn.Close()
+			if err := conn.Handshake(); (err == nil) != tt.ok {
+				t.Errorf("Handshake() error = %v, want ok = %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestClient_Disable(t *testing.T) {
+	for _, mode := range []string{"", ModeDisable} {
+		if cfg, err := Client(mode, "db", "", "", ""); cfg != nil || err != nil {
+			t.Errorf("Client(%q) = %v, %v; want nil, nil", mode, cfg, err)
+		}
+	}
+	if _, err := Client("sometimes", "db", "", "", ""); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestServer(t *testing.T) {
+	ca, caKey, caPEM := newCert(t, "test ca", nil, nil, nil)
+	_, key, certPEM := newCert(t, "proxy", []string{"proxy.internal"}, ca, caKey)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "proxy.pem")
+	keyFile := filepath.Join(dir, "proxy-key.pem")
+	os.WriteFile(caFile, caPEM, 0600)
+	os.WriteFile(certFile, certPEM, 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	if _, err := Server(filepath.Join(dir, "missing.pem"), keyFile); err == nil {
+		t.Error("Expected an error for a missing certificate")
+	}
+	serverCfg, err := Server(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if tlsConn, err := Accept(conn, serverCfg); err == nil {
+				tlsConn.Close()
+			}
+			conn.Close()
+		}
+	}()
+
+	clientCfg, err := Client(ModeVerifyFull, "proxy.internal", caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatalf("Expected the client to verify the certificate of the listener, got %v", err)
+	}
+	conn.Close()
+}
+
+func TestClient_Reload(t *testing.T) {
+	ca, caKey, caPEM := newCert(t, "test ca", nil, nil, nil)
+	_, _, otherPEM := newCert(t, "other ca", nil, nil, nil)
+	server, serverKey, _ := newCert(t, "db", []string{"db.internal"}, ca, caKey)
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	writeClientCert := func(cn string) {
+		_, key, certPEM := newCert(t, cn, nil, ca, caKey)
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(certFile, certPEM, 0600)
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	}
+	os.WriteFile(caFile, otherPEM, 0600)
+	writeClientCert("client one")
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{server.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg, err := Client(ModeVerifyFull, "db.internal", caFile, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func() error {
+		raw, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := tls.Client(raw, cfg)
+		defer conn.Close()
+		return conn.Handshake()
+	}
+	if err := handshake(); err == nil {
+		t.Fatal("Expected the handshake to fail with the wrong CA")
+	}
+
+	// The same configuration uses the files as changed on disk
+	os.WriteFile(caFile, caPEM, 0600)
+	if err := handshake(); err != nil {
+		t.Fatalf("Expected the reloaded CA to verify the backend, got %v", err)
+	}
+	if cn := <-clients; cn != "client one" {
+		t.Errorf("Expected client one, got %q", cn)
+	}
+	writeClientCert("client two, rotated")
+	if err := handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if cn := <-clients; cn != "client two, rotated" {
+		t.Errorf("Expected the rotated client certificate, got %q", cn)
+	}
+
+	// A broken file keeps the loaded certificate
+	os.WriteFile(keyFile, []byte("half written"), 0600)
+	Reload()
+	if err := handshake(); err != nil {
+		t.Fatalf("Expected the loaded certificate to be kept, got %v", err)
+	}
+	if cn := <-clients; cn != "client two, rotated" {
+		t.Errorf("Expected the loaded client certificate, got %q", cn)
+	}
+}
@@ -0,0 +1,81 @@
+// Package warmup prepares a list of known hot statements on backend
+// connections when a pool is created, the prepared statement counterpart of a
+// warm cache. After a restart or failover the first executions of these
+// statements then do not pay for parsing, catalog lookups and opening tables
+// on a cold server, and statements broken by a schema change are reported in
+// the log at startup instead of on the first client request.
+//
+// The statements are read from a file. A statement ends with a semicolon at
+// the end of a line or with an empty line, so it may span several lines.
+// Lines starting with "--" or "#" are skipped. Placeholders use the syntax of
+// the backend: "?" for MariaDB, "$1" for PostgreSQL.
+package warmup
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Load reads the statements of a warm-up file
+func Load(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var statements []string
+	var current []string
+	flush := func() {
+		if statement := strings.TrimSpace(strings.Join(current, "\n")); statement != "" {
+			statements = append(statements, statement)
+		}
+		current = nil
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "--"), strings.HasPrefix(line, "#"):
+		case strings.HasSuffix(line, ";"):
+			current = append(current, strings.TrimSuffix(line, ";"))
+			flush()
+		default:
+			current = append(current, line)
+		}
+	}
+	flush()
+	return statements, scanner.Err()
+}
+
+// Prepare prepares the statements on a connection of db and closes them
+// again, leaving the warmed connection in the idle pool of db. It returns the
+// number of statements prepared and the errors of the others.
+func Prepare(ctx context.Context, db *sql.DB, statements []string) (int, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	prepared := 0
+	var errs []error
+	for _, statement := range statements {
+		stmt, err := conn.PrepareContext(ctx, statement)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", statement, err))
+			continue
+		}
+		stmt.Close()
+		prepared++
+	}
+	return prepared, errors.Join(errs...)
+}
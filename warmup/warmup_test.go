@@ -0,0 +1,86 @@
+package warmup
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "warmup.sql")
+	content := `-- Hot statements
+SELECT * FROM users WHERE id = ?;
+# Spread over lines
+SELECT name
+FROM orders
+WHERE id = ?;
+
+SELECT 1
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	statements, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"SELECT * FROM users WHERE id = ?", "SELECT name\nFROM orders\nWHERE id = ?", "SELECT 1"}
+	if !reflect.DeepEqual(statements, want) {
+		t.Errorf("Load() = %q, want %q", statements, want)
+	}
+}
+
+// fakeDriver prepares any statement except those containing "broken"
+type fakeDriver struct{ prepared *[]string }
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) { return fakeConn(d), nil }
+
+type fakeConn fakeDriver
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.Contains(query, "broken") {
+		return nil, errors.New("syntax error")
+	}
+	*c.prepared = append(*c.prepared, query)
+	return fakeStmt{}, nil
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestPrepare(t *testing.T) {
+	var prepared []string
+	sql.Register("warmup-fake", fakeDriver{prepared: &prepared})
+	db, err := sql.Open("warmup-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	n, err := Prepare(context.Background(), db, []string{"SELECT 1", "SELECT broken", "SELECT 2"})
+	if n != 2 {
+		t.Errorf("Expected 2 prepared statements, got %d", n)
+	}
+	if err == nil || !strings.Contains(err.Error(), "SELECT broken") {
+		t.Errorf("Expected the error to name the broken statement, got %v", err)
+	}
+	if !reflect.DeepEqual(prepared, []string{"SELECT 1", "SELECT 2"}) {
+		t.Errorf("Expected the other statements to be prepared, got %q", prepared)
+	}
+}
@@ -0,0 +1,158 @@
+// Package watch detects clients that disconnect while the proxy is busy on
+// their behalf, such as waiting in a batch window or for a backend result.
+package watch
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrClientAborted is returned when a client disconnected before its request
+// was answered
+var ErrClientAborted = errors.New("client disconnected")
+
+// maxPending limits the bytes buffered from a pipelining client while
+// watching, the watch ends early when it is reached
+const maxPending = 64 * 1024
+
+// Conn wraps a client connection so that it can be watched for a disconnect
+// while the proxy is not reading from it. Bytes that the client sends during
+// a watch are buffered and returned by the next reads. A single goroutine
+// watches the connection, started by the first watch and ended by Close.
+type Conn struct {
+	net.Conn
+	mu       sync.Mutex
+	pending  []byte
+	deadline time.Time // Read deadline set by the caller, restored after a watch
+
+	start   sync.Once
+	watches chan func()   // onAbort of each watch, to the watcher
+	stopped chan bool     // End of each watch and whether the client disconnected
+	closed  chan struct{} // Closed by Close to end the watcher
+	close   sync.Once
+	aborted bool // The client disconnected during a watch
+}
+
+// NewConn wraps conn for watching
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:    conn,
+		watches: make(chan func()),
+		stopped: make(chan bool),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Read reads buffered bytes first, then from the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		c.mu.Unlock()
+		return n, nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Read(b)
+}
+
+// SetDeadline sets the read and write deadlines of the connection
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection, which is
+// restored after each watch
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Close ends the watcher and closes the connection
+func (c *Conn) Close() error {
+	c.close.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// Watch reads from the connection in the background until stopped, and calls
+// onAbort (from another goroutine) when the client disconnects. The returned
+// stop function ends the watch and reports whether the client disconnected.
+// It must be called before the connection is read again. The read deadline
+// of the connection does not apply during the watch.
+func (c *Conn) Watch(onAbort func()) (stop func() bool) {
+	if c.aborted {
+		return abortedWatch(onAbort)
+	}
+	c.start.Do(func() { go c.watch() })
+	c.Conn.SetReadDeadline(time.Time{})
+	select {
+	case c.watches <- onAbort:
+	case <-c.closed:
+		return abortedWatch(onAbort)
+	}
+	return func() bool {
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+		c.aborted = <-c.stopped
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		c.Conn.SetReadDeadline(deadline)
+		return c.aborted
+	}
+}
+
+// abortedWatch is the watch of a connection that is closed or of which the
+// client disconnected
+func abortedWatch(onAbort func()) (stop func() bool) {
+	go onAbort()
+	return func() bool { return true }
+}
+
+// watch runs the watches of the connection until it is closed or the client
+// disconnected
+func (c *Conn) watch() {
+	buf := make([]byte, 512)
+	for {
+		var onAbort func()
+		select {
+		case onAbort = <-c.watches:
+		case <-c.closed:
+			return
+		}
+		disconnected := c.read(buf, onAbort)
+		c.stopped <- disconnected
+		if disconnected {
+			return
+		}
+	}
+}
+
+// read buffers the bytes of the client until the watch is stopped, and
+// reports whether the client disconnected
+func (c *Conn) read(buf []byte, onAbort func()) bool {
+	for {
+		n, err := c.Conn.Read(buf)
+		c.mu.Lock()
+		c.pending = append(c.pending, buf[:n]...)
+		full := len(c.pending) >= maxPending
+		c.mu.Unlock()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return false
+			}
+			onAbort()
+			return true
+		}
+		if full {
+			return false
+		}
+	}
+}
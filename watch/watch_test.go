@@ -0,0 +1,73 @@
+package watch
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConn_WatchAbort(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewConn(server)
+
+	aborted := make(chan struct{})
+	stop := conn.Watch(func() { close(aborted) })
+	client.Close()
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("onAbort was not called after the client disconnected")
+	}
+	if !stop() {
+		t.Error("stop should report the disconnect")
+	}
+}
+
+func TestConn_WatchKeepsPipelinedBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server)
+
+	stop := conn.Watch(func() { t.Error("onAbort called for a connected client") })
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if stop() {
+		t.Error("stop should not report a disconnect")
+	}
+
+	go client.Write([]byte(" world"))
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello world" {
+		t.Errorf("Expected buffered bytes to be read first, got %q", buf)
+	}
+}
+
+func TestConn_WatchRestoresDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := NewConn(server)
+	defer conn.Close()
+
+	// The caller's deadline does not end the watch and applies after it
+	if err := conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		stop := conn.Watch(func() { t.Error("onAbort called for a connected client") })
+		time.Sleep(30 * time.Millisecond)
+		if stop() {
+			t.Error("stop should not report a disconnect")
+		}
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the caller's deadline after the watches, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+package writebatch
+
+import (
+	"context"
+	"log"
+
+	"github.com/mevdschee/tqdbproxy/logging"
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// DefaultAsyncQueueSize is the default maximum of pending async writes
+const DefaultAsyncQueueSize = 10000
+
+// EnqueueAsync adds a write to its batch like EnqueueFenced, but returns
+// without waiting for the result, so that the caller can acknowledge the
+// write before it executed. The write no longer depends on ctx being done,
+// only on its values, such as the durability. onComplete, if not nil, is
+// called with the result once the write executed.
+//
+// At most Config.AsyncQueueSize async writes are pending. Beyond it, or
+// when the manager is closed, an error is returned and onComplete is not
+// called; the caller should then enqueue the write as usual. Failed async
+// writes are logged and counted, as nobody waits for their error. Close
+// waits for the pending async writes, executing them immediately when their
+// batch was closed.
+//
+// With a spool (see Config.Spool) an async write without RETURNING is
+// written to the spool before EnqueueAsync returns, so that it survives a
+// restart, and when the backend is unavailable it stays spooled for a
+// replay instead of failing. Writes with the same batch key are spooled
+// without executing while spooled writes wait for a replay.
+func (m *Manager) EnqueueAsync(ctx context.Context, fence *Fence, seq *Sequence, batchKey, query string, params []interface{}, batchMs int, onComplete func(WriteResult)) error {
+	if m.closed.Load() {
+		return ErrManagerClosed
+	}
+	pending := m.asyncPending.Add(1)
+	if size := m.currentConfig().AsyncQueueSize; size > 0 && pending > int64(size) {
+		m.asyncPending.Add(-1)
+		metrics.WriteAsync.WithLabelValues("rejected").Inc()
+		return ErrAsyncQueueFull
+	}
+
+	// Spool the write before it is acknowledged, live while a batch runs it
+	var spoolID uint64
+	spooled := false
+	if m.spoolable(ctx, hasReturningClause(query)) {
+		backlogged := m.spool.backlogged(batchKey)
+		id, err := m.spool.append(batchKey, query, params, !backlogged)
+		if err != nil {
+			m.asyncPending.Add(-1)
+			return err
+		}
+		spoolID, spooled = id, backlogged
+		ctx = withSpooled(ctx)
+	}
+	metrics.WriteAsync.WithLabelValues("accepted").Inc()
+	metrics.WriteAsyncPending.Inc()
+
+	ctx = context.WithoutCancel(ctx)
+	fence.add()
+	m.async.Add(1)
+	go func() {
+		defer m.async.Done()
+		defer fence.done()
+		result := WriteResult{Spooled: true}
+		if !spooled {
+			result = m.enqueueOrdered(ctx, fence, seq, batchKey, query, params, batchMs, nil)
+			if result.Error == ErrManagerClosed {
+				result = m.executeImmediate(ctx, query, params)
+			}
+		}
+		if spoolID != 0 && !spooled {
+			if result.Error != nil && isUnavailable(result.Error) {
+				m.spool.release(batchKey, spoolID)
+				result = WriteResult{Spooled: true}
+			} else {
+				m.spool.done(batchKey, spoolID)
+			}
+		}
+		m.asyncPending.Add(-1)
+		metrics.WriteAsyncPending.Dec()
+		switch {
+		case result.Spooled:
+			// Counted by the spool metrics once replayed
+		case result.Error != nil:
+			metrics.WriteAsync.WithLabelValues("failed").Inc()
+			log.Printf("[WriteBatch] Async write failed: %v (query: %s)", result.Error, logging.QueryText(query))
+		default:
+			metrics.WriteAsync.WithLabelValues("completed").Inc()
+		}
+		if onComplete != nil {
+			onComplete(result)
+		}
+	}()
+	return nil
+}
+
+// AsyncPending returns the number of async writes that did not complete yet
+func (m *Manager) AsyncPending() int {
+	return int(m.asyncPending.Load())
+}
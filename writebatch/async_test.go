@@ -0,0 +1,77 @@
+package writebatch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManager_EnqueueAsync(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	// The call returns before the batch window passed
+	var fence Fence
+	done := make(chan WriteResult, 1)
+	err := m.EnqueueAsync(context.Background(), &fence, nil, "test:async",
+		"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"async"}, 100, func(result WriteResult) {
+			done <- result
+		})
+	if err != nil {
+		t.Fatalf("EnqueueAsync failed: %v", err)
+	}
+	if m.AsyncPending() != 1 || fence.Pending() != 1 {
+		t.Errorf("Expected 1 pending async write, got %d (fence %d)", m.AsyncPending(), fence.Pending())
+	}
+
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if result := <-done; result.Error != nil || result.BatchSize != 1 {
+		t.Errorf("Expected a batch of 1, got %d (%v)", result.BatchSize, result.Error)
+	}
+	if err := fence.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data = 'async'").Scan(&count)
+	if count != 1 || m.AsyncPending() != 0 {
+		t.Errorf("Expected 1 write and no pending async writes, got %d and %d", count, m.AsyncPending())
+	}
+}
+
+func TestManager_EnqueueAsyncQueueFull(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	cfg.AsyncQueueSize = 1
+	cfg.Clock = NewFakeClock(time.Now())
+	m := New(db, cfg)
+
+	query := "INSERT INTO test_writes (data) VALUES ('full')"
+	if err := m.EnqueueAsync(context.Background(), nil, nil, "test:full", query, nil, 60000, nil); err != nil {
+		t.Fatalf("EnqueueAsync failed: %v", err)
+	}
+	if err := m.EnqueueAsync(context.Background(), nil, nil, "test:full", query, nil, 60000, nil); err != ErrAsyncQueueFull {
+		t.Errorf("Expected ErrAsyncQueueFull, got %v", err)
+	}
+
+	// Close executes the pending async write
+	m.Close()
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data = 'full'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected the async write to execute on Close, got %d writes", count)
+	}
+	if err := m.EnqueueAsync(context.Background(), nil, nil, "test:full", query, nil, 60000, nil); err != ErrManagerClosed {
+		t.Errorf("Expected ErrManagerClosed, got %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package writebatch
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+
+	var fired []string
+	c.AfterFunc(20*time.Millisecond, func() { fired = append(fired, "b") })
+	c.AfterFunc(10*time.Millisecond, func() { fired = append(fired, "a") })
+	stopped := c.AfterFunc(15*time.Millisecond, func() { fired = append(fired, "stopped") })
+	c.AfterFunc(30*time.Millisecond, func() { fired = append(fired, "c") })
+
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer should return true")
+	}
+	if stopped.Stop() {
+		t.Error("Second Stop should return false")
+	}
+
+	c.Advance(25 * time.Millisecond)
+	if len(fired) != 2 || fired[0] != "a" || fired[1] != "b" {
+		t.Errorf("Expected [a b] after 25ms, got %v", fired)
+	}
+	if got := c.Now(); !got.Equal(start.Add(25 * time.Millisecond)) {
+		t.Errorf("Expected now to be start+25ms, got %v", got.Sub(start))
+	}
+	if c.Pending() != 1 {
+		t.Errorf("Expected 1 pending timer, got %d", c.Pending())
+	}
+
+	c.Advance(5 * time.Millisecond)
+	if len(fired) != 3 || fired[2] != "c" {
+		t.Errorf("Expected c to fire at its deadline, got %v", fired)
+	}
+}
+
+func TestManager_FakeClockWindow(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	results := make(chan WriteResult, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			results <- m.Enqueue(context.Background(), "clock:insert",
+				"INSERT INTO test_writes (data, value) VALUES (?, ?)", []interface{}{"clock", i}, 1000, nil)
+		}(i)
+	}
+	for m.Pending() < 3 {
+		runtime.Gosched()
+	}
+
+	// The window has not expired yet
+	clock.Advance(999 * time.Millisecond)
+	if m.BatchCount() != 0 || m.Pending() != 3 {
+		t.Fatalf("Batch executed before its window expired (batches: %d, pending: %d)", m.BatchCount(), m.Pending())
+	}
+
+	// Expiry executes the batch before Advance returns
+	clock.Advance(time.Millisecond)
+	if m.BatchCount() != 1 || m.Pending() != 0 {
+		t.Fatalf("Expected one executed batch, got %d batches and %d pending", m.BatchCount(), m.Pending())
+	}
+	for i := 0; i < 3; i++ {
+		result := <-results
+		if result.Error != nil {
+			t.Fatalf("Unexpected error: %v", result.Error)
+		}
+		if result.BatchSize != 3 {
+			t.Errorf("Expected batch size 3, got %d", result.BatchSize)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package writebatch
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Durability is the commit durability of a batch on PostgreSQL, see
+// WithDurability
+type Durability string
+
+const (
+	// DurabilityFull commits as configured on the backend (the default)
+	DurabilityFull Durability = ""
+	// DurabilityLocal commits once the WAL is flushed locally, without
+	// waiting for synchronous standbys (synchronous_commit = local)
+	DurabilityLocal Durability = "local"
+	// DurabilityRelaxed commits without waiting for the WAL flush, so that a
+	// crash of the backend may lose the last commits, but never corrupts
+	// data (synchronous_commit = off)
+	DurabilityRelaxed Durability = "relaxed"
+)
+
+// synchronousCommit maps a durability to its synchronous_commit setting
+var synchronousCommit = map[Durability]string{
+	DurabilityLocal:   "local",
+	DurabilityRelaxed: "off",
+}
+
+type durabilityKey struct{}
+
+// WithDurability returns a context that makes Enqueue run the write in a
+// batch with the given durability. Writes only batch with writes of the same
+// durability. The durability applies to PostgreSQL backends, elsewhere the
+// batch commits as usual.
+func WithDurability(ctx context.Context, d Durability) context.Context {
+	return context.WithValue(ctx, durabilityKey{}, d)
+}
+
+// durabilityFrom returns the durability set with WithDurability
+func durabilityFrom(ctx context.Context) Durability {
+	d, _ := ctx.Value(durabilityKey{}).(Durability)
+	return d
+}
+
+// groupKey returns the key of the batch group of a write, which keeps writes
+// with a relaxed durability apart from the others
+func groupKey(batchKey string, d Durability) string {
+	if d == DurabilityFull {
+		return batchKey
+	}
+	return batchKey + " durability:" + string(d)
+}
+
+// begin starts the transaction of a batch, with synchronous_commit set for
+// the transaction when the batch has a relaxed durability on PostgreSQL
+func (m *Manager) begin(d Durability) (*sql.Tx, error) {
+	tx, err := m.db.Begin()
+	if err != nil || d == DurabilityFull || !m.postgres {
+		return tx, err
+	}
+	if _, err := tx.Exec("SET LOCAL synchronous_commit TO " + synchronousCommit[d]); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// exec executes a statement of a batch, in a transaction of its own when the
+// batch has a relaxed durability on PostgreSQL, as synchronous_commit can
+// only be set for a transaction
+func (m *Manager) exec(d Durability, query string, args ...interface{}) (sql.Result, error) {
+	if d == DurabilityFull || !m.postgres {
+		return m.db.Exec(query, args...)
+	}
+	tx, err := m.begin(d)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return result, tx.Commit()
+}
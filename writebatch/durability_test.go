@@ -0,0 +1,67 @@
+package writebatch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManager_DurabilityGroups(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	// Writes with a relaxed durability batch apart from the others, and
+	// commit as usual on other backends than PostgreSQL
+	relaxed := WithDurability(context.Background(), DurabilityRelaxed)
+	results := make(chan WriteResult, 3)
+	for _, ctx := range []context.Context{relaxed, relaxed, context.Background()} {
+		go func() {
+			results <- m.Enqueue(ctx, "insert", "INSERT INTO test_writes (data) VALUES ('a')", nil, 100, nil)
+		}()
+	}
+	for m.Pending() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(100 * time.Millisecond)
+
+	sizes := map[int]int{}
+	for i := 0; i < 3; i++ {
+		result := <-results
+		if result.Error != nil {
+			t.Fatalf("Unexpected error: %v", result.Error)
+		}
+		sizes[result.BatchSize]++
+	}
+	if sizes[2] != 2 || sizes[1] != 1 {
+		t.Errorf("Expected a batch of 2 relaxed writes and a batch of 1, got batch sizes %v", sizes)
+	}
+}
+
+func TestPostgreSQL_RelaxedDurability(t *testing.T) {
+	db := setupPostgresDB(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+
+	m := New(db, DefaultConfig())
+	defer m.Close()
+
+	for d, expected := range map[Durability]string{DurabilityRelaxed: "off", DurabilityLocal: "local"} {
+		ctx := WithDurability(context.Background(), d)
+		result := m.Enqueue(ctx, "test:durability",
+			"INSERT INTO test_writes (data) VALUES ('a') RETURNING current_setting('synchronous_commit')", nil, 10, nil)
+		if result.Error != nil {
+			t.Fatalf("Insert failed: %v", result.Error)
+		}
+		if len(result.ReturningValues) != 1 || result.ReturningValues[0] != expected {
+			t.Errorf("Expected synchronous_commit %s for durability %s, got %v", expected, d, result.ReturningValues)
+		}
+	}
+}
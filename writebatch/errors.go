@@ -6,9 +6,18 @@ var (
 	// ErrManagerClosed is returned when operations are attempted on a closed manager
 	ErrManagerClosed = errors.New("write batch manager is closed")
 
-	// ErrTimeout is returned when a write operation times out
+	// ErrTimeout is returned when the deadline of a write or the request timeout passes before it completed
 	ErrTimeout = errors.New("write batch operation timeout")
 
 	// ErrBatchFull is returned when a batch group is full
 	ErrBatchFull = errors.New("batch group is full")
+
+	// ErrQueueFull is returned by Enqueue when too many writes of the batch key are pending
+	ErrQueueFull = errors.New("write batch queue is full")
+
+	// ErrAsyncQueueFull is returned by EnqueueAsync when too many async writes are pending
+	ErrAsyncQueueFull = errors.New("async write queue is full")
+
+	// ErrSpoolFull is returned when a write does not fit in the size limit of the spool
+	ErrSpoolFull = errors.New("write spool is full")
 )
@@ -2,6 +2,7 @@ package writebatch
 
 import (
 	"bytes"
+	"database/sql"
 	"fmt"
 	"io"
 	"log"
@@ -12,7 +13,9 @@ import (
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/lib/pq"
+	"github.com/mevdschee/tqdbproxy/alert"
 	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
 )
 
 // loadDataHandlerSeq generates unique handler names for LOAD DATA LOCAL INFILE.
@@ -24,50 +27,80 @@ func (m *Manager) executeBatch(batchKey string, group *BatchGroup) {
 	if m.closed.Load() {
 		group.mu.Lock()
 		requests := group.Requests
+		group.Requests = nil
 		group.mu.Unlock()
 		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: ErrManagerClosed}
+			req.deliver(WriteResult{Error: ErrManagerClosed})
 		}
+		if len(requests) > 0 {
+			m.fireCompleted(batchKey, requests, m.clock.Now().Sub(group.FirstSeen), 0)
+		}
+		m.completed(batchKey, requests)
 		return
 	}
+	m.runBatch(batchKey, group)
+}
+
+// runBatch executes the requests of a batch group and returns their number.
+// Groups that were already executed have no requests left.
+func (m *Manager) runBatch(batchKey string, group *BatchGroup) int {
+	m.inflight.Add(1)
+	defer m.inflight.Done()
 
 	group.mu.Lock()
-	requests := group.Requests
-	batchSize := len(requests)
+	all := group.Requests
 	firstSeen := group.FirstSeen
 	group.Requests = nil
 	group.mu.Unlock()
 
-	// Try to delete this group from the map (it might already be deleted if batch was full)
-	m.groups.CompareAndDelete(batchKey, group)
-
+	// Skip the writes whose caller gave up before the batch started
+	requests := make([]*WriteRequest, 0, len(all))
+	for _, req := range all {
+		if req.abandoned.Load() {
+			req.fence.done()
+			m.withdrawn.Add(1)
+			metrics.WriteBatchDropped.WithLabelValues("withdrawn").Inc()
+			continue
+		}
+		requests = append(requests, req)
+	}
+	batchSize := len(requests)
 	if batchSize == 0 {
-		return
+		m.completed(batchKey, all)
+		return 0
 	}
 
 	// Count this batch
 	m.batchCount.Add(1)
+	m.opCount.Add(int64(batchSize))
+	m.executing.Add(1)
 
 	// Record metrics
 	batchStart := time.Now()
+	now := m.clock.Now()
+	wait := now.Sub(firstSeen)
+	for _, req := range requests {
+		m.observeWait(now.Sub(req.EnqueuedAt))
+	}
+	m.fire(BatchEvent{Event: BatchStarted, BatchKey: batchKey, Size: batchSize, Wait: wait})
 	if requests[0] != nil {
 		queryLabel := truncateQuery(requests[0].Query, 50)
 		metrics.WriteBatchSize.WithLabelValues(queryLabel).Observe(float64(batchSize))
-		metrics.WriteBatchDelay.WithLabelValues(queryLabel).Observe(time.Since(firstSeen).Seconds())
-	}
-
-	if batchSize == 1 {
-		m.executeSingle(requests[0])
-	} else {
-		m.executeBatchedWrites(requests)
+		metrics.WriteBatchDelay.WithLabelValues(queryLabel).Observe(wait.Seconds())
 	}
 
-	// Record latency
-	if requests[0] != nil {
-		queryLabel := truncateQuery(requests[0].Query, 50)
-		metrics.WriteBatchLatency.WithLabelValues(queryLabel).Observe(time.Since(batchStart).Seconds())
-		metrics.WriteBatchedTotal.WithLabelValues(getQueryType(requests[0].Query)).Add(float64(batchSize))
-	}
+	m.executeWithRetry(batchKey, requests, func() {
+		m.executing.Add(-1)
+		// Record latency
+		if requests[0] != nil {
+			queryLabel := truncateQuery(requests[0].Query, 50)
+			metrics.WriteBatchLatency.WithLabelValues(queryLabel).Observe(time.Since(batchStart).Seconds())
+			metrics.WriteBatchedTotal.WithLabelValues(getQueryType(requests[0].Query)).Add(float64(batchSize))
+		}
+		m.fireCompleted(batchKey, requests, wait, time.Since(batchStart))
+		m.completed(batchKey, all)
+	})
+	return batchSize
 }
 
 // truncateQuery truncates a query for use as a metric label
@@ -113,10 +146,48 @@ func indexOf(s, substr string) int {
 	return -1
 }
 
+// failAll delivers err to every request of a failed batch
+func (m *Manager) failAll(requests []*WriteRequest, err error) {
+	alert.BatchFailure(err)
+	for _, req := range requests {
+		req.deliver(WriteResult{Error: err})
+	}
+}
+
+// failTransaction handles a failed statement of a rolled back batch
+// transaction: with IsolateFailures the requests execute one by one,
+// otherwise err is delivered to all of them
+func (m *Manager) failTransaction(requests []*WriteRequest, err error) {
+	if m.currentConfig().IsolateFailures {
+		m.executeIsolated(requests, err)
+		return
+	}
+	m.failAll(requests, err)
+}
+
+// executeIsolated executes the requests of a batch whose transaction failed
+// one by one, each outside a shared transaction, so that only the writes that
+// fail themselves get an error
+func (m *Manager) executeIsolated(requests []*WriteRequest, cause error) {
+	alert.BatchFailure(cause)
+	log.Printf("[WriteBatch] Batch of %d writes failed, executing them one by one: %v", len(requests), cause)
+	metrics.WriteBatchMethod.WithLabelValues("isolated").Inc()
+	for _, req := range requests {
+		result := m.executeWrite(req.durability, req.Query, req.Params)
+		req.deliver(result)
+		if result.Error == nil && req.OnBatchComplete != nil {
+			req.OnBatchComplete(result.BatchSize)
+		}
+	}
+}
+
 // executeSingle executes a single write request
 func (m *Manager) executeSingle(req *WriteRequest) {
-	result := m.executeWrite(req.Query, req.Params)
-	req.ResultChan <- result
+	result := m.executeWrite(req.durability, req.Query, req.Params)
+	if result.Error != nil {
+		alert.BatchFailure(result.Error)
+	}
+	req.deliver(result)
 }
 
 // executeBatchedWrites executes multiple write requests
@@ -131,10 +202,16 @@ func (m *Manager) executeBatchedWrites(requests []*WriteRequest) {
 		}
 	}
 
+	// Inserts into the same table and columns are merged into one INSERT,
+	// also when they differ in values or in their number of rows, unless
+	// each needs its exact insert ID
+	if !requests[0].HasReturning && !m.currentConfig().ExactIDs && mergeableInserts(requests) {
+		m.executeTrueBatchedInsert(requests, allSame)
+		return
+	}
+
 	if allSame {
-		if !requests[0].HasReturning && isBatchableInsert(firstQuery) {
-			m.executeTrueBatchedInsert(requests)
-		} else if isBatchableDelete(firstQuery) {
+		if !requests[0].HasReturning && isBatchableDelete(firstQuery) {
 			metrics.WriteBatchMethod.WithLabelValues("batched_delete").Inc()
 			m.executeTrueBatchedDelete(requests)
 		} else {
@@ -215,20 +292,18 @@ func (m *Manager) executeTrueBatchedDelete(requests []*WriteRequest) {
 	}
 
 	// Execute batched delete
-	result, err := m.db.Exec(builder.String(), allParams...)
+	result, err := m.exec(requests[0].durability, builder.String(), allParams...)
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 	affected, _ := result.RowsAffected()
 	// Send results to all requests
 	for _, req := range requests {
-		req.ResultChan <- WriteResult{
+		req.deliver(WriteResult{
 			AffectedRows: affected, // total affected, not per-request
 			BatchSize:    len(requests),
-		}
+		})
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
 		}
@@ -242,11 +317,9 @@ func (m *Manager) executePreparedBatch(requests []*WriteRequest) {
 	hasReturning := requests[0].HasReturning
 
 	// Start a transaction for the batch
-	tx, err := m.db.Begin()
+	tx, err := m.begin(requests[0].durability)
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
@@ -255,9 +328,7 @@ func (m *Manager) executePreparedBatch(requests []*WriteRequest) {
 	if err != nil {
 		log.Printf("[WriteBatch] Prepare error: %v", err)
 		tx.Rollback()
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 	defer stmt.Close()
@@ -268,19 +339,16 @@ func (m *Manager) executePreparedBatch(requests []*WriteRequest) {
 
 	for i, req := range requests {
 		if hasReturning {
-			// For RETURNING queries, use QueryRow to capture the returned value
-			// Scan into int64 for SERIAL/BIGSERIAL columns
-			var returnedValue int64
-			err := stmt.QueryRow(req.Params...).Scan(&returnedValue)
+			// For RETURNING queries, read the returned rows
+			rows, err := stmt.Query(req.Params...)
 			if err != nil {
 				results[i] = WriteResult{Error: err}
 				hasError = true
 				continue
 			}
-			results[i] = WriteResult{
-				AffectedRows:    1,
-				ReturningValues: []interface{}{returnedValue},
-				BatchSize:       len(requests),
+			results[i] = returningResult(rows, len(requests))
+			if results[i].Error != nil {
+				hasError = true
 			}
 		} else {
 			result, err := stmt.Exec(req.Params...)
@@ -303,23 +371,31 @@ func (m *Manager) executePreparedBatch(requests []*WriteRequest) {
 	// If any error occurred, rollback and send errors
 	if hasError {
 		tx.Rollback()
+		for _, r := range results {
+			if r.Error != nil {
+				if m.currentConfig().IsolateFailures {
+					m.executeIsolated(requests, r.Error)
+					return
+				}
+				alert.BatchFailure(r.Error)
+				break
+			}
+		}
 		for i, req := range requests {
-			req.ResultChan <- results[i]
+			req.deliver(results[i])
 		}
 		return
 	}
 
 	// Commit the transaction
 	if err := tx.Commit(); err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	// Send successful results
 	for i, req := range requests {
-		req.ResultChan <- results[i]
+		req.deliver(results[i])
 		// Notify connection of batch completion
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
@@ -327,41 +403,51 @@ func (m *Manager) executePreparedBatch(requests []*WriteRequest) {
 	}
 }
 
-// isBatchableInsert checks if query is a simple INSERT that can be batched
-func isBatchableInsert(query string) bool {
-	// Skip leading comments and whitespace
-	q := query
-	for {
-		q = strings.TrimSpace(q)
-		if strings.HasPrefix(q, "/*") {
-			// Skip comment
-			endIdx := strings.Index(q, "*/")
-			if endIdx == -1 {
-				break
-			}
-			q = q[endIdx+2:]
-		} else {
-			break
+// mergeableInserts checks if all requests are INSERT ... VALUES queries into
+// the same table and columns, or upserts with the same clause, that can be
+// merged into one multi-row INSERT
+func mergeableInserts(requests []*WriteRequest) bool {
+	var first, firstClause string
+	for i, req := range requests {
+		prefix, _, clause, ok := parser.InsertUpsert(req.Query)
+		if !ok || i > 0 && (prefix != first || clause != firstClause) {
+			return false
 		}
+		first, firstClause = prefix, clause
 	}
+	return true
+}
+
+// isUpsert reports whether the (mergeable) requests are upserts
+func isUpsert(requests []*WriteRequest) bool {
+	_, _, clause, _ := parser.InsertUpsert(requests[0].Query)
+	return clause != ""
+}
 
-	// Check for INSERT INTO ... VALUES pattern
-	qUpper := strings.ToUpper(q)
-	return len(q) > 12 &&
-		strings.HasPrefix(qUpper, "INSERT") &&
-		strings.Contains(qUpper, " VALUES") &&
-		(q[len(q)-1] == ')' || q[len(q)-1] == ' ')
+// singleRowInserts checks if the identical requests insert a single row each,
+// the only form that can be bulk loaded row by row
+func singleRowInserts(requests []*WriteRequest) bool {
+	_, rows, _ := parser.InsertValues(requests[0].Query)
+	return len(rows) == 1
 }
 
 // executeTrueBatchedInsert combines multiple INSERTs into one optimized operation
 // Uses PostgreSQL COPY or MariaDB LOAD DATA LOCAL INFILE when enabled and possible,
 // otherwise falls back to multi-value INSERT.
-func (m *Manager) executeTrueBatchedInsert(requests []*WriteRequest) {
+func (m *Manager) executeTrueBatchedInsert(requests []*WriteRequest, allSame bool) {
 	firstQuery := requests[0].Query
 	numParams := len(requests[0].Params)
 
-	// For queries with parameters, check if we can use a bulk-load mechanism
-	if m.config.UseCopy && numParams > 0 && allParamsAreSimple(requests) {
+	// Upserts cannot be bulk loaded
+	if isUpsert(requests) {
+		metrics.WriteBatchMethod.WithLabelValues("multi_row_upsert").Inc()
+		m.executeUpsertBatch(requests)
+		return
+	}
+
+	// For identical single-row queries with parameters, check if we can use a
+	// bulk-load mechanism
+	if m.currentConfig().UseCopy && allSame && numParams > 0 && singleRowInserts(requests) && allParamsAreSimple(requests) {
 		isPostgres := containsPostgresPlaceholder(firstQuery)
 
 		if isPostgres {
@@ -480,11 +566,9 @@ func (m *Manager) executeCopyBatchedInsert(requests []*WriteRequest) {
 	}
 
 	// Prepare COPY statement
-	txn, err := m.db.Begin()
+	txn, err := m.begin(requests[0].durability)
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
@@ -502,9 +586,7 @@ func (m *Manager) executeCopyBatchedInsert(requests []*WriteRequest) {
 		if err != nil {
 			stmt.Close()
 			txn.Rollback()
-			for _, r := range requests {
-				r.ResultChan <- WriteResult{Error: err}
-			}
+			m.failAll(requests, err)
 			return
 		}
 	}
@@ -514,38 +596,32 @@ func (m *Manager) executeCopyBatchedInsert(requests []*WriteRequest) {
 	if err != nil {
 		stmt.Close()
 		txn.Rollback()
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	err = stmt.Close()
 	if err != nil {
 		txn.Rollback()
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	// Commit transaction
 	err = txn.Commit()
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	// Send results to all requests
 	// Note: COPY doesn't return LastInsertId, so we set it to 0
 	for _, req := range requests {
-		req.ResultChan <- WriteResult{
+		req.deliver(WriteResult{
 			AffectedRows: 1,
 			LastInsertID: 0, // COPY doesn't provide last insert ID
 			BatchSize:    len(requests),
-		}
+		})
 		// Notify connection of batch completion
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
@@ -600,9 +676,7 @@ func (m *Manager) executeLoadDataInfileBatchedInsert(requests []*WriteRequest) {
 
 	txn, err := m.db.Begin()
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
@@ -616,20 +690,18 @@ func (m *Manager) executeLoadDataInfileBatchedInsert(requests []*WriteRequest) {
 	}
 
 	if err = txn.Commit(); err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	// Send results to all requests.
 	// LOAD DATA doesn't return per-row LastInsertId, so we set it to 0.
 	for _, req := range requests {
-		req.ResultChan <- WriteResult{
+		req.deliver(WriteResult{
 			AffectedRows: 1,
 			LastInsertID: 0, // LOAD DATA INFILE doesn't provide last insert ID
 			BatchSize:    len(requests),
-		}
+		})
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
 		}
@@ -702,138 +774,108 @@ func escapeLoadDataString(s string) string {
 	return b.String()
 }
 
-// executeTrueBatchedInsertMultiRow is the original multi-row INSERT implementation
-func (m *Manager) executeTrueBatchedInsertMultiRow(requests []*WriteRequest) {
-	firstQuery := requests[0].Query
-
-	// Find the VALUES clause (case-insensitive)
-	valuesIdx := -1
-	upperQuery := strings.ToUpper(firstQuery)
-	valuesPos := strings.Index(upperQuery, "VALUES")
-	if valuesPos != -1 {
-		valuesIdx = valuesPos + 6 // Position after "VALUES"
-	}
-
-	if valuesIdx == -1 {
-		// Fallback if we can't parse
-		m.executePreparedBatchFallback(requests)
-		return
+// mergeInserts merges the rows of all requests into one multi-row INSERT,
+// followed by the clause of the upserts, and returns it with the parameters
+// of all requests and the number of rows of each. Requests may differ in their
+// literal values and number of rows; PostgreSQL placeholders are renumbered to
+// follow the preceding rows.
+func mergeInserts(requests []*WriteRequest) (string, []interface{}, []int, bool) {
+	prefix, _, clause, ok := parser.InsertUpsert(requests[0].Query)
+	if !ok {
+		return "", nil, nil, false
 	}
 
-	// Build multi-value INSERT
-	baseQuery := firstQuery[:valuesIdx]
-	numParams := len(requests[0].Params)
-
-	// Handle direct queries (no parameters) - extract the VALUES clause from the original query
-	if numParams == 0 {
-		// Extract the VALUES clause from the original query
-		valuesClause := strings.TrimSpace(firstQuery[valuesIdx:])
-
-		// Use strings.Builder for efficient string concatenation
-		var builder strings.Builder
-		estimatedSize := len(baseQuery) + len(requests)*len(valuesClause) + len(requests)*2
-		builder.Grow(estimatedSize)
-
-		builder.WriteString(baseQuery)
-		builder.WriteString(" ")
-
-		// Repeat the VALUES clause for each request
-		for reqIdx := range requests {
-			if reqIdx > 0 {
-				builder.WriteString(", ")
-			}
-			builder.WriteString(valuesClause)
-		}
-
-		// Execute batched query (no parameters needed)
-		batchQuery := builder.String()
-		result, err := m.db.Exec(batchQuery)
-		if err != nil {
-			for _, req := range requests {
-				req.ResultChan <- WriteResult{Error: err}
-			}
-			return
-		}
-
-		_, _ = result.RowsAffected()
-		rawID, _ := result.LastInsertId()
-		firstID := m.normalizeFirstInsertID(rawID, len(requests))
-
-		// Send results to all requests
-		for i, req := range requests {
-			req.ResultChan <- WriteResult{
-				AffectedRows: 1, // Each request affects 1 row
-				LastInsertID: firstID + int64(i),
-				BatchSize:    len(requests),
-			}
-			// Notify connection of batch completion
-			if req.OnBatchComplete != nil {
-				req.OnBatchComplete(len(requests))
-			}
+	// Detect if using PostgreSQL placeholders ($1) or MySQL/SQLite placeholders (?)
+	isPostgres := false
+	for _, req := range requests {
+		if len(req.Params) > 0 && containsPostgresPlaceholder(req.Query) {
+			isPostgres = true
+			break
 		}
-		return
 	}
 
-	// Detect if using PostgreSQL placeholders ($1) or MySQL/SQLite placeholders (?)
-	isPostgres := len(firstQuery) > 0 && containsPostgresPlaceholder(firstQuery)
-
 	// Pre-allocate allParams slice to avoid reallocations
-	totalParams := len(requests) * numParams
-	allParams := make([]interface{}, 0, totalParams)
+	allParams := make([]interface{}, 0, len(requests)*len(requests[0].Params))
+	rowCounts := make([]int, len(requests))
 
 	// Use strings.Builder for efficient string concatenation
 	var builder strings.Builder
-	// Pre-allocate buffer: baseQuery + estimated size for value clauses
-	estimatedSize := len(baseQuery) + len(requests)*(numParams*4+3) // rough estimate
-	builder.Grow(estimatedSize)
-
-	builder.WriteString(baseQuery)
+	builder.Grow(len(prefix) + len(requests)*(len(requests[0].Query)-len(prefix)+2)) // rough estimate
+	builder.WriteString(prefix)
 	builder.WriteString(" ")
 
-	paramIndex := 1
-	for reqIdx, req := range requests {
-		if reqIdx > 0 {
-			builder.WriteString(", ")
+	totalRows := 0
+	for i, req := range requests {
+		_, rows, _, ok := parser.InsertUpsert(req.Query)
+		if !ok {
+			return "", nil, nil, false
 		}
-		builder.WriteString("(")
-
-		for i := 0; i < numParams; i++ {
-			if i > 0 {
-				builder.WriteString(",")
+		for _, row := range rows {
+			if totalRows > 0 {
+				builder.WriteString(", ")
 			}
 			if isPostgres {
-				builder.WriteString("$")
-				builder.WriteString(strconv.Itoa(paramIndex))
-				paramIndex++
-			} else {
-				builder.WriteString("?")
+				row = parser.ShiftPlaceholders(row, len(allParams))
 			}
+			builder.WriteString(row)
+			totalRows++
 		}
-		builder.WriteString(")")
+		rowCounts[i] = len(rows)
 		allParams = append(allParams, req.Params...)
 	}
+	if clause != "" {
+		builder.WriteString(" ")
+		builder.WriteString(clause)
+	}
+	return builder.String(), allParams, rowCounts, true
+}
+
+// executeTrueBatchedInsertMultiRow merges the rows of all requests into one
+// multi-row INSERT, see mergeInserts
+func (m *Manager) executeTrueBatchedInsertMultiRow(requests []*WriteRequest) {
+	query, allParams, rowCounts, ok := mergeInserts(requests)
+	if !ok {
+		// Fallback if we can't parse
+		m.executeTransactionBatch(requests)
+		return
+	}
+	totalRows := 0
+	for _, n := range rowCounts {
+		totalRows += n
+	}
 
 	// Execute batched query
-	batchQuery := builder.String()
-	result, err := m.db.Exec(batchQuery, allParams...)
+	result, err := m.exec(requests[0].durability, query, allParams...)
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
-	_, _ = result.RowsAffected()
+	affected, _ := result.RowsAffected()
 	rawID, _ := result.LastInsertId()
-	firstID := m.normalizeFirstInsertID(rawID, len(requests))
+	step := m.insertIDStep()
+	firstID := m.normalizeFirstInsertID(rawID, totalRows, step)
 
-	// Send results to all requests
+	// The generated IDs are consecutive (apart from the step) only when all
+	// rows were inserted; rows skipped by INSERT IGNORE leave them unknown
+	exact := affected == int64(totalRows)
+	if !exact {
+		log.Printf("[WriteBatch] Multi-row insert affected %d of %d rows, insert IDs are not reported", affected, totalRows)
+	}
+
+	// Send results to all requests, each with the ID of its own first row
+	row := 0
 	for i, req := range requests {
-		req.ResultChan <- WriteResult{
-			AffectedRows: 1, // Each request affects 1 row
-			LastInsertID: firstID + int64(i),
-			BatchSize:    len(requests),
+		var lastID int64
+		if exact {
+			lastID = firstID + int64(row)*step
 		}
+		req.deliver(WriteResult{
+			AffectedRows: int64(rowCounts[i]),
+			LastInsertID: lastID,
+			BatchSize:    len(requests),
+		})
+		row += rowCounts[i]
 		// Notify connection of batch completion
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
@@ -841,81 +883,166 @@ func (m *Manager) executeTrueBatchedInsertMultiRow(requests []*WriteRequest) {
 	}
 }
 
-// normalizeFirstInsertID returns the ID of the first inserted row for a multi-row INSERT.
-// MySQL/MariaDB report last_insert_id() = first row's ID.
-// SQLite reports last_insert_rowid() = last row's ID; subtract (n-1) to get the first.
-func (m *Manager) normalizeFirstInsertID(rawID int64, batchSize int) int64 {
-	if m.firstInsertIDIsFirst {
-		return rawID // MySQL: rawID already is the first row's ID
+// executeUpsertBatch merges the rows of upserts with the same clause into one
+// multi-row upsert, in a transaction. An upsert affects each row by whether it
+// was inserted or updated (1 on PostgreSQL, 1 or 2 on MariaDB, 0 when skipped
+// or unchanged), so the affected rows of the merged upsert are only attributed
+// to the requests when all rows had the same outcome. Otherwise, and when the
+// merged upsert fails (such as on PostgreSQL when two rows of the batch
+// conflict with each other), the transaction is rolled back and the upserts
+// run one by one instead, each with its own result.
+func (m *Manager) executeUpsertBatch(requests []*WriteRequest) {
+	query, params, rowCounts, ok := mergeInserts(requests)
+	if !ok {
+		m.executeTransactionBatch(requests)
+		return
 	}
-	return rawID - int64(batchSize-1) // SQLite: rawID is the last row's ID
-}
-
-// containsPostgresPlaceholder checks if query uses PostgreSQL $1 syntax
-func containsPostgresPlaceholder(query string) bool {
-	for i := 0; i < len(query)-1; i++ {
-		if query[i] == '$' && query[i+1] >= '0' && query[i+1] <= '9' {
-			return true
-		}
+	totalRows := 0
+	for _, n := range rowCounts {
+		totalRows += n
 	}
-	return false
-}
 
-// executePreparedBatchFallback is the original implementation
-func (m *Manager) executePreparedBatchFallback(requests []*WriteRequest) {
-	stmt, err := m.db.Prepare(requests[0].Query)
+	tx, err := m.begin(requests[0].durability)
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
+		m.failAll(requests, err)
+		return
+	}
+	perRow := int64(-1)
+	var rawID int64
+	result, err := tx.Exec(query, params...)
+	if err == nil {
+		affected, _ := result.RowsAffected()
+		rawID, _ = result.LastInsertId()
+		perRow = m.upsertRowsAffected(affected, int64(totalRows))
+		if perRow < 0 {
+			err = fmt.Errorf("%d affected rows for %d rows", affected, totalRows)
 		}
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Printf("[WriteBatch] Merged upsert of %d rows not used, executing the upserts one by one: %v", totalRows, err)
+		m.executeTransactionBatch(requests)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		m.failAll(requests, err)
 		return
 	}
-	defer stmt.Close()
 
-	for _, req := range requests {
-		result, err := stmt.Exec(req.Params...)
-		if err != nil {
-			req.ResultChan <- WriteResult{Error: err}
-			continue
-		}
+	// Insert IDs are only known when all rows were inserted, which MariaDB
+	// reports as one affected row per row
+	exact := perRow == 1 && m.firstInsertIDIsFirst && rawID != 0
+	step := int64(1)
+	if exact {
+		step = m.insertIDStep()
+	}
+	firstID := m.normalizeFirstInsertID(rawID, totalRows, step)
 
-		affected, _ := result.RowsAffected()
-		lastID, _ := result.LastInsertId()
-		req.ResultChan <- WriteResult{
-			AffectedRows: affected,
+	row := 0
+	for i, req := range requests {
+		var lastID int64
+		if exact {
+			lastID = firstID + int64(row)*step
+		}
+		req.deliver(WriteResult{
+			AffectedRows: perRow * int64(rowCounts[i]),
 			LastInsertID: lastID,
 			BatchSize:    len(requests),
-		}
-		// Notify connection of batch completion
+		})
+		row += rowCounts[i]
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
 		}
 	}
 }
 
+// upsertRowsAffected returns the affected rows per row of a merged upsert
+// with the given affected rows in total, when all rows had the same outcome,
+// or -1 when they differ: 0 (skipped or unchanged), 1 (inserted, or updated
+// on PostgreSQL) or 2 (updated on MariaDB). On MariaDB a mix of updated and
+// unchanged rows that adds up to one per row cannot be told apart from
+// inserted rows.
+func (m *Manager) upsertRowsAffected(affected, rows int64) int64 {
+	switch {
+	case affected == 0:
+		return 0
+	case affected == rows:
+		return 1
+	case affected == 2*rows && m.firstInsertIDIsFirst:
+		return 2
+	}
+	return -1
+}
+
+// normalizeFirstInsertID returns the ID of the first inserted row for a multi-row INSERT.
+// MySQL/MariaDB report last_insert_id() = first row's ID.
+// SQLite reports last_insert_rowid() = last row's ID; subtract (n-1) steps to get the first.
+func (m *Manager) normalizeFirstInsertID(rawID int64, batchSize int, step int64) int64 {
+	if m.firstInsertIDIsFirst {
+		return rawID // MySQL: rawID already is the first row's ID
+	}
+	return rawID - int64(batchSize-1)*step // SQLite: rawID is the last row's ID
+}
+
+// insertIDStep returns the difference between consecutive generated IDs of a
+// multi-row INSERT: @@auto_increment_increment on MySQL/MariaDB (read once,
+// as it is normally set server wide), else 1
+func (m *Manager) insertIDStep() int64 {
+	m.idStepOnce.Do(func() {
+		m.idStep = 1
+		if !m.firstInsertIDIsFirst {
+			return
+		}
+		var step int64
+		if err := m.db.QueryRow("SELECT @@auto_increment_increment").Scan(&step); err != nil {
+			log.Printf("[WriteBatch] Reading auto_increment_increment failed, assuming 1: %v", err)
+		} else if step > 0 {
+			m.idStep = step
+		}
+	})
+	return m.idStep
+}
+
+// containsPostgresPlaceholder checks if query uses PostgreSQL $1 syntax
+func containsPostgresPlaceholder(query string) bool {
+	for i := 0; i < len(query)-1; i++ {
+		if query[i] == '$' && query[i+1] >= '0' && query[i+1] <= '9' {
+			return true
+		}
+	}
+	return false
+}
+
 // executeTransactionBatch executes mixed queries in a transaction
 func (m *Manager) executeTransactionBatch(requests []*WriteRequest) {
-	tx, err := m.db.Begin()
+	tx, err := m.begin(requests[0].durability)
 	if err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	results := make([]WriteResult, len(requests))
 
 	for i, req := range requests {
+		if req.HasReturning {
+			rows, err := tx.Query(req.Query, req.Params...)
+			if err == nil {
+				results[i] = returningResult(rows, len(requests))
+				err = results[i].Error
+			}
+			if err != nil {
+				tx.Rollback()
+				m.failTransaction(requests, err)
+				return
+			}
+			continue
+		}
+
 		result, err := tx.Exec(req.Query, req.Params...)
 		if err != nil {
 			tx.Rollback()
-			// Send error to all requests
-			for j := 0; j <= i; j++ {
-				requests[j].ResultChan <- WriteResult{Error: err}
-			}
-			for j := i + 1; j < len(requests); j++ {
-				requests[j].ResultChan <- WriteResult{Error: err}
-			}
+			// Send error to all requests, or isolate the failing ones
+			m.failTransaction(requests, err)
 			return
 		}
 
@@ -929,15 +1056,13 @@ func (m *Manager) executeTransactionBatch(requests []*WriteRequest) {
 	}
 
 	if err := tx.Commit(); err != nil {
-		for _, req := range requests {
-			req.ResultChan <- WriteResult{Error: err}
-		}
+		m.failAll(requests, err)
 		return
 	}
 
 	// Send results to all requests
 	for i, req := range requests {
-		req.ResultChan <- results[i]
+		req.deliver(results[i])
 		// Notify connection of batch completion
 		if req.OnBatchComplete != nil {
 			req.OnBatchComplete(len(requests))
@@ -946,8 +1071,19 @@ func (m *Manager) executeTransactionBatch(requests []*WriteRequest) {
 }
 
 // executeWrite executes a single write operation
-func (m *Manager) executeWrite(query string, params []interface{}) WriteResult {
-	result, err := m.db.Exec(query, params...)
+func (m *Manager) executeWrite(d Durability, query string, params []interface{}) WriteResult {
+	if hasReturningClause(query) {
+		if d != DurabilityFull && m.postgres {
+			return m.executeWriteReturning(d, query, params)
+		}
+		rows, err := m.db.Query(query, params...)
+		if err != nil {
+			return WriteResult{Error: err}
+		}
+		return returningResult(rows, 1)
+	}
+
+	result, err := m.exec(d, query, params...)
 	if err != nil {
 		return WriteResult{Error: err}
 	}
@@ -961,3 +1097,61 @@ func (m *Manager) executeWrite(query string, params []interface{}) WriteResult {
 		BatchSize:    1,
 	}
 }
+
+// executeWriteReturning executes a single write with a RETURNING clause in a
+// transaction with a relaxed durability
+func (m *Manager) executeWriteReturning(d Durability, query string, params []interface{}) WriteResult {
+	tx, err := m.begin(d)
+	if err != nil {
+		return WriteResult{Error: err}
+	}
+	rows, err := tx.Query(query, params...)
+	if err != nil {
+		tx.Rollback()
+		return WriteResult{Error: err}
+	}
+	result := returningResult(rows, 1)
+	if result.Error != nil {
+		tx.Rollback()
+		return result
+	}
+	if err := tx.Commit(); err != nil {
+		return WriteResult{Error: err}
+	}
+	return result
+}
+
+// returningResult reads and closes the rows returned by the RETURNING clause
+// of a write, which counts them as affected rows
+func returningResult(rows *sql.Rows, batchSize int) WriteResult {
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return WriteResult{Error: err}
+	}
+	result := WriteResult{ReturningCols: cols, BatchSize: batchSize}
+	if types, err := rows.ColumnTypes(); err == nil {
+		for _, ct := range types {
+			result.ReturningTypes = append(result.ReturningTypes, ct.DatabaseTypeName())
+		}
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		valuePtrs := make([]interface{}, len(cols))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return WriteResult{Error: err}
+		}
+		result.ReturningRows = append(result.ReturningRows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return WriteResult{Error: err}
+	}
+	result.AffectedRows = int64(len(result.ReturningRows))
+	if len(result.ReturningRows) > 0 {
+		result.ReturningValues = result.ReturningRows[0]
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+package writebatch
+
+import (
+	"context"
+	"sync"
+)
+
+// Fence tracks the batched writes of one session, so that the session can
+// wait for them to complete before it starts a transaction. Otherwise a write
+// batched before BEGIN could commit after it. The zero value is ready to use.
+type Fence struct {
+	mu      sync.Mutex
+	pending int
+	drained chan struct{} // Closed when the pending writes completed
+}
+
+// add tracks a write
+func (f *Fence) add() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pending == 0 {
+		f.drained = make(chan struct{})
+	}
+	f.pending++
+}
+
+// done releases a tracked write
+func (f *Fence) done() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending--
+	if f.pending == 0 {
+		close(f.drained)
+		f.drained = nil
+	}
+}
+
+// Pending returns the number of tracked writes that did not complete yet
+func (f *Fence) Pending() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pending
+}
+
+// Wait blocks until no tracked write is pending, or ctx is done. Writes
+// complete when they committed, failed or were withdrawn before their batch
+// started. A nil fence does not wait.
+func (f *Fence) Wait(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	drained := f.drained
+	f.mu.Unlock()
+	if drained == nil {
+		return nil
+	}
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EnqueueFenced is EnqueueOrdered, but tracks the write in fence until it
+// completed. A write whose caller gave up (ctx is done) stays tracked while
+// its batch executes. A nil fence does not track writes.
+func (m *Manager) EnqueueFenced(ctx context.Context, fence *Fence, seq *Sequence, batchKey, query string, params []interface{}, batchMs int, onBatchComplete func(int)) WriteResult {
+	ctx, stop := m.withRequestTimeout(ctx)
+	defer stop()
+	fence.add()
+	defer fence.done()
+	return m.enqueueOrdered(ctx, fence, seq, batchKey, query, params, batchMs, onBatchComplete)
+}
@@ -0,0 +1,95 @@
+package writebatch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManager_EnqueueFenced(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	var fence Fence
+	if err := fence.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected an empty fence not to wait, got %v", err)
+	}
+
+	done := make(chan WriteResult, 1)
+	go func() {
+		done <- m.EnqueueFenced(context.Background(), &fence, nil, "fence",
+			"INSERT INTO test_writes (data) VALUES ('before')", nil, 1000, nil)
+	}()
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if fence.Pending() == 0 {
+		t.Fatal("Expected the batched write to be tracked")
+	}
+
+	// The write is still waiting for its batch window
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := fence.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected Wait to block until the deadline, got %v", err)
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- fence.Wait(context.Background()) }()
+	clock.Advance(time.Second)
+	if err := <-waited; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The write committed before Wait returned
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data = 'before'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected the write to be committed, found %d rows", count)
+	}
+	if result := <-done; result.Error != nil {
+		t.Fatalf("Unexpected error: %v", result.Error)
+	}
+}
+
+func TestManager_EnqueueFencedWithdrawn(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	// A write withdrawn before its batch started no longer holds the fence
+	var fence Fence
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan WriteResult, 1)
+	go func() {
+		done <- m.EnqueueFenced(ctx, &fence, nil, "fence",
+			"INSERT INTO test_writes (data) VALUES ('withdrawn')", nil, 1000, nil)
+	}()
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if result := <-done; result.Error != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", result.Error)
+	}
+	if n := fence.Pending(); n != 0 {
+		t.Errorf("Expected no pending writes, got %d", n)
+	}
+	if err := fence.Wait(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package writebatch
+
+import "time"
+
+// Event identifies a point in the lifecycle of a batch
+type Event int
+
+const (
+	// BatchStarted fires when the batch window closes and the batch starts executing
+	BatchStarted Event = iota
+	// BatchFlushed fires when all requests of the batch executed without error
+	BatchFlushed
+	// BatchFailed fires when one or more requests of the batch failed
+	BatchFailed
+)
+
+// String returns the name of the event
+func (e Event) String() string {
+	switch e {
+	case BatchStarted:
+		return "started"
+	case BatchFlushed:
+		return "flushed"
+	case BatchFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// BatchEvent describes a batch at a lifecycle event
+type BatchEvent struct {
+	Event    Event
+	BatchKey string
+	Size     int           // Number of requests in the batch
+	Wait     time.Duration // Time between the first enqueue and the start of execution
+	Duration time.Duration // Execution time (0 for BatchStarted)
+	Failed   int           // Number of failed requests (BatchFailed only)
+	Err      error         // Error of the first failed request (BatchFailed only)
+}
+
+// Hook is called on batch lifecycle events. Hooks run synchronously on the
+// goroutine executing the batch, so they should return quickly.
+type Hook func(BatchEvent)
+
+// RegisterHook registers fn to be called on event. Hooks can be registered
+// at any time and are called in registration order.
+func (m *Manager) RegisterHook(event Event, fn Hook) {
+	m.hooksMu.Lock()
+	defer m.hooksMu.Unlock()
+	if m.hooks == nil {
+		m.hooks = make(map[Event][]Hook)
+	}
+	m.hooks[event] = append(m.hooks[event], fn)
+}
+
+// fire calls the hooks registered for ev.Event
+func (m *Manager) fire(ev BatchEvent) {
+	m.hooksMu.RLock()
+	hooks := m.hooks[ev.Event]
+	m.hooksMu.RUnlock()
+	for _, fn := range hooks {
+		fn(ev)
+	}
+}
+
+// fireCompleted fires BatchFlushed or BatchFailed, depending on the results
+// delivered to the requests
+func (m *Manager) fireCompleted(batchKey string, requests []*WriteRequest, wait, duration time.Duration) {
+	ev := BatchEvent{
+		Event:    BatchFlushed,
+		BatchKey: batchKey,
+		Size:     len(requests),
+		Wait:     wait,
+		Duration: duration,
+	}
+	for _, req := range requests {
+		if req.err != nil {
+			if ev.Err == nil {
+				ev.Err = req.err
+			}
+			ev.Failed++
+		}
+	}
+	if ev.Failed > 0 {
+		ev.Event = BatchFailed
+	}
+	m.fire(ev)
+}
@@ -0,0 +1,69 @@
+package writebatch
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManager_Hooks(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	m := New(db, DefaultConfig())
+	defer m.Close()
+
+	// Completion hooks run after the results are delivered, so events are
+	// collected on a channel and awaited
+	events := make(chan BatchEvent, 10)
+	record := func(ev BatchEvent) { events <- ev }
+	m.RegisterHook(BatchStarted, record)
+	m.RegisterHook(BatchFlushed, record)
+	m.RegisterHook(BatchFailed, record)
+	next := func() BatchEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for batch event")
+			return BatchEvent{}
+		}
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.Enqueue(ctx, "hooks:insert", "INSERT INTO test_writes (data, value) VALUES (?, ?)", []interface{}{"hook", i}, 20, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	started := next()
+	if started.Event != BatchStarted || started.BatchKey != "hooks:insert" || started.Size != 3 {
+		t.Errorf("Unexpected started event: %+v", started)
+	}
+	if started.Wait <= 0 {
+		t.Errorf("Expected positive wait time, got %v", started.Wait)
+	}
+	flushed := next()
+	if flushed.Event != BatchFlushed || flushed.Size != 3 || flushed.Duration <= 0 || flushed.Err != nil {
+		t.Errorf("Unexpected flushed event: %+v", flushed)
+	}
+
+	// A failing batch
+	result := m.Enqueue(ctx, "hooks:fail", "INSERT INTO missing_table (data) VALUES (?)", []interface{}{"x"}, 5, nil)
+	if result.Error == nil {
+		t.Fatal("Expected error for missing table")
+	}
+	if ev := next(); ev.Event != BatchStarted {
+		t.Errorf("Expected started event, got %v", ev.Event)
+	}
+	failed := next()
+	if failed.Event != BatchFailed || failed.BatchKey != "hooks:fail" || failed.Failed != 1 || failed.Err == nil {
+		t.Errorf("Unexpected failed event: %+v", failed)
+	}
+}
@@ -11,16 +11,57 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
 )
 
 // Manager handles batching of write operations
 type Manager struct {
-	groups              sync.Map // map[string]*BatchGroup
-	config              Config
-	db                  *sql.DB
-	closed              atomic.Bool
-	batchCount          atomic.Int64
+	shards               []*shard // Open batches, spread over the shards by group key
+	configMu             sync.RWMutex
+	config               Config // Guarded by configMu, see Reconfigure
+	db                   *sql.DB
+	closed               atomic.Bool
+	shedding             atomic.Bool // Batches run at a fraction of MaxBatchSize, see SetShedding
+	batchCount           atomic.Int64
+	opCount              atomic.Int64
 	firstInsertIDIsFirst bool // true for MySQL/MariaDB (last_insert_id = first row), false for SQLite (last_insert_rowid = last row)
+	postgres             bool // true for PostgreSQL, where batches may have a relaxed durability
+	hooksMu              sync.RWMutex
+	hooks                map[Event][]Hook // Batch lifecycle hooks, see RegisterHook
+	clock                Clock            // Time source for batch windows
+	inflight             sync.WaitGroup   // Executing batches, waited for by Close
+	workers              sync.WaitGroup   // Shard workers, waited for by Close
+	workMu               sync.RWMutex
+	workStopped          bool           // Shard workers stopped, guarded by workMu
+	async                sync.WaitGroup // Pending async writes, waited for by Close
+	asyncPending         atomic.Int64   // Number of pending async writes, see EnqueueAsync
+	executing            atomic.Int64   // Number of executing batches
+	rejected             atomic.Int64   // Writes rejected with ErrQueueFull
+	withdrawn            atomic.Int64   // Writes withdrawn by a cancelled context
+	waitTotal            atomic.Int64   // Nanoseconds writes waited for their batch to start
+	waitCount            atomic.Int64   // Writes whose wait is in waitTotal
+	spool                *Spool         // Write-ahead spool, see Config.Spool
+	replayStop           chan struct{}  // Closed by Close to stop replaying the spool
+	replayDone           sync.WaitGroup // Replay loop, waited for by Close
+	replayOnce           sync.Once      // Closes replayStop once
+	idStepOnce           sync.Once
+	idStep               int64 // Difference between consecutive generated IDs, see insertIDStep
+}
+
+// Pending returns the number of requests waiting in open batches
+func (m *Manager) Pending() int {
+	pending := 0
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		for _, group := range sh.groups {
+			group.mu.Lock()
+			pending += len(group.Requests)
+			group.mu.Unlock()
+		}
+		sh.mu.Unlock()
+	}
+	return pending
 }
 
 // BatchCount returns the total number of batches executed since the manager was created.
@@ -28,17 +69,69 @@ func (m *Manager) BatchCount() int64 {
 	return m.batchCount.Load()
 }
 
+// OpCount returns the total number of writes executed in batches since the
+// manager was created.
+func (m *Manager) OpCount() int64 {
+	return m.opCount.Load()
+}
+
+// Reconfigure applies a changed configuration, e.g. on SIGHUP, to the
+// batches started after the call. The clock, spool and workers stay the
+// ones of New.
+func (m *Manager) Reconfigure(config Config) {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	config.Clock = m.config.Clock
+	config.Spool = m.config.Spool
+	config.Workers = m.config.Workers
+	m.config = config
+}
+
+// shedDivisor divides MaxBatchSize while shedding
+const shedDivisor = 4
+
+// SetShedding makes batches run once they reach a quarter of MaxBatchSize,
+// so that fewer writes wait in memory, e.g. under memory pressure
+func (m *Manager) SetShedding(on bool) {
+	m.shedding.Store(on)
+}
+
+// currentConfig returns the configuration
+func (m *Manager) currentConfig() Config {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	return m.config
+}
+
 // New creates a new write batch manager
 func New(db *sql.DB, config Config) *Manager {
 	// MySQL/MariaDB return the first auto-generated ID for multi-row INSERTs.
 	// SQLite (and some other drivers) return the last inserted row's ID instead.
 	driverType := fmt.Sprintf("%T", db.Driver())
 	firstIDIsFirst := strings.Contains(strings.ToLower(driverType), "mysql")
-	return &Manager{
-		db:                  db,
-		config:              config,
+	postgres := strings.HasPrefix(driverType, "*pq.")
+	clock := config.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	m := &Manager{
+		db:                   db,
+		config:               config,
 		firstInsertIDIsFirst: firstIDIsFirst,
+		postgres:             postgres,
+		clock:                clock,
+		spool:                config.Spool,
 	}
+	if config.Workers <= 0 {
+		m.config.Workers = DefaultWorkers()
+	}
+	m.startShards(m.config.Workers)
+	if m.spool != nil {
+		m.replayStop = make(chan struct{})
+		m.replayDone.Add(1)
+		go m.replayLoop()
+	}
+	return m
 }
 
 // Enqueue adds a write operation to the batch queue and waits for its result.
@@ -56,13 +149,65 @@ func New(db *sql.DB, config Config) *Manager {
 //   - batchMs > 0: Add to batch group, wait up to batchMs for more operations
 //   - Batch executes when: timer expires OR max_batch_size reached
 //
+// Batches execute on the worker of the shard of their batch key. With more
+// than Config.QueueSize writes of the batch key in open or executing
+// batches, the write is rejected with ErrQueueFull.
+//
 // The function blocks until the operation completes or context is cancelled.
+// When the deadline of ctx or Config.RequestTimeoutMs passes first it
+// returns ErrTimeout, and the write is removed from its batch unless the
+// batch started already; a started write completes, but its result is
+// discarded.
 // Each operation receives its individual WriteResult, including:
 //   - AffectedRows, LastInsertID (for INSERT)
 //   - BatchSize (number of operations in the batch)
 //   - Error (if any)
+//
+// The batch commits with the durability set on ctx with WithDurability, and
+// holds at most the number of writes set on ctx with WithMaxBatchSize.
+//
+// With a spool (see Config.Spool) a batched write without RETURNING that
+// fails because the backend is unavailable is spooled instead, and so are
+// the writes with the same batch key until the spooled ones are replayed.
+// The result then has Spooled set and no error.
 func (m *Manager) Enqueue(ctx context.Context, batchKey, query string, params []interface{}, batchMs int, onBatchComplete func(int)) WriteResult {
+	ctx, stop := m.withRequestTimeout(ctx)
+	defer stop()
+	return m.enqueue(ctx, nil, batchKey, query, params, batchMs, onBatchComplete)
+}
+
+// withRequestTimeout bounds ctx by Config.RequestTimeoutMs on the clock of
+// the manager. The returned func releases the timer.
+func (m *Manager) withRequestTimeout(ctx context.Context) (context.Context, func()) {
+	ms := m.currentConfig().RequestTimeoutMs
+	if ms <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := m.clock.AfterFunc(time.Duration(ms)*time.Millisecond, func() { cancel(ErrTimeout) })
+	return ctx, func() {
+		timer.Stop()
+		cancel(nil)
+	}
+}
+
+// ctxError returns the error of a done ctx, ErrTimeout when its deadline or
+// the request timeout passed
+func ctxError(ctx context.Context) error {
+	if context.Cause(ctx) == ErrTimeout || ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return ctx.Err()
+}
+
+// enqueue is Enqueue, tracking a batched write in fence until it is delivered
+// or withdrawn
+func (m *Manager) enqueue(ctx context.Context, fence *Fence, batchKey, query string, params []interface{}, batchMs int, onBatchComplete func(int)) WriteResult {
 	hasReturning := hasReturningClause(query)
+	maxBatchSize := maxBatchSizeFrom(ctx, m.currentConfig().MaxBatchSize)
+	if m.shedding.Load() {
+		maxBatchSize = max(1, maxBatchSize/shedDivisor)
+	}
 
 	if m.closed.Load() {
 		return WriteResult{Error: ErrManagerClosed}
@@ -71,6 +216,9 @@ func (m *Manager) Enqueue(ctx context.Context, batchKey, query string, params []
 	// If no wait time specified, execute immediately (no batching)
 	if batchMs == 0 {
 		result := m.executeImmediate(ctx, query, params)
+		if result.Error != nil && ctx.Err() != nil {
+			result.Error = ctxError(ctx)
+		}
 		// Call callback even for immediate execution
 		if onBatchComplete != nil {
 			onBatchComplete(result.BatchSize)
@@ -78,71 +226,108 @@ func (m *Manager) Enqueue(ctx context.Context, batchKey, query string, params []
 		return result
 	}
 
-	req := &WriteRequest{
-		Query:           query,
-		Params:          params,
-		ResultChan:      make(chan WriteResult, 1),
-		EnqueuedAt:      time.Now(),
-		OnBatchComplete: onBatchComplete,
-		HasReturning:    hasReturning,
+	if m.spoolable(ctx, hasReturning) && m.spool.backlogged(batchKey) {
+		return m.spoolWrite(batchKey, query, params, nil)
 	}
 
-	// Get or create batch group
-	groupInterface, loaded := m.groups.Load(batchKey)
-	if !loaded {
-		// Group doesn't exist, create it
-		newGroup := &BatchGroup{
-			BatchKey:  batchKey,
-			Requests:  make([]*WriteRequest, 0, m.config.MaxBatchSize),
-			FirstSeen: time.Now(),
+	durability := durabilityFrom(ctx)
+	key := groupKey(batchKey, durability)
+	sh := m.shardFor(key)
+	now := m.clock.Now()
+
+	sh.mu.Lock()
+	if size := m.currentConfig().QueueSize; size > 0 && sh.queued[key] >= size {
+		sh.mu.Unlock()
+		m.rejected.Add(1)
+		metrics.WriteBatchDropped.WithLabelValues("queue_full").Inc()
+		return WriteResult{Error: ErrQueueFull}
+	}
+	req := newRequest(query, params, now, onBatchComplete, hasReturning, durability, fence)
+	group := sh.groups[key]
+	if group == nil {
+		// First request - the window starts
+		group = &BatchGroup{
+			BatchKey:  key,
+			Requests:  make([]*WriteRequest, 0, min(maxBatchSize, 64)),
+			FirstSeen: now,
+			deadline:  now.Add(time.Duration(batchMs) * time.Millisecond),
 		}
-		groupInterface, loaded = m.groups.LoadOrStore(batchKey, newGroup)
+		sh.add(key, group)
+		m.schedule(sh, group.deadline)
 	}
-	group := groupInterface.(*BatchGroup)
-
 	group.mu.Lock()
-	isFirst := len(group.Requests) == 0
-	if group.Requests == nil {
-		// Group has been processed, this shouldn't happen but handle it
-		group.mu.Unlock()
-		// Retry with a fresh lookup
-		return m.Enqueue(ctx, batchKey, query, params, batchMs, onBatchComplete)
-	}
 	group.Requests = append(group.Requests, req)
-	currentSize := len(group.Requests)
-
-	if isFirst {
-		// First request - start timer with specified delay
-		delay := time.Duration(batchMs) * time.Millisecond
-		group.timer = time.AfterFunc(delay, func() {
-			m.executeBatch(batchKey, group)
-		})
-		group.mu.Unlock()
-	} else if currentSize >= m.config.MaxBatchSize {
-		// Batch full - execute immediately
-		timer := group.timer
-		// Delete group from map so new requests create a fresh batch
-		m.groups.Delete(batchKey)
-		group.mu.Unlock()
-		if timer != nil {
-			timer.Stop()
-		}
-		go m.executeBatch(batchKey, group)
-	} else {
-		group.mu.Unlock()
+	full := len(group.Requests) >= maxBatchSize
+	group.mu.Unlock()
+	fence.add()
+	sh.enqueue(key)
+	if full {
+		// Batch full - execute immediately, new requests start a fresh batch
+		sh.remove(key)
+	}
+	sh.mu.Unlock()
+	if full {
+		m.dispatch(sh, batchJob{key: key, group: group})
 	}
 
 	// Wait for result
 	select {
 	case result := <-req.ResultChan:
+		req.release()
+		if result.Error != nil && m.spoolable(ctx, hasReturning) && isUnavailable(result.Error) {
+			return m.spoolWrite(batchKey, query, params, result.Error)
+		}
 		return result
 	case <-ctx.Done():
-		return WriteResult{Error: ctx.Err()}
+		req.abandoned.Store(true)
+		m.withdraw(sh, key, group, req)
+		req.release()
+		return WriteResult{Error: ctxError(ctx)}
+	}
+}
+
+// withdraw removes a cancelled request from its batch group if the batch has
+// not started yet, closing the group when it becomes empty. Once the batch
+// has started the write completes, but its result is discarded.
+func (m *Manager) withdraw(sh *shard, key string, group *BatchGroup, req *WriteRequest) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	for i, r := range group.Requests {
+		if r == req {
+			group.Requests = append(group.Requests[:i], group.Requests[i+1:]...)
+			sh.dequeue(key, 1)
+			m.withdrawn.Add(1)
+			metrics.WriteBatchDropped.WithLabelValues("withdrawn").Inc()
+			req.fence.done()
+			req.release()
+			break
+		}
+	}
+	if group.Requests != nil && len(group.Requests) == 0 {
+		group.Requests = nil
+		if sh.groups[key] == group {
+			sh.remove(key)
+		}
+		if len(sh.groups) == 0 && sh.timer != nil {
+			sh.timer.Stop()
+			sh.timer = nil
+		}
 	}
 }
 
 // executeImmediate executes a query immediately without batching
 func (m *Manager) executeImmediate(ctx context.Context, query string, params []interface{}) WriteResult {
+	if hasReturningClause(query) {
+		rows, err := m.db.QueryContext(ctx, query, params...)
+		if err != nil {
+			log.Printf("[WriteBatch] executeImmediate ERROR: %v", err)
+			return WriteResult{Error: err}
+		}
+		return returningResult(rows, 0)
+	}
+
 	result, err := m.db.ExecContext(ctx, query, params...)
 	if err != nil {
 		log.Printf("[WriteBatch] executeImmediate ERROR: %v", err)
@@ -158,12 +343,55 @@ func (m *Manager) executeImmediate(ctx context.Context, query string, params []i
 	}
 }
 
-// Close shuts down the manager and waits for in-flight batches
+// Flush executes all open batches immediately, without waiting for their
+// batch windows, and returns when they completed, except for the retries of
+// writes that failed on a transient error. It returns the number of flushed
+// requests.
+func (m *Manager) Flush() int {
+	var keys []string
+	var groups []*BatchGroup
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		for key, group := range sh.groups {
+			sh.remove(key)
+			keys = append(keys, key)
+			groups = append(groups, group)
+		}
+		if sh.timer != nil {
+			sh.timer.Stop()
+			sh.timer = nil
+		}
+		sh.mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	var flushed atomic.Int64
+	for i, group := range groups {
+		wg.Add(1)
+		go func(batchKey string, group *BatchGroup) {
+			defer wg.Done()
+			flushed.Add(int64(m.runBatch(batchKey, group)))
+		}(keys[i], group)
+	}
+	wg.Wait()
+	return int(flushed.Load())
+}
+
+// Close shuts down the manager: new writes are rejected, open batches are
+// flushed and executing batches and async writes are waited for. The spool
+// is closed, its pending writes are replayed by the next manager.
 func (m *Manager) Close() error {
 	m.closed.Store(true)
-	// Wait a moment for in-flight batches to complete
-	time.Sleep(200 * time.Millisecond)
-	return nil
+	m.Flush()
+	m.async.Wait()
+	m.inflight.Wait()
+	m.stopShards()
+	if m.spool == nil {
+		return nil
+	}
+	m.replayOnce.Do(func() { close(m.replayStop) })
+	m.replayDone.Wait()
+	return m.spool.Close()
 }
 
 // hasReturningClause checks if a query contains a RETURNING clause
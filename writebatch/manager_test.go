@@ -3,13 +3,19 @@ package writebatch
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"os"
+	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
 
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/mevdschee/tqdbproxy/metrics"
+	"github.com/mevdschee/tqdbproxy/parser"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func setupTestDB(t *testing.T) *sql.DB {
@@ -54,6 +60,50 @@ func TestManager_InsertReturning(t *testing.T) {
 	}
 }
 
+func TestManager_BatchedReturning(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	// Queries that differ in their values run in one transaction
+	results := make(chan WriteResult, 2)
+	for _, data := range []string{"a", "b"} {
+		go func() {
+			results <- m.Enqueue(context.Background(), "returning",
+				"INSERT INTO test_writes (data) VALUES ('"+data+"') RETURNING id, data", nil, 100, nil)
+		}()
+	}
+	for m.Pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(100 * time.Millisecond)
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.Error != nil {
+			t.Fatalf("Unexpected error: %v", result.Error)
+		}
+		if len(result.ReturningCols) != 2 || result.ReturningCols[0] != "id" || result.ReturningCols[1] != "data" {
+			t.Fatalf("Expected columns id and data, got %v", result.ReturningCols)
+		}
+		if len(result.ReturningRows) != 1 || result.AffectedRows != 1 {
+			t.Fatalf("Expected one returned row, got %v", result.ReturningRows)
+		}
+		data, _ := result.ReturningValues[1].(string)
+		seen[data] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Errorf("Expected the rows of both writes, got %v", seen)
+	}
+}
+
 func TestManager_InsertLastInsertId_MySQL(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -177,6 +227,277 @@ func TestManager_BatchInsertLastInsertID(t *testing.T) {
 	}
 }
 
+// TestManager_ExactInsertIDs verifies that with ExactIDs inserts are not
+// merged, and each request gets the ID of its own row as stored
+func TestManager_ExactInsertIDs(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.ExactIDs = true
+	m := New(db, cfg)
+	defer m.Close()
+
+	const batchSize = 3
+	results := make([]WriteResult, batchSize)
+	var wg sync.WaitGroup
+	for i := 0; i < batchSize; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			results[idx] = m.Enqueue(context.Background(), "test:exact",
+				"INSERT INTO test_writes (data, value) VALUES (?, ?)",
+				[]interface{}{"exact", idx}, 10, nil)
+		}(i)
+	}
+	for m.Pending() < batchSize {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(10 * time.Millisecond)
+	wg.Wait()
+
+	for i, res := range results {
+		if res.Error != nil {
+			t.Fatalf("request %d failed: %v", i, res.Error)
+		}
+		if res.BatchSize != batchSize {
+			t.Errorf("request %d: expected batch size %d, got %d", i, batchSize, res.BatchSize)
+		}
+		var value int
+		if err := db.QueryRow("SELECT value FROM test_writes WHERE id = ?", res.LastInsertID).Scan(&value); err != nil {
+			t.Fatalf("request %d: row %d not found: %v", i, res.LastInsertID, err)
+		}
+		if value != i {
+			t.Errorf("request %d: LastInsertID %d points to the row of request %d", i, res.LastInsertID, value)
+		}
+	}
+}
+
+// TestManager_MergedInsertIgnoreIDs verifies that merged inserts with skipped
+// rows report no insert IDs, as they cannot be attributed to the requests
+func TestManager_MergedInsertIgnoreIDs(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("INSERT INTO test_writes (id, data) VALUES (2, 'taken')"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	results := make(chan WriteResult, 2)
+	for _, id := range []string{"1", "2"} {
+		go func() {
+			results <- m.Enqueue(context.Background(), "test:ignore",
+				"INSERT OR IGNORE INTO test_writes (id, data) VALUES ("+id+", 'new')", nil, 10, nil)
+		}()
+	}
+	for m.Pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.Error != nil {
+			t.Fatalf("Unexpected error: %v", res.Error)
+		}
+		if res.LastInsertID != 0 {
+			t.Errorf("Expected no insert ID, got %d", res.LastInsertID)
+		}
+	}
+}
+
+// TestManager_MergeMultiRowInserts verifies that multi-row and single-row
+// inserts into the same columns are merged into one INSERT, and that each
+// request gets its own row count and first insert ID.
+func TestManager_MergeMultiRowInserts(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	queries := []struct {
+		query  string
+		params []interface{}
+		rows   int64
+	}{
+		{"INSERT INTO test_writes (data, value) VALUES ('merge', 1), ('merge', 2), ('merge', 3)", nil, 3},
+		{"INSERT INTO test_writes (data, value) VALUES (?, ?)", []interface{}{"merge", 4}, 1},
+		{"INSERT INTO test_writes (data, value) VALUES ('merge', 5), (?, ?)", []interface{}{"merge", 6}, 2},
+	}
+	results := make([]chan WriteResult, len(queries))
+	for i := range queries {
+		results[i] = make(chan WriteResult, 1)
+		go func(i int) {
+			results[i] <- m.Enqueue(context.Background(), "INSERT INTO test_writes (data, value) VALUES",
+				queries[i].query, queries[i].params, 1000, nil)
+		}(i)
+		for m.Pending() < i+1 {
+			runtime.Gosched()
+		}
+	}
+	clock.Advance(time.Second)
+
+	var ids []int64
+	for i, q := range queries {
+		result := <-results[i]
+		if result.Error != nil {
+			t.Fatalf("Request %d failed: %v", i, result.Error)
+		}
+		if result.BatchSize != len(queries) || result.AffectedRows != q.rows {
+			t.Errorf("Request %d: batch size %d, affected rows %d; want %d, %d",
+				i, result.BatchSize, result.AffectedRows, len(queries), q.rows)
+		}
+		ids = append(ids, result.LastInsertID)
+	}
+
+	// Each request gets the ID of its own first row
+	var want []int64
+	rows, err := db.Query("SELECT id FROM test_writes WHERE value IN (1, 4, 5) ORDER BY value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		want = append(want, id)
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("LastInsertIDs = %v, want %v", ids, want)
+	}
+}
+
+// TestManager_CoalesceTextInserts verifies that hinted text-protocol inserts
+// that only differ in their literals share a batch key and run as one
+// multi-row INSERT.
+func TestManager_CoalesceTextInserts(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	merged := metrics.WriteBatchMethod.WithLabelValues("multi_row_insert")
+	before := testutil.ToFloat64(merged)
+
+	queries := []string{
+		"/* batch:10 */ INSERT INTO test_writes (data, value) VALUES ('text', 1)",
+		"/* batch:10 */ INSERT INTO test_writes (data, value) VALUES ('text', 2)",
+	}
+	results := make(chan WriteResult, len(queries))
+	for i, query := range queries {
+		parsed := parser.Parse(query)
+		if key := parsed.GetBatchKey(); key != "INSERT INTO test_writes (data, value) VALUES" {
+			t.Fatalf("Unexpected batch key %q", key)
+		}
+		go func() {
+			results <- m.Enqueue(context.Background(), parsed.GetBatchKey(), parsed.Query, nil, parsed.BatchMs, nil)
+		}()
+		for m.Pending() < i+1 {
+			runtime.Gosched()
+		}
+	}
+	clock.Advance(10 * time.Millisecond)
+
+	for range queries {
+		result := <-results
+		if result.Error != nil {
+			t.Fatalf("Unexpected error: %v", result.Error)
+		}
+		if result.BatchSize != 2 || result.AffectedRows != 1 {
+			t.Errorf("Expected one row in a batch of 2, got %d rows in a batch of %d", result.AffectedRows, result.BatchSize)
+		}
+	}
+	if got := testutil.ToFloat64(merged) - before; got != 1 {
+		t.Errorf("Expected 1 multi-row insert, got %v", got)
+	}
+}
+
+// TestManager_MergeUpserts verifies that upserts with the same clause are
+// merged into one multi-row upsert when all rows have the same outcome, and
+// run one by one when they differ, each with its own affected rows.
+func TestManager_MergeUpserts(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE test_upserts (k TEXT PRIMARY KEY, v INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO test_upserts (k, v) VALUES ('a', 0)"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	merged := metrics.WriteBatchMethod.WithLabelValues("multi_row_upsert")
+	batch := func(queries map[string]int64) {
+		t.Helper()
+		results := make(map[string]chan WriteResult)
+		for query := range queries {
+			results[query] = make(chan WriteResult, 1)
+			parsed := parser.Parse(query)
+			go func() {
+				results[query] <- m.Enqueue(context.Background(), parsed.GetBatchKey(), parsed.Query, nil, 10, nil)
+			}()
+			for m.Pending() < len(results) {
+				runtime.Gosched()
+			}
+		}
+		clock.Advance(10 * time.Millisecond)
+		for query, affected := range queries {
+			result := <-results[query]
+			if result.Error != nil {
+				t.Fatalf("%s failed: %v", query, result.Error)
+			}
+			if result.BatchSize != len(queries) || result.AffectedRows != affected {
+				t.Errorf("%s: batch size %d, affected rows %d; want %d, %d", query, result.BatchSize, result.AffectedRows, len(queries), affected)
+			}
+		}
+	}
+
+	// Inserted and updated rows count one each on SQLite, like on PostgreSQL
+	before := testutil.ToFloat64(merged)
+	batch(map[string]int64{
+		"INSERT INTO test_upserts (k, v) VALUES ('a', 1) ON CONFLICT (k) DO UPDATE SET v = excluded.v":           1,
+		"INSERT INTO test_upserts (k, v) VALUES ('b', 2), ('c', 3) ON CONFLICT (k) DO UPDATE SET v = excluded.v": 2,
+	})
+	if got := testutil.ToFloat64(merged) - before; got != 1 {
+		t.Errorf("Expected 1 multi-row upsert, got %v", got)
+	}
+
+	// A skipped row and an inserted row run one by one
+	batch(map[string]int64{
+		"INSERT INTO test_upserts (k, v) VALUES ('a', 4) ON CONFLICT DO NOTHING": 0,
+		"INSERT INTO test_upserts (k, v) VALUES ('d', 5) ON CONFLICT DO NOTHING": 1,
+	})
+
+	var sum int64
+	if err := db.QueryRow("SELECT SUM(v) FROM test_upserts").Scan(&sum); err != nil {
+		t.Fatal(err)
+	}
+	if sum != 1+2+3+5 {
+		t.Errorf("Expected a sum of 11, got %d", sum)
+	}
+}
+
 func TestManager_BatchDeleteAggregation(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -328,6 +649,44 @@ func TestManager_BatchMixedQueries(t *testing.T) {
 	}
 }
 
+func TestManager_IsolateFailures(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	db.Exec("INSERT INTO test_writes (id, data) VALUES (1, 'existing')")
+
+	for _, isolate := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.IsolateFailures = isolate
+		m := New(db, cfg)
+
+		// A duplicate key fails the transaction batch of both writes
+		ctx := context.Background()
+		good := make(chan WriteResult, 1)
+		go func() {
+			good <- m.Enqueue(ctx, "test:isolate", "INSERT INTO test_writes (data) VALUES (?)", []interface{}{"good"}, 20, nil)
+		}()
+		bad := m.Enqueue(ctx, "test:isolate", "INSERT INTO test_writes (id, data) VALUES (?, ?)", []interface{}{1, "duplicate"}, 20, nil)
+		result := <-good
+		m.Close()
+
+		if bad.Error == nil {
+			t.Errorf("isolate=%v: expected the duplicate key to fail", isolate)
+		}
+		if isolate && result.Error != nil {
+			t.Errorf("isolate=%v: expected the other write to succeed, got %v", isolate, result.Error)
+		}
+		if !isolate && result.Error == nil {
+			t.Errorf("isolate=%v: expected the other write to fail with its batch", isolate)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data = 'good'").Scan(&count)
+	if count != 1 {
+		t.Errorf("Expected 1 isolated write, got %d", count)
+	}
+}
+
 func TestManager_BatchSizeLimit(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -461,6 +820,101 @@ func TestManager_ContextCancellation(t *testing.T) {
 	}
 }
 
+func TestManager_CancelledRequestLeavesBatch(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := make(chan WriteResult, 1)
+	go func() {
+		results <- m.Enqueue(ctx, "test:withdraw",
+			"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"aborted"}, 1000, nil)
+	}()
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The client went away while waiting in the batch window
+	cancel()
+	if result := <-results; result.Error != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", result.Error)
+	}
+	if m.Pending() != 0 || clock.Pending() != 0 {
+		t.Errorf("Expected the request and timer to be removed, got %d pending requests and %d timers", m.Pending(), clock.Pending())
+	}
+
+	clock.Advance(time.Second)
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data = 'aborted'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || m.BatchCount() != 0 {
+		t.Errorf("Expected no write, got %d rows in %d batches", count, m.BatchCount())
+	}
+}
+
+func TestManager_RequestTimeout(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.RequestTimeoutMs = 50
+	m := New(db, cfg)
+	defer m.Close()
+
+	results := make(chan WriteResult, 1)
+	go func() {
+		results <- m.Enqueue(context.Background(), "test:timeout",
+			"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"late"}, 100, nil)
+	}()
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The timeout ends before the batch window
+	clock.Advance(50 * time.Millisecond)
+	if result := <-results; result.Error != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", result.Error)
+	}
+	if m.Pending() != 0 || clock.Pending() != 0 {
+		t.Errorf("Expected the request and timers to be removed, got %d pending requests and %d timers", m.Pending(), clock.Pending())
+	}
+	clock.Advance(100 * time.Millisecond)
+	if m.BatchCount() != 0 {
+		t.Errorf("Expected no batch, got %d", m.BatchCount())
+	}
+}
+
+func TestManager_ContextDeadline(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result := m.Enqueue(ctx, "test:deadline",
+		"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"late"}, 1000, nil)
+	if result.Error != ErrTimeout {
+		t.Fatalf("Expected ErrTimeout, got %v", result.Error)
+	}
+	if stats := m.GetStats(); stats.Pending != 0 || stats.Withdrawn != 1 {
+		t.Errorf("Expected the request to be withdrawn, got %+v", stats)
+	}
+}
+
 func TestManager_Close(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -483,6 +937,159 @@ func TestManager_Close(t *testing.T) {
 	}
 }
 
+func TestManager_Flush(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	if n := m.Flush(); n != 0 {
+		t.Errorf("Expected nothing to flush, got %d", n)
+	}
+
+	results := make(chan WriteResult, 3)
+	for i, key := range []string{"test:flush:a", "test:flush:a", "test:flush:b"} {
+		go func(i int, key string) {
+			results <- m.Enqueue(context.Background(), key,
+				"INSERT INTO test_writes (data) VALUES (?)", []interface{}{fmt.Sprintf("flush-%d", i)}, 60000, nil)
+		}(i, key)
+	}
+	for m.Pending() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Both groups execute now, without advancing the clock
+	if n := m.Flush(); n != 3 {
+		t.Errorf("Expected 3 flushed writes, got %d", n)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data LIKE 'flush-%'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || m.BatchCount() != 2 || m.Pending() != 0 {
+		t.Errorf("Expected 3 rows in 2 batches, got %d rows in %d batches with %d pending", count, m.BatchCount(), m.Pending())
+	}
+	if n := m.OpCount(); n != 3 {
+		t.Errorf("Expected 3 batched writes, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		if result := <-results; result.Error != nil {
+			t.Errorf("Expected the flushed write to succeed, got %v", result.Error)
+		}
+	}
+}
+
+func TestManager_Reconfigure(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	m.Reconfigure(Config{MaxBatchSize: 2})
+	results := make(chan WriteResult, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			results <- m.Enqueue(context.Background(), "test:reconfigure",
+				"INSERT INTO test_writes (data) VALUES (?)", []interface{}{fmt.Sprintf("reconfigure-%d", i)}, 60000, nil)
+		}(i)
+	}
+	// The batch is full at the new size, without advancing the clock
+	for i := 0; i < 2; i++ {
+		if result := <-results; result.Error != nil || result.BatchSize != 2 {
+			t.Errorf("Expected a batch of 2, got %d (%v)", result.BatchSize, result.Error)
+		}
+	}
+
+	// The clock of New is kept
+	done := make(chan WriteResult, 1)
+	go func() {
+		done <- m.Enqueue(context.Background(), "test:reconfigure",
+			"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"reconfigure-2"}, 60000, nil)
+	}()
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Minute)
+	if result := <-done; result.Error != nil {
+		t.Errorf("Expected the write to succeed, got %v", result.Error)
+	}
+}
+
+func TestManager_Shedding(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	cfg.MaxBatchSize = 8
+	cfg.Clock = NewFakeClock(time.Now())
+	m := New(db, cfg)
+	defer m.Close()
+
+	m.SetShedding(true)
+	results := make(chan WriteResult, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			results <- m.Enqueue(context.Background(), "test:shedding",
+				"INSERT INTO test_writes (data) VALUES (?)", []interface{}{fmt.Sprintf("shedding-%d", i)}, 60000, nil)
+		}(i)
+	}
+	// A quarter of the batch size fills the batch, without advancing the clock
+	for i := 0; i < 2; i++ {
+		if result := <-results; result.Error != nil || result.BatchSize != 2 {
+			t.Errorf("Expected a batch of 2, got %d (%v)", result.BatchSize, result.Error)
+		}
+	}
+}
+
+func TestManager_CloseFlushesPendingBatches(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+
+	results := make(chan WriteResult, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			results <- m.Enqueue(context.Background(), "test:close",
+				"INSERT INTO test_writes (data) VALUES (?)", []interface{}{fmt.Sprintf("pending-%d", i)}, 60000, nil)
+		}(i)
+	}
+	for m.Pending() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The batch window is a minute away, Close must not wait for it nor fail the writes
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if result := <-results; result.Error != nil {
+			t.Errorf("Expected the pending write to succeed, got %v", result.Error)
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE data LIKE 'pending-%'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || m.BatchCount() != 1 {
+		t.Errorf("Expected 3 rows in 1 batch, got %d rows in %d batches", count, m.BatchCount())
+	}
+	if clock.Pending() != 0 {
+		t.Errorf("Expected the batch timer to be stopped, got %d timers", clock.Pending())
+	}
+}
+
 func TestManager_ErrorHandling(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -840,3 +1447,40 @@ func TestParseInsertStatement(t *testing.T) {
 		})
 	}
 }
+
+func TestPostgreSQL_UpsertConflictInBatch(t *testing.T) {
+	db := setupPostgresDB(t)
+	if db == nil {
+		return
+	}
+	defer db.Close()
+
+	m := New(db, DefaultConfig())
+	defer m.Close()
+
+	// PostgreSQL rejects a multi-row upsert that updates a row twice, so the
+	// upserts run one by one
+	const query = "INSERT INTO test_writes (id, data) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data"
+	results := make(chan WriteResult, 2)
+	for _, data := range []string{"first", "second"} {
+		go func() {
+			results <- m.Enqueue(context.Background(), "test:upsert", query, []interface{}{1000, data}, 100, nil)
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		result := <-results
+		if result.Error != nil {
+			t.Fatalf("Upsert failed: %v", result.Error)
+		}
+		if result.AffectedRows != 1 {
+			t.Errorf("Expected 1 affected row, got %d", result.AffectedRows)
+		}
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_writes WHERE id = 1000").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 row, got %d", count)
+	}
+}
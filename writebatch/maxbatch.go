@@ -0,0 +1,21 @@
+package writebatch
+
+import "context"
+
+type maxBatchSizeKey struct{}
+
+// WithMaxBatchSize returns a context that makes Enqueue run the write in a
+// batch of at most n writes, instead of Config.MaxBatchSize, e.g. for the
+// writes of a server-side batch rule. Writes with the same batch key should
+// use the same maximum. A maximum of 0 or less keeps Config.MaxBatchSize.
+func WithMaxBatchSize(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, maxBatchSizeKey{}, n)
+}
+
+// maxBatchSizeFrom returns the maximum set with WithMaxBatchSize, or def
+func maxBatchSizeFrom(ctx context.Context, def int) int {
+	if n, _ := ctx.Value(maxBatchSizeKey{}).(int); n > 0 {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,49 @@
+package writebatch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestManager_MaxBatchSizeFromContext(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	cfg := DefaultConfig()
+	cfg.Clock = NewFakeClock(time.Now())
+	m := New(db, cfg)
+	defer m.Close()
+
+	// The maximum of the context fills the batch, without advancing the clock
+	ctx := WithMaxBatchSize(context.Background(), 3)
+	results := make(chan WriteResult, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			results <- m.Enqueue(ctx, "test:maxbatch",
+				"INSERT INTO test_writes (data) VALUES (?)", []interface{}{fmt.Sprintf("maxbatch-%d", i)}, 60000, nil)
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		if result := <-results; result.Error != nil || result.BatchSize != 3 {
+			t.Errorf("Expected a batch of 3, got %d (%v)", result.BatchSize, result.Error)
+		}
+	}
+}
+
+func TestMaxBatchSizeFrom(t *testing.T) {
+	tests := []struct {
+		ctx      context.Context
+		expected int
+	}{
+		{context.Background(), 1000},
+		{WithMaxBatchSize(context.Background(), 50), 50},
+		{WithMaxBatchSize(context.Background(), 0), 1000},
+	}
+	for _, tt := range tests {
+		if got := maxBatchSizeFrom(tt.ctx, 1000); got != tt.expected {
+			t.Errorf("maxBatchSizeFrom() = %d, want %d", got, tt.expected)
+		}
+	}
+}
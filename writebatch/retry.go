@@ -0,0 +1,157 @@
+package writebatch
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// RetryPolicy configures the retries of batches that fail on a transient
+// backend error, such as a deadlock
+type RetryPolicy struct {
+	MaxRetries int           // Retries of a failed batch before its error is delivered (0 = no retries)
+	Backoff    time.Duration // Wait before the first retry, doubled on every next retry
+	MaxBackoff time.Duration // Maximum wait before a retry (0 = no maximum)
+}
+
+// DefaultRetryPolicy returns the default retry policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxRetries: 3, Backoff: 10 * time.Millisecond, MaxBackoff: time.Second}
+}
+
+// backoff returns the wait before the given retry, counting from 1
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// retryAction is how a batch that failed on a transient error is retried
+type retryAction int
+
+const (
+	retryNone  retryAction = iota // Not transient, the error is delivered
+	retryBatch                    // Retry the failed writes as one batch
+	retrySplit                    // Retry the failed writes as two batches, holding fewer locks each
+)
+
+// transientErrors maps the codes of transient backend errors to their retry
+var transientErrors = map[string]retryAction{
+	"1213":  retryBatch, // MySQL: deadlock found when trying to get lock
+	"1205":  retrySplit, // MySQL: lock wait timeout exceeded
+	"1614":  retryBatch, // MySQL: transaction branch was rolled back, deadlock
+	"40001": retryBatch, // PostgreSQL: serialization failure
+	"40P01": retryBatch, // PostgreSQL: deadlock detected
+	"55P03": retrySplit, // PostgreSQL: lock not available
+}
+
+// errorCode returns the MySQL error number or PostgreSQL SQLSTATE of err
+func errorCode(err error) string {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return strconv.Itoa(int(mysqlErr.Number))
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	return ""
+}
+
+// retryActionOf returns how a write that failed with err is retried
+var retryActionOf = func(err error) retryAction {
+	return transientErrors[errorCode(err)]
+}
+
+// executeWithRetry executes the requests of a batch of key and calls done
+// once their results are final. With retries configured, results are held
+// until they are final: the requests that failed on a transient error are
+// executed again after a backoff, as a batch of their own or split in two,
+// until they succeed or run out of retries. The backoff is waited for on the
+// clock of the manager, not on the shard worker, which executes other batches
+// in the meantime.
+func (m *Manager) executeWithRetry(key string, requests []*WriteRequest, done func()) {
+	policy := m.currentConfig().Retry
+	if policy.MaxRetries <= 0 {
+		m.execute(requests)
+		done()
+		return
+	}
+	m.attempt(key, policy, [][]*WriteRequest{requests}, 0, done)
+}
+
+// attempt executes the batches of a retry, counting from 0, and dispatches
+// the writes that failed on a transient error to the worker of the shard of
+// key once the backoff of the next retry passed
+func (m *Manager) attempt(key string, policy RetryPolicy, batches [][]*WriteRequest, retry int, done func()) {
+	var failed [][]*WriteRequest
+	for _, batch := range batches {
+		for _, req := range batch {
+			req.hold = true
+		}
+		m.execute(batch)
+
+		var retries []*WriteRequest
+		var retryErr error
+		action := retryNone
+		for _, req := range batch {
+			result := req.held
+			req.hold, req.held = false, WriteResult{}
+			if retry < policy.MaxRetries && result.Error != nil {
+				if a := retryActionOf(result.Error); a != retryNone {
+					retries = append(retries, req)
+					retryErr, action = result.Error, max(action, a)
+					continue
+				}
+			}
+			req.deliver(result)
+		}
+		if len(retries) == 0 {
+			continue
+		}
+		code := errorCode(retryErr)
+		if code == "" {
+			code = "unknown"
+		}
+		metrics.WriteBatchRetries.WithLabelValues(code).Inc()
+		log.Printf("[WriteBatch] Retrying %d writes after transient error %s (retry %d of %d)", len(retries), code, retry+1, policy.MaxRetries)
+		if action == retrySplit && len(retries) > 1 {
+			half := len(retries) / 2
+			failed = append(failed, retries[:half], retries[half:])
+		} else {
+			failed = append(failed, retries)
+		}
+	}
+	if len(failed) == 0 {
+		done()
+		return
+	}
+
+	// The pending retry counts as executing, so that Close waits for it
+	m.inflight.Add(1)
+	m.clock.AfterFunc(policy.backoff(retry+1), func() {
+		defer m.inflight.Done()
+		m.dispatch(m.shardFor(key), batchJob{key: key, retry: func() {
+			m.attempt(key, policy, failed, retry+1, done)
+		}})
+	})
+}
+
+// execute executes the requests of a batch once
+func (m *Manager) execute(requests []*WriteRequest) {
+	if len(requests) == 1 {
+		m.executeSingle(requests[0])
+	} else {
+		m.executeBatchedWrites(requests)
+	}
+}
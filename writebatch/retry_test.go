@@ -0,0 +1,177 @@
+package writebatch
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for retry, want := range map[int]time.Duration{1: 10, 2: 20, 3: 40, 4: 50, 10: 50} {
+		if got := p.backoff(retry); got != want*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", retry, got, want*time.Millisecond)
+		}
+	}
+}
+
+func TestRetryActionOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want retryAction
+	}{
+		{&mysql.MySQLError{Number: 1213}, retryBatch},
+		{&mysql.MySQLError{Number: 1205}, retrySplit},
+		{&mysql.MySQLError{Number: 1062}, retryNone},
+		{&pq.Error{Code: "40P01"}, retryBatch},
+		{&pq.Error{Code: "23505"}, retryNone},
+		{sql.ErrNoRows, retryNone},
+	}
+	for _, tt := range tests {
+		if got := retryActionOf(tt.err); got != tt.want {
+			t.Errorf("retryActionOf(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// failInserts makes the next n insert statements into test_writes fail with
+// a transient error, which is retried with the given action
+func failInserts(t *testing.T, db *sql.DB, n int, action retryAction) {
+	// RAISE(FAIL) keeps the count down of the failed statement
+	_, err := db.Exec(`CREATE TABLE fail_left (n INTEGER);
+		CREATE TRIGGER fail_insert BEFORE INSERT ON test_writes
+		WHEN (SELECT n FROM fail_left) > 0
+		BEGIN UPDATE fail_left SET n = n - 1; SELECT RAISE(FAIL, 'transient'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("INSERT INTO fail_left VALUES (?)", n)
+	orig := retryActionOf
+	retryActionOf = func(err error) retryAction {
+		if strings.Contains(err.Error(), "transient") {
+			return action
+		}
+		return retryNone
+	}
+	t.Cleanup(func() { retryActionOf = orig })
+}
+
+// enqueueAll enqueues n inserts in one batch and returns their results
+func enqueueAll(m *Manager, n int) []WriteResult {
+	results := make([]WriteResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = m.Enqueue(context.Background(), "test:retry",
+				"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"retry"}, 20, nil)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func TestManager_RetryTransientError(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	failInserts(t, db, 2, retryBatch)
+
+	cfg := DefaultConfig()
+	cfg.Retry.Backoff = time.Millisecond
+	m := New(db, cfg)
+	defer m.Close()
+
+	for i, result := range enqueueAll(m, 4) {
+		if result.Error != nil {
+			t.Errorf("Write %d failed: %v", i, result.Error)
+		}
+	}
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM test_writes").Scan(&count)
+	if count != 4 {
+		t.Errorf("Expected 4 rows after the retries, got %d", count)
+	}
+}
+
+func TestManager_RetryBackoffOnClock(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	failInserts(t, db, 1, retryBatch)
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.Retry = RetryPolicy{MaxRetries: 1, Backoff: time.Second}
+	m := New(db, cfg)
+	defer m.Close()
+
+	done := make(chan WriteResult, 1)
+	go func() {
+		done <- m.Enqueue(context.Background(), "test:retry",
+			"INSERT INTO test_writes (data) VALUES (?)", []interface{}{"retry"}, 20, nil)
+	}()
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The failed write waits for the backoff on the clock, not on the worker
+	clock.Advance(20 * time.Millisecond)
+	if clock.Pending() != 1 {
+		t.Fatalf("Expected the retry to wait on the clock, got %d timers", clock.Pending())
+	}
+	select {
+	case result := <-done:
+		t.Fatalf("Expected the result to wait for the retry, got %+v", result)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if result := <-done; result.Error != nil {
+		t.Errorf("Expected the retry to succeed, got %v", result.Error)
+	}
+}
+
+func TestManager_RetrySplit(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	failInserts(t, db, 1, retrySplit)
+
+	cfg := DefaultConfig()
+	cfg.Retry.Backoff = time.Millisecond
+	m := New(db, cfg)
+	defer m.Close()
+
+	for i, result := range enqueueAll(m, 4) {
+		if result.Error != nil || result.BatchSize != 2 {
+			t.Errorf("Expected write %d to succeed in a batch of 2, got %d (%v)", i, result.BatchSize, result.Error)
+		}
+	}
+}
+
+func TestManager_RetryExhausted(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	failInserts(t, db, 10, retryBatch)
+
+	cfg := DefaultConfig()
+	cfg.Retry = RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}
+	m := New(db, cfg)
+	defer m.Close()
+
+	for i, result := range enqueueAll(m, 3) {
+		if result.Error == nil || !strings.Contains(result.Error.Error(), "transient") {
+			t.Errorf("Expected write %d to fail after the retries, got %v", i, result.Error)
+		}
+	}
+	var left int
+	db.QueryRow("SELECT n FROM fail_left").Scan(&left)
+	if left != 7 {
+		t.Errorf("Expected 3 attempts, got %d", 10-left)
+	}
+}
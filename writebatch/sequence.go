@@ -0,0 +1,51 @@
+package writebatch
+
+import (
+	"context"
+	"sync"
+)
+
+// Sequence orders the batched writes of one session. A write enqueued with
+// EnqueueOrdered joins its batch only after the previous write of the same
+// Sequence completed, so writes with different batch keys (and windows) are
+// committed in submission order. The zero value is ready to use.
+type Sequence struct {
+	mu   sync.Mutex
+	last chan struct{} // Closed when the last submitted write completed
+}
+
+// EnqueueOrdered is Enqueue, but waits for the previous write enqueued with
+// seq to complete first. A nil seq does not order writes.
+func (m *Manager) EnqueueOrdered(ctx context.Context, seq *Sequence, batchKey, query string, params []interface{}, batchMs int, onBatchComplete func(int)) WriteResult {
+	ctx, stop := m.withRequestTimeout(ctx)
+	defer stop()
+	return m.enqueueOrdered(ctx, nil, seq, batchKey, query, params, batchMs, onBatchComplete)
+}
+
+// enqueueOrdered is EnqueueOrdered, tracking batched writes in fence
+func (m *Manager) enqueueOrdered(ctx context.Context, fence *Fence, seq *Sequence, batchKey, query string, params []interface{}, batchMs int, onBatchComplete func(int)) WriteResult {
+	if seq == nil {
+		return m.enqueue(ctx, fence, batchKey, query, params, batchMs, onBatchComplete)
+	}
+
+	done := make(chan struct{})
+	seq.mu.Lock()
+	prev := seq.last
+	seq.last = done
+	seq.mu.Unlock()
+
+	if prev != nil {
+		select {
+		case <-prev:
+		case <-ctx.Done():
+			// Later writes must still wait for the earlier ones
+			go func() {
+				<-prev
+				close(done)
+			}()
+			return WriteResult{Error: ctxError(ctx)}
+		}
+	}
+	defer close(done)
+	return m.enqueue(ctx, fence, batchKey, query, params, batchMs, onBatchComplete)
+}
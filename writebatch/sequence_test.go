@@ -0,0 +1,95 @@
+package writebatch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManager_EnqueueOrdered(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	m := New(db, cfg)
+	defer m.Close()
+
+	var seq Sequence
+	results := make(chan WriteResult, 2)
+	enqueue := func(data string, batchMs int) {
+		results <- m.EnqueueOrdered(context.Background(), &seq, "order:"+data,
+			"INSERT INTO test_writes (data) VALUES ('"+data+"')", nil, batchMs, nil)
+	}
+
+	// A long window first, then a short window from the same session
+	go enqueue("first", 1000)
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go enqueue("second", 10)
+
+	// The second write must not overtake the first
+	time.Sleep(10 * time.Millisecond)
+	clock.Advance(10 * time.Millisecond)
+	if m.BatchCount() != 0 {
+		t.Fatalf("Second write executed before the first (%d batches)", m.BatchCount())
+	}
+
+	clock.Advance(990 * time.Millisecond)
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(10 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if result := <-results; result.Error != nil {
+			t.Fatalf("Unexpected error: %v", result.Error)
+		}
+	}
+
+	rows, err := db.Query("SELECT data FROM test_writes ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var order []string
+	for rows.Next() {
+		var data string
+		rows.Scan(&data)
+		order = append(order, data)
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("Expected writes in submission order, got %v", order)
+	}
+}
+
+func TestManager_EnqueueOrderedCancel(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	m := New(db, DefaultConfig())
+	defer m.Close()
+
+	// A cancelled write does not release its successor before its predecessor
+	var seq Sequence
+	first := make(chan struct{})
+	seq.last = first
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := m.EnqueueOrdered(ctx, &seq, "k", "INSERT INTO test_writes (data) VALUES ('x')", nil, 0, nil); result.Error != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", result.Error)
+	}
+
+	select {
+	case <-seq.last:
+		t.Fatal("Cancelled write completed before its predecessor")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(first)
+	select {
+	case <-seq.last:
+	case <-time.After(time.Second):
+		t.Fatal("Cancelled write did not complete after its predecessor")
+	}
+}
@@ -0,0 +1,242 @@
+package writebatch
+
+import (
+	"hash/fnv"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// DefaultQueueSize is the default maximum of writes per batch key in open or
+// executing batches
+const DefaultQueueSize = 10000
+
+// DefaultWorkers returns the default number of shard workers
+func DefaultWorkers() int {
+	return 4 * runtime.GOMAXPROCS(0)
+}
+
+// shard holds the open batch groups of part of the batch keys. The windows
+// of its groups share one timer, and its full and expired batches execute
+// one at a time on the worker of the shard.
+type shard struct {
+	mu       sync.Mutex
+	groups   map[string]*BatchGroup // Open batches by group key
+	queued   map[string]int         // Writes in open or executing batches by group key, see Config.QueueSize
+	timer    Timer                  // Fires at deadline, the end of the earliest window
+	deadline time.Time
+	work     chan batchJob // Batches for the worker
+}
+
+// batchJob is a batch for a shard worker
+type batchJob struct {
+	key   string
+	group *BatchGroup
+	done  chan struct{} // Closed once executed, nil when nobody waits
+	retry func()        // Retry of failed writes instead of a batch group, see executeWithRetry
+}
+
+// shardWorkQueue is the number of batches that may wait for a shard worker
+const shardWorkQueue = 64
+
+// startShards creates n shards and starts their workers
+func (m *Manager) startShards(n int) {
+	m.shards = make([]*shard, max(1, n))
+	for i := range m.shards {
+		sh := &shard{
+			groups: make(map[string]*BatchGroup),
+			queued: make(map[string]int),
+			work:   make(chan batchJob, shardWorkQueue),
+		}
+		m.shards[i] = sh
+		m.workers.Add(1)
+		go m.work(sh)
+	}
+}
+
+// work executes the batches of a shard until the shards are stopped
+func (m *Manager) work(sh *shard) {
+	defer m.workers.Done()
+	for job := range sh.work {
+		m.runJob(job)
+	}
+}
+
+// runJob executes a dispatched batch
+func (m *Manager) runJob(job batchJob) {
+	defer m.inflight.Done()
+	if job.retry != nil {
+		job.retry()
+	} else {
+		m.executeBatch(job.key, job.group)
+	}
+	if job.done != nil {
+		close(job.done)
+	}
+}
+
+// dispatch hands a batch to the worker of its shard. Once the shards are
+// stopped the batch executes on the calling goroutine.
+func (m *Manager) dispatch(sh *shard, job batchJob) {
+	m.workMu.RLock()
+	defer m.workMu.RUnlock()
+	m.inflight.Add(1)
+	if m.workStopped {
+		m.runJob(job)
+		return
+	}
+	sh.work <- job
+}
+
+// stopShards stops the shard workers once they executed their batches
+func (m *Manager) stopShards() {
+	m.workMu.Lock()
+	if !m.workStopped {
+		m.workStopped = true
+		for _, sh := range m.shards {
+			close(sh.work)
+		}
+	}
+	m.workMu.Unlock()
+	m.workers.Wait()
+}
+
+// shardFor returns the shard of a group key
+func (m *Manager) shardFor(key string) *shard {
+	if len(m.shards) == 1 {
+		return m.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
+
+// schedule makes the timer of the shard fire at deadline, unless it fires
+// earlier already. sh.mu is held.
+func (m *Manager) schedule(sh *shard, deadline time.Time) {
+	if sh.timer != nil {
+		if !deadline.Before(sh.deadline) {
+			return
+		}
+		sh.timer.Stop()
+	}
+	sh.deadline = deadline
+	sh.timer = m.clock.AfterFunc(deadline.Sub(m.clock.Now()), func() {
+		m.expire(sh)
+	})
+}
+
+// expire executes the batches of the shard whose window ended, in order of
+// their deadline, and returns when they completed
+func (m *Manager) expire(sh *shard) {
+	now := m.clock.Now()
+	var jobs []batchJob
+	var next time.Time
+	sh.mu.Lock()
+	sh.timer = nil
+	for key, group := range sh.groups {
+		if !group.deadline.After(now) {
+			sh.remove(key)
+			jobs = append(jobs, batchJob{key: key, group: group, done: make(chan struct{})})
+		} else if next.IsZero() || group.deadline.Before(next) {
+			next = group.deadline
+		}
+	}
+	if !next.IsZero() {
+		m.schedule(sh, next)
+	}
+	sh.mu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].group.deadline.Before(jobs[j].group.deadline) })
+	for _, job := range jobs {
+		m.dispatch(sh, job)
+	}
+	for _, job := range jobs {
+		<-job.done
+	}
+}
+
+// add opens a batch group. sh.mu is held.
+func (sh *shard) add(key string, group *BatchGroup) {
+	sh.groups[key] = group
+	metrics.WriteBatchGroups.Inc()
+}
+
+// remove closes the batch group of a key. sh.mu is held.
+func (sh *shard) remove(key string) {
+	if _, ok := sh.groups[key]; ok {
+		delete(sh.groups, key)
+		metrics.WriteBatchGroups.Dec()
+	}
+}
+
+// enqueue counts a write of a group key. sh.mu is held.
+func (sh *shard) enqueue(key string) {
+	sh.queued[key]++
+	metrics.WriteBatchQueued.WithLabelValues(truncateQuery(key, 50)).Inc()
+}
+
+// dequeue removes n completed or withdrawn writes from the count of their
+// group key. sh.mu is held.
+func (sh *shard) dequeue(key string, n int) {
+	n = min(n, sh.queued[key])
+	if sh.queued[key] == n {
+		delete(sh.queued, key)
+	} else {
+		sh.queued[key] -= n
+	}
+	metrics.WriteBatchQueued.WithLabelValues(truncateQuery(key, 50)).Sub(float64(n))
+}
+
+// completed removes the writes of an executed batch from the count of their
+// group key, and releases the references of the batch
+func (m *Manager) completed(key string, requests []*WriteRequest) {
+	sh := m.shardFor(key)
+	sh.mu.Lock()
+	sh.dequeue(key, len(requests))
+	sh.mu.Unlock()
+	for _, req := range requests {
+		req.release()
+	}
+}
+
+// requestPool recycles write requests, see newRequest
+var requestPool = sync.Pool{
+	New: func() any {
+		return &WriteRequest{ResultChan: make(chan WriteResult, 1)}
+	},
+}
+
+// newRequest returns a write request from the pool. It is shared by the
+// caller and the batch, each releases it once done with it.
+func newRequest(query string, params []interface{}, enqueuedAt time.Time, onBatchComplete func(int), hasReturning bool, durability Durability, fence *Fence) *WriteRequest {
+	req := requestPool.Get().(*WriteRequest)
+	resultChan := req.ResultChan
+	select {
+	case <-resultChan: // Result of a caller that gave up
+	default:
+	}
+	*req = WriteRequest{
+		Query:           query,
+		Params:          params,
+		ResultChan:      resultChan,
+		EnqueuedAt:      enqueuedAt,
+		OnBatchComplete: onBatchComplete,
+		HasReturning:    hasReturning,
+		durability:      durability,
+		fence:           fence,
+	}
+	req.refs.Store(2)
+	return req
+}
+
+// release drops a reference to the request, recycling it after the last
+func (r *WriteRequest) release() {
+	if r.refs.Add(-1) == 0 {
+		r.Params, r.OnBatchComplete, r.fence, r.err, r.held = nil, nil, nil, nil, WriteResult{}
+		requestPool.Put(r)
+	}
+}
@@ -0,0 +1,95 @@
+package writebatch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestManager_QueueFull(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.QueueSize = 2
+	m := New(db, cfg)
+	defer m.Close()
+
+	query := "INSERT INTO test_writes (data) VALUES (?)"
+	results := make(chan WriteResult, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- m.Enqueue(context.Background(), "test:queue", query, []interface{}{"queued"}, 100, nil)
+		}()
+	}
+	for m.Pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The batch key is full, other batch keys are not
+	if result := m.Enqueue(context.Background(), "test:queue", query, []interface{}{"rejected"}, 100, nil); result.Error != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", result.Error)
+	}
+	go m.Enqueue(context.Background(), "test:other", query, []interface{}{"other"}, 100, nil)
+	for m.Pending() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if result := <-results; result.Error != nil {
+			t.Errorf("Write %d failed: %v", i, result.Error)
+		}
+	}
+
+	// Executed writes leave the queue
+	go m.Enqueue(context.Background(), "test:queue", query, []interface{}{"again"}, 100, nil)
+	for m.Pending() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(100 * time.Millisecond)
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM test_writes").Scan(&count)
+	if count != 4 {
+		t.Errorf("Expected 4 writes, got %d", count)
+	}
+}
+
+func TestManager_ShardTimer(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.Workers = 1
+	m := New(db, cfg)
+	defer m.Close()
+
+	// The windows of all batch keys of a shard share one timer
+	results := make(chan WriteResult, 3)
+	for i, ms := range []int{30, 10, 20} {
+		key := fmt.Sprintf("test:shard%d", i)
+		go func() {
+			results <- m.Enqueue(context.Background(), key, "INSERT INTO test_writes (data) VALUES (?)", []interface{}{key}, ms, nil)
+		}()
+		for m.Pending() < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if clock.Pending() != 1 {
+		t.Errorf("Expected 1 timer, got %d", clock.Pending())
+	}
+
+	// Each batch executes when its own window ended
+	for i := 1; i <= 3; i++ {
+		clock.Advance(10 * time.Millisecond)
+		if m.BatchCount() != int64(i) || m.Pending() != 3-i {
+			t.Errorf("After %d ms: expected %d batches and %d pending, got %d and %d", i*10, i, 3-i, m.BatchCount(), m.Pending())
+		}
+		<-results
+	}
+}
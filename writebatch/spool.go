@@ -0,0 +1,505 @@
+package writebatch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mevdschee/tqdbproxy/logging"
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// spoolReplayInterval is the time between attempts to replay spooled writes
+const spoolReplayInterval = time.Second
+
+// Spool is a write-ahead spool of batched writes on disk, so that writes
+// survive a short outage of the backend and a restart of the proxy. Each
+// batch key has an append-only file of JSON lines in the spool directory: a
+// line per spooled write, and a line per write that completed. Pending writes
+// are replayed in the order of their file, see Config.Spool.
+//
+// A write may be replayed more than once when the proxy stops between
+// executing it and recording its completion.
+type Spool struct {
+	dir      string
+	maxBytes int64 // Size limit of all files (0 = unlimited)
+	mu       sync.Mutex
+	files    map[string]*spoolFile // Batch key file name -> file
+	size     int64                 // Bytes in all files
+	replayMu sync.Mutex            // Serializes replays
+}
+
+// spoolFile is the file of a batch key
+type spoolFile struct {
+	path    string
+	f       *os.File
+	size    int64
+	next    uint64        // ID of the next write
+	pending []*spoolEntry // Writes that did not complete, in order
+}
+
+// spoolEntry is a pending write of a spool file
+type spoolEntry struct {
+	id     uint64
+	query  string
+	params []interface{}
+	live   bool // Still executed by a batch, not to be replayed
+}
+
+// spoolRecord is a line of a spool file
+type spoolRecord struct {
+	ID     uint64       `json:"id"`
+	Query  string       `json:"query,omitempty"`
+	Params []spoolParam `json:"params,omitempty"`
+	Done   bool         `json:"done,omitempty"`
+}
+
+// spoolParam is a parameter of a spooled write, with its type, so that it
+// reads back as the value it was
+type spoolParam struct {
+	Type  string `json:"t"`
+	Value string `json:"v,omitempty"`
+}
+
+// OpenSpool opens the spool in dir, creating the directory when needed, and
+// reads the writes that were pending when the proxy stopped. Beyond maxBytes
+// (0 = unlimited) writes are not spooled.
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, files: make(map[string]*spoolFile)}
+	for _, path := range paths {
+		sf, err := openSpoolFile(path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files[filepath.Base(path)] = sf
+		s.size += sf.size
+	}
+	s.updateMetrics()
+	return s, nil
+}
+
+// openSpoolFile opens a spool file and reads its pending writes. A line that
+// was cut short by a crash ends the file.
+func openSpoolFile(path string) (*spoolFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sf := &spoolFile{path: path, f: f, next: 1}
+	byID := make(map[uint64]*spoolEntry)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		var record spoolRecord
+		if err != nil || json.Unmarshal(line, &record) != nil {
+			break
+		}
+		sf.size += int64(len(line))
+		sf.next = max(sf.next, record.ID+1)
+		if record.Done {
+			if entry := byID[record.ID]; entry != nil {
+				delete(byID, record.ID)
+				entry.id = 0
+			}
+			continue
+		}
+		params, err := decodeSpoolParams(record.Params)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		entry := &spoolEntry{id: record.ID, query: record.Query, params: params}
+		byID[record.ID] = entry
+		sf.pending = append(sf.pending, entry)
+	}
+	// Drop the completed writes, and what follows the last complete line
+	sf.pending = compactEntries(sf.pending)
+	if len(sf.pending) == 0 {
+		sf.size = 0
+	}
+	if err := f.Truncate(sf.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(sf.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+// compactEntries removes the completed entries, which have ID 0
+func compactEntries(entries []*spoolEntry) []*spoolEntry {
+	pending := entries[:0]
+	for _, entry := range entries {
+		if entry.id != 0 {
+			pending = append(pending, entry)
+		}
+	}
+	return pending
+}
+
+// spoolFileName returns the name of the file of a batch key
+func spoolFileName(batchKey string) string {
+	sum := sha256.Sum256([]byte(batchKey))
+	return hex.EncodeToString(sum[:12]) + ".wal"
+}
+
+// append writes a write to the file of its batch key and syncs it to disk.
+// A live write is executed by a batch and only replayed once released.
+func (s *Spool) append(batchKey, query string, params []interface{}, live bool) (uint64, error) {
+	encoded, err := encodeSpoolParams(params)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := spoolFileName(batchKey)
+	sf := s.files[name]
+	if sf == nil {
+		sf, err = openSpoolFile(filepath.Join(s.dir, name))
+		if err != nil {
+			return 0, err
+		}
+		s.files[name] = sf
+	}
+	id := sf.next
+	line, err := json.Marshal(spoolRecord{ID: id, Query: query, Params: encoded})
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	if s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		metrics.WriteSpool.WithLabelValues("rejected").Inc()
+		return 0, ErrSpoolFull
+	}
+	if err := s.write(sf, line); err != nil {
+		return 0, err
+	}
+	if err := sf.f.Sync(); err != nil {
+		return 0, err
+	}
+	sf.next++
+	sf.pending = append(sf.pending, &spoolEntry{id: id, query: query, params: params, live: live})
+	metrics.WriteSpool.WithLabelValues("spooled").Inc()
+	s.updateMetrics()
+	return id, nil
+}
+
+// write appends a line to a file
+func (s *Spool) write(sf *spoolFile, line []byte) error {
+	n, err := sf.f.Write(line)
+	sf.size += int64(n)
+	s.size += int64(n)
+	return err
+}
+
+// done records that a write completed. The file is emptied once no write is
+// pending.
+func (s *Spool) done(batchKey string, id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sf := s.files[spoolFileName(batchKey)]
+	if sf == nil {
+		return
+	}
+	s.complete(sf, id)
+	s.updateMetrics()
+}
+
+// complete removes a pending write of a file and records its completion
+func (s *Spool) complete(sf *spoolFile, id uint64) {
+	found := false
+	for _, entry := range sf.pending {
+		if entry.id == id {
+			entry.id = 0
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+	sf.pending = compactEntries(sf.pending)
+	if len(sf.pending) == 0 {
+		if err := sf.f.Truncate(0); err == nil {
+			if _, err := sf.f.Seek(0, io.SeekStart); err == nil {
+				s.size -= sf.size
+				sf.size = 0
+				return
+			}
+		}
+	}
+	line, _ := json.Marshal(spoolRecord{ID: id, Done: true})
+	if err := s.write(sf, append(line, '\n')); err != nil {
+		log.Printf("[WriteBatch] Spool write failed: %v", err)
+	}
+}
+
+// release makes a live write replayable, after its batch failed to reach the
+// backend
+func (s *Spool) release(batchKey string, id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sf := s.files[spoolFileName(batchKey)]; sf != nil {
+		for _, entry := range sf.pending {
+			if entry.id == id {
+				entry.live = false
+			}
+		}
+	}
+}
+
+// replay executes the replayable writes in the order of their files, until
+// the backend is unavailable. A write that fails for another reason is
+// dropped, as replaying it again would fail as well. It returns the number
+// of replayed writes.
+func (s *Spool) replay(exec func(query string, params []interface{}) error) int {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+	s.mu.Lock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+
+	replayed := 0
+	for _, name := range names {
+		for {
+			// The first pending write of the file, unless a batch executes it
+			s.mu.Lock()
+			sf := s.files[name]
+			if sf == nil || len(sf.pending) == 0 || sf.pending[0].live {
+				s.mu.Unlock()
+				break
+			}
+			entry := *sf.pending[0]
+			s.mu.Unlock()
+
+			err := exec(entry.query, entry.params)
+			if err != nil && isUnavailable(err) {
+				return replayed
+			}
+			s.mu.Lock()
+			s.complete(sf, entry.id)
+			s.updateMetrics()
+			s.mu.Unlock()
+			if err != nil {
+				metrics.WriteSpool.WithLabelValues("dropped").Inc()
+				log.Printf("[WriteBatch] Spooled write dropped: %v", err)
+				continue
+			}
+			metrics.WriteSpool.WithLabelValues("replayed").Inc()
+			replayed++
+		}
+	}
+	return replayed
+}
+
+// backlogged reports whether a batch key has writes waiting for a replay, so
+// that its new writes are spooled behind them to keep their order
+func (s *Spool) backlogged(batchKey string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sf := s.files[spoolFileName(batchKey)]; sf != nil {
+		for _, entry := range sf.pending {
+			if !entry.live {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pending returns the number of spooled writes that did not complete yet
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, sf := range s.files {
+		pending += len(sf.pending)
+	}
+	return pending
+}
+
+// Size returns the number of bytes in the spool files
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// updateMetrics sets the spool gauges, s.mu is held
+func (s *Spool) updateMetrics() {
+	pending := 0
+	for _, sf := range s.files {
+		pending += len(sf.pending)
+	}
+	metrics.WriteSpoolPending.Set(float64(pending))
+	metrics.WriteSpoolBytes.Set(float64(s.size))
+}
+
+// Close closes the spool files, the pending writes are replayed when the
+// spool is opened again
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for name, sf := range s.files {
+		if err := sf.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, name)
+	}
+	return firstErr
+}
+
+// encodeSpoolParams encodes the parameters of a write with their types
+func encodeSpoolParams(params []interface{}) ([]spoolParam, error) {
+	encoded := make([]spoolParam, len(params))
+	for i, param := range params {
+		switch v := param.(type) {
+		case nil:
+			encoded[i] = spoolParam{Type: "null"}
+		case int64:
+			encoded[i] = spoolParam{Type: "int", Value: strconv.FormatInt(v, 10)}
+		case int:
+			encoded[i] = spoolParam{Type: "int", Value: strconv.Itoa(v)}
+		case uint64:
+			encoded[i] = spoolParam{Type: "uint", Value: strconv.FormatUint(v, 10)}
+		case float64:
+			encoded[i] = spoolParam{Type: "float", Value: strconv.FormatFloat(v, 'g', -1, 64)}
+		case bool:
+			encoded[i] = spoolParam{Type: "bool", Value: strconv.FormatBool(v)}
+		case string:
+			encoded[i] = spoolParam{Type: "string", Value: v}
+		case []byte:
+			encoded[i] = spoolParam{Type: "bytes", Value: base64.StdEncoding.EncodeToString(v)}
+		case time.Time:
+			encoded[i] = spoolParam{Type: "time", Value: v.Format(time.RFC3339Nano)}
+		default:
+			return nil, fmt.Errorf("cannot spool parameter of type %T", param)
+		}
+	}
+	return encoded, nil
+}
+
+// decodeSpoolParams decodes the parameters of a spooled write
+func decodeSpoolParams(encoded []spoolParam) ([]interface{}, error) {
+	params := make([]interface{}, len(encoded))
+	for i, p := range encoded {
+		var err error
+		switch p.Type {
+		case "null":
+		case "int":
+			params[i], err = strconv.ParseInt(p.Value, 10, 64)
+		case "uint":
+			params[i], err = strconv.ParseUint(p.Value, 10, 64)
+		case "float":
+			params[i], err = strconv.ParseFloat(p.Value, 64)
+		case "bool":
+			params[i], err = strconv.ParseBool(p.Value)
+		case "string":
+			params[i] = p.Value
+		case "bytes":
+			params[i], err = base64.StdEncoding.DecodeString(p.Value)
+		case "time":
+			params[i], err = time.Parse(time.RFC3339Nano, p.Value)
+		default:
+			err = fmt.Errorf("unknown parameter type %q", p.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// isUnavailable reports whether a write failed because the backend could not
+// be reached, as opposed to an error of the write itself
+func isUnavailable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Connection exceptions and server shutdown
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" || pqErr.Code == "57P03"
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) ||
+		strings.Contains(err.Error(), "connection refused")
+}
+
+type spooledKey struct{}
+
+// withSpooled returns a context that marks a write as spooled already
+func withSpooled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, spooledKey{}, true)
+}
+
+// spoolable reports whether a write may be spooled: a spool is configured,
+// the write is not spooled yet and nobody waits for rows it returns
+func (m *Manager) spoolable(ctx context.Context, hasReturning bool) bool {
+	spooled, _ := ctx.Value(spooledKey{}).(bool)
+	return m.spool != nil && !spooled && !hasReturning
+}
+
+// spoolWrite spools a write for a replay, returning a spooled result, or
+// the error of the write when it cannot be spooled
+func (m *Manager) spoolWrite(batchKey, query string, params []interface{}, cause error) WriteResult {
+	if _, err := m.spool.append(batchKey, query, params, false); err != nil {
+		log.Printf("[WriteBatch] Spool append failed: %v (query: %s)", err, logging.QueryText(query))
+		if cause == nil {
+			cause = err
+		}
+		return WriteResult{Error: cause}
+	}
+	return WriteResult{Spooled: true}
+}
+
+// replayLoop replays the spooled writes until Close
+func (m *Manager) replayLoop() {
+	defer m.replayDone.Done()
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.replayStop:
+			return
+		case <-ticker.C:
+			replayed := m.spool.replay(func(query string, params []interface{}) error {
+				_, err := m.db.Exec(query, params...)
+				return err
+			})
+			if replayed > 0 {
+				log.Printf("[WriteBatch] Replayed %d spooled writes, %d pending", replayed, m.spool.Pending())
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package writebatch
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpool_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	params := []interface{}{int64(-7), uint64(7), 1.5, true, "text", []byte{0, 1}, at, nil}
+	first, err := s.append("key", "INSERT 1", params, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.append("key", "INSERT 2", nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.append("other", "INSERT 3", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	s.done("other", 1)
+	s.Close()
+
+	// A crash may leave half a line behind
+	path := filepath.Join(dir, spoolFileName("key"))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":3,"que`)
+	f.Close()
+
+	s, err = OpenSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Pending() != 2 {
+		t.Fatalf("Expected 2 pending writes, got %d", s.Pending())
+	}
+	if info, _ := os.Stat(filepath.Join(dir, spoolFileName("other"))); info.Size() != 0 {
+		t.Errorf("Expected the completed file to be emptied, got %d bytes", info.Size())
+	}
+
+	// Writes of the previous run are replayed in order, live or not
+	var queries []string
+	replayed := s.replay(func(query string, p []interface{}) error {
+		queries = append(queries, query)
+		if query == "INSERT 1" && !reflect.DeepEqual(p, params) {
+			t.Errorf("Expected params %v, got %v", params, p)
+		}
+		return nil
+	})
+	if replayed != 2 || !reflect.DeepEqual(queries, []string{"INSERT 1", "INSERT 2"}) {
+		t.Errorf("Expected INSERT 1 and 2 to be replayed, got %d: %v", replayed, queries)
+	}
+	if s.Pending() != 0 || s.Size() != 0 {
+		t.Errorf("Expected an empty spool, got %d writes in %d bytes", s.Pending(), s.Size())
+	}
+
+	// IDs continue after the ones of the files
+	if id, _ := s.append("key", "INSERT 4", nil, false); id <= first+1 {
+		t.Errorf("Expected a new ID, got %d", id)
+	}
+}
+
+func TestSpool_Replay(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.append("key", "INSERT 1", nil, false)
+	s.append("key", "INSERT 2", nil, false)
+	live, _ := s.append("key", "INSERT 3", nil, true)
+
+	// Nothing is replayed while the backend is unavailable
+	replayed := s.replay(func(string, []interface{}) error { return driver.ErrBadConn })
+	if replayed != 0 || s.Pending() != 3 {
+		t.Errorf("Expected no replay and 3 pending writes, got %d and %d", replayed, s.Pending())
+	}
+
+	// A failing write is dropped, the live write waits for its batch
+	replayed = s.replay(func(query string, _ []interface{}) error {
+		if query == "INSERT 1" {
+			return errors.New("duplicate key")
+		}
+		return nil
+	})
+	if replayed != 1 || s.Pending() != 1 {
+		t.Errorf("Expected 1 replay and 1 pending write, got %d and %d", replayed, s.Pending())
+	}
+	s.release("key", live)
+	if replayed := s.replay(func(string, []interface{}) error { return nil }); replayed != 1 {
+		t.Errorf("Expected the released write to be replayed, got %d", replayed)
+	}
+}
+
+func TestSpool_Full(t *testing.T) {
+	s, err := OpenSpool(t.TempDir(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.append("key", "INSERT INTO t VALUES (1)", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.append("key", "INSERT INTO t VALUES (2)", nil, false); err != ErrSpoolFull {
+		t.Errorf("Expected ErrSpoolFull, got %v", err)
+	}
+	if _, err := s.append("key", "INSERT INTO t VALUES (?)", []interface{}{struct{}{}}, false); err == nil {
+		t.Error("Expected an error for an unsupported parameter")
+	}
+}
+
+func TestManager_SpoolBacklog(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	s, err := OpenSpool(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Spool = s
+	m := New(db, cfg)
+	defer m.Close()
+
+	// Writes queue behind the spooled writes of their batch key
+	query := "INSERT INTO test_writes (data) VALUES (?)"
+	s.append("test:spool", query, []interface{}{"first"}, false)
+	result := m.Enqueue(context.Background(), "test:spool", query, []interface{}{"second"}, 10, nil)
+	if result.Error != nil || !result.Spooled {
+		t.Fatalf("Expected the write to be spooled, got %+v", result)
+	}
+	var fence Fence
+	err = m.EnqueueAsync(context.Background(), &fence, nil, "test:spool", query, []interface{}{"third"}, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fence.Wait(context.Background())
+
+	// The replay loop of the manager may replay them first
+	s.replay(func(query string, params []interface{}) error {
+		_, err := db.Exec(query, params...)
+		return err
+	})
+	if s.Pending() != 0 {
+		t.Fatalf("Expected the spooled writes to be replayed, got %d pending", s.Pending())
+	}
+	var data []string
+	rows, err := db.Query("SELECT data FROM test_writes ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d string
+		rows.Scan(&d)
+		data = append(data, d)
+	}
+	if !reflect.DeepEqual(data, []string{"first", "second", "third"}) {
+		t.Errorf("Expected the writes in order, got %v", data)
+	}
+
+	// Without a backlog writes execute as usual
+	result = m.Enqueue(context.Background(), "test:spool", query, []interface{}{"fourth"}, 10, nil)
+	if result.Error != nil || result.Spooled {
+		t.Errorf("Expected the write to execute, got %+v", result)
+	}
+}
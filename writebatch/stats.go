@@ -0,0 +1,59 @@
+package writebatch
+
+import (
+	"time"
+
+	"github.com/mevdschee/tqdbproxy/metrics"
+)
+
+// Stats is a snapshot of the state of a manager, see GetStats
+type Stats struct {
+	Batches      int64          // Batches executed since the manager was created
+	Ops          int64          // Writes executed in batches since the manager was created
+	Groups       int            // Open batches
+	Pending      int            // Writes waiting in open batches
+	Queued       map[string]int // Writes in open or executing batches by batch key, see Config.QueueSize
+	Executing    int            // Executing batches
+	Rejected     int64          // Writes rejected with ErrQueueFull
+	Withdrawn    int64          // Writes withdrawn from their batch by a cancelled context
+	AsyncPending int            // Acknowledged writes that did not execute yet, see EnqueueAsync
+	AvgQueueWait time.Duration  // Average time writes waited for their batch to start
+}
+
+// GetStats returns a snapshot of the queue depth and back-pressure counters
+// of the manager
+func (m *Manager) GetStats() Stats {
+	stats := Stats{
+		Batches:      m.batchCount.Load(),
+		Ops:          m.opCount.Load(),
+		Queued:       make(map[string]int),
+		Executing:    int(m.executing.Load()),
+		Rejected:     m.rejected.Load(),
+		Withdrawn:    m.withdrawn.Load(),
+		AsyncPending: int(m.asyncPending.Load()),
+	}
+	for _, sh := range m.shards {
+		sh.mu.Lock()
+		stats.Groups += len(sh.groups)
+		for _, group := range sh.groups {
+			group.mu.Lock()
+			stats.Pending += len(group.Requests)
+			group.mu.Unlock()
+		}
+		for key, n := range sh.queued {
+			stats.Queued[key] = n
+		}
+		sh.mu.Unlock()
+	}
+	if n := m.waitCount.Load(); n > 0 {
+		stats.AvgQueueWait = time.Duration(m.waitTotal.Load() / n)
+	}
+	return stats
+}
+
+// observeWait records the time a write waited for its batch to start
+func (m *Manager) observeWait(d time.Duration) {
+	m.waitTotal.Add(int64(d))
+	m.waitCount.Add(1)
+	metrics.WriteBatchQueueWait.Observe(d.Seconds())
+}
@@ -0,0 +1,61 @@
+package writebatch
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManager_GetStats(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	clock := NewFakeClock(time.Now())
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.QueueSize = 2
+	m := New(db, cfg)
+	defer m.Close()
+
+	query := "INSERT INTO test_writes (data) VALUES (?)"
+	results := make(chan WriteResult, 3)
+	for _, key := range []string{"test:a", "test:a", "test:b"} {
+		go func() {
+			results <- m.Enqueue(context.Background(), key, query, []interface{}{key}, 100, nil)
+		}()
+	}
+	for m.Pending() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	m.Enqueue(context.Background(), "test:a", query, []interface{}{"rejected"}, 100, nil)
+
+	// A cancelled write leaves its batch
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for m.Pending() < 4 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	m.Enqueue(ctx, "test:b", query, []interface{}{"withdrawn"}, 100, nil)
+
+	stats := m.GetStats()
+	if stats.Groups != 2 || stats.Pending != 3 || stats.Queued["test:a"] != 2 || stats.Queued["test:b"] != 1 {
+		t.Errorf("Expected 2 groups with 2 and 1 queued writes, got %+v", stats)
+	}
+	if stats.Rejected != 1 || stats.Withdrawn != 1 {
+		t.Errorf("Expected 1 rejected and 1 withdrawn write, got %d and %d", stats.Rejected, stats.Withdrawn)
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		<-results
+	}
+	stats = m.GetStats()
+	if stats.Batches != 2 || stats.Ops != 3 || stats.Groups != 0 || len(stats.Queued) != 0 {
+		t.Errorf("Expected 2 executed batches and an empty queue, got %+v", stats)
+	}
+	if stats.AvgQueueWait != 100*time.Millisecond {
+		t.Errorf("Expected an average queue wait of 100ms, got %v", stats.AvgQueueWait)
+	}
+}
@@ -9,9 +9,9 @@
 // How it works:
 //  1. Parser extracts batch hint (BatchMs) from SQL comment
 //  2. Write operation is added to a batch group based on its batch key
-//  3. First operation in group starts a timer for BatchMs milliseconds
-//  4. Additional operations join the batch until timer expires or max size reached
-//  5. Batch executes and each operation receives its individual result
+//  3. First operation in group starts a window of BatchMs milliseconds
+//  4. Additional operations join the batch until the window ends or max size reached
+//  5. Batch executes on the worker of its shard and each operation receives its individual result
 //
 // Key features:
 //   - Automatic grouping by query structure
@@ -25,6 +25,7 @@ package writebatch
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,14 +37,36 @@ type WriteRequest struct {
 	EnqueuedAt      time.Time
 	OnBatchComplete func(batchSize int) // Called when batch executes to update connection state
 	HasReturning    bool                // True if query has RETURNING clause
+	durability      Durability          // Durability of the batch, see WithDurability
+	err             error               // Error of the delivered result, reported to hooks
+	fence           *Fence              // Tracks the request until it is delivered or withdrawn
+	hold            bool                // Keep the result in held instead of delivering it, see executeWithRetry
+	held            WriteResult         // Result kept while hold is set
+	refs            atomic.Int32        // References of the caller and the batch, see newRequest
+	abandoned       atomic.Bool         // The caller gave up, the batch skips the request unless it started
+}
+
+// deliver sends the result of the request to its waiting caller
+func (r *WriteRequest) deliver(result WriteResult) {
+	if r.hold {
+		r.held = result
+		return
+	}
+	r.err = result.Error
+	r.ResultChan <- result
+	r.fence.done()
 }
 
 // WriteResult contains the result of a write operation
 type WriteResult struct {
 	AffectedRows    int64
 	LastInsertID    int64
-	BatchSize       int           // Number of operations in the batch that executed this request
-	ReturningValues []interface{} // Values returned by RETURNING clause
+	BatchSize       int             // Number of operations in the batch that executed this request
+	ReturningValues []interface{}   // Values of the first row returned by RETURNING clause
+	ReturningRows   [][]interface{} // All rows returned by RETURNING clause
+	ReturningCols   []string        // Column names of the RETURNING clause
+	ReturningTypes  []string        // Database type names of the RETURNING columns, as reported by the driver
+	Spooled         bool            // The backend was unavailable, the write is spooled for a replay, see Config.Spool
 	Error           error
 }
 
@@ -53,20 +76,33 @@ type BatchGroup struct {
 	Requests  []*WriteRequest
 	FirstSeen time.Time
 	mu        sync.Mutex
-	timer     *time.Timer
+	deadline  time.Time // End of the batch window
 }
 
 // Config holds configuration for the write batch manager
 type Config struct {
-	MaxBatchSize int  // Maximum number of operations per batch (1000 default)
-	UseCopy      bool // Use COPY-style bulk loading for batch inserts: PostgreSQL COPY or MariaDB LOAD DATA LOCAL INFILE (false default)
+	MaxBatchSize     int         // Maximum number of operations per batch (1000 default)
+	UseCopy          bool        // Use COPY-style bulk loading for batch inserts: PostgreSQL COPY or MariaDB LOAD DATA LOCAL INFILE (false default)
+	ExactIDs         bool        // Execute inserts one by one in the batch transaction, so that each gets its real insert ID, instead of merging them (false default)
+	IsolateFailures  bool        // Execute the writes of a failed batch transaction one by one, so that only the failing writes get an error (false default)
+	AsyncQueueSize   int         // Maximum pending writes of EnqueueAsync (DefaultAsyncQueueSize default, 0 = unlimited)
+	QueueSize        int         // Maximum writes per batch key in open or executing batches, beyond which Enqueue returns ErrQueueFull (DefaultQueueSize default, 0 = unlimited)
+	Workers          int         // Shard workers that batch keys are spread over, each executing one batch at a time (0 = DefaultWorkers)
+	RequestTimeoutMs int         // Maximum time Enqueue waits for the result of a write before it returns ErrTimeout (0 = no limit)
+	Clock            Clock       // Time source for batch windows (nil = real time, see FakeClock for tests)
+	Retry            RetryPolicy // Retries of batches that fail on a transient backend error (zero = no retries)
+	Spool            *Spool      // Write-ahead spool for batched writes while the backend is unavailable (nil = disabled)
 }
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() Config {
 	return Config{
-		MaxBatchSize: 1000,
-		UseCopy:      false, // COPY/LOAD DATA has transaction overhead; multi-row INSERT is faster for typical batching
+		MaxBatchSize:   1000,
+		UseCopy:        false, // COPY/LOAD DATA has transaction overhead; multi-row INSERT is faster for typical batching
+		AsyncQueueSize: DefaultAsyncQueueSize,
+		QueueSize:      DefaultQueueSize,
+		Workers:        DefaultWorkers(),
+		Retry:          DefaultRetryPolicy(),
 	}
 }
 